@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/benj-n/yatogm/internal/oauth"
+)
+
+// authCmd implements the "auth" subcommand, which obtains OAuth2 grants.
+func authCmd(args []string) int {
+	if len(args) == 0 || args[0] != "login" {
+		fmt.Fprintf(os.Stderr, "Usage: yatogm auth login [flags]\n\nRun \"yatogm auth login -h\" for its flags.\n")
+		return 2
+	}
+	return authLoginCmd(args[1:])
+}
+
+// authLoginCmd obtains a refresh token for mail access from a provider,
+// with the device flow or a browser on this host, and prints it for the
+// configuration. Nothing is stored.
+func authLoginCmd(args []string) int {
+	names := make([]string, 0, len(oauth.Providers))
+	for name := range oauth.Providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fs := flag.NewFlagSet("auth login", flag.ExitOnError)
+	provider := fs.String("provider", "google", "Identity provider: "+strings.Join(names, ", "))
+	flow := fs.String("flow", "browser", "\"browser\" to approve in a browser on this host, \"device\" to approve on any device with a code")
+	clientID := fs.String("client-id", os.Getenv("YATOGM_GMAIL_OAUTH2_CLIENT_ID"), "OAuth2 client ID")
+	clientSecret := fs.String("client-secret", os.Getenv("YATOGM_GMAIL_OAUTH2_CLIENT_SECRET"), "OAuth2 client secret (prefer the YATOGM_GMAIL_OAUTH2_CLIENT_SECRET variable)")
+	timeout := fs.Duration("timeout", 10*time.Minute, "Give up if the login is not approved within this time")
+	_ = fs.Parse(args)
+
+	p, ok := oauth.Providers[*provider]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown provider %q, expected one of %s\n", *provider, strings.Join(names, ", "))
+		return 2
+	}
+	if *clientID == "" {
+		fmt.Fprintf(os.Stderr, "No client ID: pass -client-id or set YATOGM_GMAIL_OAUTH2_CLIENT_ID\n")
+		return 2
+	}
+	c := &oauth.Client{Provider: p, ClientID: *clientID, ClientSecret: *clientSecret}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	ctx, cancel := context.WithTimeout(ctx, *timeout)
+	defer cancel()
+
+	var (
+		tok *oauth.Token
+		err error
+	)
+	switch *flow {
+	case "browser":
+		tok, err = c.BrowserLogin(ctx, func(authURL string) {
+			fmt.Fprintf(os.Stderr, "Open this URL in a browser on this host and approve the access:\n\n  %s\n\nWaiting for approval...\n", authURL)
+		})
+	case "device":
+		tok, err = c.DeviceLogin(ctx, func(dc oauth.DeviceCode) {
+			fmt.Fprintf(os.Stderr, "On any device, visit %s and enter the code:\n\n  %s\n\nWaiting for approval (the code expires in %s)...\n",
+				dc.VerificationURL, dc.UserCode, dc.ExpiresIn)
+		})
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown flow %q, expected \"browser\" or \"device\"\n", *flow)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Login failed: %v\n", err)
+		return 1
+	}
+	if tok.RefreshToken == "" {
+		fmt.Fprintf(os.Stderr, "Login succeeded, but %s returned no refresh token; revoke the app's access in the account settings and try again\n", *provider)
+		return 1
+	}
+
+	fmt.Fprintf(os.Stderr, "Login succeeded. Set this refresh token as gmail.oauth2.refresh_token or YATOGM_GMAIL_OAUTH2_REFRESH_TOKEN:\n")
+	fmt.Println(tok.RefreshToken)
+	return 0
+}
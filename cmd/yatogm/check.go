@@ -0,0 +1,58 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/benj-n/yatogm/internal/worker"
+)
+
+// testCmd implements the "test" subcommand: it checks the connection and
+// credentials of every configured server, of every user in a multi-user
+// service, and prints one line per server.
+// It exits non-zero if any check failed.
+func testCmd(args []string) int {
+	fs := flag.NewFlagSet("test", flag.ExitOnError)
+	g := addGlobalFlags(fs)
+	_ = fs.Parse(args)
+
+	cfg, logger, ok := g.setup()
+	if !ok {
+		return 1
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	service := len(cfg.Users) > 0
+	if service {
+		fmt.Fprintf(tw, "USER\t")
+	}
+	fmt.Fprintf(tw, "SERVICE\tACCOUNT\tSERVER\tSTATUS\tLATENCY\tDETAIL\n")
+	failed, total := 0, 0
+	for _, t := range cfg.Tenants() {
+		// The checks do not use the state tracker, so none is opened.
+		results := worker.New(t.Settings, nil, logger).Check()
+		for _, r := range results {
+			status, detail := "OK", r.Detail
+			if r.Err != nil {
+				status, detail = "FAIL", r.Err.Error()
+				failed++
+			}
+			if service {
+				fmt.Fprintf(tw, "%s\t", t.Name)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n",
+				r.Service, r.Account, r.Addr, status, r.Latency.Round(time.Millisecond), detail)
+		}
+		total += len(results)
+	}
+	tw.Flush()
+
+	if failed > 0 {
+		fmt.Fprintf(os.Stderr, "%d of %d checks failed\n", failed, total)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/benj-n/yatogm/internal/audit"
+	"github.com/benj-n/yatogm/internal/config"
+	"github.com/benj-n/yatogm/internal/schedule"
+	"github.com/benj-n/yatogm/internal/worker"
+)
+
+// runDaemon repeats runs every cfg.Interval until SIGINT or SIGTERM, then
+// returns once the run in progress has finished. Failed runs are logged
+// and retried at the next interval rather than ending the process. On
+// SIGHUP the configuration is reloaded from configPath and used from the
+// next run on. If health_check_interval is set, credentials are also
+// checked at that interval, between runs.
+func runDaemon(configPath string, cfg *config.Config, logger *slog.Logger) int {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	var current atomic.Pointer[config.Config]
+	current.Store(cfg)
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				if next := reloadConfig(configPath, current.Load(), logger); next != nil {
+					current.Store(next)
+				}
+			}
+		}
+	}()
+
+	if cfg.HealthCheckInterval > 0 {
+		logger.Info("checking credentials every health_check_interval", "health_check_interval", cfg.HealthCheckInterval.String())
+		health := make(map[string]*worker.Health)
+		go schedule.Every(ctx, cfg.HealthCheckInterval, logger, func(context.Context) {
+			checkHealth(current.Load(), health, logger)
+		})
+	}
+
+	// No one is there to confirm deletions, so confirm_deletes does not
+	// apply.
+	logger.Info("running every interval", "interval", cfg.Interval.String())
+	schedule.Every(ctx, cfg.Interval, logger, func(context.Context) {
+		runLeader(current.Load(), logger, true, false)
+	})
+	logger.Info("yatogm stopped")
+	return 0
+}
+
+// reloadConfig loads the configuration at path to replace cur, or returns
+// nil if it is invalid, in which case cur stays in effect. Settings that
+// only take effect on a restart, such as the state file and the schedule,
+// are carried over from cur so that the state is never switched mid-way.
+func reloadConfig(path string, cur *config.Config, logger *slog.Logger) *config.Config {
+	next, err := config.Load(path)
+	if err != nil {
+		logger.Error("reloading configuration failed, keeping the current one", "error", err)
+		auditReload(cur.AuditLog, path, err, logger)
+		return nil
+	}
+
+	if next.StatePath != cur.StatePath || next.StateSharded != cur.StateSharded {
+		logger.Warn("state_path or state_sharded changed, restart to apply", "state_path", cur.StatePath)
+		next.StatePath, next.StateSharded = cur.StatePath, cur.StateSharded
+	}
+	if next.StateBackend != cur.StateBackend || next.Redis != cur.Redis || next.Postgres != cur.Postgres {
+		logger.Warn("state_backend, redis or postgres changed, restart to apply", "state", cur.StateLocation())
+		next.StateBackend, next.Redis, next.Postgres = cur.StateBackend, cur.Redis, cur.Postgres
+	}
+	for i, u := range next.Users {
+		for _, c := range cur.Users {
+			if c.Name == u.Name && (c.Settings.StatePath != u.Settings.StatePath || c.Settings.StateSharded != u.Settings.StateSharded) {
+				logger.Warn("state_path or state_sharded changed, restart to apply", "user", u.Name, "state_path", c.Settings.StatePath)
+				next.Users[i].Settings.StatePath = c.Settings.StatePath
+				next.Users[i].Settings.StateSharded = c.Settings.StateSharded
+			}
+			if c.Name == u.Name && (c.Settings.StateBackend != u.Settings.StateBackend || c.Settings.Redis != u.Settings.Redis || c.Settings.Postgres != u.Settings.Postgres) {
+				logger.Warn("state_backend, redis or postgres changed, restart to apply", "user", u.Name, "state", c.Settings.StateLocation())
+				next.Users[i].Settings.StateBackend = c.Settings.StateBackend
+				next.Users[i].Settings.Redis = c.Settings.Redis
+				next.Users[i].Settings.Postgres = c.Settings.Postgres
+			}
+		}
+	}
+	if next.HealthCheckInterval != cur.HealthCheckInterval {
+		logger.Warn("health_check_interval changed, restart to apply", "health_check_interval", cur.HealthCheckInterval.String())
+		next.HealthCheckInterval = cur.HealthCheckInterval
+	}
+	if next.Interval != cur.Interval {
+		logger.Warn("interval changed, restart to apply", "interval", cur.Interval.String())
+		next.Interval = cur.Interval
+	}
+	if next.Mode != cur.Mode {
+		logger.Warn("mode changed, restart to apply", "mode", cur.Mode)
+		next.Mode = cur.Mode
+	}
+	if next.LeaderElection != cur.LeaderElection {
+		logger.Warn("leader_election changed, restart to apply")
+		next.LeaderElection = cur.LeaderElection
+	}
+	if next.LogLevel != cur.LogLevel {
+		logger.Warn("log_level changed, restart to apply", "log_level", cur.LogLevel)
+		next.LogLevel = cur.LogLevel
+	}
+
+	logger.Info("configuration reloaded",
+		"users", len(next.Users),
+		"yahoo_mailboxes", len(next.Yahoo),
+		"gmail", next.Gmail.Email,
+	)
+	auditReload(next.AuditLog, path, nil, logger)
+	return next
+}
+
+// checkHealth runs a health check of every user's credentials, keeping
+// each user's earlier outcomes in health by name. With leader election,
+// only the leader checks, so that failures are reported once.
+func checkHealth(cfg *config.Config, health map[string]*worker.Health, logger *slog.Logger) {
+	if cfg.LeaderElection.Enabled {
+		stop, leader, err := holdLease(cfg, logger)
+		if err != nil {
+			logger.Error("leader election failed", "error", err)
+			return
+		}
+		if !leader {
+			return
+		}
+		defer stop()
+	}
+	for _, t := range cfg.Tenants() {
+		h := health[t.Name]
+		if h == nil {
+			h = worker.NewHealth()
+			health[t.Name] = h
+		}
+		log := logger
+		if t.Name != "" {
+			log = logger.With("user", t.Name)
+		}
+		// The checks do not use the state tracker, so none is opened.
+		worker.New(t.Settings, nil, log).CheckHealth(h)
+	}
+}
+
+// auditReload records a configuration reload, which failed with err if it
+// is not nil, in the audit log at auditLog, if set. Reloads are triggered
+// by SIGHUP, whose sender is unknown, so the signal is the actor.
+func auditReload(auditLog, path string, err error, logger *slog.Logger) {
+	if auditLog == "" {
+		return
+	}
+	r := audit.Record{Actor: "SIGHUP", Action: "config.reload", Target: path, Outcome: audit.Succeeded}
+	if err != nil {
+		r.Outcome, r.Detail = audit.Failed, err.Error()
+	}
+	if err := audit.Append(auditLog, r); err != nil {
+		logger.Error("writing audit log failed", "error", err)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/benj-n/yatogm/internal/audit"
+	"github.com/benj-n/yatogm/internal/config"
+	"github.com/benj-n/yatogm/internal/worker"
+)
+
+// drainCmd implements the "drain" subcommand, which empties a mailbox
+// before it is decommissioned: it runs cycles over the mailbox until
+// nothing is left to forward, then prints a reconciliation and, with
+// -disable, disables the mailbox in the configuration file.
+func drainCmd(args []string) int {
+	fs := flag.NewFlagSet("drain", flag.ExitOnError)
+	g := addGlobalFlags(fs)
+	mailbox := fs.String("mailbox", "", "Yahoo mailbox to drain (required)")
+	maxCycles := fs.Int("max-cycles", 20, "Give up after this many cycles")
+	pause := fs.Duration("pause", 30*time.Second, "Pause between cycles")
+	disable := fs.Bool("disable", false, "Once drained, set disabled: true on the mailbox in the configuration file")
+	_ = fs.Parse(args)
+
+	if *mailbox == "" {
+		fmt.Fprintf(os.Stderr, "No mailbox: pass -mailbox\n")
+		return 2
+	}
+	if *maxCycles < 1 {
+		fmt.Fprintf(os.Stderr, "-max-cycles must be at least 1\n")
+		return 2
+	}
+	cfg, logger, ok := g.setup()
+	if !ok {
+		return 1
+	}
+	if cfg.Mode == "observe" {
+		logger.Error("mode is observe, which never fetches; drain from an instance that runs")
+		return 1
+	}
+
+	var (
+		tenant config.UserConfig
+		found  bool
+	)
+	for _, t := range cfg.Tenants() {
+		for _, y := range t.Settings.Yahoo {
+			if y.Email == *mailbox {
+				tenant, found = t, true
+			}
+		}
+	}
+	if !found {
+		fmt.Fprintf(os.Stderr, "Mailbox %s is not configured\n", *mailbox)
+		return 1
+	}
+	target, configPath := *mailbox, *g.configPath
+	if tenant.Name != "" {
+		target = tenant.Name + "/" + *mailbox
+		logger = logger.With("user", tenant.Name)
+		configPath = tenant.Config
+		if !filepath.IsAbs(configPath) {
+			configPath = filepath.Join(filepath.Dir(*g.configPath), configPath)
+		}
+	}
+
+	// A scheduled run on another instance would fetch the same messages.
+	if cfg.LeaderElection.Enabled {
+		stop, leader, err := holdLease(cfg, logger)
+		if err != nil {
+			logger.Error("leader election failed", "error", err)
+			return 1
+		}
+		if !leader {
+			fmt.Fprintf(os.Stderr, "Another instance holds the leader lease; drain from it, or stop it first\n")
+			return 1
+		}
+		defer stop()
+	}
+
+	tracker, err := openTracker(tenant.Settings)
+	if err != nil {
+		logger.Error("failed to initialize state tracker", "error", err)
+		return 1
+	}
+	defer tracker.Close()
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	w := worker.New(tenant.Settings, tracker, logger)
+	s, err := w.Drain(ctx, *mailbox, *maxCycles, *pause)
+	printDrainSummary(s, tracker.Stats()[*mailbox])
+	detail := fmt.Sprintf("%d cycles, %d forwarded, %d errors, %d left on the server, %d still to forward",
+		s.Cycles, s.Forwarded, s.Errors, s.Left.Total, s.Left.Pending)
+
+	code := 0
+	switch {
+	case err != nil:
+		fmt.Fprintf(os.Stderr, "Draining stopped: %v\n", err)
+		detail, code = err.Error(), 1
+	case !s.Drained:
+		fmt.Fprintf(os.Stderr, "Not drained after %d cycles; see the log for what failed\n", s.Cycles)
+		code = 1
+	case *disable:
+		if err := config.DisableMailbox(configPath, *mailbox); err != nil {
+			fmt.Fprintf(os.Stderr, "Error disabling the mailbox: %v\n", err)
+			detail, code = detail+"; disabling failed: "+err.Error(), 1
+			break
+		}
+		fmt.Printf("Disabled %s in %s\n", *mailbox, configPath)
+		detail += "; disabled in " + configPath
+	}
+
+	if cfg.AuditLog != "" {
+		r := audit.Record{
+			Actor:   audit.CurrentUser(),
+			Action:  "mailbox.drain",
+			Target:  target,
+			Outcome: audit.Succeeded,
+			Detail:  detail,
+		}
+		if code != 0 {
+			r.Outcome = audit.Failed
+		}
+		if err := audit.Append(cfg.AuditLog, r); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing audit log: %v\n", err)
+			return 1
+		}
+	}
+	return code
+}
+
+// printDrainSummary prints the reconciliation of a drain.
+func printDrainSummary(s worker.DrainSummary, tracked int) {
+	outcome := "drained"
+	if !s.Drained {
+		outcome = "not drained"
+	}
+	fmt.Printf("%s: %s after %d cycles\n", s.Mailbox, outcome, s.Cycles)
+	fmt.Printf("  forwarded:          %d\n", s.Forwarded)
+	fmt.Printf("  errors:             %d\n", s.Errors)
+	fmt.Printf("  left on the server: %d\n", s.Left.Total)
+	fmt.Printf("    still to forward: %d\n", s.Left.Pending)
+	fmt.Printf("    kept by design:   %d (hold, delete_after_forward, retain_days)\n", s.Left.Kept)
+	fmt.Printf("    oversized:        %d\n", s.Left.Oversized)
+	fmt.Printf("    quarantined:      %d\n", s.Left.Quarantined)
+	fmt.Printf("    out of range:     %d (since, before)\n", s.Left.OutOfRange)
+	fmt.Printf("  UIDs in the state:  %d\n", tracked)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/benj-n/yatogm/internal/config"
+	"github.com/benj-n/yatogm/internal/lease"
+	"github.com/benj-n/yatogm/internal/state"
+)
+
+// holdLease tries to become the leader. On success it keeps renewing the
+// lease in the background until stop is called, which renews it a final
+// time so the lease outlasts the run by a full lease duration and the
+// standby only takes over once this instance stops running.
+func holdLease(cfg *config.Config, logger *slog.Logger) (stop func(), leader bool, err error) {
+	store, err := leaseStore(cfg)
+	if err != nil {
+		return nil, false, err
+	}
+	closeStore := func() {
+		if c, ok := store.(io.Closer); ok {
+			c.Close()
+		}
+	}
+	le := cfg.LeaderElection
+	el := lease.NewElector(store, le.InstanceID, le.LeaseDuration)
+	leader, cur, err := el.Acquire()
+	if err != nil {
+		closeStore()
+		return nil, false, err
+	}
+	if !leader {
+		closeStore()
+		logger.Info("standing by, lease held by another instance",
+			"holder", cur.Holder, "expires", cur.Expires.Format(time.RFC3339))
+		return nil, false, nil
+	}
+	logger.Info("holding leader lease",
+		"instance_id", le.InstanceID, "since", cur.Acquired.Format(time.RFC3339), "expires", cur.Expires.Format(time.RFC3339))
+
+	renew := func() {
+		leader, cur, err := el.Acquire()
+		switch {
+		case err != nil:
+			logger.Error("renewing leader lease failed", "error", err)
+		case !leader:
+			logger.Error("leader lease lost to another instance", "holder", cur.Holder)
+		}
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(le.LeaseDuration / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				renew()
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		wg.Wait()
+		renew()
+		closeStore()
+	}, true, nil
+}
+
+// leaseStore returns where the lease is kept: the lease file if lease_path
+// is set, as it is by default with state files, or else the Redis server
+// or PostgreSQL database holding the state.
+func leaseStore(cfg *config.Config) (lease.Store, error) {
+	le := cfg.LeaderElection
+	switch {
+	case le.LeasePath != "":
+		return lease.NewFile(le.LeasePath), nil
+	case cfg.StateBackend == "postgres":
+		return state.NewPostgresLease(state.Postgres{URL: cfg.Postgres.URL, Owner: cfg.Postgres.Owner})
+	}
+	return state.NewRedisLease(redisOptions(cfg)), nil
+}
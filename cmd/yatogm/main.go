@@ -7,58 +7,420 @@ import (
 	"fmt"
 	"log/slog"
 	"os"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/benj-n/yatogm/internal/config"
+	"github.com/benj-n/yatogm/internal/fault"
 	"github.com/benj-n/yatogm/internal/state"
 	"github.com/benj-n/yatogm/internal/worker"
 )
 
 var version = "dev"
 
+// defaultConfigPath is where the configuration is read from unless -config
+// says otherwise.
+const defaultConfigPath = "/etc/yatogm/config.yml"
+
+// command is a yatogm subcommand. run receives the arguments after the
+// subcommand name and returns the exit code.
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) int
+}
+
+// commands lists the subcommands in the order usage shows them.
+var commands []command
+
+func init() {
+	commands = []command{
+		{"run", "Fetch and forward once, then exit (the default)", runCmd},
+		{"daemon", "Keep running and fetch and forward at the configured interval", daemonCmd},
+		{"validate", "Check the configuration and print it with secrets masked", validateCmd},
+		{"test", "Check the connection and credentials of every configured server", testCmd},
+		{"drain", "Forward everything left in a mailbox before decommissioning it", drainCmd},
+		{"plan", "Decide what a run would do with every message, and save it for \"apply\"", planCmd},
+		{"apply", "Carry out a plan saved by \"plan\" after reviewing it", applyCmd},
+		{"restore", "Deliver an archived message again, such as one deleted in Gmail", restoreCmd},
+		{"rules", "Check the configured rules (\"rules lint\"), or make one from Yahoo contacts", rulesCmd},
+		{"state", "Maintain the state file (\"state prune\" drops old UIDs)", stateCmd},
+		{"report", "Summarize a month of usage per mailbox from the state file", reportCmd},
+		{"suggest-filters", "Suggest Gmail filters for the senders and lists delivered most", suggestFiltersCmd},
+		{"auth", "Obtain an OAuth2 refresh token (\"auth login\")", authCmd},
+		{"soak", "Run the pipeline against mock servers to test for losses and duplicates", runSoak},
+		{"version", "Show version and exit", versionCmd},
+	}
+}
+
 func main() {
-	configPath := flag.String("config", "/etc/yatogm/config.yml", "Path to configuration file")
-	showVersion := flag.Bool("version", false, "Show version and exit")
-	flag.Parse()
+	args := os.Args[1:]
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		// Plain "yatogm -config ...", as in existing crontabs.
+		os.Exit(legacyCmd(args))
+	}
+	for _, c := range commands {
+		if c.name == args[0] {
+			os.Exit(c.run(args[1:]))
+		}
+	}
+	if args[0] != "help" {
+		fmt.Fprintf(os.Stderr, "yatogm: unknown command %q\n\n", args[0])
+	}
+	usage()
+	os.Exit(2)
+}
 
-	if *showVersion {
-		fmt.Printf("yatogm %s\n", version)
-		os.Exit(0)
+// usage prints the list of subcommands.
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: yatogm <command> [flags]\n\nCommands:\n")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", c.name, c.summary)
 	}
+	fmt.Fprintf(os.Stderr, "\nRun \"yatogm <command> -h\" for the flags of a command.\n")
+}
+
+// globalFlags are the flags shared by the commands that load the
+// configuration.
+type globalFlags struct {
+	configPath *string
+	faults     *string
+}
+
+// addGlobalFlags registers the shared flags on fs.
+func addGlobalFlags(fs *flag.FlagSet) globalFlags {
+	return globalFlags{
+		configPath: fs.String("config", defaultConfigPath, "Path to configuration file"),
+		faults:     fs.String("faults", os.Getenv(fault.EnvVar), "Fault injection spec for resilience testing (e.g. drop=0.01,delay=0.05)"),
+	}
+}
 
-	// Load configuration.
-	cfg, err := config.Load(*configPath)
+// setup loads the configuration, creates the logger, and enables fault
+// injection if requested. It reports false after printing the problem.
+func (g globalFlags) setup() (*config.Config, *slog.Logger, bool) {
+	cfg, err := config.Load(*g.configPath)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error loading configuration: %v\n", err)
-		os.Exit(1)
+		return nil, nil, false
 	}
 
 	// Set up structured logging.
-	logLevel := parseLogLevel(cfg.LogLevel)
 	logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
-		Level: logLevel,
+		Level: parseLogLevel(cfg.LogLevel),
 	}))
 
+	if *g.faults != "" {
+		inj, err := fault.Parse(*g.faults)
+		if err != nil {
+			logger.Error("invalid fault injection spec", "error", err)
+			return nil, nil, false
+		}
+		fault.Enable(inj)
+		logger.Warn("fault injection enabled", "faults", inj.String())
+	}
+	return cfg, logger, true
+}
+
+// legacyCmd runs yatogm invoked without a subcommand: once, or repeatedly
+// if the configuration sets an interval, or as an observer.
+func legacyCmd(args []string) int {
+	fs := flag.NewFlagSet("yatogm", flag.ExitOnError)
+	fs.Usage = func() {
+		usage()
+		fmt.Fprintf(os.Stderr, "\nWithout a command, yatogm runs once, or as a daemon if interval is set.\n\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	g := addGlobalFlags(fs)
+	showVersion := fs.Bool("version", false, "Show version and exit")
+	confirmDeletes := fs.Bool("confirm-deletes", false, "Delete forwarded messages from Yahoo under confirm_deletes")
+	acceptFresh := fs.Bool("accept-fresh-state", false, "Start with no state if the state file is corrupted, under state_corruption: fresh")
+	_ = fs.Parse(args)
+
+	if *showVersion {
+		return versionCmd(nil)
+	}
+	cfg, logger, ok := g.setup()
+	if !ok {
+		return 1
+	}
+	if cfg.Mode == "observe" {
+		logger.Info("yatogm starting in observe mode", "version", version)
+		return runObserve(cfg, logger)
+	}
+	logStart(cfg, logger)
+	if cfg.Interval > 0 {
+		return runDaemon(*g.configPath, cfg, logger)
+	}
+	return runLeader(cfg, logger, *confirmDeletes, *acceptFresh)
+}
+
+// runCmd implements the "run" subcommand.
+func runCmd(args []string) int {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	g := addGlobalFlags(fs)
+	confirmDeletes := fs.Bool("confirm-deletes", false, "Delete forwarded messages from Yahoo under confirm_deletes")
+	acceptFresh := fs.Bool("accept-fresh-state", false, "Start with no state if the state file is corrupted, under state_corruption: fresh")
+	mailbox := fs.String("mailbox", "", "Only process this configured Yahoo mailbox")
+	limit := fs.Int("limit", 0, "Retrieve at most this many messages, within max_messages_per_run")
+	since := fs.String("since", "", "Only forward messages dated from this day on, such as 2024-01-31, overriding the configured since")
+	before := fs.String("before", "", "Only forward messages dated before this day, overriding the configured before")
+	_ = fs.Parse(args)
+	if *limit < 0 {
+		fmt.Fprintf(os.Stderr, "-limit must not be negative\n")
+		return 2
+	}
+	for name, v := range map[string]string{"since": *since, "before": *before} {
+		if _, err := config.ParseDate(v); v != "" && err != nil {
+			fmt.Fprintf(os.Stderr, "-%s: %v\n", name, err)
+			return 2
+		}
+	}
+
+	cfg, logger, ok := g.setup()
+	if !ok {
+		return 1
+	}
+	if cfg.Mode == "observe" {
+		logger.Error("mode is observe, which keeps running; use \"yatogm daemon\"")
+		return 1
+	}
+	if err := restrictRun(cfg, *mailbox, *limit); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	if err := overrideDates(cfg, *since, *before); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	logStart(cfg, logger)
+	return runLeader(cfg, logger, *confirmDeletes, *acceptFresh)
+}
+
+// overrideDates replaces the since and before of every mailbox of a run
+// with those given, if set.
+func overrideDates(cfg *config.Config, since, before string) error {
+	for _, t := range cfg.Tenants() {
+		for i := range t.Settings.Yahoo {
+			y := &t.Settings.Yahoo[i]
+			if since != "" {
+				y.Since = since
+			}
+			if before != "" {
+				y.Before = before
+			}
+			s, b, err := y.DateRange()
+			if err != nil {
+				return fmt.Errorf("%s: %w", y.Email, err)
+			}
+			if !s.IsZero() && !b.IsZero() && !s.Before(b) {
+				return fmt.Errorf("%s: since %s is not earlier than before %s", y.Email, y.Since, y.Before)
+			}
+		}
+	}
+	return nil
+}
+
+// restrictRun narrows a run to the Yahoo mailbox named mailbox, if set,
+// leaving out the other mailboxes and, in a multi-user service, the other
+// users, and caps the messages it retrieves at limit, if set, or at
+// max_messages_per_run if that is lower.
+func restrictRun(cfg *config.Config, mailbox string, limit int) error {
+	if mailbox != "" {
+		var users []config.UserConfig
+		found := false
+		for _, t := range cfg.Tenants() {
+			i := slices.IndexFunc(t.Settings.Yahoo, func(y config.YahooMailbox) bool { return y.Email == mailbox })
+			if i < 0 {
+				continue
+			}
+			found = true
+			t.Settings.Yahoo = t.Settings.Yahoo[i : i+1]
+			users = append(users, t)
+		}
+		if !found {
+			return fmt.Errorf("mailbox %s is not configured, or is disabled", mailbox)
+		}
+		if len(cfg.Users) > 0 {
+			cfg.Users = users
+		}
+	}
+	if limit > 0 {
+		for _, t := range cfg.Tenants() {
+			if t.Settings.MaxMessagesPerRun == 0 || limit < t.Settings.MaxMessagesPerRun {
+				t.Settings.MaxMessagesPerRun = limit
+			}
+		}
+	}
+	return nil
+}
+
+// daemonCmd implements the "daemon" subcommand.
+func daemonCmd(args []string) int {
+	fs := flag.NewFlagSet("daemon", flag.ExitOnError)
+	g := addGlobalFlags(fs)
+	interval := fs.Duration("interval", 0, "Interval between runs, overriding the configured one")
+	_ = fs.Parse(args)
+
+	cfg, logger, ok := g.setup()
+	if !ok {
+		return 1
+	}
+	if cfg.Mode == "observe" {
+		logger.Info("yatogm starting in observe mode", "version", version)
+		return runObserve(cfg, logger)
+	}
+	if *interval > 0 {
+		if *interval < 10*time.Second {
+			logger.Error("interval must be at least 10s", "interval", interval.String())
+			return 1
+		}
+		if cfg.LeaderElection.Enabled && cfg.LeaderElection.LeaseDuration <= *interval {
+			logger.Error("leader_election.lease_duration must exceed the interval", "interval", interval.String())
+			return 1
+		}
+		cfg.Interval = *interval
+	}
+	if cfg.Interval <= 0 {
+		logger.Error("no interval configured; set interval in the configuration or pass -interval")
+		return 1
+	}
+	logStart(cfg, logger)
+	return runDaemon(*g.configPath, cfg, logger)
+}
+
+// versionCmd implements the "version" subcommand.
+func versionCmd([]string) int {
+	fmt.Printf("yatogm %s\n", version)
+	return 0
+}
+
+// logStart logs the startup banner of a fetching instance.
+func logStart(cfg *config.Config, logger *slog.Logger) {
+	if len(cfg.Users) > 0 {
+		logger.Info("yatogm starting", "version", version, "users", len(cfg.Users))
+		return
+	}
 	logger.Info("yatogm starting",
 		"version", version,
 		"yahoo_mailboxes", len(cfg.Yahoo),
 		"gmail", cfg.Gmail.Email,
 	)
+}
+
+// runLeader performs a run if this instance holds the leader lease, or is
+// the only instance, and returns the exit code. A standby exits cleanly.
+// Unless deletesConfirmed, a configuration with confirm_deletes leaves
+// forwarded messages on Yahoo; unless freshAccepted, one with
+// state_corruption "fresh" stops at a corrupted state file.
+func runLeader(cfg *config.Config, logger *slog.Logger, deletesConfirmed, freshAccepted bool) int {
+	// With a shared state directory, only the leader polls.
+	if cfg.LeaderElection.Enabled {
+		stop, leader, err := holdLease(cfg, logger)
+		if err != nil {
+			logger.Error("leader election failed", "error", err)
+			return 1
+		}
+		if !leader {
+			return 0
+		}
+		defer stop()
+	}
+	return runOnce(cfg, logger, deletesConfirmed, freshAccepted)
+}
+
+// runOnce performs a single fetch-and-forward run and returns the exit code.
+func runOnce(cfg *config.Config, logger *slog.Logger, deletesConfirmed, freshAccepted bool) int {
+	// In a multi-user service, run each user in turn, with their own state
+	// and worker, so that no settings or state are shared between them.
+	if len(cfg.Users) > 0 {
+		code := 0
+		for _, u := range cfg.Users {
+			if runOnce(u.Settings, logger.With("user", u.Name), deletesConfirmed, freshAccepted) != 0 {
+				code = 1
+			}
+		}
+		return code
+	}
 
 	// Initialize state tracker.
-	tracker, err := state.NewTracker(cfg.StatePath)
+	var trackerOpts []state.FileOption
+	if freshAccepted {
+		if cfg.StateCorruption == "fresh" {
+			trackerOpts = append(trackerOpts, state.WithCorruption(state.CorruptFresh))
+		} else {
+			logger.Warn("-accept-fresh-state only applies under state_corruption: fresh, ignoring it")
+		}
+	}
+	tracker, err := openTracker(cfg, trackerOpts...)
 	if err != nil {
-		logger.Error("failed to initialize state tracker", "error", err)
-		os.Exit(1)
+		worker.New(cfg, nil, logger).ReportStateError(err)
+		return 1
 	}
+	defer tracker.Close()
 
 	// Run the worker.
-	w := worker.New(cfg, tracker, logger)
+	var opts []worker.Option
+	if cfg.ConfirmDeletes && !deletesConfirmed {
+		logger.Warn("confirm_deletes is set and -confirm-deletes was not given, forwarded messages stay on Yahoo")
+		opts = append(opts, worker.WithDeletesWithheld())
+	}
+	w := worker.New(cfg, tracker, logger, opts...)
 	if err := w.Run(); err != nil {
 		logger.Error("run completed with errors", "error", err)
-		os.Exit(1)
+		return 1
 	}
 
 	logger.Info("yatogm finished successfully")
+	return 0
+}
+
+// openTracker loads the state of cfg from its state file, sharded or not
+// and compressed or not, from Redis or from PostgreSQL. In Redis, the
+// state of a mailbox not written for state_retention days expires, unless
+// the mailbox is on hold. A corrupted state file is dealt with as
+// state_corruption says, but for "fresh", which needs opts to confirm it.
+func openTracker(cfg *config.Config, opts ...state.FileOption) (*state.Tracker, error) {
+	switch cfg.StateBackend {
+	case "redis":
+	case "postgres":
+		return state.NewPostgresTracker(state.Postgres{URL: cfg.Postgres.URL, Owner: cfg.Postgres.Owner, WriteDelay: cfg.StateWriteDelay})
+	default:
+		corruption := state.CorruptionPolicy(cfg.StateCorruption)
+		if corruption == state.CorruptFresh {
+			corruption = state.CorruptFail
+		}
+		opts = append([]state.FileOption{
+			state.WithCompression(state.Compression(cfg.StateCompression)),
+			state.WithBackups(*cfg.StateBackups),
+			state.WithCorruption(corruption),
+		}, opts...)
+		if cfg.StateSharded {
+			return state.NewShardedTracker(cfg.StatePath, opts...)
+		}
+		return state.NewTracker(cfg.StatePath, opts...)
+	}
+	r := redisOptions(cfg)
+	r.TTL = time.Duration(cfg.StateRetention) * 24 * time.Hour
+	r.WriteDelay = cfg.StateWriteDelay
+	for _, y := range cfg.Yahoo {
+		if y.Hold {
+			r.Persist = append(r.Persist, y.Email)
+		}
+	}
+	return state.NewRedisTracker(r)
+}
+
+// redisOptions returns the Redis server and key prefix of cfg.
+func redisOptions(cfg *config.Config) state.Redis {
+	return state.Redis{
+		Addr:     cfg.Redis.Addr,
+		Username: cfg.Redis.Username,
+		Password: cfg.Redis.Password,
+		DB:       cfg.Redis.DB,
+		TLS:      cfg.Redis.TLS,
+		Prefix:   cfg.Redis.KeyPrefix,
+	}
 }
 
 func parseLogLevel(level string) slog.Level {
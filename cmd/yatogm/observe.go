@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/benj-n/yatogm/internal/config"
+	"github.com/benj-n/yatogm/internal/state"
+	"github.com/benj-n/yatogm/internal/status"
+)
+
+// runObserve serves status and metrics from the state file until the
+// process is interrupted. It never fetches mail or writes state.
+func runObserve(cfg *config.Config, logger *slog.Logger) int {
+	users := make([]status.User, 0, len(cfg.Tenants()))
+	for _, t := range cfg.Tenants() {
+		u := status.User{Name: t.Name, StatePath: t.Settings.StatePath, LatencySLO: t.Settings.LatencySLO}
+		if settings := t.Settings; settings.StateBackend != "file" {
+			u.StatePath = settings.StateLocation()
+			u.Open = (&observedTracker{cfg: settings}).open
+		}
+		for _, y := range t.Settings.Yahoo {
+			u.Mailboxes = append(u.Mailboxes, y.Email)
+			if y.Hold {
+				u.Held = append(u.Held, y.Email)
+			}
+		}
+		users = append(users, u)
+	}
+	var handler *status.Handler
+	if len(cfg.Users) > 0 {
+		handler = status.NewServiceHandler(users, logger)
+	} else {
+		handler = status.NewHandler(users[0].StatePath, users[0].Mailboxes, logger)
+		handler.SetHold(users[0].Held)
+		handler.SetLatencySLO(users[0].LatencySLO)
+		if users[0].Open != nil {
+			handler.SetOpen(users[0].Open)
+		}
+	}
+
+	srv := &http.Server{
+		Addr:              cfg.StatusAddr,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.ListenAndServe()
+	}()
+	logger.Info("observing state", "users", len(cfg.Users), "state", cfg.StateLocation(), "status_addr", cfg.StatusAddr)
+
+	select {
+	case err := <-errc:
+		logger.Error("status server failed", "error", err)
+		return 1
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.Error("status server shutdown failed", "error", err)
+		return 1
+	}
+	logger.Info("observer stopped")
+	return 0
+}
+
+// observedTracker is the state of one user kept outside files, opened on
+// the first request and reloaded for the next ones, so that the observer
+// holds one connection rather than opening the state anew each time.
+// PostgreSQL state is opened read-only: the observer leaves the schema to
+// the instances that write it.
+type observedTracker struct {
+	cfg *config.Config
+
+	mu      sync.Mutex
+	tracker *state.Tracker
+}
+
+func (o *observedTracker) open() (*state.Tracker, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.tracker != nil {
+		if err := o.tracker.Reload(); err != nil {
+			return nil, err
+		}
+		return o.tracker, nil
+	}
+	var t *state.Tracker
+	var err error
+	if o.cfg.StateBackend == "postgres" {
+		t, err = state.NewPostgresTracker(state.Postgres{URL: o.cfg.Postgres.URL, Owner: o.cfg.Postgres.Owner, ReadOnly: true})
+	} else {
+		t, err = openTracker(o.cfg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	o.tracker = t
+	return t, nil
+}
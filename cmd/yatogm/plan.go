@@ -0,0 +1,216 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/benj-n/yatogm/internal/audit"
+	"github.com/benj-n/yatogm/internal/config"
+	"github.com/benj-n/yatogm/internal/worker"
+)
+
+// actionNotes explain the actions of a plan as printed.
+var actionNotes = map[worker.Action]string{
+	worker.ActionForward:     "deliver, then delete from Yahoo",
+	worker.ActionForwardKeep: "deliver, keep on Yahoo",
+	worker.ActionDelete:      "delete from Yahoo, delivered earlier",
+	worker.ActionKeep:        "leave on Yahoo, delivered earlier",
+	worker.ActionSkip:        "leave on Yahoo, over max_message_size",
+	worker.ActionQuarantined: "leave on Yahoo, quarantined",
+	worker.ActionOutOfRange:  "leave on Yahoo, dated outside since and before",
+}
+
+// planCmd implements the "plan" subcommand, which decides what a run would
+// do with every message on the server without doing any of it, and saves
+// the plan for "apply".
+func planCmd(args []string) int {
+	fs := flag.NewFlagSet("plan", flag.ExitOnError)
+	g := addGlobalFlags(fs)
+	mailbox := fs.String("mailbox", "", "Plan only this Yahoo mailbox (default: all)")
+	user := fs.String("user", "", "User to plan for in a multi-user service (required there)")
+	out := fs.String("out", "", "Save the plan to this file, for \"yatogm apply\"")
+	_ = fs.Parse(args)
+
+	cfg, logger, ok := g.setup()
+	if !ok {
+		return 1
+	}
+	tenant, ok := findTenant(cfg, *user)
+	if !ok {
+		return 2
+	}
+	if tenant.Name != "" {
+		logger = logger.With("user", tenant.Name)
+	}
+
+	tracker, err := openTracker(tenant.Settings)
+	if err != nil {
+		logger.Error("failed to initialize state tracker", "error", err)
+		return 1
+	}
+	defer tracker.Close()
+
+	var mailboxes []string
+	if *mailbox != "" {
+		mailboxes = []string{*mailbox}
+	}
+	w := worker.New(tenant.Settings, tracker, logger)
+	p, err := w.Plan(mailboxes)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error planning: %v\n", err)
+		return 1
+	}
+	p.User = tenant.Name
+	printPlan(p)
+
+	if *out == "" {
+		fmt.Printf("\nNothing was saved; pass -out to apply this plan with \"yatogm apply\".\n")
+		return 0
+	}
+	if err := worker.WritePlan(*out, p); err != nil {
+		fmt.Fprintf(os.Stderr, "Error saving the plan: %v\n", err)
+		return 1
+	}
+	fmt.Printf("\nSaved to %s. Review it, then run \"yatogm apply %s\".\n", *out, *out)
+	return 0
+}
+
+// applyCmd implements the "apply" subcommand, which carries out a plan
+// saved by "plan", leaving alone the messages it does not cover or that a
+// run would now do something else with.
+func applyCmd(args []string) int {
+	fs := flag.NewFlagSet("apply", flag.ExitOnError)
+	g := addGlobalFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: yatogm apply [flags] <plan file>\n\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	path := fs.Arg(0)
+	p, err := worker.ReadPlan(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading the plan: %v\n", err)
+		return 1
+	}
+	cfg, logger, ok := g.setup()
+	if !ok {
+		return 1
+	}
+	if cfg.Mode == "observe" {
+		logger.Error("mode is observe, which never fetches; apply from an instance that runs")
+		return 1
+	}
+	tenant, ok := findTenant(cfg, p.User)
+	if !ok {
+		return 1
+	}
+	target := path
+	if tenant.Name != "" {
+		target = tenant.Name + "/" + path
+		logger = logger.With("user", tenant.Name)
+	}
+
+	// A scheduled run on another instance would fetch the same messages.
+	if cfg.LeaderElection.Enabled {
+		stop, leader, err := holdLease(cfg, logger)
+		if err != nil {
+			logger.Error("leader election failed", "error", err)
+			return 1
+		}
+		if !leader {
+			fmt.Fprintf(os.Stderr, "Another instance holds the leader lease; apply from it, or stop it first\n")
+			return 1
+		}
+		defer stop()
+	}
+
+	tracker, err := openTracker(tenant.Settings)
+	if err != nil {
+		logger.Error("failed to initialize state tracker", "error", err)
+		return 1
+	}
+	defer tracker.Close()
+
+	// The reviewed plan confirms its deletions, so they are not withheld
+	// under confirm_deletes.
+	w := worker.New(tenant.Settings, tracker, logger)
+	s, err := w.Apply(p)
+	detail := fmt.Sprintf("plan of %s: %d forwarded, %d errors, %d changed since the plan",
+		p.CreatedAt.Format("2006-01-02 15:04:05Z"), s.Forwarded, s.Errors, s.Changed)
+
+	code := 0
+	switch {
+	case err != nil:
+		fmt.Fprintf(os.Stderr, "Applying stopped: %v\n", err)
+		detail, code = err.Error(), 1
+	default:
+		fmt.Printf("Applied %s: %d forwarded, %d errors\n", path, s.Forwarded, s.Errors)
+		if s.Changed > 0 {
+			fmt.Printf("%d planned messages changed since the plan and were left alone; see the log, and plan again\n", s.Changed)
+		}
+		if s.Errors > 0 {
+			code = 1
+		}
+	}
+
+	if cfg.AuditLog != "" {
+		r := audit.Record{
+			Actor:   audit.CurrentUser(),
+			Action:  "plan.apply",
+			Target:  target,
+			Outcome: audit.Succeeded,
+			Detail:  detail,
+		}
+		if code != 0 {
+			r.Outcome = audit.Failed
+		}
+		if err := audit.Append(cfg.AuditLog, r); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing audit log: %v\n", err)
+			return 1
+		}
+	}
+	return code
+}
+
+// findTenant returns the configuration of user in a multi-user service,
+// or the only one otherwise, reporting false after printing the problem.
+func findTenant(cfg *config.Config, user string) (config.UserConfig, bool) {
+	if len(cfg.Users) == 0 {
+		if user != "" {
+			fmt.Fprintf(os.Stderr, "User %s given, but this is not a multi-user service\n", user)
+			return config.UserConfig{}, false
+		}
+		return config.UserConfig{Settings: cfg}, true
+	}
+	if user == "" {
+		fmt.Fprintf(os.Stderr, "This is a multi-user service, and no user was given\n")
+		return config.UserConfig{}, false
+	}
+	for _, u := range cfg.Users {
+		if u.Name == user {
+			return u, true
+		}
+	}
+	fmt.Fprintf(os.Stderr, "User %s is not configured\n", user)
+	return config.UserConfig{}, false
+}
+
+// printPlan prints the number of messages planned for each action, by
+// mailbox.
+func printPlan(p worker.Plan) {
+	for i, mp := range p.Mailboxes {
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Printf("%s: %d messages\n", mp.Mailbox, len(mp.Messages))
+		for _, a := range worker.Actions {
+			fmt.Printf("  %-13s %6d  %s\n", a, mp.Count(a), actionNotes[a])
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/benj-n/yatogm/internal/config"
+)
+
+// usageReport is the output of "yatogm report" for one month.
+type usageReport struct {
+	Month     string          `json:"month"`
+	Mailboxes []mailboxUsage  `json:"mailboxes"`
+	Quotas    []transferQuota `json:"quotas,omitempty"`
+}
+
+// mailboxUsage is the activity of one mailbox in the month.
+type mailboxUsage struct {
+	User       string `json:"user,omitempty"`
+	Mailbox    string `json:"mailbox"`
+	Forwarded  int    `json:"forwarded"`
+	Runs       int    `json:"runs"`
+	FailedRuns int    `json:"failed_runs"`
+	Errors     int    `json:"errors"`
+	// ErrorRate is the share of runs that had errors, from 0 to 1.
+	ErrorRate  float64 `json:"error_rate"`
+	Downloaded int64   `json:"downloaded_bytes"`
+	Uploaded   int64   `json:"uploaded_bytes"`
+}
+
+// transferQuota is the consumption of a monthly_transfer_cap.
+type transferQuota struct {
+	User string `json:"user,omitempty"`
+	Cap  int64  `json:"cap_bytes"`
+	Used int64  `json:"used_bytes"`
+	// UsedPercent can exceed 100, as messages in flight complete.
+	UsedPercent float64 `json:"used_percent"`
+}
+
+// reportCmd implements the "report" subcommand: it summarizes a month of
+// activity per mailbox from the state files, without connecting anywhere.
+func reportCmd(args []string) int {
+	fs := flag.NewFlagSet("report", flag.ExitOnError)
+	configPath := fs.String("config", defaultConfigPath, "Path to configuration file")
+	month := fs.String("month", time.Now().Format("2006-01"), "Month to report, as YYYY-MM")
+	format := fs.String("format", "text", "Output format: text, json, or csv")
+	_ = fs.Parse(args)
+
+	m, err := time.ParseInLocation("2006-01", *month, time.Local)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid -month %q, expected YYYY-MM\n", *month)
+		return 2
+	}
+	var write func(io.Writer, *usageReport) error
+	switch *format {
+	case "text":
+		write = writeReportText
+	case "json":
+		write = writeReportJSON
+	case "csv":
+		write = writeReportCSV
+	default:
+		fmt.Fprintf(os.Stderr, "Invalid -format %q, expected text, json, or csv\n", *format)
+		return 2
+	}
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading configuration: %v\n", err)
+		return 1
+	}
+	r := &usageReport{Month: m.Format("2006-01"), Mailboxes: []mailboxUsage{}}
+	for _, t := range cfg.Tenants() {
+		tracker, err := openTracker(t.Settings)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading state of %s: %v\n", t.Settings.StateLocation(), err)
+			return 1
+		}
+		var used int64
+		for _, y := range t.Settings.Yahoo {
+			tr, rc := tracker.Month(y.Email, m)
+			u := mailboxUsage{
+				User:       t.Name,
+				Mailbox:    y.Email,
+				Forwarded:  rc.Forwarded,
+				Runs:       rc.Runs,
+				FailedRuns: rc.FailedRuns,
+				Errors:     rc.Errors,
+				Downloaded: tr.Downloaded,
+				Uploaded:   tr.Uploaded,
+			}
+			if rc.Runs > 0 {
+				u.ErrorRate = float64(rc.FailedRuns) / float64(rc.Runs)
+			}
+			r.Mailboxes = append(r.Mailboxes, u)
+			used += tr.Total()
+		}
+		tracker.Close()
+		if c := t.Settings.MonthlyTransferCap; c > 0 {
+			r.Quotas = append(r.Quotas, transferQuota{User: t.Name, Cap: c, Used: used, UsedPercent: 100 * float64(used) / float64(c)})
+		}
+	}
+
+	if err := write(os.Stdout, r); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing report: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// writeReportText prints the report as a table, followed by the transfer
+// quotas.
+func writeReportText(w io.Writer, r *usageReport) error {
+	service := len(r.Mailboxes) > 0 && r.Mailboxes[0].User != ""
+	fmt.Fprintf(w, "Usage for %s\n\n", r.Month)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	if service {
+		fmt.Fprintf(tw, "USER\t")
+	}
+	fmt.Fprintf(tw, "MAILBOX\tFORWARDED\tRUNS\tFAILED RUNS\tERRORS\tERROR RATE\tDOWNLOADED\tUPLOADED\n")
+	for _, u := range r.Mailboxes {
+		if service {
+			fmt.Fprintf(tw, "%s\t", u.User)
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%.1f%%\t%s\t%s\n",
+			u.Mailbox, u.Forwarded, u.Runs, u.FailedRuns, u.Errors, 100*u.ErrorRate, formatBytes(u.Downloaded), formatBytes(u.Uploaded))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	for _, q := range r.Quotas {
+		prefix := ""
+		if q.User != "" {
+			prefix = q.User + ": "
+		}
+		fmt.Fprintf(w, "\n%smonthly_transfer_cap: %s of %s used (%.1f%%)", prefix, formatBytes(q.Used), formatBytes(q.Cap), q.UsedPercent)
+	}
+	if len(r.Quotas) > 0 {
+		fmt.Fprintln(w)
+	}
+	return nil
+}
+
+func writeReportJSON(w io.Writer, r *usageReport) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// writeReportCSV writes one row per mailbox. Quotas span mailboxes and
+// are left out; the JSON output has them.
+func writeReportCSV(w io.Writer, r *usageReport) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"month", "user", "mailbox", "forwarded", "runs", "failed_runs", "errors", "error_rate", "downloaded_bytes", "uploaded_bytes"})
+	for _, u := range r.Mailboxes {
+		cw.Write([]string{
+			r.Month, u.User, u.Mailbox,
+			strconv.Itoa(u.Forwarded), strconv.Itoa(u.Runs), strconv.Itoa(u.FailedRuns), strconv.Itoa(u.Errors),
+			strconv.FormatFloat(u.ErrorRate, 'f', 4, 64),
+			strconv.FormatInt(u.Downloaded, 10), strconv.FormatInt(u.Uploaded, 10),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// formatBytes formats a byte count with a binary unit.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/benj-n/yatogm/internal/audit"
+	"github.com/benj-n/yatogm/internal/config"
+	"github.com/benj-n/yatogm/internal/worker"
+)
+
+// restoreCmd implements the "restore" subcommand, which delivers an
+// archived message once more, such as after it was filtered away or
+// deleted in Gmail by mistake.
+func restoreCmd(args []string) int {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	g := addGlobalFlags(fs)
+	uid := fs.String("uid", "", "UID of the message to restore (required)")
+	mailbox := fs.String("mailbox", "", "Yahoo mailbox the message came from (required with more than one mailbox)")
+	dest := fs.String("destination", "", "Destination to deliver to, such as \"maildir\" (default: Gmail, or the first configured)")
+	_ = fs.Parse(args)
+
+	if *uid == "" {
+		fmt.Fprintf(os.Stderr, "No message: pass -uid\n")
+		return 2
+	}
+	cfg, logger, ok := g.setup()
+	if !ok {
+		return 1
+	}
+
+	var (
+		tenant config.UserConfig
+		from   string
+		found  int
+	)
+	for _, t := range cfg.Tenants() {
+		for _, y := range t.Settings.Yahoo {
+			if *mailbox == "" || y.Email == *mailbox {
+				tenant, from, found = t, y.Email, found+1
+			}
+		}
+	}
+	switch {
+	case found == 0:
+		fmt.Fprintf(os.Stderr, "Mailbox %s is not configured\n", *mailbox)
+		return 1
+	case found > 1 && *mailbox == "":
+		fmt.Fprintf(os.Stderr, "More than one mailbox is configured; pass -mailbox\n")
+		return 2
+	}
+	*mailbox = from
+	target := *mailbox + "/" + *uid
+	if tenant.Name != "" {
+		target = tenant.Name + "/" + target
+		logger = logger.With("user", tenant.Name)
+	}
+
+	// Restoring neither reads nor writes the state.
+	w := worker.New(tenant.Settings, nil, logger)
+	r, err := w.Restore(*mailbox, *uid, *dest)
+	detail := fmt.Sprintf("%s delivered to %s as %s", r.Key, r.Destination, r.ID)
+	code := 0
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error restoring: %v\n", err)
+		detail, code = err.Error(), 1
+	} else {
+		fmt.Printf("Restored %s from %s to %s (yatogm ID %s): %s\n", *uid, r.Key, r.Destination, r.ID, r.Reply)
+	}
+
+	if cfg.AuditLog != "" {
+		rec := audit.Record{
+			Actor:   audit.CurrentUser(),
+			Action:  "message.restore",
+			Target:  target,
+			ID:      r.ID,
+			Outcome: audit.Succeeded,
+			Detail:  detail,
+		}
+		if code != 0 {
+			rec.Outcome = audit.Failed
+		}
+		if err := audit.Append(cfg.AuditLog, rec); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing audit log: %v\n", err)
+			return 1
+		}
+	}
+	return code
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/benj-n/yatogm/internal/config"
+	"github.com/benj-n/yatogm/internal/contacts"
+	"github.com/benj-n/yatogm/internal/rules"
+)
+
+// rulesCmd implements the "rules" subcommand.
+func rulesCmd(args []string) int {
+	if len(args) > 0 {
+		switch args[0] {
+		case "lint":
+			return rulesLintCmd(args[1:])
+		case "import-contacts":
+			return rulesImportContactsCmd(args[1:])
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Usage: yatogm rules lint [flags] [condition ...]\n"+
+		"       yatogm rules import-contacts [flags] contacts.csv\n\n"+
+		"Run \"yatogm rules <subcommand> -h\" for its flags.\n")
+	return 2
+}
+
+// rulesImportContactsCmd reads the contacts exported from Yahoo Mail as
+// CSV and prints a rule delivering the mail from them, to add to the
+// configuration, and optionally writes Gmail filters labeling it by
+// contact category. Nothing is changed in the configuration itself.
+func rulesImportContactsCmd(args []string) int {
+	fs := flag.NewFlagSet("rules import-contacts", flag.ExitOnError)
+	name := fs.String("name", "contacts", "Name of the generated rule")
+	filters := fs.String("gmail-filters", "", "Also write Gmail filters labeling mail from each contact category to this file, for Gmail's \"Import filters\"")
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "Usage: yatogm rules import-contacts [flags] contacts.csv\n")
+		return 2
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	list, err := contacts.Parse(f)
+	f.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading %s: %v\n", fs.Arg(0), err)
+		return 1
+	}
+	rule, err := contacts.Rule(*name, list)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading %s: %v\n", fs.Arg(0), err)
+		return 1
+	}
+	out, err := yaml.Marshal(struct {
+		Rules []config.RuleConfig `yaml:"rules"`
+	}{[]config.RuleConfig{rule}})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	fmt.Printf("# Generated from %s: mail from its %d addresses is delivered, whatever\n", filepath.Base(fs.Arg(0)), len(contacts.Addresses(list)))
+	fmt.Printf("# the rules after this one say. Add it first to the rules of the configuration.\n")
+	os.Stdout.Write(out)
+
+	if *filters != "" {
+		err := writeFile(*filters, func(w io.Writer) error { return contacts.WriteGmailFilters(w, list) })
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing %s: %v\n", *filters, err)
+			return 1
+		}
+		fmt.Fprintf(os.Stderr, "Gmail filters for %d categories written to %s\n", len(contacts.Categories(list)), *filters)
+	}
+	return 0
+}
+
+// writeFile creates the file at path and writes it with write.
+func writeFile(path string, write func(io.Writer) error) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// rulesLintCmd compiles the conditions given as arguments or, without any,
+// the rules of the configuration, and reports every problem with its
+// position. It neither connects to any server nor opens the state file.
+func rulesLintCmd(args []string) int {
+	fs := flag.NewFlagSet("rules lint", flag.ExitOnError)
+	configPath := fs.String("config", defaultConfigPath, "Path to configuration file, whose rules are checked unless conditions are given")
+	_ = fs.Parse(args)
+
+	what := "conditions"
+	var cfgs []config.RuleConfig
+	for i, cond := range fs.Args() {
+		cfgs = append(cfgs, config.RuleConfig{Name: fmt.Sprintf("condition %d", i+1), If: cond, Action: string(rules.Deliver)})
+	}
+	if len(cfgs) == 0 {
+		cfg, err := config.Load(*configPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading configuration: %v\n", err)
+			return 1
+		}
+		cfgs, what = cfg.Rules, *configPath+": rules"
+	}
+
+	if lintRules(os.Stderr, cfgs) > 0 {
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "%s are valid\n", what)
+	return 0
+}
+
+// lintRules compiles cfgs, printing each problem to w with the condition
+// and a caret under where it was found, and returns the number of problems.
+func lintRules(w io.Writer, cfgs []config.RuleConfig) int {
+	problems := 0
+	for _, c := range cfgs {
+		_, err := rules.New(c.Name, c.If, rules.Action(c.Action))
+		if err == nil {
+			continue
+		}
+		problems++
+		fmt.Fprintf(w, "%s: %v\n", c.Name, err)
+		var e *rules.Error
+		if errors.As(err, &e) && !strings.Contains(c.If, "\n") {
+			fmt.Fprintf(w, "    %s\n    %s^\n", c.If, strings.Repeat(" ", e.Pos))
+		}
+	}
+	return problems
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/benj-n/yatogm/internal/fault"
+	"github.com/benj-n/yatogm/internal/soak"
+)
+
+// runSoak implements the "soak" subcommand and returns the exit code.
+func runSoak(args []string) int {
+	fs := flag.NewFlagSet("soak", flag.ExitOnError)
+	messages := fs.Int("messages", 10000, "Total number of messages to push through the pipeline")
+	batch := fs.Int("batch", 100, "Average number of messages arriving per cycle")
+	failureRate := fs.Float64("failure-rate", 0.02, "Probability of an injected failure per operation")
+	seed := fs.Int64("seed", time.Now().UnixNano(), "Random seed for a reproducible run")
+	maxCycles := fs.Int("max-cycles", 0, "Maximum number of cycles (0 = derived from -messages)")
+	fetchConcurrency := fs.Int("fetch-concurrency", 1, "POP3 sessions per mailbox")
+	sendConcurrency := fs.Int("send-concurrency", 1, "Parallel SMTP deliveries per mailbox")
+	pipelineDepth := fs.Int("pipeline-depth", 1, "Retrieved messages buffered for senders")
+	keep := fs.Bool("keep", false, "Keep messages on the server (delete_after_forward: false)")
+	faults := fs.String("faults", os.Getenv(fault.EnvVar), "Client-side fault injection spec (e.g. drop=0.01,corrupt=0.001)")
+	logLevel := fs.String("log-level", "", "Pipeline log verbosity: debug, info, warn, error (default: silent)")
+	_ = fs.Parse(args)
+
+	// Injected failures make the pipeline log errors constantly, so its
+	// output is discarded unless explicitly requested.
+	var out io.Writer = io.Discard
+	if *logLevel != "" {
+		out = os.Stderr
+	}
+	logger := slog.New(slog.NewJSONHandler(out, &slog.HandlerOptions{
+		Level: parseLogLevel(*logLevel),
+	}))
+
+	if *faults != "" {
+		inj, err := fault.Parse(*faults)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "soak: %v\n", err)
+			return 1
+		}
+		fault.Enable(inj)
+		fmt.Printf("soak: fault injection %s\n", inj)
+	}
+
+	fmt.Printf("soak: seed %d\n", *seed)
+	report, err := soak.Run(soak.Options{
+		Messages:    *messages,
+		BatchSize:   *batch,
+		FailureRate: *failureRate,
+		Seed:        *seed,
+		MaxCycles:   *maxCycles,
+
+		FetchConcurrency: *fetchConcurrency,
+		SendConcurrency:  *sendConcurrency,
+		PipelineDepth:    *pipelineDepth,
+		KeepOnServer:     *keep,
+	}, logger)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "soak: %v\n", err)
+		return 1
+	}
+
+	report.Write(os.Stdout)
+	if !report.OK() {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/benj-n/yatogm/internal/audit"
+	"github.com/benj-n/yatogm/internal/config"
+)
+
+// stateCmd implements the "state" subcommand, which maintains the state
+// file offline.
+func stateCmd(args []string) int {
+	if len(args) == 0 || args[0] != "prune" {
+		fmt.Fprintf(os.Stderr, "Usage: yatogm state prune [flags]\n\nRun \"yatogm state prune -h\" for its flags.\n")
+		return 2
+	}
+	return statePruneCmd(args[1:])
+}
+
+// statePruneCmd drops the UIDs of forwarded messages older than a retention
+// period from the state file. Without a connection to the server, it cannot
+// tell which messages are still there, so it leaves alone the mailboxes
+// that keep messages on the server; pruning during runs handles those.
+func statePruneCmd(args []string) int {
+	fs := flag.NewFlagSet("state prune", flag.ExitOnError)
+	configPath := fs.String("config", defaultConfigPath, "Path to configuration file")
+	olderThan := fs.Duration("older-than", 0, "Prune UIDs fetched longer ago than this (default: state_retention days)")
+	mailbox := fs.String("mailbox", "", "Only prune this mailbox (default: all configured mailboxes)")
+	_ = fs.Parse(args)
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading configuration: %v\n", err)
+		return 1
+	}
+	if *olderThan == 0 {
+		*olderThan = time.Duration(cfg.StateRetention) * 24 * time.Hour
+	}
+	if *olderThan <= 0 {
+		fmt.Fprintf(os.Stderr, "No retention period: pass -older-than or set state_retention\n")
+		return 2
+	}
+
+	found := false
+	for _, t := range cfg.Tenants() {
+		prefix := ""
+		if t.Name != "" {
+			prefix = t.Name + ": "
+		}
+		ok, err := pruneTenant(t, *olderThan, *mailbox, prefix, cfg.AuditLog)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error %s%v\n", prefix, err)
+			return 1
+		}
+		found = found || ok
+	}
+	if !found {
+		fmt.Fprintf(os.Stderr, "Mailbox %s is not configured\n", *mailbox)
+		return 1
+	}
+	return 0
+}
+
+// pruneTenant prunes the state file of one configuration, printing each
+// mailbox's outcome after prefix and recording each prune in the audit log
+// at auditLog, if set. It reports whether any mailbox matched.
+func pruneTenant(t config.UserConfig, olderThan time.Duration, mailbox, prefix, auditLog string) (bool, error) {
+	tracker, err := openTracker(t.Settings)
+	if err != nil {
+		return false, fmt.Errorf("loading state: %w", err)
+	}
+	defer tracker.Close()
+
+	found := false
+	for _, y := range t.Settings.Yahoo {
+		if mailbox != "" && y.Email != mailbox {
+			continue
+		}
+		found = true
+		retain := time.Duration(y.RetainDays) * 24 * time.Hour
+		switch {
+		case y.Hold:
+			fmt.Printf("%s%s: on hold, not pruned\n", prefix, y.Email)
+		case !y.DeletesAfterForward():
+			fmt.Printf("%s%s: messages are kept on the server, not pruned\n", prefix, y.Email)
+		case olderThan <= retain:
+			fmt.Printf("%s%s: messages are kept on the server for %d days (retain_days), not pruned with a shorter -older-than\n", prefix, y.Email, y.RetainDays)
+		default:
+			n, err := tracker.Prune(y.Email, olderThan)
+			if auditLog != "" {
+				r := audit.Record{
+					Actor:   audit.CurrentUser(),
+					Action:  "state.prune",
+					Target:  y.Email,
+					Outcome: audit.Succeeded,
+					Detail:  fmt.Sprintf("pruned %d UIDs older than %s", n, olderThan),
+				}
+				if t.Name != "" {
+					r.Target = t.Name + "/" + y.Email
+				}
+				if err != nil {
+					r.Outcome, r.Detail = audit.Failed, err.Error()
+				}
+				if err := audit.Append(auditLog, r); err != nil {
+					return found, err
+				}
+			}
+			if err != nil {
+				return found, fmt.Errorf("pruning %s: %w", y.Email, err)
+			}
+			fmt.Printf("%s%s: pruned %d UIDs\n", prefix, y.Email, n)
+		}
+	}
+	return found, nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"github.com/benj-n/yatogm/internal/config"
+	"github.com/benj-n/yatogm/internal/gmailfilter"
+	"github.com/benj-n/yatogm/internal/receipt"
+)
+
+// suggestFiltersCmd implements the "suggest-filters" subcommand: it reads
+// the receipts of delivered messages and suggests Gmail filters labeling
+// the mailing lists and senders that sent the most, optionally writing
+// them for Gmail to import. It connects nowhere.
+func suggestFiltersCmd(args []string) int {
+	fs := flag.NewFlagSet("suggest-filters", flag.ExitOnError)
+	configPath := fs.String("config", defaultConfigPath, "Path to configuration file")
+	receiptsPath := fs.String("receipts", "", "Receipts file to read, instead of the configured receipts_path")
+	minMessages := fs.Int("min", 10, "Suggest a filter for groups of at least this many messages")
+	prefix := fs.String("label-prefix", "", "Nest the suggested labels under this one, such as \"Yahoo\"")
+	out := fs.String("out", "", "Also write the suggested filters to this file, for Gmail's \"Import filters\"")
+	_ = fs.Parse(args)
+	if *minMessages < 1 {
+		fmt.Fprintf(os.Stderr, "-min must be at least 1\n")
+		return 2
+	}
+
+	path := *receiptsPath
+	if path == "" {
+		cfg, err := config.Load(*configPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading configuration: %v\n", err)
+			return 1
+		}
+		switch {
+		case len(cfg.Users) > 0:
+			fmt.Fprintf(os.Stderr, "Each user has their own Gmail account: pass -receipts with the receipts file of one\n")
+			return 2
+		case cfg.ReceiptsPath == "":
+			fmt.Fprintf(os.Stderr, "No receipts: set receipts_path before forwarding, or pass -receipts\n")
+			return 1
+		}
+		path = cfg.ReceiptsPath
+	}
+
+	var records []receipt.Record
+	f, err := os.Open(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	err = receipt.Read(f, func(r receipt.Record) error {
+		records = append(records, r)
+		return nil
+	})
+	f.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading %s: %v\n", path, err)
+		return 1
+	}
+
+	suggestions := gmailfilter.Suggest(records, *minMessages, *prefix)
+	if err := writeSuggestions(os.Stdout, suggestions); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	if *out != "" && len(suggestions) > 0 {
+		filters := make([]gmailfilter.Filter, len(suggestions))
+		for i, s := range suggestions {
+			filters[i] = s.Filter
+		}
+		err := writeFile(*out, func(w io.Writer) error { return gmailfilter.Write(w, filters) })
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing %s: %v\n", *out, err)
+			return 1
+		}
+		fmt.Fprintf(os.Stderr, "%d filters written to %s\n", len(filters), *out)
+	}
+	return 0
+}
+
+// writeSuggestions prints the suggested filters as a table.
+func writeSuggestions(w io.Writer, suggestions []gmailfilter.Suggestion) error {
+	if len(suggestions) == 0 {
+		_, err := fmt.Fprintf(w, "No sender or mailing list sent enough messages for a filter; try a lower -min.\n")
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "LABEL\tMATCHES\tMESSAGES\tSENDERS\n")
+	for _, s := range suggestions {
+		match := "from:" + s.From
+		if s.List != "" {
+			match = "list:" + s.List
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\n", s.Label, match, s.Messages, s.Senders)
+	}
+	return tw.Flush()
+}
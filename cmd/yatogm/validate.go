@@ -0,0 +1,42 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/benj-n/yatogm/internal/config"
+)
+
+// validateCmd implements the "validate" subcommand: it loads the
+// configuration as a run would, with environment overrides and defaults
+// applied, checks the conditions of its rules, and prints it with secrets
+// masked. It neither connects to any server nor opens the state file.
+func validateCmd(args []string) int {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	configPath := fs.String("config", defaultConfigPath, "Path to configuration file")
+	quiet := fs.Bool("q", false, "Only report problems, without printing the configuration")
+	_ = fs.Parse(args)
+
+	cfg, err := config.LoadStrict(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading configuration: %v\n", err)
+		return 1
+	}
+	if lintRules(os.Stderr, cfg.Rules) > 0 {
+		fmt.Fprintf(os.Stderr, "Error loading configuration: invalid rules\n")
+		return 1
+	}
+	if !*quiet {
+		out, err := yaml.Marshal(cfg.Redacted())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error printing configuration: %v\n", err)
+			return 1
+		}
+		os.Stdout.Write(out)
+	}
+	fmt.Fprintf(os.Stderr, "%s: configuration is valid\n", *configPath)
+	return 0
+}
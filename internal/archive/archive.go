@@ -0,0 +1,143 @@
+// Package archive keeps a copy of every retrieved message, written before
+// yatogm tries to deliver it, so that a message is never only held in
+// memory while it is being forwarded. Copies go to a local directory or to
+// an S3-compatible bucket.
+package archive
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Store is where archived messages are kept.
+type Store interface {
+	// Put stores the message of size bytes read from msg under key, as
+	// returned by Key, replacing an earlier copy, and returns where it was
+	// stored. It may be called concurrently.
+	Put(key string, msg io.ReaderAt, size int64) (location string, err error)
+}
+
+// Finder is implemented by stores that can read archived messages back,
+// which restoring them needs.
+type Finder interface {
+	// Find returns the keys under which copies of the message with the
+	// given UID, retrieved from mailbox, are archived, oldest first.
+	Find(mailbox, uid string) ([]string, error)
+	// Get returns the message archived under key.
+	Get(key string) ([]byte, error)
+}
+
+// Key returns the name under which the message with the given UID,
+// retrieved from mailbox on date, is archived:
+// <mailbox>/<YYYY-MM-DD>/<uid>.eml. Characters of the UID that are not safe
+// in a file name are replaced by "_".
+func Key(mailbox, uid string, date time.Time) string {
+	return path.Join(mailbox, date.Format("2006-01-02"), fileName(uid))
+}
+
+// fileName returns the name of the file of the message with the given UID.
+func fileName(uid string) string {
+	name := strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == ':' || r < 0x21 || r > 0x7e {
+			return '_'
+		}
+		return r
+	}, uid)
+	if name == "." || name == ".." {
+		name = "_" + name
+	}
+	return name + ".eml"
+}
+
+// parseKey splits a key returned by Key into its mailbox and file name.
+func parseKey(key string) (mailbox, name string, ok bool) {
+	dir, name := path.Split(key)
+	mailbox, date := path.Split(strings.TrimSuffix(dir, "/"))
+	if _, err := time.Parse("2006-01-02", date); err != nil || mailbox == "" {
+		return "", "", false
+	}
+	return strings.TrimSuffix(mailbox, "/"), name, true
+}
+
+// Dir is a Store that writes messages as files under a local directory.
+type Dir string
+
+// Put writes the message to <dir>/<key>, creating its directory if needed.
+// The file is written through a temporary file that is synced and renamed,
+// and the directory is synced after the rename, so that the message is on
+// disk once Put returns.
+func (d Dir) Put(key string, msg io.ReaderAt, size int64) (string, error) {
+	file := filepath.Join(string(d), filepath.FromSlash(key))
+	dir := filepath.Dir(file)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("creating archive directory: %w", err)
+	}
+	tmp := file + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return "", fmt.Errorf("archiving message: %w", err)
+	}
+	_, err = io.Copy(f, io.NewSectionReader(msg, 0, size))
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, file)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return "", fmt.Errorf("archiving message: %w", err)
+	}
+	df, err := os.Open(dir)
+	if err != nil {
+		return "", fmt.Errorf("syncing archive directory: %w", err)
+	}
+	defer df.Close()
+	if err := df.Sync(); err != nil {
+		return "", fmt.Errorf("syncing archive directory: %w", err)
+	}
+	return file, nil
+}
+
+// Find returns the keys of the files under <dir>/<mailbox>/*/ holding the
+// message, oldest first.
+func (d Dir) Find(mailbox, uid string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(string(d), filepath.FromSlash(mailbox)))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("searching the archive: %w", err)
+	}
+	name := fileName(uid)
+	var keys []string
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		key := path.Join(mailbox, e.Name(), name)
+		if _, err := os.Stat(filepath.Join(string(d), filepath.FromSlash(key))); err == nil {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// Get reads the file <dir>/<key>.
+func (d Dir) Get(key string) ([]byte, error) {
+	msg, err := os.ReadFile(filepath.Join(string(d), filepath.FromSlash(key)))
+	if err != nil {
+		return nil, fmt.Errorf("reading archived message: %w", err)
+	}
+	return msg, nil
+}
@@ -0,0 +1,79 @@
+package archive
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKey(t *testing.T) {
+	date := time.Date(2024, 5, 1, 23, 59, 0, 0, time.UTC)
+	for uid, want := range map[string]string{
+		"AGb2aXkAAABk": "AGb2aXkAAABk.eml",
+		"a/b\\c:d":     "a_b_c_d.eml",
+		"..":           "_...eml",
+		"1 2\x00é":     "1_2__.eml",
+	} {
+		if got := Key("user@yahoo.com", uid, date); got != "user@yahoo.com/2024-05-01/"+want {
+			t.Errorf("Key(%q) = %q", uid, got)
+		}
+	}
+}
+
+func TestDir(t *testing.T) {
+	dir := t.TempDir()
+	key := Key("user@yahoo.com", "uid1", time.Now())
+	raw := "Subject: hi\r\n\r\nbody\r\n"
+	if _, err := Dir(dir).Put(key, strings.NewReader(raw), int64(len(raw))); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	// A retry of the same message replaces the copy.
+	path, err := Dir(dir).Put(key, strings.NewReader(raw), int64(len(raw)))
+	if err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if path != filepath.Join(dir, filepath.FromSlash(key)) {
+		t.Errorf("unexpected path %q", path)
+	}
+	got, err := os.ReadFile(path)
+	if err != nil || string(got) != raw {
+		t.Errorf("archived message = %q (%v)", got, err)
+	}
+	entries, _ := os.ReadDir(filepath.Dir(path))
+	if len(entries) != 1 {
+		t.Errorf("expected only the message in the archive, got %v", entries)
+	}
+}
+
+func TestDirFind(t *testing.T) {
+	d := Dir(t.TempDir())
+	raw := "Subject: hi\r\n\r\nbody\r\n"
+	for _, key := range []string{
+		Key("user@yahoo.com", "uid1", time.Date(2024, 5, 2, 0, 0, 0, 0, time.UTC)),
+		Key("user@yahoo.com", "uid1", time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)),
+		Key("user@yahoo.com", "uid2", time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)),
+		Key("other@yahoo.com", "uid1", time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)),
+	} {
+		if _, err := d.Put(key, strings.NewReader(raw), int64(len(raw))); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+
+	keys, err := d.Find("user@yahoo.com", "uid1")
+	if err != nil {
+		t.Fatalf("Find failed: %v", err)
+	}
+	want := []string{"user@yahoo.com/2024-05-01/uid1.eml", "user@yahoo.com/2024-05-02/uid1.eml"}
+	if !slices.Equal(keys, want) {
+		t.Errorf("Find() = %q, want %q", keys, want)
+	}
+	if got, err := d.Get(keys[0]); err != nil || string(got) != raw {
+		t.Errorf("Get() = %q (%v)", got, err)
+	}
+	if keys, err := d.Find("new@yahoo.com", "uid1"); err != nil || len(keys) != 0 {
+		t.Errorf("expected nothing archived for a new mailbox, got %q (%v)", keys, err)
+	}
+}
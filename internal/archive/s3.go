@@ -0,0 +1,372 @@
+package archive
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3 is a Store that uploads messages to a bucket of an S3-compatible
+// service, such as AWS S3, MinIO, or Backblaze B2, signing requests with
+// AWS Signature Version 4.
+type S3 struct {
+	// Endpoint is the service's base URL, such as
+	// "https://s3.eu-west-1.amazonaws.com".
+	Endpoint string
+	// Region is the region requests are signed for.
+	Region string
+	Bucket string
+	// Prefix is prepended to every key, such as "yatogm/".
+	Prefix          string
+	AccessKeyID     string
+	SecretAccessKey string
+	// PathStyle addresses the bucket as <endpoint>/<bucket>/<key> rather
+	// than <bucket>.<endpoint host>/<key>, as most self-hosted services
+	// need.
+	PathStyle bool
+	// ServerSideEncryption, when set, asks the service to encrypt objects
+	// at rest: "AES256" or "aws:kms".
+	ServerSideEncryption string
+	// KMSKeyID is the KMS key used with "aws:kms", or the bucket's default
+	// key if empty.
+	KMSKeyID string
+	// Attempts is the total number of upload attempts; values below 2
+	// disable retries. Network errors, 5xx responses, and 429 responses
+	// are retried.
+	Attempts int
+	// Backoff is the pause before the first retry, doubling for each
+	// further one up to MaxBackoff, if set, and randomized by up to Jitter
+	// (0 to 1) of it.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	Jitter     float64
+	// HTTPClient is used for requests, or http.DefaultClient if nil.
+	HTTPClient *http.Client
+
+	// now and sleep are replaced in tests.
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+// Put uploads the message as the object <prefix><key> and returns its
+// s3:// URL.
+func (s *S3) Put(key string, msg io.ReaderAt, size int64) (string, error) {
+	key = s.Prefix + key
+	location := "s3://" + s.Bucket + "/" + key
+
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(msg, 0, size)); err != nil {
+		return "", fmt.Errorf("archiving to %s: %w", location, err)
+	}
+	payloadHash := hex.EncodeToString(h.Sum(nil))
+
+	sleep := s.sleep
+	if sleep == nil {
+		sleep = time.Sleep
+	}
+	for attempt := 1; ; attempt++ {
+		err := s.put(key, msg, size, payloadHash)
+		if err == nil {
+			return location, nil
+		}
+		if attempt >= max(s.Attempts, 1) || !retryableS3(err) {
+			return "", fmt.Errorf("archiving to %s: %w", location, err)
+		}
+		sleep(s.delay(attempt))
+	}
+}
+
+// put makes a single upload attempt.
+func (s *S3) put(key string, msg io.ReaderAt, size int64, payloadHash string) error {
+	u, err := s.objectURL(key)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPut, u.String(), io.NewSectionReader(msg, 0, size))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "message/rfc822")
+	if s.ServerSideEncryption != "" {
+		req.Header.Set("X-Amz-Server-Side-Encryption", s.ServerSideEncryption)
+		if s.KMSKeyID != "" {
+			req.Header.Set("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id", s.KMSKeyID)
+		}
+	}
+	now := time.Now
+	if s.now != nil {
+		now = s.now
+	}
+	s.sign(req, payloadHash, now())
+
+	client := s.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return &StatusError{Code: resp.StatusCode, Body: strings.TrimSpace(string(body))}
+	}
+	return nil
+}
+
+// Find lists the objects under <prefix><mailbox>/ and returns the keys,
+// without the prefix, of those holding the message, oldest first.
+func (s *S3) Find(mailbox, uid string) ([]string, error) {
+	u, err := s.objectURL("")
+	if err != nil {
+		return nil, err
+	}
+	name := fileName(uid)
+	var (
+		keys  []string
+		token string
+	)
+	for {
+		q := url.Values{"list-type": {"2"}, "prefix": {s.Prefix + mailbox + "/"}}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		u.RawQuery = strings.ReplaceAll(q.Encode(), "+", "%20")
+		body, err := s.get(u)
+		if err != nil {
+			return nil, fmt.Errorf("searching s3://%s: %w", s.Bucket, err)
+		}
+		var page struct {
+			Contents []struct {
+				Key string
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		if err := xml.Unmarshal(body, &page); err != nil {
+			return nil, fmt.Errorf("searching s3://%s: %w", s.Bucket, err)
+		}
+		for _, c := range page.Contents {
+			key := strings.TrimPrefix(c.Key, s.Prefix)
+			if m, n, ok := parseKey(key); ok && m == mailbox && n == name {
+				keys = append(keys, key)
+			}
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return keys, nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+// Get downloads the object <prefix><key>.
+func (s *S3) Get(key string) ([]byte, error) {
+	location := "s3://" + s.Bucket + "/" + s.Prefix + key
+	u, err := s.objectURL(s.Prefix + key)
+	if err != nil {
+		return nil, err
+	}
+	msg, err := s.get(u)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", location, err)
+	}
+	return msg, nil
+}
+
+// get makes a signed GET request, retried as uploads are, and returns the
+// response body.
+func (s *S3) get(u *url.URL) ([]byte, error) {
+	sleep := s.sleep
+	if sleep == nil {
+		sleep = time.Sleep
+	}
+	now := time.Now
+	if s.now != nil {
+		now = s.now
+	}
+	client := s.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	for attempt := 1; ; attempt++ {
+		body, err := func() ([]byte, error) {
+			req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+			if err != nil {
+				return nil, err
+			}
+			s.sign(req, hexSHA256(""), now())
+			resp, err := client.Do(req)
+			if err != nil {
+				return nil, err
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode/100 != 2 {
+				body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+				return nil, &StatusError{Code: resp.StatusCode, Body: strings.TrimSpace(string(body))}
+			}
+			return io.ReadAll(resp.Body)
+		}()
+		if err == nil || attempt >= max(s.Attempts, 1) || !retryableS3(err) {
+			return body, err
+		}
+		sleep(s.delay(attempt))
+	}
+}
+
+// objectURL returns the URL of the object named key.
+func (s *S3) objectURL(key string) (*url.URL, error) {
+	u, err := url.Parse(s.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid endpoint: %w", err)
+	}
+	if s.PathStyle {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.Bucket + "/" + key
+	} else {
+		u.Host = s.Bucket + "." + u.Host
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + key
+	}
+	u.RawPath = uriEncode(u.Path, false)
+	return u, nil
+}
+
+// StatusError is an unsuccessful response from the service.
+type StatusError struct {
+	Code int
+	// Body is the start of the response body, usually an XML error
+	// document.
+	Body string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("HTTP %d: %s", e.Code, e.Body)
+}
+
+// retryableS3 reports whether a failed upload may succeed if retried.
+func retryableS3(err error) bool {
+	var se *StatusError
+	if errors.As(err, &se) {
+		return se.Code >= 500 || se.Code == http.StatusTooManyRequests
+	}
+	var netErr net.Error
+	var urlErr *url.Error
+	return errors.As(err, &netErr) || errors.As(err, &urlErr) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// delay returns the pause before the given retry, counted from 1.
+func (s *S3) delay(retry int) time.Duration {
+	d := s.Backoff
+	for i := 1; i < retry && (s.MaxBackoff == 0 || d < s.MaxBackoff); i++ {
+		d *= 2
+	}
+	if s.MaxBackoff > 0 && d > s.MaxBackoff {
+		d = s.MaxBackoff
+	}
+	if s.Jitter > 0 {
+		d += time.Duration((2*rand.Float64() - 1) * s.Jitter * float64(d))
+	}
+	return max(d, 0)
+}
+
+// sign adds the headers of AWS Signature Version 4 to req, signing the
+// Host and Range headers and every X-Amz-* header.
+func (s *S3) sign(req *http.Request, payloadHash string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") || lower == "range" {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		uriEncode(req.URL.Path, false),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := day + "/" + s.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hexSHA256(canonicalRequest)
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretAccessKey), day)
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.AccessKeyID+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+// canonicalQuery returns the query parameters sorted and encoded as
+// Signature Version 4 requires.
+func canonicalQuery(q url.Values) string {
+	pairs := make([]string, 0, len(q))
+	for k, vs := range q {
+		for _, v := range vs {
+			pairs = append(pairs, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// uriEncode percent-encodes every byte of s other than unreserved
+// characters, and "/" unless encodeSlash is set.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hexSHA256(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(data))
+	return m.Sum(nil)
+}
@@ -0,0 +1,80 @@
+// Package audit appends a JSONL record for every administrative action,
+// such as a configuration reload or a state prune, separately from the
+// message-level logs and receipts.
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"time"
+)
+
+// Outcomes of an action.
+const (
+	Succeeded = "succeeded"
+	Failed    = "failed"
+)
+
+// Record describes one administrative action.
+type Record struct {
+	Time time.Time `json:"time"`
+	// Actor is who or what triggered the action, such as the operating
+	// system user running a command or the signal that caused a reload.
+	Actor string `json:"actor"`
+	// Action names the action, e.g. "config.reload", "state.prune", or
+	// "mailbox.drain".
+	Action string `json:"action"`
+	// Target is what the action applied to, such as a file or mailbox.
+	Target string `json:"target,omitempty"`
+	// ID is the yatogm ID of the message the action applied to, if any,
+	// as in the logs and receipts about it.
+	ID string `json:"yatogm_id,omitempty"`
+	// Outcome is Succeeded or Failed.
+	Outcome string `json:"outcome"`
+	// Detail describes the result or, for a failed action, the error.
+	Detail string `json:"detail,omitempty"`
+}
+
+// Append adds r to the audit log at path as a single line, creating the
+// file and its directory if needed. A zero r.Time is set to the current
+// time. The file is only ever appended to, and is synced before Append
+// returns.
+func Append(path string, r Record) error {
+	if r.Time.IsZero() {
+		r.Time = time.Now().UTC()
+	}
+	line, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("marshaling audit record: %w", err)
+	}
+	line = append(line, '\n')
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("creating audit log directory: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("opening audit log: %w", err)
+	}
+	if _, err := f.Write(line); err != nil {
+		f.Close()
+		return fmt.Errorf("writing audit log: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("syncing audit log: %w", err)
+	}
+	return f.Close()
+}
+
+// CurrentUser returns the name of the operating system user running the
+// process, or its user ID if the name cannot be looked up.
+func CurrentUser() string {
+	if u, err := user.Current(); err == nil && u.Username != "" {
+		return u.Username
+	}
+	return fmt.Sprintf("uid %d", os.Getuid())
+}
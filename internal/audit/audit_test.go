@@ -0,0 +1,56 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAppend(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit", "audit.jsonl")
+	at := time.Date(2024, 5, 1, 14, 32, 0, 0, time.UTC)
+
+	if err := Append(path, Record{Time: at, Actor: "SIGHUP", Action: "config.reload", Target: "/config/config.yml", Outcome: Succeeded}); err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+	if err := Append(path, Record{Actor: "root", Action: "message.restore", Target: "user@yahoo.com/uid1", ID: "01HX3J5Q8W4Z6N2RMB7T0KCD9E", Outcome: Failed, Detail: "disk full"}); err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var records []Record
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r Record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatalf("invalid line %q: %v", scanner.Text(), err)
+		}
+		records = append(records, r)
+	}
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records, got %d", len(records))
+	}
+	if !records[0].Time.Equal(at) || records[0].Action != "config.reload" || records[0].Outcome != Succeeded {
+		t.Errorf("unexpected first record %+v", records[0])
+	}
+	if records[1].Time.IsZero() || records[1].Detail != "disk full" || records[1].ID != "01HX3J5Q8W4Z6N2RMB7T0KCD9E" {
+		t.Errorf("expected the time to be filled in and the detail and ID kept, got %+v", records[1])
+	}
+
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("expected a 0600 audit log, got %v, %v", fi.Mode(), err)
+	}
+}
+
+func TestCurrentUser(t *testing.T) {
+	if CurrentUser() == "" {
+		t.Error("expected a user")
+	}
+}
@@ -0,0 +1,132 @@
+// Package clock abstracts telling the time and waiting, so that timeouts,
+// backoff, and scheduling can be tested without waiting in real time.
+package clock
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Clock tells the time and waits.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// Sleep pauses for d.
+	Sleep(d time.Duration)
+	// SleepContext pauses for d, or until ctx is done, and then returns
+	// ctx's error.
+	SleepContext(ctx context.Context, d time.Duration) error
+	// After returns a channel that receives the time once d has passed.
+	After(d time.Duration) <-chan time.Time
+}
+
+// System is the system's clock.
+var System Clock = system{}
+
+type system struct{}
+
+func (system) Now() time.Time                         { return time.Now() }
+func (system) Sleep(d time.Duration)                  { time.Sleep(d) }
+func (system) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+func (system) SleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+	case <-t.C:
+	}
+	return ctx.Err()
+}
+
+// Fake is a Clock whose time only moves when it is advanced. Sleep
+// advances it rather than waiting, and records how long it slept, so that
+// code sleeping on it runs at once. It is safe for concurrent use.
+type Fake struct {
+	mu     sync.Mutex
+	now    time.Time
+	slept  []time.Duration
+	timers []timer
+}
+
+// timer is a channel returned by After, waiting for its time.
+type timer struct {
+	at time.Time
+	c  chan time.Time
+}
+
+// NewFake returns a Fake set to now.
+func NewFake(now time.Time) *Fake {
+	return &Fake{now: now}
+}
+
+// Now returns the fake time.
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+// Sleep advances the fake time by d and records d.
+func (f *Fake) Sleep(d time.Duration) {
+	f.mu.Lock()
+	f.slept = append(f.slept, d)
+	f.mu.Unlock()
+	f.Advance(d)
+}
+
+// SleepContext is like Sleep, but returns ctx's error without sleeping if
+// ctx is done already.
+func (f *Fake) SleepContext(ctx context.Context, d time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	f.Sleep(d)
+	return nil
+}
+
+// Slept returns the durations passed to Sleep, in order.
+func (f *Fake) Slept() []time.Duration {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]time.Duration(nil), f.slept...)
+}
+
+// After returns a channel that receives the fake time once Advance has
+// moved it d ahead, or at once if d is not positive.
+func (f *Fake) After(d time.Duration) <-chan time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c := make(chan time.Time, 1)
+	if d <= 0 {
+		c <- f.now
+		return c
+	}
+	f.timers = append(f.timers, timer{at: f.now.Add(d), c: c})
+	return c
+}
+
+// Advance moves the fake time d ahead, firing the channels from After
+// whose time has come.
+func (f *Fake) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = f.now.Add(d)
+	pending := f.timers[:0]
+	for _, t := range f.timers {
+		if t.at.After(f.now) {
+			pending = append(pending, t)
+			continue
+		}
+		t.c <- f.now
+	}
+	f.timers = pending
+}
+
+// Waiting returns the number of channels from After still waiting.
+func (f *Fake) Waiting() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.timers)
+}
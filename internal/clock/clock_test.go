@@ -0,0 +1,57 @@
+package clock
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestFake(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	f := NewFake(start)
+
+	f.Sleep(time.Second)
+	f.Sleep(2 * time.Second)
+	if got := f.Now(); !got.Equal(start.Add(3 * time.Second)) {
+		t.Errorf("Now = %v after sleeping 3s", got)
+	}
+	if got := f.Slept(); !slices.Equal(got, []time.Duration{time.Second, 2 * time.Second}) {
+		t.Errorf("Slept = %v", got)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := f.SleepContext(ctx, time.Second); !errors.Is(err, context.Canceled) || len(f.Slept()) != 2 {
+		t.Errorf("SleepContext with a canceled context = %v, slept %v", err, f.Slept())
+	}
+
+	c := f.After(time.Minute)
+	f.Advance(59 * time.Second)
+	select {
+	case <-c:
+		t.Fatal("After fired early")
+	default:
+	}
+	if f.Waiting() != 1 {
+		t.Errorf("Waiting = %d, want 1", f.Waiting())
+	}
+	f.Advance(time.Second)
+	select {
+	case got := <-c:
+		if !got.Equal(start.Add(time.Minute + 3*time.Second)) {
+			t.Errorf("After fired with %v", got)
+		}
+	default:
+		t.Fatal("After did not fire")
+	}
+	if f.Waiting() != 0 {
+		t.Errorf("Waiting = %d, want 0", f.Waiting())
+	}
+
+	select {
+	case <-f.After(0):
+	default:
+		t.Error("After(0) did not fire at once")
+	}
+}
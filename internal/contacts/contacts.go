@@ -0,0 +1,182 @@
+// Package contacts reads the contacts exported from Yahoo Mail as CSV, and
+// turns them into rules delivering mail from known correspondents and into
+// Gmail filters labeling it by contact category.
+package contacts
+
+import (
+	"encoding/csv"
+	"errors"
+	"io"
+	"net/mail"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/benj-n/yatogm/internal/config"
+	"github.com/benj-n/yatogm/internal/gmailfilter"
+	"github.com/benj-n/yatogm/internal/rules"
+)
+
+// Contact is a correspondent from the address book.
+type Contact struct {
+	Name string
+	// Emails are the contact's addresses, lowercased.
+	Emails []string
+	// Categories are the Yahoo categories, or groups, the contact is in.
+	Categories []string
+}
+
+// Parse reads a contacts CSV file as Yahoo Mail exports it, whose first
+// row names the columns. Every column whose name mentions "email" is read
+// as an address, and "Category", "Categories", "Groups", or "Distribution
+// Lists" as categories, separated by commas or semicolons. Contacts
+// without a valid address are left out.
+func Parse(r io.Reader) ([]Contact, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.LazyQuotes = true
+	header, err := cr.Read()
+	if errors.Is(err, io.EOF) {
+		return nil, errors.New("empty file")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var emails, categories []int
+	names := map[string]int{}
+	for i, h := range header {
+		h = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(h, "\ufeff")))
+		switch {
+		case strings.Contains(strings.ReplaceAll(h, "-", ""), "email"):
+			emails = append(emails, i)
+		case h == "category" || h == "categories" || h == "groups" || h == "distribution lists":
+			categories = append(categories, i)
+		case h == "first" || h == "first name" || h == "last" || h == "last name" || h == "nickname" || h == "name":
+			names[h] = i
+		}
+	}
+	if len(emails) == 0 {
+		return nil, errors.New("no email column in the header")
+	}
+
+	var out []Contact
+	for {
+		row, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			return out, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		var c Contact
+		for _, i := range emails {
+			if i >= len(row) || strings.TrimSpace(row[i]) == "" {
+				continue
+			}
+			addr, err := mail.ParseAddress(row[i])
+			if err != nil {
+				continue
+			}
+			if a := strings.ToLower(addr.Address); !slices.Contains(c.Emails, a) {
+				c.Emails = append(c.Emails, a)
+			}
+		}
+		if len(c.Emails) == 0 {
+			continue
+		}
+		for _, i := range categories {
+			if i >= len(row) {
+				continue
+			}
+			for _, cat := range strings.FieldsFunc(row[i], func(r rune) bool { return r == ',' || r == ';' }) {
+				if cat = strings.TrimSpace(cat); cat != "" && !slices.Contains(c.Categories, cat) {
+					c.Categories = append(c.Categories, cat)
+				}
+			}
+		}
+		c.Name = name(row, names)
+		out = append(out, c)
+	}
+}
+
+// name returns a contact's display name from whichever name columns the
+// file has.
+func name(row []string, cols map[string]int) string {
+	field := func(names ...string) string {
+		for _, n := range names {
+			if i, ok := cols[n]; ok && i < len(row) && strings.TrimSpace(row[i]) != "" {
+				return strings.TrimSpace(row[i])
+			}
+		}
+		return ""
+	}
+	if n := strings.TrimSpace(field("first", "first name") + " " + field("last", "last name")); n != "" {
+		return n
+	}
+	return field("name", "nickname")
+}
+
+// Addresses returns the distinct addresses of contacts, sorted.
+func Addresses(contacts []Contact) []string {
+	var addrs []string
+	for _, c := range contacts {
+		addrs = append(addrs, c.Emails...)
+	}
+	slices.Sort(addrs)
+	return slices.Compact(addrs)
+}
+
+// Rule returns a rule named name delivering the messages from contacts,
+// so that the rules after it, such as one archiving spam, make an exception
+// for them. It is compiled to make sure it is valid.
+func Rule(name string, contacts []Contact) (config.RuleConfig, error) {
+	addrs := Addresses(contacts)
+	if len(addrs) == 0 {
+		return config.RuleConfig{}, errors.New("no contacts with an email address")
+	}
+	conds := make([]string, len(addrs))
+	for i, a := range addrs {
+		conds[i] = "from == " + strconv.Quote(a)
+	}
+	rc := config.RuleConfig{Name: name, If: strings.Join(conds, " ||\n"), Action: string(rules.Deliver)}
+	if _, err := rules.New(rc.Name, rc.If, rules.Action(rc.Action)); err != nil {
+		return config.RuleConfig{}, err
+	}
+	return rc, nil
+}
+
+// Categories returns the addresses of the contacts in each category.
+func Categories(contacts []Contact) map[string][]string {
+	out := make(map[string][]string)
+	for _, c := range contacts {
+		for _, cat := range c.Categories {
+			out[cat] = append(out[cat], c.Emails...)
+		}
+	}
+	for cat, addrs := range out {
+		slices.Sort(addrs)
+		out[cat] = slices.Compact(addrs)
+	}
+	return out
+}
+
+// WriteGmailFilters writes, for each category with contacts, Gmail filters
+// labeling the messages from them with the category's name, in the format
+// Gmail imports filters from.
+func WriteGmailFilters(w io.Writer, contacts []Contact) error {
+	cats := Categories(contacts)
+	names := make([]string, 0, len(cats))
+	for cat := range cats {
+		names = append(names, cat)
+	}
+	slices.Sort(names)
+
+	var filters []gmailfilter.Filter
+	for _, cat := range names {
+		for _, from := range gmailfilter.FromAny(cats[cat]) {
+			filters = append(filters, gmailfilter.Filter{From: from, Label: cat})
+		}
+	}
+	return gmailfilter.Write(w, filters)
+}
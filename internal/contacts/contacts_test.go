@@ -0,0 +1,117 @@
+package contacts
+
+import (
+	"bytes"
+	"encoding/xml"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/benj-n/yatogm/internal/rules"
+)
+
+// yahooExport is a contacts file in the layout Yahoo Mail exports.
+const yahooExport = "\ufeffFirst,Middle,Last,Nickname,Email,Category,Distribution Lists,Alternate Email 1,Home Phone\r\n" +
+	"Ada,,Lovelace,,Ada@Example.com,Family,,ada@work.example,\r\n" +
+	"Charles,,Babbage,,charles@example.org,\"Family,Friends\",Engine club,,555-0100\r\n" +
+	",,,Bob,bob@example.net,,,,\r\n" +
+	"No,,Address,,,Friends,,,\r\n" +
+	"Bad,,Address,,not an address,,,,\r\n"
+
+func TestParse(t *testing.T) {
+	got, err := Parse(strings.NewReader(yahooExport))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	want := []Contact{
+		{Name: "Ada Lovelace", Emails: []string{"ada@example.com", "ada@work.example"}, Categories: []string{"Family"}},
+		{Name: "Charles Babbage", Emails: []string{"charles@example.org"}, Categories: []string{"Family", "Friends", "Engine club"}},
+		{Name: "Bob", Emails: []string{"bob@example.net"}},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d contacts, want %d: %+v", len(got), len(want), got)
+	}
+	for i := range want {
+		if got[i].Name != want[i].Name || !slices.Equal(got[i].Emails, want[i].Emails) || !slices.Equal(got[i].Categories, want[i].Categories) {
+			t.Errorf("contact %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+
+	for _, bad := range []string{"", "First,Last,Phone\r\nAda,Lovelace,555\r\n"} {
+		if _, err := Parse(strings.NewReader(bad)); err == nil {
+			t.Errorf("Parse(%q): expected an error", bad)
+		}
+	}
+}
+
+func TestRule(t *testing.T) {
+	list, err := Parse(strings.NewReader(yahooExport))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc, err := Rule("contacts", list)
+	if err != nil {
+		t.Fatalf("Rule failed: %v", err)
+	}
+	if rc.Name != "contacts" || rc.Action != "deliver" || strings.Count(rc.If, "from ==") != 4 {
+		t.Errorf("unexpected rule: %+v", rc)
+	}
+	r, err := rules.New(rc.Name, rc.If, rules.Action(rc.Action))
+	if err != nil {
+		t.Fatal(err)
+	}
+	set := rules.Set{r}
+	for from, match := range map[string]bool{"ada@work.example": true, "BOB@example.net": true, "eve@example.com": false} {
+		msg := []byte("From: " + from + "\r\nSubject: hi\r\n\r\nbody\r\n")
+		if _, ok := set.Match("user@yahoo.com", bytes.NewReader(msg), int64(len(msg))); ok != match {
+			t.Errorf("message from %s matched = %v, want %v", from, ok, match)
+		}
+	}
+
+	if _, err := Rule("contacts", nil); err == nil {
+		t.Error("expected an error without contacts")
+	}
+}
+
+func TestWriteGmailFilters(t *testing.T) {
+	list, err := Parse(strings.NewReader(yahooExport))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := WriteGmailFilters(&buf, list); err != nil {
+		t.Fatalf("WriteGmailFilters failed: %v", err)
+	}
+	var feed struct {
+		Entries []struct {
+			Category struct {
+				Term string `xml:"term,attr"`
+			} `xml:"category"`
+			Properties []struct {
+				Name  string `xml:"name,attr"`
+				Value string `xml:"value,attr"`
+			} `xml:"property"`
+		} `xml:"entry"`
+	}
+	if err := xml.Unmarshal(buf.Bytes(), &feed); err != nil {
+		t.Fatalf("invalid XML: %v\n%s", err, buf.String())
+	}
+	var got []string
+	for _, e := range feed.Entries {
+		if e.Category.Term != "filter" || len(e.Properties) != 2 {
+			t.Fatalf("unexpected entry: %+v", e)
+		}
+		got = append(got, e.Properties[1].Value+": "+e.Properties[0].Value)
+	}
+	want := []string{
+		"Engine club: charles@example.org",
+		"Family: ada@example.com OR ada@work.example OR charles@example.org",
+		"Friends: charles@example.org",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("filters = %q, want %q", got, want)
+	}
+	if !strings.Contains(buf.String(), "<apps:property") {
+		t.Errorf("expected apps:property elements, got %s", buf.String())
+	}
+}
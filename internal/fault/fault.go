@@ -0,0 +1,192 @@
+// Package fault implements opt-in fault injection for resilience testing.
+//
+// Faults are disabled unless an Injector is installed with Enable, which
+// cmd/yatogm does when the YATOGM_FAULTS environment variable or -faults flag
+// is set. The spec is a comma-separated list of key=value pairs:
+//
+//	drop=0.01      probability a network read or write drops the connection
+//	delay=0.05     probability a network read or write is delayed
+//	delay_max=2s   upper bound for an injected delay (default 1s)
+//	corrupt=0.01   probability a state file write is corrupted
+//	seed=42        random seed (default: time-based)
+//
+// Hooks in the pop3, smtp, and state packages are no-ops when disabled.
+package fault
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// EnvVar is the environment variable holding the fault spec.
+const EnvVar = "YATOGM_FAULTS"
+
+// ErrInjected is returned by operations failed on purpose.
+var ErrInjected = errors.New("fault injected")
+
+// Injector decides when to inject faults.
+type Injector struct {
+	// Drop is the probability that a network operation drops the connection.
+	Drop float64
+	// Delay is the probability that a network operation is delayed.
+	Delay float64
+	// DelayMax bounds injected delays.
+	DelayMax time.Duration
+	// Corrupt is the probability that a state write is corrupted.
+	Corrupt float64
+
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+var active atomic.Pointer[Injector]
+
+// Enable installs inj as the process-wide injector. A nil inj disables
+// fault injection.
+func Enable(inj *Injector) {
+	active.Store(inj)
+}
+
+// Enabled reports whether fault injection is active.
+func Enabled() bool {
+	return active.Load() != nil
+}
+
+// Parse builds an Injector from a spec string.
+func Parse(spec string) (*Injector, error) {
+	inj := &Injector{DelayMax: time.Second}
+	seed := time.Now().UnixNano()
+
+	for _, field := range strings.Split(spec, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return nil, fmt.Errorf("fault spec %q: expected key=value", field)
+		}
+		var err error
+		switch key {
+		case "drop":
+			inj.Drop, err = parseProbability(value)
+		case "delay":
+			inj.Delay, err = parseProbability(value)
+		case "corrupt":
+			inj.Corrupt, err = parseProbability(value)
+		case "delay_max":
+			inj.DelayMax, err = time.ParseDuration(value)
+		case "seed":
+			seed, err = strconv.ParseInt(value, 10, 64)
+		default:
+			err = fmt.Errorf("unknown key")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("fault spec %q: %w", field, err)
+		}
+	}
+
+	inj.rng = rand.New(rand.NewSource(seed))
+	return inj, nil
+}
+
+func parseProbability(s string) (float64, error) {
+	p, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	if p < 0 || p > 1 {
+		return 0, fmt.Errorf("probability must be between 0 and 1")
+	}
+	return p, nil
+}
+
+// String returns the spec form of the injector's settings.
+func (inj *Injector) String() string {
+	return fmt.Sprintf("drop=%g,delay=%g,delay_max=%s,corrupt=%g", inj.Drop, inj.Delay, inj.DelayMax, inj.Corrupt)
+}
+
+func (inj *Injector) chance(p float64) bool {
+	if p <= 0 {
+		return false
+	}
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+	return inj.rng.Float64() < p
+}
+
+func (inj *Injector) delay() time.Duration {
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+	if inj.DelayMax <= 0 {
+		return 0
+	}
+	return time.Duration(inj.rng.Int63n(int64(inj.DelayMax)))
+}
+
+// Conn wraps c so that reads and writes are randomly delayed or dropped.
+// It returns c unchanged when fault injection is disabled.
+func Conn(c net.Conn) net.Conn {
+	inj := active.Load()
+	if inj == nil || (inj.Drop <= 0 && inj.Delay <= 0) {
+		return c
+	}
+	return &faultConn{Conn: c, inj: inj}
+}
+
+type faultConn struct {
+	net.Conn
+	inj *Injector
+}
+
+func (c *faultConn) Read(p []byte) (int, error) {
+	if err := c.perturb(); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *faultConn) Write(p []byte) (int, error) {
+	if err := c.perturb(); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(p)
+}
+
+func (c *faultConn) perturb() error {
+	if c.inj.chance(c.inj.Delay) {
+		time.Sleep(c.inj.delay())
+	}
+	if c.inj.chance(c.inj.Drop) {
+		c.Conn.Close()
+		return fmt.Errorf("connection dropped: %w", ErrInjected)
+	}
+	return nil
+}
+
+// CorruptWrite returns data, or when a corruption fault fires, a damaged
+// copy of it (truncated or with flipped bytes). The input is never modified.
+func CorruptWrite(data []byte) []byte {
+	inj := active.Load()
+	if inj == nil || !inj.chance(inj.Corrupt) || len(data) == 0 {
+		return data
+	}
+
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+	if inj.rng.Intn(2) == 0 {
+		return append([]byte(nil), data[:inj.rng.Intn(len(data))]...)
+	}
+	out := append([]byte(nil), data...)
+	for i := 0; i < 1+inj.rng.Intn(8); i++ {
+		out[inj.rng.Intn(len(out))] ^= byte(1 + inj.rng.Intn(255))
+	}
+	return out
+}
@@ -0,0 +1,77 @@
+package fault
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	inj, err := Parse("drop=0.1, delay=0.5,delay_max=250ms,corrupt=1,seed=7")
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if inj.Drop != 0.1 || inj.Delay != 0.5 || inj.Corrupt != 1 {
+		t.Errorf("unexpected probabilities: %s", inj)
+	}
+	if inj.DelayMax != 250*time.Millisecond {
+		t.Errorf("expected delay_max 250ms, got %s", inj.DelayMax)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, spec := range []string{"drop", "drop=2", "delay=-0.1", "delay_max=soon", "bogus=1"} {
+		if _, err := Parse(spec); err == nil {
+			t.Errorf("Parse(%q): expected error", spec)
+		}
+	}
+}
+
+func TestDisabledIsNoop(t *testing.T) {
+	Enable(nil)
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	if Conn(c1) != c1 {
+		t.Error("expected Conn to return the connection unchanged")
+	}
+
+	data := []byte("state")
+	if got := CorruptWrite(data); !bytes.Equal(got, data) {
+		t.Errorf("expected data unchanged, got %q", got)
+	}
+}
+
+func TestDropConn(t *testing.T) {
+	inj, _ := Parse("drop=1,seed=1")
+	Enable(inj)
+	defer Enable(nil)
+
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	fc := Conn(c1)
+
+	_, err := fc.Write([]byte("hello"))
+	if !errors.Is(err, ErrInjected) {
+		t.Fatalf("expected injected error, got %v", err)
+	}
+}
+
+func TestCorruptWrite(t *testing.T) {
+	inj, _ := Parse("corrupt=1,seed=1")
+	Enable(inj)
+	defer Enable(nil)
+
+	data := []byte(`{"mailboxes":{"a@yahoo.com":{"fetched_uids":{"uid1":true}}}}`)
+	orig := append([]byte(nil), data...)
+	got := CorruptWrite(data)
+	if bytes.Equal(got, data) {
+		t.Error("expected corrupted output")
+	}
+	if !bytes.Equal(data, orig) {
+		t.Error("input was modified")
+	}
+}
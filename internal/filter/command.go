@@ -0,0 +1,75 @@
+package filter
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// DefaultTimeout bounds each run of a Command without a Timeout.
+const DefaultTimeout = 30 * time.Second
+
+// Command is a Filter run as an external command, once per message, such
+// as a script or a WASM runtime running a module. The message is written
+// to its standard input, and the source mailbox is in the YATOGM_MAILBOX
+// environment variable. The first line it writes to standard output is the
+// verdict, "deliver" or "archive"; anything after that line is the message
+// to deliver instead. Exiting with a non-zero status is a failure, and the
+// message is left on the server for the next run.
+type Command struct {
+	// Args is the command and its arguments.
+	Args []string
+	// Timeout bounds each run (default: DefaultTimeout).
+	Timeout time.Duration
+}
+
+// Apply implements Filter.
+func (c Command) Apply(mailbox string, msg []byte) (Verdict, []byte, error) {
+	if len(c.Args) == 0 {
+		return "", nil, errors.New("no command")
+	}
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, c.Args[0], c.Args[1:]...)
+	cmd.Env = append(os.Environ(), "YATOGM_MAILBOX="+mailbox)
+	cmd.Stdin = bytes.NewReader(msg)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	// Children left holding the output open do not outlive the timeout
+	// by much.
+	cmd.WaitDelay = time.Second
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return "", nil, fmt.Errorf("timed out after %s", timeout)
+		}
+		if detail := strings.TrimSpace(stderr.String()); detail != "" {
+			return "", nil, fmt.Errorf("%w: %s", err, lastLine(detail))
+		}
+		return "", nil, err
+	}
+
+	line, rest, found := bytes.Cut(stdout.Bytes(), []byte("\n"))
+	verdict, err := parseVerdict(strings.TrimSpace(string(line)))
+	if err != nil {
+		return "", nil, err
+	}
+	if !found || len(rest) == 0 {
+		return verdict, nil, nil
+	}
+	return verdict, rest, nil
+}
+
+// lastLine returns the last line of s.
+func lastLine(s string) string {
+	return s[strings.LastIndexByte(s, '\n')+1:]
+}
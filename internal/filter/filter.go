@@ -0,0 +1,68 @@
+// Package filter runs external filters over retrieved messages before they
+// are delivered, so that behavior can be extended without forking: Go
+// plugins, loaded into the process, and commands, such as a WASM runtime
+// running a module, fed the message on standard input. A filter decides
+// whether a message is delivered or only archived, and may rewrite it.
+package filter
+
+import "fmt"
+
+// Verdict is what a filter decides about a message.
+type Verdict string
+
+const (
+	// Deliver delivers the message, as it was given or as rewritten.
+	Deliver Verdict = "deliver"
+	// Archive keeps the message in the archive only, without delivering
+	// it.
+	Archive Verdict = "archive"
+)
+
+// parseVerdict returns the Verdict named v.
+func parseVerdict(v string) (Verdict, error) {
+	switch Verdict(v) {
+	case Deliver, Archive:
+		return Verdict(v), nil
+	}
+	return "", fmt.Errorf("unknown verdict %q, want %q or %q", v, Deliver, Archive)
+}
+
+// A Filter decides about, and may rewrite, a message.
+type Filter interface {
+	// Apply returns the verdict about msg, retrieved from mailbox, and the
+	// message to deliver instead, or nil to deliver msg unchanged.
+	Apply(mailbox string, msg []byte) (Verdict, []byte, error)
+}
+
+// Named is a Filter with the name it is logged as.
+type Named struct {
+	Name string
+	Filter
+}
+
+// Chain is a list of filters applied in order.
+type Chain []Named
+
+// Apply applies the filters in order, each to the message the one before
+// delivers, until one archives it, and returns the verdict, the message to
+// deliver instead, or nil if none rewrote it, and the name of the filter
+// that archived the message or failed.
+func (c Chain) Apply(mailbox string, msg []byte) (v Verdict, out []byte, by string, err error) {
+	for _, f := range c {
+		cur := msg
+		if out != nil {
+			cur = out
+		}
+		v, rewritten, err := f.Apply(mailbox, cur)
+		if err != nil {
+			return "", nil, f.Name, err
+		}
+		if v == Archive {
+			return Archive, nil, f.Name, nil
+		}
+		if rewritten != nil {
+			out = rewritten
+		}
+	}
+	return Deliver, out, "", nil
+}
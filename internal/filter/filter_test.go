@@ -0,0 +1,90 @@
+package filter
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// funcFilter is a Filter in a function.
+type funcFilter func(mailbox string, msg []byte) (Verdict, []byte, error)
+
+func (f funcFilter) Apply(mailbox string, msg []byte) (Verdict, []byte, error) {
+	return f(mailbox, msg)
+}
+
+func TestChain(t *testing.T) {
+	tag := funcFilter(func(_ string, msg []byte) (Verdict, []byte, error) {
+		return Deliver, append([]byte("X-Tag: yes\r\n"), msg...), nil
+	})
+	keep := funcFilter(func(string, []byte) (Verdict, []byte, error) { return Deliver, nil, nil })
+	invoices := funcFilter(func(_ string, msg []byte) (Verdict, []byte, error) {
+		if bytes.Contains(msg, []byte("invoice")) {
+			return Archive, nil, nil
+		}
+		return Deliver, nil, nil
+	})
+	broken := funcFilter(func(string, []byte) (Verdict, []byte, error) { return "", nil, errors.New("boom") })
+
+	c := Chain{{"tag", tag}, {"keep", keep}, {"invoices", invoices}}
+	v, out, by, err := c.Apply("me@yahoo.com", []byte("Subject: hi\r\n\r\nbody\r\n"))
+	if err != nil || v != Deliver || by != "" || string(out) != "X-Tag: yes\r\nSubject: hi\r\n\r\nbody\r\n" {
+		t.Errorf("Apply = %s, %q, %q, %v", v, out, by, err)
+	}
+	v, out, by, err = c.Apply("me@yahoo.com", []byte("Subject: invoice\r\n\r\nbody\r\n"))
+	if err != nil || v != Archive || by != "invoices" || out != nil {
+		t.Errorf("Apply = %s, %q, %q, %v", v, out, by, err)
+	}
+	if _, _, by, err := append(c, Named{"broken", broken}).Apply("me@yahoo.com", nil); err == nil || by != "broken" {
+		t.Errorf("expected the broken filter to fail, got %q, %v", by, err)
+	}
+	if v, out, _, err := Chain(nil).Apply("me@yahoo.com", []byte("x")); err != nil || v != Deliver || out != nil {
+		t.Errorf("empty chain: %s, %q, %v", v, out, err)
+	}
+}
+
+func TestPluginFilter(t *testing.T) {
+	f := pluginFilter(func(mailbox string, msg []byte) (string, []byte, error) {
+		return mailbox, nil, nil
+	})
+	if v, _, err := f.Apply("archive", nil); err != nil || v != Archive {
+		t.Errorf("Apply = %s, %v", v, err)
+	}
+	if _, _, err := f.Apply("drop", nil); err == nil {
+		t.Error("expected an unknown verdict to fail")
+	}
+	if _, err := OpenPlugin("testdata/missing.so"); err == nil {
+		t.Error("expected opening a missing plugin to fail")
+	}
+}
+
+func TestCommand(t *testing.T) {
+	msg := []byte("Subject: hi\r\n\r\nbody\r\n")
+	for _, tc := range []struct {
+		script string
+		v      Verdict
+		out    string
+		err    string
+	}{
+		{`cat >/dev/null; echo deliver`, Deliver, "", ""},
+		{`cat >/dev/null; echo "$YATOGM_MAILBOX" | grep -q '^me@yahoo.com$' && echo archive`, Archive, "", ""},
+		{`echo deliver; echo "X-Filtered: yes"; cat`, Deliver, "X-Filtered: yes\nSubject: hi\r\n\r\nbody\r\n", ""},
+		{`echo drop`, "", "", "unknown verdict"},
+		{`echo "bad input" >&2; exit 3`, "", "", "exit status 3: bad input"},
+		{`exec sleep 5`, "", "", "timed out"},
+	} {
+		c := Command{Args: []string{"sh", "-c", tc.script}, Timeout: 200 * time.Millisecond}
+		v, out, err := c.Apply("me@yahoo.com", msg)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%s: expected an error containing %q, got %v", tc.script, tc.err, err)
+			}
+			continue
+		}
+		if err != nil || v != tc.v || string(out) != tc.out {
+			t.Errorf("%s: Apply = %s, %q, %v", tc.script, v, out, err)
+		}
+	}
+}
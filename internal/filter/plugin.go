@@ -0,0 +1,48 @@
+package filter
+
+import (
+	"fmt"
+	"plugin"
+)
+
+// Symbol is the name of the function a filter plugin exports, of type
+// func(mailbox string, msg []byte) (verdict string, out []byte, err error).
+// It only uses built-in types, so that plugins need not import yatogm. The
+// verdict is "deliver" or "archive"; a non-nil out is delivered instead of
+// msg. Plugins are built with "go build -buildmode=plugin", with the same
+// Go version as yatogm, and need a yatogm built with cgo.
+const Symbol = "Filter"
+
+// pluginFilter is a Filter exported by a Go plugin.
+type pluginFilter func(mailbox string, msg []byte) (verdict string, out []byte, err error)
+
+// OpenPlugin loads the Go plugin at path and returns the Filter it
+// exports as Symbol.
+func OpenPlugin(path string) (Filter, error) {
+	p, err := plugin.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	sym, err := p.Lookup(Symbol)
+	if err != nil {
+		return nil, err
+	}
+	f, ok := sym.(func(string, []byte) (string, []byte, error))
+	if !ok {
+		return nil, fmt.Errorf("%s: %s is a %T, not a func(mailbox string, msg []byte) (verdict string, out []byte, err error)", path, Symbol, sym)
+	}
+	return pluginFilter(f), nil
+}
+
+// Apply implements Filter.
+func (f pluginFilter) Apply(mailbox string, msg []byte) (Verdict, []byte, error) {
+	v, out, err := f(mailbox, msg)
+	if err != nil {
+		return "", nil, err
+	}
+	verdict, err := parseVerdict(v)
+	if err != nil {
+		return "", nil, err
+	}
+	return verdict, out, nil
+}
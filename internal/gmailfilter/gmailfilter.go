@@ -0,0 +1,109 @@
+// Package gmailfilter writes Gmail filters in the format Gmail imports them
+// from, under Settings, Filters and Blocked Addresses, "Import filters", and
+// suggests filters from the messages yatogm delivered.
+package gmailfilter
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Filter labels the messages matching its criteria. Its criteria are
+// combined: a message must match all those set.
+type Filter struct {
+	// From matches senders, addresses or "@domain", separated by " OR ".
+	From string
+	// List matches the List-Id of a mailing list's messages.
+	List string
+	// Label is the label applied, created by Gmail if missing; a "/"
+	// nests it under another.
+	Label string
+}
+
+// feed is the Atom feed Gmail imports filters from.
+type feed struct {
+	XMLName xml.Name `xml:"feed"`
+	NS      string   `xml:"xmlns,attr"`
+	AppsNS  string   `xml:"xmlns:apps,attr"`
+	Title   string   `xml:"title"`
+	Entries []entry  `xml:"entry"`
+}
+
+type entry struct {
+	Category   category   `xml:"category"`
+	Title      string     `xml:"title"`
+	Content    string     `xml:"content"`
+	Properties []property `xml:"apps:property"`
+}
+
+type category struct {
+	Term string `xml:"term,attr"`
+}
+
+type property struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+}
+
+// maxFrom bounds the length of the sender criteria of one filter, which
+// Gmail limits.
+const maxFrom = 1000
+
+// Write writes filters in the format Gmail imports them from.
+func Write(w io.Writer, filters []Filter) error {
+	f := feed{
+		NS:     "http://www.w3.org/2005/Atom",
+		AppsNS: "http://schemas.google.com/apps/2006",
+		Title:  "Mail Filters",
+	}
+	for _, filter := range filters {
+		e := entry{Category: category{Term: "filter"}, Title: "Mail Filter"}
+		if filter.From != "" {
+			e.Properties = append(e.Properties, property{Name: "from", Value: filter.From})
+		}
+		if filter.List != "" {
+			e.Properties = append(e.Properties, property{Name: "hasTheWord", Value: "list:" + filter.List})
+		}
+		e.Properties = append(e.Properties, property{Name: "label", Value: filter.Label})
+		f.Entries = append(f.Entries, e)
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(f); err != nil {
+		return fmt.Errorf("writing Gmail filters: %w", err)
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// FromAny returns the sender criteria matching any of addrs, split into as
+// many as needed to keep each within Gmail's limit; each makes a filter.
+func FromAny(addrs []string) []string {
+	return chunk(addrs, maxFrom)
+}
+
+// chunk joins addrs with " OR " into criteria of at most limit bytes
+// each, but for a single longer address.
+func chunk(addrs []string, limit int) []string {
+	var out []string
+	var b strings.Builder
+	for _, a := range addrs {
+		if b.Len() > 0 && b.Len()+len(" OR ")+len(a) > limit {
+			out = append(out, b.String())
+			b.Reset()
+		}
+		if b.Len() > 0 {
+			b.WriteString(" OR ")
+		}
+		b.WriteString(a)
+	}
+	if b.Len() > 0 {
+		out = append(out, b.String())
+	}
+	return out
+}
@@ -0,0 +1,63 @@
+package gmailfilter
+
+import (
+	"bytes"
+	"encoding/xml"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	var buf bytes.Buffer
+	filters := []Filter{
+		{From: "a@example.com OR @shop.example", Label: "Yahoo/Shopping"},
+		{List: "golang-nuts.googlegroups.com", Label: "golang-nuts"},
+	}
+	if err := Write(&buf, filters); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	var feed struct {
+		Entries []struct {
+			Category struct {
+				Term string `xml:"term,attr"`
+			} `xml:"category"`
+			Properties []struct {
+				Name  string `xml:"name,attr"`
+				Value string `xml:"value,attr"`
+			} `xml:"property"`
+		} `xml:"entry"`
+	}
+	if err := xml.Unmarshal(buf.Bytes(), &feed); err != nil {
+		t.Fatalf("invalid XML: %v\n%s", err, buf.String())
+	}
+	var got []string
+	for _, e := range feed.Entries {
+		if e.Category.Term != "filter" {
+			t.Errorf("unexpected category %q", e.Category.Term)
+		}
+		var props []string
+		for _, p := range e.Properties {
+			props = append(props, p.Name+"="+p.Value)
+		}
+		got = append(got, strings.Join(props, " "))
+	}
+	want := []string{
+		"from=a@example.com OR @shop.example label=Yahoo/Shopping",
+		"hasTheWord=list:golang-nuts.googlegroups.com label=golang-nuts",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("filters = %q, want %q", got, want)
+	}
+	if !strings.Contains(buf.String(), "<apps:property") {
+		t.Errorf("expected apps:property elements, got %s", buf.String())
+	}
+}
+
+func TestChunk(t *testing.T) {
+	got := chunk([]string{"a@x", "b@x", "c@x", "a-very-long-address@example.com"}, 12)
+	want := []string{"a@x OR b@x", "c@x", "a-very-long-address@example.com"}
+	if !slices.Equal(got, want) {
+		t.Errorf("chunk = %q, want %q", got, want)
+	}
+}
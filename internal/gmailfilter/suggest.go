@@ -0,0 +1,128 @@
+package gmailfilter
+
+import (
+	"cmp"
+	"mime"
+	"slices"
+	"strings"
+
+	"github.com/benj-n/yatogm/internal/receipt"
+)
+
+// Suggestion is a filter for a group of messages yatogm delivered: those
+// of a mailing list, or from a domain or, for a domain anyone can have an
+// address at, from one sender.
+type Suggestion struct {
+	Filter
+	// Messages counts the delivered messages the filter matches.
+	Messages int
+	// Senders counts the distinct sender addresses among them.
+	Senders int
+}
+
+// freemail are domains whose addresses belong to unrelated people, so
+// that their senders are suggested one by one rather than by domain.
+var freemail = map[string]bool{
+	"aol.com": true, "free.fr": true, "gmail.com": true, "gmx.com": true,
+	"gmx.de": true, "gmx.net": true, "googlemail.com": true, "hotmail.com": true,
+	"icloud.com": true, "laposte.net": true, "live.com": true, "mac.com": true,
+	"me.com": true, "msn.com": true, "orange.fr": true, "outlook.com": true,
+	"proton.me": true, "protonmail.com": true, "rocketmail.com": true,
+	"web.de": true, "ymail.com": true,
+}
+
+// isFreemail reports whether domain is a mail provider for the public.
+func isFreemail(domain string) bool {
+	return freemail[domain] || strings.HasPrefix(domain, "yahoo.") || strings.HasPrefix(domain, "hotmail.")
+}
+
+// group accumulates the messages of one suggestion.
+type group struct {
+	Suggestion
+	senders map[string]bool
+}
+
+// Suggest groups the delivered messages in records, each counted once
+// however many destinations it reached, by mailing list, or else by
+// sender domain or freemail address, and returns a filter for each group
+// of at least minMessages messages, the largest first. Labels are named after the
+// list or sender, under prefix if set.
+func Suggest(records []receipt.Record, minMessages int, prefix string) []Suggestion {
+	seen := make(map[string]bool)
+	groups := make(map[string]*group)
+	for _, r := range records {
+		if r.From == "" && r.ListID == "" || seen[r.ID] {
+			continue
+		}
+		seen[r.ID] = true
+
+		var key string
+		var f Filter
+		if id, name := parseListID(r.ListID); id != "" {
+			key, f = "list:"+id, Filter{List: id, Label: name}
+		} else {
+			_, domain, ok := strings.Cut(r.From, "@")
+			if !ok || domain == "" {
+				continue
+			}
+			if isFreemail(domain) {
+				key, f = "from:"+r.From, Filter{From: r.From, Label: r.From}
+			} else {
+				key, f = "from:@"+domain, Filter{From: "@" + domain, Label: domain}
+			}
+		}
+		g, ok := groups[key]
+		if !ok {
+			if prefix != "" {
+				f.Label = prefix + "/" + f.Label
+			}
+			g = &group{Suggestion: Suggestion{Filter: f}, senders: make(map[string]bool)}
+			groups[key] = g
+		}
+		g.Messages++
+		if r.From != "" {
+			g.senders[r.From] = true
+		}
+	}
+
+	var out []Suggestion
+	for _, g := range groups {
+		if g.Messages >= minMessages {
+			g.Senders = len(g.senders)
+			out = append(out, g.Suggestion)
+		}
+	}
+	slices.SortFunc(out, func(a, b Suggestion) int {
+		if c := cmp.Compare(b.Messages, a.Messages); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Label, b.Label)
+	})
+	return out
+}
+
+// parseListID returns the identifier of a List-Id header (RFC 2919), such
+// as `"Go Nuts" <golang-nuts.googlegroups.com>`, lowercased, and a name for
+// the list: its description, or the first part of its identifier.
+func parseListID(v string) (id, name string) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return "", ""
+	}
+	desc := ""
+	if i := strings.LastIndexByte(v, '<'); i >= 0 && strings.HasSuffix(v, ">") {
+		desc, v = strings.TrimSpace(v[:i]), v[i+1:len(v)-1]
+	}
+	id = strings.ToLower(strings.TrimSpace(v))
+	if id == "" {
+		return "", ""
+	}
+	if d, err := new(mime.WordDecoder).DecodeHeader(desc); err == nil {
+		desc = d
+	}
+	desc = strings.TrimSpace(strings.Trim(desc, `"`))
+	if desc == "" {
+		desc, _, _ = strings.Cut(id, ".")
+	}
+	return id, desc
+}
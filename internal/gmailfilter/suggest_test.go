@@ -0,0 +1,41 @@
+package gmailfilter
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/benj-n/yatogm/internal/receipt"
+)
+
+func TestSuggest(t *testing.T) {
+	var records []receipt.Record
+	add := func(n int, from, list string) {
+		for i := 0; i < n; i++ {
+			records = append(records, receipt.Record{ID: fmt.Sprintf("%s-%s-%d", from, list, i), From: from, ListID: list})
+		}
+	}
+	add(5, "statements@bank.example", "")
+	add(2, "alerts@bank.example", "")
+	add(4, "friend@gmail.com", "")
+	add(3, "someone@gmail.com", "")
+	add(6, "member@example.org", `"Go Nuts" <golang-nuts.googlegroups.com>`)
+	add(4, "bot@example.net", "<announce.lists.example.net>")
+	add(1, "once@rare.example", "")
+	// A message delivered to several destinations counts once.
+	records = append(records, records[0])
+
+	got := Suggest(records, 4, "Yahoo")
+	want := []Suggestion{
+		{Filter: Filter{From: "@bank.example", Label: "Yahoo/bank.example"}, Messages: 7, Senders: 2},
+		{Filter: Filter{List: "golang-nuts.googlegroups.com", Label: "Yahoo/Go Nuts"}, Messages: 6, Senders: 1},
+		{Filter: Filter{List: "announce.lists.example.net", Label: "Yahoo/announce"}, Messages: 4, Senders: 1},
+		{Filter: Filter{From: "friend@gmail.com", Label: "Yahoo/friend@gmail.com"}, Messages: 4, Senders: 1},
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("Suggest =\n%+v\nwant\n%+v", got, want)
+	}
+	if got := Suggest(records, 4, ""); got[0].Label != "bank.example" {
+		t.Errorf("expected labels without a prefix, got %q", got[0].Label)
+	}
+}
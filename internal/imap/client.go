@@ -0,0 +1,394 @@
+// Package imap implements the part of an IMAP4rev1 (RFC 3501) client that
+// yatogm needs: logging in to Gmail over TLS, finding a mailbox by its
+// special use, and listing the Message-IDs of the messages in it.
+package imap
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/benj-n/yatogm/internal/fault"
+)
+
+// DefaultCommandTimeout bounds each read from and write to the server
+// when no command timeout is set.
+const DefaultCommandTimeout = 30 * time.Second
+
+// maxLiteral bounds the literals read from the server. The header fields
+// fetched here are small; a larger literal means a confused server.
+const maxLiteral = 1 << 20
+
+// ErrServer is returned, wrapped, when the server answers a command with
+// NO or BAD.
+var ErrServer = errors.New("server error")
+
+// Dialer opens the connections to servers. A *net.Dialer is one.
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// Client is an IMAP client connected over TLS.
+type Client struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	tag    int
+	// timeout bounds each read and write, or is zero for
+	// DefaultCommandTimeout.
+	timeout time.Duration
+}
+
+// Dial connects to an IMAP server over TLS from the start, as on port 993,
+// with d, or a net.Dialer if it is nil, and reads its greeting. A zero
+// timeout leaves connecting bounded by ctx alone.
+func Dial(ctx context.Context, host string, port int, timeout time.Duration, tlsConfig *tls.Config, d Dialer) (*Client, error) {
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	if d == nil {
+		d = &net.Dialer{}
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("imap dial %s: %w", addr, err)
+	}
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.ServerName = host
+	}
+	tc := tls.Client(fault.Conn(conn), tlsConfig)
+	if err := tc.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("imap dial %s: %w", addr, err)
+	}
+	c := &Client{conn: tc, reader: bufio.NewReader(tc), timeout: timeout}
+
+	greeting, err := c.readResponse()
+	if err != nil {
+		c.conn.Close()
+		return nil, fmt.Errorf("imap greeting: %w", err)
+	}
+	if !strings.HasPrefix(strings.ToUpper(greeting.line), "* OK") {
+		c.conn.Close()
+		return nil, fmt.Errorf("imap greeting: %w: %s", ErrServer, greeting.line)
+	}
+	return c, nil
+}
+
+// SetCommandTimeout sets how long each later read from and write to the
+// server may take. Zero selects DefaultCommandTimeout, the default.
+func (c *Client) SetCommandTimeout(d time.Duration) {
+	c.timeout = d
+}
+
+// Login authenticates with a username and password, such as a Gmail app
+// password.
+func (c *Client) Login(user, pass string) error {
+	u, err := quote(user)
+	if err != nil {
+		return fmt.Errorf("imap LOGIN: %w", err)
+	}
+	p, err := quote(pass)
+	if err != nil {
+		return fmt.Errorf("imap LOGIN: %w", err)
+	}
+	if err := c.command("LOGIN "+u+" "+p, nil); err != nil {
+		return fmt.Errorf("imap LOGIN: %w", err)
+	}
+	return nil
+}
+
+// AuthenticateXOAUTH2 authenticates with an OAuth2 access token, as Gmail
+// accepts it with SASL XOAUTH2.
+func (c *Client) AuthenticateXOAUTH2(user, token string) error {
+	ir := base64.StdEncoding.EncodeToString([]byte("user=" + user + "\x01auth=Bearer " + token + "\x01\x01"))
+	if err := c.command("AUTHENTICATE XOAUTH2 "+ir, nil); err != nil {
+		return fmt.Errorf("imap AUTHENTICATE: %w", err)
+	}
+	return nil
+}
+
+// Mailbox is a mailbox the server lists.
+type Mailbox struct {
+	// Name is the name in UTF-8, decoded from modified UTF-7, or as the
+	// server sends it if it is not valid modified UTF-7.
+	Name string
+	// Attributes are the mailbox's attributes, such as `\Noselect`, or
+	// special uses (RFC 6154) such as `\Sent`.
+	Attributes []string
+}
+
+// List returns every mailbox of the account.
+func (c *Client) List() ([]Mailbox, error) {
+	var out []Mailbox
+	err := c.command(`LIST "" "*"`, func(r response) error {
+		if attrs, name, ok := parseList(r); ok {
+			if decoded, err := DecodeMailbox(name); err == nil {
+				name = decoded
+			}
+			out = append(out, Mailbox{Name: name, Attributes: attrs})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("imap LIST: %w", err)
+	}
+	return out, nil
+}
+
+// SpecialUse returns the name of the mailbox with the special-use
+// attribute attr (RFC 6154), such as `\All` for Gmail's "All Mail" under
+// whatever name the account's language gives it, or "" if there is none.
+// The name is in UTF-8, as List returns it.
+func (c *Client) SpecialUse(attr string) (string, error) {
+	mailboxes, err := c.List()
+	if err != nil {
+		return "", err
+	}
+	for _, m := range mailboxes {
+		for _, a := range m.Attributes {
+			if strings.EqualFold(a, attr) {
+				return m.Name, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// Examine opens mailbox, named in UTF-8, read-only, and returns the number
+// of messages in it.
+func (c *Client) Examine(mailbox string) (int, error) {
+	name, err := quote(EncodeMailbox(mailbox))
+	if err != nil {
+		return 0, fmt.Errorf("imap EXAMINE: %w", err)
+	}
+	exists := 0
+	err = c.command("EXAMINE "+name, func(r response) error {
+		fields := strings.Fields(r.line)
+		if len(fields) == 3 && strings.EqualFold(fields[2], "EXISTS") {
+			exists, _ = strconv.Atoi(fields[1])
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("imap EXAMINE: %w", err)
+	}
+	return exists, nil
+}
+
+// MessageIDs calls fn with the Message-ID header of each message in the
+// mailbox opened by Examine, which holds count messages, as the server
+// returns them. Messages without one are left out.
+func (c *Client) MessageIDs(count int, fn func(id string)) error {
+	if count == 0 {
+		return nil
+	}
+	err := c.command("FETCH 1:* (BODY.PEEK[HEADER.FIELDS (MESSAGE-ID)])", func(r response) error {
+		fields := strings.Fields(r.line)
+		if len(fields) < 3 || !strings.EqualFold(fields[2], "FETCH") || len(r.literals) == 0 {
+			return nil
+		}
+		tp := textproto.NewReader(bufio.NewReader(io.MultiReader(bytes.NewReader(r.literals[0]), strings.NewReader("\r\n"))))
+		h, err := tp.ReadMIMEHeader()
+		if err != nil && len(h) == 0 {
+			return nil
+		}
+		if id := strings.TrimSpace(h.Get("Message-Id")); id != "" {
+			fn(id)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("imap FETCH: %w", err)
+	}
+	return nil
+}
+
+// Logout ends the session and closes the connection.
+func (c *Client) Logout() error {
+	err := c.command("LOGOUT", nil)
+	c.conn.Close()
+	if err != nil {
+		return fmt.Errorf("imap LOGOUT: %w", err)
+	}
+	return nil
+}
+
+// Close closes the connection without logging out.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// response is a response from the server: its line, with each literal it
+// carried left as its {size} marker, and the literals in order.
+type response struct {
+	line     string
+	literals [][]byte
+}
+
+// command sends a tagged command, passes each untagged response to
+// untagged, if set, and returns an error wrapping ErrServer unless the
+// command completed with OK.
+func (c *Client) command(cmd string, untagged func(response) error) error {
+	c.tag++
+	tag := "a" + strconv.Itoa(c.tag)
+	if err := c.setDeadline(); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(c.conn, tag+" "+cmd+"\r\n"); err != nil {
+		return err
+	}
+	for {
+		r, err := c.readResponse()
+		if err != nil {
+			return err
+		}
+		switch {
+		case strings.HasPrefix(r.line, "* "):
+			if untagged != nil {
+				if err := untagged(r); err != nil {
+					return err
+				}
+			}
+		case strings.HasPrefix(r.line, "+"):
+			// A challenge, as after a failed XOAUTH2, is answered with an
+			// empty response to get the tagged result.
+			if _, err := io.WriteString(c.conn, "\r\n"); err != nil {
+				return err
+			}
+		case strings.HasPrefix(r.line, tag+" "):
+			status := strings.TrimPrefix(r.line, tag+" ")
+			if len(status) >= 2 && strings.EqualFold(status[:2], "OK") {
+				return nil
+			}
+			return fmt.Errorf("%w: %s", ErrServer, status)
+		}
+	}
+}
+
+// setDeadline bounds the next read or write by the command timeout.
+func (c *Client) setDeadline() error {
+	timeout := c.timeout
+	if timeout <= 0 {
+		timeout = DefaultCommandTimeout
+	}
+	return c.conn.SetDeadline(time.Now().Add(timeout))
+}
+
+// readResponse reads a response, with the literals it carries.
+func (c *Client) readResponse() (response, error) {
+	var r response
+	for {
+		if err := c.setDeadline(); err != nil {
+			return r, err
+		}
+		line, err := c.reader.ReadString('\n')
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return r, fmt.Errorf("server closed connection: %w", err)
+		}
+		line = strings.TrimRight(line, "\r\n")
+		r.line += line
+		n, ok := literalSize(line)
+		if !ok {
+			return r, nil
+		}
+		if n > maxLiteral {
+			return r, fmt.Errorf("literal of %d bytes too large", n)
+		}
+		lit := make([]byte, n)
+		if _, err := io.ReadFull(c.reader, lit); err != nil {
+			return r, fmt.Errorf("reading literal: %w", err)
+		}
+		r.literals = append(r.literals, lit)
+	}
+}
+
+// literalSize returns the size of the literal a line ends by announcing,
+// as in "{42}".
+func literalSize(line string) (int, bool) {
+	if !strings.HasSuffix(line, "}") {
+		return 0, false
+	}
+	i := strings.LastIndexByte(line, '{')
+	if i < 0 {
+		return 0, false
+	}
+	n, err := strconv.Atoi(line[i+1 : len(line)-1])
+	return n, err == nil && n >= 0
+}
+
+// quote returns s as an IMAP quoted string.
+func quote(s string) (string, error) {
+	if strings.ContainsAny(s, "\r\n\x00") {
+		return "", errors.New("CR, LF, or NUL in argument")
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`, nil
+}
+
+// parseList parses a LIST response, `* LIST (attrs) delimiter name`, with
+// the name as a quoted string, an atom, or a literal.
+func parseList(r response) (attrs []string, name string, ok bool) {
+	rest, ok := strings.CutPrefix(r.line, "* LIST (")
+	if !ok {
+		return nil, "", false
+	}
+	list, rest, ok := strings.Cut(rest, ") ")
+	if !ok {
+		return nil, "", false
+	}
+	attrs = strings.Fields(list)
+	// Skip the hierarchy delimiter, a quoted character or NIL.
+	if strings.HasPrefix(rest, `"\\"`) {
+		rest = rest[4:]
+	} else if strings.HasPrefix(rest, `"`) && len(rest) >= 3 {
+		rest = rest[3:]
+	} else if strings.HasPrefix(strings.ToUpper(rest), "NIL") {
+		rest = rest[3:]
+	} else {
+		return nil, "", false
+	}
+	rest = strings.TrimPrefix(rest, " ")
+	switch {
+	case len(r.literals) > 0:
+		return attrs, string(r.literals[len(r.literals)-1]), true
+	case strings.HasPrefix(rest, `"`):
+		name, err := unquote(rest)
+		return attrs, name, err == nil
+	default:
+		return attrs, rest, rest != ""
+	}
+}
+
+// unquote returns the value of an IMAP quoted string.
+func unquote(s string) (string, error) {
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
+		return "", errors.New("malformed quoted string")
+	}
+	var b strings.Builder
+	for i := 1; i < len(s)-1; i++ {
+		if s[i] == '\\' && i+1 < len(s)-1 {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,284 @@
+package imap
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCert returns a self-signed certificate for 127.0.0.1, and a pool
+// trusting it.
+func testCert(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, roots
+}
+
+// gmailServer serves a Gmail-like account over TLS, whose "All Mail" has a
+// localized name and holds messages with the given Message-IDs ("" for
+// none), and returns its port and a config trusting it.
+func gmailServer(t *testing.T, ids []string) (int, *tls.Config) {
+	t.Helper()
+	cert, roots := testCert(t)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveGmail(conn, ids)
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr).Port, &tls.Config{RootCAs: roots}
+}
+
+func serveGmail(conn net.Conn, ids []string) {
+	defer conn.Close()
+	fmt.Fprintf(conn, "* OK Gimap ready\r\n")
+	r := bufio.NewReader(conn)
+	authed, selected := false, false
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		tag, cmd, _ := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+		verb, args, _ := strings.Cut(cmd, " ")
+		switch {
+		case verb == "LOGIN":
+			if args != `"me@gmail.com" "app \"pass\""` {
+				fmt.Fprintf(conn, "%s NO [AUTHENTICATIONFAILED] Invalid credentials\r\n", tag)
+				continue
+			}
+			authed = true
+			fmt.Fprintf(conn, "%s OK me@gmail.com authenticated\r\n", tag)
+		case verb == "AUTHENTICATE":
+			ir, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(args, "XOAUTH2 "))
+			if string(ir) != "user=me@gmail.com\x01auth=Bearer token\x01\x01" {
+				fmt.Fprintf(conn, "+ eyJzdGF0dXMiOiI0MDAifQ==\r\n")
+				r.ReadString('\n')
+				fmt.Fprintf(conn, "%s NO [AUTHENTICATIONFAILED] Invalid credentials\r\n", tag)
+				continue
+			}
+			authed = true
+			fmt.Fprintf(conn, "%s OK me@gmail.com authenticated\r\n", tag)
+		case !authed:
+			fmt.Fprintf(conn, "%s BAD not authenticated\r\n", tag)
+		case verb == "LIST":
+			fmt.Fprintf(conn, "* LIST (\\HasNoChildren) \"/\" \"INBOX\"\r\n")
+			fmt.Fprintf(conn, "* LIST (\\HasChildren \\Noselect) \"/\" \"[Gmail]\"\r\n")
+			name := "[Gmail]/Tous les messages"
+			fmt.Fprintf(conn, "* LIST (\\All \\HasNoChildren) \"/\" {%d}\r\n%s\r\n", len(name), name)
+			fmt.Fprintf(conn, "* LIST (\\HasNoChildren \\Sent) \"/\" \"[Gmail]/Messages envoy&AOk-s\"\r\n")
+			fmt.Fprintf(conn, "%s OK Success\r\n", tag)
+		case verb == "EXAMINE" && args == `"[Gmail]/Messages envoy&AOk-s"`:
+			fmt.Fprintf(conn, "* 0 EXISTS\r\n%s OK [READ-ONLY] EXAMINE completed\r\n", tag)
+		case verb == "EXAMINE":
+			if args != `"[Gmail]/Tous les messages"` {
+				fmt.Fprintf(conn, "%s NO [NONEXISTENT] Unknown Mailbox\r\n", tag)
+				continue
+			}
+			selected = true
+			fmt.Fprintf(conn, "* FLAGS (\\Answered \\Flagged \\Draft \\Deleted \\Seen)\r\n")
+			fmt.Fprintf(conn, "* %d EXISTS\r\n", len(ids))
+			fmt.Fprintf(conn, "* 0 RECENT\r\n")
+			fmt.Fprintf(conn, "%s OK [READ-ONLY] EXAMINE completed\r\n", tag)
+		case verb == "FETCH" && selected:
+			if len(ids) == 0 {
+				fmt.Fprintf(conn, "%s BAD Could not parse command\r\n", tag)
+				continue
+			}
+			for i, id := range ids {
+				header := "\r\n"
+				if id != "" {
+					header = "Message-ID: " + id + "\r\n\r\n"
+				}
+				fmt.Fprintf(conn, "* %d FETCH (BODY[HEADER.FIELDS (MESSAGE-ID)] {%d}\r\n%s)\r\n", i+1, len(header), header)
+			}
+			fmt.Fprintf(conn, "%s OK Success\r\n", tag)
+		case verb == "LOGOUT":
+			fmt.Fprintf(conn, "* BYE LOGOUT Requested\r\n%s OK 73 good day\r\n", tag)
+			return
+		default:
+			fmt.Fprintf(conn, "%s BAD unknown command\r\n", tag)
+		}
+	}
+}
+
+func TestMessageIDs(t *testing.T) {
+	ids := []string{"<a@example.com>", "", "<b@example.com>"}
+	port, tlsConfig := gmailServer(t, ids)
+
+	c, err := Dial(context.Background(), "127.0.0.1", port, 5*time.Second, tlsConfig, nil)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	if err := c.Login("me@gmail.com", `app "pass"`); err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
+	all, err := c.SpecialUse(`\All`)
+	if err != nil || all != "[Gmail]/Tous les messages" {
+		t.Fatalf(`SpecialUse(\All) = %q, %v`, all, err)
+	}
+	sent, _ := c.SpecialUse(`\Sent`)
+	if sent != "[Gmail]/Messages envoyés" {
+		t.Errorf(`SpecialUse(\Sent) = %q`, sent)
+	}
+	if n, err := c.Examine(sent); err != nil || n != 0 {
+		t.Errorf("Examine(%q) = %d, %v; expected the name sent in modified UTF-7", sent, n, err)
+	}
+	if junk, err := c.SpecialUse(`\Junk`); err != nil || junk != "" {
+		t.Errorf(`SpecialUse(\Junk) = %q, %v`, junk, err)
+	}
+	mailboxes, err := c.List()
+	if err != nil || len(mailboxes) != 4 {
+		t.Fatalf("List = %+v, %v", mailboxes, err)
+	}
+	if m := mailboxes[1]; m.Name != "[Gmail]" || !slices.Equal(m.Attributes, []string{`\HasChildren`, `\Noselect`}) {
+		t.Errorf("List()[1] = %+v", m)
+	}
+	n, err := c.Examine(all)
+	if err != nil || n != 3 {
+		t.Fatalf("Examine = %d, %v", n, err)
+	}
+	var got []string
+	if err := c.MessageIDs(n, func(id string) { got = append(got, id) }); err != nil {
+		t.Fatalf("MessageIDs failed: %v", err)
+	}
+	if want := []string{"<a@example.com>", "<b@example.com>"}; !slices.Equal(got, want) {
+		t.Errorf("MessageIDs = %q, want %q", got, want)
+	}
+	if err := c.Logout(); err != nil {
+		t.Errorf("Logout failed: %v", err)
+	}
+}
+
+func TestEmptyMailbox(t *testing.T) {
+	// FETCH 1:* is an error on an empty mailbox, so it is not sent.
+	port, tlsConfig := gmailServer(t, nil)
+	c, err := Dial(context.Background(), "127.0.0.1", port, 5*time.Second, tlsConfig, nil)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer c.Close()
+	if err := c.AuthenticateXOAUTH2("me@gmail.com", "token"); err != nil {
+		t.Fatalf("AuthenticateXOAUTH2 failed: %v", err)
+	}
+	n, err := c.Examine("[Gmail]/Tous les messages")
+	if err != nil || n != 0 {
+		t.Fatalf("Examine = %d, %v", n, err)
+	}
+	if err := c.MessageIDs(n, func(string) { t.Error("unexpected Message-ID") }); err != nil {
+		t.Errorf("MessageIDs failed: %v", err)
+	}
+}
+
+func TestServerErrors(t *testing.T) {
+	port, tlsConfig := gmailServer(t, nil)
+	dial := func() *Client {
+		c, err := Dial(context.Background(), "127.0.0.1", port, 5*time.Second, tlsConfig, nil)
+		if err != nil {
+			t.Fatalf("Dial failed: %v", err)
+		}
+		t.Cleanup(func() { c.Close() })
+		return c
+	}
+
+	if err := dial().Login("me@gmail.com", "wrong"); !errors.Is(err, ErrServer) || !strings.Contains(err.Error(), "Invalid credentials") {
+		t.Errorf("Login with a wrong password = %v", err)
+	}
+	// The server's challenge after a rejected token is answered, to get
+	// its verdict.
+	if err := dial().AuthenticateXOAUTH2("me@gmail.com", "expired"); !errors.Is(err, ErrServer) {
+		t.Errorf("AuthenticateXOAUTH2 with a bad token = %v", err)
+	}
+	c := dial()
+	if err := c.Login("me@gmail.com", `app "pass"`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Examine("Nonexistent"); !errors.Is(err, ErrServer) {
+		t.Errorf("Examine of a missing mailbox = %v", err)
+	}
+	if err := c.Login("me@gmail.com\r\nLOGOUT", "x"); err == nil {
+		t.Error("expected a line break in an argument to be refused")
+	}
+
+	// A server whose certificate is not trusted is not talked to.
+	if _, err := Dial(context.Background(), "127.0.0.1", port, 5*time.Second, &tls.Config{}, nil); err == nil {
+		t.Error("expected an untrusted certificate to fail")
+	}
+}
+
+func TestCommandTimeout(t *testing.T) {
+	// A server that stops answering is given up on.
+	cert, roots := testCert(t)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		fmt.Fprintf(conn, "* OK ready\r\n")
+		bufio.NewReader(conn).ReadString('\n')
+		time.Sleep(5 * time.Second)
+	}()
+	c, err := Dial(context.Background(), "127.0.0.1", ln.Addr().(*net.TCPAddr).Port, 5*time.Second, &tls.Config{RootCAs: roots}, nil)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer c.Close()
+	c.SetCommandTimeout(100 * time.Millisecond)
+	start := time.Now()
+	if err := c.Login("me@gmail.com", "pass"); err == nil {
+		t.Fatal("expected a timeout")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("gave up after %v", elapsed)
+	}
+}
@@ -0,0 +1,94 @@
+package imap
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// utf7Base64 is the base64 of modified UTF-7, with "," for "/" and no
+// padding.
+var utf7Base64 = base64.NewEncoding("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+,").WithPadding(base64.NoPadding)
+
+// EncodeMailbox returns a mailbox name in the modified UTF-7 of RFC 3501,
+// section 5.1.3, which servers expect: printable ASCII stands for itself,
+// but for "&", sent as "&-", and other characters are sent as base64 of
+// their UTF-16 between "&" and "-", as in "Messages envoy&AOk-s".
+func EncodeMailbox(name string) string {
+	var b strings.Builder
+	var run []rune
+	flush := func() {
+		if len(run) == 0 {
+			return
+		}
+		units := utf16.Encode(run)
+		buf := make([]byte, 0, 2*len(units))
+		for _, u := range units {
+			buf = append(buf, byte(u>>8), byte(u))
+		}
+		b.WriteByte('&')
+		b.WriteString(utf7Base64.EncodeToString(buf))
+		b.WriteByte('-')
+		run = run[:0]
+	}
+	for _, r := range name {
+		switch {
+		case r >= 0x20 && r <= 0x7e:
+			flush()
+			if r == '&' {
+				b.WriteString("&-")
+			} else {
+				b.WriteRune(r)
+			}
+		default:
+			run = append(run, r)
+		}
+	}
+	flush()
+	return b.String()
+}
+
+// DecodeMailbox returns the UTF-8 name of a mailbox named in modified
+// UTF-7 by the server.
+func DecodeMailbox(s string) (string, error) {
+	var b strings.Builder
+	for {
+		i := strings.IndexByte(s, '&')
+		if i < 0 {
+			b.WriteString(s)
+			break
+		}
+		b.WriteString(s[:i])
+		s = s[i+1:]
+		j := strings.IndexByte(s, '-')
+		if j < 0 {
+			return "", errors.New("unterminated shift in modified UTF-7 mailbox name")
+		}
+		if j == 0 {
+			b.WriteByte('&')
+			s = s[1:]
+			continue
+		}
+		buf, err := utf7Base64.DecodeString(s[:j])
+		if err != nil || len(buf)%2 != 0 {
+			return "", errors.New("invalid base64 in modified UTF-7 mailbox name")
+		}
+		units := make([]uint16, len(buf)/2)
+		for k := range units {
+			units[k] = uint16(buf[2*k])<<8 | uint16(buf[2*k+1])
+		}
+		for _, r := range utf16.Decode(units) {
+			if r == utf8.RuneError {
+				return "", errors.New("invalid UTF-16 in modified UTF-7 mailbox name")
+			}
+			b.WriteRune(r)
+		}
+		s = s[j+1:]
+	}
+	if !utf8.ValidString(b.String()) {
+		return "", errors.New("invalid modified UTF-7 mailbox name")
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,31 @@
+package imap
+
+import "testing"
+
+func TestMailboxNames(t *testing.T) {
+	tests := []struct {
+		name, encoded string
+	}{
+		{"INBOX", "INBOX"},
+		{"[Gmail]/Messages envoyés", "[Gmail]/Messages envoy&AOk-s"},
+		{"Courrier indésirable", "Courrier ind&AOk-sirable"},
+		{"Tom & Jerry", "Tom &- Jerry"},
+		{"台北/日本語", "&U,BTFw-/&ZeVnLIqe-"},
+		{"~peter/mail/台北/日本語", "~peter/mail/&U,BTFw-/&ZeVnLIqe-"},
+		{"Émojis 📬", "&AMk-mojis &2D3c7A-"},
+	}
+	for _, tt := range tests {
+		if got := EncodeMailbox(tt.name); got != tt.encoded {
+			t.Errorf("EncodeMailbox(%q) = %q, want %q", tt.name, got, tt.encoded)
+		}
+		if got, err := DecodeMailbox(tt.encoded); err != nil || got != tt.name {
+			t.Errorf("DecodeMailbox(%q) = %q, %v; want %q", tt.encoded, got, err, tt.name)
+		}
+	}
+
+	for _, bad := range []string{"&AOk", "&A-", "&AOk=-", "&2D0-"} {
+		if got, err := DecodeMailbox(bad); err == nil {
+			t.Errorf("DecodeMailbox(%q) = %q, expected an error", bad, got)
+		}
+	}
+}
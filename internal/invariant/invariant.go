@@ -0,0 +1,250 @@
+// Package invariant checks, across runs and crashes, that every message is
+// forwarded at most once to each destination and deleted from its source
+// only once it was recorded as fetched.
+package invariant
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/benj-n/yatogm/internal/receipt"
+)
+
+// Kind is the invariant a violation breaks.
+type Kind string
+
+const (
+	// Duplicate is a message delivered to a destination that it had
+	// already been delivered to, under another yatogm ID.
+	Duplicate Kind = "duplicate"
+	// UntrackedDelete is a message about to be deleted from its source
+	// without being recorded as fetched.
+	UntrackedDelete Kind = "untracked_delete"
+)
+
+// Violation is a broken invariant.
+type Violation struct {
+	Kind    Kind
+	Mailbox string
+	UID     string
+	// Destination and IDs are set for a Duplicate: the destination, and
+	// the yatogm IDs of every delivery of the message to it, oldest first.
+	Destination string
+	IDs         []string
+}
+
+func (v *Violation) Error() string {
+	switch v.Kind {
+	case Duplicate:
+		return fmt.Sprintf("invariant violated: message %s of %s delivered %d times to %s (yatogm IDs %v)",
+			v.UID, v.Mailbox, len(v.IDs), v.Destination, v.IDs)
+	case UntrackedDelete:
+		return fmt.Sprintf("invariant violated: message %s of %s deleted without being recorded as fetched",
+			v.UID, v.Mailbox)
+	}
+	return fmt.Sprintf("invariant violated: %s for message %s of %s", v.Kind, v.UID, v.Mailbox)
+}
+
+// entry is one delivery recorded in the journal.
+type entry struct {
+	ID          string    `json:"yatogm_id"`
+	Source      string    `json:"source"`
+	UID         string    `json:"uid"`
+	Destination string    `json:"destination"`
+	At          time.Time `json:"at"`
+}
+
+// delivery identifies a message delivered to a destination.
+type delivery struct {
+	mailbox, uid, dest string
+}
+
+// deliveries holds the yatogm IDs each message was delivered under, per
+// destination.
+type deliveries map[delivery][]string
+
+// add records a delivery under id, unless it was recorded already, and
+// returns the IDs the message was delivered under so far.
+func (d deliveries) add(key delivery, id string) []string {
+	for _, seen := range d[key] {
+		if seen == id {
+			return d[key]
+		}
+	}
+	d[key] = append(d[key], id)
+	return d[key]
+}
+
+// Checker checks the invariants as messages are delivered and deleted. It
+// remembers every delivery in a journal, and reads the receipts of earlier
+// runs, so that a message forwarded again after a crash is caught. It is
+// safe for concurrent use.
+type Checker struct {
+	mu         sync.Mutex
+	file       *os.File
+	delivered  deliveries
+	violations []*Violation
+}
+
+// Open opens the journal at path for appending, creating it and its
+// directory if needed, and reads the deliveries it and the given receipts
+// files record. Deliveries in both, under the same yatogm ID, count once.
+func Open(path string, receipts ...string) (*Checker, error) {
+	c := &Checker{delivered: make(deliveries)}
+	if err := read(c.delivered, path, receipts); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("creating invariant journal directory: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("opening invariant journal: %w", err)
+	}
+	c.file = f
+	return c, nil
+}
+
+// Violations returns the violations err holds, as joined by a run.
+func Violations(err error) []*Violation {
+	var v *Violation
+	switch e := err.(type) {
+	case nil:
+		return nil
+	case interface{ Unwrap() []error }:
+		var found []*Violation
+		for _, err := range e.Unwrap() {
+			found = append(found, Violations(err)...)
+		}
+		return found
+	default:
+		if errors.As(err, &v) {
+			return []*Violation{v}
+		}
+		return nil
+	}
+}
+
+// read adds the deliveries in the journal at path and the receipts files
+// to d, skipping files that do not exist.
+func read(d deliveries, path string, receipts []string) error {
+	err := readLines(path, func(line []byte) error {
+		var e entry
+		if err := json.Unmarshal(line, &e); err != nil {
+			return err
+		}
+		d.add(delivery{e.Source, e.UID, e.Destination}, e.ID)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("reading invariant journal: %w", err)
+	}
+	for _, p := range receipts {
+		err := readLines(p, func(line []byte) error {
+			var r receipt.Record
+			if err := json.Unmarshal(line, &r); err != nil {
+				return err
+			}
+			d.add(delivery{r.Source, r.UID, r.Destination}, r.ID)
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("reading receipts: %w", err)
+		}
+	}
+	return nil
+}
+
+// readLines calls fn with every line of the file at path, skipping a last
+// line left incomplete by a crash. A missing file has no lines.
+func readLines(path string, fn func([]byte) error) error {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for n := 1; ; n++ {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			// io.EOF, with or without a partial line.
+			return nil
+		}
+		if len(line) <= 1 {
+			continue
+		}
+		if err := fn(line); err != nil {
+			return fmt.Errorf("%s: line %d: %w", path, n, err)
+		}
+	}
+}
+
+// Delivered records that the message uid of mailbox was delivered to dest
+// under the yatogm ID id, and returns a Duplicate violation if it had been
+// delivered there before.
+func (c *Checker) Delivered(mailbox, uid, dest, id string) error {
+	line, err := json.Marshal(entry{ID: id, Source: mailbox, UID: uid, Destination: dest, At: time.Now()})
+	if err != nil {
+		return fmt.Errorf("marshaling invariant journal entry: %w", err)
+	}
+	line = append(line, '\n')
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// The delivery happened, so it is remembered even if it breaks the
+	// invariant.
+	if _, err := c.file.Write(line); err != nil {
+		return fmt.Errorf("writing invariant journal: %w", err)
+	}
+	ids := c.delivered.add(delivery{mailbox, uid, dest}, id)
+	if len(ids) < 2 {
+		return nil
+	}
+	v := &Violation{Kind: Duplicate, Mailbox: mailbox, UID: uid, Destination: dest, IDs: slices.Clone(ids)}
+	c.violations = append(c.violations, v)
+	return v
+}
+
+// Deleting returns an UntrackedDelete violation if the message uid of
+// mailbox, about to be deleted, is not tracked as fetched. The message
+// must then be left on the server.
+func (c *Checker) Deleting(mailbox, uid string, tracked bool) error {
+	if tracked {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v := &Violation{Kind: UntrackedDelete, Mailbox: mailbox, UID: uid}
+	c.violations = append(c.violations, v)
+	return v
+}
+
+// Violations returns the violations the Checker found since it was opened.
+func (c *Checker) Violations() []*Violation {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]*Violation(nil), c.violations...)
+}
+
+// Close flushes the journal to disk and closes it.
+func (c *Checker) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.file.Sync(); err != nil {
+		c.file.Close()
+		return fmt.Errorf("syncing invariant journal: %w", err)
+	}
+	return c.file.Close()
+}
@@ -0,0 +1,126 @@
+package invariant
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/benj-n/yatogm/internal/receipt"
+)
+
+func TestDeliveredAcrossRuns(t *testing.T) {
+	dir := t.TempDir()
+	journal := filepath.Join(dir, "journal", "invariants.jsonl")
+
+	c, err := Open(journal)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if err := c.Delivered("user@yahoo.com", "uid1", "me@gmail.com", "01A"); err != nil {
+		t.Fatalf("first delivery: %v", err)
+	}
+	// Another destination, and a repeated record of the same delivery,
+	// are not duplicates.
+	if err := c.Delivered("user@yahoo.com", "uid1", "maildir", "01A"); err != nil {
+		t.Errorf("delivery to another destination: %v", err)
+	}
+	if err := c.Delivered("user@yahoo.com", "uid1", "me@gmail.com", "01A"); err != nil {
+		t.Errorf("same delivery recorded again: %v", err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A crash leaves a partial line behind.
+	f, err := os.OpenFile(journal, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"yatogm_id":"01`)
+	f.Close()
+
+	c, err = Open(journal)
+	if err != nil {
+		t.Fatalf("reopening after a crash: %v", err)
+	}
+	defer c.Close()
+	err = c.Delivered("user@yahoo.com", "uid1", "me@gmail.com", "01B")
+	var v *Violation
+	if !errors.As(err, &v) || v.Kind != Duplicate || fmt.Sprint(v.IDs) != "[01A 01B]" {
+		t.Fatalf("expected a duplicate of 01A, got %v", err)
+	}
+	if got := c.Violations(); len(got) != 1 || got[0] != v {
+		t.Errorf("Violations() = %v", got)
+	}
+}
+
+func TestDeliveredFromReceipts(t *testing.T) {
+	dir := t.TempDir()
+	receipts := filepath.Join(dir, "receipts.jsonl")
+	journal := filepath.Join(dir, "invariants.jsonl")
+
+	l, err := receipt.Open(receipts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := receipt.Record{ID: "01A", Source: "user@yahoo.com", UID: "uid1", Destination: "me@gmail.com", DeliveredAt: time.Now()}
+	if err := l.Write(r); err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+
+	// The delivery is in both files, and counts once.
+	c, err := Open(journal, receipts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Delivered(r.Source, r.UID, r.Destination, r.ID); err != nil {
+		t.Errorf("delivery in the receipts and journal: %v", err)
+	}
+	c.Close()
+
+	c, err = Open(journal, receipts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Delivered(r.Source, r.UID, r.Destination, "01B"); err == nil {
+		t.Error("expected a delivery under a new ID to be a duplicate")
+	}
+}
+
+func TestDeleting(t *testing.T) {
+	c, err := Open(filepath.Join(t.TempDir(), "invariants.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.Deleting("user@yahoo.com", "uid1", true); err != nil {
+		t.Errorf("tracked message: %v", err)
+	}
+	err = c.Deleting("user@yahoo.com", "uid2", false)
+	var v *Violation
+	if !errors.As(err, &v) || v.Kind != UntrackedDelete || v.UID != "uid2" {
+		t.Errorf("expected an untracked delete of uid2, got %v", err)
+	}
+}
+
+func TestViolations(t *testing.T) {
+	a := &Violation{Kind: Duplicate, UID: "uid1"}
+	b := &Violation{Kind: UntrackedDelete, UID: "uid2"}
+
+	if got := Violations(nil); got != nil {
+		t.Errorf("Violations(nil) = %v", got)
+	}
+	if got := Violations(errors.New("completed with 1 errors")); got != nil {
+		t.Errorf("expected no violations in a plain error, got %v", got)
+	}
+	got := Violations(errors.Join(a, fmt.Errorf("cycle: %w", b)))
+	if len(got) != 2 || got[0] != a || got[1] != b {
+		t.Errorf("Violations() = %v", got)
+	}
+}
@@ -0,0 +1,177 @@
+// Package lease implements leader election between yatogm instances that
+// share their state. The leader holds a lease naming it and an expiry, in
+// a lease file or in the state backend; other instances stand by until the
+// lease expires, at which point the first of them to run takes it over.
+package lease
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// lockWait bounds how long Acquire waits for another instance to
+	// finish updating the lease.
+	lockWait = 10 * time.Second
+	// staleLock is the age after which a lock left by a crashed instance
+	// is broken.
+	staleLock = time.Minute
+)
+
+// Lease is the content of the lease.
+type Lease struct {
+	// Holder is the instance ID of the leader.
+	Holder string `json:"holder"`
+	// Acquired is when Holder took over the lease.
+	Acquired time.Time `json:"acquired"`
+	// Expires is when the lease lapses unless renewed.
+	Expires time.Time `json:"expires"`
+}
+
+// Store keeps the lease where every instance can see it.
+type Store interface {
+	// Update reads the lease, a zero Lease if there is none, and passes
+	// it to next. If next reports true, the lease it returns replaces the
+	// one read, without another instance updating it in between; next may
+	// be called again if one did. Update returns the lease as it then
+	// stands.
+	Update(next func(cur Lease) (Lease, bool)) (Lease, error)
+}
+
+// Elector acquires and renews the lease for one instance.
+type Elector struct {
+	store Store
+	id    string
+	ttl   time.Duration
+	now   func() time.Time
+}
+
+// New returns an Elector for instance id using the lease file at path.
+// Each successful Acquire holds the lease for ttl.
+func New(path, id string, ttl time.Duration) *Elector {
+	return NewElector(NewFile(path), id, ttl)
+}
+
+// NewFile returns a Store keeping the lease in the file at path.
+func NewFile(path string) Store {
+	return fileStore(path)
+}
+
+// NewElector returns an Elector for instance id keeping the lease in
+// store. Each successful Acquire holds the lease for ttl.
+func NewElector(store Store, id string, ttl time.Duration) *Elector {
+	return &Elector{store: store, id: id, ttl: ttl, now: time.Now}
+}
+
+// Acquire takes or renews the lease if it is free, expired, or already
+// held by this instance, and reports whether this instance is the leader
+// along with the lease as it now stands.
+func (e *Elector) Acquire() (leader bool, current Lease, err error) {
+	now := e.now()
+	current, err = e.store.Update(func(cur Lease) (Lease, bool) {
+		if cur.Holder != "" && cur.Holder != e.id && now.Before(cur.Expires) {
+			leader = false
+			return cur, false
+		}
+		next := Lease{Holder: e.id, Acquired: cur.Acquired, Expires: now.Add(e.ttl)}
+		if cur.Holder != e.id || cur.Acquired.IsZero() {
+			next.Acquired = now
+		}
+		leader = true
+		return next, true
+	})
+	if err != nil {
+		return false, current, err
+	}
+	return leader, current, nil
+}
+
+// fileStore keeps the lease in a file, which instances on several hosts
+// share over a volume such as NFS.
+type fileStore string
+
+func (path fileStore) Update(next func(cur Lease) (Lease, bool)) (Lease, error) {
+	unlock, err := path.lock()
+	if err != nil {
+		return Lease{}, err
+	}
+	defer unlock()
+
+	cur, err := path.read()
+	if err != nil {
+		return Lease{}, err
+	}
+	l, ok := next(cur)
+	if !ok {
+		return cur, nil
+	}
+	if err := path.write(l); err != nil {
+		return cur, err
+	}
+	return l, nil
+}
+
+// read returns the current lease, or a zero Lease if there is none. A
+// damaged lease file is treated as no lease.
+func (path fileStore) read() (Lease, error) {
+	var l Lease
+	data, err := os.ReadFile(string(path))
+	if errors.Is(err, os.ErrNotExist) {
+		return l, nil
+	}
+	if err != nil {
+		return l, fmt.Errorf("reading lease: %w", err)
+	}
+	if err := json.Unmarshal(data, &l); err != nil {
+		return Lease{}, nil
+	}
+	return l, nil
+}
+
+// write replaces the lease file atomically using a temp file + rename.
+func (path fileStore) write(l Lease) error {
+	data, err := json.Marshal(l)
+	if err != nil {
+		return fmt.Errorf("marshaling lease: %w", err)
+	}
+	tmpFile := string(path) + ".tmp"
+	if err := os.WriteFile(tmpFile, data, 0600); err != nil {
+		return fmt.Errorf("writing temp lease file: %w", err)
+	}
+	if err := os.Rename(tmpFile, string(path)); err != nil {
+		return fmt.Errorf("renaming lease file: %w", err)
+	}
+	return nil
+}
+
+// lock serializes lease updates between instances with an exclusively
+// created lock file, breaking locks older than staleLock.
+func (path fileStore) lock() (unlock func(), err error) {
+	if err := os.MkdirAll(filepath.Dir(string(path)), 0700); err != nil {
+		return nil, fmt.Errorf("creating lease directory: %w", err)
+	}
+	lockPath := string(path) + ".lock"
+	deadline := time.Now().Add(lockWait)
+	for {
+		f, err := os.OpenFile(lockPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(lockPath) }, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, fmt.Errorf("locking lease: %w", err)
+		}
+		if fi, err := os.Stat(lockPath); err == nil && time.Since(fi.ModTime()) > staleLock {
+			os.Remove(lockPath)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("locking lease: %s is held by another instance", lockPath)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,79 @@
+package lease
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFailover(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json.lease")
+	now := time.Date(2024, 5, 1, 14, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+
+	primary := New(path, "primary", 15*time.Minute)
+	primary.now = clock
+	standby := New(path, "standby", 15*time.Minute)
+	standby.now = clock
+
+	if leader, _, err := primary.Acquire(); err != nil || !leader {
+		t.Fatalf("primary Acquire = %v, %v; want leader", leader, err)
+	}
+	leader, cur, err := standby.Acquire()
+	if err != nil || leader {
+		t.Fatalf("standby Acquire = %v, %v; want standby", leader, err)
+	}
+	if cur.Holder != "primary" {
+		t.Errorf("expected lease held by primary, got %+v", cur)
+	}
+
+	// The primary keeps renewing.
+	now = now.Add(10 * time.Minute)
+	if leader, cur, _ := primary.Acquire(); !leader || !cur.Acquired.Equal(now.Add(-10*time.Minute)) {
+		t.Errorf("renewal: leader=%v lease=%+v", leader, cur)
+	}
+	now = now.Add(10 * time.Minute)
+	if leader, _, _ := standby.Acquire(); leader {
+		t.Error("standby took over a renewed lease")
+	}
+
+	// The primary disappears; once its lease lapses the standby takes over.
+	now = now.Add(6 * time.Minute)
+	leader, cur, err = standby.Acquire()
+	if err != nil || !leader || cur.Holder != "standby" || !cur.Acquired.Equal(now) {
+		t.Fatalf("takeover: leader=%v lease=%+v err=%v", leader, cur, err)
+	}
+	if leader, _, _ := primary.Acquire(); leader {
+		t.Error("returning primary should stand by")
+	}
+}
+
+func TestStaleLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json.lease")
+	lockPath := path + ".lock"
+	if err := os.WriteFile(lockPath, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * staleLock)
+	if err := os.Chtimes(lockPath, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	if leader, _, err := New(path, "a", time.Minute).Acquire(); err != nil || !leader {
+		t.Fatalf("Acquire = %v, %v; want stale lock broken", leader, err)
+	}
+	if _, err := os.Stat(lockPath); !os.IsNotExist(err) {
+		t.Error("expected lock to be released")
+	}
+}
+
+func TestCorruptLease(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json.lease")
+	if err := os.WriteFile(path, []byte("{{{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if leader, _, err := New(path, "a", time.Minute).Acquire(); err != nil || !leader {
+		t.Fatalf("Acquire = %v, %v; want a damaged lease to be replaced", leader, err)
+	}
+}
@@ -0,0 +1,72 @@
+// Package maildir delivers messages into Maildir directories, as described
+// at https://cr.yp.to/proto/maildir.html.
+package maildir
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// deliveries numbers the deliveries made by this process, to keep file
+// names unique within the same microsecond.
+var deliveries atomic.Uint64
+
+// Deliver writes the message read from r into the Maildir at dir, creating
+// it if needed, and returns the path of the new file. The message is
+// written to tmp and synced, then moved to new, so that readers never see
+// a partial message.
+func Deliver(dir string, r io.Reader) (string, error) {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return "", fmt.Errorf("creating maildir: %w", err)
+		}
+	}
+
+	name, err := uniqueName(time.Now())
+	if err != nil {
+		return "", err
+	}
+	tmp := filepath.Join(dir, "tmp", name)
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", fmt.Errorf("creating maildir file: %w", err)
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return "", fmt.Errorf("writing maildir file: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return "", fmt.Errorf("syncing maildir file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return "", fmt.Errorf("writing maildir file: %w", err)
+	}
+
+	dst := filepath.Join(dir, "new", name)
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return "", fmt.Errorf("moving maildir file to new: %w", err)
+	}
+	return dst, nil
+}
+
+// uniqueName returns a file name of the form time.MusecPpidQn.host, which
+// no other delivery to the same Maildir can produce.
+func uniqueName(now time.Time) (string, error) {
+	host, err := os.Hostname()
+	if err != nil {
+		return "", fmt.Errorf("maildir file name: %w", err)
+	}
+	host = strings.NewReplacer("/", `\057`, ":", `\072`).Replace(host)
+	return fmt.Sprintf("%d.M%dP%dQ%d.%s",
+		now.Unix(), now.Nanosecond()/1000, os.Getpid(), deliveries.Add(1), host), nil
+}
@@ -0,0 +1,54 @@
+package maildir
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeliver(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "Maildir")
+	raw := "From: a@example.com\r\nSubject: hi\r\n\r\nbody\r\n"
+
+	var paths []string
+	for i := 0; i < 2; i++ {
+		path, err := Deliver(dir, strings.NewReader(raw))
+		if err != nil {
+			t.Fatalf("Deliver failed: %v", err)
+		}
+		paths = append(paths, path)
+	}
+	if paths[0] == paths[1] {
+		t.Errorf("expected unique file names, got %s twice", paths[0])
+	}
+	for _, path := range paths {
+		if filepath.Dir(path) != filepath.Join(dir, "new") {
+			t.Errorf("expected %s in new", path)
+		}
+		if got, err := os.ReadFile(path); err != nil || string(got) != raw {
+			t.Errorf("delivered message = %q (%v)", got, err)
+		}
+	}
+	for _, sub := range []string{"tmp", "cur"} {
+		entries, err := os.ReadDir(filepath.Join(dir, sub))
+		if err != nil || len(entries) != 0 {
+			t.Errorf("expected an empty %s, got %v (%v)", sub, entries, err)
+		}
+	}
+}
+
+func TestUniqueName(t *testing.T) {
+	now := time.Unix(1714573920, 123456789)
+	name, err := uniqueName(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(name, "1714573920.M123456P") {
+		t.Errorf("unexpected name %s", name)
+	}
+	if strings.ContainsAny(name, "/:") {
+		t.Errorf("name %s holds a path separator or colon", name)
+	}
+}
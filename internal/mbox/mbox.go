@@ -0,0 +1,136 @@
+// Package mbox appends messages to mbox files in the mboxrd format: each
+// message starts with a "From " line, lines of the message that start with
+// "From " after any number of ">" get one more ">", and line endings are
+// written as LF.
+package mbox
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// lockWait bounds how long Append waits for another writer's lock.
+	lockWait = 30 * time.Second
+	// staleLock is the age after which a lock file is assumed to be left
+	// over from a crashed writer.
+	staleLock = 5 * time.Minute
+)
+
+// mu serializes appends within the process; the lock file serializes them
+// with other processes, such as mail clients.
+var mu sync.Mutex
+
+// Append adds the message read from r to the mbox file at path, creating
+// it and its directory if needed. The file is locked with a path.lock file
+// while it is written, and truncated back if the message cannot be written
+// whole, so that readers never see a partial message.
+func Append(path string, r io.Reader, received time.Time) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("creating mbox directory: %w", err)
+	}
+	unlock, err := lock(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("opening mbox: %w", err)
+	}
+	defer f.Close()
+	start, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return fmt.Errorf("opening mbox: %w", err)
+	}
+
+	if err := write(f, r, received); err != nil {
+		f.Truncate(start)
+		return fmt.Errorf("writing mbox: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Truncate(start)
+		return fmt.Errorf("syncing mbox: %w", err)
+	}
+	return nil
+}
+
+// write writes one message in the mboxrd format to w. The message is
+// buffered to read its sender for the From line.
+func write(w io.Writer, r io.Reader, received time.Time) error {
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "From %s %s\n", envelopeSender(raw), received.UTC().Format(time.ANSIC))
+	for len(raw) > 0 {
+		line := raw
+		if i := bytes.IndexByte(raw, '\n'); i >= 0 {
+			line, raw = raw[:i], raw[i+1:]
+		} else {
+			raw = nil
+		}
+		line = bytes.TrimSuffix(line, []byte("\r"))
+		if bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From ")) {
+			bw.WriteByte('>')
+		}
+		bw.Write(line)
+		bw.WriteByte('\n')
+	}
+	// A blank line separates messages.
+	bw.WriteByte('\n')
+	return bw.Flush()
+}
+
+// envelopeSender returns the address for the From line: the Return-Path,
+// else the From address, else MAILER-DAEMON.
+func envelopeSender(raw []byte) string {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return "MAILER-DAEMON"
+	}
+	for _, key := range []string{"Return-Path", "From"} {
+		if addr, err := mail.ParseAddress(msg.Header.Get(key)); err == nil && addr.Address != "" {
+			return addr.Address
+		}
+	}
+	return "MAILER-DAEMON"
+}
+
+// lock takes the dot-lock of the mbox file at path, breaking locks older
+// than staleLock.
+func lock(path string) (unlock func(), err error) {
+	lockPath := path + ".lock"
+	deadline := time.Now().Add(lockWait)
+	for {
+		f, err := os.OpenFile(lockPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(lockPath) }, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, fmt.Errorf("locking mbox: %w", err)
+		}
+		if fi, err := os.Stat(lockPath); err == nil && time.Since(fi.ModTime()) > staleLock {
+			os.Remove(lockPath)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("locking mbox: %s is held by another process", lockPath)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
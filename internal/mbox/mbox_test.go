@@ -0,0 +1,71 @@
+package mbox
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAppend(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "user@yahoo.com", "2024-05.mbox")
+	received := time.Date(2024, 5, 1, 14, 32, 0, 0, time.UTC)
+
+	first := "Return-Path: <bounce@example.com>\r\nFrom: Alice <alice@example.com>\r\nSubject: hi\r\n\r\nFrom here on\r\n>From there\r\nbody\r\n"
+	second := "Subject: no sender\r\n\r\nlast line without newline"
+	for _, msg := range []string{first, second} {
+		if err := Append(path, strings.NewReader(msg), received); err != nil {
+			t.Fatalf("Append failed: %v", err)
+		}
+	}
+
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "From bounce@example.com Wed May  1 14:32:00 2024\n" +
+		"Return-Path: <bounce@example.com>\nFrom: Alice <alice@example.com>\nSubject: hi\n\n" +
+		">From here on\n>>From there\nbody\n\n" +
+		"From MAILER-DAEMON Wed May  1 14:32:00 2024\n" +
+		"Subject: no sender\n\nlast line without newline\n\n"
+	if string(got) != want {
+		t.Errorf("mbox =\n%q\nwant\n%q", got, want)
+	}
+	if _, err := os.Stat(path + ".lock"); !os.IsNotExist(err) {
+		t.Errorf("expected the lock to be released, got %v", err)
+	}
+}
+
+func TestAppendWaitsForLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "2024-05.mbox")
+	if err := os.WriteFile(path+".lock", nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- Append(path, strings.NewReader("Subject: x\r\n\r\nbody\r\n"), time.Now()) }()
+
+	select {
+	case err := <-done:
+		t.Fatalf("expected Append to wait for the lock, got %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	os.Remove(path + ".lock")
+	if err := <-done; err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+}
+
+func TestStaleLockIsBroken(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "2024-05.mbox")
+	if err := os.WriteFile(path+".lock", nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * staleLock)
+	if err := os.Chtimes(path+".lock", old, old); err != nil {
+		t.Fatal(err)
+	}
+	if err := Append(path, strings.NewReader("Subject: x\r\n\r\nbody\r\n"), time.Now()); err != nil {
+		t.Fatalf("expected a stale lock to be broken, got %v", err)
+	}
+}
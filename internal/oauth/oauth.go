@@ -0,0 +1,298 @@
+// Package oauth obtains OAuth2 grants for mail access from the command
+// line, with the device authorization flow (RFC 8628) for headless hosts
+// or an authorization code flow with PKCE and a localhost callback for
+// hosts with a browser.
+package oauth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Provider holds the OAuth2 endpoints of an identity provider and the
+// scopes that grant mail access.
+type Provider struct {
+	AuthURL string
+	// DeviceURL is the device authorization endpoint, empty if the provider
+	// has no device flow.
+	DeviceURL string
+	TokenURL  string
+	Scopes    []string
+	// AuthParams are added to the authorization request, e.g. to ask for
+	// a refresh token.
+	AuthParams map[string]string
+}
+
+// Providers are the known providers, by name.
+var Providers = map[string]Provider{
+	"google": {
+		AuthURL:    "https://accounts.google.com/o/oauth2/v2/auth",
+		DeviceURL:  "https://oauth2.googleapis.com/device/code",
+		TokenURL:   "https://oauth2.googleapis.com/token",
+		Scopes:     []string{"https://mail.google.com/"},
+		AuthParams: map[string]string{"access_type": "offline", "prompt": "consent"},
+	},
+	"microsoft": {
+		AuthURL:   "https://login.microsoftonline.com/common/oauth2/v2.0/authorize",
+		DeviceURL: "https://login.microsoftonline.com/common/oauth2/v2.0/devicecode",
+		TokenURL:  "https://login.microsoftonline.com/common/oauth2/v2.0/token",
+		Scopes: []string{
+			"offline_access",
+			"https://outlook.office.com/POP.AccessAsUser.All",
+			"https://outlook.office.com/SMTP.Send",
+		},
+	},
+	"yahoo": {
+		AuthURL:  "https://api.login.yahoo.com/oauth2/request_auth",
+		TokenURL: "https://api.login.yahoo.com/oauth2/get_token",
+		Scopes:   []string{"mail-r"},
+	},
+}
+
+// Client requests grants from a provider for an OAuth2 client.
+type Client struct {
+	Provider     Provider
+	ClientID     string
+	ClientSecret string
+	HTTPClient   *http.Client
+}
+
+// Token is a grant obtained from a provider.
+type Token struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+	Scope        string `json:"scope"`
+}
+
+// DeviceCode is what the user needs to approve a device flow login.
+type DeviceCode struct {
+	UserCode        string
+	VerificationURL string
+	ExpiresIn       time.Duration
+}
+
+// tokenResponse is a token endpoint reply, successful or not.
+type tokenResponse struct {
+	Token
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+func (r tokenResponse) err(status int) error {
+	msg := r.Error
+	if r.ErrorDescription != "" {
+		msg += ": " + r.ErrorDescription
+	}
+	if msg == "" {
+		msg = "no access token in response"
+	}
+	return fmt.Errorf("HTTP %d: %s", status, msg)
+}
+
+// DeviceLogin runs the device authorization flow: it requests a code,
+// passes it to show for the user to enter at the verification URL on any
+// device, and polls until the user approves or denies the request, the
+// code expires, or ctx is done.
+func (c *Client) DeviceLogin(ctx context.Context, show func(DeviceCode)) (*Token, error) {
+	if c.Provider.DeviceURL == "" {
+		return nil, errors.New("oauth2: the provider has no device flow; use the browser flow")
+	}
+	var dr struct {
+		DeviceCode string `json:"device_code"`
+		UserCode   string `json:"user_code"`
+		// Google names it verification_url.
+		VerificationURI string `json:"verification_uri"`
+		VerificationURL string `json:"verification_url"`
+		ExpiresIn       int    `json:"expires_in"`
+		Interval        int    `json:"interval"`
+		Error           string `json:"error"`
+		ErrorDesc       string `json:"error_description"`
+	}
+	dr.Interval = 5 // RFC 8628 section 3.2
+	status, err := c.post(ctx, c.Provider.DeviceURL, url.Values{
+		"client_id": {c.ClientID},
+		"scope":     {strings.Join(c.Provider.Scopes, " ")},
+	}, &dr)
+	if err != nil {
+		return nil, fmt.Errorf("oauth2 device authorization: %w", err)
+	}
+	if status != http.StatusOK || dr.DeviceCode == "" {
+		return nil, fmt.Errorf("oauth2 device authorization: %w", tokenResponse{Error: dr.Error, ErrorDescription: dr.ErrorDesc}.err(status))
+	}
+	if dr.VerificationURI == "" {
+		dr.VerificationURI = dr.VerificationURL
+	}
+	show(DeviceCode{
+		UserCode:        dr.UserCode,
+		VerificationURL: dr.VerificationURI,
+		ExpiresIn:       time.Duration(dr.ExpiresIn) * time.Second,
+	})
+
+	interval := time.Duration(dr.Interval) * time.Second
+	deadline := time.Now().Add(time.Duration(dr.ExpiresIn) * time.Second)
+	for {
+		var tr tokenResponse
+		status, err := c.post(ctx, c.Provider.TokenURL, url.Values{
+			"grant_type":    {"urn:ietf:params:oauth:grant-type:device_code"},
+			"device_code":   {dr.DeviceCode},
+			"client_id":     {c.ClientID},
+			"client_secret": {c.ClientSecret},
+		}, &tr)
+		if err != nil {
+			return nil, fmt.Errorf("oauth2 device token: %w", err)
+		}
+		switch {
+		case status == http.StatusOK && tr.AccessToken != "":
+			return &tr.Token, nil
+		case tr.Error == "authorization_pending":
+		case tr.Error == "slow_down":
+			interval += 5 * time.Second
+		default:
+			return nil, fmt.Errorf("oauth2 device token: %w", tr.err(status))
+		}
+		if dr.ExpiresIn > 0 && time.Now().Add(interval).After(deadline) {
+			return nil, errors.New("oauth2 device token: the code expired before the request was approved")
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+// BrowserLogin runs the authorization code flow with PKCE: it listens for
+// the provider's redirect on a loopback address, passes the authorization
+// URL to open for the user to visit in a browser on this host, and
+// exchanges the returned code for a token. It gives up when ctx is done.
+func (c *Client) BrowserLogin(ctx context.Context, open func(authURL string)) (*Token, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("oauth2 callback listener: %w", err)
+	}
+	defer ln.Close()
+	redirect := "http://" + ln.Addr().String() + "/callback"
+
+	verifier, state := randomString(), randomString()
+	sum := sha256.Sum256([]byte(verifier))
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {c.ClientID},
+		"redirect_uri":          {redirect},
+		"scope":                 {strings.Join(c.Provider.Scopes, " ")},
+		"state":                 {state},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(sum[:])},
+		"code_challenge_method": {"S256"},
+	}
+	for k, v := range c.Provider.AuthParams {
+		q.Set(k, v)
+	}
+
+	type result struct {
+		code string
+		err  error
+	}
+	results := make(chan result, 1)
+	srv := &http.Server{
+		ReadHeaderTimeout: 10 * time.Second,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/callback" {
+				http.NotFound(w, r)
+				return
+			}
+			v := r.URL.Query()
+			var res result
+			switch {
+			case v.Get("state") != state:
+				res.err = errors.New("oauth2 callback: state does not match the request")
+			case v.Get("error") != "":
+				res.err = fmt.Errorf("oauth2 authorization: %s %s", v.Get("error"), v.Get("error_description"))
+			default:
+				res.code = v.Get("code")
+			}
+			if res.err != nil {
+				http.Error(w, "Login failed, see the terminal.", http.StatusBadRequest)
+			} else {
+				fmt.Fprintln(w, "Login complete. You can close this window and return to the terminal.")
+			}
+			select {
+			case results <- res:
+			default:
+			}
+		}),
+	}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	open(c.Provider.AuthURL + "?" + q.Encode())
+
+	var res result
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case res = <-results:
+	}
+	if res.err != nil {
+		return nil, res.err
+	}
+
+	var tr tokenResponse
+	status, err := c.post(ctx, c.Provider.TokenURL, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {res.code},
+		"redirect_uri":  {redirect},
+		"client_id":     {c.ClientID},
+		"client_secret": {c.ClientSecret},
+		"code_verifier": {verifier},
+	}, &tr)
+	if err != nil {
+		return nil, fmt.Errorf("oauth2 code exchange: %w", err)
+	}
+	if status != http.StatusOK || tr.AccessToken == "" {
+		return nil, fmt.Errorf("oauth2 code exchange: %w", tr.err(status))
+	}
+	return &tr.Token, nil
+}
+
+// post sends a form to endpoint and decodes the JSON reply into v,
+// whatever the status, which it returns.
+func (c *Client) post(ctx context.Context, endpoint string, form url.Values, v any) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	hc := c.HTTPClient
+	if hc == nil {
+		hc = &http.Client{Timeout: 30 * time.Second}
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return resp.StatusCode, fmt.Errorf("decoding response (HTTP %d): %w", resp.StatusCode, err)
+	}
+	return resp.StatusCode, nil
+}
+
+// randomString returns 32 random bytes, base64url-encoded, as PKCE
+// verifiers require.
+func randomString() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,151 @@
+package oauth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDeviceLogin(t *testing.T) {
+	var polls atomic.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/device", func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		if r.Form.Get("client_id") != "id" || r.Form.Get("scope") != "mail" {
+			t.Errorf("unexpected device request %v", r.Form)
+		}
+		fmt.Fprint(w, `{"device_code":"dc","user_code":"ABCD-EFGH","verification_url":"https://example.com/device","expires_in":600,"interval":0}`)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		if r.Form.Get("device_code") != "dc" || r.Form.Get("client_secret") != "secret" {
+			t.Errorf("unexpected token request %v", r.Form)
+		}
+		if polls.Add(1) < 3 {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error":"authorization_pending"}`)
+			return
+		}
+		fmt.Fprint(w, `{"access_token":"at","refresh_token":"rt","expires_in":3600}`)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	c := &Client{
+		Provider:     Provider{DeviceURL: srv.URL + "/device", TokenURL: srv.URL + "/token", Scopes: []string{"mail"}},
+		ClientID:     "id",
+		ClientSecret: "secret",
+	}
+	var shown DeviceCode
+	tok, err := c.DeviceLogin(context.Background(), func(dc DeviceCode) { shown = dc })
+	if err != nil {
+		t.Fatalf("DeviceLogin failed: %v", err)
+	}
+	if tok.RefreshToken != "rt" || polls.Load() != 3 {
+		t.Errorf("expected refresh token rt after 3 polls, got %+v after %d", tok, polls.Load())
+	}
+	if shown.UserCode != "ABCD-EFGH" || shown.VerificationURL != "https://example.com/device" || shown.ExpiresIn != 10*time.Minute {
+		t.Errorf("unexpected device code %+v", shown)
+	}
+}
+
+func TestDeviceLoginDenied(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/device" {
+			fmt.Fprint(w, `{"device_code":"dc","user_code":"X","verification_uri":"u","expires_in":600,"interval":0}`)
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"error":"access_denied"}`)
+	}))
+	defer srv.Close()
+
+	c := &Client{Provider: Provider{DeviceURL: srv.URL + "/device", TokenURL: srv.URL + "/token"}}
+	if _, err := c.DeviceLogin(context.Background(), func(DeviceCode) {}); err == nil {
+		t.Fatal("expected a denied request to fail")
+	}
+	if _, err := (&Client{Provider: Providers["yahoo"]}).DeviceLogin(context.Background(), func(DeviceCode) {}); err == nil {
+		t.Error("expected an error for a provider without a device flow")
+	}
+}
+
+func TestBrowserLogin(t *testing.T) {
+	var challenge string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		sum := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+		if r.Form.Get("code") != "the-code" || base64.RawURLEncoding.EncodeToString(sum[:]) != challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error":"invalid_grant"}`)
+			return
+		}
+		fmt.Fprint(w, `{"access_token":"at","refresh_token":"rt","expires_in":3600}`)
+	}))
+	defer srv.Close()
+
+	c := &Client{
+		Provider: Provider{
+			AuthURL:    "https://auth.example.com/authorize",
+			TokenURL:   srv.URL,
+			Scopes:     []string{"mail"},
+			AuthParams: map[string]string{"access_type": "offline"},
+		},
+		ClientID: "id",
+	}
+	// The browser follows the authorization URL and is redirected back.
+	browse := func(authURL string) {
+		u, err := url.Parse(authURL)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		q := u.Query()
+		if q.Get("access_type") != "offline" || q.Get("code_challenge_method") != "S256" {
+			t.Errorf("unexpected authorization URL %s", authURL)
+		}
+		challenge = q.Get("code_challenge")
+		go func() {
+			resp, err := http.Get(q.Get("redirect_uri") + "?code=the-code&state=" + url.QueryEscape(q.Get("state")))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+		}()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	tok, err := c.BrowserLogin(ctx, browse)
+	if err != nil {
+		t.Fatalf("BrowserLogin failed: %v", err)
+	}
+	if tok.RefreshToken != "rt" {
+		t.Errorf("expected refresh token rt, got %+v", tok)
+	}
+}
+
+func TestBrowserLoginStateMismatch(t *testing.T) {
+	c := &Client{Provider: Provider{AuthURL: "https://auth.example.com/authorize"}}
+	browse := func(authURL string) {
+		u, _ := url.Parse(authURL)
+		go func() {
+			resp, err := http.Get(u.Query().Get("redirect_uri") + "?code=x&state=forged")
+			if err == nil {
+				resp.Body.Close()
+			}
+		}()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := c.BrowserLogin(ctx, browse); err == nil {
+		t.Fatal("expected a forged state to be rejected")
+	}
+}
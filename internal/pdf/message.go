@@ -0,0 +1,260 @@
+package pdf
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// headerFields are the headers printed at the top of a rendered message.
+var headerFields = []string{"From", "To", "Cc", "Date", "Subject"}
+
+// maxDepth bounds the nesting of multipart bodies that is followed.
+const maxDepth = 10
+
+// Render writes the message read from r as a PDF document: its main
+// headers, followed by the text of its body. Of alternative parts the
+// plain text is preferred; HTML is reduced to text. Attachments are listed
+// by name but not rendered.
+func Render(w io.Writer, r io.Reader) error {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return fmt.Errorf("parsing message: %w", err)
+	}
+	var doc Document
+	dec := new(mime.WordDecoder)
+	for _, key := range headerFields {
+		v := msg.Header.Get(key)
+		if v == "" {
+			continue
+		}
+		if d, err := dec.DecodeHeader(v); err == nil {
+			v = d
+		}
+		doc.Text(fmt.Sprintf("%-8s %s", key+":", v), true)
+	}
+	doc.Text("", false)
+
+	var body strings.Builder
+	if err := bodyText(&body, msg.Header.Get("Content-Type"), msg.Header.Get("Content-Transfer-Encoding"), msg.Body, 0); err != nil {
+		return fmt.Errorf("reading message body: %w", err)
+	}
+	doc.Text(strings.TrimSpace(body.String()), false)
+
+	_, err = doc.WriteTo(w)
+	return err
+}
+
+// WriteFile renders the message read from r to path, creating its
+// directory if needed. The file is written atomically, through a
+// temporary file that is then renamed.
+func WriteFile(path string, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("creating PDF directory: %w", err)
+	}
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	err = Render(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// bodyText appends the text of a body with the given Content-Type and
+// Content-Transfer-Encoding to b.
+func bodyText(b *strings.Builder, contentType, encoding string, r io.Reader, depth int) error {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType, params = "text/plain", map[string]string{}
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") && depth < maxDepth {
+		parts, err := readParts(r, params["boundary"])
+		if err != nil {
+			return err
+		}
+		if mediaType == "multipart/alternative" {
+			parts = []part{preferred(parts)}
+		}
+		for _, p := range parts {
+			if err := bodyText(b, p.contentType, p.encoding, bytes.NewReader(p.body), depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	switch mediaType {
+	case "text/plain", "text/html":
+		data, err := io.ReadAll(decoder(encoding, r))
+		if err != nil {
+			return err
+		}
+		text := toUTF8(data, params["charset"])
+		if mediaType == "text/html" {
+			text = htmlText(text)
+		}
+		b.WriteString(text)
+		b.WriteString("\n\n")
+	default:
+		b.WriteString("[Attachment: " + mediaType + "]\n\n")
+	}
+	return nil
+}
+
+// part is one part of a multipart body.
+type part struct {
+	contentType string
+	encoding    string
+	filename    string
+	body        []byte
+}
+
+// readParts reads the parts of a multipart body. Attachments are kept as
+// a placeholder naming them instead of their content.
+func readParts(r io.Reader, boundary string) ([]part, error) {
+	if boundary == "" {
+		return nil, fmt.Errorf("multipart body without boundary")
+	}
+	mr := multipart.NewReader(r, boundary)
+	var parts []part
+	for {
+		p, err := mr.NextRawPart()
+		if err == io.EOF {
+			return parts, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		pt := part{
+			contentType: p.Header.Get("Content-Type"),
+			encoding:    p.Header.Get("Content-Transfer-Encoding"),
+			filename:    p.FileName(),
+		}
+		if pt.contentType == "" {
+			pt.contentType = "text/plain"
+		}
+		if disp, _, _ := mime.ParseMediaType(p.Header.Get("Content-Disposition")); disp == "attachment" || pt.filename != "" {
+			name := pt.filename
+			if name == "" {
+				name = "unnamed"
+			}
+			pt.contentType, pt.encoding = "text/plain", ""
+			pt.body = []byte("[Attachment: " + name + "]")
+		} else if pt.body, err = io.ReadAll(p); err != nil {
+			return nil, err
+		}
+		parts = append(parts, pt)
+	}
+}
+
+// preferred returns the part of a multipart/alternative body to render:
+// the first text/plain part, or else the last one, which is the richest.
+func preferred(parts []part) part {
+	if len(parts) == 0 {
+		return part{contentType: "text/plain"}
+	}
+	for _, p := range parts {
+		if mt, _, _ := mime.ParseMediaType(p.contentType); mt == "text/plain" {
+			return p
+		}
+	}
+	return parts[len(parts)-1]
+}
+
+// decoder returns a reader decoding r according to a
+// Content-Transfer-Encoding.
+func decoder(encoding string, r io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, r)
+	case "quoted-printable":
+		return quotedprintable.NewReader(r)
+	}
+	return r
+}
+
+// toUTF8 converts text in charset to UTF-8. Latin-1 and Windows-1252 are
+// converted; other charsets are assumed to be UTF-8 or ASCII, with invalid
+// bytes replaced.
+func toUTF8(data []byte, charset string) string {
+	switch strings.ToLower(charset) {
+	case "iso-8859-1", "latin1", "windows-1252", "cp1252":
+		runes := make([]rune, len(data))
+		for i, c := range data {
+			runes[i] = rune(c)
+			if r, ok := winAnsiRunes[c]; ok {
+				runes[i] = r
+			}
+		}
+		return string(runes)
+	}
+	if utf8.Valid(data) {
+		return string(data)
+	}
+	return strings.ToValidUTF8(string(data), "?")
+}
+
+// winAnsiRunes is the inverse of winAnsi. Latin-1 leaves these bytes to
+// control characters, so reading Latin-1 as Windows-1252, as mail clients
+// do, is harmless.
+var winAnsiRunes = func() map[byte]rune {
+	m := make(map[byte]rune, len(winAnsi))
+	for r, c := range winAnsi {
+		m[c] = r
+	}
+	return m
+}()
+
+var (
+	htmlDrop     = regexp.MustCompile(`(?is)<head\b.*?</head\s*>|<script\b.*?</script\s*>|<style\b.*?</style\s*>|<!--.*?-->`)
+	htmlBreak    = regexp.MustCompile(`(?i)<br\b[^>]*>|</?(p|div|tr|table|h[1-6]|ul|ol|blockquote|pre|hr)\b[^>]*>`)
+	htmlItem     = regexp.MustCompile(`(?i)<li\b[^>]*>`)
+	htmlCell     = regexp.MustCompile(`(?i)</t[dh]\s*>`)
+	htmlTag      = regexp.MustCompile(`<[^>]*>`)
+	spaces       = regexp.MustCompile(`[ \t\f\v\x{a0}]+`)
+	blankLines   = regexp.MustCompile(`\n{3,}`)
+	lineNewlines = regexp.MustCompile(`\s*\n\s*`)
+)
+
+// htmlText reduces an HTML document to its text, keeping line breaks at
+// block elements.
+func htmlText(s string) string {
+	s = htmlDrop.ReplaceAllString(s, "")
+	s = lineNewlines.ReplaceAllString(s, " ")
+	s = htmlBreak.ReplaceAllString(s, "\n")
+	s = htmlItem.ReplaceAllString(s, "\n- ")
+	s = htmlCell.ReplaceAllString(s, "  ")
+	s = htmlTag.ReplaceAllString(s, "")
+	s = html.UnescapeString(s)
+	s = spaces.ReplaceAllString(s, " ")
+	lines := strings.Split(s, "\n")
+	for i, l := range lines {
+		lines[i] = strings.TrimSpace(l)
+	}
+	return strings.TrimSpace(blankLines.ReplaceAllString(strings.Join(lines, "\n"), "\n\n"))
+}
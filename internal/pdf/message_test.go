@@ -0,0 +1,91 @@
+package pdf
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const multipartMessage = "From: =?utf-8?q?Ma_Banque?= <no-reply@statements.mybank.com>\r\n" +
+	"To: me@yahoo.com\r\n" +
+	"Subject: Your statement\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/mixed; boundary=outer\r\n" +
+	"\r\n" +
+	"--outer\r\n" +
+	"Content-Type: multipart/alternative; boundary=inner\r\n" +
+	"\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/html; charset=utf-8\r\n" +
+	"\r\n" +
+	"<p>ignored</p>\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/plain; charset=windows-1252\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"Balance: 12,00 =80 =E9t=E9\r\n" +
+	"--inner--\r\n" +
+	"--outer\r\n" +
+	"Content-Type: application/pdf\r\n" +
+	"Content-Disposition: attachment; filename=\"statement.pdf\"\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"JVBERi0xLjQK\r\n" +
+	"--outer--\r\n"
+
+func TestBodyText(t *testing.T) {
+	var b strings.Builder
+	err := bodyText(&b, "multipart/mixed; boundary=outer", "", strings.NewReader(multipartMessage[strings.Index(multipartMessage, "--outer"):]), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := b.String()
+	if !strings.Contains(got, "Balance: 12,00 € été") {
+		t.Errorf("plain text part not decoded: %q", got)
+	}
+	if strings.Contains(got, "ignored") {
+		t.Errorf("HTML alternative rendered as well: %q", got)
+	}
+	if !strings.Contains(got, "[Attachment: statement.pdf]") {
+		t.Errorf("attachment not listed: %q", got)
+	}
+}
+
+func TestHTMLText(t *testing.T) {
+	in := `<html><head><title>Invoice</title><style>p { color: red }</style></head>
+<body><h1>Invoice&nbsp;#42</h1><p>Dear  customer,<br>thank
+you.</p><ul><li>One &amp; two</li><li>Three</li></ul>
+<table><tr><td>Total</td><td>10 &euro;</td></tr></table><!-- tracking --></body></html>`
+	want := "Invoice #42\n\nDear customer,\nthank you.\n\n- One & two\n- Three\n\nTotal 10 €"
+	if got := htmlText(in); got != want {
+		t.Errorf("htmlText() =\n%q\nwant\n%q", got, want)
+	}
+}
+
+func TestWriteFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "me@yahoo.com", "2026-10", "id.pdf")
+	if err := WriteFile(path, strings.NewReader(multipartMessage)); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, []byte("%PDF-")) {
+		t.Errorf("not a PDF file")
+	}
+	for _, want := range []string{"(From:    Ma Banque <no-reply@statements.mybank.com>) '", "(Subject: Your statement) '"} {
+		if !bytes.Contains(data, []byte(want)) {
+			t.Errorf("PDF lacks %q", want)
+		}
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary file left behind")
+	}
+
+	if err := WriteFile(path, strings.NewReader("not a message")); err == nil {
+		t.Error("expected an error for an unparsable message")
+	}
+}
@@ -0,0 +1,190 @@
+// Package pdf renders email messages as simple, self-contained PDF
+// documents for long-term, human-readable records. The layout is plain
+// text in the standard Courier fonts, so no fonts or external renderer
+// are needed; HTML bodies are reduced to their text.
+package pdf
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// Page geometry, in points, for A4 paper.
+const (
+	pageWidth  = 595
+	pageHeight = 842
+	margin     = 50
+	fontSize   = 9
+	leading    = 12
+	// lineChars is the number of Courier characters (0.6 em wide) that fit
+	// between the margins.
+	lineChars = (pageWidth - 2*margin) * 10 / (fontSize * 6)
+	// pageLines is the number of lines that fit on a page.
+	pageLines = (pageHeight - 2*margin) / leading
+)
+
+// line is one line of text on a page.
+type line struct {
+	text string
+	bold bool
+}
+
+// Document is a PDF document built up line by line.
+type Document struct {
+	lines []line
+}
+
+// Text adds text, wrapping long lines to the page width. Line breaks in
+// text start new lines.
+func (d *Document) Text(text string, bold bool) {
+	for _, l := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n") {
+		l = strings.ReplaceAll(l, "\t", "    ")
+		for utf8.RuneCountInString(l) > lineChars {
+			cut := wrapAt(l)
+			d.lines = append(d.lines, line{strings.TrimRight(l[:cut], " "), bold})
+			l = l[cut:]
+		}
+		d.lines = append(d.lines, line{l, bold})
+	}
+}
+
+// wrapAt returns the byte offset at which to wrap l, which is longer than
+// lineChars: after the last space that keeps the line within the width,
+// or at the width if there is none.
+func wrapAt(l string) int {
+	end, n := 0, 0
+	for i := range l {
+		if n == lineChars {
+			end = i
+			break
+		}
+		n++
+	}
+	if sp := strings.LastIndexByte(l[:end], ' '); sp > 0 {
+		return sp + 1
+	}
+	return end
+}
+
+// WriteTo writes the document as a PDF file.
+func (d *Document) WriteTo(w io.Writer) (int64, error) {
+	pages := make([][]line, 0, len(d.lines)/pageLines+1)
+	for i := 0; i < len(d.lines); i += pageLines {
+		pages = append(pages, d.lines[i:min(i+pageLines, len(d.lines))])
+	}
+	if len(pages) == 0 {
+		pages = append(pages, nil)
+	}
+
+	// Objects: 1 catalog, 2 page tree, 3 and 4 fonts, then a page and its
+	// content stream for each page.
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"", // page tree, filled in below
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Courier /Encoding /WinAnsiEncoding >>",
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Courier-Bold /Encoding /WinAnsiEncoding >>",
+	}
+	kids := make([]string, len(pages))
+	for i, page := range pages {
+		pageObj := len(objects) + 1
+		kids[i] = fmt.Sprintf("%d 0 R", pageObj)
+		content := pageContent(page)
+		objects = append(objects,
+			fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] /Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> /Contents %d 0 R >>",
+				pageWidth, pageHeight, pageObj+1),
+			fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", len(content), content),
+		)
+	}
+	objects[1] = fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pages))
+
+	cw := &countingWriter{w: bufio.NewWriter(w)}
+	offsets := make([]int64, len(objects))
+	fmt.Fprint(cw, "%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	for i, obj := range objects {
+		offsets[i] = cw.n
+		fmt.Fprintf(cw, "%d 0 obj\n%s\nendobj\n", i+1, obj)
+	}
+	xref := cw.n
+	fmt.Fprintf(cw, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(cw, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(cw, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	if cw.err == nil {
+		cw.err = cw.w.Flush()
+	}
+	return cw.n, cw.err
+}
+
+// pageContent returns the content stream drawing lines.
+func pageContent(lines []line) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "BT\n%d TL\n%d %d Td\n", leading, margin, pageHeight-margin-fontSize)
+	bold := false
+	fmt.Fprintf(&b, "/F1 %d Tf\n", fontSize)
+	for _, l := range lines {
+		if l.bold != bold {
+			bold = l.bold
+			font := "/F1"
+			if bold {
+				font = "/F2"
+			}
+			fmt.Fprintf(&b, "%s %d Tf\n", font, fontSize)
+		}
+		fmt.Fprintf(&b, "(%s) '\n", escape(l.text))
+	}
+	b.WriteString("ET")
+	return b.String()
+}
+
+// escape encodes s as the body of a PDF literal string in WinAnsiEncoding.
+// Characters outside Latin-1 are replaced by "?".
+func escape(s string) string {
+	var b bytes.Buffer
+	for _, r := range s {
+		switch {
+		case r == '\\' || r == '(' || r == ')':
+			b.WriteByte('\\')
+			b.WriteByte(byte(r))
+		case r < 0x20 || r == 0x7f || (r >= 0x80 && r < 0xa0):
+			b.WriteByte(' ')
+		case r < 0x100:
+			b.WriteByte(byte(r))
+		default:
+			if c, ok := winAnsi[r]; ok {
+				b.WriteByte(c)
+			} else {
+				b.WriteByte('?')
+			}
+		}
+	}
+	return b.String()
+}
+
+// winAnsi maps the common characters that WinAnsiEncoding places in
+// 0x80-0x9f.
+var winAnsi = map[rune]byte{
+	'€': 0x80, '‚': 0x82, '„': 0x84, '…': 0x85, '‘': 0x91, '’': 0x92,
+	'“': 0x93, '”': 0x94, '•': 0x95, '–': 0x96, '—': 0x97, '™': 0x99,
+}
+
+// countingWriter tracks the bytes written and the first error.
+type countingWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	c.err = err
+	return n, err
+}
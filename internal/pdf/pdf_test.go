@@ -0,0 +1,66 @@
+package pdf
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestTextWraps(t *testing.T) {
+	var d Document
+	d.Text(strings.Repeat("word ", 40)+"\n"+strings.Repeat("x", lineChars+5), false)
+	for i, l := range d.lines {
+		if n := len([]rune(l.text)); n > lineChars {
+			t.Errorf("line %d has %d characters, more than %d", i, n, lineChars)
+		}
+	}
+	if len(d.lines) != 5 {
+		t.Fatalf("expected 5 lines, got %d: %v", len(d.lines), d.lines)
+	}
+	if d.lines[3].text != strings.Repeat("x", lineChars) || d.lines[4].text != "xxxxx" {
+		t.Errorf("unbroken word not cut at the width: %v", d.lines[3:])
+	}
+}
+
+func TestWriteTo(t *testing.T) {
+	var d Document
+	d.Text("Subject: (statement) \\ été", true)
+	for i := 0; i < pageLines+1; i++ {
+		d.Text(fmt.Sprintf("line %d", i), false)
+	}
+	var buf bytes.Buffer
+	n, err := d.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(buf.Len()) {
+		t.Errorf("WriteTo reported %d bytes, wrote %d", n, buf.Len())
+	}
+	out := buf.String()
+	if !strings.HasPrefix(out, "%PDF-1.4\n") || !strings.HasSuffix(out, "%%EOF\n") {
+		t.Errorf("missing PDF header or trailer")
+	}
+	if !strings.Contains(out, "/Count 2 ") {
+		t.Errorf("expected two pages")
+	}
+	if !strings.Contains(out, "(Subject: \\(statement\\) \\\\ \xe9t\xe9) '") {
+		t.Errorf("text not escaped and encoded")
+	}
+
+	// Every xref entry must point at its object.
+	m := regexp.MustCompile(`startxref\n(\d+)\n`).FindStringSubmatch(out)
+	if m == nil {
+		t.Fatal("no startxref")
+	}
+	xref, _ := strconv.Atoi(m[1])
+	entries := strings.Split(out[xref:], "\n")[3:]
+	for i := 1; strings.HasSuffix(entries[i-1], " n "); i++ {
+		off, _ := strconv.Atoi(entries[i-1][:10])
+		if want := fmt.Sprintf("%d 0 obj\n", i); !strings.HasPrefix(out[off:], want) {
+			t.Errorf("xref entry %d points at %q", i, out[off:off+10])
+		}
+	}
+}
@@ -3,13 +3,21 @@ package pop3
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"crypto/tls"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/benj-n/yatogm/internal/clock"
+	"github.com/benj-n/yatogm/internal/fault"
 )
 
 // Message represents a fetched email message.
@@ -20,74 +28,379 @@ type Message struct {
 	Raw []byte
 }
 
-// Client is a POP3S client that connects over TLS.
+// Client is a POP3 client, normally connected over TLS.
 type Client struct {
 	conn   net.Conn
 	reader *bufio.Reader
+	// caps holds the capabilities the server advertised, or nil if they
+	// are unknown, in which case every command is assumed supported.
+	caps map[string][]string
+	// With PIPELINING, ahead lists the messages RetrieveTo is called for
+	// next, and sent those whose RETR was sent but whose response was not
+	// read yet, both in order.
+	ahead []int
+	sent  []int
+	// timeout bounds each command, including reading its response, or is
+	// zero for DefaultCommandTimeout.
+	timeout time.Duration
+	// clock sets the deadlines, or is nil for clock.System.
+	clock clock.Clock
+}
+
+// Dialer opens the connections to servers. A *net.Dialer is one; tests
+// and embedders may supply their own transport.
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// Option configures how a Client connects and keeps time.
+type Option func(*options)
+
+type options struct {
+	dialer Dialer
+	clock  clock.Clock
 }
 
+// WithDialer connects with d instead of a net.Dialer, which then also
+// bounds connecting by the dial timeout.
+func WithDialer(d Dialer) Option {
+	return func(o *options) {
+		o.dialer = d
+	}
+}
+
+// WithClock sets the deadlines by c instead of the system clock. The
+// connection's deadlines are then in c's time, which the transport must
+// keep too.
+func WithClock(c clock.Clock) Option {
+	return func(o *options) {
+		o.clock = c
+	}
+}
+
+// DefaultCommandTimeout is how long a command may take unless
+// SetCommandTimeout says otherwise.
+const DefaultCommandTimeout = 30 * time.Second
+
+// pipelineWindow bounds the commands sent ahead of reading their
+// responses, so that the server never blocks writing responses while the
+// client blocks writing commands.
+const pipelineWindow = 8
+
+// ErrNotSupported is returned for a command the server's capabilities
+// leave out, without sending it.
+var ErrNotSupported = errors.New("not supported by the server")
+
+// errServer is wrapped by the errors of -ERR responses.
+var errServer = errors.New("server error")
+
+// ErrClosed is matched by the errors after which the Client closed its
+// connection, as it no longer knew where the server's next response
+// starts. The Client cannot be used further.
+var ErrClosed = errors.New("connection closed")
+
+// closedError is an error after which the Client closed its connection.
+type closedError struct{ err error }
+
+func (e closedError) Error() string   { return e.err.Error() }
+func (e closedError) Unwrap() []error { return []error{e.err, ErrClosed} }
+
+// TLSMode selects how a Client secures its connection.
+type TLSMode string
+
+const (
+	// TLSImplicit speaks TLS from the start, as on port 995.
+	TLSImplicit TLSMode = "implicit"
+	// TLSStartTLS upgrades a plaintext connection with STLS (RFC 2595), as
+	// on port 110.
+	TLSStartTLS TLSMode = "starttls"
+	// TLSNone stays in plaintext, sending the password in the clear.
+	TLSNone TLSMode = "none"
+)
+
 // Dial connects to a POP3S server and returns a Client.
-func Dial(host string, port int, timeout time.Duration) (*Client, error) {
+func Dial(host string, port int, timeout time.Duration, opts ...Option) (*Client, error) {
+	return DialTLS(host, port, timeout, &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}, opts...)
+}
+
+// DialTLS connects to a POP3S server using the given TLS configuration.
+func DialTLS(host string, port int, timeout time.Duration, tlsConfig *tls.Config, opts ...Option) (*Client, error) {
+	return DialMode(host, port, timeout, tlsConfig, TLSImplicit, opts...)
+}
+
+// DialMode connects to a POP3 server, securing the connection as mode
+// says (TLSImplicit if empty) with the given TLS configuration. With
+// TLSStartTLS, a server that refuses STLS is an error rather than a reason
+// to go on in plaintext.
+func DialMode(host string, port int, timeout time.Duration, tlsConfig *tls.Config, mode TLSMode, opts ...Option) (*Client, error) {
+	return DialContext(context.Background(), host, port, timeout, tlsConfig, mode, opts...)
+}
+
+// DialContext is like DialMode, but connects within ctx, and gives up on
+// the TLS handshake and the greeting at ctx's deadline. A zero timeout
+// leaves connecting bounded by ctx alone.
+func DialContext(ctx context.Context, host string, port int, timeout time.Duration, tlsConfig *tls.Config, mode TLSMode, opts ...Option) (*Client, error) {
 	addr := net.JoinHostPort(host, strconv.Itoa(port))
 
-	dialer := &net.Dialer{Timeout: timeout}
-	tlsConn, err := tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{
-		MinVersion: tls.VersionTLS12,
-	})
+	o := options{dialer: &net.Dialer{Timeout: timeout}, clock: clock.System}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	conn, err := o.dialer.DialContext(ctx, "tcp", addr)
 	if err != nil {
 		return nil, fmt.Errorf("pop3 dial %s: %w", addr, err)
 	}
 
-	c := &Client{
-		conn:   tlsConn,
-		reader: bufio.NewReader(tlsConn),
+	if tlsConfig.ServerName == "" {
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.ServerName = host
+	}
+	c := &Client{conn: fault.Conn(conn), clock: o.clock}
+	if deadline, ok := ctx.Deadline(); ok && (timeout <= 0 || deadline.Sub(c.now()) < timeout) {
+		timeout = deadline.Sub(c.now())
 	}
+	if mode != TLSStartTLS && mode != TLSNone {
+		if err := c.handshake(tlsConfig, timeout); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("pop3 dial %s: %w", addr, err)
+		}
+	}
+	c.reader = bufio.NewReader(c.conn)
 
 	// Read the server greeting.
+	if err := c.setDeadline(ctx); err != nil {
+		c.conn.Close()
+		return nil, fmt.Errorf("pop3 greeting: %w", err)
+	}
 	if _, err := c.readResponse(); err != nil {
-		tlsConn.Close()
+		c.conn.Close()
 		return nil, fmt.Errorf("pop3 greeting: %w", err)
 	}
+	if err := c.loadCapabilities(); err != nil {
+		c.conn.Close()
+		return nil, err
+	}
+
+	if mode == TLSStartTLS {
+		if err := c.StartTLS(tlsConfig, timeout); err != nil {
+			c.conn.Close()
+			return nil, err
+		}
+	}
 
 	return c, nil
 }
 
-// Login authenticates with the POP3 server using USER/PASS.
+// StartTLS upgrades the plaintext connection to TLS with STLS, and asks
+// the server for its capabilities again, as they may differ under TLS.
+func (c *Client) StartTLS(tlsConfig *tls.Config, timeout time.Duration) error {
+	if !c.supports("STLS") {
+		return fmt.Errorf("pop3 STLS: %w", ErrNotSupported)
+	}
+	if _, err := c.command("STLS"); err != nil {
+		return fmt.Errorf("pop3 STLS: %w", err)
+	}
+	// Anything the server sent after its response, before the handshake,
+	// could have been injected by an attacker in the plaintext stream.
+	if c.reader.Buffered() > 0 {
+		return errors.New("pop3 STLS: unexpected data before the TLS handshake")
+	}
+	if err := c.handshake(tlsConfig, timeout); err != nil {
+		return fmt.Errorf("pop3 STLS: %w", err)
+	}
+	c.reader = bufio.NewReader(c.conn)
+	return c.loadCapabilities()
+}
+
+// SetCommandTimeout sets how long each later command may take, including
+// reading its response, such as a whole message for RETR. Zero selects
+// DefaultCommandTimeout, the default.
+func (c *Client) SetCommandTimeout(d time.Duration) {
+	c.timeout = d
+}
+
+// setDeadline bounds the next exchange on the connection by the command
+// timeout, or by ctx's deadline if that comes first, and fails if ctx is
+// done already.
+func (c *Client) setDeadline(ctx context.Context) error {
+	timeout := c.timeout
+	if timeout <= 0 {
+		timeout = DefaultCommandTimeout
+	}
+	deadline := c.now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err := c.conn.SetDeadline(deadline); err != nil {
+		return err
+	}
+	return ctx.Err()
+}
+
+// now returns the time by the client's clock.
+func (c *Client) now() time.Time {
+	if c.clock == nil {
+		return clock.System.Now()
+	}
+	return c.clock.Now()
+}
+
+// handshake starts TLS on the connection.
+func (c *Client) handshake(tlsConfig *tls.Config, timeout time.Duration) error {
+	tlsConn := tls.Client(c.conn, tlsConfig)
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = c.now().Add(timeout)
+	}
+	if err := tlsConn.SetDeadline(deadline); err != nil {
+		return err
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+	c.conn = tlsConn
+	return nil
+}
+
+// Capabilities asks the server for its capabilities with CAPA (RFC 2449)
+// and returns them by upper-cased name, each with its parameters. Servers
+// older than CAPA answer with an error.
+func (c *Client) Capabilities() (map[string][]string, error) {
+	if _, err := c.command("CAPA"); err != nil {
+		return nil, fmt.Errorf("pop3 CAPA: %w", err)
+	}
+
+	caps := make(map[string][]string)
+	err := c.readMultiline(func(line []byte) error {
+		if fields := strings.Fields(string(trimEOL(line))); len(fields) > 0 {
+			caps[strings.ToUpper(fields[0])] = fields[1:]
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("pop3 CAPA read: %w", err)
+	}
+
+	return caps, nil
+}
+
+// loadCapabilities records the server's capabilities, or that they are
+// unknown if it does not implement CAPA.
+func (c *Client) loadCapabilities() error {
+	caps, err := c.Capabilities()
+	if err != nil && !errors.Is(err, errServer) {
+		return err
+	}
+	c.caps = caps
+	return nil
+}
+
+// supports reports whether the server advertised the capability name, or
+// did not tell.
+func (c *Client) supports(name string) bool {
+	if c.caps == nil {
+		return true
+	}
+	_, ok := c.caps[name]
+	return ok
+}
+
+// Pipelining reports whether the server advertised PIPELINING (RFC 2449),
+// accepting commands before it answered the ones sent earlier. Servers
+// whose capabilities are unknown are not sent commands ahead.
+func (c *Client) Pipelining() bool {
+	_, ok := c.caps["PIPELINING"]
+	return ok
+}
+
+// Login authenticates with the POP3 server using USER/PASS, or SASL PLAIN
+// (RFC 5034) if the server only offers that, and asks for the server's
+// capabilities again, as more may be offered once logged in.
 func (c *Client) Login(user, pass string) error {
-	if _, err := c.command("USER " + user); err != nil {
-		return fmt.Errorf("pop3 USER: %w", err)
+	switch {
+	case c.supports("USER"):
+		if _, err := c.command("USER " + user); err != nil {
+			return fmt.Errorf("pop3 USER: %w", err)
+		}
+		if _, err := c.command("PASS " + pass); err != nil {
+			return fmt.Errorf("pop3 PASS: %w", err)
+		}
+	case slices.Contains(c.caps["SASL"], "PLAIN"):
+		resp := base64.StdEncoding.EncodeToString([]byte("\x00" + user + "\x00" + pass))
+		if _, err := c.command("AUTH PLAIN " + resp); err != nil {
+			return fmt.Errorf("pop3 AUTH PLAIN: %w", err)
+		}
+	default:
+		return fmt.Errorf("pop3 login: neither USER/PASS nor SASL PLAIN is offered: %w", ErrNotSupported)
 	}
-	if _, err := c.command("PASS " + pass); err != nil {
-		return fmt.Errorf("pop3 PASS: %w", err)
+	if c.caps != nil {
+		return c.loadCapabilities()
+	}
+	return nil
+}
+
+// Stat returns the number of messages in the maildrop and their total size
+// in octets.
+func (c *Client) Stat() (count int, size int64, err error) {
+	resp, err := c.command("STAT")
+	if err != nil {
+		return 0, 0, fmt.Errorf("pop3 STAT: %w", err)
+	}
+	if _, err := fmt.Sscan(strings.TrimPrefix(resp, "+OK"), &count, &size); err != nil {
+		return 0, 0, fmt.Errorf("pop3 STAT: malformed response %q", resp)
+	}
+	return count, size, nil
+}
+
+// Noop sends NOOP, which only checks that the server still responds.
+func (c *Client) Noop() error {
+	if _, err := c.command("NOOP"); err != nil {
+		return fmt.Errorf("pop3 NOOP: %w", err)
 	}
 	return nil
 }
 
 // UIDList returns a map of message number to UID for all messages.
 func (c *Client) UIDList() (map[int]string, error) {
+	if !c.supports("UIDL") {
+		// Without unique IDs, messages cannot be told apart across runs.
+		return nil, fmt.Errorf("pop3 UIDL: %w, and is needed to track which messages were forwarded", ErrNotSupported)
+	}
 	if _, err := c.command("UIDL"); err != nil {
 		return nil, fmt.Errorf("pop3 UIDL: %w", err)
 	}
 
 	result := make(map[int]string)
-	for {
-		line, err := c.reader.ReadString('\n')
-		if err != nil {
-			return nil, fmt.Errorf("pop3 UIDL read: %w", err)
-		}
-		line = strings.TrimRight(line, "\r\n")
-		if line == "." {
-			break
+	err := c.readMultiline(func(line []byte) error {
+		if num, uid, ok := parseUIDLLine(string(trimEOL(line))); ok {
+			result[num] = uid
 		}
-		parts := strings.SplitN(line, " ", 2)
-		if len(parts) != 2 {
-			continue
-		}
-		num, err := strconv.Atoi(parts[0])
-		if err != nil {
-			continue
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("pop3 UIDL read: %w", err)
+	}
+
+	return result, nil
+}
+
+// List returns a map of message number to size in octets for all messages.
+func (c *Client) List() (map[int]int64, error) {
+	if _, err := c.command("LIST"); err != nil {
+		return nil, fmt.Errorf("pop3 LIST: %w", err)
+	}
+
+	result := make(map[int]int64)
+	err := c.readMultiline(func(line []byte) error {
+		if num, size, ok := parseListLine(string(trimEOL(line))); ok {
+			result[num] = size
 		}
-		result[num] = parts[1]
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("pop3 LIST read: %w", err)
 	}
 
 	return result, nil
@@ -95,29 +408,189 @@ func (c *Client) UIDList() (map[int]string, error) {
 
 // Retrieve fetches the full message content for the given message number.
 func (c *Client) Retrieve(msgNum int) ([]byte, error) {
-	if _, err := c.command(fmt.Sprintf("RETR %d", msgNum)); err != nil {
-		return nil, fmt.Errorf("pop3 RETR %d: %w", msgNum, err)
+	var buf bytes.Buffer
+	if _, err := c.RetrieveTo(msgNum, &buf); err != nil {
+		return nil, err
 	}
+	return buf.Bytes(), nil
+}
 
-	var buf strings.Builder
-	for {
-		line, err := c.reader.ReadString('\n')
-		if err != nil {
-			return nil, fmt.Errorf("pop3 RETR %d read: %w", msgNum, err)
+// RetrieveAhead announces the messages RetrieveTo is called for next, in
+// order. With PIPELINING, RETR commands for up to pipelineWindow of them are
+// then kept sent ahead, so that the server streams each message while the
+// one before it is processed instead of waiting a round trip for every
+// message. Without it, RetrieveAhead does nothing. Any other command, or
+// retrieving another message, forgets the announced messages.
+func (c *Client) RetrieveAhead(nums []int) error {
+	if !c.Pipelining() {
+		return nil
+	}
+	if err := c.drain(context.Background()); err != nil {
+		return err
+	}
+	c.ahead = slices.Clone(nums)
+	return c.sendAhead(context.Background())
+}
+
+// sendAhead sends, in one write, RETR for the next announced messages until
+// pipelineWindow are outstanding. If that fails, it is unknown which of
+// them the server got, so the connection is closed rather than risk taking
+// the response for one message as that for another.
+func (c *Client) sendAhead(ctx context.Context) error {
+	var b bytes.Buffer
+	for len(c.sent) < pipelineWindow && len(c.ahead) > 0 {
+		fmt.Fprintf(&b, "RETR %d\r\n", c.ahead[0])
+		c.sent = append(c.sent, c.ahead[0])
+		c.ahead = c.ahead[1:]
+	}
+	if b.Len() == 0 {
+		return nil
+	}
+	if err := c.setDeadline(ctx); err != nil {
+		return c.fail(err)
+	}
+	if _, err := c.conn.Write(b.Bytes()); err != nil {
+		return c.fail(fmt.Errorf("sending command: %w", err))
+	}
+	return nil
+}
+
+// drain forgets the announced messages, and reads and discards the
+// responses to the RETR commands sent ahead, so that another command can
+// be sent.
+func (c *Client) drain(ctx context.Context) error {
+	c.ahead = nil
+	for len(c.sent) > 0 {
+		num := c.sent[0]
+		c.sent = c.sent[1:]
+		if err := c.setDeadline(ctx); err != nil {
+			return err
 		}
-		// Dot-stuffing: a line with just "." signals end of message.
-		trimmed := strings.TrimRight(line, "\r\n")
-		if trimmed == "." {
-			break
+		if _, err := c.readResponse(); err != nil {
+			if errors.Is(err, errServer) {
+				continue
+			}
+			return fmt.Errorf("pop3 RETR %d: %w", num, err)
 		}
-		// Remove dot-stuffing (leading dot on lines starting with "..")
-		if strings.HasPrefix(trimmed, "..") {
-			line = line[1:]
+		if err := c.readMultiline(func([]byte) error { return nil }); err != nil {
+			return fmt.Errorf("pop3 RETR %d read: %w", num, err)
 		}
-		buf.WriteString(line)
 	}
+	return nil
+}
 
-	return []byte(buf.String()), nil
+// RetrieveTo streams the message with the given number to w, with
+// dot-stuffing and the terminating line removed, and returns the number of
+// bytes written. Every other byte, including bare CR or LF line endings and
+// NUL or 8-bit data, is written exactly as the server sent it. If w fails,
+// the rest of the message is still read so that the session remains usable.
+func (c *Client) RetrieveTo(msgNum int, w io.Writer) (int64, error) {
+	return c.RetrieveToContext(context.Background(), msgNum, w)
+}
+
+// RetrieveToContext is like RetrieveTo, but gives up once ctx is done. The
+// rest of the message could then not be told from the next response, so
+// the connection is closed.
+func (c *Client) RetrieveToContext(ctx context.Context, msgNum int, w io.Writer) (n int64, err error) {
+	stop := context.AfterFunc(ctx, func() {
+		c.conn.SetDeadline(c.now())
+	})
+	defer func() {
+		stop()
+		if err == nil {
+			return
+		}
+		if cerr := c.expired(ctx); cerr != nil {
+			err = c.fail(fmt.Errorf("%w (%w)", err, cerr))
+		}
+	}()
+	return c.retrieve(ctx, msgNum, w)
+}
+
+// expired returns why ctx is done, or context.DeadlineExceeded once its
+// deadline has passed by the client's clock: the connection's deadline is
+// the same, so a read can time out before ctx reports it.
+func (c *Client) expired(ctx context.Context) error {
+	if ctx.Err() != nil {
+		return context.Cause(ctx)
+	}
+	if d, ok := ctx.Deadline(); ok && !c.now().Before(d) {
+		return context.DeadlineExceeded
+	}
+	return nil
+}
+
+// retrieve does the work of RetrieveToContext.
+func (c *Client) retrieve(ctx context.Context, msgNum int, w io.Writer) (int64, error) {
+	if len(c.sent) > 0 && c.sent[0] == msgNum {
+		// Its RETR was sent ahead. The next one is sent before reading
+		// the response, so that the server has it queued meanwhile.
+		c.sent = c.sent[1:]
+		if err := c.sendAhead(ctx); err != nil {
+			return 0, fmt.Errorf("pop3 RETR %d: %w", msgNum, err)
+		}
+		if err := c.setDeadline(ctx); err != nil {
+			return 0, err
+		}
+		if _, err := c.readResponse(); err != nil {
+			return 0, fmt.Errorf("pop3 RETR %d: %w", msgNum, err)
+		}
+	} else if _, err := c.commandContext(ctx, fmt.Sprintf("RETR %d", msgNum)); err != nil {
+		return 0, fmt.Errorf("pop3 RETR %d: %w", msgNum, err)
+	}
+
+	bw := bufio.NewWriter(w)
+	var (
+		n    int64
+		werr error
+	)
+	err := c.readMultiline(func(line []byte) error {
+		if werr != nil {
+			return nil
+		}
+		m, err := bw.Write(line)
+		n += int64(m)
+		werr = err
+		return nil
+	})
+	if err != nil {
+		return n, fmt.Errorf("pop3 RETR %d read: %w", msgNum, err)
+	}
+	if werr == nil {
+		werr = bw.Flush()
+	}
+	if werr != nil {
+		return n, fmt.Errorf("pop3 RETR %d write: %w", msgNum, werr)
+	}
+
+	return n, nil
+}
+
+// Top returns the header of the message with the given number, followed
+// by the blank line ending it and the first lines lines of its body, with
+// dot-stuffing removed, without retrieving the rest of the message. With
+// lines at 0, only the header is returned.
+func (c *Client) Top(msgNum, lines int) ([]byte, error) {
+	if lines < 0 {
+		return nil, fmt.Errorf("pop3 TOP %d: negative line count %d", msgNum, lines)
+	}
+	if !c.supports("TOP") {
+		return nil, fmt.Errorf("pop3 TOP %d: %w", msgNum, ErrNotSupported)
+	}
+	if _, err := c.command(fmt.Sprintf("TOP %d %d", msgNum, lines)); err != nil {
+		return nil, fmt.Errorf("pop3 TOP %d: %w", msgNum, err)
+	}
+
+	var buf bytes.Buffer
+	err := c.readMultiline(func(line []byte) error {
+		buf.Write(line)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("pop3 TOP %d read: %w", msgNum, err)
+	}
+
+	return buf.Bytes(), nil
 }
 
 // Delete marks the given message for deletion on the server.
@@ -128,6 +601,51 @@ func (c *Client) Delete(msgNum int) error {
 	return nil
 }
 
+// DeleteAll marks the messages with the given numbers for deletion on the
+// server. With PIPELINING, the DELE commands are sent pipelineWindow at a
+// time before their responses are read. The messages the server refuses to
+// mark do not stop the others; their errors are returned joined.
+func (c *Client) DeleteAll(nums []int) error {
+	var errs []error
+	if !c.Pipelining() {
+		for _, num := range nums {
+			if err := c.Delete(num); err != nil {
+				errs = append(errs, err)
+				if !errors.Is(err, errServer) {
+					break
+				}
+			}
+		}
+		return errors.Join(errs...)
+	}
+
+	if err := c.drain(context.Background()); err != nil {
+		return err
+	}
+	for batch := range slices.Chunk(nums, pipelineWindow) {
+		var b bytes.Buffer
+		for _, num := range batch {
+			fmt.Fprintf(&b, "DELE %d\r\n", num)
+		}
+		if err := c.setDeadline(context.Background()); err != nil {
+			return errors.Join(append(errs, err)...)
+		}
+		if _, err := c.conn.Write(b.Bytes()); err != nil {
+			// As in sendAhead, responses could no longer be told apart.
+			return errors.Join(append(errs, c.fail(fmt.Errorf("pop3 DELE: sending command: %w", err)))...)
+		}
+		for _, num := range batch {
+			if _, err := c.readResponse(); err != nil {
+				errs = append(errs, fmt.Errorf("pop3 DELE %d: %w", num, err))
+				if !errors.Is(err, errServer) {
+					return errors.Join(errs...)
+				}
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
 // Quit sends the QUIT command and closes the connection.
 // Deleted messages are only removed after a successful QUIT.
 func (c *Client) Quit() error {
@@ -140,37 +658,195 @@ func (c *Client) Close() error {
 	return c.conn.Close()
 }
 
-// command sends a POP3 command and reads the single-line response.
+// command sends a POP3 command and reads the single-line response, after
+// the responses to any commands sent ahead.
 func (c *Client) command(cmd string) (string, error) {
-	if err := c.conn.SetDeadline(time.Now().Add(30 * time.Second)); err != nil {
+	return c.commandContext(context.Background(), cmd)
+}
+
+// commandContext is like command, but within ctx's deadline.
+func (c *Client) commandContext(ctx context.Context, cmd string) (string, error) {
+	if err := c.drain(ctx); err != nil {
+		return "", err
+	}
+	if err := c.setDeadline(ctx); err != nil {
 		return "", err
 	}
 
 	if _, err := fmt.Fprintf(c.conn, "%s\r\n", cmd); err != nil {
-		return "", fmt.Errorf("sending command: %w", err)
+		return "", c.fail(fmt.Errorf("sending command: %w", err))
 	}
 
 	return c.readResponse()
 }
 
 // readResponse reads a single-line POP3 response and checks for +OK or -ERR.
+// Anything else, or a failed read, leaves the client out of step with the
+// server, such as reading what is left of an earlier response, so the
+// connection is closed.
 func (c *Client) readResponse() (string, error) {
-	line, err := c.reader.ReadString('\n')
+	raw, err := readLine(c.reader)
 	if err != nil {
-		if err == io.EOF {
-			return "", fmt.Errorf("server closed connection")
+		if err == io.ErrUnexpectedEOF {
+			err = fmt.Errorf("server closed connection: %w", err)
 		}
-		return "", err
+		return "", c.fail(err)
 	}
 
-	line = strings.TrimRight(line, "\r\n")
+	line := string(raw)
 
 	if strings.HasPrefix(line, "+OK") {
 		return line, nil
 	}
 	if strings.HasPrefix(line, "-ERR") {
-		return "", fmt.Errorf("server error: %s", line)
+		return "", fmt.Errorf("%w: %s", errServer, line)
+	}
+
+	if len(line) > 64 {
+		line = line[:64]
+	}
+	return "", c.fail(fmt.Errorf("unexpected response %q", line))
+}
+
+// readMultiline reads a multi-line response as readMultiline does, closing
+// the connection if that fails partway, since where the next response
+// starts is then unknown.
+func (c *Client) readMultiline(fn func(line []byte) error) error {
+	if err := readMultiline(c.reader, fn); err != nil {
+		return c.fail(err)
+	}
+	return nil
+}
+
+// fail closes the connection after err left the Client out of step with
+// the server, and returns err marked as matching ErrClosed.
+func (c *Client) fail(err error) error {
+	c.conn.Close()
+	return closedError{err}
+}
+
+// maxLineLength bounds a single response line. RFC 1939 limits responses to
+// 512 octets, but message bodies routinely exceed the 1000-octet SMTP limit,
+// so this is only a guard against a hostile server streaming an endless line.
+const maxLineLength = 1 << 20
+
+// maxUIDLength is the longest unique-id RFC 1939 allows.
+const maxUIDLength = 70
+
+// errLineTooLong is returned when a response line exceeds maxLineLength.
+var errLineTooLong = errors.New("response line too long")
+
+// readMultiline reads a dot-terminated multi-line response, calling fn for
+// each line with dot-stuffing removed. Lines keep their terminator exactly
+// as received, so that concatenating them reproduces the original data; the
+// line holding only "." ends the response and is not passed to fn.
+func readMultiline(r *bufio.Reader, fn func(line []byte) error) error {
+	for {
+		line, err := readRawLine(r)
+		if err != nil {
+			return err
+		}
+		if t := trimEOL(line); len(t) == 1 && t[0] == '.' {
+			return nil
+		}
+		// Remove dot-stuffing (RFC 1939, section 3): any line starting with
+		// "." had one prepended.
+		if len(line) > 0 && line[0] == '.' {
+			line = line[1:]
+		}
+		if err := fn(line); err != nil {
+			return err
+		}
+	}
+}
+
+// readLine reads a single line and strips the trailing CRLF (or bare LF).
+// The returned slice is only valid until the next read.
+func readLine(r *bufio.Reader) ([]byte, error) {
+	line, err := readRawLine(r)
+	if err != nil {
+		return nil, err
+	}
+	return trimEOL(line), nil
+}
+
+// readRawLine reads a single line including its trailing LF. The returned
+// slice is only valid until the next read.
+func readRawLine(r *bufio.Reader) ([]byte, error) {
+	var long []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			if len(long)+len(chunk) > maxLineLength {
+				return nil, errLineTooLong
+			}
+			long = append(long, chunk...)
+			continue
+		}
+		if err != nil {
+			if err == io.EOF {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		if long != nil {
+			if len(long)+len(chunk) > maxLineLength {
+				return nil, errLineTooLong
+			}
+			chunk = append(long, chunk...)
+		}
+		return chunk, nil
 	}
+}
+
+// trimEOL strips a trailing LF and one CR before it from line.
+func trimEOL(line []byte) []byte {
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	return bytes.TrimSuffix(line, []byte("\r"))
+}
+
+// parseUIDLLine parses a single "msgnum uid" line from a UIDL listing.
+// It reports false for lines that do not conform to RFC 1939: a positive
+// message number followed by a unique-id of 1 to 70 printable characters.
+func parseUIDLLine(line string) (int, string, bool) {
+	numStr, uid, ok := strings.Cut(line, " ")
+	if !ok {
+		return 0, "", false
+	}
+	if numStr == "" || numStr[0] < '0' || numStr[0] > '9' {
+		return 0, "", false
+	}
+	num, err := strconv.Atoi(numStr)
+	if err != nil || num <= 0 {
+		return 0, "", false
+	}
+	uid = strings.TrimRight(uid, " ")
+	if uid == "" || len(uid) > maxUIDLength {
+		return 0, "", false
+	}
+	for i := 0; i < len(uid); i++ {
+		if uid[i] < 0x21 || uid[i] > 0x7e {
+			return 0, "", false
+		}
+	}
+	return num, uid, true
+}
 
-	return line, nil
+// parseListLine parses a single "msgnum size" line from a LIST scan
+// listing, reporting false for malformed lines.
+func parseListLine(line string) (int, int64, bool) {
+	numStr, sizeStr, ok := strings.Cut(line, " ")
+	if !ok {
+		return 0, 0, false
+	}
+	num, err := strconv.Atoi(numStr)
+	if err != nil || num <= 0 {
+		return 0, 0, false
+	}
+	sizeStr, _, _ = strings.Cut(strings.TrimLeft(sizeStr, " "), " ")
+	size, err := strconv.ParseInt(sizeStr, 10, 64)
+	if err != nil || size < 0 {
+		return 0, 0, false
+	}
+	return num, size, true
 }
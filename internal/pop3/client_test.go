@@ -2,8 +2,21 @@ package pop3
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
+	"math/big"
 	"net"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -75,6 +88,115 @@ func TestClientLogin(t *testing.T) {
 	}
 }
 
+// testCert returns a self-signed certificate for 127.0.0.1, and a pool
+// trusting it.
+func testCert(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, roots
+}
+
+func TestClientStartTLS(t *testing.T) {
+	cert, roots := testCert(t)
+	// serve answers STLS with stls, upgrading the connection if it is +OK,
+	// and reports whether the password was sent over TLS.
+	serve := func(stls string) (int, chan bool) {
+		secure := make(chan bool, 1)
+		ln := mockServer(t, func(conn net.Conn) {
+			fmt.Fprintf(conn, "+OK POP3 server ready\r\n")
+			r := bufio.NewReader(conn)
+			tlsOn := false
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				switch cmd := strings.TrimSpace(line); {
+				case cmd == "CAPA":
+					fmt.Fprintf(conn, "+OK\r\nUSER\r\nSTLS\r\n.\r\n")
+				case cmd == "STLS":
+					fmt.Fprintf(conn, "%s\r\n", stls)
+					if strings.HasPrefix(stls, "+OK") {
+						tc := tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{cert}})
+						if tc.Handshake() != nil {
+							return
+						}
+						conn, r, tlsOn = tc, bufio.NewReader(tc), true
+					}
+				case strings.HasPrefix(cmd, "PASS "):
+					secure <- tlsOn
+					fmt.Fprintf(conn, "+OK\r\n")
+				case cmd == "QUIT":
+					fmt.Fprintf(conn, "+OK bye\r\n")
+					return
+				default:
+					fmt.Fprintf(conn, "+OK\r\n")
+				}
+			}
+		})
+		t.Cleanup(func() { ln.Close() })
+		port, _ := strconv.Atoi(strings.TrimPrefix(ln.Addr().String(), "127.0.0.1:"))
+		return port, secure
+	}
+	tlsConfig := &tls.Config{RootCAs: roots}
+
+	port, secure := serve("+OK begin TLS")
+	client, err := DialMode("127.0.0.1", port, 2*time.Second, tlsConfig, TLSStartTLS)
+	if err != nil {
+		t.Fatalf("DialMode failed: %v", err)
+	}
+	if err := client.Login("user", "pass"); err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
+	if !<-secure {
+		t.Error("expected the password sent over TLS")
+	}
+	if err := client.Quit(); err != nil {
+		t.Errorf("Quit failed: %v", err)
+	}
+
+	// A server refusing STLS is not used in plaintext.
+	port, _ = serve("-ERR not supported")
+	if _, err := DialMode("127.0.0.1", port, 2*time.Second, tlsConfig, TLSStartTLS); err == nil || !strings.Contains(err.Error(), "STLS") {
+		t.Errorf("expected a refused STLS to fail, got %v", err)
+	}
+
+	port, secure = serve("-ERR not supported")
+	client, err = DialMode("127.0.0.1", port, 2*time.Second, tlsConfig, TLSNone)
+	if err != nil {
+		t.Fatalf("DialMode failed: %v", err)
+	}
+	defer client.Close()
+	if err := client.Login("user", "pass"); err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
+	if <-secure {
+		t.Error("expected a plaintext session")
+	}
+}
+
 func TestClientLoginFail(t *testing.T) {
 	ln := mockServer(t, func(conn net.Conn) {
 		fmt.Fprintf(conn, "+OK POP3 server ready\r\n")
@@ -149,6 +271,81 @@ func TestClientUIDList(t *testing.T) {
 	}
 }
 
+func TestClientList(t *testing.T) {
+	ln := mockServer(t, func(conn net.Conn) {
+		fmt.Fprintf(conn, "+OK POP3 server ready\r\n")
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if line == "LIST" {
+				fmt.Fprintf(conn, "+OK 3 messages\r\n")
+				fmt.Fprintf(conn, "1 120\r\n")
+				fmt.Fprintf(conn, "2 52428800\r\n")
+				fmt.Fprintf(conn, "bogus\r\n")
+				fmt.Fprintf(conn, ".\r\n")
+			} else if line == "QUIT" {
+				fmt.Fprintf(conn, "+OK bye\r\n")
+				return
+			}
+		}
+	})
+	defer ln.Close()
+
+	conn, err := net.DialTimeout("tcp", ln.Addr().String(), 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := newTestClient(t, conn)
+	defer client.Close()
+
+	sizes, err := client.List()
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if len(sizes) != 2 || sizes[1] != 120 || sizes[2] != 52428800 {
+		t.Errorf("unexpected sizes %v", sizes)
+	}
+}
+
+func TestClientStatNoop(t *testing.T) {
+	ln := mockServer(t, func(conn net.Conn) {
+		fmt.Fprintf(conn, "+OK POP3 server ready\r\n")
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if line == "STAT" {
+				fmt.Fprintf(conn, "+OK 2 52428920\r\n")
+			} else if line == "NOOP" {
+				fmt.Fprintf(conn, "+OK\r\n")
+			} else if line == "QUIT" {
+				fmt.Fprintf(conn, "+OK bye\r\n")
+				return
+			}
+		}
+	})
+	defer ln.Close()
+
+	conn, err := net.DialTimeout("tcp", ln.Addr().String(), 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := newTestClient(t, conn)
+	defer client.Close()
+
+	count, size, err := client.Stat()
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if count != 2 || size != 52428920 {
+		t.Errorf("Stat() = %d, %d", count, size)
+	}
+	if err := client.Noop(); err != nil {
+		t.Errorf("Noop failed: %v", err)
+	}
+}
+
 func TestClientRetrieve(t *testing.T) {
 	ln := mockServer(t, func(conn net.Conn) {
 		fmt.Fprintf(conn, "+OK POP3 server ready\r\n")
@@ -193,6 +390,370 @@ func TestClientRetrieve(t *testing.T) {
 	}
 }
 
+func TestClientPipelining(t *testing.T) {
+	ln := mockServer(t, func(conn net.Conn) {
+		fmt.Fprintf(conn, "+OK POP3 server ready\r\n")
+		r := bufio.NewReader(conn)
+		// read returns the next n commands, all sent before any of them is
+		// answered, or nil if the client waits for an answer.
+		read := func(n int) []string {
+			conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			var cmds []string
+			for range n {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return nil
+				}
+				cmds = append(cmds, strings.TrimSpace(line))
+			}
+			return cmds
+		}
+		retr := func(cmd string) {
+			if num, ok := strings.CutPrefix(cmd, "RETR "); ok {
+				fmt.Fprintf(conn, "+OK\r\nSubject: %s\r\n\r\nbody\r\n.\r\n", num)
+			} else {
+				fmt.Fprintf(conn, "-ERR unexpected %s\r\n", cmd)
+			}
+		}
+
+		// Three messages announced, and the first retrieved again.
+		for _, cmd := range read(3) {
+			retr(cmd)
+		}
+		for _, cmd := range read(1) {
+			retr(cmd)
+		}
+		cmds := read(3)
+		for i, cmd := range cmds {
+			if i == 2 {
+				fmt.Fprintf(conn, "-ERR %s refused\r\n", cmd)
+				continue
+			}
+			fmt.Fprintf(conn, "+OK\r\n")
+		}
+		if len(cmds) == 3 && read(1) != nil {
+			fmt.Fprintf(conn, "+OK bye\r\n")
+		}
+	})
+	defer ln.Close()
+
+	conn, err := net.DialTimeout("tcp", ln.Addr().String(), 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := newTestClient(t, conn)
+	defer client.Close()
+	client.caps = map[string][]string{"PIPELINING": nil}
+
+	if err := client.RetrieveAhead([]int{1, 2, 3}); err != nil {
+		t.Fatalf("RetrieveAhead failed: %v", err)
+	}
+	for _, num := range []int{1, 2} {
+		raw, err := client.Retrieve(num)
+		if want := fmt.Sprintf("Subject: %d\r\n\r\nbody\r\n", num); err != nil || string(raw) != want {
+			t.Fatalf("Retrieve(%d) = %q, %v, want %q", num, raw, err, want)
+		}
+	}
+	// Out of the announced order, the response to RETR 3 is discarded.
+	if raw, err := client.Retrieve(1); err != nil || string(raw) != "Subject: 1\r\n\r\nbody\r\n" {
+		t.Fatalf("Retrieve(1) again = %q, %v", raw, err)
+	}
+
+	err = client.DeleteAll([]int{1, 2, 3})
+	if err == nil || !strings.Contains(err.Error(), "DELE 3") || strings.Contains(err.Error(), "DELE 1") {
+		t.Errorf("expected only DELE 3 to fail, got %v", err)
+	}
+	if err := client.Noop(); err != nil {
+		t.Errorf("expected the session to remain usable, got %v", err)
+	}
+}
+
+func TestClientTop(t *testing.T) {
+	ln := mockServer(t, func(conn net.Conn) {
+		fmt.Fprintf(conn, "+OK POP3 server ready\r\n")
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			switch line := scanner.Text(); line {
+			case "TOP 1 0":
+				fmt.Fprintf(conn, "+OK\r\nFrom: sender@example.com\r\nSubject: Test\r\n\r\n.\r\n")
+			case "TOP 1 1":
+				fmt.Fprintf(conn, "+OK\r\nSubject: Test\r\n\r\n..dotted\r\n.\r\n")
+			case "QUIT":
+				fmt.Fprintf(conn, "+OK bye\r\n")
+				return
+			default:
+				fmt.Fprintf(conn, "-ERR no such message\r\n")
+			}
+		}
+	})
+	defer ln.Close()
+
+	conn, err := net.DialTimeout("tcp", ln.Addr().String(), 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := newTestClient(t, conn)
+	defer client.Close()
+
+	header, err := client.Top(1, 0)
+	if err != nil {
+		t.Fatalf("Top failed: %v", err)
+	}
+	if want := "From: sender@example.com\r\nSubject: Test\r\n\r\n"; string(header) != want {
+		t.Errorf("Top(1, 0) = %q, want %q", header, want)
+	}
+	top, err := client.Top(1, 1)
+	if err != nil {
+		t.Fatalf("Top failed: %v", err)
+	}
+	if want := "Subject: Test\r\n\r\n.dotted\r\n"; string(top) != want {
+		t.Errorf("Top(1, 1) = %q, want %q", top, want)
+	}
+	if _, err := client.Top(2, 0); err == nil || !strings.Contains(err.Error(), "no such message") || errors.Is(err, ErrClosed) {
+		t.Errorf("expected the server's error, leaving the session open, got %v", err)
+	}
+	if _, err := client.Top(1, -1); err == nil {
+		t.Error("expected a negative line count to be refused")
+	}
+}
+
+func TestClientCapabilities(t *testing.T) {
+	// serve answers CAPA with capa, accepts AUTH PLAIN for user and pass,
+	// and records the other commands it is sent.
+	serve := func(capa string) (int, chan string) {
+		sent := make(chan string, 16)
+		ln := mockServer(t, func(conn net.Conn) {
+			fmt.Fprintf(conn, "+OK POP3 server ready\r\n")
+			scanner := bufio.NewScanner(conn)
+			for scanner.Scan() {
+				switch line := scanner.Text(); line {
+				case "CAPA":
+					fmt.Fprintf(conn, "%s", capa)
+				case "AUTH PLAIN " + base64.StdEncoding.EncodeToString([]byte("\x00user\x00pass")):
+					fmt.Fprintf(conn, "+OK logged in\r\n")
+				case "UIDL":
+					sent <- line
+					fmt.Fprintf(conn, "+OK\r\n1 abc\r\n.\r\n")
+				default:
+					sent <- line
+					fmt.Fprintf(conn, "+OK\r\n")
+				}
+			}
+		})
+		t.Cleanup(func() { ln.Close() })
+		port, _ := strconv.Atoi(strings.TrimPrefix(ln.Addr().String(), "127.0.0.1:"))
+		return port, sent
+	}
+
+	port, sent := serve("+OK\r\nSASL PLAIN\r\nTOP\r\nexpire 0\r\n.\r\n")
+	client, err := DialMode("127.0.0.1", port, 2*time.Second, &tls.Config{}, TLSNone)
+	if err != nil {
+		t.Fatalf("DialMode failed: %v", err)
+	}
+	defer client.Close()
+	if caps, err := client.Capabilities(); err != nil || len(caps["EXPIRE"]) != 1 || caps["EXPIRE"][0] != "0" {
+		t.Errorf("Capabilities() = %v, %v", caps, err)
+	}
+	if err := client.Login("user", "pass"); err != nil {
+		t.Fatalf("expected SASL PLAIN used without USER, got %v", err)
+	}
+	if _, err := client.UIDList(); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("expected UIDL refused without sending it, got %v", err)
+	}
+	select {
+	case cmd := <-sent:
+		t.Errorf("expected nothing sent, got %q", cmd)
+	default:
+	}
+
+	// A server without CAPA is assumed to support everything.
+	port, sent = serve("-ERR unknown command\r\n")
+	client, err = DialMode("127.0.0.1", port, 2*time.Second, &tls.Config{}, TLSNone)
+	if err != nil {
+		t.Fatalf("DialMode failed: %v", err)
+	}
+	defer client.Close()
+	if err := client.Login("user", "pass"); err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
+	if uids, err := client.UIDList(); err != nil || uids[1] != "abc" {
+		t.Errorf("UIDList() = %v, %v", uids, err)
+	}
+	if got := <-sent; got != "USER user" {
+		t.Errorf("expected USER/PASS, got %q", got)
+	}
+}
+
+// failingWriter accepts limit bytes and then fails.
+type failingWriter struct {
+	limit int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > w.limit {
+		n := w.limit
+		w.limit = 0
+		return n, errors.New("disk full")
+	}
+	w.limit -= len(p)
+	return len(p), nil
+}
+
+func TestClientRetrieveTo(t *testing.T) {
+	ln := mockServer(t, func(conn net.Conn) {
+		fmt.Fprintf(conn, "+OK POP3 server ready\r\n")
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if strings.HasPrefix(line, "RETR ") {
+				fmt.Fprintf(conn, "+OK\r\n")
+				fmt.Fprintf(conn, "Subject: %s\r\n", strings.TrimPrefix(line, "RETR "))
+				fmt.Fprintf(conn, "\r\n")
+				fmt.Fprintf(conn, "%s\r\n", strings.Repeat("x", 8192))
+				fmt.Fprintf(conn, ".\r\n")
+			} else if line == "QUIT" {
+				fmt.Fprintf(conn, "+OK bye\r\n")
+				return
+			}
+		}
+	})
+	defer ln.Close()
+
+	conn, err := net.DialTimeout("tcp", ln.Addr().String(), 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := newTestClient(t, conn)
+	defer client.Close()
+
+	// A failing writer fails the retrieval but leaves the session in sync.
+	if _, err := client.RetrieveTo(1, &failingWriter{limit: 100}); err == nil || !strings.Contains(err.Error(), "disk full") {
+		t.Fatalf("expected writer error, got %v", err)
+	}
+
+	var buf bytes.Buffer
+	n, err := client.RetrieveTo(2, &buf)
+	if err != nil {
+		t.Fatalf("RetrieveTo failed: %v", err)
+	}
+	if n != int64(buf.Len()) {
+		t.Errorf("RetrieveTo returned %d bytes, wrote %d", n, buf.Len())
+	}
+	want := "Subject: 2\r\n\r\n" + strings.Repeat("x", 8192) + "\r\n"
+	if buf.String() != want {
+		t.Errorf("unexpected message: %.40q...", buf.String())
+	}
+}
+
+func TestClientTimeouts(t *testing.T) {
+	// The server never answers RETR.
+	hang := func(conn net.Conn) {
+		fmt.Fprintf(conn, "+OK POP3 server ready\r\n")
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+		}
+	}
+	dial := func() *Client {
+		t.Helper()
+		ln := mockServer(t, hang)
+		t.Cleanup(func() { ln.Close() })
+		conn, err := net.DialTimeout("tcp", ln.Addr().String(), 2*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := newTestClient(t, conn)
+		t.Cleanup(func() { client.Close() })
+		return client
+	}
+
+	client := dial()
+	client.SetCommandTimeout(50 * time.Millisecond)
+	start := time.Now()
+	var ne net.Error
+	if _, err := client.RetrieveTo(1, io.Discard); !errors.As(err, &ne) || !ne.Timeout() {
+		t.Errorf("expected a timeout, got %v", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("command timeout took %v", d)
+	}
+
+	// A context deadline shorter than the command timeout ends the
+	// retrieval, and the session with it.
+	client = dial()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	if _, err := client.RetrieveToContext(ctx, 1, io.Discard); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the context deadline, got %v", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("context deadline took %v", d)
+	}
+	if _, err := client.command("NOOP"); err == nil {
+		t.Error("expected the session to be closed")
+	}
+}
+
+func TestClientTimeoutMidMessage(t *testing.T) {
+	// The server stops partway through the first message, and answers
+	// every later command with the rest of it.
+	ln := mockServer(t, func(conn net.Conn) {
+		fmt.Fprintf(conn, "+OK POP3 server ready\r\n")
+		scanner := bufio.NewScanner(conn)
+		first := true
+		for scanner.Scan() {
+			if first {
+				fmt.Fprintf(conn, "+OK\r\nSubject: one\r\n\r\n")
+				first = false
+				continue
+			}
+			fmt.Fprintf(conn, "rest of one\r\n.\r\n")
+		}
+	})
+	defer ln.Close()
+	conn, err := net.DialTimeout("tcp", ln.Addr().String(), 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := newTestClient(t, conn)
+	defer client.Close()
+
+	client.SetCommandTimeout(50 * time.Millisecond)
+	if _, err := client.RetrieveTo(1, io.Discard); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected the first retrieval to time out and close the session, got %v", err)
+	}
+	// The rest of the first message must not pass for the second.
+	if msg, err := client.Retrieve(2); err == nil {
+		t.Errorf("expected the session to be closed, got message %q", msg)
+	}
+}
+
+func TestClientUnexpectedResponse(t *testing.T) {
+	ln := mockServer(t, func(conn net.Conn) {
+		fmt.Fprintf(conn, "+OK POP3 server ready\r\n")
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			fmt.Fprintf(conn, "Subject: left over\r\n")
+		}
+	})
+	defer ln.Close()
+	conn, err := net.DialTimeout("tcp", ln.Addr().String(), 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := newTestClient(t, conn)
+	defer client.Close()
+
+	if _, err := client.Retrieve(1); !errors.Is(err, ErrClosed) || !strings.Contains(err.Error(), "unexpected response") {
+		t.Errorf("expected an unexpected response closing the session, got %v", err)
+	}
+	if _, err := client.command("NOOP"); err == nil {
+		t.Error("expected the session to be closed")
+	}
+}
+
 func TestClientDotStuffing(t *testing.T) {
 	ln := mockServer(t, func(conn net.Conn) {
 		fmt.Fprintf(conn, "+OK POP3 server ready\r\n")
@@ -236,3 +797,193 @@ func TestClientDotStuffing(t *testing.T) {
 		t.Errorf("dot-stuffing was not removed: %s", body)
 	}
 }
+
+func TestClientRetrieveExact(t *testing.T) {
+	// Line endings, stray CRs, and binary data must come through untouched;
+	// only the dot-stuffing and the terminating line are removed.
+	msg := "Subject: Exact\r\n\r\nbare lf\nstray\rcr\r\n\x00\xff\r\r\n.\r\n..two\n.\nno final crlf\n"
+	ln := mockServer(t, func(conn net.Conn) {
+		fmt.Fprintf(conn, "+OK POP3 server ready\r\n")
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if strings.HasPrefix(line, "RETR ") {
+				fmt.Fprintf(conn, "+OK\r\n")
+				conn.Write(dotStuff([]byte(msg)))
+			} else if line == "QUIT" {
+				fmt.Fprintf(conn, "+OK bye\r\n")
+				return
+			}
+		}
+	})
+	defer ln.Close()
+
+	conn, err := net.DialTimeout("tcp", ln.Addr().String(), 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := newTestClient(t, conn)
+	defer client.Close()
+
+	raw, err := client.Retrieve(1)
+	if err != nil {
+		t.Fatalf("Retrieve failed: %v", err)
+	}
+	if string(raw) != msg {
+		t.Errorf("Retrieve = %q, want %q", raw, msg)
+	}
+}
+
+// dotStuff encodes msg as a POP3 multi-line response body as RFC 1939
+// describes: a "." is prepended to every line starting with one, a CRLF is
+// added if msg does not end in a line break, and ".\r\n" ends the response.
+func dotStuff(msg []byte) []byte {
+	var enc bytes.Buffer
+	for len(msg) > 0 {
+		line := msg
+		if i := bytes.IndexByte(msg, '\n'); i >= 0 {
+			line = msg[:i+1]
+		}
+		msg = msg[len(line):]
+		if line[0] == '.' {
+			enc.WriteByte('.')
+		}
+		enc.Write(line)
+		if line[len(line)-1] != '\n' {
+			enc.WriteString("\r\n")
+		}
+	}
+	enc.WriteString(".\r\n")
+	return enc.Bytes()
+}
+
+func FuzzReadMultiline(f *testing.F) {
+	f.Add([]byte("line one\r\n..stuffed\r\n.\r\n"))
+	f.Add([]byte("no terminator\r\n"))
+	f.Add([]byte("bare lf\n.\n"))
+	f.Add([]byte(".\r\n"))
+	f.Add([]byte("\r\r\n\x00\xff\r\n.\r\n"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var decoded []byte
+		err := readMultiline(bufio.NewReader(bytes.NewReader(data)), func(line []byte) error {
+			if bytes.IndexByte(line, '\n') != len(line)-1 {
+				t.Fatalf("line does not end at its only LF: %q", line)
+			}
+			decoded = append(decoded, line...)
+			return nil
+		})
+		if err != nil {
+			return
+		}
+
+		// Re-encoding the decoded data must decode to the same bytes.
+		var again []byte
+		err = readMultiline(bufio.NewReader(bytes.NewReader(dotStuff(decoded))), func(line []byte) error {
+			again = append(again, line...)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("re-encoded response failed to decode: %v", err)
+		}
+		if !bytes.Equal(again, decoded) {
+			t.Fatalf("round trip changed data: %q != %q", again, decoded)
+		}
+	})
+}
+
+func FuzzRetrieveDecode(f *testing.F) {
+	f.Add([]byte("Subject: x\r\n\r\nbody\r\n"))
+	f.Add([]byte(".\r\n..\n.\n"))
+	f.Add([]byte("bare lf\nstray\rcr\r\n"))
+	f.Add([]byte("\x00\xff\r\r\n"))
+	f.Add([]byte("no final line break"))
+
+	f.Fuzz(func(t *testing.T, msg []byte) {
+		if len(msg) > maxLineLength {
+			return
+		}
+		// Any message ending in a line break must decode to exactly the
+		// bytes that were sent; others gain the CRLF the encoder added.
+		want := msg
+		if len(msg) > 0 && msg[len(msg)-1] != '\n' {
+			want = append(append([]byte(nil), msg...), "\r\n"...)
+		}
+
+		var got []byte
+		err := readMultiline(bufio.NewReader(bytes.NewReader(dotStuff(msg))), func(line []byte) error {
+			got = append(got, line...)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("decode failed: %v", err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("decoded %q, want %q", got, want)
+		}
+	})
+}
+
+func FuzzParseUIDLLine(f *testing.F) {
+	f.Add("1 abc123")
+	f.Add("2 def456 ")
+	f.Add("-1 neg")
+	f.Add("+3 plus")
+	f.Add("99999999999999999999 overflow")
+	f.Add("4 " + strings.Repeat("x", 71))
+	f.Add("5 tab\there")
+
+	f.Fuzz(func(t *testing.T, line string) {
+		num, uid, ok := parseUIDLLine(line)
+		if !ok {
+			return
+		}
+		if num <= 0 {
+			t.Fatalf("accepted non-positive message number %d from %q", num, line)
+		}
+		if uid == "" || len(uid) > maxUIDLength {
+			t.Fatalf("accepted uid of invalid length %d from %q", len(uid), line)
+		}
+		for i := 0; i < len(uid); i++ {
+			if uid[i] < 0x21 || uid[i] > 0x7e {
+				t.Fatalf("accepted uid with byte %#x from %q", uid[i], line)
+			}
+		}
+	})
+}
+
+func TestParseUIDLLine(t *testing.T) {
+	tests := []struct {
+		line    string
+		wantNum int
+		wantUID string
+		wantOK  bool
+	}{
+		{"1 abc123", 1, "abc123", true},
+		{"12 AAA-bbb_ccc", 12, "AAA-bbb_ccc", true},
+		{"3 trailing ", 3, "trailing", true},
+		{"0 zero", 0, "", false},
+		{"+4 plus", 0, "", false},
+		{"x uid", 0, "", false},
+		{"5", 0, "", false},
+		{"6 " + strings.Repeat("u", 71), 0, "", false},
+		{"7 bad\x01uid", 0, "", false},
+	}
+
+	for _, tt := range tests {
+		num, uid, ok := parseUIDLLine(tt.line)
+		if ok != tt.wantOK || num != tt.wantNum || uid != tt.wantUID {
+			t.Errorf("parseUIDLLine(%q) = (%d, %q, %v), want (%d, %q, %v)",
+				tt.line, num, uid, ok, tt.wantNum, tt.wantUID, tt.wantOK)
+		}
+	}
+}
+
+func TestReadLineTooLong(t *testing.T) {
+	data := strings.Repeat("a", maxLineLength+1) + "\r\n"
+	_, err := readLine(bufio.NewReader(strings.NewReader(data)))
+	if err != errLineTooLong {
+		t.Fatalf("expected errLineTooLong, got %v", err)
+	}
+}
@@ -0,0 +1,152 @@
+package pop3
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// Mailbox is a logged-in POP3 session addressed by UID rather than by
+// message number. Message numbers are only valid within the session that
+// listed them, so the mapping is kept here.
+type Mailbox struct {
+	client *Client
+	nums   map[string]int // UID -> message number
+	// deletes holds, if the server pipelines, the messages marked for
+	// deletion, which Close sends together before QUIT.
+	deletes []int
+}
+
+// OpenMailbox connects to a POP3 server, secured as mode says, and logs
+// in.
+func OpenMailbox(host string, port int, timeout time.Duration, tlsConfig *tls.Config, mode TLSMode, user, pass string, opts ...Option) (*Mailbox, error) {
+	client, err := DialMode(host, port, timeout, tlsConfig, mode, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if err := client.Login(user, pass); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &Mailbox{client: client}, nil
+}
+
+// SetCommandTimeout sets how long each later command may take, as
+// Client.SetCommandTimeout does.
+func (m *Mailbox) SetCommandTimeout(d time.Duration) {
+	m.client.SetCommandTimeout(d)
+}
+
+// ListUIDs returns the UIDs of the messages in the maildrop, ordered by
+// message number.
+func (m *Mailbox) ListUIDs() ([]string, error) {
+	uidMap, err := m.client.UIDList()
+	if err != nil {
+		return nil, err
+	}
+	m.nums = make(map[string]int, len(uidMap))
+	uids := make([]string, 0, len(uidMap))
+	for num, uid := range uidMap {
+		m.nums[uid] = num
+		uids = append(uids, uid)
+	}
+	sort.Slice(uids, func(i, j int) bool {
+		return m.nums[uids[i]] < m.nums[uids[j]]
+	})
+	return uids, nil
+}
+
+// Sizes returns the size in octets of each message listed by ListUIDs, by
+// UID.
+func (m *Mailbox) Sizes() (map[string]int64, error) {
+	byNum, err := m.client.List()
+	if err != nil {
+		return nil, err
+	}
+	sizes := make(map[string]int64, len(m.nums))
+	for uid, num := range m.nums {
+		if size, ok := byNum[num]; ok {
+			sizes[uid] = size
+		}
+	}
+	return sizes, nil
+}
+
+// Prefetch announces the messages, by UID, that Fetch is called for next,
+// in order, so that a server that pipelines is asked for them ahead.
+func (m *Mailbox) Prefetch(uids []string) error {
+	nums := make([]int, 0, len(uids))
+	for _, uid := range uids {
+		num, err := m.num(uid)
+		if err != nil {
+			return err
+		}
+		nums = append(nums, num)
+	}
+	return m.client.RetrieveAhead(nums)
+}
+
+// Fetch streams the message with the given UID to w and returns the number
+// of bytes written.
+func (m *Mailbox) Fetch(uid string, w io.Writer) (int64, error) {
+	return m.FetchContext(context.Background(), uid, w)
+}
+
+// FetchContext is like Fetch, but gives up once ctx is done, ending the
+// session without committing its deletions.
+func (m *Mailbox) FetchContext(ctx context.Context, uid string, w io.Writer) (int64, error) {
+	num, err := m.num(uid)
+	if err != nil {
+		return 0, err
+	}
+	return m.client.RetrieveToContext(ctx, num, w)
+}
+
+// Top returns the header of the message with the given UID and the first
+// lines lines of its body, without fetching the rest of it.
+func (m *Mailbox) Top(uid string, lines int) ([]byte, error) {
+	num, err := m.num(uid)
+	if err != nil {
+		return nil, err
+	}
+	return m.client.Top(num, lines)
+}
+
+// Delete marks the message with the given UID for deletion. It is only
+// removed once Close ends the session. If the server pipelines, the
+// message is only marked then too, along with the others.
+func (m *Mailbox) Delete(uid string) error {
+	num, err := m.num(uid)
+	if err != nil {
+		return err
+	}
+	if m.client.Pipelining() {
+		m.deletes = append(m.deletes, num)
+		return nil
+	}
+	return m.client.Delete(num)
+}
+
+// Close marks the messages whose deletion was deferred, and ends the
+// session with QUIT, which commits the deletions. Messages that could not
+// be marked stay on the server, and their errors are returned.
+func (m *Mailbox) Close() error {
+	var err error
+	if len(m.deletes) > 0 {
+		err = m.client.DeleteAll(m.deletes)
+		m.deletes = nil
+	}
+	return errors.Join(err, m.client.Quit())
+}
+
+func (m *Mailbox) num(uid string) (int, error) {
+	num, ok := m.nums[uid]
+	if !ok {
+		return 0, fmt.Errorf("pop3: no message with UID %q in this session", uid)
+	}
+	return num, nil
+}
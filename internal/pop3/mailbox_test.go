@@ -0,0 +1,124 @@
+package pop3
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMailbox(t *testing.T) {
+	deleted := make(chan string, 1)
+	ln := mockServer(t, func(conn net.Conn) {
+		fmt.Fprintf(conn, "+OK POP3 server ready\r\n")
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			switch line := scanner.Text(); line {
+			case "UIDL":
+				fmt.Fprintf(conn, "+OK\r\n2 def456\r\n1 abc123\r\n.\r\n")
+			case "LIST":
+				fmt.Fprintf(conn, "+OK\r\n1 100\r\n2 200\r\n.\r\n")
+			case "TOP 2 0":
+				fmt.Fprintf(conn, "+OK\r\nSubject: two\r\n\r\n.\r\n")
+			case "DELE 2":
+				deleted <- line
+				fmt.Fprintf(conn, "+OK\r\n")
+			case "QUIT":
+				fmt.Fprintf(conn, "+OK bye\r\n")
+				return
+			default:
+				fmt.Fprintf(conn, "-ERR unexpected %s\r\n", line)
+			}
+		}
+	})
+	defer ln.Close()
+
+	conn, err := net.DialTimeout("tcp", ln.Addr().String(), 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &Mailbox{client: newTestClient(t, conn)}
+
+	uids, err := m.ListUIDs()
+	if err != nil {
+		t.Fatalf("ListUIDs failed: %v", err)
+	}
+	if len(uids) != 2 || uids[0] != "abc123" || uids[1] != "def456" {
+		t.Errorf("expected UIDs in message order, got %v", uids)
+	}
+	sizes, err := m.Sizes()
+	if err != nil {
+		t.Fatalf("Sizes failed: %v", err)
+	}
+	if sizes["abc123"] != 100 || sizes["def456"] != 200 {
+		t.Errorf("unexpected sizes %v", sizes)
+	}
+	if header, err := m.Top("def456", 0); err != nil || string(header) != "Subject: two\r\n\r\n" {
+		t.Errorf("Top = %q, %v", header, err)
+	}
+	if err := m.Delete("def456"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if got := <-deleted; got != "DELE 2" {
+		t.Errorf("expected DELE 2, got %s", got)
+	}
+	if err := m.Delete("unknown"); err == nil {
+		t.Error("expected an error deleting an unlisted UID")
+	}
+	if err := m.Close(); err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+}
+
+func TestMailboxPipeliningDefersDeletes(t *testing.T) {
+	cmds := make(chan string, 8)
+	ln := mockServer(t, func(conn net.Conn) {
+		fmt.Fprintf(conn, "+OK POP3 server ready\r\n")
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			line := scanner.Text()
+			cmds <- line
+			switch line {
+			case "UIDL":
+				fmt.Fprintf(conn, "+OK\r\n1 abc123\r\n2 def456\r\n.\r\n")
+			case "QUIT":
+				fmt.Fprintf(conn, "+OK bye\r\n")
+				return
+			default:
+				fmt.Fprintf(conn, "+OK\r\n")
+			}
+		}
+	})
+	defer ln.Close()
+
+	conn, err := net.DialTimeout("tcp", ln.Addr().String(), 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &Mailbox{client: newTestClient(t, conn)}
+	m.client.caps = map[string][]string{"UIDL": nil, "PIPELINING": nil}
+
+	if _, err := m.ListUIDs(); err != nil {
+		t.Fatalf("ListUIDs failed: %v", err)
+	}
+	for _, uid := range []string{"def456", "abc123"} {
+		if err := m.Delete(uid); err != nil {
+			t.Fatalf("Delete failed: %v", err)
+		}
+	}
+	if err := m.client.Noop(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Close(); err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+	close(cmds)
+	var got []string
+	for cmd := range cmds {
+		got = append(got, cmd)
+	}
+	if want := "[UIDL NOOP DELE 2 DELE 1 QUIT]"; fmt.Sprint(got) != want {
+		t.Errorf("commands = %v, want %s", got, want)
+	}
+}
@@ -0,0 +1,294 @@
+// Package proxy connects to servers through a SOCKS5 (RFC 1928) or HTTP
+// CONNECT proxy, for networks that do not allow connecting directly.
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// ContextDialer opens connections, as a *net.Dialer does.
+type ContextDialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// Dialer opens connections through a proxy. It is a ContextDialer itself.
+type Dialer struct {
+	// scheme is "socks5" or "http".
+	scheme string
+	// addr is the proxy's host and port.
+	addr string
+	// user holds the credentials the proxy is sent, if any.
+	user *url.Userinfo
+	// forward connects to the proxy.
+	forward ContextDialer
+	// timeout bounds connecting through the proxy, handshake included,
+	// or is zero for no bound but the context's.
+	timeout time.Duration
+}
+
+// Parse checks a proxy URL, "socks5://[user:password@]host[:port]" or
+// "http://[user:password@]host[:port]", and returns it with the port
+// filled in: 1080 for SOCKS5 and 80 for HTTP if it is left out.
+func Parse(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		// The error would quote the URL, password included.
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			err = uerr.Err
+		}
+		return nil, fmt.Errorf("proxy: invalid URL: %w", err)
+	}
+	var port string
+	switch u.Scheme {
+	case "socks5":
+		port = "1080"
+	case "http":
+		port = "80"
+	default:
+		return nil, fmt.Errorf("proxy %q: scheme must be socks5 or http", u.Redacted())
+	}
+	if u.Hostname() == "" || (u.Path != "" && u.Path != "/") || u.RawQuery != "" {
+		return nil, fmt.Errorf("proxy %q: must be a scheme, a host, and an optional port", u.Redacted())
+	}
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Hostname(), port)
+	}
+	return u, nil
+}
+
+// New returns a Dialer connecting through the proxy at the URL raw, as
+// Parse accepts it. It reaches the proxy with forward, or a net.Dialer if
+// forward is nil, and gives up on connecting after timeout unless it is
+// zero.
+func New(raw string, forward ContextDialer, timeout time.Duration) (*Dialer, error) {
+	u, err := Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	if forward == nil {
+		forward = &net.Dialer{}
+	}
+	return &Dialer{scheme: u.Scheme, addr: u.Host, user: u.User, forward: forward, timeout: timeout}, nil
+}
+
+// DialContext connects to address through the proxy. Host names are
+// resolved by the proxy, not locally.
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		return nil, fmt.Errorf("proxy: network %q not supported", network)
+	}
+	if d.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.timeout)
+		defer cancel()
+	}
+	conn, err := d.forward.DialContext(ctx, "tcp", d.addr)
+	if err != nil {
+		return nil, fmt.Errorf("proxy %s: %w", d.addr, err)
+	}
+
+	// The handshake gives up at ctx's deadline, or as soon as it is
+	// canceled.
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+	if d.scheme == "socks5" {
+		err = d.socks5(conn, address)
+	} else {
+		conn, err = d.connect(conn, address)
+	}
+	if !stop() && err == nil {
+		err = context.Cause(ctx)
+	} else if err != nil && ctx.Err() != nil {
+		err = fmt.Errorf("%w (%w)", err, context.Cause(ctx))
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: connecting to %s: %w", d.addr, address, err)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// socks5Errors describes the SOCKS5 reply codes (RFC 1928 section 6).
+var socks5Errors = map[byte]string{
+	1: "general SOCKS server failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// socks5 asks the SOCKS5 proxy on conn to connect to address,
+// authenticating with a username and password (RFC 1929) if the Dialer has
+// them.
+func (d *Dialer) socks5(conn net.Conn, address string) error {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port %q", portStr)
+	}
+
+	// Offer no authentication, and username and password when set.
+	methods := []byte{0x00}
+	if d.user != nil {
+		methods = append(methods, 0x02)
+	}
+	if _, err := conn.Write(append([]byte{0x05, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[0] != 0x05 {
+		return fmt.Errorf("not a SOCKS5 proxy (version %d)", reply[0])
+	}
+	switch reply[1] {
+	case 0x00:
+	case 0x02:
+		if d.user == nil {
+			return errors.New("SOCKS5 proxy requires a username and password")
+		}
+		if err := d.socks5Auth(conn); err != nil {
+			return err
+		}
+	default:
+		return errors.New("SOCKS5 proxy accepts none of the offered authentication methods")
+	}
+
+	req := []byte{0x05, 0x01, 0x00}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return fmt.Errorf("host name %q too long", host)
+		}
+		req = append(req, 0x03, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(append(req, 0x01), ip4...)
+	} else {
+		req = append(append(req, 0x04), ip...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	// The reply ends with the address the proxy bound, which is of no use
+	// here but must be read past.
+	var head [4]byte
+	if _, err := io.ReadFull(conn, head[:]); err != nil {
+		return err
+	}
+	if head[1] != 0x00 {
+		if msg, ok := socks5Errors[head[1]]; ok {
+			return fmt.Errorf("SOCKS5 proxy: %s", msg)
+		}
+		return fmt.Errorf("SOCKS5 proxy: failure %d", head[1])
+	}
+	var skip int
+	switch head[3] {
+	case 0x01:
+		skip = net.IPv4len
+	case 0x04:
+		skip = net.IPv6len
+	case 0x03:
+		var n [1]byte
+		if _, err := io.ReadFull(conn, n[:]); err != nil {
+			return err
+		}
+		skip = int(n[0])
+	default:
+		return fmt.Errorf("SOCKS5 proxy: unknown address type %d", head[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, skip+2))
+	return err
+}
+
+// socks5Auth authenticates with the Dialer's username and password.
+func (d *Dialer) socks5Auth(conn net.Conn) error {
+	user := d.user.Username()
+	pass, _ := d.user.Password()
+	if len(user) > 255 || len(pass) > 255 {
+		return errors.New("SOCKS5 username or password too long")
+	}
+	req := []byte{0x01, byte(len(user))}
+	req = append(req, user...)
+	req = append(req, byte(len(pass)))
+	req = append(req, pass...)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[1] != 0x00 {
+		return errors.New("SOCKS5 proxy rejected the username and password")
+	}
+	return nil
+}
+
+// connect asks the HTTP proxy on conn to connect to address with CONNECT,
+// authenticating with Basic credentials if the Dialer has them. It returns
+// the connection to read from afterwards, which holds any bytes of the
+// server's that arrived with the proxy's response.
+func (d *Dialer) connect(conn net.Conn, address string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if d.user != nil {
+		pass, _ := d.user.Password()
+		creds := base64.StdEncoding.EncodeToString([]byte(d.user.Username() + ":" + pass))
+		req.Header.Set("Proxy-Authorization", "Basic "+creds)
+	}
+	if err := req.Write(conn); err != nil {
+		return conn, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return conn, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return conn, fmt.Errorf("HTTP proxy: %s", resp.Status)
+	}
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn is a connection whose first bytes were read ahead into r.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
@@ -0,0 +1,78 @@
+// Package quarantine keeps messages that yatogm gave up forwarding, each as
+// an .eml file with a JSON sidecar describing why, so that they can be
+// inspected and delivered by hand.
+package quarantine
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Record describes one quarantined message. It is stored next to the
+// message as <yatogm_id>.json.
+type Record struct {
+	// ID is the message's yatogm ID from the last attempt.
+	ID string `json:"yatogm_id"`
+	// Mailbox is the Yahoo mailbox the message was fetched from.
+	Mailbox string `json:"mailbox"`
+	// UID is the message's POP3 UID in the mailbox.
+	UID string `json:"uid"`
+	// Error is the error of the last forwarding attempt.
+	Error string `json:"error"`
+	// Attempts is the number of runs in which forwarding failed.
+	Attempts int `json:"attempts"`
+	// Size is the size of the message in bytes.
+	Size          int64     `json:"size"`
+	QuarantinedAt time.Time `json:"quarantined_at"`
+}
+
+// Write stores the message of size bytes read from msg as <dir>/<id>.eml
+// and r as <dir>/<id>.json, creating dir if needed, and returns the path
+// of the .eml file. The message is complete once the sidecar exists.
+func Write(dir string, r Record, msg io.ReaderAt, size int64) (string, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("creating quarantine directory: %w", err)
+	}
+	emlPath := filepath.Join(dir, r.ID+".eml")
+	if err := writeFile(emlPath, io.NewSectionReader(msg, 0, size)); err != nil {
+		return "", fmt.Errorf("writing quarantined message: %w", err)
+	}
+	sidecar, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("marshaling quarantine record: %w", err)
+	}
+	sidecar = append(sidecar, '\n')
+	if err := writeFile(filepath.Join(dir, r.ID+".json"), bytes.NewReader(sidecar)); err != nil {
+		return "", fmt.Errorf("writing quarantine record: %w", err)
+	}
+	return emlPath, nil
+}
+
+// writeFile writes the contents of src to path atomically, through a
+// synced temporary file that is then renamed.
+func writeFile(path string, src io.Reader) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, src)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
@@ -0,0 +1,53 @@
+package quarantine
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWrite(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "quarantine")
+	raw := []byte("From: a@example.com\r\nSubject: hi\r\n\r\nbody\r\n")
+	r := Record{
+		ID:            "01ARYZ6S41TSV4RRFFQ69G5FAV",
+		Mailbox:       "user@yahoo.com",
+		UID:           "uid1",
+		Error:         "smtp send: 552 5.3.4 Message too big",
+		Attempts:      3,
+		Size:          int64(len(raw)),
+		QuarantinedAt: time.Date(2024, 5, 1, 14, 32, 0, 0, time.UTC),
+	}
+
+	path, err := Write(dir, r, bytes.NewReader(raw), int64(len(raw)))
+	if err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if path != filepath.Join(dir, r.ID+".eml") {
+		t.Errorf("unexpected path %s", path)
+	}
+	eml, err := os.ReadFile(path)
+	if err != nil || !bytes.Equal(eml, raw) {
+		t.Errorf("quarantined message = %q (%v), want the original", eml, err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, r.ID+".json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got Record
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("sidecar is not a record: %v", err)
+	}
+	if got != r {
+		t.Errorf("sidecar = %+v, want %+v", got, r)
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 2 {
+		t.Errorf("expected only the message and its sidecar, got %d entries", len(entries))
+	}
+}
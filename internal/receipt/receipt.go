@@ -0,0 +1,106 @@
+// Package receipt appends a JSONL record for every delivered message, for
+// consumption by downstream pipelines.
+package receipt
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Record describes one delivered message.
+type Record struct {
+	// ID is the message's yatogm ID.
+	ID string `json:"yatogm_id"`
+	// MessageID is the original Message-ID header, if any.
+	MessageID string `json:"message_id,omitempty"`
+	// From is the sender's address, lowercased, if the From header has
+	// one.
+	From string `json:"from,omitempty"`
+	// ListID is the List-Id header of a message from a mailing list.
+	ListID string `json:"list_id,omitempty"`
+	// Source is the Yahoo mailbox the message was fetched from.
+	Source string `json:"source"`
+	// UID is the message's POP3 UID in the source mailbox.
+	UID string `json:"uid"`
+	// Destination is the address the message was delivered to.
+	Destination string `json:"destination"`
+	// SMTPResponse is the destination's reply to the message data.
+	SMTPResponse string `json:"smtp_response"`
+	// FetchedAt and DeliveredAt are when the message was retrieved from
+	// the source and accepted by the destination.
+	FetchedAt   time.Time `json:"fetched_at"`
+	DeliveredAt time.Time `json:"delivered_at"`
+}
+
+// Log appends records to a receipts file. It is safe for concurrent use.
+type Log struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// Open opens the receipts file at path for appending, creating it and its
+// directory if needed.
+func Open(path string) (*Log, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("creating receipts directory: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("opening receipts file: %w", err)
+	}
+	return &Log{file: f}, nil
+}
+
+// Write appends r as a single line.
+func (l *Log) Write(r Record) error {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("marshaling receipt: %w", err)
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.file.Write(line); err != nil {
+		return fmt.Errorf("writing receipt: %w", err)
+	}
+	return nil
+}
+
+// Read calls fn with each record of a receipts file, in order. Blank lines
+// are skipped.
+func Read(r io.Reader, fn func(Record) error) error {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1<<20)
+	for line := 1; sc.Scan(); line++ {
+		if len(bytes.TrimSpace(sc.Bytes())) == 0 {
+			continue
+		}
+		var rec Record
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			return fmt.Errorf("receipts line %d: %w", line, err)
+		}
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+	return sc.Err()
+}
+
+// Close flushes the receipts file to disk and closes it.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.file.Sync(); err != nil {
+		l.file.Close()
+		return fmt.Errorf("syncing receipts file: %w", err)
+	}
+	return l.file.Close()
+}
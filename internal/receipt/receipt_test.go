@@ -0,0 +1,89 @@
+package receipt
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLogAppends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "receipts", "receipts.jsonl")
+	delivered := time.Date(2024, 5, 1, 14, 32, 0, 0, time.UTC)
+
+	// Two runs append to the same file.
+	for run := 0; run < 2; run++ {
+		l, err := Open(path)
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				err := l.Write(Record{
+					ID:           "01ARYZ6S41TSV4RRFFQ69G5FAV",
+					MessageID:    "<abc@example.com>",
+					Source:       "user@yahoo.com",
+					UID:          "uid1",
+					Destination:  "me@gmail.com",
+					SMTPResponse: "250 2.0.0 OK",
+					FetchedAt:    delivered.Add(-time.Second),
+					DeliveredAt:  delivered,
+				})
+				if err != nil {
+					t.Errorf("Write failed: %v", err)
+				}
+			}()
+		}
+		wg.Wait()
+		if err := l.Close(); err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	lines := 0
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		lines++
+		var r Record
+		if err := json.Unmarshal(sc.Bytes(), &r); err != nil {
+			t.Fatalf("line %d is not a record: %v", lines, err)
+		}
+		if r.SMTPResponse != "250 2.0.0 OK" || !r.DeliveredAt.Equal(delivered) {
+			t.Errorf("line %d: unexpected record %+v", lines, r)
+		}
+	}
+	if lines != 20 {
+		t.Errorf("expected 20 records, got %d", lines)
+	}
+}
+
+func TestRead(t *testing.T) {
+	in := `{"yatogm_id":"a","source":"user@yahoo.com","uid":"1","destination":"me@gmail.com","from":"news@shop.example","list_id":"<news.shop.example>"}
+
+{"yatogm_id":"b","source":"user@yahoo.com","uid":"2","destination":"me@gmail.com"}
+`
+	var got []Record
+	if err := Read(strings.NewReader(in), func(r Record) error { got = append(got, r); return nil }); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if len(got) != 2 || got[0].From != "news@shop.example" || got[0].ListID != "<news.shop.example>" || got[1].ID != "b" {
+		t.Errorf("unexpected records %+v", got)
+	}
+
+	err := Read(strings.NewReader(in+"{truncated\n"), func(Record) error { return nil })
+	if err == nil || !strings.Contains(err.Error(), "line 4") {
+		t.Errorf("expected an error on line 4, got %v", err)
+	}
+}
@@ -0,0 +1,418 @@
+package rules
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// kind is the type of an expression's value.
+type kind int
+
+const (
+	boolKind kind = iota
+	intKind
+	stringKind
+)
+
+func (k kind) String() string {
+	switch k {
+	case boolKind:
+		return "bool"
+	case intKind:
+		return "number"
+	}
+	return "string"
+}
+
+// node is a type-checked expression, evaluated against a message to a bool,
+// an int64, or a string, according to its kind.
+type node struct {
+	kind kind
+	eval func(m *Message) any
+}
+
+// Expr is a compiled rule condition.
+type Expr struct {
+	src  string
+	root node
+}
+
+// String returns the source of e.
+func (e *Expr) String() string { return e.src }
+
+// Eval reports whether the condition holds for m.
+func (e *Expr) Eval(m *Message) bool { return e.root.eval(m).(bool) }
+
+// Error is a problem with a condition, at Pos bytes into its source.
+type Error struct {
+	Pos int
+	Msg string
+}
+
+func (e *Error) Error() string { return fmt.Sprintf("col %d: %s", e.Pos+1, e.Msg) }
+
+// Compile parses and type-checks a condition, which must be a bool.
+func Compile(src string) (*Expr, error) {
+	toks, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{toks: toks}
+	n, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.typ != tokEOF {
+		return nil, &Error{t.pos, fmt.Sprintf("unexpected %s", t)}
+	}
+	if n.kind != boolKind {
+		return nil, &Error{0, fmt.Sprintf("condition is a %s, not a bool", n.kind)}
+	}
+	return &Expr{src: src, root: n}, nil
+}
+
+type tokType int
+
+const (
+	tokEOF tokType = iota
+	tokIdent
+	tokNumber
+	tokString
+	tokOp
+)
+
+type token struct {
+	typ tokType
+	pos int
+	// text is the token as written, except for strings, where it is the
+	// unquoted value.
+	text string
+	// num is the value of a number.
+	num int64
+}
+
+func (t token) String() string {
+	switch t.typ {
+	case tokEOF:
+		return "end of condition"
+	case tokString:
+		return strconv.Quote(t.text)
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+// units are the suffixes a number may have, such as "5MB".
+var units = map[string]int64{
+	"":   1,
+	"KB": 1 << 10,
+	"MB": 1 << 20,
+	"GB": 1 << 30,
+}
+
+// ops are the operators, longest first.
+var ops = []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "!", "(", ")", ","}
+
+// lex splits src into tokens.
+func lex(src string) ([]token, error) {
+	var toks []token
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case isLetter(c):
+			j := i + 1
+			for j < len(src) && (isLetter(src[j]) || isDigit(src[j]) || src[j] == '.') {
+				j++
+			}
+			toks = append(toks, token{typ: tokIdent, pos: i, text: src[i:j]})
+			i = j
+		case isDigit(c):
+			j := i
+			for j < len(src) && isDigit(src[j]) {
+				j++
+			}
+			k := j
+			for k < len(src) && isLetter(src[k]) {
+				k++
+			}
+			n, err := strconv.ParseInt(src[i:j], 10, 64)
+			unit, ok := units[src[j:k]]
+			if err != nil || !ok || n > (1<<63-1)/unit {
+				return nil, &Error{i, fmt.Sprintf("invalid number %q", src[i:k])}
+			}
+			toks = append(toks, token{typ: tokNumber, pos: i, text: src[i:k], num: n * unit})
+			i = k
+		case c == '"':
+			j := i + 1
+			for j < len(src) && src[j] != '"' {
+				if src[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(src) {
+				return nil, &Error{i, "unterminated string"}
+			}
+			s, err := strconv.Unquote(src[i : j+1])
+			if err != nil {
+				return nil, &Error{i, fmt.Sprintf("invalid string %s", src[i:j+1])}
+			}
+			toks = append(toks, token{typ: tokString, pos: i, text: s})
+			i = j + 1
+		default:
+			op := ""
+			for _, o := range ops {
+				if strings.HasPrefix(src[i:], o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				return nil, &Error{i, fmt.Sprintf("unexpected character %q", c)}
+			}
+			toks = append(toks, token{typ: tokOp, pos: i, text: op})
+			i += len(op)
+		}
+	}
+	return append(toks, token{typ: tokEOF, pos: len(src)}), nil
+}
+
+func isLetter(c byte) bool { return c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' }
+func isDigit(c byte) bool  { return '0' <= c && c <= '9' }
+
+// parser builds nodes from tokens by recursive descent, from the lowest
+// precedence (||) to the highest (operands).
+type parser struct {
+	toks []token
+	i    int
+}
+
+func (p *parser) peek() token { return p.toks[p.i] }
+
+func (p *parser) next() token {
+	t := p.toks[p.i]
+	if t.typ != tokEOF {
+		p.i++
+	}
+	return t
+}
+
+// accept consumes the next token if it is the operator or keyword text.
+func (p *parser) accept(text string) (token, bool) {
+	t := p.peek()
+	if (t.typ == tokOp || t.typ == tokIdent) && t.text == text {
+		return p.next(), true
+	}
+	return t, false
+}
+
+func (p *parser) expect(text string) error {
+	if t, ok := p.accept(text); !ok {
+		return &Error{t.pos, fmt.Sprintf("expected %q, found %s", text, t)}
+	}
+	return nil
+}
+
+func (p *parser) or() (node, error) {
+	return p.logical("||", p.and, func(a, b func(*Message) any, m *Message) bool {
+		return a(m).(bool) || b(m).(bool)
+	})
+}
+
+func (p *parser) and() (node, error) {
+	return p.logical("&&", p.not, func(a, b func(*Message) any, m *Message) bool {
+		return a(m).(bool) && b(m).(bool)
+	})
+}
+
+// logical parses operands joined by op, which must all be bools.
+func (p *parser) logical(op string, operand func() (node, error), join func(a, b func(*Message) any, m *Message) bool) (node, error) {
+	pos := p.peek().pos
+	n, err := operand()
+	if err != nil {
+		return node{}, err
+	}
+	for {
+		t, ok := p.accept(op)
+		if !ok {
+			return n, nil
+		}
+		rpos := p.peek().pos
+		r, err := operand()
+		if err != nil {
+			return node{}, err
+		}
+		if n.kind != boolKind {
+			return node{}, &Error{pos, fmt.Sprintf("%s needs bools, found a %s", t.text, n.kind)}
+		}
+		if r.kind != boolKind {
+			return node{}, &Error{rpos, fmt.Sprintf("%s needs bools, found a %s", t.text, r.kind)}
+		}
+		a, b := n.eval, r.eval
+		n = node{boolKind, func(m *Message) any { return join(a, b, m) }}
+	}
+}
+
+func (p *parser) not() (node, error) {
+	t, ok := p.accept("!")
+	if !ok {
+		return p.comparison()
+	}
+	n, err := p.not()
+	if err != nil {
+		return node{}, err
+	}
+	if n.kind != boolKind {
+		return node{}, &Error{t.pos, fmt.Sprintf("! needs a bool, found a %s", n.kind)}
+	}
+	return node{boolKind, func(m *Message) any { return !n.eval(m).(bool) }}, nil
+}
+
+// comparison parses an operand, optionally compared to another.
+func (p *parser) comparison() (node, error) {
+	n, err := p.operand()
+	if err != nil {
+		return node{}, err
+	}
+	t := p.peek()
+	switch t.text {
+	case "==", "!=", "<", "<=", ">", ">=", "contains", "matches":
+		if t.typ == tokString || t.typ == tokNumber {
+			return n, nil
+		}
+	default:
+		return n, nil
+	}
+	p.next()
+	rt := p.peek()
+	r, err := p.operand()
+	if err != nil {
+		return node{}, err
+	}
+	a, b := n.eval, r.eval
+	mismatch := &Error{t.pos, fmt.Sprintf("cannot compare a %s to a %s with %s", n.kind, r.kind, t.text)}
+	switch t.text {
+	case "==", "!=":
+		if n.kind != r.kind {
+			return node{}, mismatch
+		}
+		eq := t.text == "=="
+		return node{boolKind, func(m *Message) any { return (a(m) == b(m)) == eq }}, nil
+	case "contains":
+		if n.kind != stringKind || r.kind != stringKind {
+			return node{}, mismatch
+		}
+		return node{boolKind, func(m *Message) any {
+			return strings.Contains(strings.ToLower(a(m).(string)), strings.ToLower(b(m).(string)))
+		}}, nil
+	case "matches":
+		if n.kind != stringKind || r.kind != stringKind {
+			return node{}, mismatch
+		}
+		if _, err := path.Match(rt.text, ""); rt.typ == tokString && err != nil {
+			return node{}, &Error{rt.pos, fmt.Sprintf("invalid pattern %s", rt)}
+		}
+		return node{boolKind, func(m *Message) any { return match(b(m).(string), a(m).(string)) }}, nil
+	}
+	if n.kind != intKind || r.kind != intKind {
+		return node{}, mismatch
+	}
+	var cmp func(x, y int64) bool
+	switch t.text {
+	case "<":
+		cmp = func(x, y int64) bool { return x < y }
+	case "<=":
+		cmp = func(x, y int64) bool { return x <= y }
+	case ">":
+		cmp = func(x, y int64) bool { return x > y }
+	default:
+		cmp = func(x, y int64) bool { return x >= y }
+	}
+	return node{boolKind, func(m *Message) any { return cmp(a(m).(int64), b(m).(int64)) }}, nil
+}
+
+// operand parses a literal, a variable, a function call, or a
+// parenthesized expression.
+func (p *parser) operand() (node, error) {
+	t := p.next()
+	switch t.typ {
+	case tokNumber:
+		return node{intKind, func(*Message) any { return t.num }}, nil
+	case tokString:
+		return node{stringKind, func(*Message) any { return t.text }}, nil
+	case tokOp:
+		if t.text == "(" {
+			n, err := p.or()
+			if err != nil {
+				return node{}, err
+			}
+			return n, p.expect(")")
+		}
+	case tokIdent:
+		switch t.text {
+		case "true", "false":
+			v := t.text == "true"
+			return node{boolKind, func(*Message) any { return v }}, nil
+		}
+		if _, ok := p.accept("("); ok {
+			return p.call(t)
+		}
+		v, ok := variables[t.text]
+		if !ok {
+			return node{}, &Error{t.pos, fmt.Sprintf("unknown variable %q", t.text)}
+		}
+		return node{v.kind, v.eval}, nil
+	}
+	return node{}, &Error{t.pos, fmt.Sprintf("unexpected %s", t)}
+}
+
+// call parses the arguments of a call to the function named by t, whose
+// opening parenthesis was consumed.
+func (p *parser) call(t token) (node, error) {
+	f, ok := functions[t.text]
+	if !ok {
+		return node{}, &Error{t.pos, fmt.Sprintf("unknown function %q", t.text)}
+	}
+	var args []node
+	if _, ok := p.accept(")"); !ok {
+		for {
+			a, err := p.or()
+			if err != nil {
+				return node{}, err
+			}
+			args = append(args, a)
+			if _, ok := p.accept(","); !ok {
+				break
+			}
+		}
+		if err := p.expect(")"); err != nil {
+			return node{}, err
+		}
+	}
+	if len(args) < f.min || len(args) > len(f.args) {
+		return node{}, &Error{t.pos, fmt.Sprintf("%s takes %s", t.text, f.usage())}
+	}
+	for i, a := range args {
+		if a.kind != f.args[i] {
+			return node{}, &Error{t.pos, fmt.Sprintf("%s takes %s", t.text, f.usage())}
+		}
+	}
+	call := f.call
+	return node{f.kind, func(m *Message) any {
+		vals := make([]any, len(args))
+		for i, a := range args {
+			vals[i] = a.eval(m)
+		}
+		return call(m, vals)
+	}}, nil
+}
+
+// match reports whether s matches the pattern, case-insensitively, with
+// "*" as a wildcard.
+func match(pattern, s string) bool {
+	ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(s))
+	return ok
+}
@@ -0,0 +1,89 @@
+package rules
+
+import (
+	"strings"
+	"testing"
+)
+
+const statement = "From: \"My Bank\" <Statements@Bank.com>\r\n" +
+	"To: me@example.com, Family <family@example.org>\r\n" +
+	"Subject: =?UTF-8?Q?Your_statement_=E2=82=AC?=\r\n" +
+	"X-Spam-Flag: NO\r\n" +
+	"Content-Type: multipart/mixed; boundary=b1\r\n" +
+	"\r\n" +
+	"--b1\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"See attached.\r\n" +
+	"--b1\r\n" +
+	"Content-Type: application/octet-stream\r\n" +
+	"Content-Disposition: attachment; filename=\"March.PDF\"\r\n" +
+	"\r\n" +
+	"%PDF-1.4\r\n" +
+	"--b1--\r\n"
+
+func TestEval(t *testing.T) {
+	tests := []struct {
+		cond string
+		want bool
+	}{
+		{`from == "statements@bank.com"`, true},
+		{`from.domain == "bank.com" && size < 5MB`, true},
+		{`from.domain == "bank.com" && !has_attachment("pdf")`, false},
+		{`from.name == "My Bank"`, true},
+		{`mailbox matches "*@yahoo.com"`, true},
+		{`from matches "*@bank.*"`, true},
+		{`subject contains "STATEMENT"`, true},
+		{`subject == "Your statement €"`, true},
+		{`header("x-spam-flag") == "NO" && !spam`, true},
+		{`header("X-Missing") == ""`, true},
+		{`recipient("family@*")`, true},
+		{`recipient("*@bank.com")`, false},
+		{`has_attachment() && has_attachment(".pdf")`, true},
+		{`has_attachment("zip")`, false},
+		{`size >= 1KB || size > 100`, true},
+		{`!(size < 100) && !false`, true},
+		{`true && (false || from.domain != "bank.com")`, false},
+	}
+	m := NewMessage("me@yahoo.com", strings.NewReader(statement), int64(len(statement)))
+	for _, tt := range tests {
+		e, err := Compile(tt.cond)
+		if err != nil {
+			t.Errorf("Compile(%s): %v", tt.cond, err)
+			continue
+		}
+		if got := e.Eval(m); got != tt.want {
+			t.Errorf("%s = %v, want %v", tt.cond, got, tt.want)
+		}
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	tests := []struct {
+		cond string
+		want string
+	}{
+		{``, "col 1: unexpected end of condition"},
+		{`size`, "col 1: condition is a number, not a bool"},
+		{`frm == "a"`, `col 1: unknown variable "frm"`},
+		{`size < "5MB"`, "col 6: cannot compare a number to a string with <"},
+		{`from == 1`, "col 6: cannot compare a string to a number with =="},
+		{`size && true`, "col 1: && needs bools, found a number"},
+		{`!subject`, "col 1: ! needs a bool, found a string"},
+		{`size < 5TB`, `col 8: invalid number "5TB"`},
+		{`subject == "open`, "col 12: unterminated string"},
+		{`size < 5 5`, `col 10: unexpected "5"`},
+		{`(true`, `col 6: expected ")", found end of condition`},
+		{`has_attachment(1)`, "col 1: has_attachment takes at most 1 string argument"},
+		{`header()`, "col 1: header takes 1 string argument"},
+		{`lookup("a")`, `col 1: unknown function "lookup"`},
+		{`from matches "[a"`, `col 14: invalid pattern "[a"`},
+		{`from = "a"`, `col 6: unexpected character '='`},
+	}
+	for _, tt := range tests {
+		_, err := Compile(tt.cond)
+		if err == nil || err.Error() != tt.want {
+			t.Errorf("Compile(%s) = %v, want %s", tt.cond, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package rules
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"path"
+	"strings"
+
+	"github.com/benj-n/yatogm/internal/spam"
+)
+
+// maxDepth bounds the nesting of multipart bodies searched for attachments.
+const maxDepth = 10
+
+// Message is a message that conditions are evaluated against. Its header is
+// parsed on first use, and its body only if a condition asks about
+// attachments.
+type Message struct {
+	mailbox string
+	raw     io.ReaderAt
+	size    int64
+
+	parsed      bool
+	header      mail.Header
+	body        io.Reader
+	from        *mail.Address
+	attachments []attachment
+	walked      bool
+}
+
+// attachment is what a condition can tell about an attachment.
+type attachment struct {
+	filename  string
+	mediaType string
+}
+
+// NewMessage returns the message of size bytes in raw, retrieved from
+// mailbox.
+func NewMessage(mailbox string, raw io.ReaderAt, size int64) *Message {
+	return &Message{mailbox: mailbox, raw: raw, size: size}
+}
+
+// parse reads the header, leaving it empty if the message is malformed.
+func (m *Message) parse() {
+	if m.parsed {
+		return
+	}
+	m.parsed = true
+	m.header = mail.Header{}
+	msg, err := mail.ReadMessage(io.NewSectionReader(m.raw, 0, m.size))
+	if err != nil {
+		return
+	}
+	m.header, m.body = msg.Header, msg.Body
+	if from, err := mail.ParseAddress(m.header.Get("From")); err == nil {
+		m.from = from
+	}
+}
+
+// get returns the decoded value of the header key.
+func (m *Message) get(key string) string {
+	m.parse()
+	v := m.header.Get(key)
+	if dec, err := new(mime.WordDecoder).DecodeHeader(v); err == nil {
+		return dec
+	}
+	return v
+}
+
+// fromAddress returns the lowercased From address, or "".
+func (m *Message) fromAddress() string {
+	m.parse()
+	if m.from == nil {
+		return ""
+	}
+	return strings.ToLower(m.from.Address)
+}
+
+// recipients returns the lowercased To and Cc addresses.
+func (m *Message) recipients() []string {
+	m.parse()
+	var addrs []string
+	for _, key := range []string{"To", "Cc"} {
+		list, err := m.header.AddressList(key)
+		if err != nil {
+			continue
+		}
+		for _, a := range list {
+			addrs = append(addrs, strings.ToLower(a.Address))
+		}
+	}
+	return addrs
+}
+
+// attachmentList returns the attachments, walking the body the first time.
+func (m *Message) attachmentList() []attachment {
+	m.parse()
+	if !m.walked {
+		m.walked = true
+		if m.body != nil {
+			m.attachments = walk(m.header.Get("Content-Type"), m.header.Get("Content-Disposition"), m.body, 0, nil)
+		}
+	}
+	return m.attachments
+}
+
+// walk appends to list the attachments of a part with the given
+// Content-Type and Content-Disposition: the part itself if it has a file
+// name or an attachment disposition, or those of its subparts if it is
+// multipart.
+func walk(contentType, disposition string, body io.Reader, depth int, list []attachment) []attachment {
+	mediaType, params, _ := mime.ParseMediaType(contentType)
+	mediaType = strings.ToLower(mediaType)
+	if strings.HasPrefix(mediaType, "multipart/") {
+		if depth >= maxDepth || params["boundary"] == "" {
+			return list
+		}
+		r := multipart.NewReader(body, params["boundary"])
+		for {
+			p, err := r.NextPart()
+			if err != nil {
+				return list
+			}
+			list = walk(p.Header.Get("Content-Type"), p.Header.Get("Content-Disposition"), p, depth+1, list)
+		}
+	}
+	disp, dparams, _ := mime.ParseMediaType(disposition)
+	filename := dparams["filename"]
+	if filename == "" {
+		filename = params["name"]
+	}
+	if filename != "" || strings.EqualFold(disp, "attachment") {
+		list = append(list, attachment{filename: filename, mediaType: mediaType})
+	}
+	return list
+}
+
+// variable is a named value of a message.
+type variable struct {
+	kind kind
+	eval func(m *Message) any
+}
+
+// variables are the values conditions can refer to by name.
+var variables = map[string]variable{
+	"mailbox": {stringKind, func(m *Message) any { return m.mailbox }},
+	"size":    {intKind, func(m *Message) any { return m.size }},
+	"from":    {stringKind, func(m *Message) any { return m.fromAddress() }},
+	"from.domain": {stringKind, func(m *Message) any {
+		_, domain, _ := strings.Cut(m.fromAddress(), "@")
+		return domain
+	}},
+	"from.name": {stringKind, func(m *Message) any {
+		m.parse()
+		if m.from == nil {
+			return ""
+		}
+		return m.from.Name
+	}},
+	"subject": {stringKind, func(m *Message) any { return m.get("Subject") }},
+	"spam": {boolKind, func(m *Message) any {
+		m.parse()
+		v, _ := spam.Parse(m.header)
+		return v.Spam
+	}},
+}
+
+// function is a function conditions can call.
+type function struct {
+	kind kind
+	// args are the kinds of the arguments, of which the first min are
+	// required.
+	args []kind
+	min  int
+	call func(m *Message, args []any) any
+}
+
+// usage describes the arguments of f for error messages.
+func (f function) usage() string {
+	if len(f.args) == 0 {
+		return "no arguments"
+	}
+	s := fmt.Sprintf("%d %s argument", len(f.args), f.args[0])
+	if len(f.args) > 1 {
+		s += "s"
+	}
+	if f.min < len(f.args) {
+		s = "at most " + s
+	}
+	return s
+}
+
+// functions are the functions conditions can call.
+var functions = map[string]function{
+	// header returns the decoded value of a header, or "".
+	"header": {stringKind, []kind{stringKind}, 1, func(m *Message, args []any) any {
+		return m.get(args[0].(string))
+	}},
+	// recipient reports whether a To or Cc address matches a pattern.
+	"recipient": {boolKind, []kind{stringKind}, 1, func(m *Message, args []any) any {
+		for _, addr := range m.recipients() {
+			if match(args[0].(string), addr) {
+				return true
+			}
+		}
+		return false
+	}},
+	// has_attachment reports whether the message has any attachment or,
+	// given a type such as "pdf", one whose file name has that extension
+	// or whose media subtype is that type.
+	"has_attachment": {boolKind, []kind{stringKind}, 0, func(m *Message, args []any) any {
+		list := m.attachmentList()
+		if len(args) == 0 {
+			return len(list) > 0
+		}
+		want := strings.ToLower(strings.TrimPrefix(args[0].(string), "."))
+		for _, a := range list {
+			_, subtype, _ := strings.Cut(a.mediaType, "/")
+			if strings.ToLower(strings.TrimPrefix(path.Ext(a.filename), ".")) == want || subtype == want {
+				return true
+			}
+		}
+		return false
+	}},
+}
@@ -0,0 +1,63 @@
+// Package rules decides what happens to retrieved messages with rules
+// written in a small expression language, such as
+//
+//	from.domain == "bank.com" && size < 5MB && !has_attachment("pdf")
+//
+// Conditions compare the sender, recipients, subject, headers, size,
+// attachments, and spam verdict of a message, and are type-checked when
+// compiled, so that mistakes are reported before any message is handled.
+package rules
+
+import (
+	"fmt"
+	"io"
+)
+
+// Action is what a rule does with the messages it matches.
+type Action string
+
+const (
+	// Deliver delivers the message, skipping the rules after this one.
+	Deliver Action = "deliver"
+	// Archive keeps the message in the archive only, without delivering
+	// it.
+	Archive Action = "archive"
+)
+
+// Rule applies an action to the messages its condition holds for.
+type Rule struct {
+	Name   string
+	If     *Expr
+	Action Action
+}
+
+// New compiles a rule.
+func New(name, cond string, action Action) (Rule, error) {
+	switch action {
+	case Deliver, Archive:
+	default:
+		return Rule{}, fmt.Errorf("unknown action %q, want %q or %q", action, Deliver, Archive)
+	}
+	e, err := Compile(cond)
+	if err != nil {
+		return Rule{}, err
+	}
+	return Rule{Name: name, If: e, Action: action}, nil
+}
+
+// Set is a list of rules, of which the first that matches a message
+// applies.
+type Set []Rule
+
+// Match returns the first rule whose condition holds for the message of
+// size bytes in raw, retrieved from mailbox, and reports false if none
+// does.
+func (s Set) Match(mailbox string, raw io.ReaderAt, size int64) (Rule, bool) {
+	m := NewMessage(mailbox, raw, size)
+	for _, r := range s {
+		if r.If.Eval(m) {
+			return r, true
+		}
+	}
+	return Rule{}, false
+}
@@ -0,0 +1,49 @@
+package rules
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSet(t *testing.T) {
+	var s Set
+	for _, r := range []struct {
+		name, cond string
+		action     Action
+	}{
+		{"statements", `from.domain == "bank.com" && has_attachment("pdf")`, Deliver},
+		{"bank", `from.domain == "bank.com"`, Archive},
+		{"big", `size > 10MB`, Archive},
+	} {
+		rule, err := New(r.name, r.cond, r.action)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s = append(s, rule)
+	}
+
+	match := func(msg string) string {
+		r, ok := s.Match("me@yahoo.com", strings.NewReader(msg), int64(len(msg)))
+		if !ok {
+			return ""
+		}
+		return r.Name + " " + string(r.Action)
+	}
+	if got := match(statement); got != "statements deliver" {
+		t.Errorf("statement matched %q, want the first rule", got)
+	}
+	if got := match("From: promo@bank.com\r\n\r\nHi\r\n"); got != "bank archive" {
+		t.Errorf("promotion matched %q, want the second rule", got)
+	}
+	if got := match("From: friend@example.com\r\n\r\nHi\r\n"); got != "" {
+		t.Errorf("other message matched %q, want none", got)
+	}
+	// A malformed message has an empty header but still has a size.
+	if got := match("not a message"); got != "" {
+		t.Errorf("malformed message matched %q, want none", got)
+	}
+
+	if _, err := New("x", "true", "drop"); err == nil {
+		t.Error("expected an error for an unknown action")
+	}
+}
@@ -0,0 +1,55 @@
+// Package schedule runs yatogm periodically in-process, as an alternative
+// to cron.
+//
+// Intervals are measured on the monotonic clock, so wall-clock jumps (such
+// as the NTP step on a Raspberry Pi without an RTC right after boot)
+// neither delay nor bunch up runs. Jumps are still worth knowing about,
+// since retention and throttling state are stored as wall-clock times, so
+// they are detected and logged.
+package schedule
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// SkewThreshold is the discrepancy between wall-clock and monotonic
+// elapsed time above which a clock jump is reported.
+const SkewThreshold = 30 * time.Second
+
+// Every calls fn immediately and then every interval, measured from the
+// start of each call, until ctx is done. A call that overruns the interval
+// is followed by the next one right away.
+func Every(ctx context.Context, interval time.Duration, logger *slog.Logger, fn func(ctx context.Context)) {
+	for {
+		start := time.Now()
+		fn(ctx)
+
+		wait := interval - time.Since(start)
+		if wait < 0 {
+			logger.Warn("run took longer than the interval",
+				"interval", interval.String(), "elapsed", time.Since(start).Round(time.Millisecond).String())
+			wait = 0
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		if d := skew(start, time.Now()); d > SkewThreshold || d < -SkewThreshold {
+			logger.Warn("wall clock jumped between runs",
+				"skew", d.Round(time.Second).String(), "now", time.Now().Format(time.RFC3339))
+		}
+	}
+}
+
+// skew returns how much further the wall clock moved than the monotonic
+// clock between two readings from time.Now: positive when the wall clock
+// jumped forward, negative when it was set back.
+func skew(prev, now time.Time) time.Duration {
+	return now.Round(0).Sub(prev.Round(0)) - now.Sub(prev)
+}
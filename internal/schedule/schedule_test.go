@@ -0,0 +1,65 @@
+package schedule
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestEvery(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var calls atomic.Int32
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		Every(ctx, 10*time.Millisecond, logger, func(context.Context) {
+			if calls.Add(1) == 3 {
+				cancel()
+			}
+		})
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Every did not stop after cancel")
+	}
+	if n := calls.Load(); n != 3 {
+		t.Errorf("expected 3 calls, got %d", n)
+	}
+}
+
+func TestEveryOverrun(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Calls slower than the interval run back to back instead of queueing.
+	var calls atomic.Int32
+	start := time.Now()
+	Every(ctx, time.Millisecond, logger, func(context.Context) {
+		time.Sleep(5 * time.Millisecond)
+		if calls.Add(1) == 4 {
+			cancel()
+		}
+	})
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("overrunning calls took %s", elapsed)
+	}
+}
+
+func TestSkewWithoutJump(t *testing.T) {
+	prev := time.Now()
+	if d := skew(prev, prev.Add(time.Hour)); d != 0 {
+		t.Errorf("expected no skew, got %s", d)
+	}
+	if d := skew(prev, time.Now()); d > SkewThreshold || d < -SkewThreshold {
+		t.Errorf("unexpected skew %s", d)
+	}
+}
@@ -0,0 +1,100 @@
+package smtp
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	netsmtp "net/smtp"
+
+	"github.com/benj-n/yatogm/internal/clock"
+)
+
+// client is a connection to the server, kept between deliveries.
+type client struct {
+	*netsmtp.Client
+	conn *conn
+}
+
+// conn is a connection on which every read and write must complete within
+// the command timeout, and before the deadline of the delivery using it.
+type conn struct {
+	net.Conn
+	timeout time.Duration
+	clock   clock.Clock
+
+	mu   sync.Mutex
+	ctx  context.Context
+	stop func() bool
+}
+
+// newConn wraps c, bounding its exchanges by timeout, by clk's time, and
+// ctx.
+func newConn(ctx context.Context, c net.Conn, timeout time.Duration, clk clock.Clock) *conn {
+	cn := &conn{Conn: c, timeout: timeout, clock: clk}
+	cn.bind(ctx)
+	return cn
+}
+
+// bind makes ctx bound the exchanges on the connection until unbind, and
+// interrupts the one under way when ctx is done.
+func (c *conn) bind(ctx context.Context) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ctx = ctx
+	c.stop = context.AfterFunc(ctx, func() {
+		c.Conn.SetDeadline(c.clock.Now())
+	})
+}
+
+// unbind releases the connection from the context bind gave it.
+func (c *conn) unbind() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stop != nil {
+		c.stop()
+	}
+	c.ctx, c.stop = nil, nil
+}
+
+func (c *conn) Read(p []byte) (int, error) {
+	if err := c.extend(); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *conn) Write(p []byte) (int, error) {
+	if err := c.extend(); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(p)
+}
+
+// extend sets the deadline of the next read or write, and fails if the
+// context bounding it is done already. The context's own deadline is left
+// to the interruption bind sets up, which only comes once the context
+// reports it, so that an exchange never times out for it unnoticed.
+func (c *conn) extend() error {
+	c.mu.Lock()
+	ctx := c.ctx
+	c.mu.Unlock()
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	var deadline time.Time
+	if c.timeout > 0 {
+		deadline = c.clock.Now().Add(c.timeout)
+	}
+	if err := c.Conn.SetDeadline(deadline); err != nil {
+		return err
+	}
+	return ctx.Err()
+}
+
+// Close closes the connection without QUIT.
+func (c *client) Close() error {
+	c.conn.unbind()
+	return c.Client.Close()
+}
@@ -0,0 +1,123 @@
+package smtp
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net/mail"
+	"strings"
+)
+
+// addressHeaders are the header fields holding address lists, whose
+// addresses are kept apart from their display names when downgraded.
+var addressHeaders = map[string]bool{
+	"From": true, "To": true, "Cc": true, "Bcc": true, "Reply-To": true, "Sender": true,
+	"Resent-From": true, "Resent-To": true, "Resent-Cc": true, "Resent-Sender": true,
+	"X-Original-From": true, "X-Original-To": true, "X-Original-Cc": true,
+	"Return-Path": true, "Delivered-To": true,
+}
+
+// needsSMTPUTF8 reports whether a message with the header block head,
+// sent between the envelope addresses addrs, can only be sent as it is
+// with the SMTPUTF8 extension (RFC 6531): an address or a header field is
+// not ASCII. The body is not considered, as 8BITMIME covers it.
+func needsSMTPUTF8(head []byte, addrs ...string) bool {
+	for _, addr := range addrs {
+		if !isASCII(addr) {
+			return true
+		}
+	}
+	return !isASCII(string(head))
+}
+
+// readHeaderBlock reads the header block at the start of r, up to and
+// including the blank line ending it, and returns it with a reader
+// producing the rest of the message.
+func readHeaderBlock(r io.Reader) ([]byte, io.Reader, error) {
+	br := bufio.NewReader(r)
+	var head []byte
+	for {
+		line, err := br.ReadBytes('\n')
+		head = append(head, line...)
+		if err != nil && err != io.EOF {
+			return nil, nil, err
+		}
+		if err == io.EOF || string(line) == "\n" || string(line) == "\r\n" {
+			return head, br, nil
+		}
+	}
+}
+
+// asciiAddress returns the envelope address addr with its domain in
+// punycode, for a server without SMTPUTF8. An address whose local part is
+// not ASCII cannot be written at all.
+func asciiAddress(addr string) (string, error) {
+	i := strings.LastIndex(addr, "@")
+	if i < 0 || !isASCII(addr[:i]) {
+		return "", fmt.Errorf("address %q is not ASCII and the server does not support SMTPUTF8", addr)
+	}
+	return addr[:i+1] + asciiDomain(addr[i+1:]), nil
+}
+
+// downgradeHeader returns the header block head with every field that is
+// not ASCII rewritten for a server without SMTPUTF8, following RFC 6857:
+// display names and other text become RFC 2047 encoded words, and address
+// domains punycode. ASCII fields are kept as they are. A header block that
+// cannot be parsed is returned unchanged.
+func downgradeHeader(head []byte) []byte {
+	fields, _, err := readHeader(bytes.NewReader(head))
+	if err != nil {
+		return head
+	}
+	var buf bytes.Buffer
+	end := 0
+	for _, f := range fields {
+		end += len(f.raw)
+		if isASCII(string(f.raw)) {
+			buf.Write(f.raw)
+			if !bytes.HasSuffix(f.raw, []byte("\n")) {
+				buf.WriteString("\r\n")
+			}
+			continue
+		}
+		name, value, _ := strings.Cut(string(f.raw), ":")
+		value = strings.TrimSpace(strings.NewReplacer("\r\n", "", "\n", "", "\r", "").Replace(value))
+		value = strings.ToValidUTF8(value, "\uFFFD")
+		writeHeader(&buf, strings.TrimRight(name, " \t"), downgradeValue(f.key, value))
+	}
+	// The blank line ending the block.
+	buf.Write(head[end:])
+	return buf.Bytes()
+}
+
+// downgradeValue returns the value of the header field key in ASCII.
+func downgradeValue(key, value string) string {
+	if addressHeaders[key] {
+		if list, err := mail.ParseAddressList(value); err == nil {
+			addrs := make([]string, len(list))
+			for i, a := range list {
+				addrs[i] = downgradeAddress(a)
+			}
+			return strings.Join(addrs, ", ")
+		}
+	}
+	return mime.QEncoding.Encode("utf-8", value)
+}
+
+// downgradeAddress returns a in ASCII: its display name encoded and its
+// domain in punycode. An address whose local part is not ASCII cannot be
+// written as an address, so it is kept readable as the encoded display
+// name of an empty group, as RFC 6857 does.
+func downgradeAddress(a *mail.Address) string {
+	i := strings.LastIndex(a.Address, "@")
+	if i < 0 || !isASCII(a.Address[:i]) {
+		text := a.Address
+		if a.Name != "" {
+			text = a.Name + " <" + a.Address + ">"
+		}
+		return mime.BEncoding.Encode("utf-8", text) + " :;"
+	}
+	return (&mail.Address{Name: a.Name, Address: a.Address[:i+1] + asciiDomain(a.Address[i+1:])}).String()
+}
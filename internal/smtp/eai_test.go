@@ -0,0 +1,203 @@
+package smtp
+
+import (
+	"bytes"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestDowngradeHeader(t *testing.T) {
+	head := "From: Jöhn <john@exämple.com>\r\n" +
+		"To: 用户@例子.广告, plain@example.com\r\n" +
+		"Subject: Café\r\n" +
+		"DKIM-Signature: v=1; d=example.com\r\n" +
+		"\r\n"
+	out := string(downgradeHeader([]byte(head)))
+	if !isASCII(out) {
+		t.Fatalf("expected an ASCII header block, got %q", out)
+	}
+	for _, want := range []string{
+		"From: =?utf-8?q?J=C3=B6hn?= <john@xn--exmple-cua.com>\r\n",
+		"Subject: =?utf-8?q?Caf=C3=A9?=\r\n",
+		"DKIM-Signature: v=1; d=example.com\r\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %q in %q", want, out)
+		}
+	}
+	if !strings.HasSuffix(out, "\r\n\r\n") {
+		t.Errorf("expected the blank line kept, got %q", out)
+	}
+
+	msg, err := mail.ReadMessage(strings.NewReader(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The address with a local part that is not ASCII stays readable as
+	// the name of an empty group.
+	to, err := mail.ParseAddressList(msg.Header.Get("To"))
+	if err != nil {
+		t.Fatalf("downgraded To does not parse: %v", err)
+	}
+	if len(to) != 1 || to[0].Address != "plain@example.com" {
+		t.Errorf("To = %v, want only plain@example.com", to)
+	}
+	if !strings.Contains(msg.Header.Get("To"), ":;") {
+		t.Errorf("expected an empty group in %q", msg.Header.Get("To"))
+	}
+}
+
+func TestAsciiAddress(t *testing.T) {
+	if got, err := asciiAddress("me@bücher.example"); err != nil || got != "me@xn--bcher-kva.example" {
+		t.Errorf("asciiAddress = %q, %v", got, err)
+	}
+	if _, err := asciiAddress("josé@example.com"); err == nil {
+		t.Error("expected an error for a local part that is not ASCII")
+	}
+}
+
+// deliveryServer serves SMTP sessions on a local port, offering the given
+// EHLO extensions besides AUTH, and records for each session the MAIL and
+// RCPT lines and the message data it received, and whether it ended with
+// QUIT. Recipients whose local part is "reject" are refused. When it
+// offers PIPELINING, the replies to MAIL and RCPT are held until DATA, so a
+// client waiting for each of them stalls.
+func deliveryServer(t *testing.T, extensions ...string) (port int, sessions chan []string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return serveDelivery(t, ln, extensions...)
+}
+
+// serveDelivery is deliveryServer on the listener ln.
+func serveDelivery(t *testing.T, ln net.Listener, extensions ...string) (port int, sessions chan []string) {
+	t.Helper()
+	t.Cleanup(func() { ln.Close() })
+	sessions = make(chan []string, 4)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveSession(conn, extensions, sessions)
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr).Port, sessions
+}
+
+func serveSession(conn net.Conn, extensions []string, sessions chan []string) {
+	var seen []string
+	defer func() { sessions <- seen }()
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 test ESMTP ready")
+	pipelining := slices.Contains(extensions, "PIPELINING")
+	var held []string
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, _, _ := strings.Cut(line, " ")
+		switch verb {
+		case "EHLO":
+			tp.PrintfLine("250-test")
+			for _, ext := range extensions {
+				tp.PrintfLine("250-%s", ext)
+			}
+			tp.PrintfLine("250 AUTH PLAIN")
+		case "AUTH":
+			tp.PrintfLine("235 2.7.0 Accepted")
+		case "MAIL", "RCPT":
+			seen = append(seen, line)
+			reply := "250 OK"
+			if strings.HasPrefix(line, "RCPT TO:<reject@") {
+				reply = "550 5.1.1 No such user"
+			}
+			if pipelining {
+				held = append(held, reply)
+			} else {
+				tp.PrintfLine("%s", reply)
+			}
+		case "RSET", "NOOP":
+			tp.PrintfLine("250 OK")
+		case "DATA":
+			for _, reply := range held {
+				tp.PrintfLine("%s", reply)
+			}
+			held = nil
+			tp.PrintfLine("354 go ahead")
+			data, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			seen = append(seen, string(data))
+			tp.PrintfLine("250 2.0.0 OK queued")
+		case "QUIT":
+			seen = append(seen, line)
+			tp.PrintfLine("221 bye")
+			return
+		default:
+			tp.PrintfLine("502 command not implemented")
+		}
+	}
+}
+
+func TestDeliverSMTPUTF8(t *testing.T) {
+	raw := []byte("From: Jöhn <jöhn@exämple.com>\r\nSubject: Grüße\r\n\r\nbody\r\n")
+
+	// The server offers SMTPUTF8: the message is sent as it is.
+	port, session := deliveryServer(t, "8BITMIME", "SMTPUTF8")
+	s := NewSender("127.0.0.1", port, "user@gmail.com", "secret", "dest@gmail.com")
+	s.SetForwardMode(ForwardRaw)
+	if _, err := s.Send(bytes.NewReader(raw), int64(len(raw)), "me@yahoo.com", ""); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	s.Close()
+	seen := <-session
+	if len(seen) != 4 || seen[0] != "MAIL FROM:<dest@gmail.com> BODY=8BITMIME SMTPUTF8" {
+		t.Fatalf("expected SMTPUTF8 asked for, got %q", seen)
+	}
+	if !strings.Contains(seen[2], "From: Jöhn <jöhn@exämple.com>") {
+		t.Errorf("expected the header kept, got %q", seen[2])
+	}
+
+	// The server does not: the header is downgraded.
+	port, session = deliveryServer(t, "8BITMIME")
+	s = NewSender("127.0.0.1", port, "user@gmail.com", "secret", "dest@gmail.com")
+	s.SetForwardMode(ForwardRaw)
+	if _, err := s.Send(bytes.NewReader(raw), int64(len(raw)), "me@yahoo.com", ""); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	s.Close()
+	seen = <-session
+	if len(seen) != 4 || seen[0] != "MAIL FROM:<dest@gmail.com> BODY=8BITMIME" {
+		t.Fatalf("expected no SMTPUTF8, got %q", seen)
+	}
+	head, _, _ := strings.Cut(seen[2], "\r\n\r\n")
+	if !isASCII(head) {
+		t.Errorf("expected an ASCII header block, got %q", head)
+	}
+	if !strings.Contains(head, "Subject: =?utf-8?q?Gr=C3=BC=C3=9Fe?=") {
+		t.Errorf("expected an encoded Subject, got %q", head)
+	}
+
+	// An ASCII message does not ask for SMTPUTF8 even if offered.
+	port, session = deliveryServer(t, "SMTPUTF8")
+	s = NewSender("127.0.0.1", port, "user@gmail.com", "secret", "dest@gmail.com")
+	ascii := []byte("From: a@example.com\r\nSubject: hi\r\n\r\nbody\r\n")
+	if _, err := s.Send(bytes.NewReader(ascii), int64(len(ascii)), "me@yahoo.com", ""); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	s.Close()
+	if seen = <-session; len(seen) != 4 || seen[0] != "MAIL FROM:<dest@gmail.com>" {
+		t.Errorf("expected a plain MAIL command, got %q", seen)
+	}
+}
@@ -0,0 +1,55 @@
+package smtp
+
+import (
+	"errors"
+	"fmt"
+	"net/textproto"
+	"strings"
+)
+
+// IsThrottled reports whether err is an SMTP response indicating that the
+// server is rate-limiting us, such as Gmail's "421 4.7.0 Try again later"
+// or "550 5.4.5 Daily user sending limit exceeded".
+func IsThrottled(err error) bool {
+	var tpErr *textproto.Error
+	if !errors.As(err, &tpErr) {
+		return false
+	}
+	switch tpErr.Code {
+	case 421, 450, 452:
+		return true
+	}
+	msg := tpErr.Msg
+	return (tpErr.Code/100 == 4 && strings.HasPrefix(msg, "4.7.")) || strings.HasPrefix(msg, "5.4.5")
+}
+
+// IsQuotaExceeded reports whether err is a throttling response saying that
+// the account's sending quota is used up, such as Gmail's "550 5.4.5 Daily
+// user sending limit exceeded", which only lifts after hours.
+func IsQuotaExceeded(err error) bool {
+	var tpErr *textproto.Error
+	return errors.As(err, &tpErr) && strings.HasPrefix(tpErr.Msg, "5.4.5")
+}
+
+// RejectedError is returned when the server refuses a message after
+// receiving its data, as opposed to failing to connect, authenticate, or
+// accept the envelope.
+type RejectedError struct {
+	Err error
+}
+
+func (e *RejectedError) Error() string {
+	return fmt.Sprintf("message rejected: %v", e.Err)
+}
+
+func (e *RejectedError) Unwrap() error {
+	return e.Err
+}
+
+// IsRejected reports whether err means the destination refused this
+// particular message for a reason other than throttling, so that sending
+// other messages may still succeed.
+func IsRejected(err error) bool {
+	var rejErr *RejectedError
+	return errors.As(err, &rejErr) && !IsThrottled(err)
+}
@@ -0,0 +1,67 @@
+package smtp
+
+import (
+	"bytes"
+	"maps"
+	"mime"
+	"net/textproto"
+	"path"
+	"slices"
+	"strings"
+	"text/template"
+)
+
+// HeaderPolicy decides which of the original headers that Send does not
+// rewrite itself are copied to the forwarded message in ForwardRewrite
+// mode. Patterns are matched case-insensitively against the header name,
+// with "*" matching any run of characters, as in "X-Yahoo-*".
+type HeaderPolicy struct {
+	// Keep lists headers that are always copied, even if they match Drop.
+	Keep []string
+	// Drop lists headers that are not copied.
+	Drop []string
+}
+
+// Copies reports whether the header named key is copied.
+func (p HeaderPolicy) Copies(key string) bool {
+	return matchAny(p.Keep, key) || !matchAny(p.Drop, key)
+}
+
+// matchAny reports whether key matches any of the patterns. Malformed
+// patterns never match.
+func matchAny(patterns []string, key string) bool {
+	key = strings.ToLower(key)
+	for _, p := range patterns {
+		if ok, _ := path.Match(strings.ToLower(p), key); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// SetExtraHeaders makes messages from the source mailboxes in headers carry
+// the extra headers their templates render, such as "X-Team: family", in
+// every forward mode, for Gmail filters to match. In ForwardRewrite mode
+// they replace original headers of the same name. A header whose template
+// renders nothing or fails is left out.
+func (s *Sender) SetExtraHeaders(headers map[string]map[string]*template.Template) {
+	s.extra = make(map[string]map[string]*template.Template, len(headers))
+	for source, h := range headers {
+		canonical := make(map[string]*template.Template, len(h))
+		for k, v := range h {
+			canonical[textproto.CanonicalMIMEHeaderKey(k)] = v
+		}
+		s.extra[source] = canonical
+	}
+}
+
+// writeExtraHeaders writes the extra headers of the message data describes,
+// in name order, encoding values that are not ASCII.
+func (s *Sender) writeExtraHeaders(buf *bytes.Buffer, data TemplateData) {
+	h := s.extra[data.Mailbox]
+	for _, k := range slices.Sorted(maps.Keys(h)) {
+		if v, ok := render(h[k], data); ok && v != "" {
+			writeHeader(buf, k, mime.QEncoding.Encode("utf-8", v))
+		}
+	}
+}
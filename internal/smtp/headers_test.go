@@ -0,0 +1,102 @@
+package smtp
+
+import (
+	"bytes"
+	"mime"
+	"net/mail"
+	"testing"
+	"text/template"
+)
+
+func TestHeaderPolicyCopies(t *testing.T) {
+	p := HeaderPolicy{
+		Keep: []string{"X-Yahoo-Newman-Id"},
+		Drop: []string{"X-Yahoo-*", "x-spam-*", "Received"},
+	}
+	tests := []struct {
+		key  string
+		want bool
+	}{
+		{"X-Yahoo-SMTP", false},
+		{"X-YAHOO-FILTERED-BULK", false},
+		{"X-Yahoo-Newman-Id", true},
+		{"X-Spam-Score", false},
+		{"Received", false},
+		{"Received-SPF", true},
+		{"List-Unsubscribe", true},
+	}
+	for _, tt := range tests {
+		if got := p.Copies(tt.key); got != tt.want {
+			t.Errorf("Copies(%q) = %v, want %v", tt.key, got, tt.want)
+		}
+	}
+
+	if !(HeaderPolicy{}).Copies("X-Yahoo-SMTP") {
+		t.Error("expected the zero policy to copy every header")
+	}
+}
+
+func TestBuildMessageHeaderPolicy(t *testing.T) {
+	s := NewSender("smtp.gmail.com", 587, "user@gmail.com", "secret", "dest@gmail.com")
+	s.SetHeaderPolicy(HeaderPolicy{Drop: []string{"X-Yahoo-*", "X-YMailISG"}})
+	raw := []byte("From: a@example.com\r\nSubject: hi\r\n" +
+		"X-YMailISG: abc\r\nX-Yahoo-Filtered-Bulk: 1.2.3.4\r\nList-Id: <list.example.com>\r\n\r\nbody\r\n")
+
+	out, err := buildMessage(s, raw, "me@yahoo.com", "")
+	if err != nil {
+		t.Fatalf("buildMessage failed: %v", err)
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("rewritten message does not parse: %v", err)
+	}
+	for _, key := range []string{"X-YMailISG", "X-Yahoo-Filtered-Bulk"} {
+		if got := msg.Header.Get(key); got != "" {
+			t.Errorf("%s was copied: %q", key, got)
+		}
+	}
+	if got := msg.Header.Get("List-Id"); got != "<list.example.com>" {
+		t.Errorf("List-Id = %q", got)
+	}
+	// The dropped bulk header still shows in the normalized verdict.
+	if got := msg.Header.Get("X-YaToGm-Spam-Score"); got != "1.00 (spam by X-Yahoo-Filtered-Bulk)" {
+		t.Errorf("X-YaToGm-Spam-Score = %q", got)
+	}
+}
+
+func TestExtraHeaders(t *testing.T) {
+	s := NewSender("smtp.gmail.com", 587, "user@gmail.com", "secret", "dest@gmail.com")
+	s.SetExtraHeaders(map[string]map[string]*template.Template{
+		"family@yahoo.com": parseTemplates(t, map[string]string{"x-team": "family", "X-Owner": "Zoë"}),
+	})
+	raw := []byte("From: a@example.com\r\nX-Team: original\r\nSubject: hi\r\n\r\nbody\r\n")
+
+	for _, mode := range []ForwardMode{ForwardRewrite, ForwardRaw} {
+		s.SetForwardMode(mode)
+		out, err := buildMessage(s, raw, "family@yahoo.com", "")
+		if err != nil {
+			t.Fatalf("buildMessage failed: %v", err)
+		}
+		msg, err := mail.ReadMessage(bytes.NewReader(out))
+		if err != nil {
+			t.Fatalf("%s: message does not parse: %v", mode, err)
+		}
+		if got := msg.Header.Get("X-Team"); got != "family" {
+			t.Errorf("%s: X-Team = %q, want family", mode, got)
+		}
+		if got, _ := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("X-Owner")); got != "Zoë" {
+			t.Errorf("%s: X-Owner = %q", mode, got)
+		}
+		if mode == ForwardRewrite && len(msg.Header["X-Team"]) != 1 {
+			t.Errorf("original X-Team not replaced: %q", msg.Header["X-Team"])
+		}
+
+		out, err = buildMessage(s, raw, "other@yahoo.com", "")
+		if err != nil {
+			t.Fatalf("buildMessage failed: %v", err)
+		}
+		if bytes.Contains(out, []byte("X-Owner")) || bytes.Contains(out, []byte("X-Team: family")) {
+			t.Errorf("%s: extra headers added to another mailbox's message", mode)
+		}
+	}
+}
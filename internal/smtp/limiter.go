@@ -0,0 +1,213 @@
+package smtp
+
+import (
+	"sync"
+	"time"
+
+	"github.com/benj-n/yatogm/internal/clock"
+)
+
+const (
+	// minThrottleDelay is the first pause inserted between deliveries once
+	// concurrency is already down to one.
+	minThrottleDelay = time.Second
+	// maxThrottleDelay caps the pause between deliveries.
+	maxThrottleDelay = time.Minute
+)
+
+// Limiter bounds the number of concurrent deliveries, both in aggregate and
+// per destination, so that several mailboxes forwarding to the same account
+// do not trip the destination's throttling. It is safe for concurrent use.
+//
+// Per-destination bounds adapt AIMD-style: a throttling response halves the
+// bound (and once it reaches one, doubles a pause between deliveries), while
+// each full round of successful deliveries raises it by one until the
+// configured bound is restored. A destination without one is raised up to
+// the concurrency it was throttled at, and then left unbounded again.
+type Limiter struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	global   int
+	inFlight int
+	dests    map[string]*destLimit
+	// clock pauses between deliveries while throttled.
+	clock clock.Clock
+}
+
+// destLimit tracks one destination's bound and current usage.
+type destLimit struct {
+	// max is the configured bound; zero means unbounded.
+	max int
+	// limit is the current, possibly reduced, bound; zero means unbounded.
+	limit int
+	// ceiling, for a destination without max, is the concurrency it was
+	// throttled at, up to which limit is raised before it is lifted.
+	ceiling   int
+	inFlight  int
+	successes int
+	// delay is the pause before each delivery while throttled.
+	delay time.Duration
+}
+
+// NewLimiter creates a Limiter allowing at most global concurrent
+// deliveries across all destinations. Zero means no aggregate bound.
+func NewLimiter(global int) *Limiter {
+	l := &Limiter{
+		global: global,
+		dests:  make(map[string]*destLimit),
+		clock:  clock.System,
+	}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+// SetClock makes c pause between deliveries instead of the system clock.
+func (l *Limiter) SetClock(c clock.Clock) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.clock = c
+}
+
+// SetLimit bounds concurrent deliveries to dest. Zero means no bound.
+func (l *Limiter) SetLimit(dest string, n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	d := l.dest(dest)
+	d.max, d.limit, d.ceiling = n, n, 0
+	l.cond.Broadcast()
+}
+
+// Restore resumes a reduced bound and pause for dest, such as those left by
+// throttling in an earlier run. The bound never exceeds the configured one,
+// and a zero limit leaves the current bound unchanged.
+func (l *Limiter) Restore(dest string, limit int, delay time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	d := l.dest(dest)
+	if limit > 0 && (d.max == 0 || limit < d.max) {
+		d.limit = limit
+		if d.max == 0 {
+			// The bound was at least halved from what was throttled.
+			d.ceiling = 2 * limit
+		}
+	}
+	d.delay = min(max(delay, 0), maxThrottleDelay)
+	d.successes = 0
+	l.cond.Broadcast()
+}
+
+// Limit returns the current bound for dest, which is lower than the
+// configured one after throttling. Zero means unbounded.
+func (l *Limiter) Limit(dest string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.dest(dest).limit
+}
+
+// Acquire blocks until a delivery to dest may start and returns a function
+// that must be called when it finishes.
+func (l *Limiter) Acquire(dest string) (release func()) {
+	l.mu.Lock()
+	d := l.dest(dest)
+	for (l.global > 0 && l.inFlight >= l.global) || (d.limit > 0 && d.inFlight >= d.limit) {
+		l.cond.Wait()
+	}
+	l.inFlight++
+	d.inFlight++
+	delay, clk := d.delay, l.clock
+	l.mu.Unlock()
+
+	if delay > 0 {
+		clk.Sleep(delay)
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			l.inFlight--
+			d.inFlight--
+			l.mu.Unlock()
+			l.cond.Broadcast()
+		})
+	}
+}
+
+// Throttled records a rate-limit response from dest and returns the new
+// bound. The bound is halved; once it is one, the pause between deliveries
+// is doubled instead.
+func (l *Limiter) Throttled(dest string) (limit int, delay time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	d := l.dest(dest)
+	d.successes = 0
+	current := d.limit
+	if current == 0 {
+		// Unbounded so far: start from what was actually in flight.
+		current = max(d.inFlight, 1)
+	}
+	if d.max == 0 {
+		d.ceiling = max(d.ceiling, current)
+	}
+	if current > 1 {
+		d.limit = current / 2
+	} else {
+		d.limit = 1
+		d.delay = min(max(2*d.delay, minThrottleDelay), maxThrottleDelay)
+	}
+	return d.limit, d.delay
+}
+
+// Succeeded records a successful delivery to dest. After a full round of
+// successes at the current bound, the pause is halved or, once gone, the
+// bound is raised by one up to the configured maximum or, for a destination
+// without one, up to the concurrency it was throttled at, and then lifted.
+func (l *Limiter) Succeeded(dest string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	d := l.dest(dest)
+	if d.limit == d.max && d.delay == 0 {
+		return
+	}
+	d.successes++
+	if d.successes < max(d.limit, 1) {
+		return
+	}
+	d.successes = 0
+	switch {
+	case d.delay > 0:
+		d.delay /= 2
+		if d.delay < minThrottleDelay {
+			d.delay = 0
+		}
+	case d.max == 0 && d.limit+1 >= d.ceiling:
+		d.limit, d.ceiling = 0, 0
+	case d.max == 0:
+		d.limit++
+	case d.limit+1 >= d.max:
+		d.limit = d.max
+	default:
+		d.limit++
+	}
+	l.cond.Broadcast()
+}
+
+// Delay returns the pause currently inserted before deliveries to dest.
+func (l *Limiter) Delay(dest string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.dest(dest).delay
+}
+
+// dest returns the state for dest, creating it if needed. The caller must
+// hold l.mu.
+func (l *Limiter) dest(dest string) *destLimit {
+	d, ok := l.dests[dest]
+	if !ok {
+		d = &destLimit{}
+		l.dests[dest] = d
+	}
+	return d
+}
@@ -0,0 +1,232 @@
+package smtp
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/benj-n/yatogm/internal/clock"
+)
+
+// runConcurrently starts n deliveries for each destination and returns the
+// peak number observed in flight at once across all of them.
+func runConcurrently(l *Limiter, n int, dests ...string) int32 {
+	var inFlight, peak atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < n*len(dests); i++ {
+		wg.Add(1)
+		go func(dest string) {
+			defer wg.Done()
+			release := l.Acquire(dest)
+			defer release()
+			cur := inFlight.Add(1)
+			for {
+				p := peak.Load()
+				if cur <= p || peak.CompareAndSwap(p, cur) {
+					break
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+			inFlight.Add(-1)
+		}(dests[i%len(dests)])
+	}
+	wg.Wait()
+	return peak.Load()
+}
+
+func TestLimiterPerDestination(t *testing.T) {
+	l := NewLimiter(0)
+	l.SetLimit("me@gmail.com", 2)
+
+	if peak := runConcurrently(l, 10, "me@gmail.com"); peak > 2 {
+		t.Errorf("expected at most 2 concurrent deliveries, saw %d", peak)
+	}
+	if peak := runConcurrently(l, 10, "other@gmail.com"); peak <= 2 {
+		t.Errorf("expected unbounded destination to exceed 2, saw %d", peak)
+	}
+}
+
+func TestLimiterGlobal(t *testing.T) {
+	l := NewLimiter(3)
+
+	if peak := runConcurrently(l, 10, "a@gmail.com", "b@gmail.com"); peak > 3 {
+		t.Errorf("expected at most 3 concurrent deliveries overall, saw %d", peak)
+	}
+}
+
+func TestLimiterReleaseIdempotent(t *testing.T) {
+	l := NewLimiter(1)
+	release := l.Acquire("me@gmail.com")
+	release()
+	release()
+
+	done := make(chan struct{})
+	go func() {
+		r1 := l.Acquire("me@gmail.com")
+		r1()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Acquire blocked after release")
+	}
+}
+
+func TestLimiterThrottleAndRecover(t *testing.T) {
+	l := NewLimiter(0)
+	l.SetLimit("me@gmail.com", 8)
+
+	if limit, _ := l.Throttled("me@gmail.com"); limit != 4 {
+		t.Fatalf("expected limit 4 after throttle, got %d", limit)
+	}
+	if limit, _ := l.Throttled("me@gmail.com"); limit != 2 {
+		t.Fatalf("expected limit 2 after second throttle, got %d", limit)
+	}
+
+	// One round of successes at the current bound raises it by one.
+	l.Succeeded("me@gmail.com")
+	l.Succeeded("me@gmail.com")
+	if got := l.Limit("me@gmail.com"); got != 3 {
+		t.Errorf("expected limit 3 after a round of successes, got %d", got)
+	}
+
+	for i := 0; i < 100; i++ {
+		l.Succeeded("me@gmail.com")
+	}
+	if got := l.Limit("me@gmail.com"); got != 8 {
+		t.Errorf("expected limit restored to 8, got %d", got)
+	}
+}
+
+func TestLimiterUnboundedRecover(t *testing.T) {
+	l := NewLimiter(0)
+	l.SetLimit("me@gmail.com", 0)
+
+	for i := 0; i < 4; i++ {
+		l.Acquire("me@gmail.com")
+	}
+	if limit, _ := l.Throttled("me@gmail.com"); limit != 2 {
+		t.Fatalf("expected limit 2 after throttling 4 deliveries, got %d", limit)
+	}
+
+	// Each round of successes raises the bound by one, and once it is
+	// back to where the throttling happened, it is lifted.
+	l.Succeeded("me@gmail.com")
+	if got := l.Limit("me@gmail.com"); got != 2 {
+		t.Errorf("expected limit 2 before a full round, got %d", got)
+	}
+	l.Succeeded("me@gmail.com")
+	if got := l.Limit("me@gmail.com"); got != 3 {
+		t.Errorf("expected limit 3 after a round of successes, got %d", got)
+	}
+	for i := 0; i < 3; i++ {
+		l.Succeeded("me@gmail.com")
+	}
+	if got := l.Limit("me@gmail.com"); got != 0 {
+		t.Errorf("expected no limit once back at 4, got %d", got)
+	}
+
+	// A bound restored from an earlier run is raised up to twice itself,
+	// what it was halved from at least.
+	l.Restore("me@gmail.com", 3, 0)
+	for limit := 3; limit < 6; limit++ {
+		if got := l.Limit("me@gmail.com"); got != limit {
+			t.Fatalf("expected limit %d, got %d", limit, got)
+		}
+		for i := 0; i < limit; i++ {
+			l.Succeeded("me@gmail.com")
+		}
+	}
+	if got := l.Limit("me@gmail.com"); got != 0 {
+		t.Errorf("expected no limit after recovering from the restored bound, got %d", got)
+	}
+}
+
+func TestLimiterUnboundedRepeatedThrottles(t *testing.T) {
+	l := NewLimiter(0)
+	for i := 0; i < 8; i++ {
+		l.Acquire("me@gmail.com")
+	}
+
+	// Throttled again and again, down to one and a pause.
+	for _, want := range []int{4, 2, 1, 1} {
+		if limit, _ := l.Throttled("me@gmail.com"); limit != want {
+			t.Fatalf("expected limit %d, got %d", want, limit)
+		}
+	}
+	if got := l.Delay("me@gmail.com"); got != minThrottleDelay {
+		t.Fatalf("expected delay %s, got %s", minThrottleDelay, got)
+	}
+
+	// The pause goes first, then the bound climbs one at a time back to
+	// the 8 deliveries that were first throttled, before it is lifted.
+	l.Succeeded("me@gmail.com")
+	if got := l.Delay("me@gmail.com"); got != 0 {
+		t.Fatalf("expected the pause gone, got %s", got)
+	}
+	for limit := 1; limit < 8; limit++ {
+		if got := l.Limit("me@gmail.com"); got != limit {
+			t.Fatalf("expected limit %d, got %d", limit, got)
+		}
+		for i := 0; i < limit; i++ {
+			l.Succeeded("me@gmail.com")
+		}
+	}
+	if got := l.Limit("me@gmail.com"); got != 0 {
+		t.Errorf("expected no limit once back at 8, got %d", got)
+	}
+}
+
+func TestLimiterThrottleDelay(t *testing.T) {
+	l := NewLimiter(0)
+	l.SetLimit("me@gmail.com", 1)
+
+	_, delay := l.Throttled("me@gmail.com")
+	if delay != minThrottleDelay {
+		t.Fatalf("expected delay %s, got %s", minThrottleDelay, delay)
+	}
+	if _, delay = l.Throttled("me@gmail.com"); delay != 2*minThrottleDelay {
+		t.Fatalf("expected delay %s, got %s", 2*minThrottleDelay, delay)
+	}
+
+	l.Succeeded("me@gmail.com")
+	l.Succeeded("me@gmail.com")
+	if got := l.Delay("me@gmail.com"); got != 0 {
+		t.Errorf("expected delay cleared after successes, got %s", got)
+	}
+}
+
+func TestLimiterRestore(t *testing.T) {
+	l := NewLimiter(0)
+	l.SetLimit("me@gmail.com", 4)
+
+	l.Restore("me@gmail.com", 1, 8*time.Second)
+	if got := l.Limit("me@gmail.com"); got != 1 {
+		t.Errorf("expected restored limit 1, got %d", got)
+	}
+	if got := l.Delay("me@gmail.com"); got != 8*time.Second {
+		t.Errorf("expected restored delay 8s, got %s", got)
+	}
+
+	// Deliveries pause for the delay first.
+	clk := clock.NewFake(time.Now())
+	l.SetClock(clk)
+	l.Acquire("me@gmail.com")()
+	if got := clk.Slept(); len(got) != 1 || got[0] != 8*time.Second {
+		t.Errorf("expected a pause of 8s before delivering, got %v", got)
+	}
+
+	// A persisted bound above the configured one is ignored.
+	l.Restore("me@gmail.com", 10, 0)
+	if got := l.Limit("me@gmail.com"); got != 1 {
+		t.Errorf("expected limit to stay 1, got %d", got)
+	}
+
+	// Unbounded destinations accept any persisted bound.
+	l.Restore("other@gmail.com", 2, 0)
+	if got := l.Limit("other@gmail.com"); got != 2 {
+		t.Errorf("expected restored limit 2, got %d", got)
+	}
+}
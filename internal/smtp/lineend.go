@@ -0,0 +1,126 @@
+package smtp
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+)
+
+// maxLineOctets is the longest line RFC 5322 allows, not counting its CRLF.
+const maxLineOctets = 998
+
+// SetNormalizeLineEndings makes every message sent go through a pass that
+// ends each line with CRLF, turning bare LF and bare CR into CRLF, and
+// splits lines longer than 998 octets: header lines are folded, before
+// whitespace where there is some, and body lines are broken. Servers such
+// as Gmail reject messages that break these rules. By default messages are
+// sent as they are.
+func (s *Sender) SetNormalizeLineEndings(on bool) {
+	s.normalize = on
+}
+
+// lineNormalizer is a reader producing the message read from r with line
+// endings normalized and long lines split.
+type lineNormalizer struct {
+	r      *bufio.Reader
+	line   []byte
+	out    bytes.Buffer
+	inBody bool
+	err    error
+}
+
+// normalizeLines returns a reader producing r with every line ended by CRLF
+// and no longer than maxLineOctets.
+func normalizeLines(r io.Reader) io.Reader {
+	return &lineNormalizer{r: bufio.NewReader(r)}
+}
+
+func (n *lineNormalizer) Read(p []byte) (int, error) {
+	for n.out.Len() == 0 && n.err == nil {
+		n.err = n.next()
+	}
+	if n.out.Len() > 0 {
+		return n.out.Read(p)
+	}
+	return 0, n.err
+}
+
+// next reads one line, ended by LF, CR, CRLF, or the end of the message,
+// and queues it for output.
+func (n *lineNormalizer) next() error {
+	n.line = n.line[:0]
+	for {
+		b, err := n.r.ReadByte()
+		if err != nil {
+			// A last line without an ending is left without one.
+			if len(n.line) > 0 {
+				n.emit(false)
+			}
+			return err
+		}
+		switch b {
+		case '\r':
+			if c, err := n.r.Peek(1); err == nil && c[0] == '\n' {
+				_, _ = n.r.ReadByte()
+			}
+			n.emit(true)
+			return nil
+		case '\n':
+			n.emit(true)
+			return nil
+		}
+		n.line = append(n.line, b)
+	}
+}
+
+// emit queues the current line, split into lines of at most maxLineOctets,
+// followed by CRLF if eol is set.
+func (n *lineNormalizer) emit(eol bool) {
+	line := n.line
+	if !n.inBody && len(line) == 0 {
+		n.inBody = true
+	}
+	// Header lines are not folded within the field name.
+	from := 1
+	if i := bytes.IndexByte(line, ':'); i >= 0 && len(line) > 0 && !isSpace(line[0]) {
+		from = i + 2
+	}
+	for len(line) > maxLineOctets {
+		if n.inBody {
+			n.out.Write(line[:maxLineOctets])
+			n.out.WriteString("\r\n")
+			line = line[maxLineOctets:]
+			continue
+		}
+		// Fold the header line before the last whitespace that keeps it
+		// within the limit, or, if there is none, break it and continue
+		// on a line starting with a space.
+		i := splitPoint(line, from)
+		if i < 0 {
+			n.out.Write(line[:maxLineOctets])
+			n.out.WriteString("\r\n")
+			line = append([]byte{' '}, line[maxLineOctets:]...)
+		} else {
+			n.out.Write(line[:i])
+			n.out.WriteString("\r\n")
+			line = line[i:]
+		}
+		from = 1
+	}
+	n.out.Write(line)
+	if eol {
+		n.out.WriteString("\r\n")
+	}
+}
+
+// splitPoint returns the index of the last whitespace, at or after from and
+// following other characters, within the first maxLineOctets+1 bytes of
+// line, or -1 if there is none.
+func splitPoint(line []byte, from int) int {
+	for i := min(maxLineOctets, len(line)-1); i >= max(from, 1); i-- {
+		if isSpace(line[i]) && !isSpace(line[i-1]) {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,97 @@
+package smtp
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeLines(t *testing.T) {
+	long := strings.Repeat("x", 1200)
+	words := strings.Repeat("word ", 250)
+	tests := []struct {
+		name, in, want string
+	}{
+		{"crlf unchanged", "A: 1\r\n\r\nbody\r\n", "A: 1\r\n\r\nbody\r\n"},
+		{"bare lf", "A: 1\n\nbody\nmore\n", "A: 1\r\n\r\nbody\r\nmore\r\n"},
+		{"bare cr", "A: 1\r\rbody\rmore", "A: 1\r\n\r\nbody\r\nmore"},
+		{"mixed", "A: 1\r\n\nx\r\r\ny\n\r", "A: 1\r\n\r\nx\r\n\r\ny\r\n\r\n"},
+		{"long body line", "A: 1\r\n\r\n" + long + "\r\n", "A: 1\r\n\r\n" + long[:998] + "\r\n" + long[998:] + "\r\n"},
+		{"long header folded", "A: " + words + "\r\n\r\n", "A: " + words[:994] + "\r\n" + words[994:] + "\r\n\r\n"},
+		{"long header without space", "A: " + long + "\r\n\r\n", "A: " + long[:995] + "\r\n " + long[995:] + "\r\n\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := io.ReadAll(normalizeLines(strings.NewReader(tt.in)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(out) != tt.want {
+				t.Errorf("normalized %.60q..., want %.60q...", out, tt.want)
+			}
+			checkLines(t, out)
+		})
+	}
+}
+
+func TestNormalizeLineEndings(t *testing.T) {
+	s := NewSender("smtp.gmail.com", 587, "user@gmail.com", "secret", "dest@gmail.com")
+	s.SetForwardMode(ForwardRaw)
+	raw := []byte("From: a@example.com\nSubject: hi\n\nbody\rline\n")
+
+	out, err := buildMessage(s, raw, "me@yahoo.com", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasSuffix(out, raw) {
+		t.Fatalf("expected the message sent as it is by default, got %q", out)
+	}
+
+	s.SetNormalizeLineEndings(true)
+	out, err = buildMessage(s, raw, "me@yahoo.com", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasSuffix(out, []byte("\r\nFrom: a@example.com\r\nSubject: hi\r\n\r\nbody\r\nline\r\n")) {
+		t.Errorf("expected normalized line endings, got %q", out)
+	}
+	checkLines(t, out)
+}
+
+// checkLines fails t unless every line of out ends with CRLF, except
+// perhaps the last, and is at most maxLineOctets long.
+func checkLines(t *testing.T, out []byte) {
+	t.Helper()
+	for i, line := range bytes.Split(out, []byte("\r\n")) {
+		if bytes.ContainsAny(line, "\r\n") {
+			t.Fatalf("line %d has a bare CR or LF: %q", i, line)
+		}
+		if len(line) > maxLineOctets {
+			t.Fatalf("line %d is %d octets long", i, len(line))
+		}
+	}
+}
+
+func FuzzNormalizeLines(f *testing.F) {
+	f.Add([]byte("A: 1\r\n\r\nbody\r\n"))
+	f.Add([]byte("A: 1\n\rB: 2\r\r\n\nbody"))
+	f.Add([]byte("A: " + strings.Repeat("x ", 600) + "\r\n\r\n" + strings.Repeat("y", 2000)))
+
+	f.Fuzz(func(t *testing.T, in []byte) {
+		out, err := io.ReadAll(normalizeLines(bytes.NewReader(in)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkLines(t, out)
+		// Only line breaks, and spaces starting continuation lines, are
+		// added; every other byte is kept in order.
+		strip := func(b []byte) []byte {
+			b = bytes.ReplaceAll(b, []byte("\r"), nil)
+			return bytes.ReplaceAll(b, []byte("\n"), nil)
+		}
+		if got, want := strip(out), strip(in); !bytes.Equal(bytes.ReplaceAll(got, []byte(" "), nil), bytes.ReplaceAll(want, []byte(" "), nil)) {
+			t.Fatalf("content changed: %q became %q", in, out)
+		}
+	})
+}
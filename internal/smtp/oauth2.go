@@ -0,0 +1,157 @@
+package smtp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	netsmtp "net/smtp"
+	"net/textproto"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// tokenExpiryMargin refreshes access tokens slightly before they expire so
+// a token never lapses part-way through an SMTP session.
+const tokenExpiryMargin = time.Minute
+
+// TokenSource obtains OAuth2 access tokens using a refresh token and caches
+// them until shortly before they expire. It is safe for concurrent use.
+type TokenSource struct {
+	clientID     string
+	clientSecret string
+	refreshToken string
+	tokenURL     string
+	httpClient   *http.Client
+
+	mu          sync.Mutex
+	accessToken string
+	expiry      time.Time
+}
+
+// NewTokenSource creates a TokenSource for the given OAuth2 client and
+// refresh token, refreshing access tokens at tokenURL.
+func NewTokenSource(clientID, clientSecret, refreshToken, tokenURL string) *TokenSource {
+	return &TokenSource{
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		refreshToken: refreshToken,
+		tokenURL:     tokenURL,
+		httpClient:   &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Token returns a valid access token, refreshing it if needed.
+func (ts *TokenSource) Token() (string, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.accessToken != "" && time.Now().Add(tokenExpiryMargin).Before(ts.expiry) {
+		return ts.accessToken, nil
+	}
+	if err := ts.refresh(); err != nil {
+		return "", err
+	}
+	return ts.accessToken, nil
+}
+
+// Invalidate discards the cached access token so the next call to Token
+// fetches a fresh one. It is used when the server rejects a token early.
+func (ts *TokenSource) Invalidate() {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.accessToken = ""
+}
+
+// tokenResponse is the token endpoint's JSON reply.
+type tokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	ExpiresIn        int    `json:"expires_in"`
+	RefreshToken     string `json:"refresh_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// refresh exchanges the refresh token for a new access token. The caller
+// must hold ts.mu.
+func (ts *TokenSource) refresh() error {
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"client_id":     {ts.clientID},
+		"client_secret": {ts.clientSecret},
+		"refresh_token": {ts.refreshToken},
+	}
+	resp, err := ts.httpClient.PostForm(ts.tokenURL, form)
+	if err != nil {
+		return fmt.Errorf("oauth2 token refresh: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var tr tokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tr); err != nil {
+		return fmt.Errorf("oauth2 token refresh: decoding response (HTTP %d): %w", resp.StatusCode, err)
+	}
+	if resp.StatusCode != http.StatusOK || tr.AccessToken == "" {
+		msg := tr.Error
+		if tr.ErrorDescription != "" {
+			msg += ": " + tr.ErrorDescription
+		}
+		if msg == "" {
+			msg = "no access token in response"
+		}
+		return fmt.Errorf("oauth2 token refresh: HTTP %d: %s", resp.StatusCode, msg)
+	}
+
+	ts.accessToken = tr.AccessToken
+	ts.expiry = time.Now().Add(time.Duration(tr.ExpiresIn) * time.Second)
+	// Providers may rotate the refresh token; keep using the newest one.
+	if tr.RefreshToken != "" {
+		ts.refreshToken = tr.RefreshToken
+	}
+	return nil
+}
+
+// xoauth2Auth implements the SASL XOAUTH2 mechanism used by Gmail.
+type xoauth2Auth struct {
+	username string
+	token    string
+	host     string
+}
+
+// XOAuth2Auth returns a net/smtp Auth performing SASL XOAUTH2 with the given
+// access token. Like PlainAuth, it refuses to send the token over an
+// unencrypted connection unless the server is on localhost.
+func XOAuth2Auth(username, token, host string) netsmtp.Auth {
+	return &xoauth2Auth{username: username, token: token, host: host}
+}
+
+func (a *xoauth2Auth) Start(server *netsmtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+	resp := "user=" + a.username + "\x01auth=Bearer " + a.token + "\x01\x01"
+	return "XOAUTH2", []byte(resp), nil
+}
+
+func (a *xoauth2Auth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		// On failure the server sends a JSON error challenge and expects an
+		// empty response before replying with the final error code.
+		return []byte{}, nil
+	}
+	return nil, nil
+}
+
+func isLocalhost(name string) bool {
+	return name == "localhost" || name == "127.0.0.1" || name == "::1"
+}
+
+// isAuthError reports whether err is an SMTP authentication failure.
+func isAuthError(err error) bool {
+	var tpErr *textproto.Error
+	return errors.As(err, &tpErr) && (tpErr.Code == 534 || tpErr.Code == 535)
+}
@@ -0,0 +1,94 @@
+package smtp
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	netsmtp "net/smtp"
+	"sync/atomic"
+	"testing"
+)
+
+func TestTokenSourceRefreshAndCache(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("parsing form: %v", err)
+		}
+		if r.Form.Get("grant_type") != "refresh_token" || r.Form.Get("refresh_token") != "rt-1" {
+			t.Errorf("unexpected form: %v", r.Form)
+		}
+		fmt.Fprintf(w, `{"access_token":"at-%d","expires_in":3600}`, calls.Load())
+	}))
+	defer srv.Close()
+
+	ts := NewTokenSource("id", "secret", "rt-1", srv.URL)
+	tok, err := ts.Token()
+	if err != nil {
+		t.Fatalf("Token failed: %v", err)
+	}
+	if tok != "at-1" {
+		t.Errorf("expected at-1, got %s", tok)
+	}
+
+	// A second call is served from the cache.
+	if tok, _ := ts.Token(); tok != "at-1" || calls.Load() != 1 {
+		t.Errorf("expected cached token, got %s after %d calls", tok, calls.Load())
+	}
+
+	ts.Invalidate()
+	if tok, _ := ts.Token(); tok != "at-2" {
+		t.Errorf("expected refreshed token at-2, got %s", tok)
+	}
+}
+
+func TestTokenSourceRotatesRefreshToken(t *testing.T) {
+	var seen []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		seen = append(seen, r.Form.Get("refresh_token"))
+		fmt.Fprint(w, `{"access_token":"at","expires_in":0,"refresh_token":"rt-2"}`)
+	}))
+	defer srv.Close()
+
+	ts := NewTokenSource("id", "secret", "rt-1", srv.URL)
+	_, _ = ts.Token()
+	_, _ = ts.Token() // expires_in 0 forces a second refresh
+	if len(seen) != 2 || seen[0] != "rt-1" || seen[1] != "rt-2" {
+		t.Errorf("expected refresh tokens [rt-1 rt-2], got %v", seen)
+	}
+}
+
+func TestTokenSourceError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"error":"invalid_grant","error_description":"Token has been expired or revoked."}`)
+	}))
+	defer srv.Close()
+
+	_, err := NewTokenSource("id", "secret", "rt", srv.URL).Token()
+	if err == nil {
+		t.Fatal("expected error for invalid grant")
+	}
+}
+
+func TestXOAuth2AuthStart(t *testing.T) {
+	a := XOAuth2Auth("me@gmail.com", "tok", "smtp.gmail.com")
+
+	mech, resp, err := a.Start(&netsmtp.ServerInfo{Name: "smtp.gmail.com", TLS: true})
+	if err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	if mech != "XOAUTH2" {
+		t.Errorf("expected XOAUTH2, got %s", mech)
+	}
+	want := "user=me@gmail.com\x01auth=Bearer tok\x01\x01"
+	if string(resp) != want {
+		t.Errorf("Start response = %q, want %q", resp, want)
+	}
+
+	if _, _, err := a.Start(&netsmtp.ServerInfo{Name: "smtp.gmail.com", TLS: false}); err == nil {
+		t.Error("expected refusal over an unencrypted connection")
+	}
+}
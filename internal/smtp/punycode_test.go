@@ -0,0 +1,33 @@
+package smtp
+
+import "testing"
+
+func TestAsciiDomain(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"example.com", "example.com"},
+		{"bücher.example", "xn--bcher-kva.example"},
+		{"München.de", "xn--mnchen-3ya.de"},
+		{"例子.广告", "xn--fsqu00a.xn--4rr70v"},
+		{"mail.пример.рф", "mail.xn--e1afmkfd.xn--p1ai"},
+	}
+	for _, tt := range tests {
+		if got := asciiDomain(tt.in); got != tt.want {
+			t.Errorf("asciiDomain(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestPunycode(t *testing.T) {
+	// Samples from RFC 3492 section 7.1.
+	tests := []struct{ in, want string }{
+		{"ليهمابتكلموشعربي؟", "egbpdaj6bu4bxfgehfvwxn"},
+		{"他们为什么不说中文", "ihqwcrb4cv8a8dqg056pqjye"},
+		{"3年B組金八先生", "3B-ww4c5e180e575a65lsy2b"},
+		{"Pročprostěnemluvíčesky", "Proprostnemluvesky-uyb24dma41a"},
+	}
+	for _, tt := range tests {
+		if got := punycode(tt.in); got != tt.want {
+			t.Errorf("punycode(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package smtp
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/benj-n/yatogm/internal/clock"
+)
+
+// Rate spaces out deliveries to at most a number of messages and of bytes
+// per minute, with a token bucket for each that holds a minute's worth, so
+// that a large backlog is delivered at a steady pace rather than in a
+// burst. It is safe for concurrent use.
+type Rate struct {
+	mu       sync.Mutex
+	messages bucket
+	bytes    bucket
+	last     time.Time
+	clock    clock.Clock
+}
+
+// bucket is a token bucket refilled at perMinute tokens a minute, up to
+// perMinute. Reservations may take it below zero; the debt is waited off.
+type bucket struct {
+	// perMinute is the rate and capacity; zero means unlimited.
+	perMinute int64
+	tokens    float64
+}
+
+// NewRate returns a Rate allowing messages messages and bytes bytes per
+// minute. Zero means no bound on either.
+func NewRate(messages, bytes int64) *Rate {
+	return &Rate{
+		messages: bucket{perMinute: messages, tokens: float64(messages)},
+		bytes:    bucket{perMinute: bytes, tokens: float64(bytes)},
+		clock:    clock.System,
+	}
+}
+
+// SetClock makes c tell the time and wait instead of the system clock.
+func (r *Rate) SetClock(c clock.Clock) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.clock = c
+	r.last = time.Time{}
+}
+
+// Reserve takes a message of size bytes from the buckets and returns how
+// long to wait before delivering it. A message larger than a minute's
+// worth of bytes waits until the bucket has refilled for it.
+func (r *Rate) Reserve(size int64) time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.clock.Now()
+	if !r.last.IsZero() {
+		elapsed := now.Sub(r.last)
+		r.messages.refill(elapsed)
+		r.bytes.refill(elapsed)
+	}
+	r.last = now
+	return max(r.messages.take(1), r.bytes.take(size))
+}
+
+// Wait reserves a message of size bytes and waits until it may be
+// delivered, or until ctx is done.
+func (r *Rate) Wait(ctx context.Context, size int64) (time.Duration, error) {
+	d := r.Reserve(size)
+	if d <= 0 {
+		return 0, nil
+	}
+	r.mu.Lock()
+	clk := r.clock
+	r.mu.Unlock()
+	select {
+	case <-clk.After(d):
+		return d, nil
+	case <-ctx.Done():
+		return d, ctx.Err()
+	}
+}
+
+// refill adds the tokens earned over elapsed.
+func (b *bucket) refill(elapsed time.Duration) {
+	if b.perMinute == 0 || elapsed <= 0 {
+		return
+	}
+	b.tokens = min(b.tokens+float64(b.perMinute)*elapsed.Minutes(), float64(b.perMinute))
+}
+
+// take removes n tokens and returns how long until the bucket is out of
+// debt.
+func (b *bucket) take(n int64) time.Duration {
+	if b.perMinute == 0 {
+		return 0
+	}
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / float64(b.perMinute) * float64(time.Minute))
+}
@@ -0,0 +1,79 @@
+package smtp
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/benj-n/yatogm/internal/clock"
+)
+
+func TestRateMessages(t *testing.T) {
+	clk := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	r := NewRate(6, 0)
+	r.SetClock(clk)
+
+	// A minute's worth goes at once, then one every ten seconds.
+	for i := 0; i < 6; i++ {
+		if d := r.Reserve(1 << 20); d != 0 {
+			t.Fatalf("message %d: expected no wait, got %v", i, d)
+		}
+	}
+	if d := r.Reserve(1); d != 10*time.Second {
+		t.Errorf("expected a 10s wait, got %v", d)
+	}
+	if d := r.Reserve(1); d != 20*time.Second {
+		t.Errorf("expected a 20s wait behind the previous message, got %v", d)
+	}
+	clk.Advance(time.Hour)
+	if d := r.Reserve(1); d != 0 {
+		t.Errorf("expected the bucket to have refilled, got %v", d)
+	}
+}
+
+func TestRateBytes(t *testing.T) {
+	clk := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	r := NewRate(0, 1000)
+	r.SetClock(clk)
+
+	if d := r.Reserve(600); d != 0 {
+		t.Errorf("expected no wait, got %v", d)
+	}
+	if d := r.Reserve(700); d != 18*time.Second {
+		t.Errorf("expected an 18s wait for the 300 bytes over, got %v", d)
+	}
+	clk.Advance(18 * time.Second)
+	// Larger than a minute's worth: waits for the bucket to refill for it.
+	if d := r.Reserve(2000); d != 2*time.Minute {
+		t.Errorf("expected a 2m wait for an oversized message, got %v", d)
+	}
+}
+
+func TestRateWait(t *testing.T) {
+	clk := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	r := NewRate(1, 0)
+	r.SetClock(clk)
+
+	if d, err := r.Wait(context.Background(), 1); d != 0 || err != nil {
+		t.Fatalf("Wait = %v, %v; expected no wait", d, err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := r.Wait(context.Background(), 1)
+		done <- err
+	}()
+	for clk.Waiting() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	clk.Advance(time.Minute)
+	if err := <-done; err != nil {
+		t.Errorf("Wait failed: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := r.Wait(ctx, 1); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the wait to end with ctx, got %v", err)
+	}
+}
@@ -0,0 +1,107 @@
+package smtp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+	"strings"
+)
+
+// maxLineLength is the length that the lines of header fields written by
+// yatogm are folded to where they can be (RFC 5322 section 2.1.1).
+const maxLineLength = 78
+
+// headerField is a field of an original header block as it was received,
+// with its folding and line endings.
+type headerField struct {
+	// key is the canonical field name, such as "Message-Id".
+	key string
+	raw []byte
+}
+
+// readHeader reads the header block at the start of r and returns its
+// fields in order and the offset of the body after the blank line ending
+// the block. A message without a body ends with its header block.
+func readHeader(r io.Reader) (fields []headerField, bodyStart int64, err error) {
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadBytes('\n')
+		bodyStart += int64(len(line))
+		switch {
+		case err != nil && err != io.EOF:
+			return nil, 0, err
+		case len(line) == 0 || string(line) == "\n" || string(line) == "\r\n":
+			// The blank line ending the block, or the end of the message.
+			return fields, bodyStart, nil
+		case line[0] == ' ' || line[0] == '\t':
+			if len(fields) == 0 {
+				return nil, 0, errors.New("header block starts with a continuation line")
+			}
+			fields[len(fields)-1].raw = append(fields[len(fields)-1].raw, line...)
+		default:
+			name, _, ok := bytes.Cut(line, []byte(":"))
+			if !ok || len(bytes.TrimRight(name, " \t")) == 0 {
+				return nil, 0, fmt.Errorf("malformed header line %q", bytes.TrimRight(line, "\r\n"))
+			}
+			fields = append(fields, headerField{
+				key: textproto.CanonicalMIMEHeaderKey(string(bytes.TrimRight(name, " \t"))),
+				raw: line,
+			})
+		}
+		if err == io.EOF {
+			return fields, bodyStart, nil
+		}
+	}
+}
+
+// fold returns the header field "key: value", folded before whitespace so
+// that its lines stay within maxLineLength where the value allows. Runs
+// without whitespace longer than that are left whole.
+func fold(key, value string) string {
+	line := key + ": " + value
+	if len(line) <= maxLineLength {
+		return line
+	}
+	var b strings.Builder
+	from := len(key) + 2
+	for len(line) > maxLineLength {
+		i := foldPoint(line, from)
+		if i < 0 {
+			break
+		}
+		b.WriteString(line[:i])
+		b.WriteString("\r\n")
+		line, from = line[i:], 1
+	}
+	b.WriteString(line)
+	return b.String()
+}
+
+// foldPoint returns the index of the whitespace in line, at or after from,
+// to fold before: the last one that keeps the line within maxLineLength, or
+// the first one if none does, or -1 if there is none. Only whitespace that
+// follows other characters is considered, so that no line is left blank.
+func foldPoint(line string, from int) int {
+	point := -1
+	for i := max(from, 1); i < len(line); i++ {
+		if !isSpace(line[i]) || isSpace(line[i-1]) {
+			continue
+		}
+		if i > maxLineLength && point >= 0 {
+			break
+		}
+		point = i
+		if i > maxLineLength {
+			break
+		}
+	}
+	return point
+}
+
+// isSpace reports whether c is folding whitespace.
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t'
+}
@@ -0,0 +1,83 @@
+package smtp
+
+import (
+	"bytes"
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+func TestReadHeader(t *testing.T) {
+	block := "received: from a by b;\r\n\tWed, 1 May 2024 14:32:00 +0000\r\n" +
+		"Comments: first\r\n" +
+		"RECEIVED: from c by a; Wed, 1 May 2024 14:31:59 +0000\r\n" +
+		"Comments: second,\r\n  folded\r\n"
+	fields, bodyStart, err := readHeader(strings.NewReader(block + "\r\nbody\r\n"))
+	if err != nil {
+		t.Fatalf("readHeader: %v", err)
+	}
+	if bodyStart != int64(len(block)+2) {
+		t.Errorf("bodyStart = %d, want %d", bodyStart, len(block)+2)
+	}
+	var keys []string
+	var raw strings.Builder
+	for _, f := range fields {
+		keys = append(keys, f.key)
+		raw.Write(f.raw)
+	}
+	if got := strings.Join(keys, ","); got != "Received,Comments,Received,Comments" {
+		t.Errorf("keys = %s", got)
+	}
+	if raw.String() != block {
+		t.Errorf("fields do not reproduce the block:\n%q", raw.String())
+	}
+
+	for _, bad := range []string{" continued\r\n\r\n", "no colon\r\n\r\n"} {
+		if _, _, err := readHeader(strings.NewReader(bad)); err == nil {
+			t.Errorf("%q: expected an error", bad)
+		}
+	}
+}
+
+func TestFold(t *testing.T) {
+	long := strings.Repeat("word ", 40)
+	for _, tc := range []struct{ key, value string }{
+		{"Subject", "short"},
+		{"Subject", long},
+		{"X-Original-To", "a@example.com,  " + long},
+		{"X-Token", strings.Repeat("x", 100) + " tail"},
+		{"X-Token", strings.Repeat("x", 100)},
+	} {
+		got := fold(tc.key, tc.value)
+		lines := strings.Split(got, "\r\n")
+		for i, line := range lines {
+			if i > 0 && (!isSpace(line[0]) || strings.TrimSpace(line) == "") {
+				t.Errorf("%s: bad continuation line %q", tc.key, line)
+			}
+			rest := strings.TrimLeft(strings.TrimPrefix(line, tc.key+": "), " \t")
+			if len(line) > maxLineLength && strings.ContainsAny(rest, " \t") {
+				t.Errorf("%s: line of %d bytes could have been folded: %q", tc.key, len(line), line)
+			}
+		}
+		msg, err := mail.ReadMessage(strings.NewReader(got + "\r\n\r\n"))
+		if err != nil {
+			t.Fatalf("%s: folded field does not parse: %v", tc.key, err)
+		}
+		// Unfolding removes the CRLFs, and gives back the value.
+		if v := msg.Header.Get(tc.key); v != strings.TrimSpace(tc.value) {
+			t.Errorf("%s: unfolded to %q, want %q", tc.key, v, tc.value)
+		}
+	}
+}
+
+func TestRewritePreservesDuplicates(t *testing.T) {
+	s := NewSender("smtp.gmail.com", 587, "user@gmail.com", "secret", "dest@gmail.com")
+	raw := "From: a@example.com\r\nComments: one\r\nsubject: hi\r\ncomments: two,\r\n  folded\r\n\r\nbody\r\n"
+	out, err := buildMessage(s, []byte(raw), "me@yahoo.com", "")
+	if err != nil {
+		t.Fatalf("buildMessage failed: %v", err)
+	}
+	if !bytes.Contains(out, []byte("\r\nComments: one\r\ncomments: two,\r\n  folded\r\n\r\n")) {
+		t.Errorf("duplicate fields not kept in order, casing, and folding:\n%s", out)
+	}
+}
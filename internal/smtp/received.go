@@ -0,0 +1,76 @@
+package smtp
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ReceivedMode selects what happens to the original Received chain in
+// ForwardRewrite mode.
+type ReceivedMode string
+
+const (
+	// ReceivedKeep copies the chain as it is.
+	ReceivedKeep ReceivedMode = "keep"
+	// ReceivedTrim keeps only the oldest hops, those closest to the
+	// original sender, and drops the relays added after them.
+	ReceivedTrim ReceivedMode = "trim"
+	// ReceivedDrop removes the chain.
+	ReceivedDrop ReceivedMode = "drop"
+)
+
+// ReceivedPolicy controls the Received chain of forwarded messages. Unless
+// the chain is kept, it is summarized in an X-YaToGm-Received header.
+type ReceivedPolicy struct {
+	Mode ReceivedMode
+	// Keep is the number of oldest hops kept in ReceivedTrim mode.
+	Keep int
+}
+
+// trimReceived applies p to a Received chain, most recent hop first as in
+// the message, and returns the hops to keep and a summary of the whole
+// chain, or "" when nothing was removed.
+func (p ReceivedPolicy) trimReceived(chain []string) (kept []string, summary string) {
+	keep := len(chain)
+	switch p.Mode {
+	case ReceivedTrim:
+		keep = min(max(p.Keep, 0), len(chain))
+	case ReceivedDrop:
+		keep = 0
+	}
+	if keep == len(chain) {
+		return chain, ""
+	}
+
+	summary = fmt.Sprintf("%d hops, %d removed", len(chain), len(chain)-keep)
+	oldest := chain[len(chain)-1]
+	if from := receivedFrom(oldest); from != "" {
+		summary += "; first hop from " + from
+		if date := receivedDate(oldest); date != "" {
+			summary += " at " + date
+		}
+	}
+	return chain[len(chain)-keep:], summary
+}
+
+// receivedFrom returns the host name of the "from" clause of a Received
+// header value, or "" if it has none.
+func receivedFrom(v string) string {
+	fields := strings.Fields(v)
+	for i := 0; i+1 < len(fields); i++ {
+		if strings.EqualFold(fields[i], "from") {
+			return fields[i+1]
+		}
+	}
+	return ""
+}
+
+// receivedDate returns the date after the final semicolon of a Received
+// header value, or "" if it has none.
+func receivedDate(v string) string {
+	i := strings.LastIndex(v, ";")
+	if i < 0 {
+		return ""
+	}
+	return strings.Join(strings.Fields(v[i+1:]), " ")
+}
@@ -0,0 +1,69 @@
+package smtp
+
+import (
+	"bytes"
+	"net/mail"
+	"testing"
+)
+
+var testChain = []string{
+	"from mta4.yahoo.com by mx1.yahoo.com with SMTP; Wed, 1 May 2024 14:32:00 +0000",
+	"from relay.example.net (relay.example.net [198.51.100.7]) by mta4.yahoo.com; Wed, 1 May 2024 14:31:59 +0000",
+	"from mail.example.com (mail.example.com [203.0.113.5]) by relay.example.net; Wed,\r\n 1 May 2024 14:31:58 +0000",
+}
+
+func TestTrimReceived(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  ReceivedPolicy
+		kept    int
+		summary string
+	}{
+		{"keep", ReceivedPolicy{Mode: ReceivedKeep}, 3, ""},
+		{"zero policy", ReceivedPolicy{}, 3, ""},
+		{"trim", ReceivedPolicy{Mode: ReceivedTrim, Keep: 1}, 1,
+			"3 hops, 2 removed; first hop from mail.example.com at Wed, 1 May 2024 14:31:58 +0000"},
+		{"trim beyond chain", ReceivedPolicy{Mode: ReceivedTrim, Keep: 5}, 3, ""},
+		{"drop", ReceivedPolicy{Mode: ReceivedDrop}, 0,
+			"3 hops, 3 removed; first hop from mail.example.com at Wed, 1 May 2024 14:31:58 +0000"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kept, summary := tt.policy.trimReceived(testChain)
+			if len(kept) != tt.kept {
+				t.Errorf("kept %d hops, want %d", len(kept), tt.kept)
+			}
+			if len(kept) > 0 && kept[len(kept)-1] != testChain[len(testChain)-1] {
+				t.Errorf("oldest hop not kept: %q", kept)
+			}
+			if summary != tt.summary {
+				t.Errorf("summary = %q, want %q", summary, tt.summary)
+			}
+		})
+	}
+}
+
+func TestBuildMessageReceivedPolicy(t *testing.T) {
+	s := NewSender("smtp.gmail.com", 587, "user@gmail.com", "secret", "dest@gmail.com")
+	s.SetReceivedPolicy(ReceivedPolicy{Mode: ReceivedTrim, Keep: 1})
+	var raw bytes.Buffer
+	for _, v := range testChain {
+		raw.WriteString("Received: " + v + "\r\n")
+	}
+	raw.WriteString("From: a@example.com\r\nSubject: hi\r\n\r\nbody\r\n")
+
+	out, err := buildMessage(s, raw.Bytes(), "me@yahoo.com", "")
+	if err != nil {
+		t.Fatalf("buildMessage failed: %v", err)
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("rewritten message does not parse: %v", err)
+	}
+	if got := msg.Header["Received"]; len(got) != 1 || receivedFrom(got[0]) != "mail.example.com" {
+		t.Errorf("Received = %q, want only the first hop", got)
+	}
+	if got := msg.Header.Get("X-YaToGm-Received"); got == "" {
+		t.Error("expected an X-YaToGm-Received summary")
+	}
+}
@@ -0,0 +1,76 @@
+package smtp
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/textproto"
+	"time"
+)
+
+// RetryPolicy controls how a delivery that fails with a temporary error is
+// retried within the same run. The zero value makes a single attempt.
+type RetryPolicy struct {
+	// Attempts is the total number of delivery attempts, including the
+	// first. Values below 2 disable retries.
+	Attempts int
+	// Backoff is the pause before the first retry; it doubles for each
+	// further retry.
+	Backoff time.Duration
+	// MaxBackoff caps the pause. Zero means no cap.
+	MaxBackoff time.Duration
+	// Jitter randomly shortens or lengthens each pause by up to this
+	// fraction of it (0 to 1), so concurrent senders do not retry in step.
+	Jitter float64
+}
+
+// Delay returns the pause before the given retry, counted from 1.
+func (p RetryPolicy) Delay(retry int) time.Duration {
+	return p.delay(retry, jitterSource)
+}
+
+// delay returns the pause before the given retry, counted from 1, where
+// rnd returns a value in [0, 1).
+func (p RetryPolicy) delay(retry int, rnd func() float64) time.Duration {
+	d := p.Backoff
+	for i := 1; i < retry && (p.MaxBackoff == 0 || d < p.MaxBackoff); i++ {
+		d *= 2
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	if p.Jitter > 0 {
+		d += time.Duration((2*rnd() - 1) * p.Jitter * float64(d))
+	}
+	return max(d, 0)
+}
+
+// IsTemporary reports whether err is a failure that may go away on its
+// own: a 4xx SMTP reply, or a network error such as a refused or dropped
+// connection. Permanent 5xx replies and other errors are not temporary.
+func IsTemporary(err error) bool {
+	var tpErr *textproto.Error
+	if errors.As(err, &tpErr) {
+		return tpErr.Code/100 == 4
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// IsPermanent reports whether err is a 5xx SMTP reply, which retrying the
+// same message will not change.
+func IsPermanent(err error) bool {
+	var tpErr *textproto.Error
+	return errors.As(err, &tpErr) && tpErr.Code/100 == 5
+}
+
+// retryable reports whether a failed delivery is retried in place.
+// Throttling responses are not: they are left to the Limiter, which slows
+// down every sender to the destination rather than just this one.
+func retryable(err error) bool {
+	return IsTemporary(err) && !IsThrottled(err)
+}
+
+// jitterSource returns a value in [0, 1) for retry jitter.
+var jitterSource = rand.Float64
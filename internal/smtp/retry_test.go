@@ -0,0 +1,139 @@
+package smtp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benj-n/yatogm/internal/clock"
+)
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := RetryPolicy{Attempts: 6, Backoff: time.Second, MaxBackoff: 5 * time.Second}
+	half := func() float64 { return 0.5 }
+	for retry, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		if got := p.delay(retry+1, half); got != want {
+			t.Errorf("delay(%d) = %s, want %s", retry+1, got, want)
+		}
+	}
+
+	p.Jitter = 0.5
+	if got := p.delay(2, func() float64 { return 0 }); got != time.Second {
+		t.Errorf("delay with lowest jitter = %s, want 1s", got)
+	}
+	if got := p.delay(2, func() float64 { return 0.999 }); got < 2900*time.Millisecond || got > 3*time.Second {
+		t.Errorf("delay with highest jitter = %s, want just under 3s", got)
+	}
+}
+
+func TestIsTemporary(t *testing.T) {
+	tests := []struct {
+		err       error
+		temporary bool
+		permanent bool
+	}{
+		{&textproto.Error{Code: 451, Msg: "4.3.0 Mail server temporarily rejected message."}, true, false},
+		{fmt.Errorf("smtp send: %w", &textproto.Error{Code: 421, Msg: "4.7.0 later"}), true, false},
+		{&textproto.Error{Code: 550, Msg: "5.7.1 Message rejected"}, false, true},
+		{&textproto.Error{Code: 535, Msg: "5.7.8 Username and Password not accepted."}, false, true},
+		{fmt.Errorf("smtp send: %w", &net.OpError{Op: "dial", Err: errors.New("connection refused")}), true, false},
+		{fmt.Errorf("smtp send: %w", io.EOF), true, false},
+		{errors.New("server doesn't support AUTH"), false, false},
+	}
+	for _, tt := range tests {
+		if got := IsTemporary(tt.err); got != tt.temporary {
+			t.Errorf("IsTemporary(%v) = %v, want %v", tt.err, got, tt.temporary)
+		}
+		if got := IsPermanent(tt.err); got != tt.permanent {
+			t.Errorf("IsPermanent(%v) = %v, want %v", tt.err, got, tt.permanent)
+		}
+	}
+}
+
+func TestIsRejected(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{fmt.Errorf("smtp send: %w", &RejectedError{Err: &textproto.Error{Code: 552, Msg: "5.3.4 Message size exceeds fixed limit"}}), true},
+		{&RejectedError{Err: &textproto.Error{Code: 451, Msg: "4.3.0 Mail server temporarily rejected message."}}, true},
+		{&RejectedError{Err: &textproto.Error{Code: 421, Msg: "4.7.0 Try again later"}}, false},
+		{&textproto.Error{Code: 535, Msg: "5.7.8 Username and Password not accepted."}, false},
+		{errors.New("connection refused"), false},
+	}
+	for _, tt := range tests {
+		if got := IsRejected(tt.err); got != tt.want {
+			t.Errorf("IsRejected(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+// closedPort returns a local port with nothing listening on it.
+func closedPort(t *testing.T) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+	return port
+}
+
+func TestSendRetriesTemporaryFailures(t *testing.T) {
+	s := NewSender("127.0.0.1", closedPort(t), "user@gmail.com", "secret", "dest@gmail.com")
+	s.SetRetryPolicy(RetryPolicy{Attempts: 3, Backoff: time.Second})
+	clk := clock.NewFake(time.Now())
+	s.SetClock(clk)
+
+	_, err := s.Notify("subject", "body", "")
+	if err == nil {
+		t.Fatal("expected delivery to a closed port to fail")
+	}
+	if !strings.Contains(err.Error(), "after 3 attempts") {
+		t.Errorf("error does not mention the attempts: %v", err)
+	}
+	if !IsTemporary(err) {
+		t.Errorf("wrapped error is no longer temporary: %v", err)
+	}
+	if slept := clk.Slept(); len(slept) != 2 || slept[0] != time.Second || slept[1] != 2*time.Second {
+		t.Errorf("expected pauses [1s 2s], got %v", slept)
+	}
+}
+
+func TestSendRetryPauseEndsWithContext(t *testing.T) {
+	s := NewSender("127.0.0.1", closedPort(t), "user@gmail.com", "secret", "dest@gmail.com")
+	s.SetRetryPolicy(RetryPolicy{Attempts: 3, Backoff: time.Hour})
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	raw := []byte("Subject: hi\r\n\r\nbody\r\n")
+	start := time.Now()
+	_, err := s.SendContext(ctx, bytes.NewReader(raw), int64(len(raw)), "me@yahoo.com", "")
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the context to end the pause, got %v", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("the pause between attempts outlasted the context, taking %v", d)
+	}
+}
+
+func TestSendWithoutRetryPolicy(t *testing.T) {
+	s := NewSender("127.0.0.1", closedPort(t), "user@gmail.com", "secret", "dest@gmail.com")
+	clk := clock.NewFake(time.Now())
+	s.SetClock(clk)
+
+	if _, err := s.Notify("subject", "body", ""); err == nil || strings.Contains(err.Error(), "attempts") {
+		t.Errorf("expected a single failed attempt, got %v", err)
+	}
+	if len(clk.Slept()) != 0 {
+		t.Errorf("unexpected retry after %v", clk.Slept())
+	}
+}
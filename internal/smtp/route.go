@@ -0,0 +1,139 @@
+package smtp
+
+import (
+	"hash/fnv"
+	"io"
+	"net/mail"
+	"slices"
+	"strings"
+)
+
+// A Router picks the address a message is delivered to from its header.
+type Router interface {
+	Route(h mail.Header) string
+	// Routes reports whether addr is one of the addresses Route picks
+	// from, so that a remembered route to an address since removed is
+	// not followed.
+	Routes(addr string) bool
+}
+
+// ThreadMemory remembers, by message ID, the address the messages from
+// each source mailbox were routed to.
+type ThreadMemory interface {
+	// ThreadRoute returns the address the first of ids that has a
+	// remembered route was routed to.
+	ThreadRoute(source string, ids []string) (string, bool)
+	// RecordThreadRoute remembers that the messages with the given IDs
+	// were routed to the address to.
+	RecordThreadRoute(source string, ids []string, to string)
+}
+
+// ShardKey is what a ShardRouter hashes to pick an address.
+type ShardKey string
+
+const (
+	// ShardBySender sends all messages from one sender to the same address.
+	ShardBySender ShardKey = "sender"
+	// ShardByThread sends all messages of one thread to the same address,
+	// identified by the root of its References, falling back to the sender
+	// for messages without any message IDs.
+	ShardByThread ShardKey = "thread"
+)
+
+// ShardRouter splits messages across addresses deterministically, by
+// rendezvous hashing of the sender or thread: the same key always goes to
+// the same address, and adding or removing an address only moves the keys
+// that went to it.
+type ShardRouter struct {
+	To []string
+	By ShardKey
+}
+
+// Route implements Router.
+func (r ShardRouter) Route(h mail.Header) string {
+	key := shardKey(h, r.By)
+	var (
+		best  string
+		score uint64
+	)
+	for i, to := range r.To {
+		f := fnv.New64a()
+		f.Write([]byte(key))
+		f.Write([]byte{0})
+		f.Write([]byte(strings.ToLower(to)))
+		if s := f.Sum64(); i == 0 || s > score {
+			best, score = to, s
+		}
+	}
+	return best
+}
+
+// Routes implements Router.
+func (r ShardRouter) Routes(addr string) bool {
+	return slices.ContainsFunc(r.To, func(to string) bool {
+		return strings.EqualFold(to, addr)
+	})
+}
+
+// shardKey returns the key a message with header h is sharded by.
+func shardKey(h mail.Header, by ShardKey) string {
+	if by == ShardByThread {
+		for _, name := range []string{"References", "In-Reply-To", "Message-Id"} {
+			if ids := strings.Fields(h.Get(name)); len(ids) > 0 {
+				return ids[0]
+			}
+		}
+	}
+	return strings.ToLower(ExtractEmailAddress(h.Get("From")))
+}
+
+// SetRouters makes messages from the source mailboxes in routers go to the
+// address their router picks, in the envelope and the To or Resent-To
+// header, instead of the Gmail account.
+func (s *Sender) SetRouters(routers map[string]Router) {
+	s.routers = routers
+}
+
+// SetThreadMemory makes routed messages that answer a message routed
+// before, by their In-Reply-To or References headers, go to the same
+// address, so that threads are not split when the router would pick
+// another, such as for a reply from a different sender.
+func (s *Sender) SetThreadMemory(m ThreadMemory) {
+	s.threads = m
+}
+
+// route returns the address the message of size bytes read from msg, from
+// source, is sent to, and the message IDs to remember that route by once
+// it is delivered, if any. Messages whose header cannot be parsed go where
+// recipient sends them.
+func (s *Sender) route(source string, msg io.ReaderAt, size int64) (rcpt string, ids []string) {
+	r, ok := s.routers[source]
+	if !ok {
+		return s.recipient(source), nil
+	}
+	m, err := mail.ReadMessage(io.NewSectionReader(msg, 0, size))
+	if err != nil {
+		return s.recipient(source), nil
+	}
+	rcpt = r.Route(m.Header)
+	if rcpt == "" {
+		return s.recipient(source), nil
+	}
+	if s.threads == nil {
+		return rcpt, nil
+	}
+
+	// The closest parent first: the message answered, then the rest of
+	// the thread from the most recent.
+	parents := strings.Fields(m.Header.Get("In-Reply-To"))
+	refs := strings.Fields(m.Header.Get("References"))
+	slices.Reverse(refs)
+	parents = append(parents, refs...)
+	if to, ok := s.threads.ThreadRoute(source, parents); ok && r.Routes(to) {
+		rcpt = to
+	}
+	if id := strings.Fields(m.Header.Get("Message-Id")); len(id) > 0 {
+		ids = append(ids, id[0])
+	}
+	return rcpt, append(ids, parents...)
+}
@@ -0,0 +1,133 @@
+package smtp
+
+import (
+	"bytes"
+	"fmt"
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+func TestShardRouter(t *testing.T) {
+	to := []string{"ann@example.com", "bob@example.com", "cat@example.com"}
+	r := ShardRouter{To: to, By: ShardBySender}
+	counts := make(map[string]int)
+	for i := 0; i < 300; i++ {
+		h := mail.Header{"From": {fmt.Sprintf("Sender <s%d@example.com>", i)}}
+		got := r.Route(h)
+		if again := r.Route(mail.Header{"From": {fmt.Sprintf("S%d@Example.com", i)}}); again != got {
+			t.Fatalf("sender %d routed to %s and %s", i, got, again)
+		}
+		counts[got]++
+	}
+	for _, addr := range to {
+		if counts[addr] < 50 {
+			t.Errorf("%s got %d of 300 senders", addr, counts[addr])
+		}
+	}
+
+	// Removing an address only moves the senders that went to it.
+	smaller := ShardRouter{To: to[:2], By: ShardBySender}
+	for i := 0; i < 300; i++ {
+		h := mail.Header{"From": {fmt.Sprintf("s%d@example.com", i)}}
+		if before := r.Route(h); before != to[2] && smaller.Route(h) != before {
+			t.Errorf("sender %d moved from %s", i, before)
+		}
+	}
+
+	thread := ShardRouter{To: to, By: ShardByThread}
+	root := mail.Header{"From": {"a@example.com"}, "Message-Id": {"<root@example.com>"}}
+	reply := mail.Header{
+		"From":        {"b@example.com"},
+		"Message-Id":  {"<reply@example.com>"},
+		"In-Reply-To": {"<mid@example.com>"},
+		"References":  {"<root@example.com>\r\n <mid@example.com>"},
+	}
+	if thread.Route(root) != thread.Route(reply) {
+		t.Errorf("thread split: %s and %s", thread.Route(root), thread.Route(reply))
+	}
+}
+
+func TestRouters(t *testing.T) {
+	s := NewSender("smtp.gmail.com", 587, "user@gmail.com", "secret", "dest@gmail.com")
+	s.SetRouters(map[string]Router{"team@yahoo.com": ShardRouter{To: []string{"ann@example.com"}, By: ShardBySender}})
+
+	raw := []byte("From: a@example.com\r\nSubject: hi\r\n\r\nbody\r\n")
+	for _, tc := range []struct{ source, want string }{
+		{"team@yahoo.com", "ann@example.com"},
+		{"me@yahoo.com", "dest@gmail.com"},
+	} {
+		if got, _ := s.route(tc.source, bytes.NewReader(raw), int64(len(raw))); got != tc.want {
+			t.Errorf("route(%s) = %q, want %q", tc.source, got, tc.want)
+		}
+		out, err := buildMessage(s, raw, tc.source, "")
+		if err != nil {
+			t.Fatalf("buildMessage failed: %v", err)
+		}
+		msg, err := mail.ReadMessage(bytes.NewReader(out))
+		if err != nil {
+			t.Fatalf("rewritten message does not parse: %v", err)
+		}
+		if got := msg.Header.Get("To"); got != tc.want {
+			t.Errorf("%s: To = %q, want %q", tc.source, got, tc.want)
+		}
+	}
+}
+
+// memory is a ThreadMemory in a map.
+type memory map[string]string
+
+func (m memory) ThreadRoute(source string, ids []string) (string, bool) {
+	for _, id := range ids {
+		if to, ok := m[source+" "+id]; ok {
+			return to, true
+		}
+	}
+	return "", false
+}
+
+func (m memory) RecordThreadRoute(source string, ids []string, to string) {
+	for _, id := range ids {
+		m[source+" "+id] = to
+	}
+}
+
+func TestThreadMemory(t *testing.T) {
+	to := []string{"ann@example.com", "bob@example.com", "cat@example.com"}
+	router := ShardRouter{To: to, By: ShardBySender}
+	s := NewSender("smtp.gmail.com", 587, "user@gmail.com", "secret", "dest@gmail.com")
+	s.SetRouters(map[string]Router{"team@yahoo.com": router})
+	m := memory{}
+	s.SetThreadMemory(m)
+
+	// Find a replier the router sends elsewhere than the original sender.
+	first := mail.Header{"From": {"alice@example.com"}}
+	var replier string
+	for i := 0; replier == ""; i++ {
+		from := fmt.Sprintf("r%d@example.com", i)
+		if router.Route(mail.Header{"From": {from}}) != router.Route(first) {
+			replier = from
+		}
+	}
+
+	route := func(raw string) (string, []string) {
+		return s.route("team@yahoo.com", strings.NewReader(raw), int64(len(raw)))
+	}
+	rcpt, ids := route("From: alice@example.com\r\nMessage-ID: <root@example.com>\r\n\r\nhi\r\n")
+	if rcpt != router.Route(first) || len(ids) != 1 || ids[0] != "<root@example.com>" {
+		t.Fatalf("route = %q, %q", rcpt, ids)
+	}
+	m.RecordThreadRoute("team@yahoo.com", ids, rcpt)
+
+	reply := "From: " + replier + "\r\nMessage-ID: <reply@example.com>\r\nIn-Reply-To: <root@example.com>\r\n" +
+		"References: <root@example.com>\r\n\r\nre: hi\r\n"
+	if got, ids := route(reply); got != rcpt || len(ids) != 3 {
+		t.Errorf("reply routed to %q (remembered by %q), want %q with its thread", got, ids, rcpt)
+	}
+
+	// A remembered address since removed from the router is not followed.
+	m["team@yahoo.com <root@example.com>"] = "gone@example.com"
+	if got, _ := route(reply); got != router.Route(mail.Header{"From": {replier}}) {
+		t.Errorf("reply routed to %q, want the router's pick", got)
+	}
+}
@@ -3,12 +3,58 @@ package smtp
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
+	"mime"
 	"net"
 	"net/mail"
 	netsmtp "net/smtp"
+	"net/textproto"
 	"strconv"
 	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/benj-n/yatogm/internal/clock"
+	"github.com/benj-n/yatogm/internal/fault"
+	"github.com/benj-n/yatogm/internal/spam"
+)
+
+// The timeouts of a Sender unless SetTimeouts says otherwise.
+const (
+	// DefaultDialTimeout bounds establishing the SMTP connection.
+	DefaultDialTimeout = 30 * time.Second
+	// DefaultCommandTimeout bounds each read from and write to the server.
+	DefaultCommandTimeout = 30 * time.Second
+)
+
+// ForwardMode selects how Send turns a retrieved message into the one
+// delivered to Gmail.
+type ForwardMode string
+
+const (
+	// ForwardRewrite rewrites headers so Gmail filters on the original
+	// sender. It breaks DKIM signatures over the rewritten headers.
+	ForwardRewrite ForwardMode = "rewrite"
+	// ForwardRaw sends the message byte-for-byte, only prepending Resent-*
+	// headers, so original DKIM signatures still verify.
+	ForwardRaw ForwardMode = "raw"
+)
+
+// TLSMode selects how a Sender secures its connection.
+type TLSMode string
+
+const (
+	// TLSStartTLS connects in plain text and upgrades with STARTTLS when
+	// the server offers it, as on port 587.
+	TLSStartTLS TLSMode = "starttls"
+	// TLSImplicit speaks TLS from the start of the connection, as on port
+	// 465.
+	TLSImplicit TLSMode = "implicit"
 )
 
 // Sender handles forwarding emails via SMTP to Gmail.
@@ -18,6 +64,51 @@ type Sender struct {
 	username string
 	password string
 	to       string
+	// tokens, when set, selects XOAUTH2 authentication instead of the
+	// app password.
+	tokens *TokenSource
+	mode   ForwardMode
+	tls    TLSMode
+	// helo is the client hostname announced in EHLO; empty announces
+	// "localhost".
+	helo string
+	// tlsBase, when set, is the TLS configuration the connections start
+	// from.
+	tlsBase *tls.Config
+	retry   RetryPolicy
+	// headers selects the original headers copied in ForwardRewrite mode.
+	headers HeaderPolicy
+	// received controls the original Received chain in ForwardRewrite mode.
+	received ReceivedPolicy
+	// suffixes maps source mailboxes to the plus-address suffix their
+	// messages are sent to.
+	suffixes map[string]string
+	// subjects maps source mailboxes to the template of their Subject in
+	// ForwardRewrite mode.
+	subjects map[string]*template.Template
+	// routers maps source mailboxes to the router picking the address
+	// their messages are sent to.
+	routers map[string]Router
+	// threads remembers where routed threads went.
+	threads ThreadMemory
+	// extra maps source mailboxes to the templates of the headers added to
+	// their messages.
+	extra map[string]map[string]*template.Template
+	// normalize ends every line with CRLF and splits overlong lines.
+	normalize bool
+	// clock dates messages, sets deadlines, and pauses between retries.
+	clock clock.Clock
+	// dialer, when set, opens the connections instead of a net.Dialer.
+	dialer Dialer
+	// dialTimeout bounds connecting, and commandTimeout each read and
+	// write after that.
+	dialTimeout    time.Duration
+	commandTimeout time.Duration
+
+	mu sync.Mutex
+	// idle holds the authenticated connections between deliveries, for
+	// later ones to reuse until Close.
+	idle []*client
 }
 
 // NewSender creates a new SMTP Sender configured for Gmail.
@@ -28,18 +119,186 @@ func NewSender(host string, port int, username, password, to string) *Sender {
 		username: username,
 		password: password,
 		to:       to,
+		mode:     ForwardRewrite,
+		tls:      TLSStartTLS,
+		clock:    clock.System,
+
+		dialTimeout:    DefaultDialTimeout,
+		commandTimeout: DefaultCommandTimeout,
 	}
 }
 
-// Send forwards a raw email message to the configured Gmail account.
-// It parses the original email to extract the From address and rewrites
-// headers so that Gmail's filtering system processes the email correctly.
-func (s *Sender) Send(rawEmail []byte, originalFrom string) error {
-	// Parse the original message to extract headers.
-	msg, err := mail.ReadMessage(bytes.NewReader(rawEmail))
+// NewOAuth2Sender creates a Sender that authenticates with SASL XOAUTH2
+// using access tokens from ts instead of an app password.
+func NewOAuth2Sender(host string, port int, username string, ts *TokenSource, to string) *Sender {
+	s := NewSender(host, port, username, "", to)
+	s.tokens = ts
+	return s
+}
+
+// SetForwardMode selects how messages are forwarded. The default is
+// ForwardRewrite.
+func (s *Sender) SetForwardMode(mode ForwardMode) {
+	s.mode = mode
+}
+
+// SetTLSMode selects how the connection to the server is secured. The
+// default is TLSStartTLS.
+func (s *Sender) SetTLSMode(mode TLSMode) {
+	s.tls = mode
+}
+
+// SetTLSConfig sets the TLS configuration connections to the server
+// start from, such as to trust other roots. The server name defaults to
+// the host connected to. By default the system roots are used with a
+// minimum of TLS 1.2.
+func (s *Sender) SetTLSConfig(c *tls.Config) {
+	s.tlsBase = c
+}
+
+// SetHelloName sets the client hostname announced in EHLO, for relays
+// that check it against the connection's reverse DNS. By default it is
+// "localhost".
+func (s *Sender) SetHelloName(name string) {
+	s.helo = name
+}
+
+// SetHeaderPolicy selects which original headers, beyond those rewritten
+// explicitly, are copied to messages forwarded in ForwardRewrite mode. By
+// default all of them are.
+func (s *Sender) SetHeaderPolicy(p HeaderPolicy) {
+	s.headers = p
+}
+
+// SetReceivedPolicy sets what happens to the original Received chain of
+// messages forwarded in ForwardRewrite mode. By default it is kept.
+func (s *Sender) SetReceivedPolicy(p ReceivedPolicy) {
+	s.received = p
+}
+
+// SetLabelSuffixes makes messages from the source mailboxes in suffixes go
+// to a plus-address of the Gmail account, user+suffix@gmail.com, in the
+// envelope and the To or Resent-To header, so that Gmail filters can label
+// them by source. By default messages go to the account itself.
+func (s *Sender) SetLabelSuffixes(suffixes map[string]string) {
+	s.suffixes = suffixes
+}
+
+// recipient returns the address messages from source are sent to.
+func (s *Sender) recipient(source string) string {
+	suffix := s.suffixes[source]
+	at := strings.LastIndexByte(s.to, '@')
+	if suffix == "" || at < 0 {
+		return s.to
+	}
+	return s.to[:at] + "+" + suffix + s.to[at:]
+}
+
+// SetTimeouts sets how long connecting to the server, including the TLS
+// handshake, may take, and how long each later read from or write to it
+// may. Zero selects the defaults, DefaultDialTimeout and
+// DefaultCommandTimeout.
+func (s *Sender) SetTimeouts(dial, command time.Duration) {
+	if dial <= 0 {
+		dial = DefaultDialTimeout
+	}
+	if command <= 0 {
+		command = DefaultCommandTimeout
+	}
+	s.dialTimeout, s.commandTimeout = dial, command
+}
+
+// Dialer opens the connections to the server. A *net.Dialer is one; tests
+// and embedders may supply their own transport.
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// SetDialer connects with d instead of a net.Dialer, which then also bounds
+// connecting by the dial timeout.
+func (s *Sender) SetDialer(d Dialer) {
+	s.dialer = d
+}
+
+// SetClock makes c date messages, set the connections' deadlines, and
+// pause between retries instead of the system clock. The deadlines are
+// then in c's time, which the transport must keep too.
+func (s *Sender) SetClock(c clock.Clock) {
+	s.clock = c
+}
+
+// SetRetryPolicy sets how deliveries failing with a temporary error are
+// retried. By default each delivery is attempted once.
+func (s *Sender) SetRetryPolicy(p RetryPolicy) {
+	s.retry = p
+}
+
+// Send forwards a message of size bytes read from msg to the configured
+// Gmail account and returns the server's reply to the message data, such as
+// "250 2.0.0 OK 1700000000 x1-2 - gsmtp". The message is streamed, never
+// copied in full, and read again from the start if the delivery is retried.
+// In ForwardRewrite mode, it parses the original email to extract the From
+// address and rewrites headers so that Gmail's filtering system processes
+// the email correctly. A non-empty id is added as the X-YaToGm-ID header
+// (or, in ForwardRaw mode, as the Resent-Message-ID) for correlation.
+func (s *Sender) Send(msg io.ReaderAt, size int64, originalFrom, id string) (reply string, err error) {
+	return s.SendContext(context.Background(), msg, size, originalFrom, id)
+}
+
+// SendContext is like Send, but gives up once ctx is done, without
+// retrying, or when ctx's deadline leaves no time for the next retry.
+func (s *Sender) SendContext(ctx context.Context, msg io.ReaderAt, size int64, originalFrom, id string) (reply string, err error) {
+	rcpt, thread := s.route(originalFrom, msg, size)
+	reply, err = s.send(ctx, rcpt, func() io.Reader {
+		return s.messageReader(msg, size, originalFrom, rcpt, id)
+	})
+	if err == nil && len(thread) > 0 {
+		s.threads.RecordThreadRoute(originalFrom, thread, rcpt)
+	}
+	return reply, err
+}
+
+// messageReader returns a reader producing the message delivered to rcpt.
+func (s *Sender) messageReader(msg io.ReaderAt, size int64, originalFrom, rcpt, id string) io.Reader {
+	h := mail.Header{}
+	if m, err := mail.ReadMessage(io.NewSectionReader(msg, 0, size)); err == nil {
+		h = m.Header
+	}
+	data := s.templateData(originalFrom, id, h, size)
+
+	var r io.Reader
+	if s.mode == ForwardRaw {
+		r = s.resend(io.NewSectionReader(msg, 0, size), data, rcpt, s.clock.Now())
+	} else {
+		r = s.rewrite(msg, size, data, rcpt)
+	}
+	if s.normalize {
+		r = normalizeLines(r)
+	}
+	return r
+}
+
+// rewrite prepends the headers Gmail filters on to the message, followed
+// by the original header block, copied verbatim in its order and folding
+// except for the fields the prepended ones replace, and streams the
+// original body after them. Messages that cannot be parsed are wrapped
+// as-is.
+func (s *Sender) rewrite(raw io.ReaderAt, size int64, data TemplateData, rcpt string) io.Reader {
+	originalFrom, id := data.Mailbox, data.ID
+	// Read the original header block, and parse it to extract values.
+	fields, bodyStart, err := readHeader(io.NewSectionReader(raw, 0, size))
+	var msg *mail.Message
+	if err == nil {
+		var block bytes.Buffer
+		for _, f := range fields {
+			block.Write(f.raw)
+		}
+		block.WriteString("\r\n")
+		msg, err = mail.ReadMessage(&block)
+	}
 	if err != nil {
 		// If we can't parse, send as-is with a wrapper.
-		return s.sendRaw(rawEmail, originalFrom)
+		return s.wrapRaw(io.NewSectionReader(raw, 0, size), data)
 	}
 
 	// Build the forwarded message with proper headers for Gmail filtering.
@@ -47,129 +306,591 @@ func (s *Sender) Send(rawEmail []byte, originalFrom string) error {
 
 	// Preserve important original headers.
 	origFrom := msg.Header.Get("From")
-	origDate := msg.Header.Get("Date")
 	origSubject := msg.Header.Get("Subject")
 	origMessageID := msg.Header.Get("Message-Id")
 	origTo := msg.Header.Get("To")
 	origCc := msg.Header.Get("Cc")
 	origReplyTo := msg.Header.Get("Reply-To")
-	contentType := msg.Header.Get("Content-Type")
-	contentTransferEncoding := msg.Header.Get("Content-Transfer-Encoding")
-	mimeVersion := msg.Header.Get("MIME-Version")
 
 	// Write headers that Gmail will use for filtering.
 	// The "From" must be the authenticated sender (Gmail requirement),
 	// but we embed the original sender in the display name so it's
 	// visible in the inbox (e.g. "Alice via alice@yahoo.com" <you@gmail.com>).
 	if origFrom != "" {
-		fmt.Fprintf(&buf, "From: %s <%s>\r\n", formatOriginalSender(origFrom), s.to)
+		writeHeader(&buf, "From", formatOriginalSender(origFrom)+" <"+s.to+">")
 	} else {
-		fmt.Fprintf(&buf, "From: %s\r\n", s.to)
-	}
-	fmt.Fprintf(&buf, "To: %s\r\n", s.to)
-	if origSubject != "" {
-		if origFrom != "" {
-			fmt.Fprintf(&buf, "Subject: [from: %s] %s\r\n", ExtractEmailAddress(origFrom), origSubject)
-		} else {
-			fmt.Fprintf(&buf, "Subject: %s\r\n", origSubject)
-		}
+		writeHeader(&buf, "From", s.to)
 	}
-	if origDate != "" {
-		fmt.Fprintf(&buf, "Date: %s\r\n", origDate)
+	writeHeader(&buf, "To", rcpt)
+	if subject := s.subject(data, origSubject, origFrom); subject != "" {
+		writeHeader(&buf, "Subject", subject)
 	}
 
 	// Preserve original sender info.
 	if origFrom != "" {
-		fmt.Fprintf(&buf, "X-Original-From: %s\r\n", origFrom)
-		fmt.Fprintf(&buf, "Resent-From: %s\r\n", origFrom)
+		writeHeader(&buf, "X-Original-From", origFrom)
+		writeHeader(&buf, "Resent-From", origFrom)
 	}
 	if origTo != "" {
-		fmt.Fprintf(&buf, "X-Original-To: %s\r\n", origTo)
+		writeHeader(&buf, "X-Original-To", origTo)
 	}
 	if origCc != "" {
-		fmt.Fprintf(&buf, "X-Original-Cc: %s\r\n", origCc)
+		writeHeader(&buf, "X-Original-Cc", origCc)
 	}
 	if origReplyTo != "" {
-		fmt.Fprintf(&buf, "Reply-To: %s\r\n", origReplyTo)
+		writeHeader(&buf, "Reply-To", origReplyTo)
 	} else if origFrom != "" {
-		fmt.Fprintf(&buf, "Reply-To: %s\r\n", origFrom)
+		writeHeader(&buf, "Reply-To", origFrom)
 	}
 	if origMessageID != "" {
-		fmt.Fprintf(&buf, "X-Original-Message-Id: %s\r\n", origMessageID)
+		writeHeader(&buf, "X-Original-Message-Id", origMessageID)
 	}
 
 	// Source identification.
-	fmt.Fprintf(&buf, "X-YaToGm-Source: %s\r\n", originalFrom)
-	fmt.Fprintf(&buf, "X-Mailer: YaToGm/1.0\r\n")
-
-	// MIME headers.
-	if mimeVersion != "" {
-		fmt.Fprintf(&buf, "MIME-Version: %s\r\n", mimeVersion)
+	writeHeader(&buf, "X-YaToGm-Source", originalFrom)
+	if id != "" {
+		writeHeader(&buf, "X-YaToGm-ID", id)
 	}
-	if contentType != "" {
-		fmt.Fprintf(&buf, "Content-Type: %s\r\n", contentType)
+	// The source's spam classification, which the header policy may drop
+	// in its original form.
+	if verdict, ok := spam.Parse(msg.Header); ok {
+		writeHeader(&buf, "X-YaToGm-Spam-Score", verdict.String())
 	}
-	if contentTransferEncoding != "" {
-		fmt.Fprintf(&buf, "Content-Transfer-Encoding: %s\r\n", contentTransferEncoding)
+	writeHeader(&buf, "X-Mailer", "YaToGm/1.0")
+	s.writeExtraHeaders(&buf, data)
+
+	// The Received chain, trimmed in place unless the header policy
+	// decides on it like any other header.
+	chain := msg.Header["Received"]
+	trimmed := s.received.Mode == ReceivedTrim || s.received.Mode == ReceivedDrop
+	removed := 0
+	if trimmed {
+		kept, summary := s.received.trimReceived(chain)
+		removed = len(chain) - len(kept)
+		if summary != "" {
+			writeHeader(&buf, "X-YaToGm-Received", summary)
+		}
 	}
 
-	// Copy any remaining headers that we haven't already handled.
-	handled := map[string]bool{
-		"From": true, "To": true, "Subject": true, "Date": true,
+	// Copy the original header block, but for the fields replaced above
+	// and those the header policy drops. The Date and the MIME headers,
+	// which describe the body, are always copied.
+	replaced := map[string]bool{
+		"From": true, "To": true, "Subject": true,
 		"Message-Id": true, "Cc": true, "Reply-To": true,
-		"Content-Type": true, "Content-Transfer-Encoding": true,
-		"Mime-Version": true,
 	}
-	for key, values := range msg.Header {
-		if handled[key] {
+	for key := range s.extra[originalFrom] {
+		replaced[key] = true
+	}
+	for _, f := range fields {
+		switch {
+		case replaced[f.key]:
+			continue
+		case f.key == "Received" && trimmed:
+			// The most recent hops come first and are the ones removed.
+			if removed > 0 {
+				removed--
+				continue
+			}
+		case f.key == "Date" || f.key == "Content-Type" || f.key == "Content-Transfer-Encoding" || f.key == "Mime-Version":
+		case !s.headers.Copies(f.key):
 			continue
 		}
-		for _, v := range values {
-			fmt.Fprintf(&buf, "%s: %s\r\n", key, v)
+		buf.Write(f.raw)
+		if !bytes.HasSuffix(f.raw, []byte("\n")) {
+			buf.WriteString("\r\n")
 		}
 	}
 
 	// End of headers.
-	fmt.Fprintf(&buf, "\r\n")
+	buf.WriteString("\r\n")
 
-	// Copy the body.
-	body, err := readBody(msg.Body)
-	if err != nil {
-		return fmt.Errorf("reading message body: %w", err)
+	// The body follows unchanged.
+	return io.MultiReader(&buf, io.NewSectionReader(raw, bodyStart, size-bodyStart))
+}
+
+// resend prepends a Resent-* block (RFC 5322 section 3.6.6) and the extra
+// headers of the message data describes to the raw message, resent to
+// rcpt, and leaves everything else untouched.
+func (s *Sender) resend(raw io.Reader, data TemplateData, rcpt string, now time.Time) io.Reader {
+	id := data.ID
+	var buf bytes.Buffer
+	writeHeader(&buf, "Resent-Date", now.Format(time.RFC1123Z))
+	writeHeader(&buf, "Resent-From", s.to)
+	writeHeader(&buf, "Resent-To", rcpt)
+	if id != "" {
+		writeHeader(&buf, "Resent-Message-ID", "<"+id+"@yatogm>")
+	}
+	s.writeExtraHeaders(&buf, data)
+	return io.MultiReader(&buf, raw)
+}
+
+// wrapRaw prepends identification headers to a raw email that could not
+// be parsed.
+func (s *Sender) wrapRaw(raw io.Reader, data TemplateData) io.Reader {
+	var buf bytes.Buffer
+	writeHeader(&buf, "X-YaToGm-Source", data.Mailbox)
+	if data.ID != "" {
+		writeHeader(&buf, "X-YaToGm-ID", data.ID)
 	}
-	buf.Write(body)
+	s.writeExtraHeaders(&buf, data)
+	writeHeader(&buf, "X-YaToGm-Note", "original message could not be parsed")
+	return io.MultiReader(&buf, raw)
+}
 
-	return s.sendBytes(buf.Bytes())
+// Notify sends a short plain-text message from yatogm itself to the
+// configured Gmail account, such as a report about a message that was not
+// forwarded, and returns the server's reply. A non-empty id is added as
+// the X-YaToGm-ID header.
+func (s *Sender) Notify(subject, body, id string) (reply string, err error) {
+	msg := s.notice(subject, body, id, s.clock.Now())
+	return s.send(context.Background(), s.to, func() io.Reader {
+		return bytes.NewReader(msg)
+	})
 }
 
-// sendRaw sends the raw email bytes directly when parsing fails.
-func (s *Sender) sendRaw(rawEmail []byte, originalFrom string) error {
+// notice builds the message sent by Notify.
+func (s *Sender) notice(subject, body, id string, now time.Time) []byte {
 	var buf bytes.Buffer
-	fmt.Fprintf(&buf, "X-YaToGm-Source: %s\r\n", originalFrom)
-	fmt.Fprintf(&buf, "X-YaToGm-Note: original message could not be parsed\r\n")
-	buf.Write(rawEmail)
-	return s.sendBytes(buf.Bytes())
+	writeHeader(&buf, "From", (&mail.Address{Name: "yatogm", Address: s.to}).String())
+	writeHeader(&buf, "To", s.to)
+	writeHeader(&buf, "Subject", mime.QEncoding.Encode("utf-8", sanitizeHeaderValue(subject)))
+	writeHeader(&buf, "Date", now.Format(time.RFC1123Z))
+	if id != "" {
+		writeHeader(&buf, "Message-ID", "<"+id+"@yatogm>")
+		writeHeader(&buf, "X-YaToGm-ID", id)
+	}
+	writeHeader(&buf, "MIME-Version", "1.0")
+	writeHeader(&buf, "Content-Type", "text/plain; charset=utf-8")
+	writeHeader(&buf, "Content-Transfer-Encoding", "8bit")
+	buf.WriteString("\r\n")
+	for _, line := range strings.Split(strings.TrimRight(body, "\n"), "\n") {
+		buf.WriteString(strings.TrimRight(line, "\r"))
+		buf.WriteString("\r\n")
+	}
+	return buf.Bytes()
 }
 
-// sendBytes sends the given email bytes via SMTP.
-func (s *Sender) sendBytes(data []byte) error {
-	addr := net.JoinHostPort(s.host, strconv.Itoa(s.port))
+// send delivers the message produced by open to rcpt via SMTP, over TLS
+// as the TLS mode selects, and returns the server's reply
+// to the data. Temporary failures are retried according to the retry
+// policy, with open called again for each attempt, while ctx allows.
+func (s *Sender) send(ctx context.Context, rcpt string, open func() io.Reader) (string, error) {
+	attempts := max(s.retry.Attempts, 1)
+	for attempt := 1; ; attempt++ {
+		reply, err := s.attempt(ctx, rcpt, open)
+		if err == nil || !retryable(err) || s.expired(ctx) != nil {
+			return reply, err
+		}
+		delay := s.retry.delay(attempt, jitterSource)
+		if deadline, ok := ctx.Deadline(); ok && deadline.Sub(s.clock.Now()) < delay {
+			attempts = attempt
+		}
+		if attempt >= attempts {
+			if attempts > 1 {
+				err = fmt.Errorf("%w (after %d attempts)", err, attempt)
+			}
+			return "", err
+		}
+		if cerr := s.clock.SleepContext(ctx, delay); cerr != nil {
+			return "", fmt.Errorf("%w (%w)", err, context.Cause(ctx))
+		}
+	}
+}
+
+// expired returns why ctx is done, or context.DeadlineExceeded once its
+// deadline has passed by the sender's clock, which a connection can time
+// out at before ctx reports it.
+func (s *Sender) expired(ctx context.Context) error {
+	if ctx.Err() != nil {
+		return context.Cause(ctx)
+	}
+	if d, ok := ctx.Deadline(); ok && !s.clock.Now().Before(d) {
+		return context.DeadlineExceeded
+	}
+	return nil
+}
+
+// attempt makes one delivery attempt, refreshing the OAuth2 access token
+// and trying once more if it was rejected.
+func (s *Sender) attempt(ctx context.Context, rcpt string, open func() io.Reader) (string, error) {
+	reply, err := s.sendOnce(ctx, rcpt, open())
+	if err != nil && s.tokens != nil && isAuthError(err) {
+		// The cached access token may have been revoked or expired early;
+		// fetch a fresh one and try once more.
+		s.tokens.Invalidate()
+		reply, err = s.sendOnce(ctx, rcpt, open())
+	}
+	return reply, err
+}
+
+// sendOnce performs one SMTP transaction, on an idle connection when one
+// still answers, or on a new one. The connection is kept for the next
+// delivery unless it failed.
+func (s *Sender) sendOnce(ctx context.Context, rcpt string, data io.Reader) (string, error) {
+	c, err := s.connection(ctx)
+	if err != nil {
+		return "", s.sendError(ctx, err)
+	}
+
+	reply, err := s.deliver(c.Client, rcpt, data)
+	c.conn.unbind()
+	// After an error reply the session is still usable, and the RSET
+	// before its next use clears the transaction.
+	var tpErr *textproto.Error
+	if err == nil || errors.As(err, &tpErr) {
+		s.release(c)
+	} else {
+		c.Close()
+	}
+	if err != nil {
+		return "", s.sendError(ctx, err)
+	}
+	return reply, nil
+}
+
+// sendError describes the failure of a delivery, and why ctx ended it if
+// it did.
+func (s *Sender) sendError(ctx context.Context, err error) error {
+	if cerr := s.expired(ctx); cerr != nil {
+		return fmt.Errorf("smtp send: %w (%w)", err, cerr)
+	}
+	return fmt.Errorf("smtp send: %w", err)
+}
+
+// connection returns an idle connection that answers RSET, or else a new
+// authenticated one, bound to ctx until the caller unbinds it. Idle
+// connections the server has since closed are dropped.
+func (s *Sender) connection(ctx context.Context) (*client, error) {
+	for {
+		s.mu.Lock()
+		if len(s.idle) == 0 {
+			s.mu.Unlock()
+			break
+		}
+		c := s.idle[len(s.idle)-1]
+		s.idle = s.idle[:len(s.idle)-1]
+		s.mu.Unlock()
+		c.conn.bind(ctx)
+		if err := c.Reset(); err == nil {
+			return c, nil
+		}
+		c.Close()
+	}
+
+	c, err := s.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.login(c.Client); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// release keeps c for a later delivery.
+func (s *Sender) release(c *client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.idle = append(s.idle, c)
+}
 
-	auth := netsmtp.PlainAuth("", s.username, s.password, s.host)
+// Close ends the idle connections kept between deliveries with QUIT. The
+// Sender stays usable; a later delivery connects again.
+func (s *Sender) Close() error {
+	s.mu.Lock()
+	idle := s.idle
+	s.idle = nil
+	s.mu.Unlock()
 
-	err := netsmtp.SendMail(addr, auth, s.to, []string{s.to}, data)
+	var errs []error
+	for _, c := range idle {
+		if err := c.Quit(); err != nil {
+			c.Close()
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Check connects to the server, authenticates, and sends NOOP without
+// delivering anything, to verify the connection settings and credentials.
+func (s *Sender) Check() error {
+	c, err := s.dial(context.Background())
 	if err != nil {
-		return fmt.Errorf("smtp send: %w", err)
+		return fmt.Errorf("smtp check: %w", err)
 	}
+	defer c.Close()
 
+	if err := s.login(c.Client); err != nil {
+		return fmt.Errorf("smtp check: %w", err)
+	}
+	if err := c.Noop(); err != nil {
+		return fmt.Errorf("smtp check: NOOP: %w", err)
+	}
+	if err := c.Quit(); err != nil {
+		return fmt.Errorf("smtp check: %w", err)
+	}
 	return nil
 }
 
-// readBody reads the entire body from a mail.Message.
-func readBody(r interface{ Read([]byte) (int, error) }) ([]byte, error) {
-	var buf bytes.Buffer
-	_, err := buf.ReadFrom(r)
-	return buf.Bytes(), err
+// dial connects to the server, completing the TLS handshake first in
+// TLSImplicit mode, and returns the connection bound to ctx.
+func (s *Sender) dial(ctx context.Context) (*client, error) {
+	addr := net.JoinHostPort(s.host, strconv.Itoa(s.port))
+
+	var d Dialer = &net.Dialer{Timeout: s.dialTimeout}
+	if s.dialer != nil {
+		d = s.dialer
+	}
+	raw, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	cn := newConn(ctx, fault.Conn(raw), s.commandTimeout, s.clock)
+	var conn net.Conn = cn
+	if s.tls == TLSImplicit {
+		// The client must see the *tls.Conn to know the connection is
+		// secure, or PLAIN authentication is refused.
+		tc := tls.Client(conn, s.tlsConfig())
+		hctx, cancel := context.WithTimeout(ctx, s.dialTimeout)
+		err := tc.HandshakeContext(hctx)
+		cancel()
+		if err != nil {
+			cn.unbind()
+			conn.Close()
+			return nil, fmt.Errorf("TLS handshake: %w", err)
+		}
+		conn = tc
+	}
+	c, err := netsmtp.NewClient(conn, s.host)
+	if err != nil {
+		cn.unbind()
+		conn.Close()
+		return nil, err
+	}
+	return &client{Client: c, conn: cn}, nil
+}
+
+// login greets the server, upgrades with STARTTLS in TLSStartTLS mode when
+// the server offers it, and authenticates.
+func (s *Sender) login(c *netsmtp.Client) error {
+	helo := s.helo
+	if helo == "" {
+		helo = "localhost"
+	}
+	if err := c.Hello(helo); err != nil {
+		return err
+	}
+	if ok, _ := c.Extension("STARTTLS"); ok && s.tls != TLSImplicit {
+		if err := c.StartTLS(s.tlsConfig()); err != nil {
+			return err
+		}
+	}
+	if ok, _ := c.Extension("AUTH"); !ok {
+		return errors.New("server doesn't support AUTH")
+	}
+	auth, err := s.auth()
+	if err != nil {
+		return err
+	}
+	return c.Auth(auth)
+}
+
+// deliver runs a single SMTP transaction to rcpt on the authenticated
+// connection c, mirroring net/smtp.SendMail but leaving the connection
+// open, and returns the server's reply to the message data. A message with
+// addresses or headers that are not ASCII is sent with SMTPUTF8 when the
+// server offers it, and downgraded to ASCII otherwise. When the server
+// offers PIPELINING, the envelope is sent in one batch.
+func (s *Sender) deliver(c *netsmtp.Client, rcpt string, data io.Reader) (string, error) {
+	head, body, err := readHeaderBlock(data)
+	if err != nil {
+		return "", err
+	}
+	from := s.to
+	utf8 := needsSMTPUTF8(head, from, rcpt)
+	if ok, _ := c.Extension("SMTPUTF8"); utf8 && !ok {
+		if from, err = asciiAddress(from); err != nil {
+			return "", err
+		}
+		if rcpt, err = asciiAddress(rcpt); err != nil {
+			return "", err
+		}
+		head, utf8 = downgradeHeader(head), false
+	}
+	msg := io.MultiReader(bytes.NewReader(head), body)
+	if ok, _ := c.Extension("PIPELINING"); ok {
+		return pipelineData(c, mailCommand(c, from, utf8), rcpt, msg)
+	}
+	if err := command(c.Text, 250, mailCommand(c, from, utf8)); err != nil {
+		return "", err
+	}
+	if err := c.Rcpt(rcpt); err != nil {
+		return "", err
+	}
+	return sendData(c.Text, msg)
+}
+
+// pipelineData sends the MAIL, RCPT, and DATA commands of a
+// single-recipient envelope together (RFC 2920), then reads their replies
+// in order, so that the envelope costs one round trip instead of three.
+// The transaction fails if either MAIL or RCPT is rejected. A server accepting DATA after a rejection has
+// the connection closed rather than sent the message, which abandons the
+// transaction; the closed connection is dropped before its next use.
+func pipelineData(c *netsmtp.Client, mail, rcpt string, data io.Reader) (string, error) {
+	for _, line := range []string{mail, rcpt} {
+		if strings.ContainsAny(line, "\r\n") {
+			return "", errors.New("smtp: A line must not contain CR or LF")
+		}
+	}
+	text := c.Text
+	id := text.Next()
+	text.StartRequest(id)
+	fmt.Fprintf(text.W, "%s\r\n", mail)
+	fmt.Fprintf(text.W, "RCPT TO:<%s>\r\n", rcpt)
+	text.W.WriteString("DATA\r\n")
+	err := text.W.Flush()
+	text.EndRequest(id)
+	if err != nil {
+		return "", err
+	}
+
+	text.StartResponse(id)
+	defer text.EndResponse(id)
+	var rejected error
+	// MAIL expects 250, and RCPT 250 or 251.
+	for _, expect := range []int{250, 25} {
+		if _, _, err := text.ReadResponse(expect); err != nil {
+			var tpErr *textproto.Error
+			if !errors.As(err, &tpErr) {
+				return "", err
+			}
+			if rejected == nil {
+				rejected = err
+			}
+		}
+	}
+	if _, _, err := text.ReadResponse(354); err != nil {
+		if rejected != nil {
+			return "", rejected
+		}
+		return "", err
+	}
+	if rejected != nil {
+		c.Close()
+		return "", rejected
+	}
+	w := text.DotWriter()
+	if _, err := io.Copy(w, data); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	return dataReply(text)
+}
+
+// mailCommand returns the MAIL command, as net/smtp's Client.Mail sends it,
+// but asking for SMTPUTF8 only when utf8 is set rather than whenever the
+// server offers it.
+func mailCommand(c *netsmtp.Client, from string, utf8 bool) string {
+	cmd := "MAIL FROM:<" + from + ">"
+	if ok, _ := c.Extension("8BITMIME"); ok {
+		cmd += " BODY=8BITMIME"
+	}
+	if utf8 {
+		cmd += " SMTPUTF8"
+	}
+	return cmd
+}
+
+// sendData runs the DATA command. Unlike net/smtp's Client.Data, it keeps
+// the server's final reply, which carries the destination's queue ID.
+func sendData(text *textproto.Conn, data io.Reader) (string, error) {
+	if err := command(text, 354, "DATA"); err != nil {
+		return "", err
+	}
+	w := text.DotWriter()
+	if _, err := io.Copy(w, data); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	return dataReply(text)
+}
+
+// dataReply reads the server's final reply to the message data.
+func dataReply(text *textproto.Conn) (string, error) {
+	code, msg, err := text.ReadResponse(250)
+	var tpErr *textproto.Error
+	if errors.As(err, &tpErr) {
+		return "", &RejectedError{Err: err}
+	}
+	if err != nil {
+		return "", err
+	}
+	return strconv.Itoa(code) + " " + msg, nil
+}
+
+// command sends a command and reads its reply, expecting expectCode.
+func command(text *textproto.Conn, expectCode int, cmd string) error {
+	id, err := text.Cmd("%s", cmd)
+	if err != nil {
+		return err
+	}
+	text.StartResponse(id)
+	defer text.EndResponse(id)
+	_, _, err = text.ReadResponse(expectCode)
+	return err
+}
+
+// writeHeader writes a single header field, folded. Values originate from
+// untrusted messages (and RFC 2047 decoding can yield raw control
+// characters), so any CR or LF is replaced to prevent header injection into
+// the forwarded copy.
+func writeHeader(buf *bytes.Buffer, key, value string) {
+	buf.WriteString(fold(key, sanitizeHeaderValue(value)))
+	buf.WriteString("\r\n")
+}
+
+// sanitizeHeaderValue replaces CR and LF characters with spaces.
+func sanitizeHeaderValue(value string) string {
+	if !strings.ContainsAny(value, "\r\n") {
+		return value
+	}
+	return strings.Map(func(r rune) rune {
+		if r == '\r' || r == '\n' {
+			return ' '
+		}
+		return r
+	}, value)
+}
+
+// tlsConfig returns the TLS configuration for connections to the server.
+func (s *Sender) tlsConfig() *tls.Config {
+	if s.tlsBase == nil {
+		return &tls.Config{ServerName: s.host, MinVersion: tls.VersionTLS12}
+	}
+	c := s.tlsBase.Clone()
+	if c.ServerName == "" {
+		c.ServerName = s.host
+	}
+	return c
+}
+
+// auth returns the SMTP authentication mechanism for this Sender.
+func (s *Sender) auth() (netsmtp.Auth, error) {
+	if s.tokens == nil {
+		return netsmtp.PlainAuth("", s.username, s.password, s.host), nil
+	}
+	token, err := s.tokens.Token()
+	if err != nil {
+		return nil, err
+	}
+	return XOAuth2Auth(s.username, token, s.host), nil
 }
 
 // formatOriginalSender creates a quoted display name from the original From
@@ -182,14 +903,28 @@ func formatOriginalSender(origFrom string) string {
 	addr, err := mail.ParseAddress(origFrom)
 	if err != nil {
 		// Can't parse — use the raw value, cleaned up.
-		clean := strings.NewReplacer(`"`, `'`, `\`, ``).Replace(strings.TrimSpace(origFrom))
-		return `"` + clean + `"`
+		return `"` + cleanDisplayName(strings.TrimSpace(origFrom)) + `"`
 	}
 	if addr.Name != "" {
-		name := strings.NewReplacer(`"`, `'`, `\`, ``).Replace(addr.Name)
-		return fmt.Sprintf(`"%s via %s"`, name, addr.Address)
+		return fmt.Sprintf(`"%s via %s"`, cleanDisplayName(addr.Name), cleanDisplayName(addr.Address))
 	}
-	return `"` + addr.Address + `"`
+	return `"` + cleanDisplayName(addr.Address) + `"`
+}
+
+// cleanDisplayName makes s safe to embed in a quoted display name: quotes
+// and backslashes are neutralised, control characters dropped, and invalid
+// UTF-8 replaced so the resulting From header always parses.
+func cleanDisplayName(s string) string {
+	s = strings.ToValidUTF8(s, "\uFFFD")
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r == '"':
+			return '\''
+		case r == '\\', r < 0x20, r == 0x7f:
+			return -1
+		}
+		return r
+	}, s)
 }
 
 // ExtractEmailAddress extracts the bare email address from a From header value
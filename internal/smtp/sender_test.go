@@ -1,7 +1,28 @@
 package smtp
 
 import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"mime"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"slices"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/benj-n/yatogm/internal/clock"
 )
 
 func TestExtractEmailAddress(t *testing.T) {
@@ -57,3 +78,597 @@ func TestNewSender(t *testing.T) {
 		t.Errorf("expected to dest@gmail.com, got %s", s.to)
 	}
 }
+
+// buildMessage returns the message s would deliver for raw.
+func buildMessage(s *Sender, raw []byte, originalFrom, id string) ([]byte, error) {
+	r := bytes.NewReader(raw)
+	rcpt, _ := s.route(originalFrom, r, int64(len(raw)))
+	return io.ReadAll(s.messageReader(r, int64(len(raw)), originalFrom, rcpt, id))
+}
+
+func TestBuildMessageHeaderInjection(t *testing.T) {
+	s := NewSender("smtp.gmail.com", 587, "user@gmail.com", "secret", "dest@gmail.com")
+	raw := []byte("From: =?utf-8?q?Evil=0D=0ABcc=3A_victim=40example=2Ecom?= <evil@example.com>\r\n" +
+		"Subject: hi\r\n\r\nbody\r\n")
+
+	out, err := buildMessage(s, raw, "me@yahoo.com", "")
+	if err != nil {
+		t.Fatalf("buildMessage failed: %v", err)
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("rewritten message does not parse: %v", err)
+	}
+	if got := msg.Header.Get("Bcc"); got != "" {
+		t.Errorf("header injection produced Bcc: %q", got)
+	}
+}
+
+func TestBuildMessageID(t *testing.T) {
+	s := NewSender("smtp.gmail.com", 587, "user@gmail.com", "secret", "dest@gmail.com")
+	const id = "01ARYZ6S41TSV4RRFFQ69G5FAV"
+
+	out, err := buildMessage(s, []byte("From: a@example.com\r\nSubject: hi\r\n\r\nbody\r\n"), "me@yahoo.com", id)
+	if err != nil {
+		t.Fatalf("buildMessage failed: %v", err)
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("rewritten message does not parse: %v", err)
+	}
+	if got := msg.Header.Get("X-YaToGm-ID"); got != id {
+		t.Errorf("X-YaToGm-ID = %q, want %q", got, id)
+	}
+
+	out, err = buildMessage(s, []byte("not a message at all"), "me@yahoo.com", id)
+	if err != nil {
+		t.Fatalf("buildMessage failed: %v", err)
+	}
+	if !bytes.Contains(out, []byte("X-YaToGm-ID: "+id+"\r\n")) {
+		t.Errorf("wrapped message lacks X-YaToGm-ID: %q", out)
+	}
+}
+
+func TestLabelSuffixes(t *testing.T) {
+	s := NewSender("smtp.gmail.com", 587, "user@gmail.com", "secret", "dest@gmail.com")
+	s.SetLabelSuffixes(map[string]string{"shop@yahoo.com": "shopping"})
+	if got := s.recipient("shop@yahoo.com"); got != "dest+shopping@gmail.com" {
+		t.Errorf("recipient(shop@yahoo.com) = %q", got)
+	}
+	if got := s.recipient("me@yahoo.com"); got != "dest@gmail.com" {
+		t.Errorf("recipient(me@yahoo.com) = %q", got)
+	}
+
+	raw := []byte("From: a@example.com\r\nTo: shop@yahoo.com\r\nSubject: hi\r\n\r\nbody\r\n")
+	for _, tc := range []struct {
+		mode   ForwardMode
+		header string
+	}{{ForwardRewrite, "To"}, {ForwardRaw, "Resent-To"}} {
+		s.SetForwardMode(tc.mode)
+		out, err := buildMessage(s, raw, "shop@yahoo.com", "")
+		if err != nil {
+			t.Fatalf("buildMessage failed: %v", err)
+		}
+		msg, err := mail.ReadMessage(bytes.NewReader(out))
+		if err != nil {
+			t.Fatalf("message does not parse: %v", err)
+		}
+		if got := msg.Header.Get(tc.header); got != "dest+shopping@gmail.com" {
+			t.Errorf("%s: %s = %q, want the plus-address", tc.mode, tc.header, got)
+		}
+	}
+}
+
+func TestResend(t *testing.T) {
+	s := NewSender("smtp.gmail.com", 587, "user@gmail.com", "secret", "dest@gmail.com")
+	s.SetForwardMode(ForwardRaw)
+	raw := []byte("DKIM-Signature: v=1; d=example.com; h=from:subject; b=abc\r\n" +
+		"From: a@example.com\r\nSubject: hi\r\n\r\nbody\r\n")
+	now := time.Date(2024, 5, 1, 14, 32, 0, 0, time.UTC)
+
+	out, err := io.ReadAll(s.resend(bytes.NewReader(raw), TemplateData{Mailbox: "me@yahoo.com", ID: "01ARYZ6S41TSV4RRFFQ69G5FAV"}, "dest@gmail.com", now))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasSuffix(out, raw) {
+		t.Fatalf("resent message does not end with the original bytes: %q", out)
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("resent message does not parse: %v", err)
+	}
+	want := map[string]string{
+		"Resent-Date":       "Wed, 01 May 2024 14:32:00 +0000",
+		"Resent-From":       "dest@gmail.com",
+		"Resent-To":         "dest@gmail.com",
+		"Resent-Message-Id": "<01ARYZ6S41TSV4RRFFQ69G5FAV@yatogm>",
+		"From":              "a@example.com",
+	}
+	for k, v := range want {
+		if got := msg.Header.Get(k); got != v {
+			t.Errorf("%s = %q, want %q", k, got, v)
+		}
+	}
+}
+
+func TestNotice(t *testing.T) {
+	s := NewSender("smtp.gmail.com", 587, "user@gmail.com", "secret", "dest@gmail.com")
+	now := time.Date(2024, 5, 1, 14, 32, 0, 0, time.UTC)
+
+	out := s.notice("Skipped: Café menu", "line one\nline two\n", "01ARYZ6S41TSV4RRFFQ69G5FAV", now)
+	msg, err := mail.ReadMessage(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("notice does not parse: %v", err)
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil || subject != "Skipped: Café menu" {
+		t.Errorf("Subject = %q (%v)", subject, err)
+	}
+	if got := msg.Header.Get("To"); got != "dest@gmail.com" {
+		t.Errorf("To = %q", got)
+	}
+	if got := msg.Header.Get("X-YaToGm-ID"); got != "01ARYZ6S41TSV4RRFFQ69G5FAV" {
+		t.Errorf("X-YaToGm-ID = %q", got)
+	}
+	body, _ := io.ReadAll(msg.Body)
+	if string(body) != "line one\r\nline two\r\n" {
+		t.Errorf("body = %q", body)
+	}
+}
+
+func FuzzBuildMessage(f *testing.F) {
+	f.Add([]byte("From: John Doe <john@example.com>\r\nTo: me@yahoo.com\r\nSubject: Hi\r\n\r\nHello\r\n"))
+	f.Add([]byte("Subject: no from\r\n\r\n"))
+	f.Add([]byte("From: =?utf-8?b?SGk=?= <a@b.c>\r\nX-Folded: one\r\n two\r\n\r\nbody"))
+	f.Add([]byte("not a message at all"))
+	f.Add([]byte(""))
+
+	s := NewSender("smtp.gmail.com", 587, "user@gmail.com", "secret", "dest@gmail.com")
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		out, err := buildMessage(s, raw, "me@yahoo.com", "")
+		if err != nil {
+			return
+		}
+		_, _, herr := readHeader(bytes.NewReader(raw))
+		if _, err := mail.ReadMessage(bytes.NewReader(raw)); err != nil || herr != nil {
+			// Unparseable input is wrapped as-is.
+			if !bytes.HasSuffix(out, raw) {
+				t.Fatalf("wrapped message does not end with the original")
+			}
+			return
+		}
+
+		msg, err := mail.ReadMessage(bytes.NewReader(out))
+		if err != nil {
+			t.Fatalf("rewritten message does not parse: %v\n%q", err, out)
+		}
+		if got := ExtractEmailAddress(msg.Header.Get("From")); got != "dest@gmail.com" {
+			t.Fatalf("rewritten From = %q, want dest@gmail.com", got)
+		}
+		if got := msg.Header.Get("To"); got != "dest@gmail.com" {
+			t.Fatalf("rewritten To = %q, want dest@gmail.com", got)
+		}
+	})
+}
+
+func TestIsThrottled(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&textproto.Error{Code: 421, Msg: "4.7.0 Try again later, closing connection."}, true},
+		{&textproto.Error{Code: 450, Msg: "4.2.1 The user you are trying to contact is receiving mail too quickly"}, true},
+		{&textproto.Error{Code: 451, Msg: "4.7.28 unusual rate of unsolicited mail"}, true},
+		{&textproto.Error{Code: 550, Msg: "5.4.5 Daily user sending limit exceeded."}, true},
+		{&textproto.Error{Code: 451, Msg: "4.3.0 Mail server temporarily rejected message."}, false},
+		{&textproto.Error{Code: 535, Msg: "5.7.8 Username and Password not accepted."}, false},
+		{fmt.Errorf("smtp send: %w", &textproto.Error{Code: 421, Msg: "4.7.0 later"}), true},
+		{errors.New("connection refused"), false},
+	}
+
+	for _, tt := range tests {
+		if got := IsThrottled(tt.err); got != tt.want {
+			t.Errorf("IsThrottled(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestIsQuotaExceeded(t *testing.T) {
+	if !IsQuotaExceeded(fmt.Errorf("smtp send: %w", &textproto.Error{Code: 550, Msg: "5.4.5 Daily user sending limit exceeded."})) {
+		t.Error("expected 5.4.5 to be a used-up quota")
+	}
+	if IsQuotaExceeded(&textproto.Error{Code: 421, Msg: "4.7.0 Try again later, closing connection."}) {
+		t.Error("expected 421 to be a throttling response only")
+	}
+}
+
+// checkServer serves one SMTP session on a local port, answering AUTH with
+// authReply, and records the commands it received.
+func checkServer(t *testing.T, authReply string) (port int, commands chan []string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	commands = make(chan []string, 1)
+	go func() {
+		var seen []string
+		defer func() { commands <- seen }()
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		tp := textproto.NewConn(conn)
+		tp.PrintfLine("220 test ESMTP ready")
+		for {
+			line, err := tp.ReadLine()
+			if err != nil {
+				return
+			}
+			verb, _, _ := strings.Cut(line, " ")
+			seen = append(seen, verb)
+			switch verb {
+			case "EHLO":
+				tp.PrintfLine("250-test")
+				tp.PrintfLine("250 AUTH PLAIN")
+			case "AUTH":
+				tp.PrintfLine("%s", authReply)
+			case "NOOP":
+				tp.PrintfLine("250 OK")
+			case "QUIT":
+				tp.PrintfLine("221 bye")
+				return
+			default:
+				tp.PrintfLine("502 command not implemented")
+			}
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr).Port, commands
+}
+
+func TestCheck(t *testing.T) {
+	port, commands := checkServer(t, "235 2.7.0 Accepted")
+	s := NewSender("127.0.0.1", port, "user@gmail.com", "secret", "dest@gmail.com")
+	if err := s.Check(); err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if got := strings.Join(<-commands, " "); got != "EHLO AUTH NOOP QUIT" {
+		t.Errorf("commands = %q, want no delivery", got)
+	}
+
+	port, _ = checkServer(t, "535 5.7.8 Username and Password not accepted.")
+	s = NewSender("127.0.0.1", port, "user@gmail.com", "wrong", "dest@gmail.com")
+	if err := s.Check(); err == nil || !strings.Contains(err.Error(), "535") {
+		t.Errorf("expected an authentication error, got %v", err)
+	}
+}
+
+// dialerFunc is a Dialer calling itself.
+type dialerFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+func (f dialerFunc) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return f(ctx, network, address)
+}
+
+func TestDialer(t *testing.T) {
+	port, commands := checkServer(t, "235 2.7.0 Accepted")
+	// The sender addresses localhost, where PLAIN is allowed in plaintext,
+	// but reaches the test server through the dialer.
+	var dialed []string
+	s := NewSender("localhost", 2525, "user@gmail.com", "secret", "dest@gmail.com")
+	s.SetDialer(dialerFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+		dialed = append(dialed, address)
+		var d net.Dialer
+		return d.DialContext(ctx, network, net.JoinHostPort("127.0.0.1", fmt.Sprint(port)))
+	}))
+	if err := s.Check(); err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if len(dialed) != 1 || dialed[0] != "localhost:2525" {
+		t.Errorf("dialed %q, want the configured server", dialed)
+	}
+	if got := strings.Join(<-commands, " "); got != "EHLO AUTH NOOP QUIT" {
+		t.Errorf("commands = %q", got)
+	}
+}
+
+// recordingConn records what is written to it.
+type recordingConn struct {
+	net.Conn
+	written *bytes.Buffer
+}
+
+func (c recordingConn) Write(b []byte) (int, error) {
+	c.written.Write(b)
+	return c.Conn.Write(b)
+}
+
+func TestHelloName(t *testing.T) {
+	for _, tt := range []struct {
+		name, want string
+	}{
+		{"", "EHLO localhost\r\n"},
+		{"relay.example.com", "EHLO relay.example.com\r\n"},
+	} {
+		port, _ := checkServer(t, "235 2.7.0 Accepted")
+		var written bytes.Buffer
+		s := NewSender("127.0.0.1", port, "user@gmail.com", "secret", "dest@gmail.com")
+		s.SetHelloName(tt.name)
+		s.SetDialer(dialerFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+			var d net.Dialer
+			conn, err := d.DialContext(ctx, network, address)
+			if err != nil {
+				return nil, err
+			}
+			return recordingConn{conn, &written}, nil
+		}))
+		if err := s.Check(); err != nil {
+			t.Fatalf("Check failed: %v", err)
+		}
+		if got, _, _ := strings.Cut(written.String(), "AUTH"); got != tt.want {
+			t.Errorf("SetHelloName(%q): sent %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPipelining(t *testing.T) {
+	raw := []byte("From: a@example.com\r\nSubject: hi\r\n\r\nbody\r\n")
+	port, sessions := deliveryServer(t, "PIPELINING")
+	s := NewSender("127.0.0.1", port, "user@gmail.com", "secret", "dest@gmail.com")
+	s.SetForwardMode(ForwardRaw)
+	s.SetTimeouts(0, 2*time.Second)
+	if _, err := s.Send(bytes.NewReader(raw), int64(len(raw)), "me@yahoo.com", ""); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+
+	// The envelope goes in one batch.
+	c, err := s.connection(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := s.deliver(c.Client, "one@gmail.com", bytes.NewReader(raw))
+	c.conn.unbind()
+	if err != nil || reply != "250 2.0.0 OK queued" {
+		t.Fatalf("deliver = %q, %v", reply, err)
+	}
+	s.release(c)
+
+	// A rejected recipient fails the transaction, and the message is not
+	// sent even though DATA was already in the batch.
+	c, err = s.connection(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.deliver(c.Client, "reject@gmail.com", bytes.NewReader(raw))
+	c.conn.unbind()
+	if err == nil || !strings.Contains(err.Error(), "550") {
+		t.Fatalf("expected the rejection, got %v", err)
+	}
+	c.Close()
+
+	// The data of the failed transaction never reached the server.
+	var envelopes, data []string
+	for _, line := range <-sessions {
+		if strings.HasPrefix(line, "MAIL ") || strings.HasPrefix(line, "RCPT ") {
+			envelopes = append(envelopes, line)
+		} else {
+			data = append(data, line)
+		}
+	}
+	want := []string{
+		"MAIL FROM:<dest@gmail.com>", "RCPT TO:<dest@gmail.com>",
+		"MAIL FROM:<dest@gmail.com>", "RCPT TO:<one@gmail.com>",
+		"MAIL FROM:<dest@gmail.com>", "RCPT TO:<reject@gmail.com>",
+	}
+	if !slices.Equal(envelopes, want) {
+		t.Errorf("server saw %q, want %q", envelopes, want)
+	}
+	if len(data) != 2 {
+		t.Errorf("expected two messages sent, got %q", data)
+	}
+}
+
+// testCert returns a self-signed certificate for 127.0.0.1, and a pool
+// trusting it.
+func testCert(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, roots
+}
+
+func TestImplicitTLS(t *testing.T) {
+	cert, roots := testCert(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln = tls.NewListener(ln, &tls.Config{Certificates: []tls.Certificate{cert}})
+	// STARTTLS is offered, but the connection is already secure; the test
+	// server would refuse it.
+	port, session := serveDelivery(t, ln, "STARTTLS")
+
+	s := NewSender("127.0.0.1", port, "user@gmail.com", "secret", "dest@gmail.com")
+	s.SetTLSMode(TLSImplicit)
+	s.SetTLSConfig(&tls.Config{RootCAs: roots})
+	raw := []byte("From: a@example.com\r\nSubject: hi\r\n\r\nbody\r\n")
+	if _, err := s.Send(bytes.NewReader(raw), int64(len(raw)), "me@yahoo.com", ""); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	s.Close()
+	if seen := <-session; len(seen) != 4 {
+		t.Errorf("expected one delivery, got %q", seen)
+	}
+
+	// An untrusted certificate fails the handshake.
+	ln, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln = tls.NewListener(ln, &tls.Config{Certificates: []tls.Certificate{cert}})
+	port, _ = serveDelivery(t, ln)
+	s = NewSender("127.0.0.1", port, "user@gmail.com", "secret", "dest@gmail.com")
+	s.SetTLSMode(TLSImplicit)
+	if err := s.Check(); err == nil || !strings.Contains(err.Error(), "TLS handshake") {
+		t.Errorf("expected a handshake error, got %v", err)
+	}
+
+	// The certificate is verified against the configured server name, or
+	// not at all.
+	s.SetTLSConfig(&tls.Config{RootCAs: roots, ServerName: "mail.example.com"})
+	if err := s.Check(); err == nil || !strings.Contains(err.Error(), "mail.example.com") {
+		t.Errorf("expected a name mismatch, got %v", err)
+	}
+	s.SetTLSConfig(&tls.Config{InsecureSkipVerify: true})
+	if err := s.Check(); err != nil {
+		t.Errorf("expected the certificate accepted unverified, got %v", err)
+	}
+}
+
+func TestConnectionReuse(t *testing.T) {
+	port, sessions := deliveryServer(t)
+	s := NewSender("127.0.0.1", port, "user@gmail.com", "secret", "dest@gmail.com")
+	send := func() {
+		t.Helper()
+		raw := []byte("From: a@example.com\r\nSubject: hi\r\n\r\nbody\r\n")
+		if _, err := s.Send(bytes.NewReader(raw), int64(len(raw)), "me@yahoo.com", ""); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+	}
+
+	// Both messages go over one connection.
+	send()
+	send()
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if seen := <-sessions; len(seen) != 7 || seen[6] != "QUIT" {
+		t.Fatalf("expected two deliveries and QUIT in one session, got %q", seen)
+	}
+
+	// A connection lost while idle is replaced.
+	send()
+	s.idle[0].Close()
+	send()
+	if seen := <-sessions; len(seen) != 3 {
+		t.Errorf("expected one delivery on the lost connection, got %q", seen)
+	}
+	s.Close()
+	if seen := <-sessions; len(seen) != 4 || seen[3] != "QUIT" {
+		t.Errorf("expected one delivery on a new connection, got %q", seen)
+	}
+}
+
+func TestTimeouts(t *testing.T) {
+	// The server greets, then never answers.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				fmt.Fprintf(conn, "220 test ESMTP ready\r\n")
+				io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+	port := ln.Addr().(*net.TCPAddr).Port
+	raw := []byte("From: a@example.com\r\nSubject: hi\r\n\r\nbody\r\n")
+
+	s := NewSender("127.0.0.1", port, "user@gmail.com", "secret", "dest@gmail.com")
+	s.SetTimeouts(time.Second, 50*time.Millisecond)
+	start := time.Now()
+	var ne net.Error
+	if _, err := s.Send(bytes.NewReader(raw), int64(len(raw)), "me@yahoo.com", ""); !errors.As(err, &ne) || !ne.Timeout() {
+		t.Errorf("expected a timeout, got %v", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("command timeout took %v", d)
+	}
+
+	// A context deadline shorter than the command timeout ends the
+	// delivery, and is not retried.
+	s = NewSender("127.0.0.1", port, "user@gmail.com", "secret", "dest@gmail.com")
+	s.SetRetryPolicy(RetryPolicy{Attempts: 3})
+	clk := clock.NewFake(time.Now())
+	s.SetClock(clk)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	if _, err := s.SendContext(ctx, bytes.NewReader(raw), int64(len(raw)), "me@yahoo.com", ""); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the context deadline, got %v", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("context deadline took %v", d)
+	}
+	if len(clk.Slept()) != 0 {
+		t.Errorf("retried after the context deadline, pausing %v", clk.Slept())
+	}
+}
+
+func TestRewritePreservesHeaderBlock(t *testing.T) {
+	s := NewSender("smtp.gmail.com", 587, "user@gmail.com", "secret", "dest@gmail.com")
+	original := "Received: from mta4.yahoo.com by mx1.yahoo.com;\r\n\tWed, 1 May 2024 14:32:00 +0000\r\n" +
+		"Received: from mail.example.com by mta4.yahoo.com; Wed, 1 May 2024 14:31:59 +0000\r\n" +
+		"DKIM-Signature: v=1; a=rsa-sha256; d=example.com;\r\n  h=from:subject; b=abc\r\n" +
+		"Date: Wed, 1 May 2024 14:31:58 +0000\r\n" +
+		"List-Id: <news.example.com>\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n"
+	raw := "From: a@example.com\r\nSubject: hi\r\n" + original + "\r\nbody\r\n"
+
+	out, err := buildMessage(s, []byte(raw), "me@yahoo.com", "")
+	if err != nil {
+		t.Fatalf("buildMessage failed: %v", err)
+	}
+	header, body, ok := bytes.Cut(out, []byte("\r\n\r\n"))
+	if !ok || string(body) != "body\r\n" {
+		t.Fatalf("unexpected message %q", out)
+	}
+	// The original fields follow the prepended ones in their order and
+	// folding.
+	if !bytes.HasSuffix(header, []byte("\r\n"+strings.TrimSuffix(original, "\r\n"))) {
+		t.Errorf("original header block not copied verbatim:\n%s", header)
+	}
+	if !bytes.HasPrefix(header, []byte("From: ")) || bytes.Count(header, []byte("\r\nSubject: ")) != 1 {
+		t.Errorf("unexpected From or Subject:\n%s", header)
+	}
+
+	// A message made of a header block alone.
+	out, err = buildMessage(s, []byte("From: a@example.com\r\nX-Note: folded\r\n line"), "me@yahoo.com", "")
+	if err != nil {
+		t.Fatalf("buildMessage failed: %v", err)
+	}
+	if !bytes.HasSuffix(out, []byte("X-Note: folded\r\n line\r\n\r\n")) {
+		t.Errorf("unexpected message %q", out)
+	}
+}
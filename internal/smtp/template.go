@@ -0,0 +1,131 @@
+package smtp
+
+import (
+	"io"
+	"mime"
+	"net/mail"
+	"strings"
+	"text/template"
+)
+
+// TemplateData is what subject and header templates are executed with.
+type TemplateData struct {
+	// Mailbox is the source mailbox the message was fetched from.
+	Mailbox string
+	// SourceLabel is the label_suffix of the source mailbox or, if it has
+	// none, the local part of its address.
+	SourceLabel string
+	// Subject is the original subject, with RFC 2047 encoded words
+	// decoded.
+	Subject string
+	// OriginalSubject is the same as Subject.
+	OriginalSubject string
+	// From is the address of the original sender, FromName its display
+	// name, and FromDomain the domain of its address.
+	From       string
+	FromName   string
+	FromDomain string
+	// To is the original To header, decoded.
+	To string
+	// Date is the original Date header.
+	Date string
+	// ID is the yatogm ID of the message, or "".
+	ID string
+	// Size is the size of the original message in bytes.
+	Size int64
+
+	header mail.Header
+}
+
+// Header returns the decoded value of the original header key, or "", as
+// in {{.Header "List-Id"}}.
+func (d TemplateData) Header(key string) string {
+	return decodeHeader(d.header.Get(key))
+}
+
+// decodeHeader decodes the RFC 2047 encoded words in v. With an unknown
+// charset, the encoded words are kept as they are.
+func decodeHeader(v string) string {
+	decoded, err := new(mime.WordDecoder).DecodeHeader(v)
+	if err != nil {
+		return v
+	}
+	return decoded
+}
+
+// ParseTemplate parses a subject or header template, such as
+// "[{{.SourceLabel}}] {{.OriginalSubject}}", and checks that it executes
+// with TemplateData.
+func ParseTemplate(name, text string) (*template.Template, error) {
+	t, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.Execute(io.Discard, TemplateData{}); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// templateData returns the data templates are executed with for the
+// message of size bytes with header h, fetched from source.
+func (s *Sender) templateData(source, id string, h mail.Header, size int64) TemplateData {
+	label := s.suffixes[source]
+	if label == "" {
+		label, _, _ = strings.Cut(source, "@")
+	}
+	subject := decodeHeader(h.Get("Subject"))
+	data := TemplateData{
+		Mailbox:         source,
+		SourceLabel:     label,
+		Subject:         subject,
+		OriginalSubject: subject,
+		To:              decodeHeader(h.Get("To")),
+		Date:            h.Get("Date"),
+		ID:              id,
+		Size:            size,
+		header:          h,
+	}
+	if from := h.Get("From"); from != "" {
+		data.From = ExtractEmailAddress(from)
+		_, data.FromDomain, _ = strings.Cut(data.From, "@")
+		if addr, err := mail.ParseAddress(from); err == nil {
+			data.FromName = addr.Name
+		}
+	}
+	return data
+}
+
+// render executes t with data and returns the result as a single trimmed
+// line, reporting false if t fails.
+func render(t *template.Template, data TemplateData) (string, bool) {
+	var b strings.Builder
+	if err := t.Execute(&b, data); err != nil {
+		return "", false
+	}
+	return strings.TrimSpace(sanitizeHeaderValue(b.String())), true
+}
+
+// SetSubjectTemplates makes messages from the source mailboxes in
+// templates, forwarded in ForwardRewrite mode, get the Subject their
+// template renders instead of "[from: <sender>] <subject>".
+func (s *Sender) SetSubjectTemplates(templates map[string]*template.Template) {
+	s.subjects = templates
+}
+
+// subject returns the Subject header of a message with the given original
+// Subject and From headers, or "" for none.
+func (s *Sender) subject(data TemplateData, origSubject, origFrom string) string {
+	t, ok := s.subjects[data.Mailbox]
+	if !ok {
+		if origSubject == "" || origFrom == "" {
+			return origSubject
+		}
+		return "[from: " + ExtractEmailAddress(origFrom) + "] " + origSubject
+	}
+	subject, ok := render(t, data)
+	if !ok {
+		return origSubject
+	}
+	return mime.QEncoding.Encode("utf-8", subject)
+}
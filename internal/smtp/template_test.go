@@ -0,0 +1,115 @@
+package smtp
+
+import (
+	"bytes"
+	"mime"
+	"net/mail"
+	"testing"
+	"text/template"
+)
+
+func TestSubjectTemplate(t *testing.T) {
+	tmpl, err := ParseTemplate("subject", "[Yahoo:{{.Mailbox}}] {{.Subject}}")
+	if err != nil {
+		t.Fatalf("ParseTemplate: %v", err)
+	}
+	s := NewSender("smtp.gmail.com", 587, "user@gmail.com", "secret", "dest@gmail.com")
+	s.SetSubjectTemplates(map[string]*template.Template{"me@yahoo.com": tmpl})
+
+	for _, tc := range []struct{ source, subject, want string }{
+		{"me@yahoo.com", "Lunch?", "[Yahoo:me@yahoo.com] Lunch?"},
+		{"me@yahoo.com", "=?iso-8859-1?q?Caf=E9?=", "[Yahoo:me@yahoo.com] Café"},
+		{"me@yahoo.com", "", "[Yahoo:me@yahoo.com]"},
+		{"other@yahoo.com", "Lunch?", "[from: a@example.com] Lunch?"},
+	} {
+		raw := "From: Alice <a@example.com>\r\n"
+		if tc.subject != "" {
+			raw += "Subject: " + tc.subject + "\r\n"
+		}
+		out, err := buildMessage(s, []byte(raw+"\r\nbody\r\n"), tc.source, "")
+		if err != nil {
+			t.Fatalf("buildMessage failed: %v", err)
+		}
+		msg, err := mail.ReadMessage(bytes.NewReader(out))
+		if err != nil {
+			t.Fatalf("rewritten message does not parse: %v", err)
+		}
+		got, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+		if err != nil || got != tc.want {
+			t.Errorf("%s %q: Subject = %q (%v), want %q", tc.source, tc.subject, got, err, tc.want)
+		}
+	}
+
+	for _, bad := range []string{"{{.Subject", "{{.Folder}}", `{{.Header 1}}`} {
+		if _, err := ParseTemplate("subject", bad); err == nil {
+			t.Errorf("%q: expected an error", bad)
+		}
+	}
+}
+
+// parseTemplates parses the header templates in h.
+func parseTemplates(t *testing.T, h map[string]string) map[string]*template.Template {
+	t.Helper()
+	parsed := make(map[string]*template.Template, len(h))
+	for k, v := range h {
+		tmpl, err := ParseTemplate(k, v)
+		if err != nil {
+			t.Fatalf("ParseTemplate(%q): %v", v, err)
+		}
+		parsed[k] = tmpl
+	}
+	return parsed
+}
+
+func TestHeaderTemplates(t *testing.T) {
+	s := NewSender("smtp.gmail.com", 587, "user@gmail.com", "secret", "dest@gmail.com")
+	s.SetLabelSuffixes(map[string]string{"me@yahoo.com": "family"})
+	s.SetExtraHeaders(map[string]map[string]*template.Template{
+		"me@yahoo.com": parseTemplates(t, map[string]string{
+			"X-Source":  "{{.SourceLabel}}",
+			"X-Sender":  "{{.FromName}} at {{.FromDomain}}",
+			"X-List":    `{{.Header "List-Id"}}`,
+			"X-Big":     "{{if gt .Size 10000}}yes{{end}}",
+			"X-Details": "{{.To}} {{.Date}} {{.ID}}",
+		}),
+		"other@yahoo.com": parseTemplates(t, map[string]string{"X-Source": "{{.SourceLabel}}"}),
+	})
+	raw := []byte("From: Alice <alice@example.com>\r\nTo: me@yahoo.com\r\n" +
+		"Date: Wed, 01 May 2024 14:32:00 +0000\r\nList-Id: =?utf-8?q?Caf=C3=A9?= <cafe.example.com>\r\n" +
+		"Subject: hi\r\n\r\nbody\r\n")
+
+	for _, mode := range []ForwardMode{ForwardRewrite, ForwardRaw} {
+		s.SetForwardMode(mode)
+		out, err := buildMessage(s, raw, "me@yahoo.com", "01ARYZ6S41TSV4RRFFQ69G5FAV")
+		if err != nil {
+			t.Fatalf("buildMessage failed: %v", err)
+		}
+		msg, err := mail.ReadMessage(bytes.NewReader(out))
+		if err != nil {
+			t.Fatalf("%s: message does not parse: %v", mode, err)
+		}
+		for k, want := range map[string]string{
+			"X-Source":  "family",
+			"X-Sender":  "Alice at example.com",
+			"X-List":    "Café <cafe.example.com>",
+			"X-Details": "me@yahoo.com Wed, 01 May 2024 14:32:00 +0000 01ARYZ6S41TSV4RRFFQ69G5FAV",
+		} {
+			if got, _ := new(mime.WordDecoder).DecodeHeader(msg.Header.Get(k)); got != want {
+				t.Errorf("%s: %s = %q, want %q", mode, k, got, want)
+			}
+		}
+		// A header rendering nothing is left out.
+		if _, ok := msg.Header["X-Big"]; ok {
+			t.Errorf("%s: expected no X-Big header", mode)
+		}
+
+		// Without a label suffix, the label is the mailbox's local part.
+		out, err = buildMessage(s, raw, "other@yahoo.com", "")
+		if err != nil {
+			t.Fatalf("buildMessage failed: %v", err)
+		}
+		if !bytes.Contains(out, []byte("X-Source: other\r\n")) {
+			t.Errorf("%s: expected X-Source: other, got %q", mode, out)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package soak
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// shapes are the kinds of message the generator produces, roughly weighted
+// towards what a real Yahoo inbox contains.
+var shapes = []struct {
+	weight int
+	build  func(rng *rand.Rand, b *bytes.Buffer, id string)
+}{
+	{40, plainMessage},
+	{20, alternativeMessage},
+	{10, attachmentMessage},
+	{10, dotLinesMessage},
+	{8, encodedHeadersMessage},
+	{7, minimalMessage},
+	{5, unparseableMessage},
+}
+
+// generateMessage builds a random message carrying the given soak ID.
+func generateMessage(rng *rand.Rand, id string) []byte {
+	total := 0
+	for _, s := range shapes {
+		total += s.weight
+	}
+	pick := rng.Intn(total)
+	var b bytes.Buffer
+	for _, s := range shapes {
+		if pick < s.weight {
+			s.build(rng, &b, id)
+			break
+		}
+		pick -= s.weight
+	}
+	return b.Bytes()
+}
+
+func commonHeaders(rng *rand.Rand, b *bytes.Buffer, id string) {
+	fmt.Fprintf(b, "Received: from mta%d.example.net by soak.yahoo.test; %s\r\n",
+		rng.Intn(100), time.Unix(1700000000+rng.Int63n(1e7), 0).UTC().Format(time.RFC1123Z))
+	fmt.Fprintf(b, "From: Sender %d <sender%d@example.com>\r\n", rng.Intn(1000), rng.Intn(1000))
+	fmt.Fprintf(b, "To: soak@yahoo.test\r\n")
+	fmt.Fprintf(b, "Date: %s\r\n", time.Unix(1700000000+rng.Int63n(1e7), 0).UTC().Format(time.RFC1123Z))
+	fmt.Fprintf(b, "Message-ID: <%s@soak.test>\r\n", id)
+	fmt.Fprintf(b, "%s: %s\r\n", soakIDHeader, id)
+}
+
+func plainMessage(rng *rand.Rand, b *bytes.Buffer, id string) {
+	commonHeaders(rng, b, id)
+	fmt.Fprintf(b, "Subject: plain message %s\r\n", id)
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	writeParagraphs(rng, b, 1+rng.Intn(20))
+}
+
+func alternativeMessage(rng *rand.Rand, b *bytes.Buffer, id string) {
+	commonHeaders(rng, b, id)
+	fmt.Fprintf(b, "Subject: newsletter %s\r\n", id)
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: multipart/alternative; boundary=\"soakalt\"\r\n\r\n")
+	b.WriteString("--soakalt\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	writeParagraphs(rng, b, 1+rng.Intn(5))
+	b.WriteString("--soakalt\r\nContent-Type: text/html; charset=utf-8\r\n\r\n<html><body>\r\n")
+	writeParagraphs(rng, b, 1+rng.Intn(5))
+	b.WriteString("</body></html>\r\n--soakalt--\r\n")
+}
+
+func attachmentMessage(rng *rand.Rand, b *bytes.Buffer, id string) {
+	commonHeaders(rng, b, id)
+	fmt.Fprintf(b, "Subject: invoice %s\r\n", id)
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: multipart/mixed; boundary=\"soakmix\"\r\n\r\n")
+	b.WriteString("--soakmix\r\nContent-Type: text/plain\r\n\r\nSee attached.\r\n")
+	b.WriteString("--soakmix\r\nContent-Type: application/octet-stream; name=\"blob.bin\"\r\n")
+	b.WriteString("Content-Transfer-Encoding: base64\r\n\r\n")
+	blob := make([]byte, 1024+rng.Intn(256*1024))
+	rng.Read(blob)
+	enc := base64.StdEncoding.EncodeToString(blob)
+	for len(enc) > 76 {
+		b.WriteString(enc[:76])
+		b.WriteString("\r\n")
+		enc = enc[76:]
+	}
+	b.WriteString(enc)
+	b.WriteString("\r\n--soakmix--\r\n")
+}
+
+func dotLinesMessage(rng *rand.Rand, b *bytes.Buffer, id string) {
+	commonHeaders(rng, b, id)
+	fmt.Fprintf(b, "Subject: dots %s\r\n\r\n", id)
+	b.WriteString(".\r\n..\r\n.leading dot\r\n")
+	writeParagraphs(rng, b, 1+rng.Intn(3))
+	b.WriteString(". trailing\r\n")
+}
+
+func encodedHeadersMessage(rng *rand.Rand, b *bytes.Buffer, id string) {
+	commonHeaders(rng, b, id)
+	fmt.Fprintf(b, "Subject: =?utf-8?q?R=C3=A9sum=C3=A9_=E2=9C=93?= %s\r\n", id)
+	b.WriteString("X-Folded: first part\r\n\tsecond part\r\n continued\r\n")
+	fmt.Fprintf(b, "X-Long: %s\r\n\r\n", strings.Repeat("z", 500+rng.Intn(1500)))
+	writeParagraphs(rng, b, 1+rng.Intn(3))
+}
+
+func minimalMessage(rng *rand.Rand, b *bytes.Buffer, id string) {
+	fmt.Fprintf(b, "%s: %s\r\n\r\n", soakIDHeader, id)
+	writeParagraphs(rng, b, rng.Intn(2))
+}
+
+func unparseableMessage(rng *rand.Rand, b *bytes.Buffer, id string) {
+	fmt.Fprintf(b, "%s: %s\r\n", soakIDHeader, id)
+	b.WriteString("this line is not a header and there is no blank line\r\n")
+	writeParagraphs(rng, b, rng.Intn(3))
+}
+
+const words = "lorem ipsum dolor sit amet consectetur adipiscing elit sed do eiusmod tempor"
+
+func writeParagraphs(rng *rand.Rand, b *bytes.Buffer, n int) {
+	vocab := strings.Fields(words)
+	for i := 0; i < n; i++ {
+		width := 0
+		for j := 0; j < 20+rng.Intn(80); j++ {
+			w := vocab[rng.Intn(len(vocab))]
+			if width+len(w) > 72 {
+				b.WriteString("\r\n")
+				width = 0
+			}
+			b.WriteString(w)
+			b.WriteByte(' ')
+			width += len(w) + 1
+		}
+		b.WriteString("\r\n\r\n")
+	}
+}
@@ -0,0 +1,239 @@
+package soak
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// pop3Server is an in-process POP3S server backed by an in-memory maildrop.
+// Deletions are only committed when a session ends with QUIT, as on a real
+// server, so dropped connections leave the maildrop untouched.
+type pop3Server struct {
+	ln net.Listener
+
+	mu        sync.Mutex
+	rng       *rand.Rand
+	failRate  float64
+	maildrop  []*mailItem
+	nextUID   int
+	committed map[string]bool // UIDs removed by a committed DELE
+}
+
+// mailItem is a message stored in the mock maildrop.
+type mailItem struct {
+	uid  string
+	id   string
+	data []byte
+}
+
+func newPOP3Server(tlsConfig *tls.Config, rng *rand.Rand, failRate float64) (*pop3Server, error) {
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	if err != nil {
+		return nil, fmt.Errorf("pop3 listen: %w", err)
+	}
+	s := &pop3Server{
+		ln:        ln,
+		rng:       rng,
+		failRate:  failRate,
+		committed: make(map[string]bool),
+	}
+	go s.serve()
+	return s, nil
+}
+
+func (s *pop3Server) port() int {
+	return s.ln.Addr().(*net.TCPAddr).Port
+}
+
+func (s *pop3Server) close() error {
+	return s.ln.Close()
+}
+
+// deliver adds a message to the maildrop and returns its UID.
+func (s *pop3Server) deliver(id string, data []byte) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextUID++
+	uid := "AOT" + strconv.Itoa(s.nextUID)
+	s.maildrop = append(s.maildrop, &mailItem{uid: uid, id: id, data: data})
+	return uid
+}
+
+// remaining returns the messages still in the maildrop.
+func (s *pop3Server) remaining() []*mailItem {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*mailItem(nil), s.maildrop...)
+}
+
+// wasDeleted reports whether the given UID was removed by a committed DELE.
+func (s *pop3Server) wasDeleted(uid string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.committed[uid]
+}
+
+// fail reports whether a failure should be injected, scaled by factor.
+func (s *pop3Server) fail(factor float64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rng.Float64() < s.failRate*factor
+}
+
+func (s *pop3Server) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *pop3Server) handle(conn net.Conn) {
+	defer conn.Close()
+
+	// Each session sees a snapshot of the maildrop, numbered from 1.
+	s.mu.Lock()
+	snapshot := append([]*mailItem(nil), s.maildrop...)
+	s.mu.Unlock()
+	deleted := make(map[int]bool)
+
+	w := bufio.NewWriter(conn)
+	reply := func(format string, args ...any) {
+		fmt.Fprintf(w, format+"\r\n", args...)
+		w.Flush()
+	}
+	lookup := func(arg string) (int, *mailItem) {
+		n, err := strconv.Atoi(arg)
+		if err != nil || n < 1 || n > len(snapshot) || deleted[n] {
+			return 0, nil
+		}
+		return n, snapshot[n-1]
+	}
+
+	reply("+OK soak POP3 ready")
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd, arg, _ := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+		switch strings.ToUpper(cmd) {
+		case "CAPA":
+			fmt.Fprintf(w, "+OK\r\nUSER\r\nUIDL\r\nTOP\r\nPIPELINING\r\n")
+			reply(".")
+		case "USER", "PASS", "NOOP":
+			reply("+OK")
+		case "STAT":
+			var n, size int
+			for i, m := range snapshot {
+				if !deleted[i+1] {
+					n++
+					size += len(m.data)
+				}
+			}
+			reply("+OK %d %d", n, size)
+		case "UIDL":
+			fmt.Fprintf(w, "+OK\r\n")
+			for i, m := range snapshot {
+				if !deleted[i+1] {
+					fmt.Fprintf(w, "%d %s\r\n", i+1, m.uid)
+				}
+			}
+			reply(".")
+		case "LIST":
+			fmt.Fprintf(w, "+OK\r\n")
+			for i, m := range snapshot {
+				if !deleted[i+1] {
+					fmt.Fprintf(w, "%d %d\r\n", i+1, len(m.data))
+				}
+			}
+			reply(".")
+		case "RETR":
+			_, m := lookup(arg)
+			if m == nil {
+				reply("-ERR no such message")
+				continue
+			}
+			if s.fail(1) {
+				// Drop the connection part-way through the transfer.
+				fmt.Fprintf(w, "+OK\r\n")
+				w.Write(m.data[:len(m.data)/2])
+				w.Flush()
+				return
+			}
+			fmt.Fprintf(w, "+OK %d octets\r\n", len(m.data))
+			writeDotStuffed(w, m.data)
+			reply(".")
+		case "DELE":
+			n, m := lookup(arg)
+			if m == nil {
+				reply("-ERR no such message")
+				continue
+			}
+			deleted[n] = true
+			reply("+OK")
+		case "RSET":
+			deleted = make(map[int]bool)
+			reply("+OK")
+		case "QUIT":
+			if s.fail(0.25) {
+				// Simulate a crash before the deletions are committed.
+				return
+			}
+			s.commit(snapshot, deleted)
+			reply("+OK bye")
+			return
+		default:
+			reply("-ERR unknown command")
+		}
+	}
+}
+
+// commit removes the messages deleted in a session from the maildrop.
+func (s *pop3Server) commit(snapshot []*mailItem, deleted map[int]bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	gone := make(map[string]bool)
+	for n := range deleted {
+		gone[snapshot[n-1].uid] = true
+		s.committed[snapshot[n-1].uid] = true
+	}
+	kept := s.maildrop[:0]
+	for _, m := range s.maildrop {
+		if !gone[m.uid] {
+			kept = append(kept, m)
+		}
+	}
+	s.maildrop = kept
+}
+
+// writeDotStuffed writes data as a POP3 multi-line body, ensuring CRLF
+// line endings and byte-stuffing lines that begin with a dot.
+func writeDotStuffed(w *bufio.Writer, data []byte) {
+	for len(data) > 0 {
+		line := data
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			line, data = data[:i], data[i+1:]
+		} else {
+			data = nil
+		}
+		line = bytes.TrimSuffix(line, []byte("\r"))
+		if len(line) > 0 && line[0] == '.' {
+			w.WriteByte('.')
+		}
+		w.Write(line)
+		w.WriteString("\r\n")
+	}
+}
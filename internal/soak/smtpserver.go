@@ -0,0 +1,154 @@
+package soak
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+)
+
+// soakIDHeader carries the generator's identifier for each message so that
+// deliveries can be matched back to what was put in the maildrop.
+const soakIDHeader = "X-Soak-Id"
+
+// smtpServer is an in-process SMTP server that records every accepted
+// message by its soak ID.
+type smtpServer struct {
+	ln net.Listener
+
+	mu        sync.Mutex
+	rng       *rand.Rand
+	failRate  float64
+	delivered map[string]int
+	unknown   int
+}
+
+func newSMTPServer(rng *rand.Rand, failRate float64) (*smtpServer, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("smtp listen: %w", err)
+	}
+	s := &smtpServer{
+		ln:        ln,
+		rng:       rng,
+		failRate:  failRate,
+		delivered: make(map[string]int),
+	}
+	go s.serve()
+	return s, nil
+}
+
+func (s *smtpServer) port() int {
+	return s.ln.Addr().(*net.TCPAddr).Port
+}
+
+func (s *smtpServer) close() error {
+	return s.ln.Close()
+}
+
+// deliveries returns how many times each soak ID was accepted.
+func (s *smtpServer) deliveries() (counts map[string]int, unknown int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counts = make(map[string]int, len(s.delivered))
+	for id, n := range s.delivered {
+		counts[id] = n
+	}
+	return counts, s.unknown
+}
+
+func (s *smtpServer) fail(factor float64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rng.Float64() < s.failRate*factor
+}
+
+func (s *smtpServer) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *smtpServer) handle(conn net.Conn) {
+	defer conn.Close()
+
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 soak ESMTP ready")
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, _, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO":
+			tp.PrintfLine("250-soak")
+			tp.PrintfLine("250-8BITMIME")
+			tp.PrintfLine("250 AUTH PLAIN")
+		case "HELO":
+			tp.PrintfLine("250 soak")
+		case "AUTH":
+			tp.PrintfLine("235 2.7.0 accepted")
+		case "MAIL", "RCPT", "RSET", "NOOP":
+			tp.PrintfLine("250 OK")
+		case "DATA":
+			tp.PrintfLine("354 go ahead")
+			data, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			if s.fail(1) {
+				tp.PrintfLine("451 4.3.0 temporary failure, try again")
+				continue
+			}
+			s.record(data)
+			if s.fail(0.25) {
+				// Accept the message but lose the reply, so the client
+				// cannot know it was delivered.
+				return
+			}
+			tp.PrintfLine("250 2.0.0 OK queued")
+		case "QUIT":
+			tp.PrintfLine("221 bye")
+			return
+		default:
+			tp.PrintfLine("502 command not implemented")
+		}
+	}
+}
+
+// record notes the delivery of a message body.
+func (s *smtpServer) record(data []byte) {
+	id := findSoakID(data)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if id == "" {
+		s.unknown++
+		return
+	}
+	s.delivered[id]++
+}
+
+// findSoakID scans the message for the soak ID header. A plain line scan is
+// used because some generated messages are deliberately unparseable.
+func findSoakID(data []byte) string {
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	sc.Buffer(make([]byte, 64*1024), len(data)+1)
+	prefix := soakIDHeader + ": "
+	for sc.Scan() {
+		if v, ok := strings.CutPrefix(sc.Text(), prefix); ok {
+			return strings.TrimSpace(v)
+		}
+	}
+	return ""
+}
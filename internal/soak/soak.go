@@ -0,0 +1,299 @@
+// Package soak runs the full fetch-and-forward pipeline against in-process
+// mock POP3 and SMTP servers to shake out duplicates, losses, and state
+// growth before yatogm is pointed at real mail.
+package soak
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	mathrand "math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/benj-n/yatogm/internal/config"
+	"github.com/benj-n/yatogm/internal/invariant"
+	"github.com/benj-n/yatogm/internal/state"
+	"github.com/benj-n/yatogm/internal/worker"
+)
+
+// cycleInterval is the cron interval a soak cycle stands in for.
+const cycleInterval = 15 * time.Minute
+
+// Options controls a soak run.
+type Options struct {
+	// Messages is the total number of messages to push through the pipeline.
+	Messages int
+	// BatchSize is the average number of messages arriving per cycle.
+	BatchSize int
+	// FailureRate is the probability of an injected failure per operation.
+	FailureRate float64
+	// Seed makes a run reproducible.
+	Seed int64
+	// MaxCycles bounds the run; zero picks a limit based on Messages.
+	MaxCycles int
+	// StateDir holds the state file; empty uses a temporary directory.
+	StateDir string
+	// FetchConcurrency, SendConcurrency, and PipelineDepth are passed to the
+	// mailbox configuration; zero uses the defaults.
+	FetchConcurrency int
+	SendConcurrency  int
+	PipelineDepth    int
+	// KeepOnServer disables delete_after_forward for the mailbox.
+	KeepOnServer bool
+}
+
+// Report summarizes a soak run.
+type Report struct {
+	Messages   int
+	Cycles     int
+	RunErrors  int
+	Delivered  int
+	Duplicates int
+	// Lost counts messages deleted from the server but never delivered.
+	Lost int
+	// Pending counts messages still on the server and not yet tracked.
+	Pending int
+	// Stranded counts messages tracked as fetched but never deleted. It is
+	// always zero when messages are kept on the server by design.
+	Stranded int
+	// Unknown counts deliveries whose soak ID could not be found.
+	Unknown int
+	// Receipts counts records in the receipts file.
+	Receipts int
+	// Violations counts the invariant violations the runs reported: a
+	// message delivered again, even after an injected failure, or deleted
+	// before it was recorded as fetched.
+	Violations     int
+	TrackedUIDs    int
+	StateBytes     int64
+	PeakStateBytes int64
+	Elapsed        time.Duration
+}
+
+// OK reports whether the run met the pipeline's guarantees.
+func (r *Report) OK() bool {
+	return r.Lost == 0 && r.Pending == 0
+}
+
+// Write prints the report in a human-readable form.
+func (r *Report) Write(w io.Writer) {
+	simulated := time.Duration(r.Cycles) * cycleInterval
+	fmt.Fprintf(w, "soak: %d messages over %d cycles (~%.1f days at %s intervals) in %s\n",
+		r.Messages, r.Cycles, simulated.Hours()/24, cycleInterval, r.Elapsed.Round(time.Millisecond))
+	fmt.Fprintf(w, "  delivered:   %d\n", r.Delivered)
+	fmt.Fprintf(w, "  duplicates:  %d\n", r.Duplicates)
+	fmt.Fprintf(w, "  lost:        %d\n", r.Lost)
+	fmt.Fprintf(w, "  pending:     %d\n", r.Pending)
+	fmt.Fprintf(w, "  stranded:    %d (tracked but left on the server)\n", r.Stranded)
+	fmt.Fprintf(w, "  unknown:     %d\n", r.Unknown)
+	fmt.Fprintf(w, "  receipts:    %d\n", r.Receipts)
+	fmt.Fprintf(w, "  violations:  %d\n", r.Violations)
+	fmt.Fprintf(w, "  run errors:  %d\n", r.RunErrors)
+	perUID := 0.0
+	if r.TrackedUIDs > 0 {
+		perUID = float64(r.StateBytes) / float64(r.TrackedUIDs)
+	}
+	fmt.Fprintf(w, "  state:       %d UIDs, %d bytes (peak %d, %.1f bytes/UID)\n",
+		r.TrackedUIDs, r.StateBytes, r.PeakStateBytes, perUID)
+}
+
+// Run executes a soak test. Each cycle builds a fresh tracker and worker
+// from the state file, as a cron-spawned process would.
+func Run(opts Options, logger *slog.Logger) (*Report, error) {
+	if opts.Messages <= 0 {
+		return nil, fmt.Errorf("messages must be positive")
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 100
+	}
+	if opts.MaxCycles <= 0 {
+		opts.MaxCycles = 3*(opts.Messages/opts.BatchSize) + 100
+	}
+	if opts.StateDir == "" {
+		dir, err := os.MkdirTemp("", "yatogm-soak-")
+		if err != nil {
+			return nil, fmt.Errorf("creating state directory: %w", err)
+		}
+		defer os.RemoveAll(dir)
+		opts.StateDir = dir
+	}
+	statePath := filepath.Join(opts.StateDir, "state.json")
+
+	serverTLS, clientTLS, err := selfSignedTLS()
+	if err != nil {
+		return nil, err
+	}
+
+	rng := mathrand.New(mathrand.NewSource(opts.Seed))
+	pop, err := newPOP3Server(serverTLS, mathrand.New(mathrand.NewSource(rng.Int63())), opts.FailureRate)
+	if err != nil {
+		return nil, err
+	}
+	defer pop.close()
+	smtp, err := newSMTPServer(mathrand.New(mathrand.NewSource(rng.Int63())), opts.FailureRate)
+	if err != nil {
+		return nil, err
+	}
+	defer smtp.close()
+
+	cfg := &config.Config{
+		Gmail: config.GmailConfig{
+			Email:       "soak@gmail.test",
+			AppPassword: "soak",
+			SMTPHost:    "127.0.0.1",
+			SMTPPort:    smtp.port(),
+		},
+		Yahoo: []config.YahooMailbox{{
+			Email:            "soak@yahoo.test",
+			AppPassword:      "soak",
+			POP3Host:         "127.0.0.1",
+			POP3Port:         pop.port(),
+			FetchConcurrency: opts.FetchConcurrency,
+			SendConcurrency:  opts.SendConcurrency,
+			PipelineDepth:    opts.PipelineDepth,
+		}},
+		StatePath:        statePath,
+		ReceiptsPath:     filepath.Join(opts.StateDir, "receipts.jsonl"),
+		InvariantJournal: filepath.Join(opts.StateDir, "invariants.jsonl"),
+	}
+	if opts.KeepOnServer {
+		keep := false
+		cfg.Yahoo[0].DeleteAfterForward = &keep
+	}
+
+	report := &Report{Messages: opts.Messages}
+	start := time.Now()
+	uids := make(map[string]string) // soak ID -> server UID
+	generated := 0
+
+	for report.Cycles < opts.MaxCycles {
+		report.Cycles++
+
+		// New mail arrives between runs.
+		for n := rng.Intn(2*opts.BatchSize + 1); n > 0 && generated < opts.Messages; n-- {
+			generated++
+			id := "soak-" + strconv.Itoa(generated)
+			uids[id] = pop.deliver(id, generateMessage(rng, id))
+		}
+
+		tracker, err := state.NewTracker(statePath)
+		if err != nil {
+			return nil, fmt.Errorf("cycle %d: %w", report.Cycles, err)
+		}
+		if err := worker.New(cfg, tracker, logger, worker.WithTLSConfig(clientTLS)).Run(); err != nil {
+			report.RunErrors++
+			report.Violations += len(invariant.Violations(err))
+		}
+
+		if fi, err := os.Stat(statePath); err == nil && fi.Size() > report.PeakStateBytes {
+			report.PeakStateBytes = fi.Size()
+		}
+
+		if generated == opts.Messages && countPending(pop, tracker, cfg.Yahoo[0].Email) == 0 {
+			break
+		}
+	}
+	report.Elapsed = time.Since(start)
+
+	tracker, err := state.NewTracker(statePath)
+	if err != nil {
+		return nil, err
+	}
+	mailbox := cfg.Yahoo[0].Email
+	report.TrackedUIDs = tracker.Stats()[mailbox]
+	if fi, err := os.Stat(statePath); err == nil {
+		report.StateBytes = fi.Size()
+	}
+
+	if data, err := os.ReadFile(cfg.ReceiptsPath); err == nil {
+		report.Receipts = bytes.Count(data, []byte("\n"))
+	}
+
+	counts, unknown := smtp.deliveries()
+	report.Unknown = unknown
+	for id, uid := range uids {
+		n := counts[id]
+		if n > 0 {
+			report.Delivered++
+		}
+		if n > 1 {
+			report.Duplicates += n - 1
+		}
+		if n == 0 && pop.wasDeleted(uid) {
+			report.Lost++
+		}
+	}
+	for _, m := range pop.remaining() {
+		if tracker.IsFetched(mailbox, m.uid) {
+			if !opts.KeepOnServer {
+				report.Stranded++
+			}
+		} else {
+			report.Pending++
+		}
+	}
+
+	return report, nil
+}
+
+// countPending returns the number of messages on the server that have not
+// been tracked as fetched.
+func countPending(pop *pop3Server, tracker *state.Tracker, mailbox string) int {
+	n := 0
+	for _, m := range pop.remaining() {
+		if !tracker.IsFetched(mailbox, m.uid) {
+			n++
+		}
+	}
+	return n
+}
+
+// selfSignedTLS creates a throwaway certificate for 127.0.0.1 and returns
+// matching server and client TLS configurations.
+func selfSignedTLS() (server, client *tls.Config, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("generating key: %w", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "yatogm soak"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("creating certificate: %w", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing certificate: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	server = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		MinVersion:   tls.VersionTLS12,
+	}
+	client = &tls.Config{
+		RootCAs:    pool,
+		MinVersion: tls.VersionTLS12,
+	}
+	return server, client, nil
+}
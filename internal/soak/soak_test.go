@@ -0,0 +1,82 @@
+package soak
+
+import (
+	"io"
+	"log/slog"
+	"testing"
+)
+
+func TestRunNoFailures(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	report, err := Run(Options{Messages: 150, BatchSize: 40, Seed: 1, StateDir: t.TempDir()}, logger)
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if report.Delivered != 150 {
+		t.Errorf("expected 150 delivered, got %d", report.Delivered)
+	}
+	if report.Duplicates != 0 || report.Lost != 0 || report.Pending != 0 || report.Stranded != 0 || report.Violations != 0 {
+		t.Errorf("unexpected anomalies: %+v", report)
+	}
+	if report.TrackedUIDs != 150 {
+		t.Errorf("expected 150 tracked UIDs, got %d", report.TrackedUIDs)
+	}
+	if report.Receipts != 150 {
+		t.Errorf("expected 150 receipts, got %d", report.Receipts)
+	}
+}
+
+func TestRunWithFailures(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	report, err := Run(Options{Messages: 150, BatchSize: 40, FailureRate: 0.1, Seed: 2, StateDir: t.TempDir()}, logger)
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if report.Lost != 0 {
+		t.Errorf("expected no lost messages, got %d", report.Lost)
+	}
+	if report.Pending != 0 {
+		t.Errorf("expected no pending messages, got %d", report.Pending)
+	}
+	if report.RunErrors == 0 {
+		t.Error("expected injected failures to surface as run errors")
+	}
+}
+
+func TestRunConcurrent(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	report, err := Run(Options{
+		Messages:         200,
+		BatchSize:        50,
+		FailureRate:      0.05,
+		Seed:             3,
+		StateDir:         t.TempDir(),
+		FetchConcurrency: 2,
+		SendConcurrency:  4,
+		PipelineDepth:    8,
+	}, logger)
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if report.Lost != 0 || report.Pending != 0 {
+		t.Errorf("unexpected anomalies: %+v", report)
+	}
+}
+
+func TestRunKeepOnServer(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	report, err := Run(Options{Messages: 100, BatchSize: 30, FailureRate: 0.05, Seed: 4, StateDir: t.TempDir(), KeepOnServer: true}, logger)
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if report.Lost != 0 || report.Pending != 0 {
+		t.Errorf("unexpected anomalies: %+v", report)
+	}
+	if report.Delivered != 100 {
+		t.Errorf("expected 100 delivered, got %d", report.Delivered)
+	}
+}
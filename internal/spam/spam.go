@@ -0,0 +1,121 @@
+// Package spam reads the spam classification that the source provider or
+// an upstream filter recorded in a message's headers, and normalizes it to
+// a single score.
+package spam
+
+import (
+	"fmt"
+	"net/mail"
+	"strconv"
+	"strings"
+)
+
+// defaultRequired is the SpamAssassin threshold assumed when a score is
+// given without one.
+const defaultRequired = 5.0
+
+// Verdict is a normalized spam classification.
+type Verdict struct {
+	// Score ranges from 0 (clean) to 1 (spam); 0.5 is the source's
+	// threshold.
+	Score float64
+	// Spam reports whether the source classified the message as spam.
+	Spam bool
+	// Source is the header the verdict was read from.
+	Source string
+}
+
+// String formats v as the value of the X-YaToGm-Spam-Score header, such
+// as "0.71 (spam by X-Spam-Status)".
+func (v Verdict) String() string {
+	class := "ham"
+	if v.Spam {
+		class = "spam"
+	}
+	return fmt.Sprintf("%.2f (%s by %s)", v.Score, class, v.Source)
+}
+
+// Parse returns the verdict recorded in h, reporting false if there is
+// none. Yahoo's bulk filter takes precedence, then SpamAssassin's
+// X-Spam-Status, X-Spam-Score, and X-Spam-Flag, then Exchange's spam
+// confidence level.
+func Parse(h mail.Header) (Verdict, bool) {
+	for _, key := range []string{"X-YahooFilteredBulk", "X-Yahoo-Filtered-Bulk"} {
+		if h.Get(key) != "" {
+			return Verdict{Score: 1, Spam: true, Source: key}, true
+		}
+	}
+	if v := h.Get("X-Spam-Status"); v != "" {
+		if verdict, ok := parseStatus(v); ok {
+			return verdict, true
+		}
+	}
+	if v := h.Get("X-Spam-Score"); v != "" {
+		if score, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+			return Verdict{Score: normalize(score, defaultRequired), Spam: score >= defaultRequired, Source: "X-Spam-Score"}, true
+		}
+	}
+	if v := h.Get("X-Spam-Flag"); v != "" {
+		spam := strings.EqualFold(strings.TrimSpace(v), "yes")
+		score := 0.0
+		if spam {
+			score = 1
+		}
+		return Verdict{Score: score, Spam: spam, Source: "X-Spam-Flag"}, true
+	}
+	if v := h.Get("X-MS-Exchange-Organization-SCL"); v != "" {
+		// The spam confidence level runs from -1 (trusted) to 9; 5 and
+		// above is junk by default.
+		if scl, err := strconv.Atoi(strings.TrimSpace(v)); err == nil {
+			return Verdict{Score: normalize(float64(scl), 5), Spam: scl >= 5, Source: "X-MS-Exchange-Organization-SCL"}, true
+		}
+	}
+	return Verdict{}, false
+}
+
+// parseStatus parses a SpamAssassin X-Spam-Status value such as
+// "Yes, score=7.1 required=5.0 tests=...".
+func parseStatus(v string) (Verdict, bool) {
+	flag, rest, _ := strings.Cut(v, ",")
+	flag = strings.TrimSpace(flag)
+	if !strings.EqualFold(flag, "yes") && !strings.EqualFold(flag, "no") {
+		return Verdict{}, false
+	}
+	verdict := Verdict{Spam: strings.EqualFold(flag, "yes"), Source: "X-Spam-Status"}
+	var (
+		score     float64
+		haveScore bool
+		required  = defaultRequired
+	)
+	for _, field := range strings.Fields(rest) {
+		key, val, ok := strings.Cut(field, "=")
+		if !ok {
+			continue
+		}
+		f, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			continue
+		}
+		switch key {
+		case "score", "hits":
+			score, haveScore = f, true
+		case "required":
+			required = f
+		}
+	}
+	switch {
+	case haveScore:
+		verdict.Score = normalize(score, required)
+	case verdict.Spam:
+		verdict.Score = 1
+	}
+	return verdict, true
+}
+
+// normalize maps score onto 0 to 1 so that required lands on 0.5.
+func normalize(score, required float64) float64 {
+	if required <= 0 {
+		required = defaultRequired
+	}
+	return min(max(score/(2*required), 0), 1)
+}
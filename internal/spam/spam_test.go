@@ -0,0 +1,38 @@
+package spam
+
+import (
+	"net/mail"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name   string
+		header mail.Header
+		want   string
+	}{
+		{"yahoo bulk", mail.Header{"X-Yahoofilteredbulk": {"203.0.113.5"}}, "1.00 (spam by X-YahooFilteredBulk)"},
+		{"spamassassin spam", mail.Header{"X-Spam-Status": {"Yes, score=7.5 required=5.0 tests=BAYES_99"}}, "0.75 (spam by X-Spam-Status)"},
+		{"spamassassin ham", mail.Header{"X-Spam-Status": {"No, score=-0.9 required=5.0 tests=DKIM_VALID"}}, "0.00 (ham by X-Spam-Status)"},
+		{"spamassassin without score", mail.Header{"X-Spam-Status": {"Yes"}}, "1.00 (spam by X-Spam-Status)"},
+		{"score only", mail.Header{"X-Spam-Score": {"2.5"}}, "0.25 (ham by X-Spam-Score)"},
+		{"flag", mail.Header{"X-Spam-Flag": {"YES"}}, "1.00 (spam by X-Spam-Flag)"},
+		{"exchange", mail.Header{"X-Ms-Exchange-Organization-Scl": {"1"}}, "0.10 (ham by X-MS-Exchange-Organization-SCL)"},
+		{"bulk wins", mail.Header{"X-Yahoofilteredbulk": {"1"}, "X-Spam-Flag": {"NO"}}, "1.00 (spam by X-YahooFilteredBulk)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, ok := Parse(tt.header)
+			if !ok {
+				t.Fatal("expected a verdict")
+			}
+			if got := v.String(); got != tt.want {
+				t.Errorf("verdict = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if v, ok := Parse(mail.Header{"X-Spam-Status": {"garbage"}, "Subject": {"hi"}}); ok {
+		t.Errorf("expected no verdict, got %v", v)
+	}
+}
@@ -0,0 +1,172 @@
+package state
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/benj-n/yatogm/internal/fault"
+)
+
+// WithBackups keeps the n previous generations of each state file a
+// Tracker saves, as the file's path followed by ".1" (the newest) to ".n".
+// When a state file is corrupted, the newest valid generation is read
+// instead.
+func WithBackups(n int) FileOption {
+	return func(f *fileStore) {
+		f.backups = n
+	}
+}
+
+// footerPrefix starts the last line of a state file, holding the CRC-32C
+// of the file's content before it, in hexadecimal.
+const footerPrefix = "yatogm-crc32c:"
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// seal appends the checksum footer to the content of a state file.
+func seal(data []byte) []byte {
+	footer := fmt.Sprintf("\n%s%08x\n", footerPrefix, crc32.Checksum(data, castagnoli))
+	return append(data[:len(data):len(data)], footer...)
+}
+
+// unseal returns the content of a state file without its checksum footer,
+// reporting false if the checksum does not match. A file without a footer,
+// as saved before they were added, is returned whole.
+func unseal(data []byte) ([]byte, bool) {
+	i := bytes.LastIndex(data, []byte("\n"+footerPrefix))
+	if i < 0 {
+		return data, true
+	}
+	footer := bytes.TrimSuffix(data[i+1+len(footerPrefix):], []byte("\n"))
+	sum, err := strconv.ParseUint(string(footer), 16, 32)
+	if err != nil || uint32(sum) != crc32.Checksum(data[:i], castagnoli) {
+		return nil, false
+	}
+	return data[:i], true
+}
+
+// generation returns the path of the nth previous generation of the state
+// file at path.
+func generation(path string, n int) string {
+	return path + "." + strconv.Itoa(n)
+}
+
+// readStateFile reads the state file at path into a T. A corrupted file is
+// dealt with as f's corruption policy says.
+func readStateFile[T any](f fileStore, path string) (T, error) {
+	var v T
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return v, err
+	}
+	if ok, err := decodeState(data, &v); ok || err != nil {
+		return v, err
+	}
+	v = *new(T)
+	err = replaceCorrupt(f, path, func(data []byte) bool {
+		ok, _ := decodeState(data, &v)
+		if !ok {
+			v = *new(T)
+		}
+		return ok
+	})
+	return v, err
+}
+
+// decodeState decodes the content of a state file into v, reporting false
+// if it is corrupted.
+func decodeState(data []byte, v any) (bool, error) {
+	data, ok := unseal(data)
+	if !ok {
+		return false, nil
+	}
+	data, err := decompress(data)
+	if errors.Is(err, errCorrupt) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return json.Unmarshal(data, v) == nil, nil
+}
+
+// writeStateFile compresses and seals data, and writes it to the state file
+// at path atomically, using a temp file + rename, after keeping the file
+// there as its first generation.
+func writeStateFile(f fileStore, path string, data []byte) error {
+	data, err := compress(data, f.compression)
+	if err != nil {
+		return fmt.Errorf("compressing state: %w", err)
+	}
+	data = seal(data)
+
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("creating state directory: %w", err)
+	}
+	if err := rotate(path, f.backups); err != nil {
+		return fmt.Errorf("keeping previous state: %w", err)
+	}
+
+	// Atomic write: write to temp file, then rename.
+	tmpFile := path + ".tmp"
+	if err := os.WriteFile(tmpFile, fault.CorruptWrite(data), 0600); err != nil {
+		return fmt.Errorf("writing temp state file: %w", err)
+	}
+
+	if err := os.Rename(tmpFile, path); err != nil {
+		return fmt.Errorf("renaming state file: %w", err)
+	}
+
+	return nil
+}
+
+// rotate shifts the n generations of the state file at path by one,
+// dropping the oldest, and keeps the file as the newest. The file itself
+// stays in place, so that a crash never leaves no state.
+func rotate(path string, n int) error {
+	if n <= 0 {
+		return nil
+	}
+	if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	for i := n - 1; i >= 1; i-- {
+		if err := os.Rename(generation(path, i), generation(path, i+1)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	newest := generation(path, 1)
+	if err := os.Remove(newest); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err := os.Link(path, newest); err == nil {
+		return nil
+	}
+	// Not every filesystem supports hard links.
+	return copyFile(path, newest)
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
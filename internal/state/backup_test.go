@@ -0,0 +1,80 @@
+package state
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestStateBackups(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+
+	tracker, err := NewTracker(stateFile, WithBackups(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, uid := range []string{"uid1", "uid2", "uid3"} {
+		if err := tracker.MarkFetched("a@yahoo.com", uid); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"state.json.1", "state.json.2"} {
+		if _, err := os.Stat(filepath.Join(filepath.Dir(stateFile), name)); err != nil {
+			t.Errorf("expected the generation %s: %v", name, err)
+		}
+	}
+	if _, err := os.Stat(stateFile + ".3"); !os.IsNotExist(err) {
+		t.Errorf("expected only 2 generations kept, got %v", err)
+	}
+
+	// A change the JSON still parses is caught by the checksum.
+	data, err := os.ReadFile(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(stateFile, bytes.Replace(data, []byte("uid3"), []byte("uid9"), 1), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tracker, err = NewTracker(stateFile, WithBackups(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tracker.IsFetched("a@yahoo.com", "uid2") || tracker.IsFetched("a@yahoo.com", "uid9") {
+		t.Error("expected the newest generation read")
+	}
+	if got := tracker.Corrupted(); !slices.Equal(got, []Corruption{{Path: stateFile, Generation: stateFile + ".1"}}) {
+		t.Errorf("Corrupted() = %v", got)
+	}
+	if got := tracker.Corrupted(); len(got) != 0 {
+		t.Errorf("expected the recovery reported once, got %v", got)
+	}
+
+	// Without a valid generation, the state starts fresh.
+	for _, path := range []string{stateFile, stateFile + ".1", stateFile + ".2"} {
+		if err := os.WriteFile(path, []byte(`{"mailboxes": {`), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tracker, err = NewTracker(stateFile, WithBackups(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tracker.Stats()) != 0 || !slices.Equal(tracker.Corrupted(), []Corruption{{Path: stateFile}}) {
+		t.Error("expected an empty state")
+	}
+
+	// A file saved before checksums were added is read as is.
+	legacy := `{"mailboxes": {"a@yahoo.com": {"fetched_uids": {"uid1": true}}}}`
+	if err := os.WriteFile(stateFile, []byte(legacy), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tracker, err = NewTracker(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tracker.IsFetched("a@yahoo.com", "uid1") {
+		t.Error("expected a state file without checksum read")
+	}
+}
@@ -0,0 +1,73 @@
+package state
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Compression is how a file-backed Tracker compresses the state it saves.
+// Whatever it saves with, a Tracker reads plain and gzip-compressed state
+// alike, telling them apart by their content.
+type Compression string
+
+const (
+	// CompressNone saves the state as plain JSON.
+	CompressNone Compression = "none"
+	// CompressGzip saves the state gzip-compressed.
+	CompressGzip Compression = "gzip"
+)
+
+// WithCompression compresses the state files a Tracker saves with c.
+func WithCompression(c Compression) FileOption {
+	return func(f *fileStore) {
+		f.compression = c
+	}
+}
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// errCorrupt reports a state file whose compressed content cannot be read.
+var errCorrupt = errors.New("corrupted compressed state")
+
+// decompress returns the JSON content of a state file, decompressing it if
+// needed. A zstd-compressed file is refused rather than read as corrupted,
+// which would have it overwritten.
+func decompress(data []byte) ([]byte, error) {
+	switch {
+	case bytes.HasPrefix(data, gzipMagic):
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, errCorrupt
+		}
+		out, err := io.ReadAll(r)
+		if err != nil {
+			return nil, errCorrupt
+		}
+		return out, nil
+	case bytes.HasPrefix(data, zstdMagic):
+		return nil, fmt.Errorf("state is zstd-compressed, which is not supported; decompress it with zstd -d")
+	}
+	return data, nil
+}
+
+// compress compresses the JSON content of a state file with c.
+func compress(data []byte, c Compression) ([]byte, error) {
+	if c != CompressGzip {
+		return data, nil
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,82 @@
+package state
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCompressedState(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+
+	plain, err := NewTracker(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := plain.MarkFetched("a@yahoo.com", "uid1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A plain state is read, and saved compressed.
+	compressed, err := NewTracker(stateFile, WithCompression(CompressGzip))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !compressed.IsFetched("a@yahoo.com", "uid1") {
+		t.Error("expected the plain state read")
+	}
+	if err := compressed.MarkFetched("a@yahoo.com", "uid2"); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, gzipMagic) {
+		t.Fatalf("expected the state saved gzip-compressed, got %q", data[:min(len(data), 16)])
+	}
+
+	// A compressed state is read whatever the tracker saves with.
+	plain, err = NewTracker(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !plain.IsFetched("a@yahoo.com", "uid2") {
+		t.Error("expected the compressed state read")
+	}
+
+	// Sharded mailboxes are compressed too.
+	sharded, err := NewShardedTracker(stateFile, WithCompression(CompressGzip))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sharded.MarkFetched("a@yahoo.com", "uid3"); err != nil {
+		t.Fatal(err)
+	}
+	if data, err = os.ReadFile(filepath.Join(stateFile+".d", "a@yahoo.com.json")); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, gzipMagic) {
+		t.Error("expected the mailbox file saved gzip-compressed")
+	}
+	if stats := sharded.Stats(); stats["a@yahoo.com"] != 3 {
+		t.Errorf("Stats = %v", stats)
+	}
+
+	// A truncated compressed file reads as empty, like corrupted JSON.
+	if err := os.WriteFile(stateFile, gzipMagic, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewTracker(stateFile); err != nil {
+		t.Errorf("expected a corrupted state to read as empty, got %v", err)
+	}
+
+	// A zstd-compressed file is refused rather than overwritten.
+	if err := os.WriteFile(stateFile, append(zstdMagic, 0, 0), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewTracker(stateFile); err == nil {
+		t.Error("expected a zstd-compressed state to be refused")
+	}
+}
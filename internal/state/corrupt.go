@@ -0,0 +1,81 @@
+package state
+
+import (
+	"fmt"
+	"os"
+)
+
+// CorruptionPolicy is what a Tracker does with a corrupted state file.
+type CorruptionPolicy string
+
+const (
+	// CorruptRestore reads the newest valid generation of the file
+	// instead, and fails with a *CorruptError if there is none.
+	CorruptRestore CorruptionPolicy = "restore"
+	// CorruptFail fails with a *CorruptError.
+	CorruptFail CorruptionPolicy = "fail"
+	// CorruptFresh starts with no state, setting the corrupted file aside
+	// as its path followed by ".corrupt".
+	CorruptFresh CorruptionPolicy = "fresh"
+)
+
+// WithCorruption sets what a Tracker does with a corrupted state file. By
+// default, it reads the newest valid generation, and starts with no state
+// if there is none.
+func WithCorruption(p CorruptionPolicy) FileOption {
+	return func(f *fileStore) {
+		f.corruption = p
+	}
+}
+
+// CorruptError reports a state file that is corrupted and was not replaced.
+type CorruptError struct {
+	// Path is the corrupted state file.
+	Path string
+	// Policy is the policy that refused to go on without it.
+	Policy CorruptionPolicy
+}
+
+func (e *CorruptError) Error() string {
+	if e.Policy == CorruptRestore {
+		return fmt.Sprintf("state file %s is corrupted and has no valid previous generation", e.Path)
+	}
+	return fmt.Sprintf("state file %s is corrupted", e.Path)
+}
+
+// Corruption records a corrupted state file a Tracker went on without.
+type Corruption struct {
+	// Path is the corrupted state file.
+	Path string
+	// Generation is the previous generation read instead, or empty if the
+	// state started fresh.
+	Generation string
+}
+
+// replaceCorrupt decides, as f's policy says, what replaces the corrupted
+// state file at path: the newest valid generation, decoded by decode, or
+// nothing for a fresh start. It records what it did in f.corrupted.
+func replaceCorrupt(f fileStore, path string, decode func(data []byte) bool) error {
+	if f.corruption != CorruptFail && f.corruption != CorruptFresh {
+		for n := 1; n <= f.backups; n++ {
+			prev := generation(path, n)
+			data, err := os.ReadFile(prev)
+			if err == nil && decode(data) {
+				*f.corrupted = append(*f.corrupted, Corruption{Path: path, Generation: prev})
+				return nil
+			}
+		}
+	}
+	switch f.corruption {
+	case CorruptRestore, CorruptFail:
+		return &CorruptError{Path: path, Policy: f.corruption}
+	case CorruptFresh:
+		// Kept for inspection, and so that the next save does not rotate
+		// it into the generations.
+		if err := os.Rename(path, path+".corrupt"); err != nil {
+			return fmt.Errorf("setting corrupted state aside: %w", err)
+		}
+	}
+	*f.corrupted = append(*f.corrupted, Corruption{Path: path})
+	return nil
+}
@@ -0,0 +1,65 @@
+package state
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCorruptionPolicy(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	tracker, err := NewTracker(stateFile, WithBackups(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, uid := range []string{"uid1", "uid2"} {
+		if err := tracker.MarkFetched("a@yahoo.com", uid); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(stateFile, []byte(`{"mailboxes": {`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Restoring reads the previous generation.
+	tracker, err = NewTracker(stateFile, WithBackups(1), WithCorruption(CorruptRestore))
+	if err != nil {
+		t.Fatalf("expected the previous generation read, got %v", err)
+	}
+	if !tracker.IsFetched("a@yahoo.com", "uid1") {
+		t.Error("expected the previous generation's state")
+	}
+
+	// Failing ignores it.
+	var ce *CorruptError
+	if _, err := NewTracker(stateFile, WithBackups(1), WithCorruption(CorruptFail)); !errors.As(err, &ce) || ce.Path != stateFile {
+		t.Errorf("expected a CorruptError, got %v", err)
+	}
+
+	// Restoring without a valid generation fails too.
+	if err := os.Remove(stateFile + ".1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewTracker(stateFile, WithBackups(1), WithCorruption(CorruptRestore)); !errors.As(err, &ce) {
+		t.Errorf("expected a CorruptError, got %v", err)
+	}
+
+	// Starting fresh sets the corrupted file aside.
+	tracker, err = NewTracker(stateFile, WithBackups(1), WithCorruption(CorruptFresh))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tracker.Stats()) != 0 {
+		t.Error("expected an empty state")
+	}
+	if c := tracker.Corrupted(); len(c) != 1 || c[0].Generation != "" {
+		t.Errorf("Corrupted() = %v", c)
+	}
+	if data, err := os.ReadFile(stateFile + ".corrupt"); err != nil || string(data) != `{"mailboxes": {` {
+		t.Errorf("expected the corrupted file kept, got %q, %v", data, err)
+	}
+	if _, err := os.Stat(stateFile); !os.IsNotExist(err) {
+		t.Errorf("expected the corrupted file moved, got %v", err)
+	}
+}
@@ -0,0 +1,160 @@
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/benj-n/yatogm/internal/lease"
+)
+
+// NewRedisLease returns a lease.Store keeping the leader lease in the
+// Redis server r describes, under <prefix>lease, so that replicas sharing
+// the state there need no shared volume to elect a leader.
+func NewRedisLease(r Redis) lease.Store {
+	s := &redisStore{Redis: r}
+	if s.Timeout <= 0 {
+		s.Timeout = 10 * time.Second
+	}
+	return redisLease{s}
+}
+
+// redisLease keeps the lease as JSON under <prefix>lease, updated with
+// WATCH and MULTI/EXEC, and expiring with the lease itself.
+type redisLease struct{ *redisStore }
+
+func (l redisLease) Update(next func(cur lease.Lease) (lease.Lease, bool)) (lease.Lease, error) {
+	c, err := l.dial()
+	if err != nil {
+		return lease.Lease{}, err
+	}
+	defer c.Close()
+
+	key := l.Prefix + "lease"
+	for {
+		if _, err := c.do("WATCH", key); err != nil {
+			return lease.Lease{}, err
+		}
+		reply, err := c.do("GET", key)
+		if err != nil {
+			return lease.Lease{}, err
+		}
+		// A damaged lease is treated as no lease, as in a file.
+		var cur lease.Lease
+		if v, ok := reply.([]byte); ok && json.Unmarshal(v, &cur) != nil {
+			cur = lease.Lease{}
+		}
+		updated, ok := next(cur)
+		if !ok {
+			_, err := c.do("UNWATCH")
+			return cur, err
+		}
+		data, err := json.Marshal(updated)
+		if err != nil {
+			return cur, fmt.Errorf("marshaling lease: %w", err)
+		}
+		ttl := max(time.Until(updated.Expires).Milliseconds(), 1)
+
+		c.send("MULTI")
+		c.send("SET", key, string(data), "PX", strconv.FormatInt(ttl, 10))
+		c.send("EXEC")
+		if err := c.flush(); err != nil {
+			return cur, err
+		}
+		// A command refused while queued aborts the EXEC, whose reply is
+		// the last.
+		for range 3 {
+			if reply, err = c.receive(); err != nil {
+				return cur, fmt.Errorf("writing lease: %w", err)
+			}
+		}
+		switch reply := reply.(type) {
+		case nil:
+			// Another instance updated the lease since the WATCH.
+			continue
+		case redisError:
+			return cur, fmt.Errorf("writing lease: %w", reply)
+		case []any:
+			if len(reply) == 1 {
+				if err, ok := reply[0].(redisError); ok {
+					return cur, fmt.Errorf("writing lease: %w", err)
+				}
+			}
+		}
+		return updated, nil
+	}
+}
+
+// NewPostgresLease returns a lease.Store keeping the leader lease of
+// p.Owner in the database p describes, in yatogm_leases, bringing its
+// schema up to date first. The store is an io.Closer, closing its
+// connection.
+func NewPostgresLease(p Postgres) (lease.Store, error) {
+	cfg, err := parsePostgresURL(p.URL)
+	if err != nil {
+		return nil, err
+	}
+	s := &pgStore{Postgres: p, cfg: cfg}
+	if s.Timeout <= 0 {
+		s.Timeout = 30 * time.Second
+	}
+	if err := s.migrate(); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("migrating postgres schema on %s: %w", cfg.host, err)
+	}
+	return pgLease{s}, nil
+}
+
+// pgLease keeps the lease as JSON in a row of yatogm_leases, locked for
+// the transaction that updates it.
+type pgLease struct{ *pgStore }
+
+func (l pgLease) Update(next func(cur lease.Lease) (lease.Lease, bool)) (lease.Lease, error) {
+	c, err := l.connect()
+	if err != nil {
+		return lease.Lease{}, err
+	}
+	cur, err := func() (lease.Lease, error) {
+		var cur lease.Lease
+		if err := c.exec("BEGIN"); err != nil {
+			return cur, err
+		}
+		if _, err := c.query(`INSERT INTO yatogm_leases (owner, lease) VALUES ($1::text, '{}')
+			ON CONFLICT (owner) DO NOTHING`, l.Owner); err != nil {
+			return cur, err
+		}
+		rows, err := c.query(`SELECT lease::text FROM yatogm_leases WHERE owner = $1::text FOR UPDATE`, l.Owner)
+		if err != nil {
+			return cur, err
+		}
+		if len(rows) != 1 || rows[0][0] == nil {
+			return cur, errors.New("the lease row is missing")
+		}
+		if json.Unmarshal([]byte(*rows[0][0]), &cur) != nil {
+			cur = lease.Lease{}
+		}
+		updated, ok := next(cur)
+		if !ok {
+			return cur, c.exec("COMMIT")
+		}
+		data, err := json.Marshal(updated)
+		if err != nil {
+			return cur, fmt.Errorf("marshaling lease: %w", err)
+		}
+		if _, err := c.query(`UPDATE yatogm_leases SET lease = $2::jsonb, updated_at = now() WHERE owner = $1::text`,
+			l.Owner, string(data)); err != nil {
+			return cur, err
+		}
+		if err := c.exec("COMMIT"); err != nil {
+			return cur, err
+		}
+		return updated, nil
+	}()
+	if err != nil {
+		l.reset()
+		return cur, fmt.Errorf("updating lease: %w", err)
+	}
+	return cur, nil
+}
@@ -0,0 +1,86 @@
+package state
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benj-n/yatogm/internal/lease"
+)
+
+func TestRedisLease(t *testing.T) {
+	srv := newFakeRedis(t, "")
+	opts := Redis{Addr: srv.ln.Addr().String(), Prefix: "yatogm:"}
+
+	primary := lease.NewElector(NewRedisLease(opts), "primary", time.Minute)
+	standby := lease.NewElector(NewRedisLease(opts), "standby", time.Minute)
+	if leader, _, err := primary.Acquire(); err != nil || !leader {
+		t.Fatalf("primary Acquire = %v, %v; want leader", leader, err)
+	}
+	leader, cur, err := standby.Acquire()
+	if err != nil || leader || cur.Holder != "primary" {
+		t.Fatalf("standby Acquire = %v, %+v, %v; want the lease held by primary", leader, cur, err)
+	}
+	srv.mu.Lock()
+	if ttl := srv.ttls["yatogm:lease"]; ttl <= 0 || ttl > 60000 {
+		t.Errorf("lease expires in %dms, want within the lease duration", ttl)
+	}
+	srv.mu.Unlock()
+
+	// An instance taking the lease between the read and the write makes
+	// the write start over from its lease.
+	calls := 0
+	cur, err = NewRedisLease(opts).Update(func(cur lease.Lease) (lease.Lease, bool) {
+		calls++
+		if calls == 1 {
+			if _, err := NewRedisLease(opts).Update(func(lease.Lease) (lease.Lease, bool) {
+				return lease.Lease{Holder: "other", Expires: time.Now().Add(time.Minute)}, true
+			}); err != nil {
+				t.Fatalf("Update: %v", err)
+			}
+		}
+		if cur.Holder == "other" {
+			return cur, false
+		}
+		return lease.Lease{Holder: "late", Expires: time.Now().Add(time.Minute)}, true
+	})
+	if err != nil || calls != 2 || cur.Holder != "other" {
+		t.Errorf("Update = %+v, %v after %d calls; want the other instance's lease, after 2", cur, err, calls)
+	}
+}
+
+func TestPostgresLease(t *testing.T) {
+	srv := newFakePostgres(t, "secret")
+	opts := Postgres{URL: srv.url("secret"), Owner: "service"}
+
+	var electors []*lease.Elector
+	for _, id := range []string{"primary", "standby"} {
+		store, err := NewPostgresLease(opts)
+		if err != nil {
+			t.Fatalf("NewPostgresLease: %v", err)
+		}
+		t.Cleanup(func() { store.(io.Closer).Close() })
+		electors = append(electors, lease.NewElector(store, id, time.Minute))
+	}
+	if srv.version != len(migrations) {
+		t.Errorf("expected the schema at version %d, got %d", len(migrations), srv.version)
+	}
+
+	if leader, _, err := electors[0].Acquire(); err != nil || !leader {
+		t.Fatalf("primary Acquire = %v, %v; want leader", leader, err)
+	}
+	leader, cur, err := electors[1].Acquire()
+	if err != nil || leader || cur.Holder != "primary" {
+		t.Fatalf("standby Acquire = %v, %+v, %v; want the lease held by primary", leader, cur, err)
+	}
+	// The primary renews the lease it holds.
+	if leader, _, err := electors[0].Acquire(); err != nil || !leader {
+		t.Fatalf("primary renewal = %v, %v; want leader", leader, err)
+	}
+	srv.mu.Lock()
+	if !strings.Contains(srv.leases["service"], `"holder":"primary"`) {
+		t.Errorf("stored lease %q, want it held by primary", srv.leases["service"])
+	}
+	srv.mu.Unlock()
+}
@@ -0,0 +1,522 @@
+package state
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pgConfig holds the connection settings of a postgres:// URL.
+type pgConfig struct {
+	host, port         string
+	user, password     string
+	database           string
+	sslmode            string
+	applicationName    string
+	connectTimeoutSecs int
+}
+
+// parsePostgresURL parses a postgres:// or postgresql:// URL, as libpq
+// accepts it, with the sslmode "disable", "prefer" (default), "require",
+// or "verify-full".
+func parsePostgresURL(s string) (pgConfig, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return pgConfig{}, fmt.Errorf("invalid postgres URL: %w", err)
+	}
+	if u.Scheme != "postgres" && u.Scheme != "postgresql" {
+		return pgConfig{}, fmt.Errorf("invalid postgres URL: scheme must be postgres or postgresql, got %q", u.Scheme)
+	}
+	c := pgConfig{
+		host:            u.Hostname(),
+		port:            u.Port(),
+		user:            u.User.Username(),
+		database:        strings.TrimPrefix(u.Path, "/"),
+		sslmode:         "prefer",
+		applicationName: "yatogm",
+	}
+	c.password, _ = u.User.Password()
+	if c.host == "" {
+		c.host = "localhost"
+	}
+	if c.port == "" {
+		c.port = "5432"
+	}
+	if c.database == "" {
+		c.database = c.user
+	}
+	for k, v := range u.Query() {
+		switch k {
+		case "sslmode":
+			switch v[0] {
+			case "disable", "prefer", "require", "verify-full":
+				c.sslmode = v[0]
+			default:
+				return pgConfig{}, fmt.Errorf("invalid postgres URL: sslmode must be disable, prefer, require, or verify-full, got %q", v[0])
+			}
+		case "application_name":
+			c.applicationName = v[0]
+		case "connect_timeout":
+			if c.connectTimeoutSecs, err = strconv.Atoi(v[0]); err != nil {
+				return pgConfig{}, fmt.Errorf("invalid postgres URL: connect_timeout must be a number of seconds, got %q", v[0])
+			}
+		default:
+			return pgConfig{}, fmt.Errorf("invalid postgres URL: unsupported parameter %q", k)
+		}
+	}
+	if c.user == "" {
+		return pgConfig{}, errors.New("invalid postgres URL: no user name")
+	}
+	return c, nil
+}
+
+// pgError is an error reported by the server.
+type pgError struct {
+	Severity string
+	Code     string
+	Message  string
+}
+
+func (e *pgError) Error() string {
+	return fmt.Sprintf("postgres: %s: %s (SQLSTATE %s)", e.Severity, e.Message, e.Code)
+}
+
+// pgConn speaks the PostgreSQL frontend/backend protocol (version 3.0)
+// over a connection: the simple query protocol for statements without
+// parameters, and the extended one, with text parameters, for the rest.
+type pgConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// dialPostgres connects to the server, negotiating TLS as sslmode asks,
+// and authenticates.
+func dialPostgres(c pgConfig, timeout time.Duration) (*pgConn, error) {
+	if c.connectTimeoutSecs > 0 {
+		timeout = time.Duration(c.connectTimeoutSecs) * time.Second
+	}
+	addr := net.JoinHostPort(c.host, c.port)
+	conn, err := (&net.Dialer{Timeout: timeout}).Dial("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to postgres: %w", err)
+	}
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+
+	if c.sslmode != "disable" {
+		// SSLRequest: the server answers with a single byte.
+		req := binary.BigEndian.AppendUint32(nil, 8)
+		req = binary.BigEndian.AppendUint32(req, 80877103)
+		var answer [1]byte
+		if _, err := conn.Write(req); err == nil {
+			_, err = io.ReadFull(conn, answer[:])
+		}
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("negotiating TLS with postgres: %w", err)
+		}
+		switch {
+		case answer[0] == 'S':
+			tc := &tls.Config{ServerName: c.host}
+			if c.sslmode != "verify-full" {
+				// As in libpq, "prefer" and "require" encrypt without
+				// verifying the server's certificate.
+				tc.InsecureSkipVerify = true
+			}
+			tlsConn := tls.Client(conn, tc)
+			if err := tlsConn.Handshake(); err != nil {
+				conn.Close()
+				return nil, fmt.Errorf("negotiating TLS with postgres: %w", err)
+			}
+			conn = tlsConn
+		case c.sslmode != "prefer":
+			conn.Close()
+			return nil, fmt.Errorf("postgres server at %s does not support TLS, which sslmode %s requires", addr, c.sslmode)
+		}
+	}
+
+	pc := &pgConn{Conn: conn, r: bufio.NewReader(conn)}
+	if err := pc.startup(c); err != nil {
+		pc.Close()
+		return nil, err
+	}
+	return pc, nil
+}
+
+// startup sends the startup message, authenticates, and waits until the
+// server is ready for queries.
+func (c *pgConn) startup(cfg pgConfig) error {
+	body := binary.BigEndian.AppendUint32(nil, 196608) // protocol 3.0
+	for _, kv := range [][2]string{{"user", cfg.user}, {"database", cfg.database}, {"application_name", cfg.applicationName}} {
+		body = appendCString(appendCString(body, kv[0]), kv[1])
+	}
+	body = append(body, 0)
+	msg := binary.BigEndian.AppendUint32(nil, uint32(len(body)+4))
+	if _, err := c.Write(append(msg, body...)); err != nil {
+		return fmt.Errorf("writing to postgres: %w", err)
+	}
+
+	var sc *scram
+	for {
+		typ, body, err := c.readMsg()
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case 'E':
+			return parsePgError(body)
+		case 'Z':
+			return nil
+		case 'R':
+			if len(body) < 4 {
+				return errors.New("postgres: short authentication request")
+			}
+			code, data := binary.BigEndian.Uint32(body), body[4:]
+			switch code {
+			case 0: // AuthenticationOk
+			case 3: // AuthenticationCleartextPassword
+				err = c.writeMsg('p', appendCString(nil, cfg.password))
+			case 5: // AuthenticationMD5Password
+				if len(data) < 4 {
+					return errors.New("postgres: short MD5 salt")
+				}
+				err = c.writeMsg('p', appendCString(nil, md5Password(cfg.user, cfg.password, data[:4])))
+			case 10: // AuthenticationSASL
+				if !strings.Contains(string(data), "SCRAM-SHA-256\x00") {
+					return fmt.Errorf("postgres: no supported SASL mechanism in %q", data)
+				}
+				sc = newSCRAM("", cfg.password, scramNonce())
+				first := sc.clientFirst()
+				msg := appendCString(nil, "SCRAM-SHA-256")
+				msg = binary.BigEndian.AppendUint32(msg, uint32(len(first)))
+				err = c.writeMsg('p', append(msg, first...))
+			case 11: // AuthenticationSASLContinue
+				if sc == nil {
+					return errors.New("postgres: unexpected SASL continuation")
+				}
+				var final string
+				if final, err = sc.clientFinal(string(data)); err != nil {
+					return err
+				}
+				err = c.writeMsg('p', []byte(final))
+			case 12: // AuthenticationSASLFinal
+				if sc == nil {
+					return errors.New("postgres: unexpected SASL outcome")
+				}
+				err = sc.verify(string(data))
+			default:
+				return fmt.Errorf("postgres: unsupported authentication method %d", code)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// exec runs statements without parameters with the simple query protocol,
+// discarding any rows.
+func (c *pgConn) exec(sql string) error {
+	if err := c.writeMsg('Q', appendCString(nil, sql)); err != nil {
+		return err
+	}
+	_, err := c.results()
+	return err
+}
+
+// query runs one statement with parameters and returns its rows, each as
+// the text of its columns, with nil for NULL. Parameters are strings,
+// int64s, []string, []int64, or nil for NULL, sent as text; the statement
+// should cast them where their type cannot be inferred.
+func (c *pgConn) query(sql string, args ...any) ([][]*string, error) {
+	parse := appendCString(appendCString(nil, ""), sql)
+	parse = binary.BigEndian.AppendUint16(parse, 0)
+
+	bind := appendCString(appendCString(nil, ""), "")
+	bind = binary.BigEndian.AppendUint16(bind, 0) // all parameters in text
+	bind = binary.BigEndian.AppendUint16(bind, uint16(len(args)))
+	for _, a := range args {
+		v, ok := pgText(a)
+		if !ok {
+			bind = binary.BigEndian.AppendUint32(bind, 0xFFFFFFFF) // NULL
+			continue
+		}
+		bind = binary.BigEndian.AppendUint32(bind, uint32(len(v)))
+		bind = append(bind, v...)
+	}
+	bind = binary.BigEndian.AppendUint16(bind, 0) // all results in text
+
+	execute := binary.BigEndian.AppendUint32(appendCString(nil, ""), 0)
+
+	var out []byte
+	for _, m := range []struct {
+		typ  byte
+		body []byte
+	}{{'P', parse}, {'B', bind}, {'E', execute}, {'S', nil}} {
+		out = append(out, m.typ)
+		out = binary.BigEndian.AppendUint32(out, uint32(len(m.body)+4))
+		out = append(out, m.body...)
+	}
+	if _, err := c.Write(out); err != nil {
+		return nil, fmt.Errorf("writing to postgres: %w", err)
+	}
+	return c.results()
+}
+
+// results reads the replies to a query up to ReadyForQuery, returning the
+// data rows, or the first error the server reported.
+func (c *pgConn) results() ([][]*string, error) {
+	var (
+		rows   [][]*string
+		failed error
+	)
+	for {
+		typ, body, err := c.readMsg()
+		if err != nil {
+			return nil, err
+		}
+		switch typ {
+		case 'Z':
+			return rows, failed
+		case 'E':
+			if failed == nil {
+				failed = parsePgError(body)
+			}
+		case 'D':
+			row, err := parseDataRow(body)
+			if err != nil {
+				return nil, err
+			}
+			rows = append(rows, row)
+		}
+	}
+}
+
+// Close ends the session and closes the connection.
+func (c *pgConn) Close() error {
+	_ = c.writeMsg('X', nil)
+	return c.Conn.Close()
+}
+
+func (c *pgConn) writeMsg(typ byte, body []byte) error {
+	msg := binary.BigEndian.AppendUint32([]byte{typ}, uint32(len(body)+4))
+	if _, err := c.Write(append(msg, body...)); err != nil {
+		return fmt.Errorf("writing to postgres: %w", err)
+	}
+	return nil
+}
+
+func (c *pgConn) readMsg() (byte, []byte, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(c.r, hdr[:]); err != nil {
+		return 0, nil, fmt.Errorf("reading from postgres: %w", err)
+	}
+	n := binary.BigEndian.Uint32(hdr[1:])
+	if n < 4 || n > 1<<30 {
+		return 0, nil, fmt.Errorf("postgres: invalid message length %d", n)
+	}
+	body := make([]byte, n-4)
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		return 0, nil, fmt.Errorf("reading from postgres: %w", err)
+	}
+	return hdr[0], body, nil
+}
+
+func parsePgError(body []byte) error {
+	e := &pgError{}
+	for len(body) > 1 {
+		field := body[0]
+		end := strings.IndexByte(string(body[1:]), 0)
+		if end < 0 {
+			break
+		}
+		value := string(body[1 : 1+end])
+		body = body[2+end:]
+		switch field {
+		case 'S':
+			e.Severity = value
+		case 'C':
+			e.Code = value
+		case 'M':
+			e.Message = value
+		}
+	}
+	return e
+}
+
+func parseDataRow(body []byte) ([]*string, error) {
+	if len(body) < 2 {
+		return nil, errors.New("postgres: short data row")
+	}
+	n := int(binary.BigEndian.Uint16(body))
+	body = body[2:]
+	row := make([]*string, n)
+	for i := range row {
+		if len(body) < 4 {
+			return nil, errors.New("postgres: short data row")
+		}
+		size := int32(binary.BigEndian.Uint32(body))
+		body = body[4:]
+		if size < 0 {
+			continue
+		}
+		if int(size) > len(body) {
+			return nil, errors.New("postgres: short data row")
+		}
+		v := string(body[:size])
+		row[i] = &v
+		body = body[size:]
+	}
+	return row, nil
+}
+
+// pgText returns the text form of a query parameter, or false for NULL.
+func pgText(a any) (string, bool) {
+	switch v := a.(type) {
+	case nil:
+		return "", false
+	case string:
+		return v, true
+	case int64:
+		return strconv.FormatInt(v, 10), true
+	case []string:
+		quoted := make([]string, len(v))
+		for i, s := range v {
+			quoted[i] = `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+		}
+		return "{" + strings.Join(quoted, ",") + "}", true
+	case []int64:
+		items := make([]string, len(v))
+		for i, n := range v {
+			items[i] = strconv.FormatInt(n, 10)
+		}
+		return "{" + strings.Join(items, ",") + "}", true
+	}
+	panic(fmt.Sprintf("postgres: unsupported parameter type %T", a))
+}
+
+func appendCString(b []byte, s string) []byte {
+	return append(append(b, s...), 0)
+}
+
+// md5Password answers an MD5 authentication request.
+func md5Password(user, password string, salt []byte) string {
+	inner := md5.Sum([]byte(password + user))
+	outer := md5.Sum(append([]byte(hex.EncodeToString(inner[:])), salt...))
+	return "md5" + hex.EncodeToString(outer[:])
+}
+
+// scram is the client side of a SCRAM-SHA-256 exchange (RFC 5802, RFC
+// 7677), without channel binding.
+type scram struct {
+	password        string
+	clientNonce     string
+	clientFirstBare string
+	saltedPassword  []byte
+	authMessage     string
+}
+
+func newSCRAM(user, password, nonce string) *scram {
+	user = strings.NewReplacer("=", "=3D", ",", "=2C").Replace(user)
+	return &scram{password: password, clientNonce: nonce, clientFirstBare: "n=" + user + ",r=" + nonce}
+}
+
+func scramNonce() string {
+	b := make([]byte, 18)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+func (s *scram) clientFirst() string {
+	return "n,," + s.clientFirstBare
+}
+
+// clientFinal answers the server's first message with the proof.
+func (s *scram) clientFinal(serverFirst string) (string, error) {
+	var nonce, salt string
+	iterations := 0
+	for _, attr := range strings.Split(serverFirst, ",") {
+		k, v, _ := strings.Cut(attr, "=")
+		switch k {
+		case "r":
+			nonce = v
+		case "s":
+			salt = v
+		case "i":
+			iterations, _ = strconv.Atoi(v)
+		}
+	}
+	if !strings.HasPrefix(nonce, s.clientNonce) || len(nonce) == len(s.clientNonce) {
+		return "", errors.New("postgres: SCRAM server nonce does not extend ours")
+	}
+	saltBytes, err := base64.StdEncoding.DecodeString(salt)
+	if err != nil || iterations < 1 {
+		return "", errors.New("postgres: invalid SCRAM salt or iteration count")
+	}
+
+	s.saltedPassword = pbkdf2SHA256([]byte(s.password), saltBytes, iterations)
+	clientKey := hmacSHA256(s.saltedPassword, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	withoutProof := "c=biws,r=" + nonce
+	s.authMessage = s.clientFirstBare + "," + serverFirst + "," + withoutProof
+	signature := hmacSHA256(storedKey[:], s.authMessage)
+	proof := make([]byte, len(clientKey))
+	for i := range proof {
+		proof[i] = clientKey[i] ^ signature[i]
+	}
+	return withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof), nil
+}
+
+// verify checks the server's signature in its final message, proving
+// that it knows the password too.
+func (s *scram) verify(serverFinal string) error {
+	v, ok := strings.CutPrefix(serverFinal, "v=")
+	if !ok {
+		return fmt.Errorf("postgres: SCRAM authentication failed: %s", serverFinal)
+	}
+	want := hmacSHA256(hmacSHA256(s.saltedPassword, "Server Key"), s.authMessage)
+	got, err := base64.StdEncoding.DecodeString(v)
+	if err != nil || !hmac.Equal(got, want) {
+		return errors.New("postgres: SCRAM server signature does not match")
+	}
+	return nil
+}
+
+func hmacSHA256(key []byte, msg string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(msg))
+	return m.Sum(nil)
+}
+
+// pbkdf2SHA256 derives a 32-byte key (one PBKDF2 block).
+func pbkdf2SHA256(password, salt []byte, iterations int) []byte {
+	m := hmac.New(sha256.New, password)
+	m.Write(salt)
+	m.Write([]byte{0, 0, 0, 1})
+	u := m.Sum(nil)
+	out := append([]byte(nil), u...)
+	for i := 1; i < iterations; i++ {
+		m.Reset()
+		m.Write(u)
+		u = m.Sum(u[:0])
+		for j := range out {
+			out[j] ^= u[j]
+		}
+	}
+	return out
+}
@@ -0,0 +1,402 @@
+package state
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Postgres configures a Tracker that keeps its state in PostgreSQL, so
+// that the state of many users can be kept in one place and queried with
+// SQL. The fetched UIDs are rows of yatogm_fetched, the rest of each
+// mailbox's state is JSON in yatogm_mailboxes, and the leader lease, with
+// leader election, is in yatogm_leases.
+type Postgres struct {
+	// URL is the connection URL, such as
+	// postgres://yatogm:secret@db:5432/yatogm?sslmode=verify-full.
+	URL string
+	// Owner tells apart the state of users sharing the database.
+	Owner string
+	// Timeout bounds connecting and each load and save (default: 30s).
+	Timeout time.Duration
+	// WriteDelay, when positive, defers each save by up to this long, so
+	// that the changes made meanwhile are written together, in one
+	// transaction. Tracker.Flush writes them at once.
+	WriteDelay time.Duration
+	// ReadOnly opens the state only to read it, as the observer does:
+	// the schema is taken as it is, without migrating it, and saves fail.
+	ReadOnly bool
+}
+
+// migrations are the schema changes, applied in order, each once, when a
+// Tracker is created. Version n is migrations[n-1]; released migrations
+// must never change.
+var migrations = []string{
+	`CREATE TABLE yatogm_mailboxes (
+		owner      text NOT NULL,
+		mailbox    text NOT NULL,
+		state      jsonb NOT NULL,
+		updated_at timestamptz NOT NULL DEFAULT now(),
+		PRIMARY KEY (owner, mailbox)
+	);
+	CREATE TABLE yatogm_fetched (
+		owner      text NOT NULL,
+		mailbox    text NOT NULL,
+		uid        text NOT NULL,
+		fetched_at timestamptz,
+		PRIMARY KEY (owner, mailbox, uid)
+	);
+	CREATE INDEX yatogm_fetched_at ON yatogm_fetched (owner, mailbox, fetched_at);
+	CREATE TABLE yatogm_globals (
+		owner      text PRIMARY KEY,
+		state      jsonb NOT NULL,
+		updated_at timestamptz NOT NULL DEFAULT now()
+	);`,
+	`CREATE TABLE yatogm_leases (
+		owner      text PRIMARY KEY,
+		lease      jsonb NOT NULL,
+		updated_at timestamptz NOT NULL DEFAULT now()
+	);`,
+}
+
+// migrationLock is the advisory lock key serializing migrations between
+// instances ("yato").
+const migrationLock = 0x7961746f
+
+// NewPostgresTracker creates a Tracker saving to the database p describes,
+// bringing its schema up to date, unless p.ReadOnly, and loading the state
+// already there.
+func NewPostgresTracker(p Postgres) (*Tracker, error) {
+	cfg, err := parsePostgresURL(p.URL)
+	if err != nil {
+		return nil, err
+	}
+	s := &pgStore{
+		Postgres: p,
+		cfg:      cfg,
+		rest:     make(map[string][]byte),
+		fetched:  make(map[string]map[string]int64),
+	}
+	if s.Timeout <= 0 {
+		s.Timeout = 30 * time.Second
+	}
+	if !p.ReadOnly {
+		if err := s.migrate(); err != nil {
+			s.Close()
+			return nil, fmt.Errorf("migrating postgres schema on %s: %w", cfg.host, err)
+		}
+	}
+	t, err := newTracker(s)
+	if err != nil {
+		s.Close()
+		return nil, fmt.Errorf("loading state from postgres on %s: %w", cfg.host, err)
+	}
+	t.delay = p.WriteDelay
+	return t, nil
+}
+
+// pgStore keeps the state in PostgreSQL, over one connection, made when
+// first needed and again after a failure.
+type pgStore struct {
+	Postgres
+	cfg  pgConfig
+	conn *pgConn
+	// rest, fetched, and global hold what was last loaded or saved, so
+	// that a save only writes what changed: each mailbox's state without
+	// its fetched UIDs, as JSON, its fetched UIDs with their fetch times,
+	// and the global state.
+	rest    map[string][]byte
+	fetched map[string]map[string]int64
+	global  []byte
+}
+
+// pgGlobal is what is stored in yatogm_globals.
+type pgGlobal struct {
+	Destinations   map[string]*DestinationState `json:"destinations,omitempty"`
+	Seeds          map[string]*Seed             `json:"seeds,omitempty"`
+	ClockHighWater time.Time                    `json:"clock_high_water,omitempty"`
+}
+
+// connect returns the connection, making it if needed, with a deadline
+// for the operation about to run.
+func (s *pgStore) connect() (*pgConn, error) {
+	if s.conn == nil {
+		c, err := dialPostgres(s.cfg, s.Timeout)
+		if err != nil {
+			return nil, err
+		}
+		s.conn = c
+	}
+	_ = s.conn.SetDeadline(time.Now().Add(s.Timeout))
+	return s.conn, nil
+}
+
+// reset drops the connection after a failure, so the next operation
+// starts afresh.
+func (s *pgStore) reset() {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+}
+
+// Close closes the connection, if any.
+func (s *pgStore) Close() error {
+	s.reset()
+	return nil
+}
+
+// migrate applies the migrations the database does not have yet, in one
+// transaction, holding a lock so that instances starting together do not
+// apply them twice.
+func (s *pgStore) migrate() error {
+	c, err := s.connect()
+	if err != nil {
+		return err
+	}
+	err = func() error {
+		if err := c.exec(fmt.Sprintf(`BEGIN;
+			SELECT pg_advisory_xact_lock(%d);
+			CREATE TABLE IF NOT EXISTS yatogm_schema_migrations (
+				version    integer PRIMARY KEY,
+				applied_at timestamptz NOT NULL DEFAULT now()
+			);`, migrationLock)); err != nil {
+			return err
+		}
+		rows, err := c.query(`SELECT coalesce(max(version), 0) FROM yatogm_schema_migrations`)
+		if err != nil {
+			return err
+		}
+		version := 0
+		if len(rows) == 1 && rows[0][0] != nil {
+			version, _ = strconv.Atoi(*rows[0][0])
+		}
+		if version > len(migrations) {
+			return fmt.Errorf("the schema is at version %d, newer than this version of yatogm knows (%d)", version, len(migrations))
+		}
+		for v := version + 1; v <= len(migrations); v++ {
+			if err := c.exec(migrations[v-1]); err != nil {
+				return fmt.Errorf("migration %d: %w", v, err)
+			}
+			if _, err := c.query(`INSERT INTO yatogm_schema_migrations (version) VALUES ($1::integer)`, int64(v)); err != nil {
+				return fmt.Errorf("migration %d: %w", v, err)
+			}
+		}
+		return c.exec("COMMIT")
+	}()
+	if err != nil {
+		s.reset()
+	}
+	return err
+}
+
+func (s *pgStore) load(sd *StateData) error {
+	c, err := s.connect()
+	if err != nil {
+		return err
+	}
+	mailboxes, err := c.query(`SELECT mailbox, state::text FROM yatogm_mailboxes WHERE owner = $1::text`, s.Owner)
+	if err != nil {
+		s.reset()
+		return err
+	}
+	fetched, err := c.query(`SELECT mailbox, uid, extract(epoch FROM fetched_at)::bigint FROM yatogm_fetched WHERE owner = $1::text`, s.Owner)
+	if err != nil {
+		s.reset()
+		return err
+	}
+	globals, err := c.query(`SELECT state::text FROM yatogm_globals WHERE owner = $1::text`, s.Owner)
+	if err != nil {
+		s.reset()
+		return err
+	}
+	if len(mailboxes) == 0 && len(fetched) == 0 && len(globals) == 0 {
+		return fs.ErrNotExist
+	}
+
+	loaded := StateData{Mailboxes: make(map[string]*MailboxState, len(mailboxes))}
+	ensure := func(mailbox string) *MailboxState {
+		ms, ok := loaded.Mailboxes[mailbox]
+		if !ok {
+			ms = &MailboxState{}
+			loaded.Mailboxes[mailbox] = ms
+		}
+		return ms
+	}
+	for _, row := range mailboxes {
+		ms := ensure(*row[0])
+		if err := json.Unmarshal([]byte(*row[1]), ms); err != nil {
+			return fmt.Errorf("decoding the state of %s: %w", *row[0], err)
+		}
+	}
+	for _, row := range fetched {
+		ms := ensure(*row[0])
+		if ms.FetchedUIDs == nil {
+			ms.FetchedUIDs = make(map[string]bool)
+			ms.FetchedAt = make(map[string]int64)
+		}
+		ms.FetchedUIDs[*row[1]] = true
+		if row[2] != nil {
+			ms.FetchedAt[*row[1]], _ = strconv.ParseInt(*row[2], 10, 64)
+		}
+	}
+	if len(globals) == 1 {
+		var g pgGlobal
+		if err := json.Unmarshal([]byte(*globals[0][0]), &g); err != nil {
+			return fmt.Errorf("decoding the global state: %w", err)
+		}
+		loaded.Destinations, loaded.Seeds, loaded.ClockHighWater = g.Destinations, g.Seeds, g.ClockHighWater
+	}
+
+	// Remember what was loaded, in the form save compares against.
+	for mailbox, ms := range loaded.Mailboxes {
+		rest, uids, err := splitMailbox(ms)
+		if err != nil {
+			return err
+		}
+		s.rest[mailbox], s.fetched[mailbox] = rest, uids
+	}
+	if s.global, err = json.Marshal(pgGlobal{Destinations: loaded.Destinations, Seeds: loaded.Seeds, ClockHighWater: loaded.ClockHighWater}); err != nil {
+		return fmt.Errorf("marshaling state: %w", err)
+	}
+	*sd = loaded
+	return nil
+}
+
+// splitMailbox separates a mailbox's fetched UIDs, with their fetch times
+// (0 if unknown), from the rest of its state, which it marshals.
+func splitMailbox(ms *MailboxState) ([]byte, map[string]int64, error) {
+	uids := make(map[string]int64, len(ms.FetchedUIDs))
+	for uid := range ms.FetchedUIDs {
+		uids[uid] = ms.FetchedAt[uid]
+	}
+	rest := *ms
+	rest.FetchedUIDs, rest.FetchedAt = nil, nil
+	data, err := json.Marshal(&rest)
+	if err != nil {
+		return nil, nil, fmt.Errorf("marshaling state: %w", err)
+	}
+	return data, uids, nil
+}
+
+// pgMailboxChange is what a save writes for one mailbox.
+type pgMailboxChange struct {
+	mailbox string
+	rest    []byte // nil if unchanged
+	uids    map[string]int64
+	// upsert holds the UIDs added or given another fetch time, and
+	// remove those dropped.
+	upsert []string
+	remove []string
+}
+
+func (s *pgStore) save(sd *StateData) error {
+	var changes []pgMailboxChange
+	for _, mailbox := range slices.Sorted(maps.Keys(sd.Mailboxes)) {
+		rest, uids, err := splitMailbox(sd.Mailboxes[mailbox])
+		if err != nil {
+			return err
+		}
+		ch := pgMailboxChange{mailbox: mailbox, uids: uids}
+		if !bytes.Equal(rest, s.rest[mailbox]) {
+			ch.rest = rest
+		}
+		old := s.fetched[mailbox]
+		for uid, at := range uids {
+			if prev, ok := old[uid]; !ok || prev != at {
+				ch.upsert = append(ch.upsert, uid)
+			}
+		}
+		for uid := range old {
+			if _, ok := uids[uid]; !ok {
+				ch.remove = append(ch.remove, uid)
+			}
+		}
+		if ch.rest != nil || len(ch.upsert) > 0 || len(ch.remove) > 0 {
+			changes = append(changes, ch)
+		}
+	}
+	global, err := json.Marshal(pgGlobal{Destinations: sd.Destinations, Seeds: sd.Seeds, ClockHighWater: sd.ClockHighWater})
+	if err != nil {
+		return fmt.Errorf("marshaling state: %w", err)
+	}
+	globalChanged := !bytes.Equal(global, s.global)
+	if len(changes) == 0 && !globalChanged {
+		return nil
+	}
+	if s.ReadOnly {
+		return errors.New("saving state: the state is open read-only")
+	}
+
+	c, err := s.connect()
+	if err != nil {
+		return err
+	}
+	if err := s.write(c, changes, global, globalChanged); err != nil {
+		s.reset()
+		return fmt.Errorf("saving state: %w", err)
+	}
+
+	for _, ch := range changes {
+		if ch.rest != nil {
+			s.rest[ch.mailbox] = ch.rest
+		}
+		s.fetched[ch.mailbox] = ch.uids
+	}
+	s.global = global
+	return nil
+}
+
+// write applies the changes in one transaction.
+func (s *pgStore) write(c *pgConn, changes []pgMailboxChange, global []byte, globalChanged bool) error {
+	if err := c.exec("BEGIN"); err != nil {
+		return err
+	}
+	for _, ch := range changes {
+		if ch.rest != nil {
+			if _, err := c.query(`INSERT INTO yatogm_mailboxes (owner, mailbox, state) VALUES ($1::text, $2::text, $3::jsonb)
+				ON CONFLICT (owner, mailbox) DO UPDATE SET state = EXCLUDED.state, updated_at = now()`,
+				s.Owner, ch.mailbox, string(ch.rest)); err != nil {
+				return err
+			}
+		}
+		if len(ch.upsert) > 0 {
+			slices.Sort(ch.upsert)
+			// Unknown fetch times, from before they were recorded, are NULL.
+			ats := make([]string, len(ch.upsert))
+			for i, uid := range ch.upsert {
+				ats[i] = "NULL"
+				if at := ch.uids[uid]; at != 0 {
+					ats[i] = strconv.FormatInt(at, 10)
+				}
+			}
+			if _, err := c.query(`INSERT INTO yatogm_fetched (owner, mailbox, uid, fetched_at)
+				SELECT $1::text, $2::text, u, to_timestamp(t) FROM unnest($3::text[], $4::bigint[]) AS x(u, t)
+				ON CONFLICT (owner, mailbox, uid) DO UPDATE SET fetched_at = EXCLUDED.fetched_at`,
+				s.Owner, ch.mailbox, ch.upsert, "{"+strings.Join(ats, ",")+"}"); err != nil {
+				return err
+			}
+		}
+		if len(ch.remove) > 0 {
+			if _, err := c.query(`DELETE FROM yatogm_fetched WHERE owner = $1::text AND mailbox = $2::text AND uid = ANY($3::text[])`,
+				s.Owner, ch.mailbox, ch.remove); err != nil {
+				return err
+			}
+		}
+	}
+	if globalChanged {
+		if _, err := c.query(`INSERT INTO yatogm_globals (owner, state) VALUES ($1::text, $2::jsonb)
+			ON CONFLICT (owner) DO UPDATE SET state = EXCLUDED.state, updated_at = now()`,
+			s.Owner, string(global)); err != nil {
+			return err
+		}
+	}
+	return c.exec("COMMIT")
+}
@@ -0,0 +1,492 @@
+package state
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Redis configures a Tracker that keeps its state in Redis, so that
+// replicas and ephemeral containers can share it. Each mailbox's state is
+// stored as JSON under <prefix>mailbox:<mailbox>, and the rest in the hash
+// <prefix>global, a field for each destination and seed, so that replicas
+// changing different ones do not overwrite each other.
+type Redis struct {
+	// Addr is the server's host:port.
+	Addr string
+	// Username and Password authenticate with AUTH, if Password is set.
+	Username string
+	Password string
+	// DB is the database number to SELECT.
+	DB int
+	// TLS connects over TLS, verifying the server's certificate.
+	TLS bool
+	// Prefix is prepended to every key, such as "yatogm:".
+	Prefix string
+	// TTL, when positive, expires the state of a mailbox that was not
+	// written for this long, such as one removed from the configuration.
+	TTL time.Duration
+	// Persist lists the mailboxes whose state never expires, such as
+	// those on legal hold.
+	Persist []string
+	// Timeout bounds each load and save (default: 10s).
+	Timeout time.Duration
+	// WriteDelay, when positive, defers each save by up to this long, so
+	// that the changes made meanwhile are written together, in one round
+	// trip. Tracker.Flush writes them at once.
+	WriteDelay time.Duration
+}
+
+// NewRedisTracker creates a Tracker saving to the Redis server r
+// describes, loading the state already there.
+func NewRedisTracker(r Redis) (*Tracker, error) {
+	s := &redisStore{Redis: r, written: make(map[string][]byte), fields: make(map[string][]byte)}
+	if s.Timeout <= 0 {
+		s.Timeout = 10 * time.Second
+	}
+	t, err := newTracker(s)
+	if err != nil {
+		return nil, fmt.Errorf("loading state from redis %s: %w", r.Addr, err)
+	}
+	t.delay = r.WriteDelay
+	return t, nil
+}
+
+// Fields of the <prefix>global hash: a JSON value for each destination and
+// seed, under these prefixes, and the clock high water mark.
+const (
+	redisDestinationField = "destination:"
+	redisSeedField        = "seed:"
+	redisClockField       = "clock_high_water"
+)
+
+// redisStore keeps the state in Redis. A connection is made for each load
+// and save, so that a Tracker holds none between them.
+type redisStore struct {
+	Redis
+	// written holds the value last loaded or saved under each key, and
+	// fields under each field of the global hash, so that a save only
+	// writes the keys and fields that changed.
+	written map[string][]byte
+	fields  map[string][]byte
+}
+
+// redisError is an error reply from the server.
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+func (s *redisStore) globalKey() string { return s.Prefix + "global" }
+
+func (s *redisStore) mailboxKey(mailbox string) string { return s.Prefix + "mailbox:" + mailbox }
+
+func (s *redisStore) load(sd *StateData) error {
+	c, err := s.dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	seen := make(map[string]bool)
+	var keys []string
+	cursor := "0"
+	for {
+		reply, err := c.do("SCAN", cursor, "MATCH", globEscape(s.mailboxKey(""))+"*", "COUNT", "1000")
+		if err != nil {
+			return err
+		}
+		page, ok := reply.([]any)
+		if !ok || len(page) != 2 {
+			return fmt.Errorf("redis: unexpected SCAN reply %v", reply)
+		}
+		next, _ := page[0].([]byte)
+		found, _ := page[1].([]any)
+		for _, k := range found {
+			if k, ok := k.([]byte); ok && !seen[string(k)] {
+				seen[string(k)] = true
+				keys = append(keys, string(k))
+			}
+		}
+		if cursor = string(next); cursor == "0" || cursor == "" {
+			break
+		}
+	}
+
+	c.send("HGETALL", s.globalKey())
+	for _, k := range keys {
+		c.send("GET", k)
+	}
+	if err := c.flush(); err != nil {
+		return err
+	}
+	reply, err := c.receive()
+	if err != nil {
+		return err
+	}
+	if err, ok := reply.(redisError); ok {
+		return err
+	}
+	global, _ := reply.([]any)
+	values := make([][]byte, 0, len(keys))
+	for range keys {
+		reply, err := c.receive()
+		if err != nil {
+			return err
+		}
+		v, _ := reply.([]byte)
+		values = append(values, v)
+	}
+
+	if len(global) == 0 && len(keys) == 0 {
+		return fs.ErrNotExist
+	}
+	loaded := StateData{Mailboxes: make(map[string]*MailboxState, len(keys))}
+	fields := make(map[string][]byte, len(global)/2)
+	for i := 0; i+1 < len(global); i += 2 {
+		f, _ := global[i].([]byte)
+		v, _ := global[i+1].([]byte)
+		if err := loaded.decodeRedisField(string(f), v); err != nil {
+			return fmt.Errorf("decoding field %s of %s: %w", f, s.globalKey(), err)
+		}
+		fields[string(f)] = v
+	}
+	for i, k := range keys {
+		v := values[i]
+		if v == nil {
+			// Expired since the scan.
+			continue
+		}
+		var ms MailboxState
+		if err := json.Unmarshal(v, &ms); err != nil {
+			return fmt.Errorf("decoding %s: %w", k, err)
+		}
+		loaded.Mailboxes[strings.TrimPrefix(k, s.mailboxKey(""))] = &ms
+		s.written[k] = v
+	}
+	s.fields = fields
+	*sd = loaded
+	return nil
+}
+
+// decodeRedisField sets the destination, seed, or clock high water mark
+// stored in a field of the global hash. Unknown fields are ignored.
+func (sd *StateData) decodeRedisField(field string, v []byte) error {
+	switch {
+	case field == redisClockField:
+		return json.Unmarshal(v, &sd.ClockHighWater)
+	case strings.HasPrefix(field, redisDestinationField):
+		var ds DestinationState
+		if err := json.Unmarshal(v, &ds); err != nil {
+			return err
+		}
+		if sd.Destinations == nil {
+			sd.Destinations = make(map[string]*DestinationState)
+		}
+		sd.Destinations[strings.TrimPrefix(field, redisDestinationField)] = &ds
+	case strings.HasPrefix(field, redisSeedField):
+		var seed Seed
+		if err := json.Unmarshal(v, &seed); err != nil {
+			return err
+		}
+		if sd.Seeds == nil {
+			sd.Seeds = make(map[string]*Seed)
+		}
+		sd.Seeds[strings.TrimPrefix(field, redisSeedField)] = &seed
+	}
+	return nil
+}
+
+// redisFields returns the fields of the global hash for sd.
+func redisFields(sd *StateData) (map[string][]byte, error) {
+	fields := make(map[string][]byte, len(sd.Destinations)+len(sd.Seeds)+1)
+	for name, ds := range sd.Destinations {
+		v, err := json.Marshal(ds)
+		if err != nil {
+			return nil, err
+		}
+		fields[redisDestinationField+name] = v
+	}
+	for name, seed := range sd.Seeds {
+		v, err := json.Marshal(seed)
+		if err != nil {
+			return nil, err
+		}
+		fields[redisSeedField+name] = v
+	}
+	if !sd.ClockHighWater.IsZero() {
+		v, err := json.Marshal(sd.ClockHighWater)
+		if err != nil {
+			return nil, err
+		}
+		fields[redisClockField] = v
+	}
+	return fields, nil
+}
+
+func (s *redisStore) save(sd *StateData) error {
+	fields, err := redisFields(sd)
+	if err != nil {
+		return fmt.Errorf("marshaling state: %w", err)
+	}
+	values := make(map[string][]byte, len(sd.Mailboxes))
+	for mailbox, ms := range sd.Mailboxes {
+		v, err := json.Marshal(ms)
+		if err != nil {
+			return fmt.Errorf("marshaling state: %w", err)
+		}
+		values[s.mailboxKey(mailbox)] = v
+	}
+
+	var changed, changedFields, removedFields []string
+	for k, v := range values {
+		if old, ok := s.written[k]; !ok || !bytes.Equal(old, v) {
+			changed = append(changed, k)
+		}
+	}
+	for f, v := range fields {
+		if old, ok := s.fields[f]; !ok || !bytes.Equal(old, v) {
+			changedFields = append(changedFields, f)
+		}
+	}
+	// Only the fields this replica loaded or wrote are removed, so that
+	// one added by another replica meanwhile is kept.
+	for f := range s.fields {
+		if _, ok := fields[f]; !ok {
+			removedFields = append(removedFields, f)
+		}
+	}
+	n := len(changed) + len(changedFields) + len(removedFields)
+	if n == 0 {
+		return nil
+	}
+	slices.Sort(changed)
+	slices.Sort(changedFields)
+	slices.Sort(removedFields)
+
+	c, err := s.dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	// Write the changed keys and fields in a transaction, so that a failed
+	// save leaves none of them half-updated. Each destination and seed is
+	// a field of its own, so replicas overwrite each other's changes only
+	// when they change the same one; the clock high water mark is written
+	// by whichever saves last, close enough for detecting a clock that
+	// went back.
+	c.send("MULTI")
+	for _, k := range changed {
+		if ttl := s.ttl(k); ttl > 0 {
+			c.send("SET", k, string(values[k]), "EX", strconv.FormatInt(int64(ttl/time.Second), 10))
+		} else {
+			c.send("SET", k, string(values[k]))
+		}
+	}
+	for _, f := range changedFields {
+		c.send("HSET", s.globalKey(), f, string(fields[f]))
+	}
+	for _, f := range removedFields {
+		c.send("HDEL", s.globalKey(), f)
+	}
+	c.send("EXEC")
+	if err := c.flush(); err != nil {
+		return err
+	}
+	var (
+		reply  any
+		failed error
+	)
+	for range n + 2 {
+		if reply, err = c.receive(); err != nil {
+			return fmt.Errorf("saving state: %w", err)
+		}
+		if err, ok := reply.(redisError); ok && failed == nil {
+			failed = err
+		}
+	}
+	if results, ok := reply.([]any); ok {
+		for _, r := range results {
+			if err, ok := r.(redisError); ok && failed == nil {
+				failed = err
+			}
+		}
+	} else if failed == nil {
+		failed = errors.New("redis: transaction aborted")
+	}
+	if failed != nil {
+		return fmt.Errorf("saving state: %w", failed)
+	}
+
+	for _, k := range changed {
+		s.written[k] = values[k]
+	}
+	s.fields = fields
+	return nil
+}
+
+// ttl returns the expiry of key, or 0 if it never expires.
+func (s *redisStore) ttl(key string) time.Duration {
+	if s.TTL < time.Second || !strings.HasPrefix(key, s.mailboxKey("")) {
+		return 0
+	}
+	if slices.Contains(s.Persist, strings.TrimPrefix(key, s.mailboxKey(""))) {
+		return 0
+	}
+	return s.TTL
+}
+
+// dial connects to the server, authenticates, and selects the database.
+// The whole exchange over the connection must finish within the timeout.
+func (s *redisStore) dial() (*redisConn, error) {
+	d := &net.Dialer{Timeout: s.Timeout}
+	var (
+		conn net.Conn
+		err  error
+	)
+	if s.TLS {
+		host, _, _ := net.SplitHostPort(s.Addr)
+		conn, err = tls.DialWithDialer(d, "tcp", s.Addr, &tls.Config{ServerName: host})
+	} else {
+		conn, err = d.Dial("tcp", s.Addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("connecting to redis: %w", err)
+	}
+	_ = conn.SetDeadline(time.Now().Add(s.Timeout))
+	c := &redisConn{Conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+
+	if s.Password != "" {
+		args := []string{"AUTH", s.Password}
+		if s.Username != "" {
+			args = []string{"AUTH", s.Username, s.Password}
+		}
+		if _, err := c.do(args...); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("authenticating to redis: %w", err)
+		}
+	}
+	if s.DB != 0 {
+		if _, err := c.do("SELECT", strconv.Itoa(s.DB)); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("selecting redis database %d: %w", s.DB, err)
+		}
+	}
+	return c, nil
+}
+
+// redisConn speaks the Redis protocol (RESP2) over a connection.
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+// do sends a command and returns its reply.
+func (c *redisConn) do(args ...string) (any, error) {
+	c.send(args...)
+	if err := c.flush(); err != nil {
+		return nil, err
+	}
+	reply, err := c.receive()
+	if err != nil {
+		return nil, err
+	}
+	if err, ok := reply.(redisError); ok {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// send buffers a command; flush sends the buffered commands.
+func (c *redisConn) send(args ...string) {
+	fmt.Fprintf(c.w, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(c.w, "$%d\r\n%s\r\n", len(a), a)
+	}
+}
+
+func (c *redisConn) flush() error {
+	if err := c.w.Flush(); err != nil {
+		return fmt.Errorf("writing to redis: %w", err)
+	}
+	return nil
+}
+
+// receive reads a reply: a string for a status, a redisError for an
+// error, an int64, a []byte or nil for a bulk string, or a []any or nil
+// for an array. An error reply is returned as a value, not as the error,
+// since replies to pipelined commands must all be read.
+func (c *redisConn) receive() (any, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("reading from redis: %w", err)
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return redisError(line[1:]), nil
+	case ':':
+		n, err := strconv.ParseInt(line[1:], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("redis: bad integer reply %q", line)
+		}
+		return n, nil
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("redis: bad bulk reply %q", line)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, fmt.Errorf("reading from redis: %w", err)
+		}
+		return buf[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("redis: bad array reply %q", line)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]any, n)
+		for i := range items {
+			if items[i], err = c.receive(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
+
+// globEscape escapes the characters special in a SCAN MATCH pattern.
+func globEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`*?[]\`, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,412 @@
+package state
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis is an in-memory Redis server speaking just enough of the
+// protocol for the Redis store.
+type fakeRedis struct {
+	ln       net.Listener
+	password string
+
+	mu     sync.Mutex
+	keys   map[string]string
+	ttls   map[string]int
+	hashes map[string]map[string]string
+	// failSet makes SET and HSET fail with an error reply.
+	failSet bool
+	// sets counts the SET and HSET commands run.
+	sets int
+	// versions counts the writes to each key, for WATCH.
+	versions map[string]int
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{ln: ln, password: password, keys: make(map[string]string), ttls: make(map[string]int), hashes: make(map[string]map[string]string), versions: make(map[string]int)}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	authed := f.password == ""
+	var queued [][]string
+	inMulti := false
+	watched := make(map[string]int)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(args[0])
+		switch {
+		case cmd == "AUTH":
+			if args[len(args)-1] != f.password {
+				fmt.Fprint(conn, "-WRONGPASS invalid password\r\n")
+				continue
+			}
+			authed = true
+			fmt.Fprint(conn, "+OK\r\n")
+		case !authed:
+			fmt.Fprint(conn, "-NOAUTH Authentication required.\r\n")
+		case cmd == "MULTI":
+			inMulti = true
+			fmt.Fprint(conn, "+OK\r\n")
+		case cmd == "WATCH":
+			f.mu.Lock()
+			for _, k := range args[1:] {
+				watched[k] = f.versions[k]
+			}
+			f.mu.Unlock()
+			fmt.Fprint(conn, "+OK\r\n")
+		case cmd == "UNWATCH":
+			clear(watched)
+			fmt.Fprint(conn, "+OK\r\n")
+		case cmd == "EXEC":
+			f.mu.Lock()
+			touched := false
+			for k, v := range watched {
+				touched = touched || f.versions[k] != v
+			}
+			f.mu.Unlock()
+			if touched {
+				fmt.Fprint(conn, "*-1\r\n")
+			} else {
+				fmt.Fprintf(conn, "*%d\r\n", len(queued))
+				for _, q := range queued {
+					fmt.Fprint(conn, f.exec(q))
+				}
+			}
+			queued, inMulti = nil, false
+			clear(watched)
+		case inMulti:
+			queued = append(queued, args)
+			fmt.Fprint(conn, "+QUEUED\r\n")
+		default:
+			fmt.Fprint(conn, f.exec(args))
+		}
+	}
+}
+
+func (f *fakeRedis) exec(args []string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch strings.ToUpper(args[0]) {
+	case "SELECT":
+		return "+OK\r\n"
+	case "GET":
+		v, ok := f.keys[args[1]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+	case "SET":
+		if f.failSet {
+			return "-OOM command not allowed\r\n"
+		}
+		f.sets++
+		f.versions[args[1]]++
+		f.keys[args[1]] = args[2]
+		delete(f.ttls, args[1])
+		// The TTL is kept in the unit of EX or PX.
+		if len(args) == 5 && (strings.ToUpper(args[3]) == "EX" || strings.ToUpper(args[3]) == "PX") {
+			f.ttls[args[1]], _ = strconv.Atoi(args[4])
+		}
+		return "+OK\r\n"
+	case "HSET":
+		if f.failSet {
+			return "-OOM command not allowed\r\n"
+		}
+		f.sets++
+		if f.hashes[args[1]] == nil {
+			f.hashes[args[1]] = make(map[string]string)
+		}
+		f.hashes[args[1]][args[2]] = args[3]
+		return ":1\r\n"
+	case "HDEL":
+		delete(f.hashes[args[1]], args[2])
+		return ":1\r\n"
+	case "HGETALL":
+		h := f.hashes[args[1]]
+		s := fmt.Sprintf("*%d\r\n", 2*len(h))
+		for k, v := range h {
+			s += fmt.Sprintf("$%d\r\n%s\r\n$%d\r\n%s\r\n", len(k), k, len(v), v)
+		}
+		return s
+	case "SCAN":
+		pattern := strings.ReplaceAll(args[3], `\`, "")
+		var out []string
+		for k := range f.keys {
+			if ok, _ := path.Match(pattern, k); ok {
+				out = append(out, k)
+			}
+		}
+		s := fmt.Sprintf("*2\r\n$1\r\n0\r\n*%d\r\n", len(out))
+		for _, k := range out {
+			s += fmt.Sprintf("$%d\r\n%s\r\n", len(k), k)
+		}
+		return s
+	}
+	return "-ERR unknown command\r\n"
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+	args := make([]string, n)
+	for i := range args {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func TestRedisTracker(t *testing.T) {
+	srv := newFakeRedis(t, "secret")
+	opts := Redis{
+		Addr:     srv.ln.Addr().String(),
+		Password: "secret",
+		Prefix:   "yatogm:",
+		TTL:      30 * 24 * time.Hour,
+		Persist:  []string{"held@yahoo.com"},
+	}
+
+	tracker, err := NewRedisTracker(opts)
+	if err != nil {
+		t.Fatalf("NewRedisTracker: %v", err)
+	}
+	if err := tracker.MarkFetched("user@yahoo.com", "uid1"); err != nil {
+		t.Fatalf("MarkFetched: %v", err)
+	}
+	if err := tracker.MarkFetched("held@yahoo.com", "uid9"); err != nil {
+		t.Fatalf("MarkFetched: %v", err)
+	}
+	if err := tracker.SetDestination("gmail", DestinationState{Concurrency: 2}); err != nil {
+		t.Fatalf("SetDestination: %v", err)
+	}
+	if err := tracker.SetSeed("gmail", []string{"<a@example.com>"}, time.Now()); err != nil {
+		t.Fatalf("SetSeed: %v", err)
+	}
+
+	srv.mu.Lock()
+	if got := srv.ttls["yatogm:mailbox:user@yahoo.com"]; got != 30*24*60*60 {
+		t.Errorf("TTL of user@yahoo.com = %d, want 30 days", got)
+	}
+	if _, ok := srv.ttls["yatogm:mailbox:held@yahoo.com"]; ok {
+		t.Error("state of a persisted mailbox should not expire")
+	}
+	for _, f := range []string{"destination:gmail", "seed:gmail", "clock_high_water"} {
+		if _, ok := srv.hashes["yatogm:global"][f]; !ok {
+			t.Errorf("expected field %s of yatogm:global to be written", f)
+		}
+	}
+	srv.mu.Unlock()
+
+	// A second replica sees the same state.
+	other, err := NewRedisTracker(opts)
+	if err != nil {
+		t.Fatalf("NewRedisTracker: %v", err)
+	}
+	if !other.IsFetched("user@yahoo.com", "uid1") || !other.IsFetched("held@yahoo.com", "uid9") {
+		t.Error("expected fetched UIDs to be shared")
+	}
+	if ds, ok := other.Destination("gmail"); !ok || ds.Concurrency != 2 {
+		t.Errorf("Destination(gmail) = %+v, %v", ds, ok)
+	}
+	if !other.IsSeeded("gmail", "<a@example.com>") {
+		t.Error("expected the seeded Message-IDs to be shared")
+	}
+
+	// Another prefix is another state.
+	opts.Prefix = "other:"
+	fresh, err := NewRedisTracker(opts)
+	if err != nil {
+		t.Fatalf("NewRedisTracker: %v", err)
+	}
+	if fresh.IsFetched("user@yahoo.com", "uid1") {
+		t.Error("expected no state under another prefix")
+	}
+}
+
+func TestRedisReplicasShareGlobal(t *testing.T) {
+	srv := newFakeRedis(t, "")
+	opts := Redis{Addr: srv.ln.Addr().String(), Prefix: "yatogm:"}
+
+	// Both replicas load the state before either writes.
+	one, err := NewRedisTracker(opts)
+	if err != nil {
+		t.Fatalf("NewRedisTracker: %v", err)
+	}
+	two, err := NewRedisTracker(opts)
+	if err != nil {
+		t.Fatalf("NewRedisTracker: %v", err)
+	}
+	if err := one.SetDestination("gmail", DestinationState{Concurrency: 2}); err != nil {
+		t.Fatalf("SetDestination: %v", err)
+	}
+	if err := two.SetDestination("work", DestinationState{Concurrency: 3}); err != nil {
+		t.Fatalf("SetDestination: %v", err)
+	}
+	if err := two.SetSeed("work", []string{"<a@example.com>"}, time.Now()); err != nil {
+		t.Fatalf("SetSeed: %v", err)
+	}
+	if err := one.MarkFetched("user@yahoo.com", "uid1"); err != nil {
+		t.Fatalf("MarkFetched: %v", err)
+	}
+
+	// Neither replica's save undid the other's changes.
+	again, err := NewRedisTracker(opts)
+	if err != nil {
+		t.Fatalf("NewRedisTracker: %v", err)
+	}
+	if ds, ok := again.Destination("gmail"); !ok || ds.Concurrency != 2 {
+		t.Errorf("Destination(gmail) = %+v, %v", ds, ok)
+	}
+	if ds, ok := again.Destination("work"); !ok || ds.Concurrency != 3 {
+		t.Errorf("Destination(work) = %+v, %v", ds, ok)
+	}
+	if !again.IsSeeded("work", "<a@example.com>") {
+		t.Error("expected the seed written by the other replica to be kept")
+	}
+}
+
+func TestRedisTrackerErrors(t *testing.T) {
+	srv := newFakeRedis(t, "secret")
+
+	if _, err := NewRedisTracker(Redis{Addr: srv.ln.Addr().String(), Password: "wrong"}); err == nil {
+		t.Error("expected a wrong password to fail")
+	}
+
+	tracker, err := NewRedisTracker(Redis{Addr: srv.ln.Addr().String(), Password: "secret"})
+	if err != nil {
+		t.Fatalf("NewRedisTracker: %v", err)
+	}
+	srv.mu.Lock()
+	srv.failSet = true
+	srv.mu.Unlock()
+	if err := tracker.MarkFetched("user@yahoo.com", "uid1"); err == nil || !strings.Contains(err.Error(), "OOM") {
+		t.Errorf("MarkFetched = %v, want the server's error", err)
+	}
+
+	// The failed write is retried with the next save.
+	srv.mu.Lock()
+	srv.failSet = false
+	srv.mu.Unlock()
+	if err := tracker.MarkFetched("user@yahoo.com", "uid2"); err != nil {
+		t.Fatalf("MarkFetched: %v", err)
+	}
+	again, err := NewRedisTracker(Redis{Addr: srv.ln.Addr().String(), Password: "secret"})
+	if err != nil {
+		t.Fatalf("NewRedisTracker: %v", err)
+	}
+	if !again.IsFetched("user@yahoo.com", "uid1") {
+		t.Error("expected uid1 to be saved with the next write")
+	}
+}
+
+func TestRedisWriteDelay(t *testing.T) {
+	srv := newFakeRedis(t, "")
+	opts := Redis{Addr: srv.ln.Addr().String(), Prefix: "yatogm:", WriteDelay: time.Hour}
+
+	tracker, err := NewRedisTracker(opts)
+	if err != nil {
+		t.Fatalf("NewRedisTracker: %v", err)
+	}
+	for _, uid := range []string{"uid1", "uid2", "uid3"} {
+		if err := tracker.MarkFetched("user@yahoo.com", uid); err != nil {
+			t.Fatalf("MarkFetched: %v", err)
+		}
+	}
+	if !tracker.IsFetched("user@yahoo.com", "uid3") {
+		t.Error("expected deferred changes to be read back")
+	}
+	srv.mu.Lock()
+	if srv.sets != 0 {
+		t.Errorf("expected no write before the delay, got %d", srv.sets)
+	}
+	srv.failSet = true
+	srv.mu.Unlock()
+
+	// A failed flush keeps the changes for the next one.
+	if err := tracker.Flush(); err == nil {
+		t.Error("expected the flush to fail")
+	}
+	srv.mu.Lock()
+	srv.failSet = false
+	srv.sets = 0
+	srv.mu.Unlock()
+	if err := tracker.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	srv.mu.Lock()
+	if srv.sets != 2 {
+		t.Errorf("expected the mailbox and global keys written once, got %d writes", srv.sets)
+	}
+	srv.mu.Unlock()
+	other, err := NewRedisTracker(opts)
+	if err != nil {
+		t.Fatalf("NewRedisTracker: %v", err)
+	}
+	if !other.IsFetched("user@yahoo.com", "uid3") {
+		t.Error("expected the flushed changes to be saved")
+	}
+
+	// Once the delay is over, the changes are written without a flush.
+	opts.WriteDelay = 10 * time.Millisecond
+	tracker, err = NewRedisTracker(opts)
+	if err != nil {
+		t.Fatalf("NewRedisTracker: %v", err)
+	}
+	if err := tracker.MarkFetched("user@yahoo.com", "uid4"); err != nil {
+		t.Fatalf("MarkFetched: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		srv.mu.Lock()
+		saved := strings.Contains(srv.keys["yatogm:mailbox:user@yahoo.com"], "uid4")
+		srv.mu.Unlock()
+		if saved {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the deferred change to be written")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,122 @@
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// NewShardedTracker creates a Tracker keeping the throttling state in the
+// file at filePath and the state of each mailbox in its own file, in the
+// directory filePath + ".d". A mailbox's file is read when the mailbox is
+// first used, and written only when the mailbox changed, so that a large
+// state costs only for the mailboxes a run handles. Mailboxes found in the
+// file at filePath, as saved by a Tracker from NewTracker, are moved to
+// their own files on the next save; NewTracker reads a sharded state back.
+func NewShardedTracker(filePath string, opts ...FileOption) (*Tracker, error) {
+	t, err := newTracker(shardStore(newFileStore(filePath, opts)))
+	if err != nil {
+		return nil, fmt.Errorf("loading state from %s: %w", filePath, err)
+	}
+	return t, nil
+}
+
+// shardStore keeps the state in a JSON file and the state of each mailbox
+// in a JSON file of its own, named after the escaped mailbox, in the
+// directory beside it.
+type shardStore fileStore
+
+func (s shardStore) dir() string { return s.path + ".d" }
+
+func (s shardStore) mailboxPath(mailbox string) string {
+	return filepath.Join(s.dir(), url.PathEscape(mailbox)+".json")
+}
+
+// load reads the state file, with the mailboxes it still holds from
+// before the state was sharded.
+func (s shardStore) load(sd *StateData) error {
+	loaded, err := readStateFile[StateData](fileStore(s), s.path)
+	if err != nil {
+		return err
+	}
+	if !loaded.Sharded && loaded.Mailboxes != nil {
+		*sd = loaded
+		return nil
+	}
+	sd.Destinations, sd.Seeds, sd.ClockHighWater = loaded.Destinations, loaded.Seeds, loaded.ClockHighWater
+	return nil
+}
+
+func (s shardStore) loadMailbox(mailbox string) (*MailboxState, error) {
+	ms, err := readStateFile[*MailboxState](fileStore(s), s.mailboxPath(mailbox))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	return ms, err
+}
+
+func (s shardStore) mailboxes() ([]string, error) {
+	entries, err := os.ReadDir(s.dir())
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var mailboxes []string
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok || e.IsDir() {
+			continue
+		}
+		if mailbox, err := url.PathUnescape(name); err == nil {
+			mailboxes = append(mailboxes, mailbox)
+		}
+	}
+	return mailboxes, nil
+}
+
+func (s shardStore) save(sd *StateData) error {
+	mailboxes := make([]string, 0, len(sd.Mailboxes))
+	for mailbox := range sd.Mailboxes {
+		mailboxes = append(mailboxes, mailbox)
+	}
+	return s.saveMailboxes(sd, mailboxes)
+}
+
+// saveMailboxes writes the file of each of the given mailboxes, then the
+// state file without any mailbox, so that a mailbox moved out of the state
+// file is only dropped from it once written apart.
+func (s shardStore) saveMailboxes(sd *StateData, mailboxes []string) error {
+	if len(mailboxes) > 0 {
+		if err := os.MkdirAll(s.dir(), 0700); err != nil {
+			return fmt.Errorf("creating state directory: %w", err)
+		}
+	}
+	for _, mailbox := range mailboxes {
+		data, err := json.Marshal(sd.Mailboxes[mailbox])
+		if err != nil {
+			return fmt.Errorf("marshaling state: %w", err)
+		}
+		if err := writeStateFile(fileStore(s), s.mailboxPath(mailbox), data); err != nil {
+			return err
+		}
+	}
+
+	data, err := json.MarshalIndent(StateData{
+		Mailboxes:      map[string]*MailboxState{},
+		Destinations:   sd.Destinations,
+		Seeds:          sd.Seeds,
+		ClockHighWater: sd.ClockHighWater,
+		Sharded:        true,
+	}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshaling state: %w", err)
+	}
+	return writeStateFile(fileStore(s), s.path, data)
+}
@@ -0,0 +1,105 @@
+package state
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestShardedTracker(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+
+	// A state saved whole is split on the first save.
+	whole, err := NewTracker(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range []string{"a@yahoo.com", "b/c@yahoo.com"} {
+		if err := whole.MarkFetched(m, "uid1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sharded, err := NewShardedTracker(stateFile)
+	if err != nil {
+		t.Fatalf("NewShardedTracker: %v", err)
+	}
+	if err := sharded.MarkFetched("a@yahoo.com", "uid2"); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a@yahoo.com.json", "b%2Fc@yahoo.com.json"} {
+		if _, err := os.Stat(filepath.Join(stateFile+".d", name)); err != nil {
+			t.Errorf("expected the mailbox file %s: %v", name, err)
+		}
+	}
+	data, err := os.ReadFile(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ = unseal(data)
+	var sd StateData
+	if err := json.Unmarshal(data, &sd); err != nil {
+		t.Fatal(err)
+	}
+	if !sd.Sharded || len(sd.Mailboxes) != 0 {
+		t.Errorf("expected the state file without mailboxes, got %s", data)
+	}
+
+	// Mailboxes are loaded when first used, and only changed ones saved.
+	sharded, err = NewShardedTracker(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sharded.data.Mailboxes) != 0 {
+		t.Errorf("expected no mailbox loaded up front, got %d", len(sharded.data.Mailboxes))
+	}
+	if !sharded.IsFetched("a@yahoo.com", "uid2") || len(sharded.data.Mailboxes) != 1 {
+		t.Errorf("expected only a@yahoo.com loaded, got %d mailboxes", len(sharded.data.Mailboxes))
+	}
+	other := filepath.Join(stateFile+".d", "b%2Fc@yahoo.com.json")
+	if err := os.Remove(other); err != nil {
+		t.Fatal(err)
+	}
+	if err := sharded.MarkFetched("a@yahoo.com", "uid3"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(other); !os.IsNotExist(err) {
+		t.Errorf("expected the unchanged mailbox not saved, got %v", err)
+	}
+
+	// NewTracker reads a sharded state whole.
+	if err := sharded.MarkFetched("b/c@yahoo.com", "uid4"); err != nil {
+		t.Fatal(err)
+	}
+	whole, err = NewTracker(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats := whole.Stats(); stats["a@yahoo.com"] != 3 || stats["b/c@yahoo.com"] != 1 {
+		t.Errorf("Stats = %v", stats)
+	}
+	if stats := sharded.Stats(); len(stats) != 2 {
+		t.Errorf("expected every mailbox counted, got %v", stats)
+	}
+}
+
+func TestShardedTrackerUnreadable(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	// A directory where the mailbox's file should be cannot be read.
+	if err := os.MkdirAll(filepath.Join(stateFile+".d", "a@yahoo.com.json"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	tracker, err := NewShardedTracker(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tracker.Load("a@yahoo.com"); err == nil {
+		t.Fatal("expected an unreadable mailbox to fail to load")
+	}
+	if err := tracker.MarkFetched("a@yahoo.com", "uid1"); err == nil {
+		t.Error("expected the unloaded mailbox not to be saved")
+	}
+	if err := tracker.Load("b@yahoo.com"); err != nil {
+		t.Errorf("expected a mailbox without state to load, got %v", err)
+	}
+}
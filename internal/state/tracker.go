@@ -3,54 +3,341 @@ package state
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"os"
-	"path/filepath"
+	"io"
+	"io/fs"
+	"maps"
+	"slices"
+	"strings"
 	"sync"
+	"time"
 )
 
 // Tracker persists the set of fetched email UIDs per mailbox.
 type Tracker struct {
-	mu       sync.Mutex
-	filePath string
-	data     StateData
+	mu    sync.Mutex
+	store store
+	data  StateData
+	// With a mailboxStore, looked records the mailboxes whose state was
+	// looked for, failed why those that could not be loaded, and dirty
+	// those changed since the last save.
+	looked map[string]bool
+	failed map[string]error
+	dirty  map[string]bool
+	// With a write delay, saves are deferred and the changes made
+	// meanwhile written together: pending records that there are unsaved
+	// changes, and timer writes them once the delay is over.
+	delay   time.Duration
+	pending bool
+	timer   *time.Timer
 }
 
-// StateData holds the fetched UIDs per mailbox (keyed by email address).
+// store loads and saves the state of a Tracker.
+type store interface {
+	// load reads the saved state into sd, returning an error matching
+	// fs.ErrNotExist if there is none yet.
+	load(sd *StateData) error
+	save(sd *StateData) error
+}
+
+// mailboxStore is a store keeping the state of each mailbox apart, which
+// a Tracker loads when the mailbox is first used and saves only when it
+// changed. Its load may leave out any mailbox.
+type mailboxStore interface {
+	store
+	// loadMailbox reads the saved state of mailbox, or returns nil if
+	// there is none.
+	loadMailbox(mailbox string) (*MailboxState, error)
+	// mailboxes lists the mailboxes with saved state.
+	mailboxes() ([]string, error)
+	// saveMailboxes saves the state of the given mailboxes, and the rest
+	// of sd but its other mailboxes.
+	saveMailboxes(sd *StateData, mailboxes []string) error
+}
+
+// StateData holds the fetched UIDs per mailbox (keyed by email address),
+// the throttling state per destination, and the messages found in each
+// destination before the first run.
 type StateData struct {
-	Mailboxes map[string]*MailboxState `json:"mailboxes"`
+	Mailboxes    map[string]*MailboxState     `json:"mailboxes"`
+	Destinations map[string]*DestinationState `json:"destinations,omitempty"`
+	// Seeds holds, per destination, the Message-IDs it had before the
+	// first run, which are not delivered to it again.
+	Seeds map[string]*Seed `json:"seeds,omitempty"`
+	// ClockHighWater is the latest wall-clock time at which the state was
+	// saved. A current time well before it means the clock was set back
+	// or has not been synchronized yet.
+	ClockHighWater time.Time `json:"clock_high_water,omitempty"`
+	// Sharded marks a state file whose mailboxes are kept apart, each in
+	// its own file (see NewShardedTracker).
+	Sharded bool `json:"sharded,omitempty"`
 }
 
 // MailboxState holds the state for a single mailbox.
 type MailboxState struct {
 	FetchedUIDs map[string]bool `json:"fetched_uids"`
+	// FetchedAt holds when each UID was recorded as fetched, in Unix
+	// seconds, so that old UIDs can be pruned. UIDs recorded before it
+	// existed are given the time of the first prune.
+	FetchedAt map[string]int64 `json:"fetched_at,omitempty"`
+	// FirstSeen holds, for mailboxes with a retention period, when each UID
+	// was first listed on the server, in Unix seconds.
+	FirstSeen map[string]int64 `json:"first_seen,omitempty"`
+	// Skipped holds the size in bytes of each UID left on the server for
+	// exceeding the maximum message size.
+	Skipped map[string]int64 `json:"skipped,omitempty"`
+	// Dates holds the Date header, in Unix seconds, of each UID left on
+	// the server for being dated outside the mailbox's since and before.
+	Dates map[string]int64 `json:"dates,omitempty"`
+	// Failures counts, per UID, the runs in which Gmail rejected the
+	// message, until it is forwarded or quarantined.
+	Failures map[string]int `json:"failures,omitempty"`
+	// Delivered holds, for messages sent to several destinations, the
+	// destinations each UID was delivered to until it is fetched, so that
+	// a retry only goes to those that failed.
+	Delivered map[string][]string `json:"delivered,omitempty"`
+	// Quarantined holds when each UID was written to the quarantine
+	// directory, in Unix seconds. Quarantined messages are not retried.
+	Quarantined map[string]int64 `json:"quarantined,omitempty"`
+	// DailyTransfer and MonthlyTransfer count the bytes moved for the
+	// mailbox, keyed by local date ("2006-01-02") and month ("2006-01").
+	DailyTransfer   map[string]Transfer `json:"daily_transfer,omitempty"`
+	MonthlyTransfer map[string]Transfer `json:"monthly_transfer,omitempty"`
+	// LastReceived is when a run last found new mail in the mailbox, and
+	// StaleAlerted when it was last reported as stale, in Unix seconds.
+	LastReceived int64 `json:"last_received,omitempty"`
+	StaleAlerted int64 `json:"stale_alerted,omitempty"`
+	// Latencies holds the forwarding latency of recently forwarded
+	// messages, oldest first.
+	Latencies []Latency `json:"latencies,omitempty"`
+	// MonthlyRuns counts the runs over the mailbox and their outcomes,
+	// keyed by local month ("2006-01").
+	MonthlyRuns map[string]RunCounts `json:"monthly_runs,omitempty"`
+	// Threads holds, for mailboxes whose messages are routed to several
+	// addresses, the address each recent message ID was routed to, so that
+	// follow-ups land with the rest of their thread.
+	Threads map[string]ThreadRoute `json:"threads,omitempty"`
+	// Senders holds, with sender reputation enabled, the history of the
+	// messages from each sender, keyed by lowercased address.
+	Senders map[string]SenderStats `json:"senders,omitempty"`
+	// Checkpoint is, for mailboxes synced differentially, the last message
+	// up to which everything listed was handled.
+	Checkpoint *Checkpoint `json:"checkpoint,omitempty"`
+}
+
+// Checkpoint marks the position in the server's listing of a mailbox up to
+// which every message was handled, so that a differential run only
+// examines the messages listed after it.
+type Checkpoint struct {
+	// UID is the last handled message.
+	UID string `json:"uid"`
+	// Position is the number of messages listed up to and including UID
+	// when it was set. Servers list messages in arrival order, so UID
+	// found further down means messages were inserted before it.
+	Position int `json:"position"`
+	// At is when the checkpoint was set, and ReconciledAt when a run last
+	// examined every message, in Unix seconds.
+	At           int64 `json:"at"`
+	ReconciledAt int64 `json:"reconciled_at,omitempty"`
+}
+
+// SenderStats is the history of the messages one sender sent to a
+// mailbox.
+type SenderStats struct {
+	// Messages counts the messages handled, forwarded or archived.
+	Messages int `json:"messages"`
+	// Spam counts those the source classified as spam.
+	Spam int `json:"spam"`
+	// Quarantined counts the messages quarantined after repeated
+	// rejections.
+	Quarantined int `json:"quarantined"`
+	// LastSeen is when a message from the sender was last counted, in
+	// Unix seconds.
+	LastSeen int64 `json:"last_seen"`
+}
+
+// ThreadRoute is the address a message was routed to.
+type ThreadRoute struct {
+	To string `json:"to"`
+	// At is when the message was routed, in Unix seconds.
+	At int64 `json:"at"`
+}
+
+// RunCounts counts runs over a mailbox and their outcomes.
+type RunCounts struct {
+	Runs int `json:"runs"`
+	// FailedRuns counts the runs with at least one error.
+	FailedRuns int `json:"failed_runs"`
+	Forwarded  int `json:"forwarded"`
+	Errors     int `json:"errors"`
+}
+
+// Latency is how long after the time in its Date header a message was
+// forwarded.
+type Latency struct {
+	// At is when the message was forwarded, in Unix seconds.
+	At      int64 `json:"at"`
+	Seconds int64 `json:"seconds"`
 }
 
+// Transfer counts message bytes downloaded from the source mailbox and
+// uploaded to the destination.
+type Transfer struct {
+	Downloaded int64 `json:"downloaded"`
+	Uploaded   int64 `json:"uploaded"`
+}
+
+// Total returns the bytes transferred in both directions.
+func (t Transfer) Total() int64 {
+	return t.Downloaded + t.Uploaded
+}
+
+const (
+	dayKey   = "2006-01-02"
+	monthKey = "2006-01"
+	// transferDays and transferMonths bound the transfer history kept per
+	// mailbox.
+	transferDays   = 62
+	transferMonths = 24
+	// latencyAge and latencySamples bound the latency history kept per
+	// mailbox.
+	latencyAge     = 7 * 24 * time.Hour
+	latencySamples = 1000
+	// threadAge bounds the thread routes kept per mailbox: a follow-up
+	// more than this long after the message it answers is routed anew.
+	threadAge = 90 * 24 * time.Hour
+	// senderAge bounds the sender history kept per mailbox: a sender
+	// silent for this long starts over.
+	senderAge = 365 * 24 * time.Hour
+)
+
+// DestinationState remembers how a destination throttled us, so that the
+// next run does not immediately retry into a known rate-limit window.
+type DestinationState struct {
+	// DeferredUntil is the earliest time deliveries should be attempted again.
+	DeferredUntil time.Time `json:"deferred_until"`
+	// Cooldown is the deferral last applied; it grows on repeated throttling.
+	Cooldown time.Duration `json:"cooldown,omitempty"`
+	// Concurrency and Delay are the reduced bound and pause to resume with.
+	Concurrency int           `json:"concurrency,omitempty"`
+	Delay       time.Duration `json:"delay,omitempty"`
+}
+
+// Seed records the messages a destination had before the first run, such
+// as mail forwarded to it by hand before the migration.
+type Seed struct {
+	// At is when the destination was scanned.
+	At time.Time `json:"at"`
+	// MessageIDs holds the Message-IDs found, without angle brackets.
+	MessageIDs map[string]bool `json:"message_ids,omitempty"`
+}
+
+// FileOption configures a Tracker saving to files.
+type FileOption func(*fileStore)
+
 // NewTracker creates a new Tracker, loading existing state from disk if available.
-func NewTracker(filePath string) (*Tracker, error) {
+func NewTracker(filePath string, opts ...FileOption) (*Tracker, error) {
+	t, err := newTracker(newFileStore(filePath, opts))
+	if err != nil {
+		return nil, fmt.Errorf("loading state from %s: %w", filePath, err)
+	}
+	return t, nil
+}
+
+// newTracker creates a Tracker saving to s, loading its state if any.
+func newTracker(s store) (*Tracker, error) {
 	t := &Tracker{
-		filePath: filePath,
+		store: s,
 		data: StateData{
 			Mailboxes: make(map[string]*MailboxState),
 		},
 	}
 
-	if err := t.load(); err != nil {
-		// If file doesn't exist, start fresh.
-		if !os.IsNotExist(err) {
-			return nil, fmt.Errorf("loading state from %s: %w", filePath, err)
+	if err := s.load(&t.data); err != nil {
+		// If there is no saved state yet, start fresh.
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+	if _, ok := s.(mailboxStore); ok {
+		t.looked = make(map[string]bool)
+		t.failed = make(map[string]error)
+		t.dirty = make(map[string]bool)
+		// Mailboxes loaded up front, from before the state was split,
+		// are saved apart on the next save.
+		for mailbox := range t.data.Mailboxes {
+			t.looked[mailbox], t.dirty[mailbox] = true, true
 		}
 	}
 
 	return t, nil
 }
 
+// Corrupted returns the corrupted state files the Tracker went on without
+// since the last call.
+func (t *Tracker) Corrupted() []Corruption {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var f fileStore
+	switch s := t.store.(type) {
+	case fileStore:
+		f = s
+	case shardStore:
+		f = fileStore(s)
+	default:
+		return nil
+	}
+	corrupted := *f.corrupted
+	*f.corrupted = nil
+	return corrupted
+}
+
+// Load loads the state of mailbox, if its store loads each mailbox when
+// first used, and returns why it could not. Until then, the mailbox reads
+// as having no state, and changes to it are not saved.
+func (t *Tracker) Load(mailbox string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.lookup(mailbox)
+	return t.failed[mailbox]
+}
+
+// Reload reads the saved state again, so that a Tracker kept open only to
+// read the state, as the observer's is, sees what was saved since. Changes
+// not saved yet are dropped.
+func (t *Tracker) Reload() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	data := StateData{Mailboxes: make(map[string]*MailboxState)}
+	if err := t.store.load(&data); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if t.timer != nil {
+		t.timer.Stop()
+		t.timer = nil
+	}
+	t.data, t.pending = data, false
+	if t.looked != nil {
+		clear(t.looked)
+		clear(t.failed)
+		clear(t.dirty)
+		for mailbox := range t.data.Mailboxes {
+			t.looked[mailbox] = true
+		}
+	}
+	return nil
+}
+
 // IsFetched returns true if the given UID has been fetched for the given mailbox.
 func (t *Tracker) IsFetched(mailbox, uid string) bool {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 
-	ms, ok := t.data.Mailboxes[mailbox]
+	ms, ok := t.lookup(mailbox)
 	if !ok {
 		return false
 	}
@@ -62,44 +349,608 @@ func (t *Tracker) MarkFetched(mailbox, uid string) error {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 
-	ms, ok := t.data.Mailboxes[mailbox]
+	ms := t.mailbox(mailbox)
+	ms.FetchedUIDs[uid] = true
+	ms.FetchedAt[uid] = time.Now().Unix()
+	delete(ms.Skipped, uid)
+	delete(ms.Dates, uid)
+	delete(ms.Failures, uid)
+	delete(ms.Delivered, uid)
+
+	return t.save()
+}
+
+// MarkBatchFetched marks multiple UIDs as fetched and persists once.
+func (t *Tracker) MarkBatchFetched(mailbox string, uids []string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ms := t.mailbox(mailbox)
+	now := time.Now().Unix()
+	for _, uid := range uids {
+		ms.FetchedUIDs[uid] = true
+		ms.FetchedAt[uid] = now
+	}
+
+	return t.save()
+}
+
+// MarkSeen records now as the first-seen time of each UID that does not
+// have one yet, persisting only if anything changed.
+func (t *Tracker) MarkSeen(mailbox string, uids []string, now time.Time) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ms := t.mailbox(mailbox)
+	if ms.FirstSeen == nil {
+		ms.FirstSeen = make(map[string]int64)
+	}
+	changed := false
+	for _, uid := range uids {
+		if _, ok := ms.FirstSeen[uid]; !ok {
+			ms.FirstSeen[uid] = now.Unix()
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	return t.save()
+}
+
+// FirstSeen returns when the given UID was first seen, as recorded by
+// MarkSeen.
+func (t *Tracker) FirstSeen(mailbox, uid string) (time.Time, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ms, ok := t.lookup(mailbox)
 	if !ok {
-		ms = &MailboxState{
-			FetchedUIDs: make(map[string]bool),
+		return time.Time{}, false
+	}
+	sec, ok := ms.FirstSeen[uid]
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(sec, 0), true
+}
+
+// MarkSkipped records that the given UID of size bytes was skipped for
+// being too large, and persists to disk.
+func (t *Tracker) MarkSkipped(mailbox, uid string, size int64) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ms := t.mailbox(mailbox)
+	if ms.Skipped == nil {
+		ms.Skipped = make(map[string]int64)
+	}
+	ms.Skipped[uid] = size
+
+	return t.save()
+}
+
+// IsSkipped returns true if the given UID was recorded by MarkSkipped and
+// has not been fetched since.
+func (t *Tracker) IsSkipped(mailbox, uid string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ms, ok := t.lookup(mailbox)
+	if !ok {
+		return false
+	}
+	_, ok = ms.Skipped[uid]
+	return ok
+}
+
+// RecordDates records the date of each UID in dates, left on the server
+// for its date, and forgets those of UIDs not in listed, which the server
+// no longer lists, persisting only if anything changed.
+func (t *Tracker) RecordDates(mailbox string, dates map[string]time.Time, listed []string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ms := t.mailbox(mailbox)
+	changed := false
+	if len(ms.Dates) > 0 {
+		on := make(map[string]bool, len(listed))
+		for _, uid := range listed {
+			on[uid] = true
 		}
-		t.data.Mailboxes[mailbox] = ms
+		for uid := range ms.Dates {
+			if !on[uid] {
+				delete(ms.Dates, uid)
+				changed = true
+			}
+		}
+	}
+	for uid, date := range dates {
+		if ms.Dates == nil {
+			ms.Dates = make(map[string]int64)
+		}
+		if at, ok := ms.Dates[uid]; !ok || at != date.Unix() {
+			ms.Dates[uid] = date.Unix()
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
 	}
 
-	ms.FetchedUIDs[uid] = true
+	return t.save()
+}
+
+// Date returns the date of the given UID, as recorded by RecordDates.
+func (t *Tracker) Date(mailbox, uid string) (time.Time, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ms, ok := t.lookup(mailbox)
+	if !ok {
+		return time.Time{}, false
+	}
+	sec, ok := ms.Dates[uid]
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(sec, 0), true
+}
+
+// MarkDelivered records that the given UID was delivered to dest and
+// persists to disk. The record is dropped once the UID is fetched.
+func (t *Tracker) MarkDelivered(mailbox, uid, dest string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ms := t.mailbox(mailbox)
+	if ms.Delivered == nil {
+		ms.Delivered = make(map[string][]string)
+	}
+	if slices.Contains(ms.Delivered[uid], dest) {
+		return nil
+	}
+	ms.Delivered[uid] = append(ms.Delivered[uid], dest)
 
 	return t.save()
 }
 
-// MarkBatchFetched marks multiple UIDs as fetched and persists once.
-func (t *Tracker) MarkBatchFetched(mailbox string, uids []string) error {
+// IsDelivered returns true if the given UID was recorded by MarkDelivered
+// for dest and has not been fetched since.
+func (t *Tracker) IsDelivered(mailbox, uid, dest string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ms, ok := t.lookup(mailbox)
+	if !ok {
+		return false
+	}
+	return slices.Contains(ms.Delivered[uid], dest)
+}
+
+// RecordFailure counts a failed attempt to forward the given UID, persists
+// to disk, and returns the number of failures so far.
+func (t *Tracker) RecordFailure(mailbox, uid string) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ms := t.mailbox(mailbox)
+	if ms.Failures == nil {
+		ms.Failures = make(map[string]int)
+	}
+	ms.Failures[uid]++
+
+	return ms.Failures[uid], t.save()
+}
+
+// MarkQuarantined records that the given UID was quarantined at now,
+// forgets its failures, and persists to disk.
+func (t *Tracker) MarkQuarantined(mailbox, uid string, now time.Time) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ms := t.mailbox(mailbox)
+	if ms.Quarantined == nil {
+		ms.Quarantined = make(map[string]int64)
+	}
+	ms.Quarantined[uid] = now.Unix()
+	delete(ms.Failures, uid)
+
+	return t.save()
+}
+
+// IsQuarantined returns true if the given UID was recorded by
+// MarkQuarantined.
+func (t *Tracker) IsQuarantined(mailbox, uid string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ms, ok := t.lookup(mailbox)
+	if !ok {
+		return false
+	}
+	_, ok = ms.Quarantined[uid]
+	return ok
+}
+
+// Quarantined returns the number of quarantined UIDs for the mailbox.
+func (t *Tracker) Quarantined(mailbox string) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ms, ok := t.lookup(mailbox)
+	if !ok {
+		return 0
+	}
+	return len(ms.Quarantined)
+}
+
+// MarkReceived records that new mail was found in the mailbox at now and
+// persists to disk.
+func (t *Tracker) MarkReceived(mailbox string, now time.Time) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.mailbox(mailbox).LastReceived = now.Unix()
+	return t.save()
+}
+
+// LastReceived returns when new mail was last found in the mailbox, and
+// when it was last reported as stale; either is zero if it never was.
+func (t *Tracker) LastReceived(mailbox string) (received, alerted time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ms, ok := t.lookup(mailbox)
+	if !ok {
+		return time.Time{}, time.Time{}
+	}
+	if ms.LastReceived != 0 {
+		received = time.Unix(ms.LastReceived, 0)
+	}
+	if ms.StaleAlerted != 0 {
+		alerted = time.Unix(ms.StaleAlerted, 0)
+	}
+	return received, alerted
+}
+
+// MarkStaleAlerted records that the mailbox was reported as stale at now
+// and persists to disk.
+func (t *Tracker) MarkStaleAlerted(mailbox string, now time.Time) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.mailbox(mailbox).StaleAlerted = now.Unix()
+	return t.save()
+}
+
+// Checkpoint returns the differential sync checkpoint of the mailbox, if
+// any.
+func (t *Tracker) Checkpoint(mailbox string) (Checkpoint, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ms, ok := t.lookup(mailbox)
+	if !ok || ms.Checkpoint == nil {
+		return Checkpoint{}, false
+	}
+	return *ms.Checkpoint, true
+}
+
+// SetCheckpoint records the differential sync checkpoint of the mailbox
+// and persists to disk.
+func (t *Tracker) SetCheckpoint(mailbox string, cp Checkpoint) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.mailbox(mailbox).Checkpoint = &cp
+	return t.save()
+}
+
+// ClearCheckpoint forgets the differential sync checkpoint of the mailbox,
+// so that the next run examines every message, persisting only if there
+// was one.
+func (t *Tracker) ClearCheckpoint(mailbox string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ms, ok := t.lookup(mailbox)
+	if !ok || ms.Checkpoint == nil {
+		return nil
+	}
+	ms.Checkpoint = nil
+	return t.save()
+}
+
+// RecordLatency records that a message was forwarded at now, latency
+// after its Date header, drops history beyond the retention window, and
+// persists to disk.
+func (t *Tracker) RecordLatency(mailbox string, now time.Time, latency time.Duration) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ms := t.mailbox(mailbox)
+	ms.Latencies = append(ms.Latencies, Latency{At: now.Unix(), Seconds: int64(latency / time.Second)})
+	oldest := now.Add(-latencyAge).Unix()
+	drop := max(len(ms.Latencies)-latencySamples, 0)
+	for drop < len(ms.Latencies) && ms.Latencies[drop].At < oldest {
+		drop++
+	}
+	ms.Latencies = slices.Clone(ms.Latencies[drop:])
+
+	return t.save()
+}
+
+// Latencies returns the latencies of the messages forwarded from the
+// mailbox since the given time, oldest first.
+func (t *Tracker) Latencies(mailbox string, since time.Time) []time.Duration {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 
-	ms, ok := t.data.Mailboxes[mailbox]
+	ms, ok := t.lookup(mailbox)
 	if !ok {
-		ms = &MailboxState{
-			FetchedUIDs: make(map[string]bool),
+		return nil
+	}
+	var out []time.Duration
+	for _, l := range ms.Latencies {
+		if l.At >= since.Unix() {
+			out = append(out, time.Duration(l.Seconds)*time.Second)
 		}
-		t.data.Mailboxes[mailbox] = ms
 	}
+	return out
+}
 
-	for _, uid := range uids {
-		ms.FetchedUIDs[uid] = true
+// ThreadRoute returns the address the first of the given message IDs that
+// has a recorded route, from the mailbox, was routed to.
+func (t *Tracker) ThreadRoute(mailbox string, ids []string) (string, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ms, ok := t.lookup(mailbox)
+	if !ok {
+		return "", false
+	}
+	for _, id := range ids {
+		if r, ok := ms.Threads[id]; ok {
+			return r.To, true
+		}
+	}
+	return "", false
+}
+
+// RecordThreadRoute records that messages with the given IDs, from the
+// mailbox, were routed to the address to at now, drops routes older than
+// the retention window, and persists to disk.
+func (t *Tracker) RecordThreadRoute(mailbox string, ids []string, to string, now time.Time) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ms := t.mailbox(mailbox)
+	if ms.Threads == nil {
+		ms.Threads = make(map[string]ThreadRoute)
+	}
+	oldest := now.Add(-threadAge).Unix()
+	maps.DeleteFunc(ms.Threads, func(_ string, r ThreadRoute) bool {
+		return r.At < oldest
+	})
+	for _, id := range ids {
+		ms.Threads[id] = ThreadRoute{To: to, At: now.Unix()}
+	}
+
+	return t.save()
+}
+
+// Sender returns the history of the messages from the sender with the
+// given address to the mailbox.
+func (t *Tracker) Sender(mailbox, addr string) SenderStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ms, ok := t.lookup(mailbox)
+	if !ok {
+		return SenderStats{}
 	}
+	return ms.Senders[strings.ToLower(addr)]
+}
+
+// RecordSender counts a message from the sender with the given address,
+// and whether it was spam, and persists to disk.
+func (t *Tracker) RecordSender(mailbox, addr string, spam bool, now time.Time) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.updateSender(mailbox, addr, now, func(st *SenderStats) {
+		st.Messages++
+		if spam {
+			st.Spam++
+		}
+	})
+	return t.save()
+}
 
+// RecordSenderQuarantined counts a quarantined message from the sender
+// with the given address, and persists to disk.
+func (t *Tracker) RecordSenderQuarantined(mailbox, addr string, now time.Time) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.updateSender(mailbox, addr, now, func(st *SenderStats) {
+		st.Quarantined++
+	})
 	return t.save()
 }
 
+// updateSender applies update to the history of a sender to the mailbox
+// at now, and drops senders silent for longer than the retention window.
+// The caller must hold t.mu.
+func (t *Tracker) updateSender(mailbox, addr string, now time.Time, update func(*SenderStats)) {
+	ms := t.mailbox(mailbox)
+	if ms.Senders == nil {
+		ms.Senders = make(map[string]SenderStats)
+	}
+	oldest := now.Add(-senderAge).Unix()
+	maps.DeleteFunc(ms.Senders, func(_ string, st SenderStats) bool {
+		return st.LastSeen < oldest
+	})
+	addr = strings.ToLower(addr)
+	st := ms.Senders[addr]
+	update(&st)
+	st.LastSeen = now.Unix()
+	ms.Senders[addr] = st
+}
+
+// AddTransfer adds the given byte counts to the mailbox's totals for the
+// day and month of now, drops history older than the retention window,
+// and persists to disk.
+func (t *Tracker) AddTransfer(mailbox string, now time.Time, downloaded, uploaded int64) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ms := t.mailbox(mailbox)
+	if ms.DailyTransfer == nil {
+		ms.DailyTransfer = make(map[string]Transfer)
+	}
+	if ms.MonthlyTransfer == nil {
+		ms.MonthlyTransfer = make(map[string]Transfer)
+	}
+	add := func(m map[string]Transfer, key string) {
+		tr := m[key]
+		tr.Downloaded += downloaded
+		tr.Uploaded += uploaded
+		m[key] = tr
+	}
+	add(ms.DailyTransfer, now.Format(dayKey))
+	add(ms.MonthlyTransfer, now.Format(monthKey))
+
+	// Keys sort chronologically, so older ones compare lower.
+	oldestDay := now.AddDate(0, 0, -transferDays).Format(dayKey)
+	for k := range ms.DailyTransfer {
+		if k < oldestDay {
+			delete(ms.DailyTransfer, k)
+		}
+	}
+	oldestMonth := now.AddDate(0, -transferMonths, 0).Format(monthKey)
+	for k := range ms.MonthlyTransfer {
+		if k < oldestMonth {
+			delete(ms.MonthlyTransfer, k)
+		}
+	}
+
+	return t.save()
+}
+
+// AddRun counts a run over the mailbox that ended at now, having
+// forwarded and failed on the given numbers of messages, drops history
+// older than the retention window, and persists to disk.
+func (t *Tracker) AddRun(mailbox string, now time.Time, forwarded, errors int) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ms := t.mailbox(mailbox)
+	if ms.MonthlyRuns == nil {
+		ms.MonthlyRuns = make(map[string]RunCounts)
+	}
+	key := now.Format(monthKey)
+	rc := ms.MonthlyRuns[key]
+	rc.Runs++
+	if errors > 0 {
+		rc.FailedRuns++
+	}
+	rc.Forwarded += forwarded
+	rc.Errors += errors
+	ms.MonthlyRuns[key] = rc
+
+	oldestMonth := now.AddDate(0, -transferMonths, 0).Format(monthKey)
+	for k := range ms.MonthlyRuns {
+		if k < oldestMonth {
+			delete(ms.MonthlyRuns, k)
+		}
+	}
+
+	return t.save()
+}
+
+// Month returns the mailbox's transfer totals and run counts for the month
+// of the given time.
+func (t *Tracker) Month(mailbox string, month time.Time) (Transfer, RunCounts) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ms, ok := t.lookup(mailbox)
+	if !ok {
+		return Transfer{}, RunCounts{}
+	}
+	key := month.Format(monthKey)
+	return ms.MonthlyTransfer[key], ms.MonthlyRuns[key]
+}
+
+// Transfer returns the mailbox's transfer totals for the day and the month
+// of now.
+func (t *Tracker) Transfer(mailbox string, now time.Time) (day, month Transfer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ms, ok := t.lookup(mailbox)
+	if !ok {
+		return Transfer{}, Transfer{}
+	}
+	return ms.DailyTransfer[now.Format(dayKey)], ms.MonthlyTransfer[now.Format(monthKey)]
+}
+
+// Prune forgets the fetched UIDs of mailbox recorded more than olderThan
+// ago, except those in keep, and returns how many it dropped. A forgotten
+// UID that is still on the server would be forwarded again, so keep should
+// hold the UIDs the server still lists. UIDs without a fetch time, from
+// before it was recorded, are given the current one.
+func (t *Tracker) Prune(mailbox string, olderThan time.Duration, keep ...string) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.lookup(mailbox); !ok {
+		return 0, nil
+	}
+	ms := t.mailbox(mailbox)
+	kept := make(map[string]bool, len(keep))
+	for _, uid := range keep {
+		kept[uid] = true
+	}
+	now := time.Now()
+	cutoff := now.Add(-olderThan).Unix()
+	changed, pruned := false, 0
+	for uid := range ms.FetchedUIDs {
+		at, ok := ms.FetchedAt[uid]
+		switch {
+		case !ok:
+			ms.FetchedAt[uid] = now.Unix()
+			changed = true
+		case at < cutoff && !kept[uid]:
+			delete(ms.FetchedUIDs, uid)
+			delete(ms.FetchedAt, uid)
+			delete(ms.FirstSeen, uid)
+			pruned++
+		}
+	}
+	if !changed && pruned == 0 {
+		return 0, nil
+	}
+
+	return pruned, t.save()
+}
+
 // Stats returns the number of tracked UIDs per mailbox.
 func (t *Tracker) Stats() map[string]int {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 
+	// Every mailbox is loaded to be counted.
+	if ms, ok := t.store.(mailboxStore); ok {
+		if mailboxes, err := ms.mailboxes(); err == nil {
+			for _, mailbox := range mailboxes {
+				t.lookup(mailbox)
+			}
+		}
+	}
 	stats := make(map[string]int)
 	for k, v := range t.data.Mailboxes {
 		stats[k] = len(v.FetchedUIDs)
@@ -107,47 +958,303 @@ func (t *Tracker) Stats() map[string]int {
 	return stats
 }
 
-// load reads the state from disk.
-func (t *Tracker) load() error {
-	data, err := os.ReadFile(t.filePath)
-	if err != nil {
-		return err
+// Destination returns the persisted throttling state for dest, if any.
+func (t *Tracker) Destination(dest string) (DestinationState, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ds, ok := t.data.Destinations[dest]
+	if !ok {
+		return DestinationState{}, false
 	}
+	return *ds, true
+}
 
-	var sd StateData
-	if err := json.Unmarshal(data, &sd); err != nil {
-		// If state file is corrupted, log and start fresh.
+// Destinations returns a copy of the persisted throttling state of every
+// destination.
+func (t *Tracker) Destinations() map[string]DestinationState {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	out := make(map[string]DestinationState, len(t.data.Destinations))
+	for k, v := range t.data.Destinations {
+		out[k] = *v
+	}
+	return out
+}
+
+// SetDestination records the throttling state for dest and persists to disk.
+func (t *Tracker) SetDestination(dest string, ds DestinationState) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.data.Destinations == nil {
+		t.data.Destinations = make(map[string]*DestinationState)
+	}
+	t.data.Destinations[dest] = &ds
+
+	return t.save()
+}
+
+// ClearDestination forgets the throttling state for dest, persisting only
+// if there was any.
+func (t *Tracker) ClearDestination(dest string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.data.Destinations[dest]; !ok {
 		return nil
 	}
+	delete(t.data.Destinations, dest)
+
+	return t.save()
+}
+
+// Seeded reports whether the Message-IDs already in dest were recorded.
+func (t *Tracker) Seeded(dest string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
 
-	if sd.Mailboxes != nil {
-		t.data = sd
+	_, ok := t.data.Seeds[dest]
+	return ok
+}
+
+// SetSeed records ids as the Message-IDs already in dest, as found at now,
+// and persists to disk. IDs are compared without angle brackets.
+func (t *Tracker) SetSeed(dest string, ids []string, now time.Time) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	seed := &Seed{At: now, MessageIDs: make(map[string]bool, len(ids))}
+	for _, id := range ids {
+		if id = normalizeMessageID(id); id != "" {
+			seed.MessageIDs[id] = true
+		}
+	}
+	if t.data.Seeds == nil {
+		t.data.Seeds = make(map[string]*Seed)
 	}
+	t.data.Seeds[dest] = seed
 
-	return nil
+	return t.save()
 }
 
-// save writes the state to disk atomically using a temp file + rename.
-func (t *Tracker) save() error {
-	dir := filepath.Dir(t.filePath)
-	if err := os.MkdirAll(dir, 0700); err != nil {
-		return fmt.Errorf("creating state directory: %w", err)
+// IsSeeded reports whether the message with Message-ID id was in dest
+// before the first run.
+func (t *Tracker) IsSeeded(dest, id string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	seed, ok := t.data.Seeds[dest]
+	if !ok {
+		return false
 	}
+	id = normalizeMessageID(id)
+	return id != "" && seed.MessageIDs[id]
+}
 
-	data, err := json.MarshalIndent(t.data, "", "  ")
+// normalizeMessageID strips the spaces and angle brackets around a
+// Message-ID.
+func normalizeMessageID(id string) string {
+	return strings.Trim(strings.TrimSpace(id), "<>")
+}
+
+// lookup returns the state for mailbox, if any, loading it first from a
+// mailboxStore. The caller must hold t.mu.
+func (t *Tracker) lookup(mailbox string) (*MailboxState, bool) {
+	if ms, ok := t.data.Mailboxes[mailbox]; ok {
+		return ms, true
+	}
+	ls, ok := t.store.(mailboxStore)
+	if !ok || t.looked[mailbox] {
+		return nil, false
+	}
+	ms, err := ls.loadMailbox(mailbox)
 	if err != nil {
-		return fmt.Errorf("marshaling state: %w", err)
+		t.failed[mailbox] = err
+		return nil, false
+	}
+	delete(t.failed, mailbox)
+	t.looked[mailbox] = true
+	if ms == nil {
+		return nil, false
+	}
+	t.data.Mailboxes[mailbox] = ms
+	return ms, true
+}
+
+// mailbox returns the state for mailbox, creating it if needed, to be
+// changed. The caller must hold t.mu.
+func (t *Tracker) mailbox(mailbox string) *MailboxState {
+	ms, ok := t.lookup(mailbox)
+	if !ok {
+		ms = &MailboxState{}
+		t.data.Mailboxes[mailbox] = ms
+	}
+	if t.dirty != nil {
+		t.dirty[mailbox] = true
+	}
+	if ms.FetchedUIDs == nil {
+		ms.FetchedUIDs = make(map[string]bool)
+	}
+	if ms.FetchedAt == nil {
+		ms.FetchedAt = make(map[string]int64)
+	}
+	return ms
+}
+
+// Flush writes the changes whose save was deferred by a write delay, if
+// any, and returns why they could not be. It is called where the state
+// must be saved before going on, such as before deleting a message
+// recorded as fetched.
+func (t *Tracker) Flush() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.flush()
+}
+
+// Close writes the changes whose save was deferred, and releases the
+// Tracker's connection to the server holding the state, if any. The state
+// stays readable; a later save reconnects.
+func (t *Tracker) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	err := t.flush()
+	if c, ok := t.store.(io.Closer); ok {
+		err = errors.Join(err, c.Close())
 	}
+	return err
+}
 
-	// Atomic write: write to temp file, then rename.
-	tmpFile := t.filePath + ".tmp"
-	if err := os.WriteFile(tmpFile, data, 0600); err != nil {
-		return fmt.Errorf("writing temp state file: %w", err)
+// ClockHighWater returns the latest wall-clock time the state was saved at.
+func (t *Tracker) ClockHighWater() time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.data.ClockHighWater
+}
+
+// save persists the state, recording the current time as the clock high
+// water mark. With a write delay, it only schedules the write.
+func (t *Tracker) save() error {
+	if now := time.Now().UTC().Truncate(time.Second); now.After(t.data.ClockHighWater) {
+		t.data.ClockHighWater = now
+	}
+	if t.delay <= 0 {
+		return t.write()
+	}
+	t.pending = true
+	if t.timer == nil {
+		t.timer = time.AfterFunc(t.delay, t.flushDeferred)
 	}
+	return nil
+}
 
-	if err := os.Rename(tmpFile, t.filePath); err != nil {
-		return fmt.Errorf("renaming state file: %w", err)
+// flushDeferred writes the deferred changes once the write delay is over.
+// If that fails, they are written with the next flush or deferred save.
+func (t *Tracker) flushDeferred() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.timer = nil
+	t.flush()
+}
+
+// flush writes the deferred changes, if any. The caller must hold t.mu.
+func (t *Tracker) flush() error {
+	if t.timer != nil {
+		t.timer.Stop()
+		t.timer = nil
+	}
+	if !t.pending {
+		return nil
+	}
+	if err := t.write(); err != nil {
+		return err
 	}
+	t.pending = false
+	return nil
+}
 
+// write writes the state to the store. The caller must hold t.mu.
+func (t *Tracker) write() error {
+	ls, ok := t.store.(mailboxStore)
+	if !ok {
+		return t.store.save(&t.data)
+	}
+
+	// A mailbox whose saved state could not be loaded is not overwritten.
+	var dirty []string
+	for mailbox := range t.dirty {
+		if err := t.failed[mailbox]; err != nil {
+			return fmt.Errorf("state of %s was not loaded: %w", mailbox, err)
+		}
+		dirty = append(dirty, mailbox)
+	}
+	slices.Sort(dirty)
+	if err := ls.saveMailboxes(&t.data, dirty); err != nil {
+		return err
+	}
+	clear(t.dirty)
 	return nil
 }
+
+// fileStore keeps the state in a JSON file, compressed or not, and its
+// previous generations.
+type fileStore struct {
+	path        string
+	compression Compression
+	backups     int
+	corruption  CorruptionPolicy
+	// corrupted records the corrupted state files gone on without.
+	corrupted *[]Corruption
+}
+
+func newFileStore(path string, opts []FileOption) fileStore {
+	f := fileStore{path: path, compression: CompressNone, corrupted: new([]Corruption)}
+	for _, opt := range opts {
+		opt(&f)
+	}
+	return f
+}
+
+// load reads the state from disk, along with the mailboxes kept apart if
+// it was saved sharded.
+func (f fileStore) load(sd *StateData) error {
+	loaded, err := readStateFile[StateData](f, f.path)
+	if err != nil {
+		return err
+	}
+	if loaded.Mailboxes == nil {
+		return nil
+	}
+	if loaded.Sharded {
+		shards := shardStore(f)
+		mailboxes, err := shards.mailboxes()
+		if err != nil {
+			return err
+		}
+		for _, mailbox := range mailboxes {
+			if _, ok := loaded.Mailboxes[mailbox]; ok {
+				continue
+			}
+			ms, err := shards.loadMailbox(mailbox)
+			if err != nil {
+				return err
+			}
+			if ms != nil {
+				loaded.Mailboxes[mailbox] = ms
+			}
+		}
+		loaded.Sharded = false
+	}
+	*sd = loaded
+	return nil
+}
+
+// save writes the state to disk atomically using a temp file + rename.
+func (f fileStore) save(sd *StateData) error {
+	data, err := json.MarshalIndent(sd, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshaling state: %w", err)
+	}
+	return writeStateFile(f, f.path, data)
+}
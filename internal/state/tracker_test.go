@@ -1,9 +1,11 @@
 package state
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestNewTrackerFresh(t *testing.T) {
@@ -137,3 +139,642 @@ func TestMultipleMailboxes(t *testing.T) {
 		t.Error("expected uid2 not fetched for a@yahoo.com")
 	}
 }
+
+func TestDestinationPersistence(t *testing.T) {
+	dir := t.TempDir()
+	stateFile := filepath.Join(dir, "state.json")
+
+	tracker, err := NewTracker(stateFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := tracker.Destination("me@gmail.com"); ok {
+		t.Fatal("expected no destination state in fresh tracker")
+	}
+
+	want := DestinationState{
+		DeferredUntil: time.Date(2024, 5, 1, 14, 32, 0, 0, time.UTC),
+		Cooldown:      10 * time.Minute,
+		Concurrency:   1,
+		Delay:         4 * time.Second,
+	}
+	if err := tracker.SetDestination("me@gmail.com", want); err != nil {
+		t.Fatalf("SetDestination failed: %v", err)
+	}
+
+	// Reload from disk, as the next run would.
+	tracker2, err := NewTracker(stateFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got, ok := tracker2.Destination("me@gmail.com")
+	if !ok {
+		t.Fatal("expected destination state after reload")
+	}
+	if !got.DeferredUntil.Equal(want.DeferredUntil) || got.Cooldown != want.Cooldown ||
+		got.Concurrency != want.Concurrency || got.Delay != want.Delay {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	if err := tracker2.ClearDestination("me@gmail.com"); err != nil {
+		t.Fatalf("ClearDestination failed: %v", err)
+	}
+	tracker3, err := NewTracker(stateFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := tracker3.Destination("me@gmail.com"); ok {
+		t.Error("expected destination state to be cleared")
+	}
+}
+
+func TestStateWithoutDestinations(t *testing.T) {
+	dir := t.TempDir()
+	stateFile := filepath.Join(dir, "state.json")
+
+	// State files written before destinations were tracked.
+	old := `{"mailboxes": {"a@yahoo.com": {"fetched_uids": {"uid1": true}}}}`
+	if err := os.WriteFile(stateFile, []byte(old), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tracker, err := NewTracker(stateFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !tracker.IsFetched("a@yahoo.com", "uid1") {
+		t.Error("expected uid1 fetched")
+	}
+	if err := tracker.SetDestination("me@gmail.com", DestinationState{Concurrency: 2}); err != nil {
+		t.Fatalf("SetDestination failed: %v", err)
+	}
+}
+
+func TestMarkSeen(t *testing.T) {
+	dir := t.TempDir()
+	stateFile := filepath.Join(dir, "state.json")
+
+	tracker, err := NewTracker(stateFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	first := time.Unix(1700000000, 0)
+	if err := tracker.MarkSeen("user@yahoo.com", []string{"uid1"}, first); err != nil {
+		t.Fatalf("MarkSeen failed: %v", err)
+	}
+	// Seeing uid1 again must not move its first-seen time.
+	if err := tracker.MarkSeen("user@yahoo.com", []string{"uid1", "uid2"}, first.Add(time.Hour)); err != nil {
+		t.Fatalf("MarkSeen failed: %v", err)
+	}
+
+	tracker2, err := NewTracker(stateFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if seen, ok := tracker2.FirstSeen("user@yahoo.com", "uid1"); !ok || !seen.Equal(first) {
+		t.Errorf("uid1 first seen = %v, %v; want %v", seen, ok, first)
+	}
+	if seen, ok := tracker2.FirstSeen("user@yahoo.com", "uid2"); !ok || !seen.Equal(first.Add(time.Hour)) {
+		t.Errorf("uid2 first seen = %v, %v; want %v", seen, ok, first.Add(time.Hour))
+	}
+	if _, ok := tracker2.FirstSeen("user@yahoo.com", "uid3"); ok {
+		t.Error("expected no first-seen time for uid3")
+	}
+	// Seen messages are not fetched yet.
+	if tracker2.IsFetched("user@yahoo.com", "uid1") {
+		t.Error("expected uid1 not fetched")
+	}
+}
+
+func TestClockHighWater(t *testing.T) {
+	dir := t.TempDir()
+	stateFile := filepath.Join(dir, "state.json")
+
+	// A high-water mark in the future, as left by a clock that ran ahead,
+	// is never moved back.
+	future := time.Now().Add(24 * time.Hour).UTC().Truncate(time.Second)
+	content := `{"mailboxes": {}, "clock_high_water": "` + future.Format(time.RFC3339) + `"}`
+	if err := os.WriteFile(stateFile, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tracker, err := NewTracker(stateFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_ = tracker.MarkFetched("a@yahoo.com", "uid1")
+	if got := tracker.ClockHighWater(); !got.Equal(future) {
+		t.Errorf("high-water mark moved back to %v", got)
+	}
+
+	fresh, err := NewTracker(filepath.Join(dir, "fresh.json"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	before := time.Now().Add(-time.Second)
+	_ = fresh.MarkFetched("a@yahoo.com", "uid1")
+	if got := fresh.ClockHighWater(); got.Before(before) {
+		t.Errorf("expected high-water mark to be set on save, got %v", got)
+	}
+}
+
+func TestMarkSkipped(t *testing.T) {
+	dir := t.TempDir()
+	stateFile := filepath.Join(dir, "state.json")
+
+	tracker, err := NewTracker(stateFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := tracker.MarkSkipped("user@yahoo.com", "big", 50<<20); err != nil {
+		t.Fatalf("MarkSkipped failed: %v", err)
+	}
+
+	tracker2, err := NewTracker(stateFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !tracker2.IsSkipped("user@yahoo.com", "big") {
+		t.Error("expected big to be skipped after reload")
+	}
+	if tracker2.IsFetched("user@yahoo.com", "big") {
+		t.Error("expected a skipped message not to count as fetched")
+	}
+
+	// Fetching it later, e.g. after raising the limit, clears the mark.
+	if err := tracker2.MarkFetched("user@yahoo.com", "big"); err != nil {
+		t.Fatalf("MarkFetched failed: %v", err)
+	}
+	if tracker2.IsSkipped("user@yahoo.com", "big") {
+		t.Error("expected fetching to clear the skipped mark")
+	}
+}
+
+func TestRecordDates(t *testing.T) {
+	dir := t.TempDir()
+	stateFile := filepath.Join(dir, "state.json")
+
+	tracker, err := NewTracker(stateFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	old := time.Date(2023, 11, 14, 10, 0, 0, 0, time.UTC)
+	dates := map[string]time.Time{"uid1": old, "uid2": old}
+	if err := tracker.RecordDates("user@yahoo.com", dates, []string{"uid1", "uid2"}); err != nil {
+		t.Fatalf("RecordDates failed: %v", err)
+	}
+
+	tracker2, err := NewTracker(stateFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if date, ok := tracker2.Date("user@yahoo.com", "uid1"); !ok || !date.Equal(old) {
+		t.Errorf("Date(uid1) = %v, %v after reload, want %v", date, ok, old)
+	}
+
+	// Messages no longer listed are forgotten, and forwarded ones too.
+	if err := tracker2.RecordDates("user@yahoo.com", nil, []string{"uid1"}); err != nil {
+		t.Fatalf("RecordDates failed: %v", err)
+	}
+	if _, ok := tracker2.Date("user@yahoo.com", "uid2"); ok {
+		t.Error("expected the date of a message no longer listed to be forgotten")
+	}
+	if err := tracker2.MarkFetched("user@yahoo.com", "uid1"); err != nil {
+		t.Fatalf("MarkFetched failed: %v", err)
+	}
+	if _, ok := tracker2.Date("user@yahoo.com", "uid1"); ok {
+		t.Error("expected fetching to forget the date")
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	dir := t.TempDir()
+	stateFile := filepath.Join(dir, "state.json")
+
+	tracker, err := NewTracker(stateFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for want := 1; want <= 2; want++ {
+		n, err := tracker.RecordFailure("user@yahoo.com", "bad")
+		if err != nil {
+			t.Fatalf("RecordFailure failed: %v", err)
+		}
+		if n != want {
+			t.Errorf("expected %d failures, got %d", want, n)
+		}
+	}
+
+	// A successful forward forgets the failures.
+	if _, err := tracker.RecordFailure("user@yahoo.com", "flaky"); err != nil {
+		t.Fatalf("RecordFailure failed: %v", err)
+	}
+	if err := tracker.MarkFetched("user@yahoo.com", "flaky"); err != nil {
+		t.Fatalf("MarkFetched failed: %v", err)
+	}
+	if n, _ := tracker.RecordFailure("user@yahoo.com", "flaky"); n != 1 {
+		t.Errorf("expected failures to restart at 1 after a forward, got %d", n)
+	}
+
+	if err := tracker.MarkQuarantined("user@yahoo.com", "bad", time.Now()); err != nil {
+		t.Fatalf("MarkQuarantined failed: %v", err)
+	}
+
+	tracker2, err := NewTracker(stateFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !tracker2.IsQuarantined("user@yahoo.com", "bad") {
+		t.Error("expected bad to be quarantined after reload")
+	}
+	if tracker2.IsQuarantined("user@yahoo.com", "flaky") {
+		t.Error("expected flaky not to be quarantined")
+	}
+	if got := tracker2.Quarantined("user@yahoo.com"); got != 1 {
+		t.Errorf("expected 1 quarantined UID, got %d", got)
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	dir := t.TempDir()
+	stateFile := filepath.Join(dir, "state.json")
+
+	tracker, err := NewTracker(stateFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	may1 := time.Date(2024, 5, 1, 10, 0, 0, 0, time.Local)
+	may2 := may1.AddDate(0, 0, 1)
+	for _, tc := range []struct {
+		at       time.Time
+		down, up int64
+		mailbox  string
+	}{
+		{may1, 1000, 1100, "a@yahoo.com"},
+		{may1.Add(time.Hour), 500, 550, "a@yahoo.com"},
+		{may2, 200, 210, "a@yahoo.com"},
+		{may2, 7, 7, "b@yahoo.com"},
+	} {
+		if err := tracker.AddTransfer(tc.mailbox, tc.at, tc.down, tc.up); err != nil {
+			t.Fatalf("AddTransfer failed: %v", err)
+		}
+	}
+
+	tracker2, err := NewTracker(stateFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	day, month := tracker2.Transfer("a@yahoo.com", may1)
+	if day != (Transfer{1500, 1650}) {
+		t.Errorf("May 1 = %+v, want 1500/1650", day)
+	}
+	if month != (Transfer{1700, 1860}) || month.Total() != 3560 {
+		t.Errorf("May = %+v, want 1700/1860", month)
+	}
+	if day, _ := tracker2.Transfer("a@yahoo.com", may2); day != (Transfer{200, 210}) {
+		t.Errorf("May 2 = %+v, want 200/210", day)
+	}
+
+	// Old history is dropped as new transfers are recorded.
+	later := may1.AddDate(3, 0, 0)
+	if err := tracker2.AddTransfer("a@yahoo.com", later, 1, 1); err != nil {
+		t.Fatalf("AddTransfer failed: %v", err)
+	}
+	if _, month := tracker2.Transfer("a@yahoo.com", may1); month != (Transfer{}) {
+		t.Errorf("expected May 2024 to be pruned, got %+v", month)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	dir := t.TempDir()
+	stateFile := filepath.Join(dir, "state.json")
+
+	// uid1 to uid3 were fetched 100 days ago, uid4 yesterday, and legacy
+	// has no fetch time.
+	old := time.Now().Add(-100 * 24 * time.Hour).Unix()
+	recent := time.Now().Add(-24 * time.Hour).Unix()
+	data := fmt.Sprintf(`{"mailboxes": {"a@yahoo.com": {
+		"fetched_uids": {"uid1": true, "uid2": true, "uid3": true, "uid4": true, "legacy": true},
+		"fetched_at": {"uid1": %d, "uid2": %d, "uid3": %d, "uid4": %d},
+		"first_seen": {"uid1": %d, "uid2": %d}}}}`, old, old, old, recent, old, old)
+	if err := os.WriteFile(stateFile, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tracker, err := NewTracker(stateFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// uid2 is still on the server.
+	n, err := tracker.Prune("a@yahoo.com", 30*24*time.Hour, "uid2")
+	if err != nil {
+		t.Fatalf("Prune failed: %v", err)
+	}
+	if n != 2 {
+		t.Errorf("expected 2 UIDs pruned, got %d", n)
+	}
+
+	tracker2, err := NewTracker(stateFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for uid, want := range map[string]bool{"uid1": false, "uid2": true, "uid3": false, "uid4": true, "legacy": true} {
+		if got := tracker2.IsFetched("a@yahoo.com", uid); got != want {
+			t.Errorf("%s fetched = %v, want %v", uid, got, want)
+		}
+	}
+	if _, ok := tracker2.FirstSeen("a@yahoo.com", "uid1"); ok {
+		t.Error("expected the first-seen time of uid1 to be pruned")
+	}
+	if _, ok := tracker2.FirstSeen("a@yahoo.com", "uid2"); !ok {
+		t.Error("expected the first-seen time of uid2 to be kept")
+	}
+
+	// The legacy UID now has a fetch time, and is pruned once that is old
+	// enough.
+	if n, err := tracker2.Prune("a@yahoo.com", -time.Minute); err != nil || n != 3 {
+		t.Errorf("Prune() = %d, %v; want all 3 remaining UIDs", n, err)
+	}
+	if n, err := tracker2.Prune("unknown@yahoo.com", 0); err != nil || n != 0 {
+		t.Errorf("Prune() of an unknown mailbox = %d, %v", n, err)
+	}
+}
+
+func TestMarkDelivered(t *testing.T) {
+	dir := t.TempDir()
+	stateFile := filepath.Join(dir, "state.json")
+
+	tracker, err := NewTracker(stateFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := tracker.MarkDelivered("user@yahoo.com", "uid1", "archive"); err != nil {
+			t.Fatalf("MarkDelivered failed: %v", err)
+		}
+	}
+
+	tracker2, err := NewTracker(stateFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !tracker2.IsDelivered("user@yahoo.com", "uid1", "archive") {
+		t.Error("expected uid1 to be delivered to archive after reload")
+	}
+	if tracker2.IsDelivered("user@yahoo.com", "uid1", "me@gmail.com") {
+		t.Error("expected uid1 not to be delivered to me@gmail.com")
+	}
+	if tracker2.IsFetched("user@yahoo.com", "uid1") {
+		t.Error("expected a partly delivered message not to count as fetched")
+	}
+
+	if err := tracker2.MarkFetched("user@yahoo.com", "uid1"); err != nil {
+		t.Fatalf("MarkFetched failed: %v", err)
+	}
+	if tracker2.IsDelivered("user@yahoo.com", "uid1", "archive") {
+		t.Error("expected fetching to clear the deliveries")
+	}
+}
+
+func TestLastReceived(t *testing.T) {
+	dir := t.TempDir()
+	stateFile := filepath.Join(dir, "state.json")
+
+	tracker, err := NewTracker(stateFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if received, alerted := tracker.LastReceived("user@yahoo.com"); !received.IsZero() || !alerted.IsZero() {
+		t.Errorf("expected no history, got %v, %v", received, alerted)
+	}
+	now := time.Unix(1714573920, 0)
+	if err := tracker.MarkReceived("user@yahoo.com", now); err != nil {
+		t.Fatalf("MarkReceived failed: %v", err)
+	}
+	if err := tracker.MarkStaleAlerted("user@yahoo.com", now.Add(time.Hour)); err != nil {
+		t.Fatalf("MarkStaleAlerted failed: %v", err)
+	}
+
+	tracker2, err := NewTracker(stateFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	received, alerted := tracker2.LastReceived("user@yahoo.com")
+	if !received.Equal(now) || !alerted.Equal(now.Add(time.Hour)) {
+		t.Errorf("LastReceived after reload = %v, %v", received, alerted)
+	}
+}
+
+func TestCheckpoint(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	tracker, err := NewTracker(stateFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := tracker.Checkpoint("user@yahoo.com"); ok {
+		t.Error("expected no checkpoint")
+	}
+	cp := Checkpoint{UID: "uid7", Position: 7, At: 1714573920, ReconciledAt: 1714570000}
+	if err := tracker.SetCheckpoint("user@yahoo.com", cp); err != nil {
+		t.Fatalf("SetCheckpoint failed: %v", err)
+	}
+
+	tracker2, err := NewTracker(stateFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got, ok := tracker2.Checkpoint("user@yahoo.com"); !ok || got != cp {
+		t.Errorf("Checkpoint after reload = %+v, %v", got, ok)
+	}
+	if err := tracker2.ClearCheckpoint("user@yahoo.com"); err != nil {
+		t.Fatalf("ClearCheckpoint failed: %v", err)
+	}
+	if _, ok := tracker2.Checkpoint("user@yahoo.com"); ok {
+		t.Error("expected the checkpoint cleared")
+	}
+}
+
+func TestThreadRoutes(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	tracker, err := NewTracker(stateFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	now := time.Unix(1714573920, 0)
+	if err := tracker.RecordThreadRoute("team@yahoo.com", []string{"<old@example.com>"}, "bob@example.com", now.Add(-100*24*time.Hour)); err != nil {
+		t.Fatalf("RecordThreadRoute failed: %v", err)
+	}
+	if err := tracker.RecordThreadRoute("team@yahoo.com", []string{"<root@example.com>"}, "ann@example.com", now); err != nil {
+		t.Fatalf("RecordThreadRoute failed: %v", err)
+	}
+
+	tracker2, err := NewTracker(stateFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if to, ok := tracker2.ThreadRoute("team@yahoo.com", []string{"<unknown@example.com>", "<root@example.com>"}); !ok || to != "ann@example.com" {
+		t.Errorf("ThreadRoute = %q, %v", to, ok)
+	}
+	// The route older than the retention window was dropped when the last
+	// was recorded.
+	if to, ok := tracker2.ThreadRoute("team@yahoo.com", []string{"<old@example.com>"}); ok {
+		t.Errorf("expected the old route dropped, got %q", to)
+	}
+	if _, ok := tracker2.ThreadRoute("other@yahoo.com", []string{"<root@example.com>"}); ok {
+		t.Error("expected routes to be kept per mailbox")
+	}
+}
+
+func TestSenders(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	tracker, err := NewTracker(stateFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	now := time.Unix(1714573920, 0)
+	if err := tracker.RecordSender("user@yahoo.com", "old@example.com", false, now.Add(-400*24*time.Hour)); err != nil {
+		t.Fatalf("RecordSender failed: %v", err)
+	}
+	for _, spam := range []bool{true, true, false} {
+		if err := tracker.RecordSender("user@yahoo.com", "Deals@Example.com", spam, now); err != nil {
+			t.Fatalf("RecordSender failed: %v", err)
+		}
+	}
+	if err := tracker.RecordSenderQuarantined("user@yahoo.com", "deals@example.com", now); err != nil {
+		t.Fatalf("RecordSenderQuarantined failed: %v", err)
+	}
+
+	tracker2, err := NewTracker(stateFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := SenderStats{Messages: 3, Spam: 2, Quarantined: 1, LastSeen: now.Unix()}
+	if got := tracker2.Sender("user@yahoo.com", "deals@example.com"); got != want {
+		t.Errorf("Sender = %+v, want %+v", got, want)
+	}
+	// The sender silent for over a year was dropped.
+	if got := tracker2.Sender("user@yahoo.com", "old@example.com"); got != (SenderStats{}) {
+		t.Errorf("Sender(old@example.com) = %+v, want none", got)
+	}
+}
+
+func TestLatencies(t *testing.T) {
+	dir := t.TempDir()
+	stateFile := filepath.Join(dir, "state.json")
+
+	tracker, err := NewTracker(stateFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	now := time.Unix(1714573920, 0)
+	old := now.Add(-8 * 24 * time.Hour)
+	for _, r := range []struct {
+		at      time.Time
+		latency time.Duration
+	}{
+		{old, time.Hour},
+		{now.Add(-2 * 24 * time.Hour), 30 * time.Second},
+		{now, 90 * time.Second},
+	} {
+		if err := tracker.RecordLatency("user@yahoo.com", r.at, r.latency); err != nil {
+			t.Fatalf("RecordLatency failed: %v", err)
+		}
+	}
+
+	tracker2, err := NewTracker(stateFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// The sample older than a week was dropped when the last was added.
+	if got := tracker2.Latencies("user@yahoo.com", old); len(got) != 2 || got[0] != 30*time.Second || got[1] != 90*time.Second {
+		t.Errorf("Latencies = %v", got)
+	}
+	if got := tracker2.Latencies("user@yahoo.com", now.Add(-24*time.Hour)); len(got) != 1 {
+		t.Errorf("expected one latency in the last day, got %v", got)
+	}
+}
+
+func TestAddRun(t *testing.T) {
+	dir := t.TempDir()
+	stateFile := filepath.Join(dir, "state.json")
+
+	tracker, err := NewTracker(stateFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	may := time.Date(2024, 5, 1, 12, 0, 0, 0, time.Local)
+	for _, r := range []struct {
+		at                time.Time
+		forwarded, errors int
+	}{
+		{may, 3, 0},
+		{may.Add(time.Hour), 1, 2},
+		{may.AddDate(0, 1, 0), 5, 0},
+	} {
+		if err := tracker.AddRun("user@yahoo.com", r.at, r.forwarded, r.errors); err != nil {
+			t.Fatalf("AddRun failed: %v", err)
+		}
+	}
+	if err := tracker.AddTransfer("user@yahoo.com", may, 4096, 4200); err != nil {
+		t.Fatal(err)
+	}
+
+	tracker2, err := NewTracker(stateFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	tr, rc := tracker2.Month("user@yahoo.com", may)
+	if rc != (RunCounts{Runs: 2, FailedRuns: 1, Forwarded: 4, Errors: 2}) || tr.Total() != 8296 {
+		t.Errorf("May = %+v, %+v", tr, rc)
+	}
+	if _, rc := tracker2.Month("user@yahoo.com", may.AddDate(0, 1, 0)); rc.Forwarded != 5 {
+		t.Errorf("June = %+v", rc)
+	}
+	if _, rc := tracker2.Month("other@yahoo.com", may); rc != (RunCounts{}) {
+		t.Errorf("expected no runs for an unknown mailbox, got %+v", rc)
+	}
+}
+
+func TestSeed(t *testing.T) {
+	dir := t.TempDir()
+	stateFile := filepath.Join(dir, "state.json")
+
+	tracker, err := NewTracker(stateFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if tracker.Seeded("me@gmail.com") || tracker.IsSeeded("me@gmail.com", "<a@example.com>") {
+		t.Fatal("expected no seed in fresh tracker")
+	}
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	if err := tracker.SetSeed("me@gmail.com", []string{"<a@example.com>", " b@example.com ", ""}, now); err != nil {
+		t.Fatalf("SetSeed failed: %v", err)
+	}
+
+	// An empty seed still marks the destination as scanned.
+	if err := tracker.SetSeed("empty@gmail.com", nil, now); err != nil {
+		t.Fatalf("SetSeed failed: %v", err)
+	}
+
+	tracker2, err := NewTracker(stateFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !tracker2.Seeded("me@gmail.com") || !tracker2.Seeded("empty@gmail.com") {
+		t.Error("expected both destinations seeded after reload")
+	}
+	for _, id := range []string{"<a@example.com>", "a@example.com", "<b@example.com>"} {
+		if !tracker2.IsSeeded("me@gmail.com", id) {
+			t.Errorf("expected %s to be seeded", id)
+		}
+	}
+	for _, id := range []string{"<c@example.com>", "", "<>"} {
+		if tracker2.IsSeeded("me@gmail.com", id) {
+			t.Errorf("expected %q not to be seeded", id)
+		}
+	}
+	if tracker2.IsSeeded("other@gmail.com", "<a@example.com>") {
+		t.Error("expected the seed to apply to its destination only")
+	}
+}
@@ -0,0 +1,438 @@
+// Package status serves a read-only view of yatogm's state over HTTP: a
+// health check, a JSON status document, and Prometheus metrics. The state
+// file is re-read on every request and never written, so an observer can
+// share it with a running instance.
+package status
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/benj-n/yatogm/internal/state"
+)
+
+// Status is the document served at /status.
+type Status struct {
+	StatePath string `json:"state_path"`
+	// StateModified is when the state file was last written, if it exists.
+	StateModified *time.Time                   `json:"state_modified,omitempty"`
+	Mailboxes     map[string]MailboxStatus     `json:"mailboxes"`
+	Destinations  map[string]DestinationStatus `json:"destinations"`
+}
+
+// MailboxStatus describes one source mailbox.
+type MailboxStatus struct {
+	// Hold reports that the mailbox is under a legal hold, so its messages
+	// are kept on the server and its state is never pruned.
+	Hold        bool `json:"hold"`
+	TrackedUIDs int  `json:"tracked_uids"`
+	// Quarantined counts messages given up on after repeated rejections.
+	Quarantined int `json:"quarantined"`
+	// TransferToday and TransferMonth count message bytes moved in the
+	// current day and calendar month.
+	TransferToday state.Transfer `json:"transfer_today"`
+	TransferMonth state.Transfer `json:"transfer_month"`
+	// LastReceived is when a run last found new mail in the mailbox.
+	LastReceived *time.Time `json:"last_received,omitempty"`
+	// Latency summarizes the forwarding latency of the messages forwarded
+	// in the last latencyWindow, if any.
+	Latency *LatencyStatus `json:"latency,omitempty"`
+}
+
+// latencyWindow is the period latency percentiles are computed over.
+const latencyWindow = 24 * time.Hour
+
+// LatencyStatus summarizes how long after the time in their Date header
+// messages were forwarded, in seconds.
+type LatencyStatus struct {
+	Count int     `json:"count"`
+	Sum   float64 `json:"sum"`
+	P50   float64 `json:"p50"`
+	P90   float64 `json:"p90"`
+	P99   float64 `json:"p99"`
+	// SLO is the configured latency_slo, and OverSLO the number of
+	// messages that exceeded it, if it is set.
+	SLO     float64 `json:"slo,omitempty"`
+	OverSLO int     `json:"over_slo,omitempty"`
+}
+
+// latencyStatus summarizes latencies, counting those above slo if it is
+// set. Percentiles use the nearest-rank method.
+func latencyStatus(latencies []time.Duration, slo time.Duration) *LatencyStatus {
+	if len(latencies) == 0 {
+		return nil
+	}
+	sorted := slices.Clone(latencies)
+	slices.Sort(sorted)
+	rank := func(p float64) float64 {
+		i := int(math.Ceil(p*float64(len(sorted)))) - 1
+		return sorted[max(i, 0)].Seconds()
+	}
+	ls := &LatencyStatus{Count: len(sorted), P50: rank(0.5), P90: rank(0.9), P99: rank(0.99)}
+	for _, l := range sorted {
+		ls.Sum += l.Seconds()
+		if slo > 0 && l > slo {
+			ls.OverSLO++
+		}
+	}
+	if slo > 0 {
+		ls.SLO = slo.Seconds()
+	}
+	return ls
+}
+
+// DestinationStatus describes the throttling of one destination.
+type DestinationStatus struct {
+	Deferred      bool       `json:"deferred"`
+	DeferredUntil *time.Time `json:"deferred_until,omitempty"`
+	Concurrency   int        `json:"concurrency,omitempty"`
+	Delay         string     `json:"delay,omitempty"`
+}
+
+// Handler serves the status endpoints for a state file, or for the state
+// files of the users of a multi-user service.
+type Handler struct {
+	users   []User
+	service bool
+	logger  *slog.Logger
+	mux     *http.ServeMux
+	now     func() time.Time
+}
+
+// User describes the state of one user of a multi-user service.
+type User struct {
+	Name      string
+	StatePath string
+	// Open, if set, loads the state instead of the file at StatePath,
+	// which then only describes where it is. The Handler does not close
+	// the Tracker it returns, so that Open can reload the same one for
+	// each request.
+	Open func() (*state.Tracker, error)
+	// Mailboxes are always reported, even before they appear in the state.
+	Mailboxes []string
+	// Held lists the mailboxes under a legal hold.
+	Held []string
+	// LatencySLO is the user's latency_slo, if set.
+	LatencySLO time.Duration
+}
+
+// NewHandler returns a Handler for the state file at statePath. The given
+// mailboxes are always reported, even before they appear in the state.
+func NewHandler(statePath string, mailboxes []string, logger *slog.Logger) *Handler {
+	return newHandler([]User{{StatePath: statePath, Mailboxes: mailboxes}}, false, logger)
+}
+
+// NewServiceHandler returns a Handler for the users of a multi-user
+// service. It serves /status as a document per user, keyed by name, and
+// labels every mailbox and destination metric with the user.
+func NewServiceHandler(users []User, logger *slog.Logger) *Handler {
+	return newHandler(users, true, logger)
+}
+
+func newHandler(users []User, service bool, logger *slog.Logger) *Handler {
+	h := &Handler{
+		users:   users,
+		service: service,
+		logger:  logger,
+		mux:     http.NewServeMux(),
+		now:     time.Now,
+	}
+	h.mux.HandleFunc("GET /healthz", h.serveHealth)
+	h.mux.HandleFunc("GET /status", h.serveStatus)
+	h.mux.HandleFunc("GET /metrics", h.serveMetrics)
+	return h
+}
+
+// SetHold marks mailboxes as under a legal hold in the reports of a
+// single-user Handler.
+func (h *Handler) SetHold(mailboxes []string) {
+	h.users[0].Held = mailboxes
+}
+
+// SetLatencySLO sets the latency objective that forwarding latencies are
+// compared to in the reports of a single-user Handler.
+func (h *Handler) SetLatencySLO(slo time.Duration) {
+	h.users[0].LatencySLO = slo
+}
+
+// SetOpen makes a single-user Handler load the state with open, such as
+// from Redis or PostgreSQL, instead of from its state file.
+func (h *Handler) SetOpen(open func() (*state.Tracker, error)) {
+	h.users[0].Open = open
+}
+
+// ServeHTTP implements http.Handler.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+func (h *Handler) serveHealth(w http.ResponseWriter, r *http.Request) {
+	io.WriteString(w, "ok\n")
+}
+
+func (h *Handler) serveStatus(w http.ResponseWriter, r *http.Request) {
+	sts, err := h.snapshots()
+	if err != nil {
+		h.fail(w, err)
+		return
+	}
+	var doc any = sts[0]
+	if h.service {
+		byUser := make(map[string]*Status, len(sts))
+		for i, u := range h.users {
+			byUser[u.Name] = sts[i]
+		}
+		doc = byUser
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(doc)
+}
+
+func (h *Handler) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	sts, err := h.snapshots()
+	if err != nil {
+		h.fail(w, err)
+		return
+	}
+	users := make([]userStatus, len(sts))
+	for i, st := range sts {
+		users[i] = userStatus{st: st}
+		if h.service {
+			users[i].name = h.users[i].Name
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetrics(w, users, h.now())
+}
+
+func (h *Handler) fail(w http.ResponseWriter, err error) {
+	h.logger.Error("reading state failed", "error", err)
+	http.Error(w, "reading state failed", http.StatusInternalServerError)
+}
+
+// snapshots summarizes the state of every user, in order.
+func (h *Handler) snapshots() ([]*Status, error) {
+	sts := make([]*Status, len(h.users))
+	for i, u := range h.users {
+		st, err := h.snapshot(u)
+		if err != nil {
+			return nil, err
+		}
+		sts[i] = st
+	}
+	return sts, nil
+}
+
+// snapshot loads the state of u and summarizes it.
+func (h *Handler) snapshot(u User) (*Status, error) {
+	var tracker *state.Tracker
+	var err error
+	if u.Open != nil {
+		tracker, err = u.Open()
+	} else if tracker, err = state.NewTracker(u.StatePath); err == nil {
+		defer tracker.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	st := &Status{
+		StatePath:    u.StatePath,
+		Mailboxes:    make(map[string]MailboxStatus),
+		Destinations: make(map[string]DestinationStatus),
+	}
+	if fi, err := os.Stat(u.StatePath); err == nil && u.Open == nil {
+		mod := fi.ModTime().UTC()
+		st.StateModified = &mod
+	}
+	now := h.now()
+	for _, mailbox := range u.Mailboxes {
+		st.Mailboxes[mailbox] = MailboxStatus{}
+	}
+	for mailbox, n := range tracker.Stats() {
+		st.Mailboxes[mailbox] = MailboxStatus{TrackedUIDs: n}
+	}
+	held := make(map[string]bool, len(u.Held))
+	for _, m := range u.Held {
+		held[m] = true
+	}
+	for mailbox, ms := range st.Mailboxes {
+		ms.TransferToday, ms.TransferMonth = tracker.Transfer(mailbox, now)
+		ms.Quarantined = tracker.Quarantined(mailbox)
+		ms.Hold = held[mailbox]
+		ms.Latency = latencyStatus(tracker.Latencies(mailbox, now.Add(-latencyWindow)), u.LatencySLO)
+		if received, _ := tracker.LastReceived(mailbox); !received.IsZero() {
+			received = received.UTC()
+			ms.LastReceived = &received
+		}
+		st.Mailboxes[mailbox] = ms
+	}
+	for dest, ds := range tracker.Destinations() {
+		d := DestinationStatus{Concurrency: ds.Concurrency}
+		if now.Before(ds.DeferredUntil) {
+			until := ds.DeferredUntil.UTC()
+			d.Deferred = true
+			d.DeferredUntil = &until
+		}
+		if ds.Delay > 0 {
+			d.Delay = ds.Delay.String()
+		}
+		st.Destinations[dest] = d
+	}
+	return st, nil
+}
+
+// userStatus is the status of one user for writeMetrics. A single-user
+// instance has one, with no name, and its metrics carry no user label.
+type userStatus struct {
+	name string
+	st   *Status
+}
+
+// labels returns the user label to put before the other labels of a
+// sample, if any.
+func (u userStatus) labels() string {
+	if u.name == "" {
+		return ""
+	}
+	return "user=" + label(u.name) + ","
+}
+
+// writeMetrics renders the status of users in the Prometheus text
+// exposition format.
+func writeMetrics(w io.Writer, users []userStatus, now time.Time) {
+	gauge := func(name, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	}
+	mailboxes := func(fn func(u userStatus, mailbox string, ms MailboxStatus)) {
+		for _, u := range users {
+			for _, mailbox := range sortedKeys(u.st.Mailboxes) {
+				fn(u, mailbox, u.st.Mailboxes[mailbox])
+			}
+		}
+	}
+	dests := func(fn func(u userStatus, dest string, ds DestinationStatus)) {
+		for _, u := range users {
+			for _, dest := range sortedKeys(u.st.Destinations) {
+				fn(u, dest, u.st.Destinations[dest])
+			}
+		}
+	}
+
+	gauge("yatogm_tracked_uids", "Message UIDs recorded as fetched, per mailbox.")
+	mailboxes(func(u userStatus, mailbox string, ms MailboxStatus) {
+		fmt.Fprintf(w, "yatogm_tracked_uids{%smailbox=%s} %d\n", u.labels(), label(mailbox), ms.TrackedUIDs)
+	})
+	gauge("yatogm_quarantined_messages", "Messages written to the quarantine directory, per mailbox.")
+	mailboxes(func(u userStatus, mailbox string, ms MailboxStatus) {
+		fmt.Fprintf(w, "yatogm_quarantined_messages{%smailbox=%s} %d\n", u.labels(), label(mailbox), ms.Quarantined)
+	})
+	gauge("yatogm_mailbox_hold", "Whether the mailbox is under a legal hold.")
+	mailboxes(func(u userStatus, mailbox string, ms MailboxStatus) {
+		v := 0
+		if ms.Hold {
+			v = 1
+		}
+		fmt.Fprintf(w, "yatogm_mailbox_hold{%smailbox=%s} %d\n", u.labels(), label(mailbox), v)
+	})
+	gauge("yatogm_transfer_bytes", "Message bytes moved in the current day or calendar month, per mailbox and direction.")
+	mailboxes(func(u userStatus, mailbox string, ms MailboxStatus) {
+		for _, p := range []struct {
+			period string
+			tr     state.Transfer
+		}{{"day", ms.TransferToday}, {"month", ms.TransferMonth}} {
+			fmt.Fprintf(w, "yatogm_transfer_bytes{%smailbox=%s,direction=\"download\",period=%q} %d\n", u.labels(), label(mailbox), p.period, p.tr.Downloaded)
+			fmt.Fprintf(w, "yatogm_transfer_bytes{%smailbox=%s,direction=\"upload\",period=%q} %d\n", u.labels(), label(mailbox), p.period, p.tr.Uploaded)
+		}
+	})
+	gauge("yatogm_mailbox_last_received_timestamp_seconds", "When new mail was last found in the mailbox, for mailboxes that have received any.")
+	mailboxes(func(u userStatus, mailbox string, ms MailboxStatus) {
+		if ms.LastReceived != nil {
+			fmt.Fprintf(w, "yatogm_mailbox_last_received_timestamp_seconds{%smailbox=%s} %d\n", u.labels(), label(mailbox), ms.LastReceived.Unix())
+		}
+	})
+
+	fmt.Fprintf(w, "# HELP yatogm_forward_latency_seconds Time from a message's Date header to its forwarding, over the last 24 hours, per mailbox.\n# TYPE yatogm_forward_latency_seconds summary\n")
+	mailboxes(func(u userStatus, mailbox string, ms MailboxStatus) {
+		if ms.Latency == nil {
+			return
+		}
+		for _, q := range []struct {
+			quantile string
+			v        float64
+		}{{"0.5", ms.Latency.P50}, {"0.9", ms.Latency.P90}, {"0.99", ms.Latency.P99}} {
+			fmt.Fprintf(w, "yatogm_forward_latency_seconds{%smailbox=%s,quantile=%q} %g\n", u.labels(), label(mailbox), q.quantile, q.v)
+		}
+		fmt.Fprintf(w, "yatogm_forward_latency_seconds_sum{%smailbox=%s} %g\n", u.labels(), label(mailbox), ms.Latency.Sum)
+		fmt.Fprintf(w, "yatogm_forward_latency_seconds_count{%smailbox=%s} %d\n", u.labels(), label(mailbox), ms.Latency.Count)
+	})
+	gauge("yatogm_forward_latency_over_slo", "Messages forwarded later than latency_slo over the last 24 hours, per mailbox.")
+	mailboxes(func(u userStatus, mailbox string, ms MailboxStatus) {
+		if ms.Latency != nil && ms.Latency.SLO > 0 {
+			fmt.Fprintf(w, "yatogm_forward_latency_over_slo{%smailbox=%s} %d\n", u.labels(), label(mailbox), ms.Latency.OverSLO)
+		}
+	})
+
+	written := false
+	for _, u := range users {
+		if u.st.StateModified == nil {
+			continue
+		}
+		if !written {
+			gauge("yatogm_state_modified_timestamp_seconds", "When the state file was last written.")
+			written = true
+		}
+		labels := ""
+		if u.name != "" {
+			labels = "{user=" + label(u.name) + "}"
+		}
+		fmt.Fprintf(w, "yatogm_state_modified_timestamp_seconds%s %d\n", labels, u.st.StateModified.Unix())
+	}
+
+	gauge("yatogm_destination_deferred", "Whether deliveries to the destination are deferred after throttling.")
+	dests(func(u userStatus, dest string, ds DestinationStatus) {
+		v := 0
+		if ds.Deferred {
+			v = 1
+		}
+		fmt.Fprintf(w, "yatogm_destination_deferred{%sdestination=%s} %d\n", u.labels(), label(dest), v)
+	})
+	gauge("yatogm_destination_deferred_seconds", "Time left until deliveries to the destination resume.")
+	dests(func(u userStatus, dest string, ds DestinationStatus) {
+		left := 0.0
+		if ds.DeferredUntil != nil {
+			left = ds.DeferredUntil.Sub(now).Seconds()
+		}
+		fmt.Fprintf(w, "yatogm_destination_deferred_seconds{%sdestination=%s} %g\n", u.labels(), label(dest), left)
+	})
+	gauge("yatogm_destination_concurrency", "Reduced delivery concurrency carried over after throttling (0 = not reduced).")
+	dests(func(u userStatus, dest string, ds DestinationStatus) {
+		fmt.Fprintf(w, "yatogm_destination_concurrency{%sdestination=%s} %d\n", u.labels(), label(dest), ds.Concurrency)
+	})
+}
+
+// label quotes a Prometheus label value.
+func label(v string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	return `"` + r.Replace(v) + `"`
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,182 @@
+package status
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benj-n/yatogm/internal/state"
+)
+
+func newTestHandler(t *testing.T) (*Handler, *state.Tracker) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "state.json")
+	tracker, err := state.NewTracker(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	return NewHandler(path, []string{"a@yahoo.com", "b@yahoo.com"}, logger), tracker
+}
+
+func get(t *testing.T, h http.Handler, path string) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET %s: status %d: %s", path, rec.Code, rec.Body)
+	}
+	return rec
+}
+
+func TestStatus(t *testing.T) {
+	h, tracker := newTestHandler(t)
+	h.SetHold([]string{"b@yahoo.com"})
+	now := time.Date(2024, 5, 1, 14, 0, 0, 0, time.UTC)
+	h.now = func() time.Time { return now }
+
+	_ = tracker.MarkBatchFetched("a@yahoo.com", []string{"uid1", "uid2"})
+	_ = tracker.AddTransfer("a@yahoo.com", now, 4096, 4200)
+	_ = tracker.SetDestination("me@gmail.com", state.DestinationState{
+		DeferredUntil: now.Add(32 * time.Minute),
+		Concurrency:   1,
+		Delay:         2 * time.Second,
+	})
+
+	var st Status
+	if err := json.Unmarshal(get(t, h, "/status").Body.Bytes(), &st); err != nil {
+		t.Fatalf("decoding status: %v", err)
+	}
+	if st.Mailboxes["a@yahoo.com"].TrackedUIDs != 2 {
+		t.Errorf("expected 2 tracked UIDs for a@yahoo.com, got %+v", st.Mailboxes)
+	}
+	if tr := st.Mailboxes["a@yahoo.com"].TransferMonth; tr.Downloaded != 4096 || tr.Uploaded != 4200 {
+		t.Errorf("unexpected monthly transfer %+v", tr)
+	}
+	if ms, ok := st.Mailboxes["b@yahoo.com"]; !ok || !ms.Hold {
+		t.Errorf("expected configured mailbox b@yahoo.com to be listed on hold, got %+v", st.Mailboxes)
+	}
+	if st.Mailboxes["a@yahoo.com"].Hold {
+		t.Error("a@yahoo.com is not on hold")
+	}
+	d := st.Destinations["me@gmail.com"]
+	if !d.Deferred || d.DeferredUntil == nil || !d.DeferredUntil.Equal(now.Add(32*time.Minute)) || d.Delay != "2s" {
+		t.Errorf("unexpected destination status %+v", d)
+	}
+	if st.StateModified == nil {
+		t.Error("expected state modification time")
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	h, tracker := newTestHandler(t)
+	h.SetHold([]string{"b@yahoo.com"})
+	now := time.Date(2024, 5, 1, 14, 0, 0, 0, time.UTC)
+	h.now = func() time.Time { return now }
+
+	_ = tracker.MarkFetched("a@yahoo.com", "uid1")
+	_ = tracker.MarkQuarantined("a@yahoo.com", "uid2", now)
+	_ = tracker.AddTransfer("a@yahoo.com", now, 4096, 4200)
+	_ = tracker.MarkReceived("a@yahoo.com", now)
+	for _, l := range []time.Duration{30 * time.Second, time.Minute, 10 * time.Minute} {
+		_ = tracker.RecordLatency("a@yahoo.com", now, l)
+	}
+	h.SetLatencySLO(5 * time.Minute)
+	_ = tracker.SetDestination("me@gmail.com", state.DestinationState{DeferredUntil: now.Add(time.Minute), Concurrency: 2})
+
+	body := get(t, h, "/metrics").Body.String()
+	for _, want := range []string{
+		`yatogm_tracked_uids{mailbox="a@yahoo.com"} 1`,
+		`yatogm_tracked_uids{mailbox="b@yahoo.com"} 0`,
+		`yatogm_quarantined_messages{mailbox="a@yahoo.com"} 1`,
+		`yatogm_mailbox_hold{mailbox="a@yahoo.com"} 0`,
+		`yatogm_mailbox_hold{mailbox="b@yahoo.com"} 1`,
+		`yatogm_transfer_bytes{mailbox="a@yahoo.com",direction="download",period="month"} 4096`,
+		`yatogm_transfer_bytes{mailbox="a@yahoo.com",direction="upload",period="day"} 4200`,
+		`yatogm_transfer_bytes{mailbox="b@yahoo.com",direction="download",period="day"} 0`,
+		`yatogm_mailbox_last_received_timestamp_seconds{mailbox="a@yahoo.com"} 1714572000`,
+		`yatogm_forward_latency_seconds{mailbox="a@yahoo.com",quantile="0.5"} 60`,
+		`yatogm_forward_latency_seconds{mailbox="a@yahoo.com",quantile="0.99"} 600`,
+		`yatogm_forward_latency_seconds_sum{mailbox="a@yahoo.com"} 690`,
+		`yatogm_forward_latency_seconds_count{mailbox="a@yahoo.com"} 3`,
+		`yatogm_forward_latency_over_slo{mailbox="a@yahoo.com"} 1`,
+		`yatogm_destination_deferred{destination="me@gmail.com"} 1`,
+		`yatogm_destination_deferred_seconds{destination="me@gmail.com"} 60`,
+		`yatogm_destination_concurrency{destination="me@gmail.com"} 2`,
+		"# TYPE yatogm_state_modified_timestamp_seconds gauge",
+	} {
+		if !strings.Contains(body, want+"\n") {
+			t.Errorf("metrics missing %q:\n%s", want, body)
+		}
+	}
+}
+
+func TestHealthAndMissingState(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	h := NewHandler(filepath.Join(t.TempDir(), "missing.json"), nil, logger)
+
+	if body := get(t, h, "/healthz").Body.String(); body != "ok\n" {
+		t.Errorf("unexpected health body %q", body)
+	}
+	// A state file that does not exist yet is an empty state, not an error.
+	get(t, h, "/status")
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/status", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected POST to be rejected, got %d", rec.Code)
+	}
+}
+
+func TestLabelEscaping(t *testing.T) {
+	if got := label("a\"b\\c\nd"); got != `"a\"b\\c\nd"` {
+		t.Errorf("label() = %s", got)
+	}
+}
+
+func TestServiceHandler(t *testing.T) {
+	dir := t.TempDir()
+	var users []User
+	for _, name := range []string{"alice", "bob"} {
+		path := filepath.Join(dir, name+".json")
+		tracker, err := state.NewTracker(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = tracker.MarkFetched(name+"@yahoo.com", "uid1")
+		users = append(users, User{Name: name, StatePath: path, Mailboxes: []string{name + "@yahoo.com"}})
+	}
+	users[1].Held = []string{"bob@yahoo.com"}
+	h := NewServiceHandler(users, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	var byUser map[string]Status
+	if err := json.Unmarshal(get(t, h, "/status").Body.Bytes(), &byUser); err != nil {
+		t.Fatalf("decoding status: %v", err)
+	}
+	if len(byUser) != 2 || byUser["alice"].Mailboxes["alice@yahoo.com"].TrackedUIDs != 1 || !byUser["bob"].Mailboxes["bob@yahoo.com"].Hold {
+		t.Errorf("unexpected status %+v", byUser)
+	}
+	if _, ok := byUser["alice"].Mailboxes["bob@yahoo.com"]; ok {
+		t.Error("bob's mailbox is reported for alice")
+	}
+
+	body := get(t, h, "/metrics").Body.String()
+	for _, want := range []string{
+		`yatogm_tracked_uids{user="alice",mailbox="alice@yahoo.com"} 1`,
+		`yatogm_mailbox_hold{user="bob",mailbox="bob@yahoo.com"} 1`,
+		`yatogm_state_modified_timestamp_seconds{user="bob"} `,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics missing %q:\n%s", want, body)
+		}
+	}
+	if n := strings.Count(body, "# TYPE yatogm_tracked_uids gauge"); n != 1 {
+		t.Errorf("expected one TYPE line per metric, got %d", n)
+	}
+}
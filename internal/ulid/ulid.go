@@ -0,0 +1,152 @@
+// Package ulid generates ULIDs: 128-bit, lexicographically sortable
+// identifiers made of a 48-bit millisecond timestamp followed by 80 random
+// bits, written as 26 Crockford base32 characters (https://github.com/ulid/spec).
+package ulid
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// encoding is Crockford's base32 alphabet.
+const encoding = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// maxTime is the largest timestamp a ULID can hold.
+const maxTime = 1<<48 - 1
+
+// ULID is a parsed identifier.
+type ULID [16]byte
+
+// New returns a ULID for t with randomness read from entropy.
+func New(t time.Time, entropy io.Reader) (ULID, error) {
+	var u ULID
+	ms := t.UnixMilli()
+	if ms < 0 || ms > maxTime {
+		return u, fmt.Errorf("ulid: time %s out of range", t)
+	}
+	putTime(&u, uint64(ms))
+	if _, err := io.ReadFull(entropy, u[6:]); err != nil {
+		return u, fmt.Errorf("ulid: reading entropy: %w", err)
+	}
+	return u, nil
+}
+
+var (
+	mu   sync.Mutex
+	last ULID
+)
+
+// Make returns a new ULID for the current time. IDs made within the same
+// millisecond increment the random part of the previous one, so IDs from
+// one process sort in the order they were made. It is safe for concurrent
+// use.
+func Make() ULID {
+	mu.Lock()
+	defer mu.Unlock()
+
+	ms := uint64(time.Now().UnixMilli())
+	if last != (ULID{}) && ms <= last.ms() {
+		// Same millisecond, or the clock stepped back: keep the previous
+		// timestamp and increment its random part.
+		if !last.incrementRandom() {
+			return last
+		}
+		ms = last.ms() + 1
+	}
+	var u ULID
+	putTime(&u, ms)
+	if _, err := io.ReadFull(rand.Reader, u[6:]); err != nil {
+		panic("ulid: crypto/rand failed: " + err.Error())
+	}
+	last = u
+	return u
+}
+
+// incrementRandom adds one to the random part, reporting whether it
+// overflowed.
+func (u *ULID) incrementRandom() bool {
+	for i := len(u) - 1; i >= 6; i-- {
+		u[i]++
+		if u[i] != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func putTime(u *ULID, ms uint64) {
+	for i := 5; i >= 0; i-- {
+		u[i] = byte(ms)
+		ms >>= 8
+	}
+}
+
+func (u ULID) ms() uint64 {
+	var ms uint64
+	for i := 0; i < 6; i++ {
+		ms = ms<<8 | uint64(u[i])
+	}
+	return ms
+}
+
+// Time returns the timestamp encoded in u.
+func (u ULID) Time() time.Time {
+	return time.UnixMilli(int64(u.ms()))
+}
+
+// String returns the canonical 26-character form of u.
+func (u ULID) String() string {
+	// The text form holds 130 bits: two zero bits, then the 128 bits of u.
+	var out [26]byte
+	for i := range out {
+		var v byte
+		for bit := i*5 - 2; bit < i*5+3; bit++ {
+			v <<= 1
+			if bit >= 0 && u[bit/8]&(0x80>>(bit%8)) != 0 {
+				v |= 1
+			}
+		}
+		out[i] = encoding[v]
+	}
+	return string(out[:])
+}
+
+// errInvalid is returned by Parse for malformed input.
+var errInvalid = errors.New("ulid: invalid string")
+
+// Parse parses the canonical text form of a ULID, case-insensitively.
+func Parse(s string) (ULID, error) {
+	var u ULID
+	if len(s) != 26 || s[0] > '7' {
+		return u, errInvalid
+	}
+	for i := 0; i < len(s); i++ {
+		v := decode(s[i])
+		if v < 0 {
+			return u, errInvalid
+		}
+		for j := 0; j < 5; j++ {
+			bit := i*5 - 2 + j
+			if bit >= 0 && v&(0x10>>j) != 0 {
+				u[bit/8] |= 0x80 >> (bit % 8)
+			}
+		}
+	}
+	return u, nil
+}
+
+func decode(c byte) int {
+	if c >= 'a' && c <= 'z' {
+		c -= 'a' - 'A'
+	}
+	for i := 0; i < len(encoding); i++ {
+		if encoding[i] == c {
+			return i
+		}
+	}
+	return -1
+}
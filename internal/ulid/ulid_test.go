@@ -0,0 +1,76 @@
+package ulid
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStringBounds(t *testing.T) {
+	if got := (ULID{}).String(); got != "00000000000000000000000000" {
+		t.Errorf("zero ULID = %q", got)
+	}
+	var maxULID ULID
+	for i := range maxULID {
+		maxULID[i] = 0xff
+	}
+	if got := maxULID.String(); got != "7ZZZZZZZZZZZZZZZZZZZZZZZZZ" {
+		t.Errorf("max ULID = %q", got)
+	}
+}
+
+func TestNewRoundTrip(t *testing.T) {
+	ts := time.UnixMilli(1469918176385)
+	u, err := New(ts, bytes.NewReader(bytes.Repeat([]byte{0xa5}, 10)))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	s := u.String()
+	// The timestamp from the ULID spec's example encodes to 01ARYZ6S41.
+	if !strings.HasPrefix(s, "01ARYZ6S41") {
+		t.Errorf("unexpected timestamp encoding in %q", s)
+	}
+	if !u.Time().Equal(ts) {
+		t.Errorf("Time() = %v, want %v", u.Time(), ts)
+	}
+
+	parsed, err := Parse(strings.ToLower(s))
+	if err != nil {
+		t.Fatalf("Parse(%q) failed: %v", s, err)
+	}
+	if parsed != u {
+		t.Errorf("round trip mismatch: %x != %x", parsed, u)
+	}
+}
+
+func TestNewOutOfRange(t *testing.T) {
+	if _, err := New(time.UnixMilli(-1), bytes.NewReader(make([]byte, 10))); err == nil {
+		t.Error("expected error for negative time")
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, s := range []string{
+		"",
+		"0000000000000000000000000",   // too short
+		"80000000000000000000000000",  // overflows 128 bits
+		"0000000000000000000000000U",  // not in the alphabet
+		"000000000000000000000000000", // too long
+	} {
+		if _, err := Parse(s); err == nil {
+			t.Errorf("Parse(%q): expected error", s)
+		}
+	}
+}
+
+func TestMakeSorted(t *testing.T) {
+	prev := Make().String()
+	for i := 0; i < 1000; i++ {
+		next := Make().String()
+		if next <= prev {
+			t.Fatalf("IDs not increasing: %s then %s", prev, next)
+		}
+		prev = next
+	}
+}
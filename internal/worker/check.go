@@ -0,0 +1,96 @@
+package worker
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/benj-n/yatogm/internal/config"
+	"github.com/benj-n/yatogm/internal/pop3"
+)
+
+// CheckResult is the outcome of checking the connection to one server.
+type CheckResult struct {
+	// Service is "yahoo" or "gmail".
+	Service string
+	// Account is the address logged in as.
+	Account string
+	// Addr is the server's host:port.
+	Addr string
+	// Latency is the time taken by the whole check.
+	Latency time.Duration
+	// Detail describes what the server reported, such as the mailbox size.
+	Detail string
+	// Err is the reason the check failed, or nil.
+	Err error
+}
+
+// Check connects to every Yahoo mailbox and to Gmail, if configured,
+// authenticates, and runs STAT and NOOP, to verify settings and
+// credentials. It retrieves, deletes, and delivers nothing, and does not
+// use the state tracker.
+func (w *Worker) Check() []CheckResult {
+	results := make([]CheckResult, 0, len(w.cfg.Yahoo)+1)
+	for _, yahoo := range w.cfg.Yahoo {
+		results = append(results, w.checkMailbox(yahoo))
+	}
+
+	if w.cfg.Gmail.Email == "" {
+		return results
+	}
+
+	r := CheckResult{
+		Service: "gmail",
+		Account: w.cfg.Gmail.Email,
+		Addr:    net.JoinHostPort(w.cfg.Gmail.SMTPHost, strconv.Itoa(w.cfg.Gmail.SMTPPort)),
+	}
+	start := w.clock.Now()
+	r.Err = w.sender.Check()
+	r.Latency = w.clock.Now().Sub(start)
+	if r.Err == nil {
+		r.Detail = "authenticated as " + w.cfg.Gmail.Auth
+	}
+	return append(results, r)
+}
+
+// checkMailbox checks the connection to one Yahoo mailbox.
+func (w *Worker) checkMailbox(yahoo config.YahooMailbox) CheckResult {
+	r := CheckResult{
+		Service: "yahoo",
+		Account: yahoo.Email,
+		Addr:    net.JoinHostPort(yahoo.POP3Host, strconv.Itoa(yahoo.POP3Port)),
+	}
+	start := w.clock.Now()
+	r.Detail, r.Err = w.statMailbox(yahoo)
+	r.Latency = w.clock.Now().Sub(start)
+	return r
+}
+
+// statMailbox logs in to a Yahoo mailbox and describes its contents.
+func (w *Worker) statMailbox(yahoo config.YahooMailbox) (string, error) {
+	opts, err := w.pop3Options(yahoo)
+	if err != nil {
+		return "", err
+	}
+	client, err := pop3.DialMode(yahoo.POP3Host, yahoo.POP3Port, w.cfg.DialTimeout, config.PinnedTLS(w.tlsConfig, yahoo.TLSPins), pop3.TLSMode(yahoo.POP3TLSMode), opts...)
+	if err != nil {
+		return "", err
+	}
+	client.SetCommandTimeout(w.cfg.CommandTimeout)
+	defer client.Close()
+	if err := client.Login(yahoo.Email, yahoo.AppPassword); err != nil {
+		return "", err
+	}
+	count, size, err := client.Stat()
+	if err != nil {
+		return "", err
+	}
+	if err := client.Noop(); err != nil {
+		return "", err
+	}
+	if err := client.Quit(); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d messages, %d bytes", count, size), nil
+}
@@ -0,0 +1,97 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/benj-n/yatogm/internal/clock"
+)
+
+func TestCheckUnreachable(t *testing.T) {
+	cfg := unreachableConfig(t)
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError}))
+
+	results := New(cfg, nil, logger).Check()
+	if len(results) != 2 {
+		t.Fatalf("expected a result per mailbox and for Gmail, got %+v", results)
+	}
+	for i, want := range []string{"yahoo", "gmail"} {
+		r := results[i]
+		if r.Service != want || r.Addr != "127.0.0.1:1" || r.Err == nil {
+			t.Errorf("result %d = %+v, want a failed %s check", i, r, want)
+		}
+	}
+	if results[0].Account != "test@yahoo.com" || results[1].Account != "test@gmail.com" {
+		t.Errorf("unexpected accounts: %+v", results)
+	}
+}
+
+func TestCheckWithDialerAndClock(t *testing.T) {
+	cfg := unreachableConfig(t)
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError}))
+
+	// Each connection takes 2s by the fake clock, and fails.
+	clk := clock.NewFake(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC))
+	var dialed []string
+	dial := dialerFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+		dialed = append(dialed, address)
+		clk.Advance(2 * time.Second)
+		return nil, errors.New("no route")
+	})
+
+	results := New(cfg, nil, logger, WithClock(clk), WithDialer(dial)).Check()
+	if len(dialed) != 2 {
+		t.Fatalf("expected both servers dialed through the dialer, got %q", dialed)
+	}
+	for i, r := range results {
+		if r.Err == nil || !strings.Contains(r.Err.Error(), "no route") || r.Latency != 2*time.Second {
+			t.Errorf("result %d = %+v, want the dialer's error after 2s", i, r)
+		}
+	}
+}
+
+func TestCheckThroughProxy(t *testing.T) {
+	cfg := unreachableConfig(t)
+	cfg.Proxy = "socks5://proxy.example.com:1080"
+	direct := cfg.Yahoo[0]
+	direct.Email, direct.POP3Port, direct.Proxy = "direct@yahoo.com", 2, "direct"
+	cfg.Yahoo = append(cfg.Yahoo, direct)
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError}))
+
+	// The proxy is reached with the Worker's dialer, except by the mailbox
+	// that connects directly.
+	var mu sync.Mutex
+	var dialed []string
+	dial := dialerFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+		mu.Lock()
+		dialed = append(dialed, address)
+		mu.Unlock()
+		return nil, errors.New("no route")
+	})
+	results := New(cfg, nil, logger, WithDialer(dial)).Check()
+	slices.Sort(dialed)
+	if want := []string{"127.0.0.1:2", "proxy.example.com:1080", "proxy.example.com:1080"}; !slices.Equal(dialed, want) {
+		t.Errorf("dialed %q, want %q", dialed, want)
+	}
+	for _, r := range results {
+		if viaProxy := r.Account != "direct@yahoo.com"; viaProxy != strings.Contains(fmt.Sprint(r.Err), "proxy proxy.example.com:1080") {
+			t.Errorf("result for %s = %v", r.Account, r.Err)
+		}
+	}
+}
+
+// dialerFunc is a Dialer calling itself.
+type dialerFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+func (f dialerFunc) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return f(ctx, network, address)
+}
@@ -0,0 +1,102 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/benj-n/yatogm/internal/clock"
+)
+
+const (
+	// minRunPause is how long every delivery to a destination waits after
+	// its first throttling response in a run.
+	minRunPause = 30 * time.Second
+	// maxRunPause is the longest pause within a run: once throttling would
+	// double the pause past it, the run stops delivering to the
+	// destination and leaves the rest to later runs.
+	maxRunPause = 8 * time.Minute
+)
+
+// errGaveUp is returned for deliveries not attempted because the
+// destination kept throttling, or its daily quota is used up.
+var errGaveUp = errors.New("destination throttling, delivery left for a later run")
+
+// cooldown holds every delivery to a destination for a pause after each
+// throttling response, doubling the pause on each one and starting over
+// after a success, so that a throttling Gmail is left alone rather than
+// sent every pending message, each of which counts against its sending
+// quota. It is safe for concurrent use.
+type cooldown struct {
+	mu    sync.Mutex
+	until time.Time
+	pause time.Duration
+	// gaveUp is set once the run stops delivering.
+	gaveUp bool
+}
+
+// reset forgets the pauses of an earlier run.
+func (c *cooldown) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.until, c.pause, c.gaveUp = time.Time{}, 0, false
+}
+
+// wait blocks until the current pause is over, or ctx is done. It returns
+// errGaveUp at once if the run gave up on the destination.
+func (c *cooldown) wait(ctx context.Context, clk clock.Clock) error {
+	c.mu.Lock()
+	until, gaveUp := c.until, c.gaveUp
+	c.mu.Unlock()
+	if gaveUp {
+		return errGaveUp
+	}
+	d := until.Sub(clk.Now())
+	if d <= 0 {
+		return nil
+	}
+	select {
+	case <-clk.After(d):
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.gaveUp {
+		return errGaveUp
+	}
+	return nil
+}
+
+// throttled records a throttling response at now and returns the pause
+// every delivery now waits, or false if the run gives up instead: on a
+// used-up quota, which no pause within the run lifts, or once the pause
+// would exceed maxRunPause. Responses to deliveries started before the
+// current pause do not extend it.
+func (c *cooldown) throttled(now time.Time, quota bool) (time.Duration, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.gaveUp {
+		return 0, false
+	}
+	if now.Before(c.until) {
+		return c.until.Sub(now), true
+	}
+	next := max(2*c.pause, minRunPause)
+	if quota || next > maxRunPause {
+		c.gaveUp = true
+		return 0, false
+	}
+	c.pause = next
+	c.until = now.Add(next)
+	return next, true
+}
+
+// succeeded records a successful delivery, after which the next
+// throttling response pauses for minRunPause again.
+func (c *cooldown) succeeded() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pause = 0
+}
@@ -0,0 +1,97 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/benj-n/yatogm/internal/clock"
+)
+
+func TestCooldownDoubles(t *testing.T) {
+	clk := clock.NewFake(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC))
+	var c cooldown
+
+	var pauses []time.Duration
+	for {
+		pause, ok := c.throttled(clk.Now(), false)
+		if !ok {
+			break
+		}
+		pauses = append(pauses, pause)
+		// Throttling answers to deliveries already in flight do not
+		// extend the pause.
+		if again, _ := c.throttled(clk.Now(), false); again != pause {
+			t.Fatalf("expected a concurrent response to keep the %v pause, got %v", pause, again)
+		}
+		clk.Advance(pause)
+	}
+	want := []time.Duration{30 * time.Second, time.Minute, 2 * time.Minute, 4 * time.Minute, 8 * time.Minute}
+	if len(pauses) != len(want) {
+		t.Fatalf("pauses = %v, want %v", pauses, want)
+	}
+	for i := range want {
+		if pauses[i] != want[i] {
+			t.Errorf("pauses = %v, want %v", pauses, want)
+		}
+	}
+	if err := c.wait(context.Background(), clk); !errors.Is(err, errGaveUp) {
+		t.Errorf("expected the run to give up, got %v", err)
+	}
+
+	c.reset()
+	if err := c.wait(context.Background(), clk); err != nil {
+		t.Errorf("expected a new run to deliver, got %v", err)
+	}
+}
+
+func TestCooldownSuccessStartsOver(t *testing.T) {
+	clk := clock.NewFake(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC))
+	var c cooldown
+	c.throttled(clk.Now(), false)
+	clk.Advance(time.Hour)
+	c.succeeded()
+	if pause, ok := c.throttled(clk.Now(), false); !ok || pause != minRunPause {
+		t.Errorf("expected the pause to start over after a success, got %v, %v", pause, ok)
+	}
+}
+
+func TestCooldownQuota(t *testing.T) {
+	clk := clock.NewFake(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC))
+	var c cooldown
+	if _, ok := c.throttled(clk.Now(), true); ok {
+		t.Error("expected a used-up quota to end deliveries for the run")
+	}
+	if err := c.wait(context.Background(), clk); !errors.Is(err, errGaveUp) {
+		t.Errorf("expected errGaveUp, got %v", err)
+	}
+}
+
+func TestCooldownWait(t *testing.T) {
+	clk := clock.NewFake(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC))
+	var c cooldown
+	c.throttled(clk.Now(), false)
+
+	done := make(chan error, 1)
+	go func() { done <- c.wait(context.Background(), clk) }()
+	for clk.Waiting() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("expected the delivery to wait out the pause, got %v", err)
+	default:
+	}
+	clk.Advance(minRunPause)
+	if err := <-done; err != nil {
+		t.Errorf("wait failed: %v", err)
+	}
+
+	c.throttled(clk.Now(), false)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := c.wait(ctx, clk); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the wait to end with ctx, got %v", err)
+	}
+}
@@ -0,0 +1,82 @@
+package worker
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+
+	"github.com/benj-n/yatogm/internal/state"
+)
+
+// corruptNoticed records the state files whose corruption stopped a run
+// and was sent to Gmail, so that a daemon retrying every interval sends
+// one notice rather than one per run.
+var corruptNoticed sync.Map
+
+// reportCorrupted logs the corrupted state files the tracker went on
+// without, and sends a notice about each to Gmail: messages recorded only
+// in the lost state may be forwarded again.
+func (w *Worker) reportCorrupted(log *slog.Logger) {
+	for _, c := range w.tracker.Corrupted() {
+		var b strings.Builder
+		fmt.Fprintf(&b, "The state file %s was found corrupted.\n\n", c.Path)
+		if c.Generation != "" {
+			log.Warn("state file corrupted, read its previous generation; recent changes may be lost",
+				"file", c.Path, "generation", c.Generation)
+			fmt.Fprintf(&b, "Its previous generation, %s, was read instead. Messages forwarded after it was saved may be forwarded again.\n", c.Generation)
+		} else {
+			log.Error("state file corrupted, starting with no state; messages still on the server will be forwarded again",
+				"file", c.Path)
+			b.WriteString("yatogm started with no state, so every message still on the server is forwarded again.\n")
+		}
+		w.noticeCorruption("[yatogm] state file corrupted: "+c.Path, b.String())
+	}
+}
+
+// ReportStateError logs why the state could not be loaded, for a worker
+// created without it, and if it is corrupted, sends a notice to Gmail, once
+// per file while the process runs.
+func (w *Worker) ReportStateError(err error) {
+	defer w.closeSMTP()
+	w.stateError(w.logger, err)
+}
+
+// stateError logs why the state could not be loaded and notifies Gmail if
+// it is corrupted, as ReportStateError does.
+func (w *Worker) stateError(log *slog.Logger, err error) {
+	var ce *state.CorruptError
+	if !errors.As(err, &ce) {
+		log.Error("loading state failed", "error", err)
+		return
+	}
+	if w.cfg.StateCorruption == "fresh" {
+		log.Error("state file corrupted, run once with -accept-fresh-state to start with no state", "file", ce.Path)
+	} else {
+		log.Error("state file corrupted, not forwarding until it is restored", "file", ce.Path, "error", err)
+	}
+	if _, seen := corruptNoticed.LoadOrStore(ce.Path, true); seen {
+		return
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "The state file %s is corrupted, and state_corruption is %q.\n\n", ce.Path, w.cfg.StateCorruption)
+	b.WriteString("Nothing is forwarded until the state can be read again, so that messages forwarded before are not forwarded twice. ")
+	if w.cfg.StateCorruption == "fresh" {
+		b.WriteString("To start over, forwarding again every message still on the server, run \"yatogm run -accept-fresh-state\" once.\n")
+	} else {
+		b.WriteString("Restore the file from a backup, or set state_corruption to \"fresh\" and run \"yatogm run -accept-fresh-state\" once to start over.\n")
+	}
+	w.noticeCorruption("[yatogm] state file corrupted, forwarding stopped: "+ce.Path, b.String())
+}
+
+// noticeCorruption sends a notice about corrupted state to Gmail, if it is
+// configured.
+func (w *Worker) noticeCorruption(subject, body string) {
+	if w.cfg.Gmail.Email == "" {
+		return
+	}
+	if err := w.notify(subject, body); err != nil {
+		w.logger.Error("state corruption notification failed", "error", err)
+	}
+}
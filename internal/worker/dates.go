@@ -0,0 +1,52 @@
+package worker
+
+import (
+	"time"
+
+	"github.com/benj-n/yatogm/internal/config"
+)
+
+// outOfRange reports whether the message uid is dated outside the since and
+// before of yahoo, reading its header on sess unless its date was recorded
+// by an earlier run, and returns the number of bytes downloaded. The date
+// of a message found out of range is added to found, if not nil, for the
+// caller to record. A message without a valid Date header is in range.
+func (w *Worker) outOfRange(sess *session, yahoo config.YahooMailbox, uid string, found map[string]time.Time) (bool, int64, error) {
+	since, before, _ := yahoo.DateRange()
+	if since.IsZero() && before.IsZero() {
+		return false, 0, nil
+	}
+	if date, ok := w.tracker.Date(yahoo.Email, uid); ok {
+		return outside(date, since, before), 0, nil
+	}
+	header, n, err := sess.retrieveHeader(uid)
+	if err != nil {
+		return false, n, err
+	}
+	date, err := header.Date()
+	if err != nil || !outside(date, since, before) {
+		return false, n, nil
+	}
+	if found != nil {
+		found[uid] = date
+	}
+	return true, n, nil
+}
+
+// knownOutOfRange reports whether the message uid was left on the server
+// for being dated outside the since and before of yahoo, without reading
+// its header.
+func (w *Worker) knownOutOfRange(yahoo config.YahooMailbox, uid string) bool {
+	date, ok := w.tracker.Date(yahoo.Email, uid)
+	if !ok {
+		return false
+	}
+	since, before, _ := yahoo.DateRange()
+	return outside(date, since, before)
+}
+
+// outside reports whether date is before since or not before before, either
+// of which may be zero, for no bound.
+func outside(date, since, before time.Time) bool {
+	return !since.IsZero() && date.Before(since) || !before.IsZero() && !date.Before(before)
+}
@@ -0,0 +1,114 @@
+package worker
+
+import (
+	"log/slog"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/benj-n/yatogm/internal/config"
+	"github.com/benj-n/yatogm/internal/state"
+)
+
+// toppedSession returns message headers without retrieving the messages,
+// counting the headers read.
+type toppedSession struct {
+	*fakeMailboxSession
+	tops *int
+}
+
+func (s toppedSession) Top(uid string, lines int) ([]byte, error) {
+	*s.tops++
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+	header, _, _ := strings.Cut(s.m.msgs[uid], "\r\n\r\n")
+	return []byte(header + "\r\n\r\n"), nil
+}
+
+func TestDateRangeFiltering(t *testing.T) {
+	cfg := unreachableConfig(t)
+	cfg.Gmail = config.GmailConfig{}
+	cfg.Yahoo = []config.YahooMailbox{{Email: "a@yahoo.com", Since: "2024-01-01", Before: "2025-01-01"}}
+	tracker, err := state.NewTracker(cfg.StatePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mailbox := &fakeMailbox{msgs: map[string]string{
+		"uid1": "Date: Tue, 14 Nov 2023 10:00:00 +0000\r\nSubject: old\r\n\r\nbody\r\n",
+		"uid2": "Date: Sat, 15 Jun 2024 10:00:00 +0000\r\nSubject: in range\r\n\r\nbody\r\n",
+		"uid3": "Date: Mon, 03 Feb 2025 10:00:00 +0000\r\nSubject: new\r\n\r\nbody\r\n",
+		"uid4": "Subject: undated\r\n\r\nbody\r\n",
+	}}
+	tops := 0
+	open := func(y config.YahooMailbox) (Source, error) {
+		s, err := mailbox.open(y)
+		return toppedSession{s.(*fakeMailboxSession), &tops}, err
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelError}))
+	// Messages dated outside the range stay on the server, and later runs
+	// find their dates in the state.
+	var w *Worker
+	for run := 1; run <= 2; run++ {
+		w = New(cfg, tracker, logger, WithSource(open), WithDestination(&contentDestination{}, true))
+		if _, errs, err := w.run(cfg.Yahoo); err != nil || errs != 0 {
+			t.Fatalf("run %d: %d errors (%v)", run, errs, err)
+		}
+		if _, ok := mailbox.msgs["uid2"]; ok || len(mailbox.msgs) != 2 {
+			t.Errorf("run %d: left %d messages, want the old and new ones", run, len(mailbox.msgs))
+		}
+		if tops != 4 {
+			t.Errorf("run %d: read %d headers, want 4", run, tops)
+		}
+	}
+
+	inv, err := w.inventory(cfg.Yahoo[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inv.OutOfRange != 2 || inv.Pending != 0 {
+		t.Errorf("inventory = %+v, want 2 messages out of range and none pending", inv)
+	}
+
+	p, err := w.Plan(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := p.Mailboxes[0].Count(ActionOutOfRange); n != 2 {
+		t.Errorf("plan has %d messages out of range, want 2", n)
+	}
+}
+
+func TestDateRangeRunCap(t *testing.T) {
+	cfg := unreachableConfig(t)
+	cfg.Gmail = config.GmailConfig{}
+	cfg.Yahoo = []config.YahooMailbox{{Email: "a@yahoo.com", Since: "2024-01-01", MaxMessagesPerRun: 1}}
+	tracker, err := state.NewTracker(cfg.StatePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mailbox := &fakeMailbox{msgs: map[string]string{
+		"uid1": "Date: Sat, 15 Jun 2024 10:00:00 +0000\r\nSubject: one\r\n\r\nbody\r\n",
+		"uid2": "Date: Sun, 16 Jun 2024 10:00:00 +0000\r\nSubject: two\r\n\r\nbody\r\n",
+		"uid3": "Date: Mon, 17 Jun 2024 10:00:00 +0000\r\nSubject: three\r\n\r\nbody\r\n",
+	}}
+	tops := 0
+	open := func(y config.YahooMailbox) (Source, error) {
+		s, err := mailbox.open(y)
+		return toppedSession{s.(*fakeMailboxSession), &tops}, err
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelError}))
+	// Only the header of the message the run has room for is read; the
+	// rest wait for later runs.
+	for run := 1; run <= 3; run++ {
+		w := New(cfg, tracker, logger, WithSource(open), WithDestination(&contentDestination{}, true))
+		if fetched, errs, err := w.run(cfg.Yahoo); err != nil || errs != 0 || fetched != 1 {
+			t.Fatalf("run %d: %d fetched, %d errors (%v)", run, fetched, errs, err)
+		}
+		if tops != run {
+			t.Errorf("run %d: read %d headers in all, want %d", run, tops, run)
+		}
+	}
+	if len(mailbox.msgs) != 0 {
+		t.Errorf("left %d messages, want none", len(mailbox.msgs))
+	}
+}
@@ -0,0 +1,77 @@
+package worker
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/benj-n/yatogm/internal/config"
+	"github.com/benj-n/yatogm/internal/state"
+)
+
+// hangingSession is a session on which retrieving one message never ends
+// but with its context.
+type hangingSession struct {
+	*fakeMailboxSession
+	hang string
+}
+
+func (s hangingSession) FetchContext(ctx context.Context, uid string, w io.Writer) (int64, error) {
+	if uid == s.hang {
+		<-ctx.Done()
+		return 0, ctx.Err()
+	}
+	return s.Fetch(uid, w)
+}
+
+func TestDeadlines(t *testing.T) {
+	cfg := unreachableConfig(t)
+	cfg.Gmail = config.GmailConfig{}
+	cfg.Maildir.Dir = t.TempDir()
+	tracker, err := state.NewTracker(cfg.StatePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mb := &fakeMailbox{msgs: map[string]string{
+		"uid1": "From: a@example.com\r\nSubject: one\r\n\r\nbody\r\n",
+		"uid2": "From: a@example.com\r\nSubject: two\r\n\r\nbody\r\n",
+		"uid3": "From: a@example.com\r\nSubject: three\r\n\r\nbody\r\n",
+	}}
+	open := func(yahoo config.YahooMailbox) (Source, error) {
+		s, err := mb.open(yahoo)
+		if err != nil {
+			return nil, err
+		}
+		return hangingSession{s.(*fakeMailboxSession), "uid2"}, nil
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelError}))
+
+	// A message past its deadline ends the session, and the messages
+	// after it wait for the next run.
+	cfg.MessageDeadline = 50 * time.Millisecond
+	w := New(cfg, tracker, logger, WithSource(open))
+	if fetched, errs := w.processMailbox(0, cfg.Yahoo[0]); fetched != 1 || errs != 1 {
+		t.Fatalf("expected one message forwarded and one error, got %d fetched, %d errors", fetched, errs)
+	}
+	if tracker.IsFetched("test@yahoo.com", "uid3") {
+		t.Error("expected the message after the one past its deadline to be left")
+	}
+
+	// Past the mailbox deadline, no further message is retrieved.
+	cfg.MessageDeadline = 0
+	cfg.MailboxDeadline = 50 * time.Millisecond
+	w = New(cfg, tracker, logger, WithSource(open))
+	start := time.Now()
+	if fetched, errs := w.processMailbox(0, cfg.Yahoo[0]); fetched != 0 || errs != 1 {
+		t.Fatalf("expected nothing forwarded and one error, got %d fetched, %d errors", fetched, errs)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("mailbox deadline took %v", d)
+	}
+	if _, ok := mb.msgs["uid3"]; !ok || tracker.IsFetched("test@yahoo.com", "uid3") {
+		t.Error("expected the message after the mailbox deadline to be left")
+	}
+}
@@ -0,0 +1,122 @@
+package worker
+
+import (
+	"context"
+	"io"
+	"path/filepath"
+	"time"
+
+	"github.com/benj-n/yatogm/internal/maildir"
+	"github.com/benj-n/yatogm/internal/mbox"
+	smtpsender "github.com/benj-n/yatogm/internal/smtp"
+)
+
+// Destination is where forwarded messages are delivered to.
+type Destination interface {
+	// Name identifies the destination in logs, receipts, and state, and
+	// must not change between runs.
+	Name() string
+	// Deliver delivers a message of size bytes, fetched from the source
+	// mailbox and tagged with its yatogm ID, and returns the destination's
+	// reply. It should give up once ctx is done. It may be called
+	// concurrently.
+	Deliver(ctx context.Context, msg io.ReaderAt, size int64, source, id string) (reply string, err error)
+}
+
+// destination is a configured Destination. A message is only recorded as
+// fetched, and deleted from its source, once every required destination
+// has it.
+type destination struct {
+	Destination
+	required bool
+}
+
+// WithDestination adds a destination to deliver messages to besides Gmail.
+// Messages wait for a required destination as they wait for Gmail; a
+// failure to deliver to an optional one is counted as an error, but does
+// not hold the message back.
+func WithDestination(d Destination, required bool) Option {
+	return func(w *Worker) {
+		w.destinations = append(w.destinations, destination{d, required})
+	}
+}
+
+// gmailDestination delivers to the Gmail account over SMTP, within the
+// account's concurrency bound and rate limit, and slows down and pauses
+// while Gmail throttles.
+type gmailDestination struct {
+	w *Worker
+}
+
+func (g gmailDestination) Name() string {
+	return g.w.cfg.Gmail.Email
+}
+
+func (g gmailDestination) Deliver(ctx context.Context, msg io.ReaderAt, size int64, source, id string) (string, error) {
+	w, dest := g.w, g.Name()
+	if w.rate != nil {
+		waited, err := w.rate.Wait(ctx, size)
+		if err != nil {
+			return "", err
+		}
+		if waited > 0 {
+			w.logger.Debug("rate limit reached, delivery waited", "destination", dest, "mailbox", source, "yatogm_id", id, "waited", waited.String())
+		}
+	}
+	if err := w.cooldown.wait(ctx, w.clock); err != nil {
+		return "", err
+	}
+	release := w.limiter.Acquire(dest)
+	reply, err := w.sender.SendContext(ctx, msg, size, source, id)
+	release()
+	if smtpsender.IsThrottled(err) {
+		w.throttledLast.Store(true)
+		limit, delay := w.limiter.Throttled(dest)
+		pause, ok := w.cooldown.throttled(w.clock.Now(), smtpsender.IsQuotaExceeded(err))
+		if !ok {
+			w.logger.Warn("destination throttled, no more deliveries this run",
+				"destination", dest, "mailbox", source, "yatogm_id", id, "error", err)
+		} else {
+			w.logger.Warn("destination throttled, pausing deliveries",
+				"destination", dest, "mailbox", source, "yatogm_id", id, "pause", pause.String(), "concurrency", limit, "delay", delay.String(), "error", err)
+		}
+	} else if err == nil {
+		w.throttledLast.Store(false)
+		w.limiter.Succeeded(dest)
+		w.cooldown.succeeded()
+	}
+	return reply, err
+}
+
+// maildirDestination stores messages as retrieved in a Maildir per source
+// mailbox under dir.
+type maildirDestination struct {
+	dir string
+}
+
+func (m maildirDestination) Name() string {
+	return "maildir"
+}
+
+func (m maildirDestination) Deliver(_ context.Context, msg io.ReaderAt, size int64, source, id string) (string, error) {
+	return maildir.Deliver(filepath.Join(m.dir, source), io.NewSectionReader(msg, 0, size))
+}
+
+// mboxDestination appends messages to an mbox file per source mailbox and
+// month under dir.
+type mboxDestination struct {
+	dir string
+}
+
+func (m mboxDestination) Name() string {
+	return "mbox"
+}
+
+func (m mboxDestination) Deliver(_ context.Context, msg io.ReaderAt, size int64, source, id string) (string, error) {
+	now := time.Now()
+	path := filepath.Join(m.dir, source, now.Format("2006-01")+".mbox")
+	if err := mbox.Append(path, io.NewSectionReader(msg, 0, size), now); err != nil {
+		return "", err
+	}
+	return path, nil
+}
@@ -0,0 +1,138 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/benj-n/yatogm/internal/config"
+)
+
+// Inventory counts the messages on the server in a mailbox by what will
+// become of them.
+type Inventory struct {
+	// Total is the number of messages listed.
+	Total int
+	// Pending messages are still to be forwarded, or were forwarded and
+	// are still to be deleted.
+	Pending int
+	// Kept messages were forwarded and stay on the server, by hold,
+	// delete_after_forward, or retain_days.
+	Kept int
+	// Oversized messages exceed max_message_size and are left alone.
+	Oversized int
+	// Quarantined messages were given up on after repeated rejections.
+	Quarantined int
+	// OutOfRange messages are dated outside since and before and left
+	// alone.
+	OutOfRange int
+}
+
+// DrainSummary reconciles a drained mailbox: what was forwarded while
+// draining, and what is left on the server.
+type DrainSummary struct {
+	Mailbox   string
+	Cycles    int
+	Forwarded int
+	Errors    int
+	// Left is what the server listed after the last cycle.
+	Left Inventory
+	// Drained reports that nothing is left to forward.
+	Drained bool
+}
+
+// Drain runs cycles over mailbox until nothing is left on the server to
+// forward, other than messages filtered out by size or date or
+// quarantined, or until maxCycles cycles have run, ctx is done, or
+// QuarantineAfter cycles in a row forwarded nothing, such as while Gmail
+// rejects a message. Cycles are pause apart.
+func (w *Worker) Drain(ctx context.Context, mailbox string, maxCycles int, pause time.Duration) (DrainSummary, error) {
+	s := DrainSummary{Mailbox: mailbox}
+	var yahoo config.YahooMailbox
+	found := false
+	for _, y := range w.cfg.Yahoo {
+		if y.Email == mailbox {
+			yahoo, found = y, true
+		}
+	}
+	if !found {
+		return s, fmt.Errorf("mailbox %s is not configured", mailbox)
+	}
+	log := w.logger.With("mailbox", mailbox)
+
+	// Messages before a sync checkpoint may still be due for deletion.
+	w.fullSync = true
+	defer func() { w.fullSync = false }()
+
+	idle := 0
+	for s.Cycles < maxCycles {
+		if s.Cycles > 0 {
+			select {
+			case <-ctx.Done():
+				return s, ctx.Err()
+			case <-w.clock.After(pause):
+			}
+		}
+		s.Cycles++
+		fetched, errors, err := w.run([]config.YahooMailbox{yahoo})
+		if err != nil {
+			return s, err
+		}
+		s.Forwarded += fetched
+		s.Errors += errors
+
+		left, err := w.inventory(yahoo)
+		if err != nil {
+			log.Error("listing the mailbox failed", "error", err)
+			s.Errors++
+		} else {
+			s.Left = left
+			log.Info("drain cycle complete", "cycle", s.Cycles, "forwarded", fetched, "errors", errors,
+				"pending", left.Pending, "kept", left.Kept, "oversized", left.Oversized, "quarantined", left.Quarantined, "out_of_range", left.OutOfRange)
+			if left.Pending == 0 {
+				s.Drained = true
+				return s, nil
+			}
+		}
+
+		if fetched > 0 {
+			idle = 0
+		} else if idle++; idle >= max(w.cfg.QuarantineAfter, 1) {
+			log.Warn("nothing forwarded in several cycles, giving up", "cycles", idle)
+			return s, nil
+		}
+	}
+	return s, nil
+}
+
+// inventory lists the mailbox and sorts its messages by what will become
+// of them.
+func (w *Worker) inventory(yahoo config.YahooMailbox) (Inventory, error) {
+	sess, err := w.openSession(yahoo)
+	if err != nil {
+		return Inventory{}, err
+	}
+	defer sess.src.Close()
+
+	now := w.clock.Now()
+	inv := Inventory{Total: len(sess.uids)}
+	for _, uid := range sess.uids {
+		switch {
+		case w.tracker.IsQuarantined(yahoo.Email, uid):
+			inv.Quarantined++
+		case w.tracker.IsFetched(yahoo.Email, uid):
+			if w.retained(yahoo, uid, now) {
+				inv.Kept++
+			} else {
+				inv.Pending++
+			}
+		case w.tracker.IsSkipped(yahoo.Email, uid):
+			inv.Oversized++
+		case w.knownOutOfRange(yahoo, uid):
+			inv.OutOfRange++
+		default:
+			inv.Pending++
+		}
+	}
+	return inv, nil
+}
@@ -0,0 +1,115 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/benj-n/yatogm/internal/config"
+	"github.com/benj-n/yatogm/internal/state"
+)
+
+// fakeMailbox is an in-memory mailbox whose sessions, like POP3 ones,
+// only remove deleted messages when they are closed.
+type fakeMailbox struct {
+	mu   sync.Mutex
+	msgs map[string]string
+	// broken lists UIDs that cannot be retrieved.
+	broken []string
+}
+
+func (m *fakeMailbox) open(config.YahooMailbox) (Source, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := &fakeMailboxSession{m: m}
+	for uid := range m.msgs {
+		s.uids = append(s.uids, uid)
+	}
+	slices.Sort(s.uids)
+	return s, nil
+}
+
+type fakeMailboxSession struct {
+	m       *fakeMailbox
+	uids    []string
+	deleted []string
+}
+
+func (s *fakeMailboxSession) ListUIDs() ([]string, error) { return s.uids, nil }
+
+func (s *fakeMailboxSession) Fetch(uid string, w io.Writer) (int64, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+	if slices.Contains(s.m.broken, uid) {
+		return 0, errors.New("retrieve failed")
+	}
+	n, err := io.WriteString(w, s.m.msgs[uid])
+	return int64(n), err
+}
+
+func (s *fakeMailboxSession) Delete(uid string) error {
+	s.deleted = append(s.deleted, uid)
+	return nil
+}
+
+func (s *fakeMailboxSession) Close() error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+	for _, uid := range s.deleted {
+		delete(s.m.msgs, uid)
+	}
+	return nil
+}
+
+func TestDrain(t *testing.T) {
+	cfg := unreachableConfig(t)
+	cfg.Gmail = config.GmailConfig{}
+	cfg.Maildir.Dir = t.TempDir()
+	cfg.MailboxConcurrency = 1
+	cfg.QuarantineAfter = 2
+	tracker, err := state.NewTracker(cfg.StatePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tracker.MarkQuarantined("test@yahoo.com", "uid3", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	mb := &fakeMailbox{msgs: map[string]string{
+		"uid1": "From: a@example.com\r\nSubject: one\r\n\r\nbody\r\n",
+		"uid2": "From: a@example.com\r\nSubject: two\r\n\r\nbody\r\n",
+		"uid3": "From: a@example.com\r\nSubject: rejected\r\n\r\nbody\r\n",
+	}}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelError}))
+	w := New(cfg, tracker, logger, WithSource(mb.open))
+
+	s, err := w.Drain(context.Background(), "test@yahoo.com", 10, 0)
+	if err != nil {
+		t.Fatalf("Drain: %v", err)
+	}
+	want := Inventory{Total: 1, Quarantined: 1}
+	if !s.Drained || s.Cycles != 1 || s.Forwarded != 2 || s.Errors != 0 || s.Left != want {
+		t.Errorf("unexpected summary %+v", s)
+	}
+
+	// A message that cannot be retrieved is retried until QuarantineAfter
+	// cycles forward nothing.
+	mb.msgs["uid4"] = "From: a@example.com\r\n\r\nbody\r\n"
+	mb.broken = []string{"uid4"}
+	s, err = w.Drain(context.Background(), "test@yahoo.com", 10, 0)
+	if err != nil {
+		t.Fatalf("Drain: %v", err)
+	}
+	if s.Drained || s.Cycles != 2 || s.Errors != 2 || s.Left.Pending != 1 {
+		t.Errorf("unexpected summary %+v", s)
+	}
+
+	if _, err := w.Drain(context.Background(), "other@yahoo.com", 10, 0); err == nil {
+		t.Error("expected an unconfigured mailbox to be refused")
+	}
+}
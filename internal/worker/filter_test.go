@@ -0,0 +1,69 @@
+package worker
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/benj-n/yatogm/internal/config"
+	"github.com/benj-n/yatogm/internal/state"
+)
+
+// contentDestination records the content of the messages delivered to it.
+type contentDestination struct {
+	delivered []string
+}
+
+func (d *contentDestination) Name() string { return "content" }
+
+func (d *contentDestination) Deliver(_ context.Context, msg io.ReaderAt, size int64, source, id string) (string, error) {
+	b, err := io.ReadAll(io.NewSectionReader(msg, 0, size))
+	d.delivered = append(d.delivered, string(b))
+	return "stored", err
+}
+
+func TestFilters(t *testing.T) {
+	cfg := unreachableConfig(t)
+	cfg.Gmail = config.GmailConfig{}
+	cfg.Filters = []config.FilterConfig{{
+		Name:    "invoices",
+		Command: []string{"sh", "-c", `if grep -q invoice; then echo archive; else echo deliver; fi`},
+	}, {
+		Name:    "tag",
+		Command: []string{"sh", "-c", `echo deliver; echo "X-Tag: $YATOGM_MAILBOX"; cat`},
+	}}
+	tracker, err := state.NewTracker(cfg.StatePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mb := &fakeMailbox{msgs: map[string]string{
+		"uid1": "From: a@example.com\r\nSubject: invoice\r\n\r\nbody\r\n",
+	}}
+	dest := &contentDestination{}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelError}))
+
+	// Without an archive, a message a filter archives stays on the server.
+	w := New(cfg, tracker, logger, WithSource(mb.open), WithDestination(dest, true))
+	if fetched, errs, err := w.run(cfg.Yahoo); err != nil || fetched != 0 || errs != 1 {
+		t.Fatalf("expected the filter to fail, got %d fetched, %d errors (%v)", fetched, errs, err)
+	}
+	if _, ok := mb.msgs["uid1"]; !ok || len(dest.delivered) != 0 {
+		t.Fatalf("expected the message left on the server, undelivered")
+	}
+
+	cfg.ArchiveDir = t.TempDir()
+	mb.msgs["uid2"] = "From: a@example.com\r\nSubject: hi\r\n\r\nbody\r\n"
+	w = New(cfg, tracker, logger, WithSource(mb.open), WithDestination(dest, true))
+	if fetched, errs, err := w.run(cfg.Yahoo); err != nil || fetched != 2 || errs != 0 {
+		t.Fatalf("expected two messages handled, got %d fetched, %d errors (%v)", fetched, errs, err)
+	}
+	if len(dest.delivered) != 1 || !strings.HasPrefix(dest.delivered[0], "X-Tag: test@yahoo.com\nFrom: a@example.com\r\nSubject: hi\r\n") {
+		t.Errorf("expected only the rewritten message delivered, got %q", dest.delivered)
+	}
+	if len(mb.msgs) != 0 {
+		t.Errorf("expected both messages deleted, got %v", mb.msgs)
+	}
+}
@@ -0,0 +1,101 @@
+package worker
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// healthFailures is the number of health checks in a row a credential must
+// fail before it is reported, so that a passing network problem does not
+// raise an alarm.
+const healthFailures = 2
+
+// Health remembers the outcome of earlier health checks, across workers, so
+// that a credential is reported once when it starts failing and once when
+// it recovers, rather than at every check.
+type Health struct {
+	mu       sync.Mutex
+	failures map[string]int // service and account -> failed checks in a row
+}
+
+// NewHealth returns a Health with no failures recorded.
+func NewHealth() *Health {
+	return &Health{failures: make(map[string]int)}
+}
+
+// update records the results of a health check and returns those whose
+// credential now counts as failing, and those that work again after having
+// been reported.
+func (h *Health) update(results []CheckResult) (failing, recovered []CheckResult) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, r := range results {
+		key := r.Service + " " + r.Account
+		if r.Err == nil {
+			if h.failures[key] >= healthFailures {
+				recovered = append(recovered, r)
+			}
+			delete(h.failures, key)
+			continue
+		}
+		h.failures[key]++
+		if h.failures[key] == healthFailures {
+			failing = append(failing, r)
+		}
+	}
+	return failing, recovered
+}
+
+// CheckHealth checks every server as Check does and reports credentials
+// that have failed healthFailures checks in a row, and those that work
+// again afterwards. Reports are logged and, when Gmail is configured and
+// passed its own check, sent to Gmail as notices.
+func (w *Worker) CheckHealth(h *Health) []CheckResult {
+	results := w.Check()
+	failing, recovered := h.update(results)
+	defer w.closeSMTP()
+
+	gmailOK := false
+	for _, r := range results {
+		if r.Service == "gmail" && r.Err == nil {
+			gmailOK = true
+		}
+	}
+	for _, r := range failing {
+		w.logger.Error("credential failing health checks",
+			"service", r.Service, "account", r.Account, "checks", healthFailures, "error", r.Err)
+		if gmailOK {
+			if err := w.notify(healthNotice(r, true)); err != nil {
+				w.logger.Error("health notification failed", "error", err)
+			}
+		}
+	}
+	for _, r := range recovered {
+		w.logger.Info("credential passing health checks again", "service", r.Service, "account", r.Account)
+		if gmailOK {
+			if err := w.notify(healthNotice(r, false)); err != nil {
+				w.logger.Error("health notification failed", "error", err)
+			}
+		}
+	}
+	return results
+}
+
+// healthNotice returns the subject and body of the notice about a
+// credential that started failing, or that recovered.
+func healthNotice(r CheckResult, failing bool) (subject, body string) {
+	var b strings.Builder
+	if !failing {
+		fmt.Fprintf(&b, "The %s account %s passes health checks again.\n", r.Service, r.Account)
+		return fmt.Sprintf("[yatogm] %s login working again: %s", r.Service, r.Account), b.String()
+	}
+	fmt.Fprintf(&b, "The %s account %s failed its last %d health checks.\n\n", r.Service, r.Account, healthFailures)
+	fmt.Fprintf(&b, "Server: %s\n", r.Addr)
+	fmt.Fprintf(&b, "Error:  %v\n\n", r.Err)
+	if r.Service == "yahoo" {
+		b.WriteString("If the app password was revoked, generate a new one in the Yahoo account security settings and update the configuration. ")
+	}
+	b.WriteString("Mail from this account is not forwarded until it logs in again.\n")
+	return fmt.Sprintf("[yatogm] %s login failing: %s", r.Service, r.Account), b.String()
+}
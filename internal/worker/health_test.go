@@ -0,0 +1,69 @@
+package worker
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestHealthUpdate(t *testing.T) {
+	h := NewHealth()
+	ok := CheckResult{Service: "yahoo", Account: "user@yahoo.com"}
+	bad := ok
+	bad.Err = errors.New("pop3 PASS: -ERR [AUTH] Authentication failed")
+
+	for i, step := range []struct {
+		result             CheckResult
+		failing, recovered int
+	}{
+		{bad, 0, 0}, // a single failure is not reported
+		{ok, 0, 0},
+		{bad, 0, 0},
+		{bad, 1, 0}, // the second failure in a row is
+		{bad, 0, 0}, // and only once
+		{ok, 0, 1},
+		{ok, 0, 0},
+	} {
+		failing, recovered := h.update([]CheckResult{step.result})
+		if len(failing) != step.failing || len(recovered) != step.recovered {
+			t.Errorf("check %d: got %d failing, %d recovered, want %d, %d",
+				i+1, len(failing), len(recovered), step.failing, step.recovered)
+		}
+	}
+}
+
+func TestCheckHealth(t *testing.T) {
+	cfg := unreachableConfig(t)
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError}))
+	w := New(cfg, nil, logger)
+	h := NewHealth()
+
+	// Gmail is unreachable too, so the failures are only logged.
+	for range healthFailures {
+		results := w.CheckHealth(h)
+		if len(results) != 2 || results[0].Err == nil || results[1].Err == nil {
+			t.Fatalf("expected both checks to fail, got %+v", results)
+		}
+	}
+	if h.failures["yahoo test@yahoo.com"] != healthFailures || h.failures["gmail test@gmail.com"] != healthFailures {
+		t.Errorf("unexpected failure counts %v", h.failures)
+	}
+}
+
+func TestHealthNotice(t *testing.T) {
+	r := CheckResult{Service: "yahoo", Account: "user@yahoo.com", Addr: "pop.mail.yahoo.com:995", Err: errors.New("auth failed")}
+	subject, body := healthNotice(r, true)
+	if subject != "[yatogm] yahoo login failing: user@yahoo.com" {
+		t.Errorf("subject = %q", subject)
+	}
+	for _, want := range []string{"pop.mail.yahoo.com:995", "auth failed", "app password"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("body does not mention %q:\n%s", want, body)
+		}
+	}
+	if subject, _ := healthNotice(r, false); !strings.Contains(subject, "working again") {
+		t.Errorf("recovery subject = %q", subject)
+	}
+}
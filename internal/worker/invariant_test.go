@@ -0,0 +1,80 @@
+package worker
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/benj-n/yatogm/internal/config"
+	"github.com/benj-n/yatogm/internal/invariant"
+	"github.com/benj-n/yatogm/internal/state"
+)
+
+func TestInvariantsCatchRedeliveryAfterLostState(t *testing.T) {
+	cfg := unreachableConfig(t)
+	cfg.Gmail = config.GmailConfig{}
+	cfg.Maildir.Dir = t.TempDir()
+	cfg.InvariantJournal = filepath.Join(t.TempDir(), "invariants.jsonl")
+	keep := false
+	cfg.Yahoo[0].DeleteAfterForward = &keep
+	mb := &fakeMailbox{msgs: map[string]string{
+		"uid1": "From: a@example.com\r\nSubject: one\r\n\r\nbody\r\n",
+	}}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelError + 4}))
+
+	tracker, err := state.NewTracker(cfg.StatePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := New(cfg, tracker, logger, WithSource(mb.open)).Run(); err != nil {
+		t.Fatalf("first run: %v", err)
+	}
+
+	// The state is lost, as if the host crashed before it reached the
+	// disk, so the next run forwards the message again.
+	tracker, err = state.NewTracker(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = New(cfg, tracker, logger, WithSource(mb.open)).Run()
+	v := invariant.Violations(err)
+	if len(v) != 1 || v[0].Kind != invariant.Duplicate || v[0].UID != "uid1" || v[0].Destination != "maildir" {
+		t.Fatalf("expected uid1 reported as delivered twice, got %v", err)
+	}
+}
+
+func TestInvariantsKeepUntrackedMessages(t *testing.T) {
+	cfg := unreachableConfig(t)
+	tracker, err := state.NewTracker(cfg.StatePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tracker.MarkFetched("test@yahoo.com", "uid1"); err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelError}))
+	w := New(cfg, tracker, logger)
+	w.invariants, err = invariant.Open(filepath.Join(t.TempDir(), "invariants.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.invariants.Close()
+
+	src := &fakeSource{uids: []string{"uid1", "uid2"}}
+	sess := &session{src: src, uids: src.uids}
+	if err := w.delete(sess, cfg.Yahoo[0], "uid1"); err != nil {
+		t.Errorf("deleting a fetched message: %v", err)
+	}
+	var v *invariant.Violation
+	if err := w.delete(sess, cfg.Yahoo[0], "uid2"); !errors.As(err, &v) || v.Kind != invariant.UntrackedDelete {
+		t.Errorf("expected an untracked delete, got %v", err)
+	}
+	if len(src.deleted) != 1 || src.deleted[0] != "uid1" {
+		t.Errorf("expected only uid1 deleted, got %v", src.deleted)
+	}
+	if err := w.violations(); len(invariant.Violations(err)) != 1 {
+		t.Errorf("expected the violation reported by the run, got %v", err)
+	}
+}
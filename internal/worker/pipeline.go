@@ -0,0 +1,288 @@
+package worker
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/mail"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/benj-n/yatogm/internal/pop3"
+)
+
+// session is a source session shared by a fetcher and the senders that
+// delete its messages. Sessions may list different messages, so each keeps
+// its own.
+type session struct {
+	mu   sync.Mutex
+	src  Source
+	uids []string // oldest first
+	has  map[string]bool
+	// withhold leaves messages on the server: delete only records them.
+	withhold bool
+	// deleted lists the UIDs marked for deletion, which Close removes, or
+	// which would have been with deletions withheld.
+	deleted []string
+}
+
+// retrieve streams a message into a new spool, which the caller must close,
+// giving up once ctx is done if the source can.
+func (s *session) retrieve(ctx context.Context, uid string) (*spool, error) {
+	sp := &spool{}
+	s.mu.Lock()
+	var err error
+	if cf, ok := s.src.(ContextFetcher); ok {
+		_, err = cf.FetchContext(ctx, uid, sp)
+	} else {
+		_, err = s.src.Fetch(uid, sp)
+	}
+	s.mu.Unlock()
+	if err != nil {
+		sp.Close()
+		return nil, err
+	}
+	return sp, nil
+}
+
+// sessionLost reports whether err, from retrieving a message, leaves its
+// session unusable: a timeout, after which the rest of the message could
+// pass for the next one, or a connection the client closed.
+func sessionLost(err error) bool {
+	return timedOut(err) || errors.Is(err, pop3.ErrClosed)
+}
+
+// prefetch announces the messages retrieve is called for next, in order,
+// if the source can start retrieving them ahead.
+func (s *session) prefetch(uids []string) error {
+	p, ok := s.src.(Prefetcher)
+	if !ok {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return p.Prefetch(uids)
+}
+
+// sizes returns the size of each message on the session, by UID.
+func (s *session) sizes() (map[string]int64, error) {
+	sizer, ok := s.src.(Sizer)
+	if !ok {
+		return nil, errors.New("source cannot report message sizes")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return sizer.Sizes()
+}
+
+// retrieveHeader retrieves the header of a message and returns the number
+// of bytes downloaded. With a source that cannot return the header alone,
+// the whole message is downloaded, and the body discarded as it arrives.
+func (s *session) retrieveHeader(uid string) (mail.Header, int64, error) {
+	if t, ok := s.src.(Topper); ok {
+		s.mu.Lock()
+		b, err := t.Top(uid, 0)
+		s.mu.Unlock()
+		if err == nil {
+			// A header without a body may not end with a blank line.
+			msg, err := mail.ReadMessage(bytes.NewReader(append(b, "\r\n"...)))
+			if err != nil {
+				return nil, int64(len(b)), fmt.Errorf("parsing header: %w", err)
+			}
+			return msg.Header, int64(len(b)), nil
+		}
+		if !errors.Is(err, pop3.ErrNotSupported) {
+			return nil, int64(len(b)), err
+		}
+	}
+
+	var hc headerCapture
+	s.mu.Lock()
+	n, err := s.src.Fetch(uid, &hc)
+	s.mu.Unlock()
+	if err != nil {
+		return nil, n, err
+	}
+	if !hc.done {
+		// A message without a body.
+		hc.buf.WriteString("\r\n")
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(hc.buf.Bytes()))
+	if err != nil {
+		return nil, n, fmt.Errorf("parsing header: %w", err)
+	}
+	return msg.Header, n, nil
+}
+
+func (s *session) delete(uid string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.withhold {
+		if err := s.src.Delete(uid); err != nil {
+			return err
+		}
+	}
+	s.deleted = append(s.deleted, uid)
+	return nil
+}
+
+// close ends the session, first logging exactly which messages its end
+// removes from the server, or, with deletions withheld, leaves there.
+func (s *session) close(log *slog.Logger) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case len(s.deleted) == 0:
+	case s.withhold:
+		log.Warn("deletions withheld, messages left on the server; run with -confirm-deletes to remove them",
+			"count", len(s.deleted), "uids", s.deleted)
+	default:
+		log.Info("committing deletions", "count", len(s.deleted), "uids", s.deleted)
+	}
+	return s.src.Close()
+}
+
+// job is a retrieved message waiting to be forwarded.
+type job struct {
+	// ctx bounds retrieving and forwarding the message; cancel releases it.
+	ctx    context.Context
+	cancel context.CancelFunc
+	sess   *session
+	uid    string
+	// id is the message's yatogm ID, a ULID that tags its headers and logs.
+	id        string
+	msg       *spool
+	fetchedAt time.Time
+}
+
+// context returns the context bounding the job, which may have none.
+func (j job) context() context.Context {
+	if j.ctx == nil {
+		return context.Background()
+	}
+	return j.ctx
+}
+
+// done releases the job's context.
+func (j job) done() {
+	if j.cancel != nil {
+		j.cancel()
+	}
+}
+
+// spoolMemLimit is the size above which a retrieved message is moved from
+// memory to a temporary file.
+const spoolMemLimit = 1 << 20
+
+// spool holds one retrieved message: in memory while small, in a temporary
+// file once it grows past spoolMemLimit, so that large attachments queued
+// in the pipeline do not all sit in memory. Reads may start anywhere and
+// be repeated, as a retried delivery needs.
+type spool struct {
+	buf  bytes.Buffer
+	file *os.File
+	size int64
+}
+
+func (s *spool) Write(p []byte) (int, error) {
+	if s.file == nil && int64(s.buf.Len()+len(p)) > spoolMemLimit {
+		f, err := os.CreateTemp("", "yatogm-*.eml")
+		if err != nil {
+			return 0, fmt.Errorf("creating spool file: %w", err)
+		}
+		s.file = f
+		if _, err := f.Write(s.buf.Bytes()); err != nil {
+			return 0, fmt.Errorf("writing spool file: %w", err)
+		}
+		s.buf = bytes.Buffer{}
+	}
+	if s.file == nil {
+		n, _ := s.buf.Write(p)
+		s.size += int64(n)
+		return n, nil
+	}
+	n, err := s.file.Write(p)
+	s.size += int64(n)
+	return n, err
+}
+
+func (s *spool) ReadAt(p []byte, off int64) (int, error) {
+	if s.file != nil {
+		return s.file.ReadAt(p, off)
+	}
+	return bytes.NewReader(s.buf.Bytes()).ReadAt(p, off)
+}
+
+// Size returns the number of bytes written to the spool.
+func (s *spool) Size() int64 {
+	return s.size
+}
+
+// Close releases the spool, removing its temporary file if it has one.
+func (s *spool) Close() error {
+	s.buf = bytes.Buffer{}
+	if s.file == nil {
+		return nil
+	}
+	name := s.file.Name()
+	err := s.file.Close()
+	if rmErr := os.Remove(name); err == nil {
+		err = rmErr
+	}
+	s.file = nil
+	return err
+}
+
+// tally counts per-mailbox outcomes across pipeline goroutines.
+type tally struct {
+	mu      sync.Mutex
+	fetched int
+	errors  int
+}
+
+func (t *tally) addFetched() {
+	t.mu.Lock()
+	t.fetched++
+	t.mu.Unlock()
+}
+
+func (t *tally) addError() {
+	t.mu.Lock()
+	t.errors++
+	t.mu.Unlock()
+}
+
+func (t *tally) counts() (fetched, errors int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.fetched, t.errors
+}
+
+// maxHeaderCapture bounds the header kept by headerCapture.
+const maxHeaderCapture = 64 << 10
+
+// headerCapture is a writer that keeps a message's header, up to the blank
+// line ending it or maxHeaderCapture bytes, and discards the rest.
+type headerCapture struct {
+	buf  bytes.Buffer
+	done bool
+}
+
+func (h *headerCapture) Write(p []byte) (int, error) {
+	if h.done {
+		return len(p), nil
+	}
+	h.buf.Write(p[:min(len(p), maxHeaderCapture-h.buf.Len())])
+	if i := bytes.Index(h.buf.Bytes(), []byte("\r\n\r\n")); i >= 0 {
+		h.buf.Truncate(i + 4)
+		h.done = true
+	} else if h.buf.Len() >= maxHeaderCapture {
+		// Terminate a truncated header so that it still parses.
+		h.buf.WriteString("\r\n\r\n")
+		h.done = true
+	}
+	return len(p), nil
+}
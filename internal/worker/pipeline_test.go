@@ -0,0 +1,86 @@
+package worker
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestSpool(t *testing.T) {
+	small := bytes.Repeat([]byte("a"), 100)
+	large := bytes.Repeat([]byte("0123456789abcdef"), spoolMemLimit/16+1)
+
+	for _, tc := range []struct {
+		name   string
+		data   []byte
+		inFile bool
+	}{
+		{"small", small, false},
+		{"large", large, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sp := &spool{}
+			// Write in chunks, as RetrieveTo does.
+			for rest := tc.data; len(rest) > 0; {
+				n := min(len(rest), 4096)
+				if _, err := sp.Write(rest[:n]); err != nil {
+					t.Fatalf("Write failed: %v", err)
+				}
+				rest = rest[n:]
+			}
+			if sp.Size() != int64(len(tc.data)) {
+				t.Errorf("Size() = %d, want %d", sp.Size(), len(tc.data))
+			}
+			if (sp.file != nil) != tc.inFile {
+				t.Errorf("spooled to file = %v, want %v", sp.file != nil, tc.inFile)
+			}
+
+			// Reading twice yields the same bytes, as a retry needs.
+			for i := 0; i < 2; i++ {
+				got, err := io.ReadAll(io.NewSectionReader(sp, 0, sp.Size()))
+				if err != nil {
+					t.Fatalf("read failed: %v", err)
+				}
+				if !bytes.Equal(got, tc.data) {
+					t.Fatalf("read %d bytes back, want %d identical bytes", len(got), len(tc.data))
+				}
+			}
+
+			var name string
+			if sp.file != nil {
+				name = sp.file.Name()
+			}
+			if err := sp.Close(); err != nil {
+				t.Fatalf("Close failed: %v", err)
+			}
+			if name != "" {
+				if _, err := os.Stat(name); !os.IsNotExist(err) {
+					t.Errorf("spool file %s not removed", name)
+				}
+			}
+		})
+	}
+}
+
+func TestHeaderCapture(t *testing.T) {
+	header := "From: a@example.com\r\nSubject: big\r\n\r\n"
+	var hc headerCapture
+	// Lines arrive separately from their CRLF, as RetrieveTo writes them.
+	for _, p := range []string{"From: a@example.com", "\r\n", "Subject: big", "\r\n", "", "\r\n", "body", "\r\n"} {
+		if n, err := hc.Write([]byte(p)); n != len(p) || err != nil {
+			t.Fatalf("Write(%q) = %d, %v", p, n, err)
+		}
+	}
+	if got := hc.buf.String(); got != header {
+		t.Errorf("captured %q, want %q", got, header)
+	}
+
+	// An endless header is cut off at the limit.
+	var long headerCapture
+	line := bytes.Repeat([]byte("X-Padding: 0123456789\r\n"), maxHeaderCapture/16)
+	long.Write(line)
+	if !long.done || long.buf.Len() > maxHeaderCapture+4 {
+		t.Errorf("captured %d bytes of an oversized header", long.buf.Len())
+	}
+}
@@ -0,0 +1,249 @@
+package worker
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/benj-n/yatogm/internal/config"
+)
+
+// Action is what a run does with a message on the server.
+type Action string
+
+const (
+	// ActionForward delivers the message and deletes it from the server.
+	ActionForward Action = "forward"
+	// ActionForwardKeep delivers the message and keeps it on the server,
+	// by hold, delete_after_forward, or retain_days.
+	ActionForwardKeep Action = "forward-keep"
+	// ActionDelete deletes a message forwarded by an earlier run.
+	ActionDelete Action = "delete"
+	// ActionKeep leaves a message forwarded by an earlier run on the
+	// server, by hold, delete_after_forward, or retain_days.
+	ActionKeep Action = "keep"
+	// ActionSkip leaves a message larger than max_message_size on the
+	// server.
+	ActionSkip Action = "skip"
+	// ActionQuarantined leaves a quarantined message on the server.
+	ActionQuarantined Action = "quarantined"
+	// ActionOutOfRange leaves a message dated outside since and before on
+	// the server.
+	ActionOutOfRange Action = "out-of-range"
+)
+
+// Actions lists the actions in the order plans are shown.
+var Actions = []Action{ActionForward, ActionForwardKeep, ActionDelete, ActionKeep, ActionSkip, ActionQuarantined, ActionOutOfRange}
+
+// Plan is what a run would do with each message on the server, decided
+// without retrieving any, for Apply to carry out once reviewed.
+type Plan struct {
+	// User is the user of a multi-user service the plan is for, or "".
+	User      string        `json:"user,omitempty"`
+	CreatedAt time.Time     `json:"created_at"`
+	Mailboxes []MailboxPlan `json:"mailboxes"`
+}
+
+// MailboxPlan is the plan for one mailbox.
+type MailboxPlan struct {
+	Mailbox  string           `json:"mailbox"`
+	Messages []PlannedMessage `json:"messages"`
+}
+
+// PlannedMessage is the action planned for one message.
+type PlannedMessage struct {
+	UID string `json:"uid"`
+	// Size is the size of the message in bytes, or 0 if the source cannot
+	// report sizes.
+	Size   int64  `json:"size,omitempty"`
+	Action Action `json:"action"`
+}
+
+// Count returns the number of messages planned for action a.
+func (p MailboxPlan) Count(a Action) int {
+	n := 0
+	for _, m := range p.Messages {
+		if m.Action == a {
+			n++
+		}
+	}
+	return n
+}
+
+// WritePlan saves p to path as JSON, readable only by its owner.
+func WritePlan(path string, p Plan) error {
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o600)
+}
+
+// ReadPlan loads a plan saved by WritePlan.
+func ReadPlan(path string) (Plan, error) {
+	var p Plan
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return p, err
+	}
+	if err := json.Unmarshal(data, &p); err != nil {
+		return p, fmt.Errorf("parsing plan %s: %w", path, err)
+	}
+	for _, mp := range p.Mailboxes {
+		for _, m := range mp.Messages {
+			if !slices.Contains(Actions, m.Action) {
+				return p, fmt.Errorf("plan %s: %s: message %s has unknown action %q", path, mp.Mailbox, m.UID, m.Action)
+			}
+		}
+	}
+	return p, nil
+}
+
+// Plan lists the given mailboxes, or every configured one if none are
+// given, and decides what a run would do with each message. It neither
+// retrieves nor deletes any message and does not change the state. Rules,
+// filters, and sender reputation, which need the message itself, still
+// decide at apply time where a forwarded message is delivered.
+func (w *Worker) Plan(mailboxes []string) (Plan, error) {
+	for _, m := range mailboxes {
+		if !slices.ContainsFunc(w.cfg.Yahoo, func(y config.YahooMailbox) bool { return y.Email == m }) {
+			return Plan{}, fmt.Errorf("mailbox %s is not configured", m)
+		}
+	}
+	p := Plan{CreatedAt: w.clock.Now().UTC()}
+	for _, yahoo := range w.cfg.Yahoo {
+		if len(mailboxes) > 0 && !slices.Contains(mailboxes, yahoo.Email) {
+			continue
+		}
+		mp, err := w.planMailbox(yahoo, w.clock.Now())
+		if err != nil {
+			return Plan{}, fmt.Errorf("%s: %w", yahoo.Email, err)
+		}
+		p.Mailboxes = append(p.Mailboxes, mp)
+	}
+	return p, nil
+}
+
+// planMailbox lists a mailbox and decides what a run would do with each of
+// its messages.
+func (w *Worker) planMailbox(yahoo config.YahooMailbox, now time.Time) (MailboxPlan, error) {
+	if err := w.tracker.Load(yahoo.Email); err != nil {
+		return MailboxPlan{}, fmt.Errorf("loading state: %w", err)
+	}
+	sess, err := w.openSession(yahoo)
+	if err != nil {
+		return MailboxPlan{}, err
+	}
+	defer sess.src.Close()
+
+	sizes, err := sess.sizes()
+	if err != nil && w.cfg.MaxMessageSize > 0 {
+		return MailboxPlan{}, fmt.Errorf("listing message sizes: %w", err)
+	}
+	mp := MailboxPlan{Mailbox: yahoo.Email, Messages: []PlannedMessage{}}
+	for _, uid := range sess.uids {
+		action := w.decide(yahoo, uid, sizes, now)
+		if action == ActionForward || action == ActionForwardKeep {
+			out, _, err := w.outOfRange(sess, yahoo, uid, nil)
+			if err != nil {
+				return MailboxPlan{}, fmt.Errorf("reading the header of message %s: %w", uid, err)
+			}
+			if out {
+				action = ActionOutOfRange
+			}
+		}
+		mp.Messages = append(mp.Messages, PlannedMessage{UID: uid, Size: sizes[uid], Action: action})
+	}
+	return mp, nil
+}
+
+// ApplySummary is the outcome of applying a plan.
+type ApplySummary struct {
+	Forwarded int
+	Errors    int
+	// Changed counts the planned messages left alone because a run would
+	// now do something else with them, or because they are no longer on
+	// the server.
+	Changed int
+}
+
+// Apply runs a cycle over the mailboxes of p that only does what p planned:
+// messages that are not in the plan, or that a run would now do something
+// else with, are left as they are for a later run.
+func (w *Worker) Apply(p Plan) (ApplySummary, error) {
+	plan := make(map[string]map[string]Action, len(p.Mailboxes))
+	var mailboxes []config.YahooMailbox
+	for _, mp := range p.Mailboxes {
+		i := slices.IndexFunc(w.cfg.Yahoo, func(y config.YahooMailbox) bool { return y.Email == mp.Mailbox })
+		if i < 0 {
+			return ApplySummary{}, fmt.Errorf("mailbox %s of the plan is not configured", mp.Mailbox)
+		}
+		mailboxes = append(mailboxes, w.cfg.Yahoo[i])
+		plan[mp.Mailbox] = make(map[string]Action, len(mp.Messages))
+		for _, m := range mp.Messages {
+			plan[mp.Mailbox][m.UID] = m.Action
+		}
+	}
+
+	w.plan, w.fullSync = plan, true
+	w.planChanged.Store(0)
+	defer func() { w.plan, w.fullSync = nil, false }()
+	fetched, errors, err := w.run(mailboxes)
+	return ApplySummary{Forwarded: fetched, Errors: errors, Changed: int(w.planChanged.Load())}, err
+}
+
+// decide returns what a run does with the message uid on yahoo, whose size
+// sizes lists if max_message_size is set.
+func (w *Worker) decide(yahoo config.YahooMailbox, uid string, sizes map[string]int64, now time.Time) Action {
+	switch {
+	case w.tracker.IsQuarantined(yahoo.Email, uid):
+		return ActionQuarantined
+	case w.tracker.IsFetched(yahoo.Email, uid):
+		if w.retained(yahoo, uid, now) {
+			return ActionKeep
+		}
+		return ActionDelete
+	}
+	if size, ok := sizes[uid]; ok && w.cfg.MaxMessageSize > 0 && size > w.cfg.MaxMessageSize {
+		return ActionSkip
+	}
+	if w.retained(yahoo, uid, now) {
+		return ActionForwardKeep
+	}
+	return ActionForward
+}
+
+// planned reports whether the plan being applied has action for the
+// message uid, logging why not.
+func (w *Worker) planned(log *slog.Logger, yahoo config.YahooMailbox, uid string, action Action) bool {
+	want, ok := w.plan[yahoo.Email][uid]
+	switch {
+	case !ok:
+		log.Debug("message not in the plan, leaving it", "uid", uid, "action", action)
+	case want != action:
+		log.Warn("message changed since the plan, leaving it", "uid", uid, "planned", want, "action", action)
+		w.planChanged.Add(1)
+	default:
+		return true
+	}
+	return false
+}
+
+// checkPlanGone logs and counts the messages the plan being applied has
+// for yahoo that the session no longer lists.
+func (w *Worker) checkPlanGone(log *slog.Logger, yahoo config.YahooMailbox, sess *session) {
+	var gone []string
+	for uid := range w.plan[yahoo.Email] {
+		if !sess.has[uid] {
+			gone = append(gone, uid)
+		}
+	}
+	if len(gone) > 0 {
+		slices.Sort(gone)
+		log.Warn("planned messages no longer on the server", "count", len(gone), "uids", gone)
+		w.planChanged.Add(int64(len(gone)))
+	}
+}
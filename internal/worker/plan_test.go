@@ -0,0 +1,107 @@
+package worker
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/benj-n/yatogm/internal/config"
+	"github.com/benj-n/yatogm/internal/state"
+)
+
+func TestPlanApply(t *testing.T) {
+	cfg := unreachableConfig(t)
+	cfg.Gmail = config.GmailConfig{}
+	tracker, err := state.NewTracker(cfg.StatePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tracker.MarkFetched("test@yahoo.com", "uid1"); err != nil {
+		t.Fatal(err)
+	}
+	mb := &fakeMailbox{msgs: map[string]string{
+		"uid1": "From: a@example.com\r\nSubject: forwarded\r\n\r\nbody\r\n",
+		"uid2": "From: a@example.com\r\nSubject: two\r\n\r\nbody\r\n",
+		"uid3": "From: a@example.com\r\nSubject: three\r\n\r\nbody\r\n",
+		"uid5": "From: a@example.com\r\nSubject: five\r\n\r\nbody\r\n",
+	}}
+	dest := &contentDestination{}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelError}))
+	w := New(cfg, tracker, logger, WithSource(mb.open), WithDestination(dest, true))
+
+	p, err := w.Plan(nil)
+	if err != nil {
+		t.Fatalf("Plan: %v", err)
+	}
+	if len(p.Mailboxes) != 1 || p.Mailboxes[0].Count(ActionDelete) != 1 || p.Mailboxes[0].Count(ActionForward) != 3 {
+		t.Fatalf("unexpected plan %+v", p)
+	}
+	if len(dest.delivered) != 0 || len(mb.msgs) != 4 {
+		t.Fatal("expected planning to change nothing")
+	}
+
+	path := filepath.Join(t.TempDir(), "plan.json")
+	if err := WritePlan(path, p); err != nil {
+		t.Fatal(err)
+	}
+	if p, err = ReadPlan(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// Since the plan, uid2 was forwarded, uid3 removed, and uid4 arrived.
+	if err := tracker.MarkFetched("test@yahoo.com", "uid2"); err != nil {
+		t.Fatal(err)
+	}
+	delete(mb.msgs, "uid3")
+	mb.msgs["uid4"] = "From: a@example.com\r\nSubject: four\r\n\r\nbody\r\n"
+
+	s, err := w.Apply(p)
+	if err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	if s.Forwarded != 1 || s.Errors != 0 || s.Changed != 2 {
+		t.Errorf("unexpected summary %+v", s)
+	}
+	if len(dest.delivered) != 1 || !strings.Contains(dest.delivered[0], "five") {
+		t.Errorf("expected only uid5 delivered, got %q", dest.delivered)
+	}
+	for _, uid := range []string{"uid1", "uid5"} {
+		if _, ok := mb.msgs[uid]; ok {
+			t.Errorf("expected %s deleted", uid)
+		}
+	}
+	for _, uid := range []string{"uid2", "uid4"} {
+		if _, ok := mb.msgs[uid]; !ok {
+			t.Errorf("expected %s left on the server", uid)
+		}
+	}
+
+	// Without the plan, a run handles everything again.
+	if _, _, err := w.run(cfg.Yahoo); err != nil {
+		t.Fatal(err)
+	}
+	if len(mb.msgs) != 0 {
+		t.Errorf("expected the mailbox emptied, got %v", mb.msgs)
+	}
+
+	if _, err := w.Plan([]string{"other@yahoo.com"}); err == nil {
+		t.Error("expected an unconfigured mailbox to be refused")
+	}
+	p.Mailboxes[0].Mailbox = "other@yahoo.com"
+	if _, err := w.Apply(p); err == nil {
+		t.Error("expected a plan for an unconfigured mailbox to be refused")
+	}
+}
+
+func TestReadPlanUnknownAction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "plan.json")
+	data := `{"mailboxes": [{"mailbox": "a@yahoo.com", "messages": [{"uid": "1", "action": "purge"}]}]}`
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadPlan(path); err == nil || !strings.Contains(err.Error(), `unknown action "purge"`) {
+		t.Errorf("expected an unknown action error, got %v", err)
+	}
+}
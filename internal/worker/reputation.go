@@ -0,0 +1,59 @@
+package worker
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/mail"
+	"strings"
+
+	"github.com/benj-n/yatogm/internal/config"
+	"github.com/benj-n/yatogm/internal/spam"
+)
+
+// sender returns the lowercased From address of a raw message, or "" if
+// the message has none or cannot be parsed, and whether its source
+// classified it as spam. Only the header is read.
+func sender(raw io.ReaderAt, size int64) (addr string, isSpam bool) {
+	msg, err := mail.ReadMessage(io.NewSectionReader(raw, 0, size))
+	if err != nil {
+		return "", false
+	}
+	verdict, _ := spam.Parse(msg.Header)
+	from, err := mail.ParseAddress(msg.Header.Get("From"))
+	if err != nil {
+		return "", verdict.Spam
+	}
+	return strings.ToLower(from.Address), verdict.Spam
+}
+
+// archivesOnly returns why messages from addr to the mailbox are archived
+// without being delivered, as the sender's history crosses a
+// sender_reputation threshold, or "" if they are delivered.
+func (w *Worker) archivesOnly(yahoo config.YahooMailbox, addr string) string {
+	r := w.cfg.SenderReputation
+	if !r.Enabled || addr == "" {
+		return ""
+	}
+	st := w.tracker.Sender(yahoo.Email, addr)
+	switch {
+	case r.MaxQuarantined > 0 && st.Quarantined >= r.MaxQuarantined:
+		return fmt.Sprintf("%d messages quarantined", st.Quarantined)
+	case st.Messages >= r.MinMessages && float64(st.Spam) >= r.SpamRatio*float64(st.Messages):
+		return fmt.Sprintf("%d of %d messages spam", st.Spam, st.Messages)
+	}
+	return ""
+}
+
+// recordSender adds a handled message to the history of its sender, if
+// sender reputation is enabled. A failure is counted but, as the message
+// was handled, does not stop it from being recorded as fetched.
+func (w *Worker) recordSender(log *slog.Logger, yahoo config.YahooMailbox, j job, addr string, isSpam bool, t *tally) {
+	if !w.cfg.SenderReputation.Enabled || addr == "" {
+		return
+	}
+	if err := w.tracker.RecordSender(yahoo.Email, addr, isSpam, w.clock.Now()); err != nil {
+		log.Error("state update failed", "uid", j.uid, "error", err)
+		t.addError()
+	}
+}
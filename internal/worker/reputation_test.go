@@ -0,0 +1,57 @@
+package worker
+
+import (
+	"log/slog"
+	"os"
+	"testing"
+
+	"github.com/benj-n/yatogm/internal/config"
+	"github.com/benj-n/yatogm/internal/state"
+)
+
+func TestSenderReputation(t *testing.T) {
+	cfg := unreachableConfig(t)
+	cfg.Gmail = config.GmailConfig{}
+	cfg.ArchiveDir = t.TempDir()
+	cfg.SenderReputation = config.ReputationConfig{Enabled: true, MinMessages: 2, SpamRatio: 0.5}
+	tracker, err := state.NewTracker(cfg.StatePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spam := "From: Deals <Deals@example.com>\r\nX-YahooFilteredBulk: 203.0.113.5\r\nSubject: sale\r\n\r\nbody\r\n"
+	mb := &fakeMailbox{msgs: map[string]string{
+		"uid1": spam,
+		"uid2": spam,
+		"uid3": "From: a@example.com\r\nSubject: hi\r\n\r\nbody\r\n",
+	}}
+	dest := &fakeDestination{}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelError}))
+
+	w := New(cfg, tracker, logger, WithSource(mb.open), WithDestination(dest, true))
+	if fetched, errs := w.processMailbox(0, cfg.Yahoo[0]); fetched != 3 || errs != 0 {
+		t.Fatalf("expected three messages handled, got %d fetched, %d errors", fetched, errs)
+	}
+	if len(dest.delivered) != 3 {
+		t.Fatalf("expected every message delivered before the sender has a history, got %v", dest.delivered)
+	}
+	if st := tracker.Sender("test@yahoo.com", "deals@example.com"); st.Messages != 2 || st.Spam != 2 {
+		t.Errorf("unexpected sender history %+v", st)
+	}
+
+	// Once the sender crosses spam_ratio, its messages are archived and
+	// deleted without being delivered.
+	mb.msgs["uid4"] = spam
+	mb.msgs["uid5"] = "From: a@example.com\r\nSubject: again\r\n\r\nbody\r\n"
+	if fetched, errs := w.processMailbox(0, cfg.Yahoo[0]); fetched != 2 || errs != 0 {
+		t.Fatalf("expected two messages handled, got %d fetched, %d errors", fetched, errs)
+	}
+	if len(dest.delivered) != 4 {
+		t.Errorf("expected only the message from a@example.com delivered, got %v", dest.delivered)
+	}
+	if len(mb.msgs) != 0 {
+		t.Errorf("expected archived messages deleted, got %v", mb.msgs)
+	}
+	if st := tracker.Sender("test@yahoo.com", "deals@example.com"); st.Messages != 3 {
+		t.Errorf("expected the archived message counted, got %+v", st)
+	}
+}
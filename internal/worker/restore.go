@@ -0,0 +1,82 @@
+package worker
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/benj-n/yatogm/internal/archive"
+	"github.com/benj-n/yatogm/internal/ulid"
+)
+
+// Restored describes a message delivered again from the archive.
+type Restored struct {
+	// Key is the archive key of the copy delivered.
+	Key string
+	// Destination is the name of the destination it was delivered to.
+	Destination string
+	// ID is the yatogm ID of the new delivery.
+	ID    string
+	Reply string
+}
+
+// Restore delivers the latest archived copy of the message with the given
+// UID, retrieved from mailbox, once more to the destination named dest,
+// or to the first one (Gmail, when configured) if dest is empty. It undoes
+// an accidental filter or deletion on the destination's side for as long
+// as the archive keeps the message. The state is neither read nor written.
+func (w *Worker) Restore(mailbox, uid, dest string) (Restored, error) {
+	r := Restored{}
+	var d Destination
+	for _, c := range w.destinations {
+		if dest == "" || c.Name() == dest {
+			d = c.Destination
+			break
+		}
+	}
+	if d == nil {
+		if dest == "" {
+			return r, errors.New("no destination is configured")
+		}
+		return r, fmt.Errorf("no destination named %s", dest)
+	}
+	r.Destination = d.Name()
+	defer w.closeSMTP()
+
+	var store archive.Finder
+	searched := 0
+	for _, s := range w.archives {
+		f, ok := s.(archive.Finder)
+		if !ok {
+			continue
+		}
+		searched++
+		keys, err := f.Find(mailbox, uid)
+		if err != nil {
+			return r, err
+		}
+		if len(keys) > 0 {
+			store, r.Key = f, keys[len(keys)-1]
+			break
+		}
+	}
+	if searched == 0 {
+		return r, errors.New("no archive to restore from; archive_dir or archive_s3 must be set")
+	}
+	if store == nil {
+		return r, fmt.Errorf("no archived copy of %s from %s", uid, mailbox)
+	}
+	msg, err := store.Get(r.Key)
+	if err != nil {
+		return r, err
+	}
+
+	r.ID = ulid.Make().String()
+	w.logger.Info("restoring message", "mailbox", mailbox, "uid", uid, "key", r.Key, "destination", r.Destination, "yatogm_id", r.ID)
+	r.Reply, err = d.Deliver(context.Background(), bytes.NewReader(msg), int64(len(msg)), mailbox, r.ID)
+	if err != nil {
+		return r, fmt.Errorf("delivering to %s: %w", r.Destination, err)
+	}
+	return r, nil
+}
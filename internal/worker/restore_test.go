@@ -0,0 +1,52 @@
+package worker
+
+import (
+	"log/slog"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benj-n/yatogm/internal/archive"
+	"github.com/benj-n/yatogm/internal/config"
+)
+
+func TestRestore(t *testing.T) {
+	cfg := unreachableConfig(t)
+	cfg.Gmail = config.GmailConfig{}
+	cfg.ArchiveDir = t.TempDir()
+	raw := "From: a@example.com\r\nSubject: hi\r\n\r\nbody\r\n"
+	key := archive.Key("test@yahoo.com", "uid1", time.Now())
+	if _, err := archive.Dir(cfg.ArchiveDir).Put(key, strings.NewReader(raw), int64(len(raw))); err != nil {
+		t.Fatal(err)
+	}
+	dest := &fakeDestination{}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelError}))
+	w := New(cfg, nil, logger, WithDestination(dest, true))
+
+	r, err := w.Restore("test@yahoo.com", "uid1", "")
+	if err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	if r.Key != key || r.Destination != "archive" || r.Reply != "stored" {
+		t.Errorf("unexpected restore %+v", r)
+	}
+	if len(dest.delivered) != 1 || dest.delivered[0] != r.ID {
+		t.Errorf("expected the message delivered under a new yatogm ID, got %v", dest.delivered)
+	}
+
+	for _, tc := range []struct{ uid, dest, want string }{
+		{"uid2", "", "no archived copy"},
+		{"uid1", "gmail", "no destination named gmail"},
+	} {
+		if _, err := w.Restore("test@yahoo.com", tc.uid, tc.dest); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("Restore(%s, %s): expected an error containing %q, got %v", tc.uid, tc.dest, tc.want, err)
+		}
+	}
+
+	cfg.ArchiveDir = ""
+	w = New(cfg, nil, logger, WithDestination(dest, true))
+	if _, err := w.Restore("test@yahoo.com", "uid1", ""); err == nil || !strings.Contains(err.Error(), "no archive") {
+		t.Errorf("expected restoring without an archive to fail, got %v", err)
+	}
+}
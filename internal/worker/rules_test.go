@@ -0,0 +1,60 @@
+package worker
+
+import (
+	"log/slog"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/benj-n/yatogm/internal/config"
+	"github.com/benj-n/yatogm/internal/state"
+)
+
+func TestRules(t *testing.T) {
+	cfg := unreachableConfig(t)
+	cfg.Gmail = config.GmailConfig{}
+	cfg.ArchiveDir = t.TempDir()
+	cfg.Rules = []config.RuleConfig{
+		{Name: "statements", If: `from.domain == "bank.com" && subject contains "statement"`, Action: "deliver"},
+		{Name: "bank", If: `from.domain == "bank.com"`, Action: "archive"},
+	}
+	tracker, err := state.NewTracker(cfg.StatePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mb := &fakeMailbox{msgs: map[string]string{
+		"uid1": "From: news@bank.com\r\nSubject: Offers\r\n\r\nbody\r\n",
+		"uid2": "From: news@bank.com\r\nSubject: Your statement\r\n\r\nbody\r\n",
+		"uid3": "From: a@example.com\r\nSubject: hi\r\n\r\nbody\r\n",
+	}}
+	dest := &contentDestination{}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelError}))
+
+	w := New(cfg, tracker, logger, WithSource(mb.open), WithDestination(dest, true))
+	if fetched, errs, err := w.run(cfg.Yahoo); err != nil || fetched != 3 || errs != 0 {
+		t.Fatalf("expected three messages handled, got %d fetched, %d errors (%v)", fetched, errs, err)
+	}
+	if len(dest.delivered) != 2 {
+		t.Fatalf("expected two messages delivered, got %q", dest.delivered)
+	}
+	for _, d := range dest.delivered {
+		if strings.Contains(d, "Offers") {
+			t.Errorf("expected the archived message undelivered, got %q", d)
+		}
+	}
+	if len(mb.msgs) != 0 {
+		t.Errorf("expected all messages deleted, got %v", mb.msgs)
+	}
+
+	// A condition that does not compile stops the run before any message
+	// is handled.
+	cfg.Rules = []config.RuleConfig{{Name: "bad", If: `size < "5MB"`, Action: "archive"}}
+	mb.msgs["uid4"] = "From: news@bank.com\r\nSubject: Offers\r\n\r\nbody\r\n"
+	w = New(cfg, tracker, logger, WithSource(mb.open), WithDestination(dest, true))
+	if _, _, err := w.run(cfg.Yahoo); err == nil || !strings.Contains(err.Error(), "rule bad: col 6") {
+		t.Errorf("expected a rule error, got %v", err)
+	}
+	if _, ok := mb.msgs["uid4"]; !ok {
+		t.Error("expected the message left on the server")
+	}
+}
@@ -0,0 +1,135 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/benj-n/yatogm/internal/config"
+	"github.com/benj-n/yatogm/internal/imap"
+)
+
+// seedGmail records the Message-IDs already in Gmail, with dedup_existing
+// set, unless they were recorded by an earlier run. The scan runs once,
+// before the first delivery; a failed one is retried by the next run.
+func (w *Worker) seedGmail() error {
+	dest := w.cfg.Gmail.Email
+	if !w.cfg.Gmail.DedupExisting.Enabled || dest == "" || w.tracker.Seeded(dest) {
+		return nil
+	}
+	w.logger.Info("scanning Gmail for the messages it already has", "destination", dest)
+	ids, err := w.scanGmail(context.Background())
+	if err != nil {
+		return fmt.Errorf("scanning Gmail for existing messages: %w", err)
+	}
+	if err := w.tracker.SetSeed(dest, ids, w.clock.Now()); err != nil {
+		return fmt.Errorf("saving the messages already in Gmail: %w", err)
+	}
+	w.logger.Info("Gmail scanned, the messages it has will not be delivered again", "destination", dest, "messages", len(ids))
+	return nil
+}
+
+// gmailMessageIDs lists the Message-IDs in the folder dedup_existing
+// names, or in "All Mail", over IMAP.
+func (w *Worker) gmailMessageIDs(ctx context.Context) ([]string, error) {
+	d := w.cfg.Gmail.DedupExisting
+	dialer, err := w.proxied(w.cfg.Proxy)
+	if err != nil {
+		return nil, err
+	}
+	c, err := imap.Dial(ctx, d.IMAPHost, d.IMAPPort, w.cfg.DialTimeout, config.PinnedTLS(w.tlsConfig, w.cfg.Gmail.TLSPins), dialer)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	c.SetCommandTimeout(w.cfg.CommandTimeout)
+
+	if w.tokens != nil {
+		token, err := w.tokens.Token()
+		if err != nil {
+			return nil, err
+		}
+		err = c.AuthenticateXOAUTH2(w.cfg.Gmail.Email, token)
+	} else {
+		err = c.Login(w.cfg.Gmail.Email, w.cfg.Gmail.AppPassword)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	folder, err := gmailFolder(c, d.Folder)
+	if err != nil {
+		return nil, err
+	}
+	n, err := c.Examine(folder)
+	if errors.Is(err, imap.ErrServer) {
+		return nil, fmt.Errorf("%w; %s", err, folderHint(c))
+	}
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, n)
+	if err := c.MessageIDs(n, func(id string) { ids = append(ids, id) }); err != nil {
+		return nil, err
+	}
+	if err := c.Logout(); err != nil {
+		w.logger.Debug("IMAP logout failed", "error", err)
+	}
+	return ids, nil
+}
+
+// gmailFolder returns the name of the folder configured as folder, which
+// is looked up by its special use if it is one, such as `\Sent`, since
+// Gmail names folders in the account's language.
+func gmailFolder(c *imap.Client, folder string) (string, error) {
+	if folder != "" && !strings.HasPrefix(folder, `\`) {
+		return folder, nil
+	}
+	use := folder
+	if use == "" {
+		use = `\All`
+	}
+	name, err := c.SpecialUse(use)
+	switch {
+	case err != nil:
+		return "", err
+	case name != "":
+		return name, nil
+	case folder == "":
+		return "INBOX", nil
+	}
+	return "", fmt.Errorf("no Gmail folder has the special use %s; %s", folder, folderHint(c))
+}
+
+// folderHint lists the folders of the account and their special uses, for
+// an error about a folder that was not found.
+func folderHint(c *imap.Client) string {
+	mailboxes, err := c.List()
+	if err != nil {
+		return "the folders could not be listed"
+	}
+	var names []string
+	for _, m := range mailboxes {
+		name := strconv.Quote(m.Name)
+		for _, a := range m.Attributes {
+			if slices.ContainsFunc(config.SpecialUses, func(u string) bool { return strings.EqualFold(u, a) }) {
+				name += " (" + a + ")"
+			}
+		}
+		names = append(names, name)
+	}
+	return "the account has " + strings.Join(names, ", ")
+}
+
+// alreadyInGmail reports whether d is Gmail and had the message before
+// the first run.
+func (w *Worker) alreadyInGmail(d destination, j job) bool {
+	if _, ok := d.Destination.(gmailDestination); !ok || !w.cfg.Gmail.DedupExisting.Enabled {
+		return false
+	}
+	id := messageID(j.msg, j.msg.Size())
+	return id != "" && w.tracker.IsSeeded(d.Name(), id)
+}
@@ -0,0 +1,87 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"testing"
+
+	"github.com/benj-n/yatogm/internal/config"
+	"github.com/benj-n/yatogm/internal/state"
+)
+
+func TestSeedGmail(t *testing.T) {
+	cfg := unreachableConfig(t)
+	cfg.Gmail.DedupExisting.Enabled = true
+	tracker, err := state.NewTracker(cfg.StatePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError + 4}))
+	w := New(cfg, tracker, logger)
+	scans := 0
+	scanErr := errors.New("connection refused")
+	w.scanGmail = func(context.Context) ([]string, error) {
+		scans++
+		return []string{"<old@example.com>"}, scanErr
+	}
+
+	// Until Gmail is scanned, no run starts.
+	if _, _, err := w.run(nil); err == nil || !errors.Is(err, scanErr) {
+		t.Fatalf("expected the failed scan to stop the run, got %v", err)
+	}
+	if tracker.Seeded(cfg.Gmail.Email) {
+		t.Fatal("expected no seed after a failed scan")
+	}
+	scanErr = nil
+	for range 2 {
+		if _, _, err := w.run(nil); err != nil {
+			t.Fatalf("run failed: %v", err)
+		}
+	}
+	if scans != 2 {
+		t.Errorf("expected Gmail to be scanned once it succeeded, got %d scans", scans)
+	}
+
+	// A message Gmail had is not delivered to it again, but is still
+	// recorded as fetched and deleted. Others are delivered, and fail here.
+	src := &fakeSource{uids: []string{"uid1", "uid2", "uid3"}}
+	sess := &session{src: src, uids: src.uids, has: map[string]bool{"uid1": true, "uid2": true, "uid3": true}}
+	for _, tt := range []struct {
+		uid, messageID string
+		fetched, errs  int
+	}{
+		{"uid1", "<old@example.com>", 1, 0},
+		{"uid2", "<new@example.com>", 0, 1},
+		{"uid3", "", 0, 1},
+	} {
+		sp := &spool{}
+		sp.Write([]byte("From: a@example.com\r\nMessage-ID: " + tt.messageID + "\r\nSubject: hi\r\n\r\nbody\r\n"))
+		var tl tally
+		w.forward(logger, cfg.Yahoo[0], job{sess: sess, uid: tt.uid, id: "01ARYZ6S41TSV4RRFFQ69G5FAV", msg: sp}, &tl)
+		if fetched, errs := tl.counts(); fetched != tt.fetched || errs != tt.errs {
+			t.Errorf("%s: got %d fetched, %d errors, want %d, %d", tt.uid, fetched, errs, tt.fetched, tt.errs)
+		}
+	}
+	if !tracker.IsFetched("test@yahoo.com", "uid1") || len(src.deleted) != 1 || src.deleted[0] != "uid1" {
+		t.Errorf("expected the message already in Gmail to be fetched and deleted, deleted %v", src.deleted)
+	}
+}
+
+func TestSeedGmailDisabled(t *testing.T) {
+	cfg := unreachableConfig(t)
+	tracker, err := state.NewTracker(cfg.StatePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError + 4}))
+	w := New(cfg, tracker, logger)
+	w.scanGmail = func(context.Context) ([]string, error) {
+		t.Error("unexpected scan of Gmail")
+		return nil, nil
+	}
+	if _, _, err := w.run([]config.YahooMailbox{}); err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+}
@@ -0,0 +1,101 @@
+package worker
+
+import (
+	"context"
+	"io"
+
+	"github.com/benj-n/yatogm/internal/config"
+	"github.com/benj-n/yatogm/internal/pop3"
+)
+
+// Source is a logged-in session on a mailbox that messages are fetched
+// from. Messages are addressed by UIDs, which must stay the same across
+// sessions, since the state tracker records them.
+type Source interface {
+	// ListUIDs returns the UIDs of the messages in the mailbox, oldest
+	// first.
+	ListUIDs() ([]string, error)
+	// Fetch streams a message listed by ListUIDs to w and returns the
+	// number of bytes written.
+	Fetch(uid string, w io.Writer) (int64, error)
+	// Delete removes a message. A source may defer the removal until Close.
+	Delete(uid string) error
+	// Close ends the session, committing deletions.
+	Close() error
+}
+
+// Sizer is implemented by sources that can report message sizes without
+// fetching the messages, which max_message_size needs.
+type Sizer interface {
+	// Sizes returns the size in bytes of each message listed by ListUIDs,
+	// by UID.
+	Sizes() (map[string]int64, error)
+}
+
+// Topper is implemented by sources that can return the header of a
+// message without fetching all of it, so that a message can be looked at
+// before deciding to fetch it.
+type Topper interface {
+	// Top returns the header of a message listed by ListUIDs, the blank
+	// line ending it, and the first lines lines of its body.
+	Top(uid string, lines int) ([]byte, error)
+}
+
+// Prefetcher is implemented by sources that can start retrieving messages
+// before they are fetched, as a POP3 server that pipelines commands can.
+type Prefetcher interface {
+	// Prefetch announces the messages, listed by ListUIDs, that Fetch is
+	// called for next, in order.
+	Prefetch(uids []string) error
+}
+
+// ContextFetcher is implemented by sources that can give up fetching a
+// message when a context is done.
+type ContextFetcher interface {
+	// FetchContext is like Fetch, but gives up once ctx is done. The
+	// session may not be usable after that.
+	FetchContext(ctx context.Context, uid string, w io.Writer) (int64, error)
+}
+
+// OpenFunc opens a new session on a configured mailbox.
+type OpenFunc func(yahoo config.YahooMailbox) (Source, error)
+
+// WithSource replaces the POP3 sessions opened on each mailbox with
+// sessions opened by open.
+func WithSource(open OpenFunc) Option {
+	return func(w *Worker) {
+		w.open = open
+	}
+}
+
+// pop3Options returns the options POP3 sessions on yahoo are opened with.
+func (w *Worker) pop3Options(yahoo config.YahooMailbox) ([]pop3.Option, error) {
+	opts := []pop3.Option{pop3.WithClock(w.clock)}
+	via := yahoo.Proxy
+	if via == "" {
+		via = w.cfg.Proxy
+	}
+	d, err := w.proxied(via)
+	if err != nil {
+		return nil, err
+	}
+	if d != nil {
+		opts = append(opts, pop3.WithDialer(d))
+	}
+	return opts, nil
+}
+
+// openPOP3 opens a POP3 session on a Yahoo mailbox, secured as its
+// pop3_tls_mode says.
+func (w *Worker) openPOP3(yahoo config.YahooMailbox) (Source, error) {
+	opts, err := w.pop3Options(yahoo)
+	if err != nil {
+		return nil, err
+	}
+	mb, err := pop3.OpenMailbox(yahoo.POP3Host, yahoo.POP3Port, w.cfg.DialTimeout, config.PinnedTLS(w.tlsConfig, yahoo.TLSPins), pop3.TLSMode(yahoo.POP3TLSMode), yahoo.Email, yahoo.AppPassword, opts...)
+	if err != nil {
+		return nil, err
+	}
+	mb.SetCommandTimeout(w.cfg.CommandTimeout)
+	return mb, nil
+}
@@ -0,0 +1,61 @@
+package worker
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/benj-n/yatogm/internal/config"
+)
+
+// checkStale records whether the mailbox, listing uids at now, holds new
+// mail. With stale_after set, a mailbox that has received mail before but
+// none for that long is reported once: in the log and, if Gmail is
+// configured, with a notice. The report is repeated only after new mail
+// arrived and stopped again.
+func (w *Worker) checkStale(log *slog.Logger, yahoo config.YahooMailbox, uids []string, now time.Time, t *tally) {
+	received, alerted := w.tracker.LastReceived(yahoo.Email)
+	for _, uid := range uids {
+		if w.tracker.IsFetched(yahoo.Email, uid) || w.tracker.IsSkipped(yahoo.Email, uid) || w.tracker.IsQuarantined(yahoo.Email, uid) {
+			continue
+		}
+		if alerted.After(received) {
+			log.Info("mailbox receiving mail again", "last_received", received.Format(time.RFC3339))
+		}
+		if err := w.tracker.MarkReceived(yahoo.Email, now); err != nil {
+			log.Error("state update failed", "error", err)
+			t.addError()
+		}
+		return
+	}
+
+	if w.cfg.StaleAfter <= 0 || received.IsZero() || now.Sub(received) < w.cfg.StaleAfter || alerted.After(received) {
+		return
+	}
+	log.Warn("no new mail in mailbox for longer than stale_after",
+		"last_received", received.Format(time.RFC3339), "stale_after", w.cfg.StaleAfter.String())
+	if w.cfg.Gmail.Email != "" {
+		if err := w.notify(staleNotice(yahoo.Email, received, now)); err != nil {
+			// Not recorded, so that the next run tries again.
+			log.Error("stale mailbox notification failed", "error", err)
+			t.addError()
+			return
+		}
+	}
+	if err := w.tracker.MarkStaleAlerted(yahoo.Email, now); err != nil {
+		log.Error("state update failed", "error", err)
+		t.addError()
+	}
+}
+
+// staleNotice returns the subject and body of the notice about a mailbox
+// that last received mail at received.
+func staleNotice(mailbox string, received, now time.Time) (subject, body string) {
+	var b strings.Builder
+	days := int(now.Sub(received).Hours() / 24)
+	fmt.Fprintf(&b, "No new mail has arrived in %s since %s (%d days).\n\n", mailbox, received.Format("Mon, 02 Jan 2006 15:04 MST"), days)
+	b.WriteString("yatogm can still log in, so the mailbox is reachable, but it may no longer receive mail: ")
+	b.WriteString("check that POP access is still enabled in the Yahoo Mail settings, and that no filter or forwarding rule sends mail elsewhere.\n")
+	return "[yatogm] No new mail in " + mailbox, b.String()
+}
@@ -0,0 +1,70 @@
+package worker
+
+import (
+	"log/slog"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benj-n/yatogm/internal/config"
+	"github.com/benj-n/yatogm/internal/state"
+)
+
+func TestCheckStale(t *testing.T) {
+	cfg := unreachableConfig(t)
+	cfg.Gmail = config.GmailConfig{}
+	cfg.Maildir.Dir = t.TempDir()
+	cfg.StaleAfter = 7 * 24 * time.Hour
+	tracker, err := state.NewTracker(cfg.StatePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError}))
+	w := New(cfg, tracker, logger)
+	yahoo := cfg.Yahoo[0]
+	now := time.Now().Truncate(time.Second)
+
+	var tl tally
+	// A mailbox that never received mail is not stale.
+	w.checkStale(logger, yahoo, nil, now, &tl)
+	if _, alerted := tracker.LastReceived(yahoo.Email); !alerted.IsZero() {
+		t.Error("expected no alert for a mailbox without history")
+	}
+
+	// New mail is recorded.
+	last := now.Add(-10 * 24 * time.Hour)
+	w.checkStale(logger, yahoo, []string{"uid1"}, last, &tl)
+	if received, _ := tracker.LastReceived(yahoo.Email); !received.Equal(last) {
+		t.Fatalf("expected new mail recorded at %v, got %v", last, received)
+	}
+
+	// Once it has been fetched, the mailbox is stale, and reported once.
+	if err := tracker.MarkFetched(yahoo.Email, "uid1"); err != nil {
+		t.Fatal(err)
+	}
+	w.checkStale(logger, yahoo, []string{"uid1"}, now, &tl)
+	if _, alerted := tracker.LastReceived(yahoo.Email); !alerted.Equal(now) {
+		t.Fatalf("expected a stale alert at %v, got %v", now, alerted)
+	}
+	w.checkStale(logger, yahoo, []string{"uid1"}, now.Add(time.Hour), &tl)
+	if _, alerted := tracker.LastReceived(yahoo.Email); !alerted.Equal(now) {
+		t.Errorf("expected no second alert, got one at %v", alerted)
+	}
+	if _, errs := tl.counts(); errs != 0 {
+		t.Errorf("expected no errors, got %d", errs)
+	}
+}
+
+func TestStaleNotice(t *testing.T) {
+	received := time.Date(2024, 5, 1, 14, 32, 0, 0, time.UTC)
+	subject, body := staleNotice("user@yahoo.com", received, received.Add(10*24*time.Hour))
+	if subject != "[yatogm] No new mail in user@yahoo.com" {
+		t.Errorf("subject = %q", subject)
+	}
+	for _, want := range []string{"Wed, 01 May 2024 14:32 UTC", "(10 days)", "POP access"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("body does not mention %q:\n%s", want, body)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package worker
+
+import (
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/benj-n/yatogm/internal/config"
+	"github.com/benj-n/yatogm/internal/state"
+)
+
+// syncFrom returns the index in uids, the listing of a differentially
+// synced mailbox, of the first message a run examines: the one after the
+// checkpoint, or 0 for a full reconciliation when one is due or the
+// checkpoint cannot be trusted.
+func (w *Worker) syncFrom(log *slog.Logger, yahoo config.YahooMailbox, uids []string, now time.Time) int {
+	if w.fullSync {
+		return 0
+	}
+	cp, ok := w.tracker.Checkpoint(yahoo.Email)
+	if !ok {
+		log.Info("no sync checkpoint, examining every message")
+		return 0
+	}
+	if now.Sub(time.Unix(cp.ReconciledAt, 0)) >= yahoo.ReconcileInterval {
+		log.Info("reconciliation due, examining every message",
+			"reconciled_at", time.Unix(cp.ReconciledAt, 0).Format(time.RFC3339))
+		return 0
+	}
+	// Servers list messages oldest first, so the checkpoint can only move
+	// up, as messages before it are deleted.
+	i := slices.Index(uids, cp.UID)
+	switch {
+	case i < 0:
+		log.Warn("sync checkpoint no longer listed, examining every message", "checkpoint", cp.UID)
+	case i+1 > cp.Position:
+		log.Warn("messages listed before the sync checkpoint, examining every message",
+			"checkpoint", cp.UID, "position", i+1, "was", cp.Position)
+	default:
+		log.Info("examining messages after the sync checkpoint", "checkpoint", cp.UID, "after", len(uids)-i-1)
+		return i + 1
+	}
+	return 0
+}
+
+// advanceCheckpoint moves the checkpoint of a differentially synced
+// mailbox past the messages of uids, from index from on, that the run
+// settled, up to the first one a later run still has to handle. Messages
+// the run deleted are passed over, as the server no longer lists them; one
+// whose deletion was withheld stops the checkpoint, to be deleted later.
+func (w *Worker) advanceCheckpoint(log *slog.Logger, yahoo config.YahooMailbox, sessions []*session, uids []string, from int, now time.Time, t *tally) {
+	deleted := make(map[string]bool)
+	for _, sess := range sessions {
+		if !sess.withhold {
+			for _, uid := range sess.deleted {
+				deleted[uid] = true
+			}
+		}
+	}
+
+	prev, _ := w.tracker.Checkpoint(yahoo.Email)
+	cp := state.Checkpoint{At: prev.At, ReconciledAt: prev.ReconciledAt}
+	if from > 0 {
+		cp.UID, cp.Position = uids[from-1], from
+	} else {
+		cp.ReconciledAt = now.Unix()
+	}
+	position := cp.Position
+	for _, uid := range uids[from:] {
+		if deleted[uid] {
+			continue
+		}
+		if !w.settled(yahoo, uid, now) {
+			break
+		}
+		position++
+		cp.UID, cp.Position = uid, position
+	}
+
+	var err error
+	if cp.UID == "" {
+		// Nothing is settled yet: the next run reconciles again.
+		err = w.tracker.ClearCheckpoint(yahoo.Email)
+	} else if cp != prev {
+		cp.At = now.Unix()
+		if cp.UID != prev.UID {
+			log.Debug("sync checkpoint advanced", "checkpoint", cp.UID, "position", cp.Position)
+		}
+		err = w.tracker.SetCheckpoint(yahoo.Email, cp)
+	}
+	if err != nil {
+		log.Error("state update failed", "error", err)
+		t.addError()
+	}
+}
+
+// settled reports whether nothing is left to do for the message uid, which
+// is still on the server: it is quarantined, left there for its size or
+// date, or forwarded and retained.
+func (w *Worker) settled(yahoo config.YahooMailbox, uid string, now time.Time) bool {
+	switch {
+	case w.tracker.IsQuarantined(yahoo.Email, uid), w.tracker.IsSkipped(yahoo.Email, uid):
+		return true
+	case w.tracker.IsFetched(yahoo.Email, uid):
+		return w.retained(yahoo, uid, now)
+	}
+	return w.knownOutOfRange(yahoo, uid)
+}
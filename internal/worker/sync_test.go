@@ -0,0 +1,134 @@
+package worker
+
+import (
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benj-n/yatogm/internal/config"
+	"github.com/benj-n/yatogm/internal/state"
+)
+
+func TestDifferentialSync(t *testing.T) {
+	cfg := unreachableConfig(t)
+	cfg.Gmail = config.GmailConfig{}
+	keep := false
+	cfg.Yahoo[0].DeleteAfterForward = &keep
+	cfg.Yahoo[0].Sync = "differential"
+	cfg.Yahoo[0].ReconcileInterval = time.Hour
+	tracker, err := state.NewTracker(cfg.StatePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := func(subject string) string {
+		return "From: a@example.com\r\nSubject: " + subject + "\r\n\r\nbody\r\n"
+	}
+	mb := &fakeMailbox{
+		msgs: map[string]string{"uid1": msg("one"), "uid2": msg("two"), "uid3": msg("three"), "uid4": msg("four")},
+		// uid3 cannot be retrieved, so it is still to be forwarded.
+		broken: []string{"uid3"},
+	}
+	dest := &contentDestination{}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelError}))
+	w := New(cfg, tracker, logger, WithSource(mb.open), WithDestination(dest, true))
+
+	// Only the messages after the checkpoint are examined.
+	now := time.Now().Unix()
+	if err := tracker.SetCheckpoint("test@yahoo.com", state.Checkpoint{UID: "uid1", Position: 1, At: now, ReconciledAt: now}); err != nil {
+		t.Fatal(err)
+	}
+	delivered := func(want ...string) {
+		t.Helper()
+		var got []string
+		for _, d := range dest.delivered {
+			got = append(got, strings.TrimSuffix(strings.SplitAfter(d, "Subject: ")[1], "\r\n\r\nbody\r\n"))
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("delivered %q, want %q", got, want)
+		}
+		dest.delivered = nil
+	}
+	checkpoint := func(uid string, position int) state.Checkpoint {
+		t.Helper()
+		cp, ok := tracker.Checkpoint("test@yahoo.com")
+		if !ok || cp.UID != uid || cp.Position != position {
+			t.Errorf("checkpoint = %+v, %v, want %s at %d", cp, ok, uid, position)
+		}
+		return cp
+	}
+	if _, _, err := w.run(cfg.Yahoo); err != nil {
+		t.Fatal(err)
+	}
+	delivered("two", "four")
+	// The checkpoint stops before uid3.
+	checkpoint("uid2", 2)
+
+	mb.broken = nil
+	mb.msgs["uid5"] = msg("five")
+	if _, _, err := w.run(cfg.Yahoo); err != nil {
+		t.Fatal(err)
+	}
+	delivered("three", "five")
+	if cp := checkpoint("uid5", 5); cp.ReconciledAt != now {
+		t.Errorf("expected no reconciliation, got %+v", cp)
+	}
+
+	// A message listed before the checkpoint has everything examined.
+	mb.msgs["uid0"] = msg("zero")
+	if _, _, err := w.run(cfg.Yahoo); err != nil {
+		t.Fatal(err)
+	}
+	delivered("zero", "one")
+	if cp := checkpoint("uid5", 6); cp.ReconciledAt < now {
+		t.Errorf("expected a reconciliation, got %+v", cp)
+	}
+	if len(mb.msgs) != 6 {
+		t.Errorf("expected every message kept, got %v", mb.msgs)
+	}
+}
+
+func TestDifferentialSyncDeletes(t *testing.T) {
+	cfg := unreachableConfig(t)
+	cfg.Gmail = config.GmailConfig{}
+	cfg.Yahoo[0].Sync = "differential"
+	cfg.Yahoo[0].ReconcileInterval = time.Hour
+	tracker, err := state.NewTracker(cfg.StatePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, uid := range []string{"uid1", "uid3"} {
+		if err := tracker.MarkQuarantined("test@yahoo.com", uid, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mb := &fakeMailbox{msgs: map[string]string{
+		"uid1": "Subject: one\r\n\r\nbody\r\n",
+		"uid2": "Subject: two\r\n\r\nbody\r\n",
+		"uid3": "Subject: three\r\n\r\nbody\r\n",
+	}}
+	dest := &contentDestination{}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelError}))
+	w := New(cfg, tracker, logger, WithSource(mb.open), WithDestination(dest, true))
+
+	// The deleted uid2 is passed over; the quarantined messages stay.
+	if _, _, err := w.run(cfg.Yahoo); err != nil {
+		t.Fatal(err)
+	}
+	cp, ok := tracker.Checkpoint("test@yahoo.com")
+	if len(dest.delivered) != 1 || !ok || cp.UID != "uid3" || cp.Position != 2 {
+		t.Fatalf("unexpected checkpoint %+v, %v after delivering %d", cp, ok, len(dest.delivered))
+	}
+	mb.msgs["uid4"] = "Subject: four\r\n\r\nbody\r\n"
+	if _, _, err := w.run(cfg.Yahoo); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := tracker.Checkpoint("test@yahoo.com"); got != cp || len(dest.delivered) != 2 {
+		t.Errorf("expected uid4 forwarded and the checkpoint kept, got %+v after delivering %d", got, len(dest.delivered))
+	}
+	if len(mb.msgs) != 2 {
+		t.Errorf("expected only the quarantined messages left, got %v", mb.msgs)
+	}
+}
@@ -2,15 +2,51 @@
 package worker
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
-	"sort"
+	"mime"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
 	"time"
 
+	"github.com/benj-n/yatogm/internal/archive"
+	"github.com/benj-n/yatogm/internal/clock"
 	"github.com/benj-n/yatogm/internal/config"
-	"github.com/benj-n/yatogm/internal/pop3"
+	"github.com/benj-n/yatogm/internal/filter"
+	"github.com/benj-n/yatogm/internal/invariant"
+	"github.com/benj-n/yatogm/internal/pdf"
+	"github.com/benj-n/yatogm/internal/proxy"
+	"github.com/benj-n/yatogm/internal/quarantine"
+	"github.com/benj-n/yatogm/internal/receipt"
+	"github.com/benj-n/yatogm/internal/rules"
 	smtpsender "github.com/benj-n/yatogm/internal/smtp"
 	"github.com/benj-n/yatogm/internal/state"
+	"github.com/benj-n/yatogm/internal/ulid"
+)
+
+const (
+	// throttleCooldown is how long later runs hold off when a run ends with
+	// the destination still throttling deliveries.
+	throttleCooldown = 5 * time.Minute
+	// maxThrottleCooldown caps the cooldown, which doubles for every
+	// consecutive run that ends throttled.
+	maxThrottleCooldown = time.Hour
+	// clockSkewTolerance is how far the wall clock may lag the latest state
+	// write before it is considered unsynchronized.
+	clockSkewTolerance = 5 * time.Minute
 )
 
 // Worker processes email fetching and forwarding for all configured mailboxes.
@@ -18,141 +54,1363 @@ type Worker struct {
 	cfg     *config.Config
 	tracker *state.Tracker
 	sender  *smtpsender.Sender
-	logger  *slog.Logger
+	// tokens, with OAuth2, authenticates with Gmail, as the sender does.
+	tokens  *smtpsender.TokenSource
+	limiter *smtpsender.Limiter
+	// rate paces deliveries to Gmail, or is nil without rate_limit.
+	rate     *smtpsender.Rate
+	receipts *receipt.Log
+	// invariants, with invariant_journal set, checks each delivery and
+	// deletion of the current run.
+	invariants *invariant.Checker
+	// rules decide about each message before the filters run.
+	rules rules.Set
+	// filters run over each message before it is delivered.
+	filters   filter.Chain
+	logger    *slog.Logger
+	tlsConfig *tls.Config
+	open      OpenFunc
+	// scanGmail lists the Message-IDs already in Gmail, for
+	// dedup_existing.
+	scanGmail func(ctx context.Context) ([]string, error)
+	// clock tells the time of the run and waits between cycles.
+	clock clock.Clock
+	// dialer, when set, opens the POP3 and SMTP connections.
+	dialer Dialer
+	// pop3Retry retries connecting to a mailbox.
+	pop3Retry smtpsender.RetryPolicy
+	// archives keep a copy of each message before it is delivered.
+	archives []archive.Store
+	// destinations are Gmail, the Maildir, and the mbox files, as
+	// configured, followed by those added by WithDestination.
+	destinations []destination
+
+	// throttledLast reports whether the latest delivery attempt of the
+	// current run was answered with a throttling response.
+	throttledLast atomic.Bool
+	// cooldown pauses deliveries to Gmail within a run while it throttles.
+	cooldown cooldown
+	// runLeft counts down the messages the current run may still
+	// retrieve under max_messages_per_run.
+	runLeft atomic.Int64
+	// clockSuspect is set for a run whose wall clock lags the state, so
+	// that no new wall-clock timestamps are recorded from it.
+	clockSuspect bool
+	// withholdDeletes leaves forwarded messages on the server, as a
+	// one-shot run does under confirm_deletes without -confirm-deletes.
+	withholdDeletes bool
+	// plan, while Apply runs, maps mailboxes and UIDs to the actions
+	// planned for them, and planChanged counts the planned messages left
+	// alone.
+	plan        map[string]map[string]Action
+	planChanged atomic.Int64
+	// fullSync has differentially synced mailboxes examined in full, as
+	// applying a plan and draining need.
+	fullSync bool
+}
+
+// Option customizes a Worker.
+type Option func(*Worker)
+
+// WithTLSConfig sets the TLS configuration used for POP3S connections.
+// By default it is the one the tls settings describe, as for SMTP.
+func WithTLSConfig(tlsConfig *tls.Config) Option {
+	return func(w *Worker) {
+		w.tlsConfig = tlsConfig
+	}
+}
+
+// WithDeletesWithheld makes the Worker leave the messages it would delete
+// on the server. They are still recorded as forwarded, so a later run
+// that does not withhold deletions removes them.
+func WithDeletesWithheld() Option {
+	return func(w *Worker) {
+		w.withholdDeletes = true
+	}
+}
+
+// WithClock makes the Worker, its POP3 sessions, and its SMTP deliveries
+// tell the time and wait by c instead of the system clock.
+func WithClock(c clock.Clock) Option {
+	return func(w *Worker) {
+		w.clock = c
+		w.sender.SetClock(c)
+		w.limiter.SetClock(c)
+		if w.rate != nil {
+			w.rate.SetClock(c)
+		}
+	}
+}
+
+// Dialer opens connections to the POP3 and SMTP servers, as pop3.Dialer
+// and smtp.Dialer do.
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// WithDialer makes the Worker connect to the POP3 and SMTP servers with d,
+// such as a custom transport, instead of a net.Dialer.
+func WithDialer(d Dialer) Option {
+	return func(w *Worker) {
+		w.dialer = d
+		w.sender.SetDialer(d)
+	}
+}
+
+// proxied returns the dialer connecting through the proxy at via, or the
+// one WithDialer set, nil for a net.Dialer, when via is empty or "direct".
+// The proxy is reached with the latter.
+func (w *Worker) proxied(via string) (Dialer, error) {
+	if via == "" || via == "direct" {
+		return w.dialer, nil
+	}
+	d, err := proxy.New(via, w.dialer, w.cfg.DialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// failedDialer fails every connection with err, rather than connecting
+// around a proxy that cannot be used.
+type failedDialer struct {
+	err error
+}
+
+func (d failedDialer) DialContext(context.Context, string, string) (net.Conn, error) {
+	return nil, d.err
+}
+
+// threadMemory remembers where routed threads went in the state.
+type threadMemory struct {
+	w *Worker
+}
+
+func (m threadMemory) ThreadRoute(source string, ids []string) (string, bool) {
+	return m.w.tracker.ThreadRoute(source, ids)
+}
+
+// RecordThreadRoute logs failures to save the route, as the message was
+// delivered already: its follow-ups are then routed as if it were not.
+func (m threadMemory) RecordThreadRoute(source string, ids []string, to string) {
+	if err := m.w.tracker.RecordThreadRoute(source, ids, to, m.w.clock.Now()); err != nil {
+		m.w.logger.Warn("failed to save thread route", "mailbox", source, "to", to, "error", err)
+	}
 }
 
 // New creates a new Worker.
-func New(cfg *config.Config, tracker *state.Tracker, logger *slog.Logger) *Worker {
-	sender := smtpsender.NewSender(
-		cfg.Gmail.SMTPHost,
-		cfg.Gmail.SMTPPort,
-		cfg.Gmail.Email,
-		cfg.Gmail.AppPassword,
-		cfg.Gmail.Email,
+func New(cfg *config.Config, tracker *state.Tracker, logger *slog.Logger, opts ...Option) *Worker {
+	var (
+		sender *smtpsender.Sender
+		tokens *smtpsender.TokenSource
 	)
+	if cfg.Gmail.Auth == "oauth2" {
+		tokens = smtpsender.NewTokenSource(
+			cfg.Gmail.OAuth2.ClientID,
+			cfg.Gmail.OAuth2.ClientSecret,
+			cfg.Gmail.OAuth2.RefreshToken,
+			cfg.Gmail.OAuth2.TokenURL,
+		)
+		sender = smtpsender.NewOAuth2Sender(
+			cfg.Gmail.SMTPHost,
+			cfg.Gmail.SMTPPort,
+			cfg.Gmail.Email,
+			tokens,
+			cfg.Gmail.Email,
+		)
+	} else {
+		sender = smtpsender.NewSender(
+			cfg.Gmail.SMTPHost,
+			cfg.Gmail.SMTPPort,
+			cfg.Gmail.Email,
+			cfg.Gmail.AppPassword,
+			cfg.Gmail.Email,
+		)
+	}
+
+	sender.SetForwardMode(smtpsender.ForwardMode(cfg.Gmail.ForwardMode))
+	sender.SetTLSMode(smtpsender.TLSMode(cfg.Gmail.SMTPTLSMode))
+	sender.SetHelloName(cfg.Gmail.HeloName)
+	sender.SetNormalizeLineEndings(cfg.Gmail.NormalizeLineEndings)
+	sender.SetHeaderPolicy(smtpsender.HeaderPolicy{Keep: cfg.Gmail.KeepHeaders, Drop: cfg.Gmail.DropHeaders})
+	sender.SetReceivedPolicy(smtpsender.ReceivedPolicy{
+		Mode: smtpsender.ReceivedMode(cfg.Gmail.Received),
+		Keep: cfg.Gmail.ReceivedKeep,
+	})
+	suffixes := make(map[string]string)
+	subjects := make(map[string]*template.Template)
+	routers := make(map[string]smtpsender.Router)
+	extra := make(map[string]map[string]*template.Template)
+	for _, y := range cfg.Yahoo {
+		if y.LabelSuffix != "" {
+			suffixes[y.Email] = y.LabelSuffix
+		}
+		if len(y.Shard.To) > 0 {
+			routers[y.Email] = smtpsender.ShardRouter{To: y.Shard.To, By: smtpsender.ShardKey(y.Shard.By)}
+		}
 
-	return &Worker{
-		cfg:     cfg,
-		tracker: tracker,
-		sender:  sender,
-		logger:  logger,
+		// The mailbox's headers and subject template take precedence over
+		// the headers of every message.
+		headers := make(map[string]string)
+		for _, h := range []map[string]string{cfg.Gmail.Headers, y.ExtraHeaders} {
+			for name, text := range h {
+				headers[textproto.CanonicalMIMEHeaderKey(name)] = text
+			}
+		}
+		if y.SubjectTemplate != "" {
+			headers["Subject"] = y.SubjectTemplate
+		}
+		for name, text := range headers {
+			t, err := smtpsender.ParseTemplate(name, text)
+			if err != nil {
+				logger.Warn("ignoring invalid header template", "mailbox", y.Email, "header", name, "error", err)
+				continue
+			}
+			if name == "Subject" {
+				subjects[y.Email] = t
+				continue
+			}
+			if extra[y.Email] == nil {
+				extra[y.Email] = make(map[string]*template.Template)
+			}
+			extra[y.Email][name] = t
+		}
+	}
+	sender.SetLabelSuffixes(suffixes)
+	sender.SetSubjectTemplates(subjects)
+	sender.SetRouters(routers)
+	sender.SetExtraHeaders(extra)
+	retry := smtpsender.RetryPolicy{
+		Attempts:   cfg.Gmail.Retry.Attempts,
+		Backoff:    cfg.Gmail.Retry.Backoff,
+		MaxBackoff: cfg.Gmail.Retry.MaxBackoff,
+	}
+	if cfg.Gmail.Retry.Jitter != nil {
+		retry.Jitter = *cfg.Gmail.Retry.Jitter
+	}
+	sender.SetRetryPolicy(retry)
+	sender.SetTimeouts(cfg.DialTimeout, cfg.CommandTimeout)
+
+	tlsConfig, err := cfg.TLS.ClientConfig()
+	if err != nil {
+		// Validation rules this out; trust no server rather than fall
+		// back to the system roots.
+		logger.Error("TLS settings unusable, no server certificate will be trusted", "error", err)
+		tlsConfig = &tls.Config{MinVersion: tls.VersionTLS12, RootCAs: x509.NewCertPool()}
+	}
+	if cfg.TLS.InsecureSkipVerify {
+		logger.Warn("tls.insecure_skip_verify is set: server certificates are not verified, and passwords and messages can be intercepted")
+	}
+	sender.SetTLSConfig(config.PinnedTLS(tlsConfig, cfg.Gmail.TLSPins))
+	limiter := smtpsender.NewLimiter(cfg.MaxSendConcurrency)
+	limiter.SetLimit(cfg.Gmail.Email, cfg.Gmail.MaxConcurrency)
+
+	w := &Worker{
+		cfg:       cfg,
+		tracker:   tracker,
+		sender:    sender,
+		tokens:    tokens,
+		limiter:   limiter,
+		logger:    logger,
+		tlsConfig: tlsConfig,
+		clock:     clock.System,
+		pop3Retry: smtpsender.RetryPolicy{
+			Attempts:   cfg.POP3Retry.Attempts,
+			Backoff:    cfg.POP3Retry.Backoff,
+			MaxBackoff: cfg.POP3Retry.MaxBackoff,
+		},
+	}
+	if cfg.POP3Retry.Jitter != nil {
+		w.pop3Retry.Jitter = *cfg.POP3Retry.Jitter
+	}
+	if r := cfg.RateLimit; r.MessagesPerMinute > 0 || r.BytesPerMinute > 0 {
+		w.rate = smtpsender.NewRate(r.MessagesPerMinute, r.BytesPerMinute)
+	}
+	w.open = w.openPOP3
+	w.scanGmail = w.gmailMessageIDs
+	if tracker != nil {
+		sender.SetThreadMemory(threadMemory{w})
+	}
+	if cfg.ArchiveDir != "" {
+		w.archives = append(w.archives, archive.Dir(cfg.ArchiveDir))
+	}
+	if s3 := cfg.ArchiveS3; s3.Bucket != "" {
+		store := &archive.S3{
+			Endpoint:             s3.Endpoint,
+			Region:               s3.Region,
+			Bucket:               s3.Bucket,
+			Prefix:               s3.Prefix,
+			AccessKeyID:          s3.AccessKeyID,
+			SecretAccessKey:      s3.SecretAccessKey,
+			PathStyle:            s3.PathStyle,
+			ServerSideEncryption: s3.ServerSideEncryption,
+			KMSKeyID:             s3.KMSKeyID,
+			Attempts:             s3.Retry.Attempts,
+			Backoff:              s3.Retry.Backoff,
+			MaxBackoff:           s3.Retry.MaxBackoff,
+		}
+		if s3.Retry.Jitter != nil {
+			store.Jitter = *s3.Retry.Jitter
+		}
+		w.archives = append(w.archives, store)
+	}
+	if cfg.Gmail.Email != "" {
+		w.destinations = append(w.destinations, destination{gmailDestination{w}, true})
+	}
+	if cfg.Maildir.Dir != "" {
+		required := cfg.Maildir.Required || cfg.Gmail.Email == ""
+		w.destinations = append(w.destinations, destination{maildirDestination{cfg.Maildir.Dir}, required})
 	}
+	if cfg.Mbox.Dir != "" {
+		required := cfg.Mbox.Required || cfg.Gmail.Email == ""
+		w.destinations = append(w.destinations, destination{mboxDestination{cfg.Mbox.Dir}, required})
+	}
+	for _, opt := range opts {
+		opt(w)
+	}
+	if cfg.Proxy != "" {
+		d, err := w.proxied(cfg.Proxy)
+		if err != nil {
+			d = failedDialer{err}
+		}
+		sender.SetDialer(d)
+	}
+	return w
 }
 
 // Run executes one full cycle: fetch from all Yahoo mailboxes and forward to Gmail.
 func (w *Worker) Run() error {
-	w.logger.Info("starting fetch cycle", "mailboxes", len(w.cfg.Yahoo))
+	_, errors, err := w.run(w.cfg.Yahoo)
+	if err != nil {
+		return err
+	}
+	if errors > 0 {
+		return fmt.Errorf("completed with %d errors", errors)
+	}
+	return nil
+}
 
-	var totalFetched, totalErrors int
+// run executes one cycle over mailboxes and returns the number of messages
+// forwarded and of errors, or an error if the cycle could not start or, once
+// it completed, the invariant violations it found.
+func (w *Worker) run(mailboxes []config.YahooMailbox) (fetched, errors int, err error) {
+	// Deliveries share SMTP connections for the run.
+	defer w.closeSMTP()
+	w.reportCorrupted(w.logger)
+	now := w.clock.Now()
+	w.clockSuspect = false
+	if hw := w.tracker.ClockHighWater(); now.Before(hw.Add(-clockSkewTolerance)) {
+		// Typical after booting a host without an RTC, before NTP syncs.
+		w.clockSuspect = true
+		w.logger.Warn("wall clock is behind the last state update, not recording retention timestamps this run",
+			"now", now.Format(time.RFC3339), "state_updated", hw.Format(time.RFC3339), "behind", hw.Sub(now).Round(time.Second).String())
+	}
 
-	for i, yahoo := range w.cfg.Yahoo {
-		fetched, errors := w.processMailbox(i, yahoo)
-		totalFetched += fetched
-		totalErrors += errors
+	// Honour throttling left over from an earlier run, unless the clock
+	// was set back so far that the deferral cannot be genuine.
+	dest := w.cfg.Gmail.Email
+	prev, ok := w.tracker.Destination(dest)
+	if ok && now.Before(prev.DeferredUntil) {
+		if prev.DeferredUntil.Sub(now) <= maxThrottleCooldown {
+			w.logger.Warn("destination deferred after throttling, skipping run",
+				"destination", dest, "until", prev.DeferredUntil.Format(time.RFC3339))
+			return 0, 0, nil
+		}
+		w.logger.Warn("ignoring implausible throttle deferral, clock may have been set back",
+			"destination", dest, "until", prev.DeferredUntil.Format(time.RFC3339), "now", now.Format(time.RFC3339))
 	}
 
+	if w.capReached(now) {
+		w.logger.Warn("monthly transfer cap reached, skipping run",
+			"monthly_transfer_cap", w.cfg.MonthlyTransferCap, "used", w.monthTransfer(now))
+		return 0, 0, nil
+	}
+	// Nothing is delivered before Gmail's own messages are known, or
+	// they would be delivered again.
+	if err := w.seedGmail(); err != nil {
+		return 0, 0, err
+	}
+	if ok {
+		w.limiter.Restore(dest, prev.Concurrency, prev.Delay)
+		w.logger.Info("resuming after throttling",
+			"destination", dest, "concurrency", w.limiter.Limit(dest), "delay", w.limiter.Delay(dest).String())
+	}
+	w.throttledLast.Store(false)
+	w.cooldown.reset()
+	w.runLeft.Store(int64(w.cfg.MaxMessagesPerRun))
+
+	if w.cfg.ReceiptsPath != "" {
+		receipts, err := receipt.Open(w.cfg.ReceiptsPath)
+		if err != nil {
+			return 0, 0, err
+		}
+		w.receipts = receipts
+		defer func() {
+			if err := receipts.Close(); err != nil {
+				w.logger.Error("closing receipts file failed", "error", err)
+			}
+			w.receipts = nil
+		}()
+	}
+
+	if w.cfg.InvariantJournal != "" {
+		var receipts []string
+		if w.cfg.ReceiptsPath != "" {
+			receipts = append(receipts, w.cfg.ReceiptsPath)
+		}
+		checker, err := invariant.Open(w.cfg.InvariantJournal, receipts...)
+		if err != nil {
+			return 0, 0, err
+		}
+		w.invariants = checker
+		defer func() {
+			if cerr := checker.Close(); cerr != nil {
+				w.logger.Error("closing invariant journal failed", "error", cerr)
+			}
+			w.invariants = nil
+		}()
+	}
+
+	if w.rules, err = compileRules(w.cfg.Rules); err != nil {
+		return 0, 0, err
+	}
+	if w.filters, err = openFilters(w.cfg.Filters); err != nil {
+		return 0, 0, err
+	}
+
+	w.logger.Info("starting fetch cycle", "mailboxes", len(mailboxes))
+
+	var (
+		mu                        sync.Mutex
+		totalFetched, totalErrors int
+		wg                        sync.WaitGroup
+	)
+	sem := make(chan struct{}, max(w.cfg.MailboxConcurrency, 1))
+	for i, yahoo := range mailboxes {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, yahoo config.YahooMailbox) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			fetched, errors := w.processMailbox(i, yahoo)
+			if err := w.tracker.AddRun(yahoo.Email, w.clock.Now(), fetched, errors); err != nil {
+				w.logger.Error("state update failed", "mailbox", yahoo.Email, "error", err)
+				errors++
+			}
+			if err := w.tracker.Flush(); err != nil {
+				w.logger.Error("saving state failed", "mailbox", yahoo.Email, "error", err)
+				errors++
+			}
+			mu.Lock()
+			totalFetched += fetched
+			totalErrors += errors
+			mu.Unlock()
+		}(i, yahoo)
+	}
+	wg.Wait()
+
 	w.logger.Info("fetch cycle complete",
 		"total_fetched", totalFetched,
 		"total_errors", totalErrors,
 	)
+	if err := w.saveDestinationState(dest, prev); err != nil {
+		w.logger.Error("saving throttle state failed", "destination", dest, "error", err)
+		totalErrors++
+	}
+	if err := w.tracker.Flush(); err != nil {
+		w.logger.Error("saving state failed", "error", err)
+		totalErrors++
+	}
 
 	// Log state stats.
 	for mailbox, count := range w.tracker.Stats() {
 		w.logger.Debug("state", "mailbox", mailbox, "tracked_uids", count)
 	}
+	for _, yahoo := range mailboxes {
+		day, month := w.tracker.Transfer(yahoo.Email, w.clock.Now())
+		w.logger.Debug("transfer", "mailbox", yahoo.Email,
+			"today_downloaded", day.Downloaded, "today_uploaded", day.Uploaded,
+			"month_downloaded", month.Downloaded, "month_uploaded", month.Uploaded)
+	}
 
-	if totalErrors > 0 {
-		return fmt.Errorf("completed with %d errors", totalErrors)
+	return totalFetched, totalErrors, w.violations()
+}
+
+// violations returns the invariant violations found by the current run,
+// joined, or nil if there are none or invariants are not checked.
+func (w *Worker) violations() error {
+	if w.invariants == nil {
+		return nil
 	}
-	return nil
+	var errs []error
+	for _, v := range w.invariants.Violations() {
+		errs = append(errs, v)
+	}
+	return errors.Join(errs...)
 }
 
 // processMailbox fetches and forwards emails from a single Yahoo mailbox.
+//
+// Messages flow through a pipeline: one goroutine per POP3 session
+// retrieves messages into a queue of PipelineDepth, and SendConcurrency
+// goroutines forward them, update state, and mark them for deletion on the
+// session they came from.
 func (w *Worker) processMailbox(index int, yahoo config.YahooMailbox) (fetched, errors int) {
 	log := w.logger.With("mailbox", yahoo.Email, "index", index)
+	if yahoo.Hold {
+		log = log.With("hold", true)
+	}
 	log.Info("processing mailbox")
 
-	// Connect to POP3 server.
-	client, err := pop3.Dial(yahoo.POP3Host, yahoo.POP3Port, 30*time.Second)
+	// Once the mailbox deadline passes, no further message is retrieved,
+	// and those under way are given up.
+	ctx, cancel := withTimeout(context.Background(), w.cfg.MailboxDeadline)
+	defer cancel()
+
+	// Without its state, messages forwarded before would look new.
+	if err := w.tracker.Load(yahoo.Email); err != nil {
+		w.stateError(log, err)
+		return 0, 1
+	}
+	w.reportCorrupted(log)
+
+	// The first session decides whether the mailbox can be processed at all.
+	first, err := w.openFirstSession(log, yahoo)
 	if err != nil {
-		log.Error("failed to connect", "error", err)
+		log.Error("failed to open session", "error", err)
 		return 0, 1
 	}
+	sessions := []*session{first}
+	for i := 1; i < max(yahoo.FetchConcurrency, 1); i++ {
+		sess, err := w.openSession(yahoo)
+		if err != nil {
+			log.Warn("additional POP3 session unavailable", "session", i, "error", err)
+			break
+		}
+		sessions = append(sessions, sess)
+	}
 	defer func() {
-		if err := client.Quit(); err != nil {
-			log.Warn("quit failed", "error", err)
+		for _, sess := range sessions {
+			if err := sess.close(log); err != nil {
+				log.Warn("closing session failed", "error", err)
+			}
 		}
 	}()
 
-	// Login.
-	if err := client.Login(yahoo.Email, yahoo.AppPassword); err != nil {
-		log.Error("login failed", "error", err)
-		return 0, 1
+	log.Info("found messages", "total", len(first.uids), "sessions", len(sessions))
+
+	// Without sizes, oversized messages cannot be told apart, so nothing
+	// is forwarded.
+	var sizes map[string]int64
+	if w.cfg.MaxMessageSize > 0 {
+		if sizes, err = first.sizes(); err != nil {
+			log.Error("failed to list message sizes", "error", err)
+			return 0, 1
+		}
 	}
 
-	log.Debug("logged in successfully")
+	var t tally
+	now := w.clock.Now()
 
-	// Get UID list.
-	uidMap, err := client.UIDList()
-	if err != nil {
-		log.Error("UIDL failed", "error", err)
-		return 0, 1
+	// A differentially synced mailbox only has the messages after its
+	// checkpoint examined, between reconciliations.
+	uids, from := first.uids, 0
+	if yahoo.Sync == "differential" {
+		from = w.syncFrom(log, yahoo, first.uids, now)
+		uids = first.uids[from:]
 	}
 
-	log.Info("found messages", "total", len(uidMap))
-
-	// Sort message numbers for deterministic processing.
-	msgNums := make([]int, 0, len(uidMap))
-	for num := range uidMap {
-		msgNums = append(msgNums, num)
+	// Retention is counted from when a message was first listed. With a
+	// suspect clock, nothing is recorded: a timestamp from a clock that is
+	// far behind would make messages look old, and get them deleted early,
+	// once it is corrected.
+	if yahoo.DeletesAfterForward() && yahoo.RetainDays > 0 && !w.clockSuspect {
+		if err := w.tracker.MarkSeen(yahoo.Email, uids, now); err != nil {
+			log.Error("state update failed", "error", err)
+			t.addError()
+		}
 	}
-	sort.Ints(msgNums)
 
-	// Process each message.
-	for _, msgNum := range msgNums {
-		uid := uidMap[msgNum]
+	if !w.clockSuspect {
+		w.checkStale(log, yahoo, uids, now, &t)
+	}
 
-		// Skip already-fetched messages.
-		if w.tracker.IsFetched(yahoo.Email, uid) {
-			log.Debug("skipping already-fetched message", "msg_num", msgNum, "uid", uid)
+	// Assign pending messages to sessions round-robin, in message order.
+	// Already-fetched messages are still on the server if an earlier
+	// session ended before QUIT committed the deletion, or by design while
+	// they are retained; once neither applies, the DELE is issued on the
+	// first session.
+	work := make([][]string, len(sessions))
+	next, queued, capped := 0, 0, 0
+	dated := make(map[string]time.Time)
+	// While a plan is applied, only the messages it has the same action
+	// for are handled.
+	for _, uid := range uids {
+		action := w.decide(yahoo, uid, sizes, now)
+		if action == ActionForward || action == ActionForwardKeep {
+			// Once the run is full, the message is left for a later
+			// run whatever its date, so its header is not read.
+			if w.runFull(yahoo, queued) {
+				if _, ok := w.plan[yahoo.Email][uid]; w.plan == nil || ok {
+					capped++
+				}
+				continue
+			}
+			out, n, err := w.outOfRange(first, yahoo, uid, dated)
+			w.addTransfer(log, yahoo, n, 0, &t)
+			if err != nil {
+				log.Error("retrieving header failed", "uid", uid, "error", err)
+				t.addError()
+				continue
+			}
+			if out {
+				action = ActionOutOfRange
+			}
+		}
+		if w.plan != nil && !w.planned(log, yahoo, uid, action) {
 			continue
 		}
+		switch action {
+		case ActionQuarantined:
+			log.Debug("skipping quarantined message", "uid", uid)
+			continue
+		case ActionKeep:
+			log.Debug("skipping already-fetched message", "uid", uid)
+			continue
+		case ActionOutOfRange:
+			log.Debug("skipping message dated outside since and before", "uid", uid)
+			continue
+		case ActionDelete:
+			log.Debug("skipping already-fetched message", "uid", uid)
+			if err := w.delete(first, yahoo, uid); err != nil {
+				log.Error("delete failed", "uid", uid, "error", err)
+				t.addError()
+			}
+			continue
+		case ActionSkip:
+			if w.tracker.IsSkipped(yahoo.Email, uid) {
+				log.Debug("skipping oversized message", "uid", uid, "size", sizes[uid])
+			} else {
+				w.skip(log, first, yahoo, uid, sizes[uid], &t)
+			}
+			continue
+		}
+		if !w.takeRunSlot(yahoo, queued) {
+			capped++
+			continue
+		}
+		queued++
+		for {
+			sess := next % len(sessions)
+			next++
+			if sessions[sess].has[uid] {
+				work[sess] = append(work[sess], uid)
+				break
+			}
+		}
+	}
+
+	// The dates of messages left for their date spare later runs reading
+	// their headers again.
+	if err := w.tracker.RecordDates(yahoo.Email, dated, first.uids); err != nil {
+		log.Error("state update failed", "error", err)
+		t.addError()
+	}
+	if capped > 0 {
+		log.Info("message cap reached, leaving messages for later runs",
+			"queued", queued, "left", capped, "max_messages_per_run", w.runCap(yahoo))
+	}
+	if w.plan != nil {
+		w.checkPlanGone(log, yahoo, first)
+	}
+
+	jobs := make(chan job, max(yahoo.PipelineDepth, 1))
+
+	var fetchers sync.WaitGroup
+	for i, sess := range sessions {
+		fetchers.Add(1)
+		go func(sess *session, uids []string) {
+			defer fetchers.Done()
+			// Only speed is lost if the messages cannot be requested ahead.
+			if err := sess.prefetch(uids); err != nil {
+				log.Warn("requesting messages ahead failed", "error", err)
+			}
+			for _, uid := range uids {
+				if w.capReached(w.clock.Now()) {
+					log.Warn("monthly transfer cap reached, leaving remaining messages for next month",
+						"monthly_transfer_cap", w.cfg.MonthlyTransferCap)
+					return
+				}
+				if ctx.Err() != nil {
+					log.Warn("mailbox deadline reached, leaving remaining messages for the next run",
+						"mailbox_deadline", w.cfg.MailboxDeadline.String())
+					return
+				}
+				id := ulid.Make().String()
+				log.Info("fetching message", "uid", uid, "yatogm_id", id)
+
+				mctx, mcancel := withTimeout(ctx, w.cfg.MessageDeadline)
+				msg, err := sess.retrieve(mctx, uid)
+				if err != nil {
+					log.Error("retrieve failed", "uid", uid, "yatogm_id", id, "error", err)
+					t.addError()
+					mcancel()
+					// A message the server refuses, such as with -ERR,
+					// leaves the session in step, and the next is retrieved.
+					// A timeout or a broken connection ends the session.
+					switch {
+					case !sessionLost(err):
+						continue
+					case timedOut(err) && ctx.Err() == nil:
+						log.Warn("message deadline reached, leaving the session's remaining messages for the next run",
+							"uid", uid, "message_deadline", w.cfg.MessageDeadline.String())
+					default:
+						log.Warn("session lost, leaving its remaining messages for the next run", "uid", uid)
+					}
+					return
+				}
+				jobs <- job{ctx: mctx, cancel: mcancel, sess: sess, uid: uid, id: id, msg: msg, fetchedAt: w.clock.Now()}
+			}
+		}(sess, work[i])
+	}
+
+	var senders sync.WaitGroup
+	for i := 0; i < max(yahoo.SendConcurrency, 1); i++ {
+		senders.Add(1)
+		go func() {
+			defer senders.Done()
+			for j := range jobs {
+				w.forward(log, yahoo, j, &t)
+			}
+		}()
+	}
 
-		log.Info("fetching message", "msg_num", msgNum, "uid", uid)
+	fetchers.Wait()
+	close(jobs)
+	senders.Wait()
 
-		// Retrieve the message.
-		rawMsg, err := client.Retrieve(msgNum)
+	if yahoo.Sync == "differential" {
+		w.advanceCheckpoint(log, yahoo, sessions, first.uids, from, w.clock.Now(), &t)
+	}
+
+	// Only UIDs the server no longer lists are pruned, so nothing pruned
+	// can be forwarded again. A suspect clock could make UIDs look old.
+	if w.cfg.StateRetention > 0 && !yahoo.Hold && !w.clockSuspect {
+		retention := time.Duration(w.cfg.StateRetention) * 24 * time.Hour
+		if n, err := w.tracker.Prune(yahoo.Email, retention, first.uids...); err != nil {
+			log.Error("state update failed", "error", err)
+			t.addError()
+		} else if n > 0 {
+			log.Info("pruned old UIDs from state", "pruned", n, "state_retention_days", w.cfg.StateRetention)
+		}
+	}
+
+	fetched, errors = t.counts()
+	log.Info("mailbox processing complete", "fetched", fetched, "errors", errors)
+	return fetched, errors
+}
+
+// timedOut reports whether err is that of an operation given up for a
+// context deadline.
+func timedOut(err error) bool {
+	return errors.Is(err, context.DeadlineExceeded)
+}
+
+// takeRunSlot reports whether another message may be retrieved from yahoo
+// in this run, after queued already were, and if so counts it against the
+// global max_messages_per_run.
+func (w *Worker) takeRunSlot(yahoo config.YahooMailbox, queued int) bool {
+	if yahoo.MaxMessagesPerRun > 0 && queued >= yahoo.MaxMessagesPerRun {
+		return false
+	}
+	return w.cfg.MaxMessagesPerRun <= 0 || w.runLeft.Add(-1) >= 0
+}
+
+// runFull reports whether the current run has already retrieved as many
+// messages from yahoo as max_messages_per_run allows, without taking a slot.
+func (w *Worker) runFull(yahoo config.YahooMailbox, queued int) bool {
+	if yahoo.MaxMessagesPerRun > 0 && queued >= yahoo.MaxMessagesPerRun {
+		return true
+	}
+	return w.cfg.MaxMessagesPerRun > 0 && w.runLeft.Load() <= 0
+}
+
+// runCap returns the cap on the messages retrieved from yahoo in a run, for
+// logging: its own, or the global one.
+func (w *Worker) runCap(yahoo config.YahooMailbox) int {
+	if yahoo.MaxMessagesPerRun > 0 {
+		return yahoo.MaxMessagesPerRun
+	}
+	return w.cfg.MaxMessagesPerRun
+}
+
+// forward sends a retrieved message to Gmail, records it in state, and
+// marks it for deletion on its session unless it is retained.
+func (w *Worker) forward(log *slog.Logger, yahoo config.YahooMailbox, j job, t *tally) {
+	log = log.With("yatogm_id", j.id)
+	defer j.msg.Close()
+	defer j.done()
+
+	// Keep a copy in every archive before any delivery is attempted.
+	// Without one, the message is left on the server for the next run.
+	key := archive.Key(yahoo.Email, j.uid, j.fetchedAt)
+	for _, store := range w.archives {
+		location, err := store.Put(key, j.msg, j.msg.Size())
 		if err != nil {
-			log.Error("retrieve failed", "msg_num", msgNum, "uid", uid, "error", err)
-			errors++
-			continue
+			log.Error("archiving failed, not forwarding", "uid", j.uid, "error", err)
+			t.addError()
+			w.addTransfer(log, yahoo, j.msg.Size(), 0, t)
+			return
 		}
+		log.Debug("message archived", "uid", j.uid, "location", location)
+	}
 
-		// Forward to Gmail.
-		if err := w.sender.Send(rawMsg, yahoo.Email); err != nil {
-			log.Error("forward failed", "msg_num", msgNum, "uid", uid, "error", err)
-			errors++
-			continue
+	// Messages from senders with a bad reputation are only archived.
+	destinations := w.destinations
+	from, isSpam := "", false
+	if w.cfg.SenderReputation.Enabled {
+		from, isSpam = sender(j.msg, j.msg.Size())
+	}
+	archivedOnly := false
+	if reason := w.archivesOnly(yahoo, from); reason != "" {
+		log = log.With("archived_only", reason)
+		destinations, archivedOnly = nil, true
+	}
+
+	// The first rule that matches may have the message archived only.
+	if !archivedOnly && len(w.rules) > 0 {
+		if r, ok := w.rules.Match(yahoo.Email, j.msg, j.msg.Size()); ok {
+			log.Debug("rule matched", "rule", r.Name, "action", r.Action, "uid", j.uid)
+			if r.Action == rules.Archive {
+				log = log.With("archived_only", "rule "+r.Name)
+				destinations, archivedOnly = nil, true
+			}
+		}
+	}
+
+	// Filters may have the message archived only, or rewrite what is
+	// delivered. If one fails, the message is left on the server.
+	msg, size := io.ReaderAt(j.msg), j.msg.Size()
+	if !archivedOnly && len(w.filters) > 0 {
+		verdict, out, by, err := w.filter(yahoo, j)
+		if err != nil {
+			log.Error("filter failed, not forwarding", "filter", by, "uid", j.uid, "error", err)
+			t.addError()
+			w.addTransfer(log, yahoo, j.msg.Size(), 0, t)
+			return
+		}
+		switch {
+		case verdict == filter.Archive:
+			log = log.With("archived_only", "filter "+by)
+			destinations, archivedOnly = nil, true
+		case out != nil:
+			msg, size = bytes.NewReader(out), int64(len(out))
 		}
+	}
+
+	// A message past its deadline is left on the server.
+	if err := context.Cause(j.context()); err != nil {
+		log.Error("deadline reached, not forwarding", "uid", j.uid, "error", err)
+		t.addError()
+		w.addTransfer(log, yahoo, j.msg.Size(), 0, t)
+		return
+	}
 
-		// Mark as fetched.
-		if err := w.tracker.MarkFetched(yahoo.Email, uid); err != nil {
-			log.Error("state update failed", "msg_num", msgNum, "uid", uid, "error", err)
-			errors++
+	// Deliver to every destination the message has not reached on an
+	// earlier attempt.
+	var uploaded int64
+	complete := true
+	for _, d := range destinations {
+		name := d.Name()
+		if len(w.destinations) > 1 && w.tracker.IsDelivered(yahoo.Email, j.uid, name) {
+			continue
+		}
+		if w.alreadyInGmail(d, j) {
+			log.Info("message already in Gmail, not delivered again", "destination", name, "uid", j.uid)
 			continue
 		}
+		reply, err := d.Deliver(j.context(), msg, size, yahoo.Email, j.id)
+		if err != nil {
+			log.Error("forward failed", "destination", name, "uid", j.uid, "error", err)
+			t.addError()
+			if d.required {
+				complete = false
+				if smtpsender.IsRejected(err) {
+					w.recordRejection(log, yahoo, j, err, t)
+				}
+			}
+			continue
+		}
+		// Only deliveries to Gmail leave the host.
+		if _, ok := d.Destination.(gmailDestination); ok {
+			uploaded += size
+		}
+		w.writeReceipt(log, yahoo, j, name, reply, t)
+		w.checkDelivered(log, yahoo, j, name, t)
+		if len(w.destinations) > 1 {
+			if err := w.tracker.MarkDelivered(yahoo.Email, j.uid, name); err != nil {
+				log.Error("state update failed", "destination", name, "uid", j.uid, "error", err)
+				t.addError()
+			}
+		}
+	}
+	w.addTransfer(log, yahoo, j.msg.Size(), uploaded, t)
+	if !complete {
+		return
+	}
 
-		// Delete from Yahoo server (actual removal happens on QUIT).
-		if err := client.Delete(msgNum); err != nil {
-			log.Error("delete failed", "msg_num", msgNum, "uid", uid, "error", err)
-			errors++
+	if !archivedOnly {
+		if w.cfg.PDFArchive.Dir != "" {
+			w.archivePDF(log, yahoo, j, t)
+		}
+		w.recordLatency(log, yahoo, j, t)
+	}
+
+	// Mark as fetched.
+	if err := w.tracker.MarkFetched(yahoo.Email, j.uid); err != nil {
+		log.Error("state update failed", "uid", j.uid, "error", err)
+		t.addError()
+		return
+	}
+	w.recordSender(log, yahoo, j, from, isSpam, t)
+	// With a state write delay, the message must be saved as fetched
+	// before it is deleted.
+	if err := w.tracker.Flush(); err != nil {
+		log.Error("saving state failed", "uid", j.uid, "error", err)
+		t.addError()
+		return
+	}
+
+	if w.retained(yahoo, j.uid, w.clock.Now()) {
+		t.addFetched()
+		log.Info("message forwarded, kept on server", "uid", j.uid)
+		return
+	}
+
+	// Delete from Yahoo server (actual removal happens on QUIT).
+	if err := w.delete(j.sess, yahoo, j.uid); err != nil {
+		log.Error("delete failed", "uid", j.uid, "error", err)
+		t.addError()
+		return
+	}
+
+	t.addFetched()
+	log.Info("message forwarded and deleted", "uid", j.uid)
+}
+
+// withTimeout returns ctx bounded by d from now, or just cancelable if d
+// is zero.
+func withTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if d <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, d)
+}
+
+// filter applies the filters to a message, failing if they would have it
+// archived only while there is no archive.
+func (w *Worker) filter(yahoo config.YahooMailbox, j job) (v filter.Verdict, out []byte, by string, err error) {
+	raw, err := io.ReadAll(io.NewSectionReader(j.msg, 0, j.msg.Size()))
+	if err != nil {
+		return "", nil, "", err
+	}
+	v, out, by, err = w.filters.Apply(yahoo.Email, raw)
+	if err == nil && v == filter.Archive && len(w.archives) == 0 {
+		err = errors.New("archives the message, but no archive is configured")
+	}
+	return v, out, by, err
+}
+
+// compileRules compiles the configured rules.
+func compileRules(cfgs []config.RuleConfig) (rules.Set, error) {
+	var set rules.Set
+	for _, c := range cfgs {
+		r, err := rules.New(c.Name, c.If, rules.Action(c.Action))
+		if err != nil {
+			return nil, fmt.Errorf("rule %s: %w", c.Name, err)
+		}
+		set = append(set, r)
+	}
+	return set, nil
+}
+
+// openFilters loads the configured filters.
+func openFilters(cfgs []config.FilterConfig) (filter.Chain, error) {
+	var chain filter.Chain
+	for _, c := range cfgs {
+		if c.Plugin == "" {
+			chain = append(chain, filter.Named{Name: c.Name, Filter: filter.Command{Args: c.Command, Timeout: c.Timeout}})
 			continue
 		}
+		f, err := filter.OpenPlugin(c.Plugin)
+		if err != nil {
+			return nil, fmt.Errorf("loading filter %s: %w", c.Name, err)
+		}
+		chain = append(chain, filter.Named{Name: c.Name, Filter: f})
+	}
+	return chain, nil
+}
+
+// writeReceipt appends a receipt for a delivery to dest, if receipts are
+// enabled. A failure is counted but, as the message was delivered, does not
+// stop it from being recorded, so that it is not sent twice.
+func (w *Worker) writeReceipt(log *slog.Logger, yahoo config.YahooMailbox, j job, dest, reply string, t *tally) {
+	if w.receipts == nil {
+		return
+	}
+	rec := receipt.Record{
+		ID:           j.id,
+		Source:       yahoo.Email,
+		UID:          j.uid,
+		Destination:  dest,
+		SMTPResponse: reply,
+		FetchedAt:    j.fetchedAt,
+		DeliveredAt:  w.clock.Now(),
+	}
+	if msg, err := mail.ReadMessage(io.NewSectionReader(j.msg, 0, j.msg.Size())); err == nil {
+		rec.MessageID = msg.Header.Get("Message-Id")
+		if from, err := mail.ParseAddress(msg.Header.Get("From")); err == nil {
+			rec.From = strings.ToLower(from.Address)
+		}
+		rec.ListID = strings.TrimSpace(msg.Header.Get("List-Id"))
+	}
+	if err := w.receipts.Write(rec); err != nil {
+		log.Error("receipt write failed", "destination", dest, "uid", j.uid, "error", err)
+		t.addError()
+	}
+}
 
-		fetched++
-		log.Info("message forwarded and deleted", "msg_num", msgNum, "uid", uid)
+// checkDelivered records a delivery to dest with the invariant checker, if
+// invariants are checked, counting a message delivered there before as an
+// error. The message is still recorded, so that it is not sent again.
+func (w *Worker) checkDelivered(log *slog.Logger, yahoo config.YahooMailbox, j job, dest string, t *tally) {
+	if w.invariants == nil {
+		return
 	}
+	if err := w.invariants.Delivered(yahoo.Email, j.uid, dest, j.id); err != nil {
+		log.Error("invariant check failed", "destination", dest, "uid", j.uid, "error", err)
+		t.addError()
+	}
+}
 
-	log.Info("mailbox processing complete", "fetched", fetched, "errors", errors)
-	return fetched, errors
+// delete marks uid for deletion on sess. If invariants are checked, a
+// message not recorded as fetched is left on the server instead.
+func (w *Worker) delete(sess *session, yahoo config.YahooMailbox, uid string) error {
+	if w.invariants != nil {
+		if err := w.invariants.Deleting(yahoo.Email, uid, w.tracker.IsFetched(yahoo.Email, uid)); err != nil {
+			return err
+		}
+	}
+	return sess.delete(uid)
+}
+
+// archivePDF renders a delivered message to the PDF archive if its sender
+// matches pdf_archive.senders. A failure is counted but, as the message
+// was delivered, does not stop it from being recorded.
+func (w *Worker) archivePDF(log *slog.Logger, yahoo config.YahooMailbox, j job, t *tally) {
+	msg, err := mail.ReadMessage(io.NewSectionReader(j.msg, 0, j.msg.Size()))
+	if err != nil || !senderMatches(w.cfg.PDFArchive.Senders, msg.Header.Get("From")) {
+		return
+	}
+	dst := filepath.Join(w.cfg.PDFArchive.Dir, yahoo.Email, j.fetchedAt.Format("2006-01"), j.id+".pdf")
+	if err := pdf.WriteFile(dst, io.NewSectionReader(j.msg, 0, j.msg.Size())); err != nil {
+		log.Error("PDF rendering failed", "uid", j.uid, "error", err)
+		t.addError()
+		return
+	}
+	log.Debug("message rendered to PDF", "uid", j.uid, "path", dst)
+}
+
+// recordLatency records how long after the time in its Date header a
+// forwarded message reached its destinations, and logs it if that exceeds
+// latency_slo. Messages without a valid Date are not counted, nor are any
+// while the clock is suspect; a Date in the future counts as no latency.
+func (w *Worker) recordLatency(log *slog.Logger, yahoo config.YahooMailbox, j job, t *tally) {
+	if w.clockSuspect {
+		return
+	}
+	msg, err := mail.ReadMessage(io.NewSectionReader(j.msg, 0, j.msg.Size()))
+	if err != nil {
+		return
+	}
+	date, err := msg.Header.Date()
+	if err != nil {
+		return
+	}
+	now := w.clock.Now()
+	latency := max(now.Sub(date), 0)
+	if w.cfg.LatencySLO > 0 && latency > w.cfg.LatencySLO {
+		log.Warn("message forwarded later than latency_slo",
+			"uid", j.uid, "latency", latency.Round(time.Second).String(), "latency_slo", w.cfg.LatencySLO.String())
+	}
+	if err := w.tracker.RecordLatency(yahoo.Email, now, latency); err != nil {
+		log.Error("state update failed", "uid", j.uid, "error", err)
+		t.addError()
+	}
+}
+
+// senderMatches reports whether the address in a From header matches one
+// of patterns, case-insensitively.
+func senderMatches(patterns []string, from string) bool {
+	addr, err := mail.ParseAddress(from)
+	if err != nil {
+		return false
+	}
+	for _, p := range patterns {
+		if ok, _ := path.Match(strings.ToLower(p), strings.ToLower(addr.Address)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// recordRejection counts a run in which Gmail rejected the message and,
+// once it was rejected in quarantine_after runs, writes it to the
+// quarantine directory so that it is kept but no longer retried. Failures
+// such as outages or bad credentials that are not about the message itself
+// are never counted, so they cannot quarantine a whole mailbox.
+func (w *Worker) recordRejection(log *slog.Logger, yahoo config.YahooMailbox, j job, cause error, t *tally) {
+	if w.cfg.QuarantineDir == "" {
+		return
+	}
+	attempts, err := w.tracker.RecordFailure(yahoo.Email, j.uid)
+	if err != nil {
+		log.Error("state update failed", "uid", j.uid, "error", err)
+		t.addError()
+		return
+	}
+	if attempts < w.cfg.QuarantineAfter {
+		return
+	}
+
+	now := w.clock.Now()
+	path, err := quarantine.Write(w.cfg.QuarantineDir, quarantine.Record{
+		ID:            j.id,
+		Mailbox:       yahoo.Email,
+		UID:           j.uid,
+		Error:         cause.Error(),
+		Attempts:      attempts,
+		Size:          j.msg.Size(),
+		QuarantinedAt: now,
+	}, j.msg, j.msg.Size())
+	if err != nil {
+		// The message is still on the server; the next run tries again.
+		log.Error("quarantine failed", "uid", j.uid, "error", err)
+		t.addError()
+		return
+	}
+	if err := w.tracker.MarkQuarantined(yahoo.Email, j.uid, now); err != nil {
+		log.Error("state update failed", "uid", j.uid, "error", err)
+		t.addError()
+		return
+	}
+	if w.cfg.SenderReputation.Enabled {
+		if from, _ := sender(j.msg, j.msg.Size()); from != "" {
+			if err := w.tracker.RecordSenderQuarantined(yahoo.Email, from, now); err != nil {
+				log.Error("state update failed", "uid", j.uid, "error", err)
+				t.addError()
+			}
+		}
+	}
+	log.Warn("message quarantined after repeated rejections, leaving it on the server",
+		"uid", j.uid, "attempts", attempts, "path", path)
+}
+
+// skip leaves a message larger than max_message_size on the server and
+// records it as skipped, after notifying Gmail about it if enabled. If the
+// notification fails, the message is not recorded, so the next run tries
+// again.
+func (w *Worker) skip(log *slog.Logger, sess *session, yahoo config.YahooMailbox, uid string, size int64, t *tally) {
+	id := ulid.Make().String()
+	log = log.With("uid", uid, "yatogm_id", id)
+	log.Warn("message exceeds max_message_size, leaving it on the server",
+		"size", size, "max_message_size", w.cfg.MaxMessageSize)
+
+	if w.cfg.NotifySkipped {
+		header, n, err := sess.retrieveHeader(uid)
+		w.addTransfer(log, yahoo, n, 0, t)
+		if err != nil {
+			log.Error("retrieving header of skipped message failed", "error", err)
+			t.addError()
+			return
+		}
+		subject, body := skipNotice(yahoo.Email, header, size, w.cfg.MaxMessageSize)
+		release := w.limiter.Acquire(w.cfg.Gmail.Email)
+		_, err = w.sender.Notify(subject, body, id)
+		release()
+		if err != nil {
+			log.Error("skip notification failed", "error", err)
+			t.addError()
+			return
+		}
+	}
+
+	if err := w.tracker.MarkSkipped(yahoo.Email, uid, size); err != nil {
+		log.Error("state update failed", "error", err)
+		t.addError()
+	}
+}
+
+// skipNotice returns the subject and body of the notice about a message of
+// size bytes from mailbox that exceeds limit.
+func skipNotice(mailbox string, header mail.Header, size, limit int64) (subject, body string) {
+	dec := new(mime.WordDecoder)
+	decoded := func(key string) string {
+		v := header.Get(key)
+		if d, err := dec.DecodeHeader(v); err == nil {
+			v = d
+		}
+		if v == "" {
+			return "(none)"
+		}
+		return v
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "A message in %s was not forwarded because it is larger than max_message_size.\n\n", mailbox)
+	fmt.Fprintf(&b, "From:    %s\n", decoded("From"))
+	fmt.Fprintf(&b, "Subject: %s\n", decoded("Subject"))
+	fmt.Fprintf(&b, "Date:    %s\n", decoded("Date"))
+	fmt.Fprintf(&b, "Size:    %d bytes (limit %d)\n\n", size, limit)
+	b.WriteString("It was left on the server. Read it in Yahoo Mail, or raise max_message_size to forward it on the next run.\n")
+	return "[yatogm] Message too large to forward: " + decoded("Subject"), b.String()
+}
+
+// notify sends a notice from yatogm to Gmail, within the account's
+// concurrency bound.
+func (w *Worker) notify(subject, body string) error {
+	release := w.limiter.Acquire(w.cfg.Gmail.Email)
+	defer release()
+	_, err := w.sender.Notify(subject, body, ulid.Make().String())
+	return err
+}
+
+// closeSMTP ends the SMTP connections kept open between deliveries.
+func (w *Worker) closeSMTP() {
+	if err := w.sender.Close(); err != nil {
+		w.logger.Warn("closing SMTP connections failed", "error", err)
+	}
+}
+
+// addTransfer records bytes moved for the mailbox. A delivery counts as an
+// upload of the retrieved message's size, leaving out rewritten headers and
+// protocol overhead; failed deliveries are not counted.
+func (w *Worker) addTransfer(log *slog.Logger, yahoo config.YahooMailbox, downloaded, uploaded int64, t *tally) {
+	if downloaded == 0 && uploaded == 0 {
+		return
+	}
+	if err := w.tracker.AddTransfer(yahoo.Email, w.clock.Now(), downloaded, uploaded); err != nil {
+		log.Error("state update failed", "error", err)
+		t.addError()
+	}
+}
+
+// monthTransfer returns the bytes transferred for all mailboxes in the
+// month of now.
+func (w *Worker) monthTransfer(now time.Time) int64 {
+	var total int64
+	for _, yahoo := range w.cfg.Yahoo {
+		_, month := w.tracker.Transfer(yahoo.Email, now)
+		total += month.Total()
+	}
+	return total
+}
+
+// capReached reports whether the monthly transfer cap, if any, is used up.
+// Messages already being retrieved or forwarded still complete, so the cap
+// can be exceeded by up to that much.
+func (w *Worker) capReached(now time.Time) bool {
+	return w.cfg.MonthlyTransferCap > 0 && w.monthTransfer(now) >= w.cfg.MonthlyTransferCap
+}
+
+// retained reports whether a forwarded message stays on the server for now:
+// either the mailbox keeps messages, or the message was first seen less than
+// retain_days ago. Messages without a first-seen time are kept.
+func (w *Worker) retained(yahoo config.YahooMailbox, uid string, now time.Time) bool {
+	if !yahoo.DeletesAfterForward() {
+		return true
+	}
+	if yahoo.RetainDays <= 0 {
+		return false
+	}
+	seen, ok := w.tracker.FirstSeen(yahoo.Email, uid)
+	return !ok || now.Sub(seen) < time.Duration(yahoo.RetainDays)*24*time.Hour
+}
+
+// saveDestinationState persists the destination's throttling at the end of
+// a run so that the next, possibly cron-spawned, run picks up from it. A run
+// whose last delivery attempt was throttled defers later runs for a cooldown
+// that doubles on each consecutive throttled run; otherwise only a reduced
+// bound or pause is carried over, and a fully recovered destination is
+// forgotten.
+func (w *Worker) saveDestinationState(dest string, prev state.DestinationState) error {
+	limit, delay := w.limiter.Limit(dest), w.limiter.Delay(dest)
+	throttled := w.throttledLast.Load()
+	if !throttled && limit == w.cfg.Gmail.MaxConcurrency && delay == 0 {
+		return w.tracker.ClearDestination(dest)
+	}
+
+	ds := state.DestinationState{Concurrency: limit, Delay: delay}
+	if throttled {
+		ds.Cooldown = min(max(2*prev.Cooldown, throttleCooldown), maxThrottleCooldown)
+		ds.DeferredUntil = w.clock.Now().Add(ds.Cooldown)
+		w.logger.Warn("destination still throttling, deferring later runs",
+			"destination", dest, "until", ds.DeferredUntil.Format(time.RFC3339), "cooldown", ds.Cooldown.String())
+	} else {
+		w.logger.Info("destination still slowed after throttling",
+			"destination", dest, "concurrency", limit, "delay", delay.String())
+	}
+	return w.tracker.SetDestination(dest, ds)
+}
+
+// messageID returns the Message-ID header of a raw message, or "" if the
+// message has none or cannot be parsed. Only the header is read.
+func messageID(raw io.ReaderAt, size int64) string {
+	msg, err := mail.ReadMessage(io.NewSectionReader(raw, 0, size))
+	if err != nil {
+		return ""
+	}
+	return msg.Header.Get("Message-Id")
+}
+
+// openFirstSession opens the first session on a mailbox, retrying as
+// pop3_retry says while it fails to connect.
+func (w *Worker) openFirstSession(log *slog.Logger, yahoo config.YahooMailbox) (*session, error) {
+	attempts := max(w.pop3Retry.Attempts, 1)
+	for attempt := 1; ; attempt++ {
+		sess, err := w.openSession(yahoo)
+		if err == nil || attempt >= attempts || !connectFailed(err) {
+			return sess, err
+		}
+		delay := w.pop3Retry.Delay(attempt)
+		log.Warn("connecting failed, retrying", "attempt", attempt, "attempts", attempts, "delay", delay.String(), "error", err)
+		w.clock.Sleep(delay)
+	}
+}
+
+// connectFailed reports whether opening a session failed on the way to the
+// server, as on a DNS or TCP failure or a dropped connection, rather than
+// being refused by it.
+func connectFailed(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// openSession opens a new session on a mailbox and lists its messages.
+func (w *Worker) openSession(yahoo config.YahooMailbox) (*session, error) {
+	src, err := w.open(yahoo)
+	if err != nil {
+		return nil, err
+	}
+	uids, err := src.ListUIDs()
+	if err != nil {
+		src.Close()
+		return nil, err
+	}
+	has := make(map[string]bool, len(uids))
+	for _, uid := range uids {
+		has[uid] = true
+	}
+	return &session{src: src, uids: uids, has: has, withhold: w.withholdDeletes}, nil
 }
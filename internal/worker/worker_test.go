@@ -1,12 +1,28 @@
 package worker
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
 	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/benj-n/yatogm/internal/clock"
 	"github.com/benj-n/yatogm/internal/config"
+	smtpsender "github.com/benj-n/yatogm/internal/smtp"
 	"github.com/benj-n/yatogm/internal/state"
 )
 
@@ -47,3 +63,924 @@ func TestNewWorker(t *testing.T) {
 		t.Error("expected non-nil sender")
 	}
 }
+
+// unreachableConfig returns a configuration whose POP3 server refuses
+// connections, so any attempt to process the mailbox fails.
+func unreachableConfig(t *testing.T) *config.Config {
+	return &config.Config{
+		Gmail: config.GmailConfig{
+			Email:          "test@gmail.com",
+			AppPassword:    "secret",
+			SMTPHost:       "127.0.0.1",
+			SMTPPort:       1,
+			MaxConcurrency: 4,
+		},
+		Yahoo: []config.YahooMailbox{
+			{
+				Email:       "test@yahoo.com",
+				AppPassword: "yahoo-secret",
+				POP3Host:    "127.0.0.1",
+				POP3Port:    1,
+			},
+		},
+		StatePath: filepath.Join(t.TempDir(), "state.json"),
+	}
+}
+
+func TestRunDeferredAfterThrottling(t *testing.T) {
+	cfg := unreachableConfig(t)
+	tracker, err := state.NewTracker(cfg.StatePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	until := time.Now().Add(time.Hour)
+	if err := tracker.SetDestination(cfg.Gmail.Email, state.DestinationState{DeferredUntil: until, Concurrency: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError}))
+
+	// The run must not touch the mailbox, so the unreachable server does
+	// not produce an error.
+	if err := New(cfg, tracker, logger).Run(); err != nil {
+		t.Fatalf("expected deferred run to be skipped, got %v", err)
+	}
+	ds, ok := tracker.Destination(cfg.Gmail.Email)
+	if !ok || !ds.DeferredUntil.Equal(until) {
+		t.Errorf("expected deferral to be kept, got %+v", ds)
+	}
+}
+
+func TestRunResumesReducedConcurrency(t *testing.T) {
+	cfg := unreachableConfig(t)
+	tracker, err := state.NewTracker(cfg.StatePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := state.DestinationState{
+		DeferredUntil: time.Now().Add(-time.Minute),
+		Cooldown:      throttleCooldown,
+		Concurrency:   1,
+		Delay:         2 * time.Second,
+	}
+	if err := tracker.SetDestination(cfg.Gmail.Email, prev); err != nil {
+		t.Fatal(err)
+	}
+
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError}))
+
+	w := New(cfg, tracker, logger)
+	if err := w.Run(); err == nil {
+		t.Fatal("expected the unreachable mailbox to fail the run")
+	}
+	if got := w.limiter.Limit(cfg.Gmail.Email); got != 1 {
+		t.Errorf("expected concurrency 1 restored, got %d", got)
+	}
+
+	// Nothing was delivered, so the reduced bound carries over without a
+	// new deferral.
+	ds, ok := tracker.Destination(cfg.Gmail.Email)
+	if !ok {
+		t.Fatal("expected destination state to be kept")
+	}
+	if !ds.DeferredUntil.IsZero() || ds.Concurrency != 1 || ds.Delay != 2*time.Second {
+		t.Errorf("unexpected destination state %+v", ds)
+	}
+}
+
+func TestDestinationStateUnbounded(t *testing.T) {
+	cfg := unreachableConfig(t)
+	cfg.Gmail.MaxConcurrency = 0
+	tracker, err := state.NewTracker(cfg.StatePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError}))
+	w := New(cfg, tracker, logger)
+	dest := cfg.Gmail.Email
+
+	// A bound left by throttling carries over until deliveries have
+	// succeeded back up to twice it.
+	w.limiter.Restore(dest, 2, 0)
+	if err := w.saveDestinationState(dest, state.DestinationState{}); err != nil {
+		t.Fatal(err)
+	}
+	if ds, ok := tracker.Destination(dest); !ok || ds.Concurrency != 2 {
+		t.Fatalf("expected the reduced bound to be kept, got %+v, %v", ds, ok)
+	}
+
+	for i := 0; i < 2+3; i++ {
+		w.limiter.Succeeded(dest)
+	}
+	if err := w.saveDestinationState(dest, state.DestinationState{}); err != nil {
+		t.Fatal(err)
+	}
+	if ds, ok := tracker.Destination(dest); ok {
+		t.Errorf("expected a recovered unbounded destination to be forgotten, got %+v", ds)
+	}
+}
+
+func TestMaxMessagesPerRun(t *testing.T) {
+	cfg := unreachableConfig(t)
+	cfg.Gmail = config.GmailConfig{}
+	cfg.MailboxConcurrency = 1
+	cfg.MaxMessagesPerRun = 3
+	cfg.Yahoo = []config.YahooMailbox{
+		{Email: "a@yahoo.com", MaxMessagesPerRun: 2},
+		{Email: "b@yahoo.com"},
+	}
+	tracker, err := state.NewTracker(cfg.StatePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mailboxes := map[string]*fakeMailbox{}
+	for _, y := range cfg.Yahoo {
+		mailboxes[y.Email] = &fakeMailbox{msgs: map[string]string{
+			"uid1": "Subject: 1\r\n\r\nbody\r\n",
+			"uid2": "Subject: 2\r\n\r\nbody\r\n",
+			"uid3": "Subject: 3\r\n\r\nbody\r\n",
+		}}
+	}
+	open := func(y config.YahooMailbox) (Source, error) { return mailboxes[y.Email].open(y) }
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelError}))
+
+	// Each run takes up to two messages from a, its own cap, and what the
+	// global cap leaves from b.
+	for i, want := range [][2]int{{1, 2}, {0, 0}} {
+		w := New(cfg, tracker, logger, WithSource(open), WithDestination(&contentDestination{}, true))
+		if _, errs, err := w.run(cfg.Yahoo); err != nil || errs != 0 {
+			t.Fatalf("run %d: %d errors (%v)", i+1, errs, err)
+		}
+		if a, b := len(mailboxes["a@yahoo.com"].msgs), len(mailboxes["b@yahoo.com"].msgs); a != want[0] || b != want[1] {
+			t.Errorf("run %d: %d and %d messages left, want %d and %d", i+1, a, b, want[0], want[1])
+		}
+	}
+}
+
+func TestRateLimitedDelivery(t *testing.T) {
+	cfg := unreachableConfig(t)
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError}))
+	if w := New(cfg, nil, logger); w.rate != nil {
+		t.Fatal("expected no rate limit unless configured")
+	}
+
+	cfg.RateLimit = config.RateLimitConfig{MessagesPerMinute: 1}
+	w := New(cfg, nil, logger, WithClock(clock.NewFake(time.Now())))
+	if w.rate == nil {
+		t.Fatal("expected rate_limit to pace deliveries")
+	}
+	w.rate.Reserve(1)
+
+	// The next delivery waits its turn, giving up with its context rather
+	// than reaching the SMTP server.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	msg := strings.NewReader("Subject: hi\r\n\r\nbody\r\n")
+	if _, err := (gmailDestination{w}).Deliver(ctx, msg, msg.Size(), "test@yahoo.com", "id"); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the delivery to wait for the rate limit, got %v", err)
+	}
+}
+
+func TestRunIgnoresImplausibleDeferral(t *testing.T) {
+	cfg := unreachableConfig(t)
+	tracker, err := state.NewTracker(cfg.StatePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Further out than any cooldown, as after the clock was set back.
+	until := time.Now().Add(48 * time.Hour)
+	if err := tracker.SetDestination(cfg.Gmail.Email, state.DestinationState{DeferredUntil: until, Concurrency: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError}))
+
+	if err := New(cfg, tracker, logger).Run(); err == nil {
+		t.Fatal("expected the run to proceed and fail on the unreachable mailbox")
+	}
+}
+
+func TestRunClockBehindState(t *testing.T) {
+	cfg := unreachableConfig(t)
+	ahead := time.Now().Add(24 * time.Hour).UTC().Format(time.RFC3339)
+	data := `{"mailboxes": {}, "clock_high_water": "` + ahead + `"}`
+	if err := os.WriteFile(cfg.StatePath, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tracker, err := state.NewTracker(cfg.StatePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError}))
+
+	w := New(cfg, tracker, logger)
+	_ = w.Run()
+	if !w.clockSuspect {
+		t.Error("expected the clock to be flagged as behind the state")
+	}
+}
+
+func TestRetained(t *testing.T) {
+	cfg := unreachableConfig(t)
+	tracker, err := state.NewTracker(cfg.StatePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError}))
+	w := New(cfg, tracker, logger)
+
+	now := time.Now()
+	if err := tracker.MarkSeen("test@yahoo.com", []string{"old"}, now.Add(-8*24*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tracker.MarkSeen("test@yahoo.com", []string{"new"}, now.Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	keep := false
+	tests := []struct {
+		name    string
+		mailbox config.YahooMailbox
+		uid     string
+		want    bool
+	}{
+		{"delete right away", config.YahooMailbox{Email: "test@yahoo.com"}, "new", false},
+		{"kept on server", config.YahooMailbox{Email: "test@yahoo.com", DeleteAfterForward: &keep}, "old", true},
+		{"past retention", config.YahooMailbox{Email: "test@yahoo.com", RetainDays: 7}, "old", false},
+		{"within retention", config.YahooMailbox{Email: "test@yahoo.com", RetainDays: 7}, "new", true},
+		{"never seen", config.YahooMailbox{Email: "test@yahoo.com", RetainDays: 7}, "unknown", true},
+		{"on hold", config.YahooMailbox{Email: "test@yahoo.com", Hold: true}, "old", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := w.retained(tt.mailbox, tt.uid, now); got != tt.want {
+				t.Errorf("retained() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSkipNotice(t *testing.T) {
+	header := mail.Header{
+		"From":    {"Alice <alice@example.com>"},
+		"Subject": {"=?utf-8?q?Vacation_photos_=C3=A9t=C3=A9?="},
+	}
+	subject, body := skipNotice("me@yahoo.com", header, 52428800, 26214400)
+	if subject != "[yatogm] Message too large to forward: Vacation photos été" {
+		t.Errorf("subject = %q", subject)
+	}
+	for _, want := range []string{
+		"me@yahoo.com",
+		"From:    Alice <alice@example.com>",
+		"Subject: Vacation photos été",
+		"Date:    (none)",
+		"Size:    52428800 bytes (limit 26214400)",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("body lacks %q:\n%s", want, body)
+		}
+	}
+}
+
+func TestRunSkippedAtTransferCap(t *testing.T) {
+	cfg := unreachableConfig(t)
+	cfg.MonthlyTransferCap = 1000
+	tracker, err := state.NewTracker(cfg.StatePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tracker.AddTransfer("test@yahoo.com", time.Now(), 600, 400); err != nil {
+		t.Fatal(err)
+	}
+
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError}))
+
+	// The cap is used up, so the unreachable mailbox is never contacted.
+	if err := New(cfg, tracker, logger).Run(); err != nil {
+		t.Fatalf("expected run to be skipped at the cap, got %v", err)
+	}
+
+	cfg.MonthlyTransferCap = 2000
+	if err := New(cfg, tracker, logger).Run(); err == nil {
+		t.Fatal("expected run to proceed below the cap")
+	}
+}
+
+func TestRecordRejectionQuarantines(t *testing.T) {
+	cfg := unreachableConfig(t)
+	cfg.QuarantineDir = filepath.Join(t.TempDir(), "quarantine")
+	cfg.QuarantineAfter = 2
+	tracker, err := state.NewTracker(cfg.StatePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError}))
+	w := New(cfg, tracker, logger)
+
+	raw := "From: a@example.com\r\nSubject: hi\r\n\r\nbody\r\n"
+	rejected := &smtpsender.RejectedError{Err: errors.New("552 5.3.4 too big")}
+	for run := 1; run <= 2; run++ {
+		sp := &spool{}
+		sp.Write([]byte(raw))
+		j := job{uid: "uid1", id: "01ARYZ6S41TSV4RRFFQ69G5FAV", msg: sp}
+		var tl tally
+		w.recordRejection(logger, cfg.Yahoo[0], j, rejected, &tl)
+		sp.Close()
+		if _, errs := tl.counts(); errs != 0 {
+			t.Fatalf("run %d: unexpected errors", run)
+		}
+		if got := tracker.IsQuarantined("test@yahoo.com", "uid1"); got != (run == 2) {
+			t.Errorf("run %d: quarantined = %v", run, got)
+		}
+	}
+
+	eml, err := os.ReadFile(filepath.Join(cfg.QuarantineDir, "01ARYZ6S41TSV4RRFFQ69G5FAV.eml"))
+	if err != nil || string(eml) != raw {
+		t.Errorf("quarantined message = %q (%v)", eml, err)
+	}
+}
+
+func TestSenderMatches(t *testing.T) {
+	patterns := []string{"*@statements.mybank.com", "invoices@shop.example"}
+	tests := []struct {
+		from string
+		want bool
+	}{
+		{"My Bank <No-Reply@Statements.MyBank.com>", true},
+		{"invoices@shop.example", true},
+		{"other@shop.example", false},
+		{"no-reply@mybank.com", false},
+		{"not an address", false},
+	}
+	for _, tt := range tests {
+		if got := senderMatches(patterns, tt.from); got != tt.want {
+			t.Errorf("senderMatches(%q) = %v, want %v", tt.from, got, tt.want)
+		}
+	}
+}
+
+func TestArchivePDF(t *testing.T) {
+	cfg := unreachableConfig(t)
+	cfg.PDFArchive = config.PDFArchiveConfig{Dir: t.TempDir(), Senders: []string{"*@statements.mybank.com"}}
+	tracker, err := state.NewTracker(cfg.StatePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError}))
+	w := New(cfg, tracker, logger)
+
+	fetchedAt := time.Date(2026, 10, 3, 9, 0, 0, 0, time.UTC)
+	for _, from := range []string{"no-reply@statements.mybank.com", "friend@example.com"} {
+		sp := &spool{}
+		sp.Write([]byte("From: " + from + "\r\nSubject: hi\r\n\r\nbody\r\n"))
+		j := job{uid: from, id: strings.Split(from, "@")[0], msg: sp, fetchedAt: fetchedAt}
+		var tl tally
+		w.archivePDF(logger, cfg.Yahoo[0], j, &tl)
+		sp.Close()
+		if _, errs := tl.counts(); errs != 0 {
+			t.Fatalf("%s: unexpected errors", from)
+		}
+	}
+
+	dir := filepath.Join(cfg.PDFArchive.Dir, "test@yahoo.com", "2026-10")
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "no-reply.pdf" {
+		t.Errorf("expected only the matching sender rendered, got %v", entries)
+	}
+}
+
+// fakeSource is a Source over an in-memory mailbox.
+type fakeSource struct {
+	uids    []string
+	deleted []string
+	closed  bool
+}
+
+func (f *fakeSource) ListUIDs() ([]string, error) { return f.uids, nil }
+
+func (f *fakeSource) Fetch(uid string, w io.Writer) (int64, error) {
+	return 0, errors.New("not implemented")
+}
+
+func (f *fakeSource) Delete(uid string) error {
+	f.deleted = append(f.deleted, uid)
+	return nil
+}
+
+func (f *fakeSource) Close() error {
+	f.closed = true
+	return nil
+}
+
+func TestWithSource(t *testing.T) {
+	cfg := unreachableConfig(t)
+	cfg.MailboxConcurrency = 1
+	tracker, err := state.NewTracker(cfg.StatePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tracker.MarkFetched("test@yahoo.com", "uid1"); err != nil {
+		t.Fatal(err)
+	}
+	src := &fakeSource{uids: []string{"uid1"}}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelError}))
+	w := New(cfg, tracker, logger, WithSource(func(yahoo config.YahooMailbox) (Source, error) {
+		return src, nil
+	}))
+
+	if fetched, errs := w.processMailbox(0, cfg.Yahoo[0]); fetched != 0 || errs != 0 {
+		t.Errorf("expected nothing fetched and no errors, got %d fetched, %d errors", fetched, errs)
+	}
+	if len(src.deleted) != 1 || src.deleted[0] != "uid1" {
+		t.Errorf("expected the already-forwarded message to be deleted, got %v", src.deleted)
+	}
+	if !src.closed {
+		t.Error("expected the session to be closed")
+	}
+
+	// Without sizes, max_message_size cannot be enforced, so nothing is
+	// forwarded.
+	cfg.MaxMessageSize = 1024
+	src.uids = []string{"uid2"}
+	if _, errs := w.processMailbox(0, cfg.Yahoo[0]); errs != 1 {
+		t.Errorf("expected a source without sizes to fail with max_message_size, got %d errors", errs)
+	}
+}
+
+func TestConnectRetry(t *testing.T) {
+	cfg := unreachableConfig(t)
+	cfg.POP3Retry = config.RetryConfig{Attempts: 3, Backoff: time.Second}
+	tracker, err := state.NewTracker(cfg.StatePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelError}))
+
+	// Connecting fails twice, then succeeds.
+	opens := 0
+	fail := 2
+	open := func(yahoo config.YahooMailbox) (Source, error) {
+		opens++
+		if opens <= fail {
+			return nil, &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+		}
+		return &fakeSource{}, nil
+	}
+	clk := clock.NewFake(time.Now())
+	w := New(cfg, tracker, logger, WithSource(open), WithClock(clk))
+	if _, errs := w.processMailbox(0, cfg.Yahoo[0]); errs != 0 {
+		t.Errorf("expected the mailbox processed after retrying, got %d errors", errs)
+	}
+	if got := clk.Slept(); len(got) != 2 || got[0] != time.Second || got[1] != 2*time.Second {
+		t.Errorf("expected pauses [1s 2s], got %v", got)
+	}
+
+	// Past the attempts, the mailbox is given up for the run.
+	opens, fail = 0, 5
+	if _, errs := w.processMailbox(0, cfg.Yahoo[0]); errs != 1 || opens != 3 {
+		t.Errorf("expected 3 attempts and an error, got %d attempts and %d errors", opens, errs)
+	}
+
+	// A rejected login is not retried.
+	rejected := 0
+	w = New(cfg, tracker, logger, WithClock(clk), WithSource(func(config.YahooMailbox) (Source, error) {
+		rejected++
+		return nil, errors.New("pop3 PASS: -ERR invalid credentials")
+	}))
+	if _, errs := w.processMailbox(0, cfg.Yahoo[0]); errs != 1 || rejected != 1 {
+		t.Errorf("expected a single attempt and an error, got %d attempts and %d errors", rejected, errs)
+	}
+}
+
+func TestDeletesWithheld(t *testing.T) {
+	cfg := unreachableConfig(t)
+	cfg.Gmail = config.GmailConfig{}
+	cfg.Maildir.Dir = t.TempDir()
+	tracker, err := state.NewTracker(cfg.StatePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mb := &fakeMailbox{msgs: map[string]string{
+		"uid1": "From: a@example.com\r\nSubject: one\r\n\r\nbody\r\n",
+	}}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelError}))
+
+	w := New(cfg, tracker, logger, WithSource(mb.open), WithDeletesWithheld())
+	if fetched, errs := w.processMailbox(0, cfg.Yahoo[0]); fetched != 1 || errs != 0 {
+		t.Fatalf("expected one message forwarded, got %d fetched, %d errors", fetched, errs)
+	}
+	if _, ok := mb.msgs["uid1"]; !ok {
+		t.Error("expected the message to be left on the server")
+	}
+	if !tracker.IsFetched("test@yahoo.com", "uid1") {
+		t.Error("expected the message to be recorded as forwarded")
+	}
+
+	// A run that does not withhold deletions removes it without
+	// forwarding it again.
+	w = New(cfg, tracker, logger, WithSource(mb.open))
+	if fetched, errs := w.processMailbox(0, cfg.Yahoo[0]); fetched != 0 || errs != 0 {
+		t.Fatalf("expected nothing forwarded, got %d fetched, %d errors", fetched, errs)
+	}
+	if len(mb.msgs) != 0 {
+		t.Errorf("expected the message to be deleted, got %v", mb.msgs)
+	}
+}
+
+func TestRedeleteFetched(t *testing.T) {
+	cfg := unreachableConfig(t)
+	cfg.Gmail = config.GmailConfig{}
+	cfg.Maildir.Dir = t.TempDir()
+	tracker, err := state.NewTracker(cfg.StatePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// uid1 was forwarded and deleted by a session that ended before QUIT,
+	// so the server still has it.
+	if err := tracker.MarkFetched("test@yahoo.com", "uid1"); err != nil {
+		t.Fatal(err)
+	}
+	mb := &fakeMailbox{msgs: map[string]string{
+		"uid1": "From: a@example.com\r\nSubject: one\r\n\r\nbody\r\n",
+		"uid2": "From: a@example.com\r\nSubject: two\r\n\r\nbody\r\n",
+	}}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelError}))
+	w := New(cfg, tracker, logger, WithSource(mb.open))
+
+	if fetched, errs := w.processMailbox(0, cfg.Yahoo[0]); fetched != 1 || errs != 0 {
+		t.Fatalf("expected one message forwarded, got %d fetched, %d errors", fetched, errs)
+	}
+	if len(mb.msgs) != 0 {
+		t.Errorf("expected both messages deleted, got %v", mb.msgs)
+	}
+	entries, err := os.ReadDir(filepath.Join(cfg.Maildir.Dir, "test@yahoo.com", "new"))
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("expected only uid2 in the Maildir, got %v (%v)", entries, err)
+	}
+	if got, err := os.ReadFile(filepath.Join(cfg.Maildir.Dir, "test@yahoo.com", "new", entries[0].Name())); err != nil || !strings.Contains(string(got), "Subject: two") {
+		t.Errorf("stored message = %q (%v)", got, err)
+	}
+}
+
+// fakeDestination records the messages delivered to it.
+type fakeDestination struct {
+	mu        sync.Mutex
+	delivered []string
+}
+
+func (f *fakeDestination) Name() string { return "archive" }
+
+func (f *fakeDestination) Deliver(_ context.Context, msg io.ReaderAt, size int64, source, id string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.delivered = append(f.delivered, id)
+	return "stored", nil
+}
+
+func TestForwardFanOut(t *testing.T) {
+	cfg := unreachableConfig(t)
+	tracker, err := state.NewTracker(cfg.StatePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError + 4}))
+	archive := &fakeDestination{}
+	w := New(cfg, tracker, logger, WithDestination(archive, false))
+
+	// Gmail is unreachable, so the message is not fetched, but the archive
+	// has it and is not sent it again on the next attempt.
+	for attempt := 1; attempt <= 2; attempt++ {
+		sp := &spool{}
+		sp.Write([]byte("From: a@example.com\r\nSubject: hi\r\n\r\nbody\r\n"))
+		var tl tally
+		w.forward(logger, cfg.Yahoo[0], job{uid: "uid1", id: "01ARYZ6S41TSV4RRFFQ69G5FAV", msg: sp}, &tl)
+		if fetched, errs := tl.counts(); fetched != 0 || errs != 1 {
+			t.Errorf("attempt %d: expected only the Gmail failure, got %d fetched, %d errors", attempt, fetched, errs)
+		}
+	}
+	if len(archive.delivered) != 1 {
+		t.Errorf("expected one delivery to the archive, got %d", len(archive.delivered))
+	}
+	if !tracker.IsDelivered("test@yahoo.com", "uid1", "archive") || tracker.IsFetched("test@yahoo.com", "uid1") {
+		t.Error("expected uid1 to be delivered to the archive only")
+	}
+}
+
+func TestForwardMaildirOnly(t *testing.T) {
+	cfg := unreachableConfig(t)
+	cfg.Gmail = config.GmailConfig{}
+	cfg.Maildir.Dir = t.TempDir()
+	tracker, err := state.NewTracker(cfg.StatePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError}))
+	w := New(cfg, tracker, logger)
+
+	raw := "From: a@example.com\r\nSubject: hi\r\n\r\nbody\r\n"
+	sp := &spool{}
+	sp.Write([]byte(raw))
+	src := &fakeSource{uids: []string{"uid1"}}
+	sess := &session{src: src, uids: src.uids, has: map[string]bool{"uid1": true}}
+	var tl tally
+	w.forward(logger, cfg.Yahoo[0], job{sess: sess, uid: "uid1", id: "01ARYZ6S41TSV4RRFFQ69G5FAV", msg: sp}, &tl)
+
+	if fetched, errs := tl.counts(); fetched != 1 || errs != 0 {
+		t.Fatalf("expected the message forwarded, got %d fetched, %d errors", fetched, errs)
+	}
+	if !tracker.IsFetched("test@yahoo.com", "uid1") || len(src.deleted) != 1 {
+		t.Error("expected the message to be recorded and deleted")
+	}
+	entries, err := os.ReadDir(filepath.Join(cfg.Maildir.Dir, "test@yahoo.com", "new"))
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("expected one message in the Maildir, got %v (%v)", entries, err)
+	}
+	got, err := os.ReadFile(filepath.Join(cfg.Maildir.Dir, "test@yahoo.com", "new", entries[0].Name()))
+	if err != nil || string(got) != raw {
+		t.Errorf("stored message = %q (%v)", got, err)
+	}
+	if results := w.Check(); len(results) != 1 || results[0].Service != "yahoo" {
+		t.Errorf("expected only the Yahoo mailbox checked, got %+v", results)
+	}
+}
+
+func TestForwardArchivesFirst(t *testing.T) {
+	cfg := unreachableConfig(t)
+	cfg.ArchiveDir = t.TempDir()
+	tracker, err := state.NewTracker(cfg.StatePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError}))
+	w := New(cfg, tracker, logger)
+
+	raw := "From: a@example.com\r\nSubject: hi\r\n\r\nbody\r\n"
+	sp := &spool{}
+	sp.Write([]byte(raw))
+	src := &fakeSource{uids: []string{"uid1"}}
+	sess := &session{src: src, uids: src.uids, has: map[string]bool{"uid1": true}}
+	fetchedAt := time.Now()
+	var tl tally
+	w.forward(logger, cfg.Yahoo[0], job{sess: sess, uid: "uid1", id: "01ARYZ6S41TSV4RRFFQ69G5FAV", msg: sp, fetchedAt: fetchedAt}, &tl)
+
+	// Gmail is unreachable, but the message is on disk.
+	if fetched, errs := tl.counts(); fetched != 0 || errs != 1 {
+		t.Fatalf("expected the delivery to fail, got %d fetched, %d errors", fetched, errs)
+	}
+	got, err := os.ReadFile(filepath.Join(cfg.ArchiveDir, "test@yahoo.com", fetchedAt.Format("2006-01-02"), "uid1.eml"))
+	if err != nil || string(got) != raw {
+		t.Errorf("archived message = %q (%v)", got, err)
+	}
+}
+
+func TestForwardArchiveFailure(t *testing.T) {
+	cfg := unreachableConfig(t)
+	cfg.Gmail = config.GmailConfig{}
+	cfg.Maildir.Dir = t.TempDir()
+	// A file where the archive directory should be makes every write fail.
+	cfg.ArchiveDir = filepath.Join(t.TempDir(), "archive")
+	if err := os.WriteFile(cfg.ArchiveDir, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	tracker, err := state.NewTracker(cfg.StatePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError}))
+	w := New(cfg, tracker, logger)
+
+	sp := &spool{}
+	sp.Write([]byte("Subject: hi\r\n\r\nbody\r\n"))
+	src := &fakeSource{uids: []string{"uid1"}}
+	sess := &session{src: src, uids: src.uids, has: map[string]bool{"uid1": true}}
+	var tl tally
+	w.forward(logger, cfg.Yahoo[0], job{sess: sess, uid: "uid1", id: "01ARYZ6S41TSV4RRFFQ69G5FAV", msg: sp, fetchedAt: time.Now()}, &tl)
+
+	if fetched, errs := tl.counts(); fetched != 0 || errs != 1 {
+		t.Fatalf("expected the archive failure counted, got %d fetched, %d errors", fetched, errs)
+	}
+	if tracker.IsFetched("test@yahoo.com", "uid1") || len(src.deleted) != 0 {
+		t.Error("expected the message left on the server")
+	}
+	if _, err := os.Stat(filepath.Join(cfg.Maildir.Dir, "test@yahoo.com")); !os.IsNotExist(err) {
+		t.Errorf("expected no delivery to be attempted, got %v", err)
+	}
+}
+
+func TestForwardArchiveS3(t *testing.T) {
+	var mu sync.Mutex
+	objects := map[string]string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		objects[r.URL.Path] = string(body)
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	cfg := unreachableConfig(t)
+	cfg.Gmail = config.GmailConfig{}
+	cfg.Maildir.Dir = t.TempDir()
+	cfg.ArchiveS3 = config.S3ArchiveConfig{
+		Endpoint:        srv.URL,
+		Region:          "us-east-1",
+		Bucket:          "mail",
+		PathStyle:       true,
+		AccessKeyID:     "key",
+		SecretAccessKey: "secret",
+		Retry:           config.RetryConfig{Attempts: 1},
+	}
+	tracker, err := state.NewTracker(cfg.StatePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError}))
+	w := New(cfg, tracker, logger)
+
+	raw := "Subject: hi\r\n\r\nbody\r\n"
+	sp := &spool{}
+	sp.Write([]byte(raw))
+	src := &fakeSource{uids: []string{"uid1"}}
+	sess := &session{src: src, uids: src.uids, has: map[string]bool{"uid1": true}}
+	fetchedAt := time.Now()
+	var tl tally
+	w.forward(logger, cfg.Yahoo[0], job{sess: sess, uid: "uid1", id: "01ARYZ6S41TSV4RRFFQ69G5FAV", msg: sp, fetchedAt: fetchedAt}, &tl)
+
+	if fetched, errs := tl.counts(); fetched != 1 || errs != 0 {
+		t.Fatalf("expected the message forwarded, got %d fetched, %d errors", fetched, errs)
+	}
+	if got := objects["/mail/test@yahoo.com/"+fetchedAt.Format("2006-01-02")+"/uid1.eml"]; got != raw {
+		t.Errorf("uploaded objects %q", objects)
+	}
+}
+
+func TestForwardRecordsLatency(t *testing.T) {
+	cfg := unreachableConfig(t)
+	cfg.Gmail = config.GmailConfig{}
+	cfg.Maildir.Dir = t.TempDir()
+	cfg.LatencySLO = time.Minute
+	tracker, err := state.NewTracker(cfg.StatePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError}))
+	w := New(cfg, tracker, logger)
+
+	date := time.Now().Add(-5 * time.Minute).Format(time.RFC1123Z)
+	for i, raw := range []string{
+		"Date: " + date + "\r\nSubject: hi\r\n\r\nbody\r\n",
+		"Subject: no date\r\n\r\nbody\r\n",
+	} {
+		uid := fmt.Sprintf("uid%d", i)
+		sp := &spool{}
+		sp.Write([]byte(raw))
+		src := &fakeSource{uids: []string{uid}}
+		sess := &session{src: src, uids: src.uids, has: map[string]bool{uid: true}}
+		var tl tally
+		w.forward(logger, cfg.Yahoo[0], job{sess: sess, uid: uid, id: "01ARYZ6S41TSV4RRFFQ69G5FAV", msg: sp}, &tl)
+	}
+
+	got := tracker.Latencies("test@yahoo.com", time.Now().Add(-time.Hour))
+	if len(got) != 1 || got[0] < 5*time.Minute || got[0] > 6*time.Minute {
+		t.Errorf("expected one latency of about 5m, got %v", got)
+	}
+}
+
+func TestForwardMbox(t *testing.T) {
+	cfg := unreachableConfig(t)
+	cfg.Gmail = config.GmailConfig{}
+	cfg.Mbox.Dir = t.TempDir()
+	tracker, err := state.NewTracker(cfg.StatePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError}))
+	w := New(cfg, tracker, logger)
+
+	sp := &spool{}
+	sp.Write([]byte("From: a@example.com\r\nSubject: hi\r\n\r\nFrom the start\r\n"))
+	src := &fakeSource{uids: []string{"uid1"}}
+	sess := &session{src: src, uids: src.uids, has: map[string]bool{"uid1": true}}
+	var tl tally
+	w.forward(logger, cfg.Yahoo[0], job{sess: sess, uid: "uid1", id: "01ARYZ6S41TSV4RRFFQ69G5FAV", msg: sp}, &tl)
+
+	if fetched, errs := tl.counts(); fetched != 1 || errs != 0 {
+		t.Fatalf("expected the message forwarded, got %d fetched, %d errors", fetched, errs)
+	}
+	path := filepath.Join(cfg.Mbox.Dir, "test@yahoo.com", time.Now().Format("2006-01")+".mbox")
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(got), "From a@example.com ") || !strings.Contains(string(got), "\n>From the start\n\n") {
+		t.Errorf("unexpected mbox contents %q", got)
+	}
+}
+
+func TestTLSSettings(t *testing.T) {
+	cfg := unreachableConfig(t)
+	cfg.TLS = config.TLSConfig{ServerName: "mail.lab", MinVersion: "1.3", InsecureSkipVerify: true}
+	var logs strings.Builder
+	logger := slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelWarn}))
+
+	w := New(cfg, nil, logger)
+	if c := w.tlsConfig; c.ServerName != "mail.lab" || c.MinVersion != tls.VersionTLS13 || !c.InsecureSkipVerify {
+		t.Errorf("POP3 TLS configuration = %+v", c)
+	}
+	if !strings.Contains(logs.String(), "tls.insecure_skip_verify is set") {
+		t.Errorf("expected a warning about skipping verification, got %q", logs.String())
+	}
+
+	// Unusable settings trust no server, rather than the system roots.
+	cfg.TLS = config.TLSConfig{CAFile: filepath.Join(t.TempDir(), "missing.pem")}
+	w = New(cfg, nil, logger)
+	if c := w.tlsConfig; c.RootCAs == nil || c.InsecureSkipVerify {
+		t.Errorf("expected an empty root pool, got %+v", c)
+	}
+}
+
+func TestRetrieveRefusedMessage(t *testing.T) {
+	// A POP3 server refusing to retrieve uid2, which stays on it.
+	msgs := []string{"uid1", "uid2", "uid3"}
+	var mu sync.Mutex
+	deleted := map[int]bool{}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				fmt.Fprintf(conn, "+OK ready\r\n")
+				marked := map[int]bool{}
+				r := bufio.NewScanner(conn)
+				for r.Scan() {
+					line := r.Text()
+					num, _ := strconv.Atoi(strings.TrimPrefix(line, "DELE "))
+					switch {
+					case line == "UIDL":
+						fmt.Fprintf(conn, "+OK\r\n")
+						for i, uid := range msgs {
+							fmt.Fprintf(conn, "%d %s\r\n", i+1, uid)
+						}
+						fmt.Fprintf(conn, ".\r\n")
+					case line == "RETR 2":
+						fmt.Fprintf(conn, "-ERR message locked\r\n")
+					case strings.HasPrefix(line, "RETR "):
+						fmt.Fprintf(conn, "+OK\r\nFrom: a@example.com\r\nSubject: %s\r\n\r\nbody\r\n.\r\n", line)
+					case strings.HasPrefix(line, "DELE "):
+						marked[num] = true
+						fmt.Fprintf(conn, "+OK\r\n")
+					case line == "QUIT":
+						mu.Lock()
+						for num := range marked {
+							deleted[num] = true
+						}
+						mu.Unlock()
+						fmt.Fprintf(conn, "+OK bye\r\n")
+						return
+					case line == "CAPA":
+						fmt.Fprintf(conn, "-ERR\r\n")
+					default:
+						fmt.Fprintf(conn, "+OK\r\n")
+					}
+				}
+			}()
+		}
+	}()
+
+	cfg := unreachableConfig(t)
+	cfg.Gmail = config.GmailConfig{}
+	cfg.Maildir.Dir = t.TempDir()
+	cfg.Yahoo[0].POP3Port = ln.Addr().(*net.TCPAddr).Port
+	cfg.Yahoo[0].POP3TLSMode = "none"
+	tracker, err := state.NewTracker(cfg.StatePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelError}))
+
+	// The refusal leaves the session in step, so uid3 is still forwarded.
+	w := New(cfg, tracker, logger)
+	if fetched, errs := w.processMailbox(0, cfg.Yahoo[0]); fetched != 2 || errs != 1 {
+		t.Fatalf("expected two messages forwarded and one error, got %d fetched, %d errors", fetched, errs)
+	}
+	if !tracker.IsFetched("test@yahoo.com", "uid3") || tracker.IsFetched("test@yahoo.com", "uid2") {
+		t.Error("expected uid1 and uid3 forwarded, and uid2 left")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !deleted[1] || deleted[2] || !deleted[3] {
+		t.Errorf("expected uid1 and uid3 deleted, got %v", deleted)
+	}
+}